@@ -21,6 +21,7 @@
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -53,6 +54,7 @@
 	bootstrapDNS   = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns")
 	unpublishedDNS = flag.String("unpublished-bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns and not publish in the list")
 	verifyClients  = flag.Bool("verify-clients", false, "verify clients to this DERP server through a local tailscaled instance.")
+	regionIDs      = flag.String("region-ids", "", "optional comma-separated list of the DERP map region IDs this server serves, so that clients can reach all of them over one connection")
 
 	acceptConnLimit = flag.Float64("accept-connection-limit", math.Inf(+1), "rate limit for accepting new connection")
 	acceptConnBurst = flag.Int("accept-connection-burst", math.MaxInt, "burst limit for accepting new connection")
@@ -152,6 +154,17 @@ func main() {
 
 	s := derp.NewServer(cfg.PrivateKey, log.Printf)
 	s.SetVerifyClient(*verifyClients)
+	if *regionIDs != "" {
+		var ids []int
+		for _, f := range strings.Split(*regionIDs, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(f))
+			if err != nil {
+				log.Fatalf("invalid -region-ids: %v", err)
+			}
+			ids = append(ids, id)
+		}
+		s.SetRegionIDs(ids)
+	}
 
 	if *meshPSKFile != "" {
 		b, err := os.ReadFile(*meshPSKFile)
@@ -140,6 +140,9 @@ func printReport(dm *tailcfg.DERPMap, report *netcheck.Report) error {
 	printf("\t* PortMapping: %v\n", portMapping(report))
 	if report.CaptivePortal != "" {
 		printf("\t* CaptivePortal: %v\n", report.CaptivePortal)
+		if report.CaptivePortalURL != "" {
+			printf("\t* CaptivePortalURL: %v (HTTP %d)\n", report.CaptivePortalURL, report.CaptivePortalStatus)
+		}
 	}
 
 	// When DERP latency checking failed,
@@ -34,6 +34,8 @@ type Client struct {
 	canAckPings bool
 	isProber    bool
 
+	canCoalesceRegions bool
+
 	wmu  sync.Mutex // hold while writing to bw
 	bw   *bufio.Writer
 	rate *rate.Limiter // if non-nil, rate limiter to use
@@ -60,6 +62,8 @@ type clientOpt struct {
 	ServerPub   key.NodePublic
 	CanAckPings bool
 	IsProber    bool
+
+	CanCoalesceRegions bool
 }
 
 // MeshKey returns a ClientOpt to pass to the DERP server during connect to get
@@ -84,6 +88,13 @@ func CanAckPings(v bool) ClientOpt {
 	return clientOptFunc(func(o *clientOpt) { o.CanAckPings = v })
 }
 
+// CanCoalesceRegions returns a ClientOpt to set whether it advertises to
+// the server that it can send packets to peers in any of the regions the
+// server serves over one connection. See ServerInfoMessage.Regions.
+func CanCoalesceRegions(v bool) ClientOpt {
+	return clientOptFunc(func(o *clientOpt) { o.CanCoalesceRegions = v })
+}
+
 func NewClient(privateKey key.NodePrivate, nc Conn, brw *bufio.ReadWriter, logf logger.Logf, opts ...ClientOpt) (*Client, error) {
 	var opt clientOpt
 	for _, o := range opts {
@@ -107,6 +118,8 @@ func newClient(privateKey key.NodePrivate, nc Conn, brw *bufio.ReadWriter, logf
 		canAckPings: opt.CanAckPings,
 		isProber:    opt.IsProber,
 		clock:       tstime.StdClock{},
+
+		canCoalesceRegions: opt.CanCoalesceRegions,
 	}
 	if opt.ServerPub.IsZero() {
 		if err := c.recvServerKey(); err != nil {
@@ -175,6 +188,11 @@ type clientInfo struct {
 
 	// IsProber is whether this client is a prober.
 	IsProber bool `json:",omitempty"`
+
+	// CanCoalesceRegions is whether the client can send packets to peers
+	// homed in any of the regions the server serves over this one
+	// connection. If so, the server lists them in its serverInfo.
+	CanCoalesceRegions bool `json:",omitempty"`
 }
 
 func (c *Client) sendClientKey() error {
@@ -183,6 +201,8 @@ func (c *Client) sendClientKey() error {
 		MeshKey:     c.meshKey,
 		CanAckPings: c.canAckPings,
 		IsProber:    c.isProber,
+
+		CanCoalesceRegions: c.canCoalesceRegions,
 	})
 	if err != nil {
 		return err
@@ -216,22 +236,68 @@ func (c *Client) send(dstKey key.NodePublic, pkt []byte) (ret error) {
 
 	c.wmu.Lock()
 	defer c.wmu.Unlock()
+	wrote, err := c.writeSendPacketLocked(dstKey, pkt)
+	if err != nil || !wrote {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+// SendBatch sends each of pkts to dstKey, in order, as separate packets.
+// It's like calling Send for each packet, but flushes the connection only
+// once, after the last one.
+//
+// Packets over the server's send rate limit are dropped individually, as
+// with Send. If any packet is too big, none are sent.
+func (c *Client) SendBatch(dstKey key.NodePublic, pkts [][]byte) (ret error) {
+	defer func() {
+		if ret != nil {
+			ret = fmt.Errorf("derp.SendBatch: %w", ret)
+		}
+	}()
+
+	for _, pkt := range pkts {
+		if len(pkt) > MaxPacketSize {
+			return fmt.Errorf("packet too big: %d", len(pkt))
+		}
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var wroteAny bool
+	for _, pkt := range pkts {
+		wrote, err := c.writeSendPacketLocked(dstKey, pkt)
+		if err != nil {
+			return err
+		}
+		wroteAny = wroteAny || wrote
+	}
+	if !wroteAny {
+		return nil
+	}
+	return c.bw.Flush()
+}
+
+// writeSendPacketLocked writes a frameSendPacket of pkt to dstKey to c.bw,
+// without flushing it. It reports whether the packet was written, rather
+// than dropped by the send rate limiter. c.wmu must be held.
+func (c *Client) writeSendPacketLocked(dstKey key.NodePublic, pkt []byte) (wrote bool, err error) {
 	if c.rate != nil {
 		pktLen := frameHeaderLen + key.NodePublicRawLen + len(pkt)
 		if !c.rate.AllowN(c.clock.Now(), pktLen) {
-			return nil // drop
+			return false, nil // drop
 		}
 	}
 	if err := writeFrameHeader(c.bw, frameSendPacket, uint32(key.NodePublicRawLen+len(pkt))); err != nil {
-		return err
+		return false, err
 	}
 	if _, err := c.bw.Write(dstKey.AppendTo(nil)); err != nil {
-		return err
+		return false, err
 	}
 	if _, err := c.bw.Write(pkt); err != nil {
-		return err
+		return false, err
 	}
-	return c.bw.Flush()
+	return true, nil
 }
 
 func (c *Client) ForwardPacket(srcKey, dstKey key.NodePublic, pkt []byte) (err error) {
@@ -383,6 +449,11 @@ type ServerInfoMessage struct {
 	// Zero means unspecified. There might be a limit, but the
 	// client need not try to respect it.
 	TokenBucketBytesBurst int
+
+	// Regions are the IDs of the DERP regions the server serves, if
+	// more than one and the client set CanCoalesceRegions. Packets to
+	// peers homed in any of them may be sent over this connection.
+	Regions []int
 }
 
 func (ServerInfoMessage) msg() {}
@@ -531,6 +602,7 @@ func (c *Client) recvTimeout(timeout time.Duration) (m ReceivedMessage, err erro
 			sm := ServerInfoMessage{
 				TokenBucketBytesPerSecond: si.TokenBucketBytesPerSecond,
 				TokenBucketBytesBurst:     si.TokenBucketBytesBurst,
+				Regions:                   si.Regions,
 			}
 			c.setSendRateLimiter(sm)
 			return sm, nil
@@ -152,6 +152,10 @@ type Server struct {
 	// known peer in the network, as specified by a running tailscaled's client's LocalAPI.
 	verifyClients bool
 
+	// regionIDs are the DERP regions this server serves, announced to
+	// clients that can coalesce regions. See SetRegionIDs.
+	regionIDs []int
+
 	mu       sync.Mutex
 	closed   bool
 	netConns map[Conn]chan struct{} // chan is closed when conn closes
@@ -362,6 +366,18 @@ func (s *Server) SetVerifyClient(v bool) {
 	s.verifyClients = v
 }
 
+// SetRegionIDs sets the IDs of the DERP map regions this server serves,
+// such as when several regions point at one frontend. Clients that can
+// coalesce regions then send packets to peers homed in any of them over
+// their one connection to this server, rather than dialing each region.
+// Every region listed must reach the same set of peers as this server:
+// that is, be this server or meshed with it.
+//
+// It must be called before serving begins.
+func (s *Server) SetRegionIDs(ids []int) {
+	s.regionIDs = append([]int(nil), ids...)
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
 func (s *Server) HasMeshKey() bool { return s.meshKey != "" }
 
@@ -733,7 +749,7 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 	s.registerClient(c)
 	defer s.unregisterClient(c)
 
-	err = s.sendServerInfo(c.bw, clientKey)
+	err = s.sendServerInfo(c.bw, clientKey, &c.info)
 	if err != nil {
 		return fmt.Errorf("send server info: %v", err)
 	}
@@ -1200,10 +1216,18 @@ type serverInfo struct {
 
 	TokenBucketBytesPerSecond int `json:",omitempty"`
 	TokenBucketBytesBurst     int `json:",omitempty"`
+
+	// Regions are the IDs of the DERP regions the server serves, sent
+	// only to clients that declared CanCoalesceRegions.
+	Regions []int `json:",omitempty"`
 }
 
-func (s *Server) sendServerInfo(bw *lazyBufioWriter, clientKey key.NodePublic) error {
-	msg, err := json.Marshal(serverInfo{Version: ProtocolVersion})
+func (s *Server) sendServerInfo(bw *lazyBufioWriter, clientKey key.NodePublic, ci *clientInfo) error {
+	si := serverInfo{Version: ProtocolVersion}
+	if ci.CanCoalesceRegions && len(s.regionIDs) > 1 {
+		si.Regions = s.regionIDs
+	}
+	msg, err := json.Marshal(si)
 	if err != nil {
 		return err
 	}
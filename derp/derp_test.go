@@ -1486,6 +1486,38 @@ func TestClientSendRateLimiting(t *testing.T) {
 	}
 }
 
+func TestClientSendBatch(t *testing.T) {
+	cw := new(countWriter)
+	c := &Client{
+		bw:    bufio.NewWriter(cw),
+		clock: &tstest.Clock{},
+	}
+
+	pkts := make([][]byte, 10)
+	for i := range pkts {
+		pkts[i] = make([]byte, 100)
+	}
+	if err := c.SendBatch(key.NodePublic{}, pkts); err != nil {
+		t.Fatal(err)
+	}
+	writes, bytes := cw.Stats()
+	if writes != 1 {
+		t.Errorf("writes = %v; want 1", writes)
+	}
+	if want := int64(len(pkts) * (frameHeaderLen + key.NodePublicRawLen + 100)); bytes != want {
+		t.Errorf("bytes = %v; want %v", bytes, want)
+	}
+
+	cw.ResetStats()
+	pkts = append(pkts, make([]byte, MaxPacketSize+1))
+	if err := c.SendBatch(key.NodePublic{}, pkts); err == nil {
+		t.Error("SendBatch with oversized packet succeeded; want error")
+	}
+	if writes, _ := cw.Stats(); writes != 0 {
+		t.Errorf("writes after failed SendBatch = %v; want 0", writes)
+	}
+}
+
 func TestServerRepliesToPing(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -1515,3 +1547,36 @@ func TestServerRepliesToPing(t *testing.T) {
 		}
 	}
 }
+
+func TestServerInfoRegions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+	ts.s.SetRegionIDs([]int{1, 2})
+
+	for _, coalesce := range []bool{false, true} {
+		var si ServerInfoMessage
+		newTestClient(t, ts, fmt.Sprintf("coalesce-%v", coalesce), func(nc net.Conn, priv key.NodePrivate, logf logger.Logf) (*Client, error) {
+			brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+			c, err := NewClient(priv, nc, brw, logf, CanCoalesceRegions(coalesce))
+			if err != nil {
+				return nil, err
+			}
+			m, err := c.Recv()
+			if err != nil {
+				return nil, err
+			}
+			si, _ = m.(ServerInfoMessage)
+			return c, nil
+		})
+		var want []int
+		if coalesce {
+			want = []int{1, 2}
+		}
+		if !reflect.DeepEqual(si.Regions, want) {
+			t.Errorf("CanCoalesceRegions(%v): Regions = %v; want %v", coalesce, si.Regions, want)
+		}
+	}
+}
@@ -74,14 +74,25 @@ type Client struct {
 	// In either case, additional timeouts may be added to the base context.
 	BaseContext func() context.Context
 
+	// ConnectTimeout optionally limits the time to do all of DNS, TCP,
+	// TLS, HTTP upgrade and DERP upgrade when connecting. Zero means 10
+	// seconds.
+	ConnectTimeout time.Duration
+	// DialTimeout optionally limits the time to make a TCP connection to
+	// each DERP node. Zero means 1.5 seconds.
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout optionally limits the time to do the TLS
+	// handshake. Zero means it's only limited by ConnectTimeout.
+	TLSHandshakeTimeout time.Duration
+
 	privateKey key.NodePrivate
 	logf       logger.Logf
 	netMon     *netmon.Monitor // optional; nil means interfaces will be looked up on-demand
 	dialer     func(ctx context.Context, network, addr string) (net.Conn, error)
 
 	// regionDialer allows the caller to override the dialer used to
-	// connect to DERP regions. If nil, the default dialer is used.
-	regionDialer func(ctx context.Context, r *tailcfg.DERPRegion) net.Conn
+	// connect to DERP nodes. If nil, the default dialer is used.
+	regionDialer func(ctx context.Context, r *tailcfg.DERPRegion, n *tailcfg.DERPNode) net.Conn
 
 	// Either url or getRegion is non-nil:
 	url       *url.URL
@@ -107,6 +118,8 @@ type Client struct {
 	tlsState     *tls.ConnectionState
 	pingOut      map[derp.PingMessage]chan<- bool // chan to send to on pong
 	clock        tstime.Clock
+
+	canCoalesceRegions bool // see SetCanCoalesceRegions; guarded by mu
 }
 
 func (c *Client) String() string {
@@ -340,7 +353,7 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	// timeout is the fallback maximum time (if ctx doesn't limit
 	// it further) to do all of: DNS + TCP + TLS + HTTP Upgrade +
 	// DERP upgrade.
-	const timeout = 10 * time.Second
+	timeout := cmpx.Or(c.ConnectTimeout, 10*time.Second)
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	go func() {
 		select {
@@ -379,12 +392,13 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	}()
 
 	if c.regionDialer != nil {
-		conn := c.regionDialer(ctx, reg)
+		conn := c.dialRegionCustom(ctx, reg)
 		if conn != nil {
 			brw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 			derpClient, err := derp.NewClient(c.privateKey, conn, brw, c.logf,
 				derp.MeshKey(c.MeshKey),
 				derp.CanAckPings(c.canAckPings),
+				derp.CanCoalesceRegions(c.canCoalesceRegions),
 				derp.IsProber(c.IsProber),
 			)
 			if err != nil {
@@ -439,6 +453,7 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 		derpClient, err := derp.NewClient(c.privateKey, conn, brw, c.logf,
 			derp.MeshKey(c.MeshKey),
 			derp.CanAckPings(c.canAckPings),
+			derp.CanCoalesceRegions(c.canCoalesceRegions),
 			derp.IsProber(c.IsProber),
 		)
 		if err != nil {
@@ -501,7 +516,13 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 		// Force a handshake now (instead of waiting for it to
 		// be done implicitly on read/write) so we can check
 		// the ConnectionState.
-		if err := tlsConn.Handshake(); err != nil {
+		hctx := ctx
+		if c.TLSHandshakeTimeout > 0 {
+			var cancel context.CancelFunc
+			hctx, cancel = context.WithTimeout(ctx, c.TLSHandshakeTimeout)
+			defer cancel()
+		}
+		if err := tlsConn.HandshakeContext(hctx); err != nil {
 			return nil, 0, err
 		}
 
@@ -598,6 +619,7 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 		derp.MeshKey(c.MeshKey),
 		derp.ServerPublicKey(serverPub),
 		derp.CanAckPings(c.canAckPings),
+		derp.CanCoalesceRegions(c.canCoalesceRegions),
 		derp.IsProber(c.IsProber),
 	)
 	if err != nil {
@@ -629,12 +651,34 @@ func (c *Client) SetURLDialer(dialer func(ctx context.Context, network, addr str
 }
 
 // SetRegionDialer sets the dialer to use for dialing DERP regions.
-func (c *Client) SetRegionDialer(dialer func(ctx context.Context, region *tailcfg.DERPRegion) net.Conn) {
+//
+// It's called with each non-STUN-only node of the region in turn, until it
+// returns a connection to one that speaks the DERP protocol; if it returns
+// nil for all of them, the default dialer is used. For clients made with
+// NewClient, the region and node are nil.
+func (c *Client) SetRegionDialer(dialer func(ctx context.Context, region *tailcfg.DERPRegion, node *tailcfg.DERPNode) net.Conn) {
 	c.mu.Lock()
 	c.regionDialer = dialer
 	c.mu.Unlock()
 }
 
+// dialRegionCustom returns a connection to a node of reg made by
+// c.regionDialer, or nil if it made none. reg is nil if dialing c.url.
+func (c *Client) dialRegionCustom(ctx context.Context, reg *tailcfg.DERPRegion) net.Conn {
+	if reg == nil {
+		return c.regionDialer(ctx, nil, nil)
+	}
+	for _, n := range reg.Nodes {
+		if n.STUNOnly {
+			continue
+		}
+		if conn := c.regionDialer(ctx, reg, n); conn != nil {
+			return conn
+		}
+	}
+	return nil
+}
+
 // SetForcedWebsocketCallback is a callback that is called when the client
 // decides to force WebSockets on the next connection attempt.
 func (c *Client) SetForcedWebsocketCallback(callback func(region int, reason string)) {
@@ -773,12 +817,12 @@ func shouldDialProto(s string, pred func(netip.Addr) bool) bool {
 
 const dialNodeTimeout = 1500 * time.Millisecond
 
-// dialNode returns a TCP connection to node n, racing IPv4 and IPv6
-// (both as applicable) against each other.
-// A node is only given dialNodeTimeout to connect.
-//
-// TODO(bradfitz): longer if no options remain perhaps? ...  Or longer
-// overall but have dialRegion start overlapping races?
+// dialNode returns a TCP connection to node n, racing its IPv4 address,
+// IPv6 address and hostname (as applicable) against each other with
+// happy eyeballs (RFC 8305): each attempt starts once the previous one
+// failed or happyEyeballsDelay passed, and gets c.DialTimeout (or
+// dialNodeTimeout) of its own to connect, so that a blackholed address
+// family doesn't use up the others' time.
 func (c *Client) dialNode(ctx context.Context, n *tailcfg.DERPNode) (net.Conn, error) {
 	// First see if we need to use an HTTP proxy.
 	proxyReq := &http.Request{
@@ -793,38 +837,31 @@ func (c *Client) dialNode(ctx context.Context, n *tailcfg.DERPNode) (net.Conn, e
 		return c.dialNodeUsingProxy(ctx, n, proxyURL)
 	}
 
+	attempts := c.nodeDialAttempts(n)
+	if len(attempts) == 0 {
+		return nil, errors.New("both IPv4 and IPv6 are explicitly disabled for node")
+	}
+
+	// Canceled on return, to stop the attempts that lost the race.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ctx = sockstats.WithSockStats(ctx, sockstats.LabelDERPHTTPClient, c.logf)
+
 	type res struct {
 		c   net.Conn
 		err error
 	}
 	resc := make(chan res) // must be unbuffered
-	ctx, cancel := context.WithTimeout(ctx, dialNodeTimeout)
-	defer cancel()
-
-	ctx = sockstats.WithSockStats(ctx, sockstats.LabelDERPHTTPClient, c.logf)
-
-	nwait := 0
-	startDial := func(dstPrimary, proto string) {
-		nwait++
+	port := "443"
+	if n.DERPPort != 0 {
+		port = fmt.Sprint(n.DERPPort)
+	}
+	dialTimeout := cmpx.Or(c.DialTimeout, dialNodeTimeout)
+	startDial := func(a nodeDialAttempt) {
 		go func() {
-			if proto == "tcp4" && c.preferIPv6() {
-				t, tChannel := c.clock.NewTimer(200 * time.Millisecond)
-				select {
-				case <-ctx.Done():
-					// Either user canceled original context,
-					// it timed out, or the v6 dial succeeded.
-					t.Stop()
-					return
-				case <-tChannel:
-					// Start v4 dial
-				}
-			}
-			dst := cmpx.Or(dstPrimary, n.HostName)
-			port := "443"
-			if n.DERPPort != 0 {
-				port = fmt.Sprint(n.DERPPort)
-			}
-			c, err := c.dialContext(ctx, proto, net.JoinHostPort(dst, port))
+			dctx, cancel := context.WithTimeout(ctx, dialTimeout)
+			defer cancel()
+			c, err := c.dialContext(dctx, a.network, net.JoinHostPort(a.host, port))
 			select {
 			case resc <- res{c, err}:
 			case <-ctx.Done():
@@ -834,16 +871,31 @@ type res struct {
 			}
 		}()
 	}
-	if shouldDialProto(n.IPv4, netip.Addr.Is4) {
-		startDial(n.IPv4, "tcp4")
-	}
-	if shouldDialProto(n.IPv6, netip.Addr.Is6) {
-		startDial(n.IPv6, "tcp6")
-	}
-	if nwait == 0 {
-		return nil, errors.New("both IPv4 and IPv6 are explicitly disabled for node")
+
+	var (
+		next, nwait int
+		delay       tstime.TimerController
+		delayc      <-chan time.Time // nil once all attempts started
+	)
+	defer func() {
+		if delay != nil {
+			delay.Stop()
+		}
+	}()
+	startNext := func() {
+		startDial(attempts[next])
+		next++
+		nwait++
+		if delay != nil {
+			delay.Stop()
+		}
+		delay, delayc = nil, nil
+		if next < len(attempts) {
+			delay, delayc = c.clock.NewTimer(happyEyeballsDelay)
+		}
 	}
 
+	startNext()
 	var firstErr error
 	for {
 		select {
@@ -855,15 +907,73 @@ type res struct {
 			if firstErr == nil {
 				firstErr = res.err
 			}
-			if nwait == 0 {
+			if next < len(attempts) {
+				// No need to wait out the delay once an attempt failed.
+				startNext()
+			} else if nwait == 0 {
 				return nil, firstErr
 			}
+		case <-delayc:
+			startNext()
 		case <-ctx.Done():
 			return nil, ctx.Err()
 		}
 	}
 }
 
+// happyEyeballsDelay is how long dialNode waits for an attempt to connect
+// to a DERP node before starting the next one alongside it, per the
+// "Connection Attempt Delay" of RFC 8305.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// nodeDialAttempt is a way to connect to a DERP node: dialing host over
+// network.
+type nodeDialAttempt struct {
+	network string // "tcp4", "tcp6" or "tcp"
+	host    string // IP address or hostname
+}
+
+// nodeDialAttempts returns the ways to connect to n in the order that
+// dialNode starts them, alternating between IPv4 and IPv6, the preferred
+// one first. A family whose address n doesn't set is dialed by hostname.
+// If n sets any, its hostname is tried last over their families, in case
+// DNS leads to an address that works.
+func (c *Client) nodeDialAttempts(n *tailcfg.DERPNode) []nodeDialAttempt {
+	type family struct {
+		network string
+		addr    string
+		ok      bool
+	}
+	fams := []family{
+		{"tcp4", n.IPv4, shouldDialProto(n.IPv4, netip.Addr.Is4)},
+		{"tcp6", n.IPv6, shouldDialProto(n.IPv6, netip.Addr.Is6)},
+	}
+	if c.preferIPv6() {
+		fams[0], fams[1] = fams[1], fams[0]
+	}
+	var attempts []nodeDialAttempt
+	var byHostname []string // networks of the families with explicit addresses
+	for _, f := range fams {
+		if !f.ok {
+			continue
+		}
+		attempts = append(attempts, nodeDialAttempt{f.network, cmpx.Or(f.addr, n.HostName)})
+		if f.addr != "" {
+			byHostname = append(byHostname, f.network)
+		}
+	}
+	if n.HostName == "" {
+		return attempts
+	}
+	switch len(byHostname) {
+	case 1:
+		attempts = append(attempts, nodeDialAttempt{byHostname[0], n.HostName})
+	case 2:
+		attempts = append(attempts, nodeDialAttempt{"tcp", n.HostName})
+	}
+	return attempts
+}
+
 func firstStr(a, b string) string {
 	if a != "" {
 		return a
@@ -946,6 +1056,19 @@ func (c *Client) Send(dstKey key.NodePublic, b []byte) error {
 	return err
 }
 
+// SendBatch sends each of pkts to dstKey as separate packets, flushing
+// the connection once. See derp.Client.SendBatch.
+func (c *Client) SendBatch(dstKey key.NodePublic, pkts [][]byte) error {
+	client, _, err := c.connect(c.newContext(), "derphttp.Client.SendBatch")
+	if err != nil {
+		return err
+	}
+	if err := client.SendBatch(dstKey, pkts); err != nil {
+		c.closeForReconnect(client)
+	}
+	return err
+}
+
 func (c *Client) registerPing(m derp.PingMessage, ch chan<- bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -1078,6 +1201,17 @@ func (c *Client) SetCanAckPings(v bool) {
 	c.canAckPings = v
 }
 
+// SetCanCoalesceRegions sets whether this client tells the server it can
+// send packets to peers in any of the regions the server serves over its
+// one connection. See derp.ServerInfoMessage.Regions.
+//
+// This only affects future connections.
+func (c *Client) SetCanCoalesceRegions(v bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.canCoalesceRegions = v
+}
+
 // NotePreferred notes whether this Client is the caller's preferred
 // (home) DERP node. It's only used for stats.
 func (c *Client) NotePreferred(v bool) {
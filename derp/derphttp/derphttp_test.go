@@ -11,6 +11,7 @@
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -18,6 +19,7 @@
 	"nhooyr.io/websocket"
 	"tailscale.com/derp"
 	"tailscale.com/net/wsconn"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 )
 
@@ -325,3 +327,162 @@ func TestForceWebsockets(t *testing.T) {
 
 	c.Close()
 }
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	// A server that accepts connections but never speaks TLS, like a
+	// stalled proxy.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	c, err := NewClient(key.NewNode(), "https://"+ln.Addr().String()+"/derp", t.Logf)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+	c.TLSHandshakeTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	if err := c.Connect(context.Background()); err == nil {
+		t.Fatal("Connect succeeded; want TLS handshake timeout")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Connect took %v; want it to give up after the TLS handshake timeout", d)
+	}
+}
+
+func TestNodeDialAttempts(t *testing.T) {
+	tests := []struct {
+		name       string
+		node       *tailcfg.DERPNode
+		preferIPv6 bool
+		want       []nodeDialAttempt
+	}{
+		{
+			name: "hostname",
+			node: &tailcfg.DERPNode{HostName: "derp.example.com"},
+			want: []nodeDialAttempt{{"tcp4", "derp.example.com"}, {"tcp6", "derp.example.com"}},
+		},
+		{
+			name:       "hostname-prefer-ipv6",
+			node:       &tailcfg.DERPNode{HostName: "derp.example.com"},
+			preferIPv6: true,
+			want:       []nodeDialAttempt{{"tcp6", "derp.example.com"}, {"tcp4", "derp.example.com"}},
+		},
+		{
+			name: "addrs",
+			node: &tailcfg.DERPNode{HostName: "derp.example.com", IPv4: "192.0.2.1", IPv6: "2001:db8::1"},
+			want: []nodeDialAttempt{{"tcp4", "192.0.2.1"}, {"tcp6", "2001:db8::1"}, {"tcp", "derp.example.com"}},
+		},
+		{
+			name: "ipv4-addr",
+			node: &tailcfg.DERPNode{HostName: "derp.example.com", IPv4: "192.0.2.1"},
+			want: []nodeDialAttempt{{"tcp4", "192.0.2.1"}, {"tcp6", "derp.example.com"}, {"tcp4", "derp.example.com"}},
+		},
+		{
+			name: "ipv6-disabled",
+			node: &tailcfg.DERPNode{HostName: "derp.example.com", IPv4: "192.0.2.1", IPv6: "none"},
+			want: []nodeDialAttempt{{"tcp4", "192.0.2.1"}, {"tcp4", "derp.example.com"}},
+		},
+		{
+			name: "no-hostname",
+			node: &tailcfg.DERPNode{IPv4: "192.0.2.1", IPv6: "none"},
+			want: []nodeDialAttempt{{"tcp4", "192.0.2.1"}},
+		},
+		{
+			name: "all-disabled",
+			node: &tailcfg.DERPNode{HostName: "derp.example.com", IPv4: "none", IPv6: "none"},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewNetcheckClient(t.Logf)
+			c.SetAddressFamilySelector(testAddrFamSel(tt.preferIPv6))
+			if got := c.nodeDialAttempts(tt.node); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("nodeDialAttempts = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type testAddrFamSel bool
+
+func (s testAddrFamSel) PreferIPv6() bool { return bool(s) }
+
+func TestDialNodeHappyEyeballs(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// The IPv4 address is unreachable, or blackholed, but the hostname
+	// gets through.
+	c := NewNetcheckClient(t.Logf)
+	c.DialTimeout = 10 * time.Second
+	n := &tailcfg.DERPNode{
+		HostName: "localhost",
+		IPv4:     "192.0.2.1",
+		IPv6:     "none",
+		DERPPort: ln.Addr().(*net.TCPAddr).Port,
+	}
+	start := time.Now()
+	conn, err := c.dialNode(context.Background(), n)
+	if err != nil {
+		t.Fatalf("dialNode: %v", err)
+	}
+	conn.Close()
+	if d := time.Since(start); d >= c.DialTimeout {
+		t.Errorf("dialNode took %v; want the hostname dialed before the IPv4 address timed out", d)
+	}
+}
+
+func TestRegionDialerNodes(t *testing.T) {
+	reg := &tailcfg.DERPRegion{
+		RegionID: 1,
+		Nodes: []*tailcfg.DERPNode{
+			{Name: "1a", RegionID: 1, STUNOnly: true},
+			{Name: "1b", RegionID: 1},
+			{Name: "1c", RegionID: 1},
+		},
+	}
+	c := NewNetcheckClient(t.Logf)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	var dialed []string
+	c.SetRegionDialer(func(ctx context.Context, r *tailcfg.DERPRegion, n *tailcfg.DERPNode) net.Conn {
+		dialed = append(dialed, n.Name)
+		if n.Name == "1c" {
+			return c1
+		}
+		return nil
+	})
+	if got := c.dialRegionCustom(context.Background(), reg); got != c1 {
+		t.Errorf("dialRegionCustom = %v; want the conn to 1c", got)
+	}
+	if want := []string{"1b", "1c"}; !reflect.DeepEqual(dialed, want) {
+		t.Errorf("dialed %q; want %q", dialed, want)
+	}
+}
@@ -25,6 +25,7 @@
 	"fmt"
 	"net"
 	"net/netip"
+	"strings"
 
 	"go4.org/mem"
 	"tailscale.com/types/key"
@@ -44,12 +45,56 @@
 	TypePing        = MessageType(0x01)
 	TypePong        = MessageType(0x02)
 	TypeCallMeMaybe = MessageType(0x03)
+	TypePortPredict = MessageType(0x04)
 )
 
 const v0 = byte(0)
 
 var errShort = errors.New("short message")
 
+// ErrUnknownMessageType is returned by Parse for a message of a type it
+// doesn't know, such as one added by a newer version of the protocol.
+var ErrUnknownMessageType = errors.New("unknown message type")
+
+// Capability is a set of optional disco protocol features, advertised in
+// a node's Pings so that its peers only use those features with nodes that
+// handle them, rather than having their messages ignored or misread.
+//
+// A new feature gets the next free bit. Nodes must ignore the bits they
+// don't know.
+type Capability uint32
+
+const (
+	// CapPortPredict means the node handles PortPredict messages.
+	CapPortPredict Capability = 1 << iota
+)
+
+var capabilityNames = []string{
+	"port-predict",
+}
+
+// Has reports whether c includes all of the capabilities in c2.
+func (c Capability) Has(c2 Capability) bool {
+	return c&c2 == c2
+}
+
+func (c Capability) String() string {
+	if c == 0 {
+		return "none"
+	}
+	var names []string
+	for i, name := range capabilityNames {
+		if c&(1<<i) != 0 {
+			names = append(names, name)
+			c &^= 1 << i
+		}
+	}
+	if c != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(c)))
+	}
+	return strings.Join(names, "|")
+}
+
 // LooksLikeDiscoWrapper reports whether p looks like it's a packet
 // containing an encrypted disco message.
 func LooksLikeDiscoWrapper(p []byte) bool {
@@ -83,8 +128,10 @@ func Parse(p []byte) (Message, error) {
 		return parsePong(ver, p)
 	case TypeCallMeMaybe:
 		return parseCallMeMaybe(ver, p)
+	case TypePortPredict:
+		return parsePortPredict(ver, p)
 	default:
-		return nil, fmt.Errorf("unknown message type 0x%02x", byte(t))
+		return nil, fmt.Errorf("%w 0x%02x", ErrUnknownMessageType, byte(t))
 	}
 }
 
@@ -117,19 +164,50 @@ type Ping struct {
 	// netmap data to reduce the discokey:nodekey relation from 1:N to
 	// 1:1.
 	NodeKey key.NodePublic
+
+	// Migrating is whether the sender just moved to a new local socket
+	// (such as after a network change) and is pinging from its new
+	// address, which the recipient should switch to as soon as it
+	// confirms it. Old clients don't send or understand this field.
+	Migrating bool
+
+	// Caps are the optional protocol features the sender handles. Old
+	// clients don't send this field, which then parses as zero.
+	Caps Capability
 }
 
+// pingFlagMigrating is the bit of a Ping's flags byte, which follows its
+// NodeKey, set if it's Migrating.
+const pingFlagMigrating = 1 << 0
+
+// pingCapsLen is the length of a Ping's Caps, a big-endian uint32 that
+// follows its flags byte.
+const pingCapsLen = 4
+
 func (m *Ping) AppendMarshal(b []byte) []byte {
 	dataLen := 12
 	hasKey := !m.NodeKey.IsZero()
-	if hasKey {
+	hasFlags := m.Migrating || m.Caps != 0
+	if hasKey || hasFlags {
 		dataLen += key.NodePublicRawLen
 	}
+	if hasFlags {
+		dataLen++
+	}
+	if m.Caps != 0 {
+		dataLen += pingCapsLen
+	}
 	ret, d := appendMsgHeader(b, TypePing, v0, dataLen)
 	n := copy(d, m.TxID[:])
 	if hasKey {
 		m.NodeKey.AppendTo(d[:n])
 	}
+	if m.Migrating {
+		d[n+key.NodePublicRawLen] = pingFlagMigrating
+	}
+	if m.Caps != 0 {
+		binary.BigEndian.PutUint32(d[n+key.NodePublicRawLen+1:], uint32(m.Caps))
+	}
 	return ret
 }
 
@@ -143,6 +221,14 @@ func parsePing(ver uint8, p []byte) (m *Ping, err error) {
 	// compatibility.
 	if len(p) >= key.NodePublicRawLen {
 		m.NodeKey = key.NodePublicFromRaw32(mem.B(p[:key.NodePublicRawLen]))
+		p = p[key.NodePublicRawLen:]
+	}
+	if len(p) >= 1 {
+		m.Migrating = p[0]&pingFlagMigrating != 0
+		p = p[1:]
+	}
+	if len(p) >= pingCapsLen {
+		m.Caps = Capability(binary.BigEndian.Uint32(p))
 	}
 	return m, nil
 }
@@ -240,15 +326,84 @@ func parsePong(ver uint8, p []byte) (m *Pong, err error) {
 	return m, nil
 }
 
+// PortPredict is a message sent only over DERP by a node behind a NAT
+// with endpoint-dependent mapping (a "hard" NAT) to a peer also behind
+// one, to coordinate guessing the ports their NATs map next, when
+// CallMeMaybe can't open a path.
+//
+// The recipient, if it supports port prediction and is behind a hard NAT
+// itself, replies with its own PortPredict with the same TxID. Then both
+// ping the ports predicted for the other.
+type PortPredict struct {
+	// TxID identifies the exchange.
+	TxID [12]byte
+
+	// Addr is the sender's public IP address and the port its NAT
+	// mapped most recently.
+	Addr netip.AddrPort // 18 bytes (16+2) on the wire; v4-mapped ipv6 for IPv4
+
+	// Step is the difference the sender measured between the ports
+	// its NAT maps for consecutive new flows. Zero means unknown.
+	Step int16
+
+	// Reply is whether this is the reply to a PortPredict.
+	Reply bool
+}
+
+const portPredictLen = 12 + 16 + 2 + 2 + 1
+
+// portPredictFlagReply is the bit of a PortPredict's flags byte set if
+// it's a Reply.
+const portPredictFlagReply = 1 << 0
+
+func (m *PortPredict) AppendMarshal(b []byte) []byte {
+	ret, d := appendMsgHeader(b, TypePortPredict, v0, portPredictLen)
+	d = d[copy(d, m.TxID[:]):]
+	ip16 := m.Addr.Addr().As16()
+	d = d[copy(d, ip16[:]):]
+	binary.BigEndian.PutUint16(d, m.Addr.Port())
+	binary.BigEndian.PutUint16(d[2:], uint16(m.Step))
+	if m.Reply {
+		d[4] = portPredictFlagReply
+	}
+	return ret
+}
+
+func parsePortPredict(ver uint8, p []byte) (m *PortPredict, err error) {
+	if len(p) < portPredictLen {
+		return nil, errShort
+	}
+	m = new(PortPredict)
+	p = p[copy(m.TxID[:], p):]
+	ip := netip.AddrFrom16([16]byte(p[:16])).Unmap()
+	p = p[16:]
+	m.Addr = netip.AddrPortFrom(ip, binary.BigEndian.Uint16(p))
+	m.Step = int16(binary.BigEndian.Uint16(p[2:]))
+	m.Reply = p[4]&portPredictFlagReply != 0
+	return m, nil
+}
+
 // MessageSummary returns a short summary of m for logging purposes.
 func MessageSummary(m Message) string {
 	switch m := m.(type) {
 	case *Ping:
-		return fmt.Sprintf("ping tx=%x", m.TxID[:6])
+		s := fmt.Sprintf("ping tx=%x", m.TxID[:6])
+		if m.Migrating {
+			s += " migrating"
+		}
+		if m.Caps != 0 {
+			s += " caps=" + m.Caps.String()
+		}
+		return s
 	case *Pong:
 		return fmt.Sprintf("pong tx=%x", m.TxID[:6])
 	case *CallMeMaybe:
 		return "call-me-maybe"
+	case *PortPredict:
+		if m.Reply {
+			return fmt.Sprintf("port-predict tx=%x reply", m.TxID[:6])
+		}
+		return fmt.Sprintf("port-predict tx=%x", m.TxID[:6])
 	default:
 		return fmt.Sprintf("%#v", m)
 	}
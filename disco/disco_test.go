@@ -4,6 +4,7 @@
 package disco
 
 import (
+	"errors"
 	"fmt"
 	"net/netip"
 	"reflect"
@@ -35,6 +36,24 @@ func TestMarshalAndParse(t *testing.T) {
 			},
 			want: "01 00 01 02 03 04 05 06 07 08 09 0a 0b 0c 00 01 02 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 1e 1f",
 		},
+		{
+			name: "ping_migrating",
+			m: &Ping{
+				TxID:      [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+				NodeKey:   key.NodePublicFromRaw32(mem.B([]byte{1: 1, 2: 2, 30: 30, 31: 31})),
+				Migrating: true,
+			},
+			want: "01 00 01 02 03 04 05 06 07 08 09 0a 0b 0c 00 01 02 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 1e 1f 01",
+		},
+		{
+			name: "ping_caps",
+			m: &Ping{
+				TxID:    [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+				NodeKey: key.NodePublicFromRaw32(mem.B([]byte{1: 1, 2: 2, 30: 30, 31: 31})),
+				Caps:    CapPortPredict | 1<<31,
+			},
+			want: "01 00 01 02 03 04 05 06 07 08 09 0a 0b 0c 00 01 02 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 1e 1f 00 80 00 00 01",
+		},
 		{
 			name: "pong",
 			m: &Pong{
@@ -66,6 +85,25 @@ func TestMarshalAndParse(t *testing.T) {
 			},
 			want: "03 00 00 00 00 00 00 00 00 00 00 00 ff ff 01 02 03 04 02 37 20 01 00 00 00 00 00 00 00 00 00 00 00 00 34 56 03 15",
 		},
+		{
+			name: "port_predict",
+			m: &PortPredict{
+				TxID: [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+				Addr: mustIPPort("2.3.4.5:1234"),
+				Step: -2,
+			},
+			want: "04 00 01 02 03 04 05 06 07 08 09 0a 0b 0c 00 00 00 00 00 00 00 00 00 00 ff ff 02 03 04 05 04 d2 ff fe 00",
+		},
+		{
+			name: "port_predict_reply",
+			m: &PortPredict{
+				TxID:  [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+				Addr:  mustIPPort("2.3.4.5:1234"),
+				Step:  2,
+				Reply: true,
+			},
+			want: "04 00 01 02 03 04 05 06 07 08 09 0a 0b 0c 00 00 00 00 00 00 00 00 00 00 ff ff 02 03 04 05 04 d2 00 02 01",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -92,6 +130,41 @@ func TestMarshalAndParse(t *testing.T) {
 	}
 }
 
+func TestParseUnknown(t *testing.T) {
+	// A ping from a newer version with fields after Caps.
+	ping := (&Ping{TxID: [12]byte{1}, Caps: CapPortPredict}).AppendMarshal(nil)
+	m, err := Parse(append(ping, 0xff, 0xff))
+	if err != nil {
+		t.Fatalf("Parse of longer ping: %v", err)
+	}
+	if got := m.(*Ping).Caps; got != CapPortPredict {
+		t.Errorf("Caps = %v; want %v", got, CapPortPredict)
+	}
+
+	if _, err := Parse([]byte{0x7f, 0}); !errors.Is(err, ErrUnknownMessageType) {
+		t.Errorf("Parse of unknown type = %v; want ErrUnknownMessageType", err)
+	}
+}
+
+func TestCapabilityString(t *testing.T) {
+	tests := []struct {
+		c    Capability
+		want string
+	}{
+		{0, "none"},
+		{CapPortPredict, "port-predict"},
+		{CapPortPredict | 1<<31, "port-predict|0x80000000"},
+	}
+	for _, tt := range tests {
+		if got := tt.c.String(); got != tt.want {
+			t.Errorf("Capability(%#x).String() = %q; want %q", uint32(tt.c), got, tt.want)
+		}
+	}
+	if c := CapPortPredict | 1<<31; !c.Has(CapPortPredict) || Capability(0).Has(CapPortPredict) {
+		t.Error("Has wrong")
+	}
+}
+
 func mustIPPort(s string) netip.AddrPort {
 	ipp, err := netip.ParseAddrPort(s)
 	if err != nil {
@@ -45,6 +45,8 @@
 	ipnWantRunning          bool
 	anyInterfaceUp          = true // until told otherwise
 	udp4Unbound             bool
+	captivePortal           bool
+	captivePortalURL        string
 	controlHealth           []string
 	lastLoginErr            error
 	localLogConfigErr       error
@@ -383,6 +385,28 @@ func SetUDP4Unbound(unbound bool) {
 	selfCheckLocked()
 }
 
+// SetCaptivePortal sets whether netcheck found a captive portal
+// intercepting HTTP traffic and, if it redirected, the URL it redirected
+// to, where the user typically must log in.
+func SetCaptivePortal(found bool, url string) {
+	mu.Lock()
+	defer mu.Unlock()
+	captivePortal = found
+	captivePortalURL = ""
+	if found {
+		captivePortalURL = url
+	}
+	selfCheckLocked()
+}
+
+// CaptivePortal reports whether a captive portal was found, per
+// SetCaptivePortal, and the URL it redirected to, if any.
+func CaptivePortal() (found bool, url string) {
+	mu.Lock()
+	defer mu.Unlock()
+	return captivePortal, captivePortalURL
+}
+
 // SetAuthRoutineInError records the latest error encountered as a result of a
 // login attempt. Providing a nil error indicates successful login, or that
 // being logged in w/coordination is not currently desired.
@@ -489,6 +513,13 @@ func overallErrorLocked() error {
 	if err := envknob.ApplyDiskConfigError(); err != nil {
 		errs = append(errs, err)
 	}
+	if captivePortal {
+		if captivePortalURL != "" {
+			errs = append(errs, fmt.Errorf("captive portal detected; log in at %s", captivePortalURL))
+		} else {
+			errs = append(errs, errors.New("captive portal detected"))
+		}
+	}
 	for serverName, err := range tlsConnectionErrors {
 		errs = append(errs, fmt.Errorf("TLS connection error for %q: %w", serverName, err))
 	}
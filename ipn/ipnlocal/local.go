@@ -76,6 +76,7 @@
 	"tailscale.com/util/dnsname"
 	"tailscale.com/util/mak"
 	"tailscale.com/util/multierr"
+	"tailscale.com/util/osdiag"
 	"tailscale.com/util/osshare"
 	"tailscale.com/util/set"
 	"tailscale.com/util/systemd"
@@ -4600,10 +4601,23 @@ func (b *LocalBackend) DebugReSTUN() error {
 	if err != nil {
 		return err
 	}
-	mc.ReSTUN("explicit-debug")
+	mc.RefreshEndpoints(magicsock.RefreshFull, "explicit-debug")
 	return nil
 }
 
+// OSDiagNetworkInfo returns the local UDP port of b's engine and the name
+// of its TUN interface, if any, for the OS support info.
+func (b *LocalBackend) OSDiagNetworkInfo() osdiag.NetworkInfo {
+	var ni osdiag.NetworkInfo
+	if mc, err := b.magicConn(); err == nil {
+		ni.UDPPort = mc.LocalPort()
+	}
+	if tunWrap, ok := b.sys.Tun.GetOK(); ok && !b.sys.IsNetstack() {
+		ni.TUNName, _ = tunWrap.Name()
+	}
+	return ni
+}
+
 func (b *LocalBackend) magicConn() (*magicsock.Conn, error) {
 	mc, ok := b.sys.MagicSock.GetOK()
 	if !ok {
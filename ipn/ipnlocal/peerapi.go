@@ -47,6 +47,7 @@
 	"tailscale.com/net/netutil"
 	"tailscale.com/net/sockstats"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/multierr"
 	"tailscale.com/version/distro"
@@ -957,6 +958,32 @@ func (h *peerAPIHandler) handleServeSockStats(w http.ResponseWriter, r *http.Req
 
 	fmt.Fprintln(w, "</table>")
 
+	if peerStats := sockstats.GetPeers(); peerStats != nil && len(peerStats.Stats) > 0 {
+		fmt.Fprintln(w, "<h2>By Peer</h2>")
+		fmt.Fprintln(w, "<table border='1' cellspacing='0' style='border-collapse: collapse;'>")
+		fmt.Fprintln(w, "<thead><th>Label</th><th>Peer</th><th>Tx</th><th>Rx</th></thead>")
+		fmt.Fprintln(w, "<tbody>")
+		for _, label := range labels {
+			byPeer := peerStats.Stats[label]
+			peers := make([]key.NodePublic, 0, len(byPeer))
+			for peer := range byPeer {
+				peers = append(peers, peer)
+			}
+			// Busiest first, as they're what keeps the radio awake.
+			sort.Slice(peers, func(i, j int) bool {
+				si, sj := byPeer[peers[i]], byPeer[peers[j]]
+				return si.TxBytes+si.RxBytes > sj.TxBytes+sj.RxBytes
+			})
+			for _, peer := range peers {
+				stat := byPeer[peer]
+				fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td align=right>%d</td><td align=right>%d</td></tr>\n",
+					html.EscapeString(label.String()), html.EscapeString(peer.ShortString()), stat.TxBytes, stat.RxBytes)
+			}
+		}
+		fmt.Fprintln(w, "</tbody>")
+		fmt.Fprintln(w, "</table>")
+	}
+
 	fmt.Fprintln(w, "<h2>Debug Info</h2>")
 
 	fmt.Fprintln(w, "<pre>")
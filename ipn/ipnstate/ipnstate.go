@@ -216,6 +216,44 @@ type PeerStatus struct {
 	CurAddr string // one of Addrs, or unique if roaming
 	Relay   string // DERP region
 
+	// CurAddrLoss is the percentage of recent disco pings to CurAddr
+	// that got no reply. It's zero if unknown.
+	CurAddrLoss float64 `json:",omitempty"`
+
+	// DERPReason is why traffic to the peer goes via DERP (Relay) rather
+	// than, or as well as, direct UDP: "no-endpoints", "pings-failed",
+	// "endpoints-blocked", "send-errors", "mtu-too-small",
+	// "trust-expired", "pong-loss" or "derp-faster". It's empty if the peer is reached
+	// directly alone, or hasn't been sent anything.
+	DERPReason string `json:",omitempty"`
+
+	// SmoothedRTTSeconds is the smoothed round-trip time of disco pings
+	// to the peer on its current path, and JitterSeconds the variation
+	// of their round-trip times, as RFC 3550's interarrival jitter.
+	// They're zero if unknown.
+	SmoothedRTTSeconds float64 `json:",omitempty"`
+	JitterSeconds      float64 `json:",omitempty"`
+
+	// PathChanges is how many times the path to the peer changed in the
+	// last five minutes.
+	PathChanges int `json:",omitempty"`
+
+	// SharedDiscoKey is whether other peers have the same disco key as
+	// this one, such as after a node moved between accounts. Disco
+	// messages from such peers can't always be attributed to one of them.
+	SharedDiscoKey bool `json:",omitempty"`
+
+	// WireGuardOnlyLatencySeconds is, for a WireGuard-only peer (see
+	// tailcfg.Node.IsWireGuardOnly), the latest round-trip time of the
+	// ICMP pings to each of its endpoints that answered, by endpoint.
+	// Its CurAddr is the endpoint chosen from them.
+	WireGuardOnlyLatencySeconds map[string]float64 `json:",omitempty"`
+
+	// ProbeOnly is whether the peer is only measured, never sent
+	// traffic; see tailcfg.Node.ProbeOnly. Its CurAddr and
+	// SmoothedRTTSeconds are those of the disco probes.
+	ProbeOnly bool `json:",omitempty"`
+
 	RxBytes        int64
 	TxBytes        int64
 	Created        time.Time // time registered with tailcontrol
@@ -409,6 +447,30 @@ func (sb *StatusBuilder) AddPeer(peer key.NodePublic, st *PeerStatus) {
 	if v := st.CurAddr; v != "" {
 		e.CurAddr = v
 	}
+	if v := st.CurAddrLoss; v != 0 {
+		e.CurAddrLoss = v
+	}
+	if v := st.DERPReason; v != "" {
+		e.DERPReason = v
+	}
+	if v := st.SmoothedRTTSeconds; v != 0 {
+		e.SmoothedRTTSeconds = v
+	}
+	if v := st.JitterSeconds; v != 0 {
+		e.JitterSeconds = v
+	}
+	if v := st.PathChanges; v != 0 {
+		e.PathChanges = v
+	}
+	if st.SharedDiscoKey {
+		e.SharedDiscoKey = true
+	}
+	if v := st.WireGuardOnlyLatencySeconds; v != nil {
+		e.WireGuardOnlyLatencySeconds = v
+	}
+	if st.ProbeOnly {
+		e.ProbeOnly = true
+	}
 	if v := st.RxBytes; v != 0 {
 		e.RxBytes = v
 	}
@@ -617,6 +679,12 @@ type PingResult struct {
 	Err            string
 	LatencySeconds float64
 
+	// SmoothedRTTSeconds, JitterSeconds and PathChanges are as in
+	// PeerStatus, as of this ping. They're not set for TSMP pings.
+	SmoothedRTTSeconds float64 `json:",omitempty"`
+	JitterSeconds      float64 `json:",omitempty"`
+	PathChanges        int     `json:",omitempty"`
+
 	// Endpoint is the ip:port if direct UDP was used.
 	// It is not currently set for TSMP pings.
 	Endpoint string
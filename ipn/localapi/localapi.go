@@ -352,6 +352,7 @@ func (h *Handler) serveBugReport(w http.ResponseWriter, r *http.Request) {
 	envknob.LogCurrent(logger.WithPrefix(h.logf, "user bugreport: "))
 
 	// OS-specific details
+	osdiag.SetNetworkInfo(h.b.OSDiagNetworkInfo())
 	osdiag.LogSupportInfo(logger.WithPrefix(h.logf, "user bugreport OS: "), osdiag.LogSupportInfoReasonBugReport)
 
 	if defBool(r.URL.Query().Get("diagnose"), false) {
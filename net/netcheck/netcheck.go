@@ -124,6 +124,19 @@ type Report struct {
 	// intercepting HTTP traffic.
 	CaptivePortal opt.Bool
 
+	// CaptivePortalStatus is the HTTP status code of the response to
+	// the captive portal check, if it found a captive portal.
+	CaptivePortalStatus int
+	// CaptivePortalURL is the absolute URL the captive portal
+	// redirected the check to, if it found one that did. It's
+	// typically where the user must log in.
+	CaptivePortalURL string
+
+	// Partial is whether the probe budget ran out before every region
+	// was probed, so regions missing from RegionLatency may still be
+	// reachable.
+	Partial bool
+
 	// TODO: update Clone when adding new fields
 }
 
@@ -175,10 +188,12 @@ type Client struct {
 
 	// GetSTUNConn4 optionally provides a func to return the
 	// connection to use for sending & receiving IPv4 packets. If
-	// nil, an ephemeral one is created as needed.
+	// nil, an ephemeral one is created as needed. If it returns nil,
+	// IPv4 isn't probed.
 	GetSTUNConn4 func() STUNConn
 
 	// GetSTUNConn6 is like GetSTUNConn4, but for IPv6.
+	// If it returns nil, IPv6 isn't probed.
 	GetSTUNConn6 func() STUNConn
 
 	// SkipExternalNetwork controls whether the client should not try
@@ -207,6 +222,16 @@ type Client struct {
 	// probes.
 	GetDERPHeaders func() http.Header
 
+	// MaxConcurrentProbes optionally limits how many DERP regions are
+	// probed at once, by STUN and then by HTTPS. Zero means no limit.
+	MaxConcurrentProbes int
+
+	// ProbeBudget optionally specifies the longest a report may take.
+	// The STUN probing gets the same share of it as of the default,
+	// overallProbeTimeout. When it runs out, GetReport returns the
+	// regions measured so far in a Report with Partial set.
+	ProbeBudget time.Duration
+
 	// For tests
 	testEnoughRegions      int
 	testCaptivePortalDelay time.Duration
@@ -227,6 +252,41 @@ type STUNConn interface {
 	ReadFromUDPAddrPort([]byte) (int, netip.AddrPort, error)
 }
 
+func (c *Client) probeBudget() time.Duration {
+	if c.ProbeBudget > 0 {
+		return c.ProbeBudget
+	}
+	return overallProbeTimeout
+}
+
+// probeLimiter limits the number of DERP regions probed at once. A nil
+// probeLimiter doesn't.
+type probeLimiter struct {
+	sem syncs.Semaphore
+}
+
+func (c *Client) newProbeLimiter() *probeLimiter {
+	if c.MaxConcurrentProbes <= 0 {
+		return nil
+	}
+	return &probeLimiter{sem: syncs.NewSemaphore(c.MaxConcurrentProbes)}
+}
+
+// acquire reports whether a region may be probed before ctx is done.
+// If so, release must be called when the probe finishes.
+func (l *probeLimiter) acquire(ctx context.Context) bool {
+	if l == nil {
+		return ctx.Err() == nil
+	}
+	return l.sem.AcquireContext(ctx)
+}
+
+func (l *probeLimiter) release() {
+	if l != nil {
+		l.sem.Release()
+	}
+}
+
 func (c *Client) enoughRegions() int {
 	if c.testEnoughRegions > 0 {
 		return c.testEnoughRegions
@@ -823,7 +883,8 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (_ *Report,
 	// Mask user context with ours that we guarantee to cancel so
 	// we can depend on it being closed in goroutines later.
 	// (User ctx might be context.Background, etc)
-	ctx, cancel := context.WithTimeout(ctx, overallProbeTimeout)
+	budget := c.probeBudget()
+	ctx, cancel := context.WithTimeout(ctx, budget)
 	defer cancel()
 
 	ctx = sockstats.WithSockStats(ctx, sockstats.LabelNetcheckClient, c.logf)
@@ -944,6 +1005,11 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (_ *Report,
 
 	if f := c.GetSTUNConn4; f != nil {
 		rs.pc4 = f()
+		if rs.pc4 == nil {
+			// IPv4 is disabled by the caller.
+			ifState = ptr.To(*ifState) // shallow clone
+			ifState.HaveV4 = false
+		}
 	} else {
 		u4, err := nettype.MakePacketListenerWithNetIP(netns.Listener(c.logf, nil)).ListenPacket(ctx, "udp4", c.udpBindAddr())
 		if err != nil {
@@ -998,12 +1064,16 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (_ *Report,
 
 		tmr := time.AfterFunc(c.captivePortalDelay(), func() {
 			defer close(ch)
-			found, err := c.checkCaptivePortal(ctx, dm, preferredDERP)
+			res, err := c.checkCaptivePortal(ctx, dm, preferredDERP)
 			if err != nil {
 				c.logf("[v1] checkCaptivePortal: %v", err)
 				return
 			}
-			rs.report.CaptivePortal.Set(found)
+			rs.report.CaptivePortal.Set(res.found)
+			if res.found {
+				rs.report.CaptivePortalStatus = res.statusCode
+				rs.report.CaptivePortalURL = res.location
+			}
 		})
 
 		captivePortalStop = func() {
@@ -1029,11 +1099,17 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (_ *Report,
 	// this in Coder, so it just adds time to the initial connect.
 	captivePortalStop()
 
+	limiter := c.newProbeLimiter()
 	wg := syncs.NewWaitGroupChan()
 	wg.Add(len(plan))
 	for _, probeSet := range plan {
 		setCtx, cancelSet := context.WithCancel(ctx)
 		go func(probeSet []probe) {
+			if !limiter.acquire(setCtx) {
+				wg.Decr()
+				return
+			}
+			defer limiter.release()
 			pwg := syncs.NewWaitGroupChan()
 			pwg.Add(len(probeSet))
 			for _, p := range probeSet {
@@ -1050,7 +1126,7 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (_ *Report,
 		}(probeSet)
 	}
 
-	stunTimer := time.NewTimer(stunProbeTimeout)
+	stunTimer := time.NewTimer(budget * stunProbeTimeout / overallProbeTimeout)
 	defer stunTimer.Stop()
 
 	select {
@@ -1112,6 +1188,10 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (_ *Report,
 		for _, reg := range need {
 			go func(reg *tailcfg.DERPRegion) {
 				defer wg.Done()
+				if !limiter.acquire(ctx) {
+					return
+				}
+				defer limiter.release()
 				if d, ip, err := c.measureHTTPLatency(ctx, reg); err != nil {
 					c.logf("[v1] netcheck: measuring HTTP(S) latency of %v (%d): %v", reg.RegionCode, reg.RegionID, err)
 				} else {
@@ -1144,6 +1224,12 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (_ *Report,
 	// Wait for captive portal check before finishing the report.
 	<-captivePortalDone
 
+	if ctx.Err() != nil {
+		rs.mu.Lock()
+		rs.report.Partial = true
+		rs.mu.Unlock()
+	}
+
 	return c.finishAndStoreReport(rs, dm), nil
 }
 
@@ -1170,12 +1256,17 @@ func (c *Client) finishAndStoreReport(rs *reportState, dm *tailcfg.DERPMap) *Rep
 	Timeout:   http.DefaultClient.Timeout,
 }
 
+// captivePortalResult is the result of checkCaptivePortal.
+type captivePortalResult struct {
+	found      bool   // whether we think we have a captive portal
+	statusCode int    // of the check's response
+	location   string // absolute redirect URL, if the response had one
+}
+
 // checkCaptivePortal reports whether or not we think the system is behind a
 // captive portal, detected by making a request to a URL that we know should
 // return a "204 No Content" response and checking if that's what we get.
-//
-// The boolean return is whether we think we have a captive portal.
-func (c *Client) checkCaptivePortal(ctx context.Context, dm *tailcfg.DERPMap, preferredDERP int) (bool, error) {
+func (c *Client) checkCaptivePortal(ctx context.Context, dm *tailcfg.DERPMap, preferredDERP int) (res captivePortalResult, err error) {
 	defer noRedirectClient.CloseIdleConnections()
 
 	// If we have a preferred DERP region with more than one node, try
@@ -1190,7 +1281,7 @@ func (c *Client) checkCaptivePortal(ctx context.Context, dm *tailcfg.DERPMap, pr
 			rids = append(rids, id)
 		}
 		if len(rids) == 0 {
-			return false, nil
+			return res, nil
 		}
 		preferredDERP = rids[rand.Intn(len(rids))]
 	}
@@ -1201,12 +1292,12 @@ func (c *Client) checkCaptivePortal(ctx context.Context, dm *tailcfg.DERPMap, pr
 		// Don't try to connect to invalid hostnames. This occurred in tests:
 		// https://github.com/tailscale/tailscale/issues/6207
 		// TODO(bradfitz,andrew-d): how to actually handle this nicely?
-		return false, nil
+		return res, nil
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+node.HostName+"/generate_204", nil)
 	if err != nil {
-		return false, err
+		return res, err
 	}
 
 	// Note: the set of valid characters in a challenge and the total
@@ -1216,7 +1307,7 @@ func (c *Client) checkCaptivePortal(ctx context.Context, dm *tailcfg.DERPMap, pr
 	req.Header.Set("X-Tailscale-Challenge", chal)
 	r, err := noRedirectClient.Do(req)
 	if err != nil {
-		return false, err
+		return res, err
 	}
 	defer r.Body.Close()
 
@@ -1224,7 +1315,12 @@ func (c *Client) checkCaptivePortal(ctx context.Context, dm *tailcfg.DERPMap, pr
 	validResponse := r.Header.Get("X-Tailscale-Response") == expectedResponse
 
 	c.logf("[v2] checkCaptivePortal url=%q status_code=%d valid_response=%v", req.URL.String(), r.StatusCode, validResponse)
-	return r.StatusCode != 204 || !validResponse, nil
+	res.found = r.StatusCode != 204 || !validResponse
+	res.statusCode = r.StatusCode
+	if loc, err := r.Location(); err == nil {
+		res.location = loc.String()
+	}
+	return res, nil
 }
 
 // runHTTPOnlyChecks is the netcheck done by environments that can
@@ -1505,6 +1601,9 @@ func (c *Client) logConciseReport(r *Report, dm *tailcfg.DERPMap) {
 		if r.CaptivePortal != "" {
 			fmt.Fprintf(w, " captiveportal=%v", r.CaptivePortal)
 		}
+		if r.Partial {
+			fmt.Fprintf(w, " partial")
+		}
 		fmt.Fprintf(w, " derp=%v", r.PreferredDERP)
 		if r.PreferredDERP != 0 {
 			fmt.Fprintf(w, " derpdist=")
@@ -1642,6 +1741,11 @@ func (c *Client) addReportHistoryAndSetPreferredDERP(r *Report, dm tailcfg.DERPM
 			keepOld = true
 		}
 	}
+	// A partial report that didn't get to measure the old region says
+	// nothing about whether it's still the best.
+	if changingPreferred && !oldRegionIsAccessible && r.Partial && dm.Regions().Has(prevDERP) {
+		keepOld = true
+	}
 	if keepOld {
 		// Reset the report's PreferredDERP to be the previous value,
 		// which undoes any region change we made above.
@@ -234,12 +234,42 @@ func TestWorksWhenUDPBlocked(t *testing.T) {
 	// Captive portal test is irrelevant; accept what the current report
 	// has.
 	want.CaptivePortal = r.CaptivePortal
+	// Whether the context expires before the STUN probing gives up
+	// depends on the machine's network; accept either.
+	want.Partial = r.Partial
 
 	if !reflect.DeepEqual(r, want) {
 		t.Errorf("mismatch\n got: %+v\nwant: %+v\n", r, want)
 	}
 }
 
+func TestProbeLimiter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var unlimited *probeLimiter
+	for i := 0; i < 3; i++ {
+		if !unlimited.acquire(ctx) {
+			t.Fatalf("nil probeLimiter acquire %d failed", i)
+		}
+	}
+
+	l := (&Client{MaxConcurrentProbes: 1}).newProbeLimiter()
+	if !l.acquire(ctx) {
+		t.Fatal("first acquire failed")
+	}
+	if l.acquire(ctx) {
+		t.Fatal("second acquire succeeded; want it to wait until ctx is done")
+	}
+	l.release()
+	if !l.acquire(context.Background()) {
+		t.Fatal("acquire after release failed")
+	}
+	if unlimited.acquire(ctx) {
+		t.Fatal("nil probeLimiter acquire succeeded after ctx done")
+	}
+}
+
 func TestAddReportHistoryAndSetPreferredDERP(t *testing.T) {
 	// report returns a *Report from (DERP host, time.Duration)+ pairs.
 	report := func(a ...any) *Report {
@@ -265,6 +295,14 @@ func TestAddReportHistoryAndSetPreferredDERP(t *testing.T) {
 		}
 		return r
 	}
+	partial := func(r *Report) *Report {
+		r.Partial = true
+		return r
+	}
+	twoRegions := map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, Nodes: []*tailcfg.DERPNode{{Name: "d1a", RegionID: 1}}},
+		2: {RegionID: 2, Nodes: []*tailcfg.DERPNode{{Name: "d2a", RegionID: 2}}},
+	}
 	type step struct {
 		after time.Duration
 		r     *Report
@@ -443,6 +481,36 @@ type step struct {
 			wantDERP:    1, // region 2 is STUN only, so we should never use it
 
 		},
+		{
+			name:    "partial_keeps_unmeasured_old",
+			regions: twoRegions,
+			steps: []step{
+				{0, report("d1", 4, "d2", 5)},
+				{1 * time.Second, partial(report("d2", 5))},
+			},
+			wantPrevLen: 2,
+			wantDERP:    1, // 1 wasn't measured, not gone
+		},
+		{
+			name:    "full_drops_unmeasured_old",
+			regions: twoRegions,
+			steps: []step{
+				{0, report("d1", 4, "d2", 5)},
+				{1 * time.Second, report("d2", 5)},
+			},
+			wantPrevLen: 2,
+			wantDERP:    2, // 1 is gone
+		},
+		{
+			name:    "partial_can_switch",
+			regions: twoRegions,
+			steps: []step{
+				{0, report("d1", 4, "d2", 5)},
+				{1 * time.Second, partial(report("d1", 4, "d2", 1))},
+			},
+			wantPrevLen: 2,
+			wantDERP:    2, // 2 got fast enough
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -931,6 +999,37 @@ func TestNoCaptivePortalWhenUDP(t *testing.T) {
 	}
 }
 
+func TestCheckCaptivePortalRedirect(t *testing.T) {
+	tr := RoundTripFunc(func(req *http.Request) *http.Response {
+		h := make(http.Header)
+		h.Set("Location", "/login?next=1")
+		return &http.Response{
+			StatusCode: http.StatusFound,
+			Header:     h,
+			Body:       http.NoBody,
+			Request:    req,
+		}
+	})
+	tstest.Replace(t, &noRedirectClient.Transport, http.RoundTripper(tr))
+
+	c := &Client{Logf: t.Logf}
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, Nodes: []*tailcfg.DERPNode{{Name: "1a", RegionID: 1, HostName: "derp.example.com"}}},
+	}}
+	res, err := c.checkCaptivePortal(context.Background(), dm, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := captivePortalResult{
+		found:      true,
+		statusCode: http.StatusFound,
+		location:   "http://derp.example.com/login?next=1",
+	}
+	if res != want {
+		t.Errorf("checkCaptivePortal = %+v; want %+v", res, want)
+	}
+}
+
 type RoundTripFunc func(req *http.Request) *http.Response
 
 func (f RoundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -68,6 +68,19 @@ func ShouldDisableUDPGSO(err error) bool {
 	return shouldDisableUDPGSO(err)
 }
 
+var isUDPGSOError func(error) bool // non-nil on Linux
+
+// IsUDPGSOError reports whether err, returned by a send that coalesced
+// several UDP datagrams into one (UDP_SEGMENT), may have been caused by the
+// coalescing itself, such that sending the same datagrams individually could
+// succeed.
+func IsUDPGSOError(err error) bool {
+	if isUDPGSOError == nil {
+		return false
+	}
+	return isUDPGSOError(err)
+}
+
 type ErrUDPGSODisabled struct {
 	OnLaddr  string
 	RetryErr error
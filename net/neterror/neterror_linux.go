@@ -23,4 +23,18 @@ func init() {
 		}
 		return false
 	}
+	isUDPGSOError = func(err error) bool {
+		var serr *os.SyscallError
+		if errors.As(err, &serr) {
+			// Besides EIO (see above), the kernel rejects a UDP_SEGMENT
+			// send with EMSGSIZE if the segments don't fit the route's
+			// MTU or the send is over the segment limit, and with EINVAL
+			// if the segment size is not acceptable to the device.
+			switch serr.Err {
+			case unix.EIO, unix.EMSGSIZE, unix.EINVAL:
+				return true
+			}
+		}
+		return false
+	}
 }
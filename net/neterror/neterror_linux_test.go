@@ -52,3 +52,35 @@ func TestTreatAsLostUDP(t *testing.T) {
 	}
 
 }
+
+func TestIsUDPGSOError(t *testing.T) {
+	sendErr := func(errno syscall.Errno) error {
+		return &net.OpError{
+			Op: "write",
+			Err: &os.SyscallError{
+				Syscall: "sendmmsg",
+				Err:     errno,
+			},
+		}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"non-nil", errors.New("foo"), false},
+		{"eio", sendErr(syscall.EIO), true},
+		{"emsgsize", sendErr(syscall.EMSGSIZE), true},
+		{"einval", sendErr(syscall.EINVAL), true},
+		{"eperm", sendErr(syscall.EPERM), false},
+		{"host_unreach", sendErr(syscall.EHOSTUNREACH), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsUDPGSOError(tt.err); got != tt.want {
+				t.Errorf("got = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -17,10 +17,16 @@
 	"context"
 	"net"
 	"net/netip"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
+	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netknob"
 	"tailscale.com/net/netmon"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/syncs"
 	"tailscale.com/types/logger"
 )
 
@@ -38,7 +44,7 @@ func SetEnabled(on bool) {
 // route information to bind to a particular interface. It is the same as
 // setting the TS_BIND_TO_INTERFACE_BY_ROUTE.
 //
-// Currently, this only changes the behaviour on macOS.
+// Currently, this only changes the behaviour on macOS and Windows.
 func SetBindToInterfaceByRoute(v bool) {
 	bindToInterfaceByRoute.Store(v)
 }
@@ -53,15 +59,199 @@ func SetDisableBindConnToInterface(v bool) {
 	disableBindConnToInterface.Store(v)
 }
 
+var coderSoftIsolation atomic.Bool
+
+// SetCoderSoftIsolation enables or disables soft isolation mode. In soft
+// isolation mode, sockets are only bound to the default interface (or
+// marked to bypass Tailscale's routing table) when the system would
+// otherwise route their traffic out the Tailscale interface. This avoids
+// overriding policy routing set up by other software on the host.
+//
+// Enabling it makes SoftIsolation the default Policy; it has no effect if
+// a Policy was set with SetPolicy. Currently, this only has an effect on
+// Linux and Windows.
+func SetCoderSoftIsolation(v bool) {
+	coderSoftIsolation.Store(v)
+}
+
+var coderInterfaceName syncs.AtomicValue[string]
+
+// SetCoderInterfaceName sets the name of the Coder TUN interface, which
+// soft isolation and binding by route check route lookups against. If
+// it's not set, the interface is found by its addresses instead.
+func SetCoderInterfaceName(name string) {
+	coderInterfaceName.Store(name)
+	ClearRouteCache()
+}
+
+// coderInterfaceIndex returns the index of the Coder TUN interface, or 0 if
+// there isn't one. It's a variable so tests can replace it.
+//
+// Without an interface name from SetCoderInterfaceName, it's the first
+// interface with an address in the Tailscale ULA range, which every Coder
+// node has. Unlike interfaces.Tailscale, this doesn't go by interface
+// names, as Coder's don't look like Tailscale's (on Windows, it's
+// "Coder"), and doesn't trust CGNAT addresses, which other VPNs use too.
+var coderInterfaceIndex = func() (int, error) {
+	if name := coderInterfaceName.Load(); name != "" {
+		ifc, err := net.InterfaceByName(name)
+		if err != nil {
+			return 0, err
+		}
+		return ifc.Index, nil
+	}
+	ifcs, err := net.Interfaces()
+	if err != nil {
+		return 0, err
+	}
+	for _, ifc := range ifcs {
+		addrs, err := ifc.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip, ok := netip.AddrFromSlice(ipnet.IP); ok && tsaddr.TailscaleULARange().Contains(ip) {
+				return ifc.Index, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+// parseDst returns the IP address in address, which is of the form
+// "ip:port" or "ip". It reports false if address has no IP address or
+// the IP address is unspecified, as there's no route to look up.
+func parseDst(address string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	dst, err := netip.ParseAddr(host)
+	if err != nil || dst.IsUnspecified() {
+		return netip.Addr{}, false
+	}
+	return dst.Unmap(), true
+}
+
+// routeCacheTTL is how long the result of a route lookup for a given
+// destination is trusted before we ask the OS again.
+const routeCacheTTL = 30 * time.Second
+
+// routeCacheErrTTL is how long a failed route lookup is remembered, so a
+// burst of dials to a destination without a route doesn't ask the OS
+// for each of them.
+const routeCacheErrTTL = 2 * time.Second
+
+// maxRouteCacheEntries bounds the number of destinations in routeCache.
+const maxRouteCacheEntries = 1024
+
+// routeInfo is the result of a route lookup.
+type routeInfo struct {
+	ifIndex  int  // interface traffic to the destination is sent out of
+	viaCoder bool // ifIndex is the Coder TUN interface
+}
+
+type routeCacheEntry struct {
+	route   routeInfo
+	err     error
+	expires time.Time
+}
+
+// routeCache caches route lookups per destination address, for the
+// platforms that look up routes in soft isolation mode or when binding
+// by route.
+var routeCache struct {
+	sync.Mutex
+	m map[netip.Addr]routeCacheEntry
+}
+
+// ClearRouteCache clears the cache of route lookups used in soft isolation
+// mode and when binding by route. It should be called when the system's
+// routes or interfaces change.
+func ClearRouteCache() {
+	routeCache.Lock()
+	defer routeCache.Unlock()
+	clear(routeCache.m)
+}
+
+// AttachMonitor makes changes reported by netMon clear the route cache (see
+// ClearRouteCache), so the results of route lookups don't outlive the
+// routes and interfaces they were based on. It returns a func that
+// detaches it again.
+func AttachMonitor(netMon *netmon.Monitor) (detach func()) {
+	return netMon.RegisterChangeCallback(func(bool, *interfaces.State) {
+		// Clear the cache even if the interfaces didn't change
+		// (changed is false), as the routes may have.
+		ClearRouteCache()
+	})
+}
+
+// getRouteCached returns the route traffic to dst would take, using
+// getInterfaceIndex, the platform's route lookup, on a cache miss.
+func getRouteCached(dst netip.Addr, getInterfaceIndex func(netip.Addr) (int, error)) (routeInfo, error) {
+	now := time.Now()
+	routeCache.Lock()
+	e, ok := routeCache.m[dst]
+	routeCache.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.route, e.err
+	}
+
+	e = routeCacheEntry{expires: now.Add(routeCacheTTL)}
+	e.route.ifIndex, e.err = getInterfaceIndex(dst)
+	if e.err == nil {
+		var coderIdx int
+		coderIdx, e.err = coderInterfaceIndex()
+		e.route.viaCoder = coderIdx != 0 && e.route.ifIndex == coderIdx
+	}
+	if e.err != nil {
+		e.route = routeInfo{}
+		e.expires = now.Add(routeCacheErrTTL)
+	}
+
+	routeCache.Lock()
+	defer routeCache.Unlock()
+	if len(routeCache.m) >= maxRouteCacheEntries {
+		clear(routeCache.m)
+	}
+	if routeCache.m == nil {
+		routeCache.m = make(map[netip.Addr]routeCacheEntry)
+	}
+	routeCache.m[dst] = e
+	return e.route, e.err
+}
+
+// shouldBindSoftIsolation reports whether a socket dialing or listening on
+// address needs to be bound or marked in soft isolation mode, which is
+// the case if the platform's getInterfaceIndex says traffic to it would
+// go out the Coder interface.
+//
+// Destinations we can't reason about (unparseable or unspecified
+// addresses, or failed route lookups) keep the default behavior of
+// always binding, since a routing loop is worse than ignoring the
+// host's routing policy.
+func shouldBindSoftIsolation(address string, getInterfaceIndex func(netip.Addr) (int, error)) bool {
+	dst, ok := parseDst(address)
+	if !ok {
+		return true
+	}
+	r, err := getRouteCached(dst, getInterfaceIndex)
+	if err != nil {
+		return true
+	}
+	return r.viaCoder
+}
+
 // Listener returns a new net.Listener with its Control hook func
 // initialized as necessary to run in logical network namespace that
 // doesn't route back into Tailscale.
 // The netMon parameter is optional; if non-nil it's used to do faster interface lookups.
 func Listener(logf logger.Logf, netMon *netmon.Monitor) *net.ListenConfig {
-	if disabled.Load() {
-		return new(net.ListenConfig)
-	}
-	return &net.ListenConfig{Control: control(logf, netMon)}
+	return ListenerWithPolicy(logf, netMon, nil)
 }
 
 // NewDialer returns a new Dialer using a net.Dialer with its Control
@@ -81,14 +271,24 @@ func NewDialer(logf logger.Logf, netMon *netmon.Monitor) Dialer {
 // ALL_PROXY.
 // The netMon parameter is optional; if non-nil it's used to do faster interface lookups.
 func FromDialer(logf logger.Logf, netMon *netmon.Monitor, d *net.Dialer) Dialer {
-	if disabled.Load() {
-		return d
-	}
-	d.Control = control(logf, netMon)
-	if wrapDialer != nil {
-		return wrapDialer(d)
+	return FromDialerWithPolicy(logf, netMon, d, nil)
+}
+
+// ControlFor returns a func for the Control field of a net.Dialer or
+// net.ListenConfig, so that sockets created elsewhere in the process, such
+// as by an embedder's own HTTP clients, are kept off the Tailscale
+// interface like this package's are: per the Policy set by SetPolicy, or
+// soft isolation. It does nothing while netns is disabled with SetEnabled.
+// Unlike FromDialer, it doesn't handle SOCKS proxies.
+// The netMon parameter is optional; if non-nil it's used to do faster interface lookups.
+func ControlFor(logf logger.Logf, netMon *netmon.Monitor) func(network, address string, c syscall.RawConn) error {
+	ctl := control(logf, netMon, nil)
+	return func(network, address string, c syscall.RawConn) error {
+		if disabled.Load() {
+			return nil
+		}
+		return ctl(network, address, c)
 	}
-	return d
 }
 
 // IsSOCKSDialer reports whether d is SOCKS-proxying dialer as returned by
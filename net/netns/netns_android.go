@@ -50,15 +50,23 @@ func SetAndroidProtectFunc(f func(fd int) error) {
 	androidProtectFunc = f
 }
 
-func control(logger.Logf, *netmon.Monitor) func(network, address string, c syscall.RawConn) error {
-	return controlC
+func control(_ logger.Logf, _ *netmon.Monitor, p Policy) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return controlC(p, network, address, c)
+	}
 }
 
-// controlC marks c as necessary to dial in a separate network namespace.
+// controlC marks c as necessary to dial in a separate network namespace,
+// if p (or the default Policy, if p is nil) says so. A Policy's interface
+// index is ignored, as protecting a socket on Android doesn't bind it to
+// any particular interface.
 //
 // It's intentionally the same signature as net.Dialer.Control
-// and net.ListenConfig.Control.
-func controlC(network, address string, c syscall.RawConn) error {
+// and net.ListenConfig.Control, but for p.
+func controlC(p Policy, network, address string, c syscall.RawConn) error {
+	if _, bind := policyOrDefault(p).ShouldBind(address); !bind {
+		return nil
+	}
 	var sockErr error
 	err := c.Control(func(fd uintptr) {
 		androidProtectFuncMu.Lock()
@@ -23,9 +23,9 @@
 	"tailscale.com/types/logger"
 )
 
-func control(logf logger.Logf, netMon *netmon.Monitor) func(network, address string, c syscall.RawConn) error {
+func control(logf logger.Logf, netMon *netmon.Monitor, p Policy) func(network, address string, c syscall.RawConn) error {
 	return func(network, address string, c syscall.RawConn) error {
-		return controlLogf(logf, netMon, network, address, c)
+		return controlLogf(logf, netMon, p, network, address, c)
 	}
 }
 
@@ -33,11 +33,9 @@ func control(logf logger.Logf, netMon *netmon.Monitor) func(network, address str
 
 var errInterfaceStateInvalid = errors.New("interface state invalid")
 
-// controlLogf marks c as necessary to dial in a separate network namespace.
-//
-// It's intentionally the same signature as net.Dialer.Control
-// and net.ListenConfig.Control.
-func controlLogf(logf logger.Logf, netMon *netmon.Monitor, network, address string, c syscall.RawConn) error {
+// controlLogf marks c as necessary to dial in a separate network namespace,
+// if p (or the default Policy, if p is nil) says so.
+func controlLogf(logf logger.Logf, netMon *netmon.Monitor, p Policy, network, address string, c syscall.RawConn) error {
 	if isLocalhost(address) {
 		// Don't bind to an interface for localhost connections.
 		return nil
@@ -48,11 +46,18 @@ func controlLogf(logf logger.Logf, netMon *netmon.Monitor, network, address stri
 		return nil
 	}
 
-	idx, err := getInterfaceIndex(logf, netMon, address)
-	if err != nil {
-		// callee logged
+	idx, bind := policyOrDefault(p).ShouldBind(address)
+	if !bind {
 		return nil
 	}
+	if idx == 0 {
+		var err error
+		idx, err = getInterfaceIndex(logf, netMon, address)
+		if err != nil {
+			// callee logged
+			return nil
+		}
+	}
 
 	return bindConnToInterface(c, network, address, idx, logf)
 }
@@ -12,7 +12,7 @@
 	"tailscale.com/types/logger"
 )
 
-func control(logger.Logf, *netmon.Monitor) func(network, address string, c syscall.RawConn) error {
+func control(logger.Logf, *netmon.Monitor, Policy) func(network, address string, c syscall.RawConn) error {
 	return controlC
 }
 
@@ -6,12 +6,16 @@
 package netns
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"sync"
 	"syscall"
 
+	"github.com/jsimonetti/rtnetlink"
+	"github.com/mdlayher/netlink"
 	"golang.org/x/sys/unix"
 	"tailscale.com/envknob"
 	"tailscale.com/net/interfaces"
@@ -79,25 +83,38 @@ func ignoreErrors() bool {
 	return false
 }
 
-func control(logger.Logf, *netmon.Monitor) func(network, address string, c syscall.RawConn) error {
-	return controlC
+func control(_ logger.Logf, _ *netmon.Monitor, p Policy) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return controlC(p, network, address, c)
+	}
 }
 
-// controlC marks c as necessary to dial in a separate network namespace.
+// controlC marks c as necessary to dial in a separate network namespace,
+// if p (or the default Policy, if p is nil) says so.
 //
 // It's intentionally the same signature as net.Dialer.Control
-// and net.ListenConfig.Control.
-func controlC(network, address string, c syscall.RawConn) error {
+// and net.ListenConfig.Control, but for p.
+func controlC(p Policy, network, address string, c syscall.RawConn) error {
 	if isLocalhost(address) {
 		// Don't bind to an interface for localhost connections.
 		return nil
 	}
+	ifIndex, bind := policyOrDefault(p).ShouldBind(address)
+	if !bind {
+		// For instance, in soft isolation mode the route for this
+		// destination doesn't go out the Coder interface, so leave
+		// the socket alone and let the host's routing policy decide.
+		return nil
+	}
 
 	var sockErr error
 	err := c.Control(func(fd uintptr) {
-		if UseSocketMark() {
+		switch {
+		case ifIndex != 0:
+			sockErr = bindToIndex(fd, ifIndex)
+		case UseSocketMark():
 			sockErr = setBypassMark(fd)
-		} else {
+		default:
 			sockErr = bindToDevice(fd)
 		}
 	})
@@ -118,6 +135,13 @@ func setBypassMark(fd uintptr) error {
 	return nil
 }
 
+func bindToIndex(fd uintptr, ifIndex int) error {
+	if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BINDTOIFINDEX, ifIndex); err != nil {
+		return fmt.Errorf("setting SO_BINDTOIFINDEX: %w", err)
+	}
+	return nil
+}
+
 func bindToDevice(fd uintptr) error {
 	ifc, err := interfaces.DefaultRouteInterface()
 	if err != nil {
@@ -132,3 +156,51 @@ func bindToDevice(fd uintptr) error {
 	}
 	return nil
 }
+
+// getInterfaceIndex returns the index of the interface traffic to dst would
+// be sent out of. It's a variable so tests can replace it.
+var getInterfaceIndex = routeInterfaceIndex
+
+func init() {
+	platformInterfaceIndex = func(dst netip.Addr) (int, error) {
+		return getInterfaceIndex(dst)
+	}
+}
+
+var errNoRoute = errors.New("no route found")
+
+// routeInterfaceIndex asks the kernel, via an RTM_GETROUTE netlink request,
+// which interface index traffic to dst would be sent out of.
+func routeInterfaceIndex(dst netip.Addr) (int, error) {
+	c, err := rtnetlink.Dial(nil)
+	if err != nil {
+		return 0, fmt.Errorf("routeInterfaceIndex: Dial: %w", err)
+	}
+	defer c.Close()
+
+	req := &rtnetlink.RouteMessage{
+		Family:    unix.AF_INET,
+		DstLength: 32,
+		Attributes: rtnetlink.RouteAttributes{
+			Dst: net.IP(dst.AsSlice()),
+		},
+	}
+	if dst.Is6() {
+		req.Family = unix.AF_INET6
+		req.DstLength = 128
+	}
+	msgs, err := c.Execute(req, unix.RTM_GETROUTE, netlink.Request)
+	if err != nil {
+		return 0, fmt.Errorf("routeInterfaceIndex: RTM_GETROUTE %v: %w", dst, err)
+	}
+	for _, m := range msgs {
+		rm, ok := m.(*rtnetlink.RouteMessage)
+		if !ok {
+			continue
+		}
+		if idx := int(rm.Attributes.OutIface); idx != 0 {
+			return idx, nil
+		}
+	}
+	return 0, errNoRoute
+}
@@ -4,7 +4,12 @@
 package netns
 
 import (
+	"net"
+	"net/netip"
+	"syscall"
 	"testing"
+
+	"golang.org/x/exp/slices"
 )
 
 func TestSocketMarkWorks(t *testing.T) {
@@ -12,3 +17,92 @@ func TestSocketMarkWorks(t *testing.T) {
 	// we cannot actually assert whether the test runner has SO_MARK available
 	// or not, as we don't know. We're just checking that it doesn't panic.
 }
+
+func TestRouteInterfaceIndex(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	idx, err := routeInterfaceIndex(netip.MustParseAddr("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx != lo.Index {
+		t.Errorf("routeInterfaceIndex(127.0.0.1) = %d; want %d (lo)", idx, lo.Index)
+	}
+}
+
+// countingRawConn is a syscall.RawConn counting the calls to Control.
+type countingRawConn struct {
+	syscall.RawConn
+	controls int
+}
+
+func (c *countingRawConn) Control(f func(fd uintptr)) error {
+	c.controls++
+	return nil
+}
+
+func TestControlPolicy(t *testing.T) {
+	var seen []string
+	skipAll := PolicyFunc(func(address string) (int, bool) {
+		seen = append(seen, address)
+		return 0, false
+	})
+	c := new(countingRawConn)
+	if err := controlC(skipAll, "tcp4", "192.0.2.1:443", c); err != nil {
+		t.Fatal(err)
+	}
+	if c.controls != 0 {
+		t.Errorf("socket touched despite the policy not binding it")
+	}
+	if !slices.Equal(seen, []string{"192.0.2.1:443"}) {
+		t.Errorf("policy saw %q; want the dialed address", seen)
+	}
+
+	// Localhost is never bound, and the policy isn't asked.
+	seen = nil
+	bindAll := PolicyFunc(func(address string) (int, bool) {
+		seen = append(seen, address)
+		return 0, true
+	})
+	if err := controlC(bindAll, "tcp4", "127.0.0.1:443", c); err != nil {
+		t.Fatal(err)
+	}
+	if c.controls != 0 || len(seen) != 0 {
+		t.Errorf("localhost: controls = %d, policy saw %q; want neither", c.controls, seen)
+	}
+
+	if err := controlC(bindAll, "tcp4", "192.0.2.1:443", c); err != nil {
+		t.Fatal(err)
+	}
+	if c.controls != 1 {
+		t.Errorf("controls = %d; want 1", c.controls)
+	}
+}
+
+func TestControlFor(t *testing.T) {
+	t.Cleanup(func() {
+		SetPolicy(nil)
+		SetEnabled(true)
+	})
+	SetPolicy(PolicyFunc(func(string) (int, bool) { return 0, true }))
+	ctl := ControlFor(t.Logf, nil)
+
+	c := new(countingRawConn)
+	if err := ctl("tcp4", "192.0.2.1:443", c); err != nil {
+		t.Fatal(err)
+	}
+	if c.controls != 1 {
+		t.Errorf("controls = %d; want 1", c.controls)
+	}
+
+	// It follows SetEnabled after it's created.
+	SetEnabled(false)
+	if err := ctl("tcp4", "192.0.2.1:443", c); err != nil {
+		t.Fatal(err)
+	}
+	if c.controls != 1 {
+		t.Errorf("socket touched while netns is disabled")
+	}
+}
@@ -14,8 +14,14 @@
 package netns
 
 import (
+	"errors"
 	"flag"
+	"net/netip"
 	"testing"
+	"time"
+
+	"tailscale.com/net/interfaces"
+	"tailscale.com/net/netmon"
 )
 
 var extNetwork = flag.Bool("use-external-network", false, "use the external network in tests")
@@ -76,3 +82,245 @@ func TestIsLocalhost(t *testing.T) {
 		}
 	}
 }
+
+// fakeRoutes replaces coderInterfaceIndex with one reporting coderIdx, and
+// returns a getInterfaceIndex func looking up dsts in routes, counting
+// the lookups. Destinations not in routes fail to look up.
+func fakeRoutes(t *testing.T, coderIdx int, routes map[netip.Addr]int) (getInterfaceIndex func(netip.Addr) (int, error), lookups map[netip.Addr]int) {
+	old := coderInterfaceIndex
+	coderInterfaceIndex = func() (int, error) { return coderIdx, nil }
+	t.Cleanup(func() {
+		coderInterfaceIndex = old
+		ClearRouteCache()
+	})
+	ClearRouteCache()
+	lookups = map[netip.Addr]int{}
+	return func(dst netip.Addr) (int, error) {
+		lookups[dst]++
+		idx, ok := routes[dst]
+		if !ok {
+			return 0, errors.New("no route")
+		}
+		return idx, nil
+	}, lookups
+}
+
+func TestParseDst(t *testing.T) {
+	tests := []struct {
+		address string
+		want    netip.Addr
+		wantOK  bool
+	}{
+		{"100.64.0.1:443", netip.MustParseAddr("100.64.0.1"), true},
+		{"100.64.0.1", netip.MustParseAddr("100.64.0.1"), true},
+		{"[fd7a:115c:a1e0::1]:443", netip.MustParseAddr("fd7a:115c:a1e0::1"), true},
+		{"[::ffff:100.64.0.1]:443", netip.MustParseAddr("100.64.0.1"), true},
+		{"0.0.0.0:0", netip.Addr{}, false},
+		{":0", netip.Addr{}, false},
+		{"example.com:80", netip.Addr{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseDst(tt.address)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseDst(%q) = %v, %v; want %v, %v", tt.address, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestShouldBindSoftIsolation(t *testing.T) {
+	viaCoder := netip.MustParseAddr("100.64.0.1")
+	getIdx, lookups := fakeRoutes(t, 7, map[netip.Addr]int{
+		viaCoder:                         7,
+		netip.MustParseAddr("192.0.2.1"): 2,
+	})
+
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"100.64.0.1:443", true},
+		{"192.0.2.1:443", false},
+		{"[::ffff:100.64.0.1]:443", true},
+		{"198.51.100.1:443", true}, // lookup fails
+		{"0.0.0.0:0", true},
+		{":0", true},
+		{"example.com:80", true},
+	}
+	for _, tt := range tests {
+		if got := shouldBindSoftIsolation(tt.address, getIdx); got != tt.want {
+			t.Errorf("shouldBindSoftIsolation(%q) = %v; want %v", tt.address, got, tt.want)
+		}
+	}
+	if n := lookups[viaCoder]; n != 1 {
+		t.Errorf("lookups for %v = %d; want 1 (cached)", viaCoder, n)
+	}
+
+	ClearRouteCache()
+	shouldBindSoftIsolation("100.64.0.1:443", getIdx)
+	if n := lookups[viaCoder]; n != 2 {
+		t.Errorf("lookups for %v after ClearRouteCache = %d; want 2", viaCoder, n)
+	}
+}
+
+func TestGetRouteCachedTTL(t *testing.T) {
+	ok := netip.MustParseAddr("192.0.2.1")
+	bad := netip.MustParseAddr("198.51.100.1")
+	getIdx, lookups := fakeRoutes(t, 7, map[netip.Addr]int{ok: 2})
+
+	for range 3 {
+		if r, err := getRouteCached(ok, getIdx); err != nil || r != (routeInfo{ifIndex: 2}) {
+			t.Fatalf("getRouteCached(%v) = %+v, %v; want ifIndex 2", ok, r, err)
+		}
+		if _, err := getRouteCached(bad, getIdx); err == nil {
+			t.Fatalf("getRouteCached(%v) succeeded; want error", bad)
+		}
+	}
+	if lookups[ok] != 1 || lookups[bad] != 1 {
+		t.Errorf("lookups = %v; want one per destination (cached)", lookups)
+	}
+
+	routeCache.Lock()
+	okTTL := time.Until(routeCache.m[ok].expires)
+	badTTL := time.Until(routeCache.m[bad].expires)
+	routeCache.Unlock()
+	if okTTL <= routeCacheErrTTL || okTTL > routeCacheTTL {
+		t.Errorf("route cached for %v; want %v", okTTL, routeCacheTTL)
+	}
+	if badTTL > routeCacheErrTTL {
+		t.Errorf("failed lookup cached for %v; want at most %v", badTTL, routeCacheErrTTL)
+	}
+
+	// Expired entries are looked up again.
+	routeCache.Lock()
+	for dst, e := range routeCache.m {
+		e.expires = time.Now().Add(-time.Second)
+		routeCache.m[dst] = e
+	}
+	routeCache.Unlock()
+	getRouteCached(ok, getIdx)
+	getRouteCached(bad, getIdx)
+	if lookups[ok] != 2 || lookups[bad] != 2 {
+		t.Errorf("lookups after expiry = %v; want two per destination", lookups)
+	}
+}
+
+func TestGetRouteCachedBounded(t *testing.T) {
+	routes := map[netip.Addr]int{}
+	dst := netip.MustParseAddr("10.0.0.0")
+	for range maxRouteCacheEntries + 1 {
+		routes[dst] = 2
+		dst = dst.Next()
+	}
+	getIdx, _ := fakeRoutes(t, 7, routes)
+	for dst := range routes {
+		getRouteCached(dst, getIdx)
+	}
+	routeCache.Lock()
+	n := len(routeCache.m)
+	routeCache.Unlock()
+	if n > maxRouteCacheEntries {
+		t.Errorf("route cache has %d entries; want at most %d", n, maxRouteCacheEntries)
+	}
+}
+
+func TestSetCoderInterfaceName(t *testing.T) {
+	t.Cleanup(func() { SetCoderInterfaceName("") })
+	SetCoderInterfaceName("does-not-exist0")
+	if _, err := coderInterfaceIndex(); err == nil {
+		t.Error("coderInterfaceIndex succeeded for a missing interface")
+	}
+	// A missing Coder interface fails the lookup, so sockets are bound.
+	getIdx := func(netip.Addr) (int, error) { return 1, nil }
+	if !shouldBindSoftIsolation("192.0.2.1:443", getIdx) {
+		t.Error("shouldBindSoftIsolation = false without a Coder interface; want true")
+	}
+}
+
+func TestPolicyOrDefault(t *testing.T) {
+	t.Cleanup(func() {
+		SetPolicy(nil)
+		SetCoderSoftIsolation(false)
+	})
+	never := PolicyFunc(func(string) (int, bool) { return 0, false })
+	index3 := PolicyFunc(func(string) (int, bool) { return 3, true })
+
+	check := func(name string, p Policy, wantIdx int, wantBind bool) {
+		t.Helper()
+		idx, bind := policyOrDefault(p).ShouldBind("192.0.2.1:443")
+		if idx != wantIdx || bind != wantBind {
+			t.Errorf("%s: ShouldBind = %v, %v; want %v, %v", name, idx, bind, wantIdx, wantBind)
+		}
+	}
+	check("default", nil, 0, true)
+	check("own policy", never, 0, false)
+
+	SetPolicy(index3)
+	check("global policy", nil, 3, true)
+	check("own policy over global", never, 0, false)
+
+	// The global policy wins over soft isolation.
+	SetCoderSoftIsolation(true)
+	check("global policy with soft isolation", nil, 3, true)
+
+	SetPolicy(nil)
+	getIdx, _ := fakeRoutes(t, 7, map[netip.Addr]int{netip.MustParseAddr("192.0.2.1"): 2})
+	old := platformInterfaceIndex
+	platformInterfaceIndex = getIdx
+	t.Cleanup(func() { platformInterfaceIndex = old })
+	check("soft isolation", nil, 0, false)
+}
+
+func TestAttachMonitor(t *testing.T) {
+	dst := netip.MustParseAddr("192.0.2.1")
+	getIdx, lookups := fakeRoutes(t, 7, map[netip.Addr]int{dst: 2})
+
+	mon, err := netmon.New(t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mon.Close()
+	events := make(chan bool, 10)
+	mon.RegisterChangeCallback(func(bool, *interfaces.State) { events <- true })
+	mon.Start()
+
+	cacheLen := func() int {
+		routeCache.Lock()
+		defer routeCache.Unlock()
+		return len(routeCache.m)
+	}
+	// flap simulates an interface going down and back up, and waits
+	// for the monitor to report it.
+	flap := func() {
+		t.Helper()
+		mon.InjectEvent()
+		select {
+		case <-events:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for change callback")
+		}
+	}
+
+	detach := AttachMonitor(mon)
+	for i := range 3 {
+		getRouteCached(dst, getIdx)
+		flap()
+		// The callbacks run concurrently, so wait for ours.
+		deadline := time.Now().Add(5 * time.Second)
+		for cacheLen() != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("flap %d: route cache not cleared", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	getRouteCached(dst, getIdx)
+	if n := lookups[dst]; n != 4 {
+		t.Errorf("lookups = %d; want 4 (one per flap, plus one)", n)
+	}
+
+	detach()
+	flap()
+	if cacheLen() != 1 {
+		t.Error("route cache cleared after detaching")
+	}
+}
@@ -4,7 +4,9 @@
 package netns
 
 import (
+	"fmt"
 	"math/bits"
+	"net/netip"
 	"strings"
 	"syscall"
 
@@ -27,13 +29,20 @@ func interfaceIndex(iface *winipcfg.IPAdapterAddresses) uint32 {
 	return iface.IfIndex
 }
 
-func control(logger.Logf, *netmon.Monitor) func(network, address string, c syscall.RawConn) error {
-	return controlC
+func control(_ logger.Logf, _ *netmon.Monitor, p Policy) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return controlC(p, network, address, c)
+	}
 }
 
 // controlC binds c to the Windows interface that holds a default
 // route, and is not the Tailscale WinTun interface.
-func controlC(network, address string, c syscall.RawConn) error {
+//
+// If binding by route is enabled, c is instead bound to the interface
+// Windows would route address over, unless that's the Coder interface.
+// Either way, p (or the default Policy, if p is nil) may leave c unbound
+// or pick its interface instead.
+func controlC(p Policy, network, address string, c syscall.RawConn) error {
 	if strings.HasPrefix(address, "127.") {
 		// Don't bind to an interface for localhost connections,
 		// otherwise we get:
@@ -51,22 +60,37 @@ func controlC(network, address string, c syscall.RawConn) error {
 		canV6 = true
 	}
 
+	ifIndex, bind := policyOrDefault(p).ShouldBind(address)
+	if !bind {
+		return nil
+	}
+	idx4, idx6 := uint32(ifIndex), uint32(ifIndex)
+	if ifIndex == 0 {
+		idx4, idx6 = routeBindIndex(address)
+	}
+
 	if canV4 {
-		iface, err := interfaces.GetWindowsDefault(windows.AF_INET)
-		if err != nil {
-			return err
+		if idx4 == 0 {
+			iface, err := interfaces.GetWindowsDefault(windows.AF_INET)
+			if err != nil {
+				return err
+			}
+			idx4 = interfaceIndex(iface)
 		}
-		if err := bindSocket4(c, interfaceIndex(iface)); err != nil {
+		if err := bindSocket4(c, idx4); err != nil {
 			return err
 		}
 	}
 
 	if canV6 {
-		iface, err := interfaces.GetWindowsDefault(windows.AF_INET6)
-		if err != nil {
-			return err
+		if idx6 == 0 {
+			iface, err := interfaces.GetWindowsDefault(windows.AF_INET6)
+			if err != nil {
+				return err
+			}
+			idx6 = interfaceIndex(iface)
 		}
-		if err := bindSocket6(c, interfaceIndex(iface)); err != nil {
+		if err := bindSocket6(c, idx6); err != nil {
 			return err
 		}
 	}
@@ -74,6 +98,53 @@ func controlC(network, address string, c syscall.RawConn) error {
 	return nil
 }
 
+// routeBindIndex returns the interface indexes to bind a socket dialing or
+// listening on address to, for IPv4 and IPv6 traffic, when binding by
+// route. A zero index means the default route interface should be used.
+// Only the index of address's own family is ever non-zero, as the route
+// says nothing about the other family.
+func routeBindIndex(address string) (idx4, idx6 uint32) {
+	if !bindToInterfaceByRoute.Load() {
+		return 0, 0
+	}
+	dst, ok := parseDst(address)
+	if !ok {
+		return 0, 0
+	}
+	r, err := getRouteCached(dst, getInterfaceIndex)
+	if err != nil || r.viaCoder {
+		// Binding to the Coder interface would loop, so use the
+		// default route interface.
+		return 0, 0
+	}
+	if dst.Is4() {
+		return uint32(r.ifIndex), 0
+	}
+	return 0, uint32(r.ifIndex)
+}
+
+func init() {
+	platformInterfaceIndex = func(dst netip.Addr) (int, error) {
+		return getInterfaceIndex(dst)
+	}
+}
+
+// getInterfaceIndex returns the index of the interface Windows would
+// route traffic to dst over. It's a variable so tests can replace it.
+var getInterfaceIndex = func(dst netip.Addr) (int, error) {
+	var sa windows.Sockaddr
+	if dst.Is4() {
+		sa = &windows.SockaddrInet4{Addr: dst.As4()}
+	} else {
+		sa = &windows.SockaddrInet6{Addr: dst.As16()}
+	}
+	var idx uint32
+	if err := windows.GetBestInterfaceEx(sa, &idx); err != nil {
+		return 0, fmt.Errorf("GetBestInterfaceEx(%v): %w", dst, err)
+	}
+	return int(idx), nil
+}
+
 // sockoptBoundInterface is the value of IP_UNICAST_IF and IPV6_UNICAST_IF.
 //
 // See https://docs.microsoft.com/en-us/windows/win32/winsock/ipproto-ip-socket-options
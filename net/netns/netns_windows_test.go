@@ -0,0 +1,93 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netns
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestRouteBindIndex(t *testing.T) {
+	const coderIdx = 7
+	routes := map[netip.Addr]int{
+		netip.MustParseAddr("100.64.0.1"):        coderIdx,
+		netip.MustParseAddr("fd7a:115c:a1e0::1"): coderIdx,
+		netip.MustParseAddr("192.0.2.1"):         2,
+		netip.MustParseAddr("2001:db8::1"):       3,
+	}
+	getIdx, lookups := fakeRoutes(t, coderIdx, routes)
+	oldGetIdx := getInterfaceIndex
+	getInterfaceIndex = getIdx
+	t.Cleanup(func() {
+		getInterfaceIndex = oldGetIdx
+		SetBindToInterfaceByRoute(false)
+	})
+
+	tests := []struct {
+		name     string
+		byRoute  bool
+		address  string
+		wantIdx4 uint32
+		wantIdx6 uint32
+	}{
+		{name: "default", address: "192.0.2.1:443"},
+		{name: "v4", byRoute: true, address: "192.0.2.1:443", wantIdx4: 2},
+		{name: "v6", byRoute: true, address: "[2001:db8::1]:443", wantIdx6: 3},
+		{name: "coder", byRoute: true, address: "100.64.0.1:443"},
+		{name: "coder_v6", byRoute: true, address: "[fd7a:115c:a1e0::1]:443"},
+		{name: "no_route", byRoute: true, address: "198.51.100.1:443"},
+		{name: "unspecified", byRoute: true, address: ":0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetBindToInterfaceByRoute(tt.byRoute)
+			idx4, idx6 := routeBindIndex(tt.address)
+			if idx4 != tt.wantIdx4 || idx6 != tt.wantIdx6 {
+				t.Errorf("routeBindIndex(%q) = %v, %v; want %v, %v",
+					tt.address, idx4, idx6, tt.wantIdx4, tt.wantIdx6)
+			}
+		})
+	}
+
+	// Each destination is looked up once; later uses hit the cache.
+	for dst, n := range lookups {
+		if n != 1 {
+			t.Errorf("lookups for %v = %d; want 1", dst, n)
+		}
+	}
+}
+
+func TestSoftIsolationPolicy(t *testing.T) {
+	const coderIdx = 7
+	getIdx, _ := fakeRoutes(t, coderIdx, map[netip.Addr]int{
+		netip.MustParseAddr("100.64.0.1"): coderIdx,
+		netip.MustParseAddr("192.0.2.1"):  2,
+	})
+	oldGetIdx := getInterfaceIndex
+	getInterfaceIndex = getIdx
+	t.Cleanup(func() { getInterfaceIndex = oldGetIdx })
+
+	for _, tt := range []struct {
+		address string
+		want    bool
+	}{
+		{"100.64.0.1:443", true},
+		{"192.0.2.1:443", false}, // soft isolation skips the bind
+		{"198.51.100.1:443", true},
+	} {
+		if _, bind := SoftIsolation.ShouldBind(tt.address); bind != tt.want {
+			t.Errorf("SoftIsolation.ShouldBind(%q) = %v; want %v", tt.address, bind, tt.want)
+		}
+	}
+}
+
+func TestGetInterfaceIndex(t *testing.T) {
+	idx, err := getInterfaceIndex(netip.MustParseAddr("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx == 0 {
+		t.Error("getInterfaceIndex(127.0.0.1) = 0; want the loopback interface")
+	}
+}
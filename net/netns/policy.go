@@ -0,0 +1,113 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netns
+
+import (
+	"net"
+	"net/netip"
+
+	"tailscale.com/net/netmon"
+	"tailscale.com/syncs"
+	"tailscale.com/types/logger"
+)
+
+// Policy decides whether sockets created by this package are bound to an
+// interface (or otherwise marked) to keep their traffic off the Tailscale
+// interface.
+//
+// Policies apply on Linux, macOS, Windows and Android. Sockets to
+// localhost are never bound, whatever the Policy.
+type Policy interface {
+	// ShouldBind reports whether a socket dialing or listening on
+	// address, in the form "host:port", should be bound. If so,
+	// ifaceIndex is the index of the interface to bind it to, or zero
+	// for the platform's usual choice (typically the default route
+	// interface).
+	ShouldBind(address string) (ifaceIndex int, bind bool)
+}
+
+// PolicyFunc is a Policy implemented by a func.
+type PolicyFunc func(address string) (ifaceIndex int, bind bool)
+
+// ShouldBind implements Policy.
+func (f PolicyFunc) ShouldBind(address string) (ifaceIndex int, bind bool) {
+	return f(address)
+}
+
+// AlwaysBind is the Policy binding every socket to the platform's usual
+// choice of interface. It's the default, unless soft isolation is enabled.
+var AlwaysBind Policy = PolicyFunc(func(string) (int, bool) {
+	return 0, true
+})
+
+// SoftIsolation is the Policy of soft isolation mode: sockets are only
+// bound if the system would route their traffic out the Coder interface.
+// See SetCoderSoftIsolation.
+//
+// On platforms without route lookups (all but Linux and Windows), it's
+// the same as AlwaysBind.
+var SoftIsolation Policy = PolicyFunc(func(address string) (int, bool) {
+	if platformInterfaceIndex == nil {
+		return 0, true
+	}
+	return 0, shouldBindSoftIsolation(address, platformInterfaceIndex)
+})
+
+// platformInterfaceIndex returns the index of the interface traffic to a
+// destination would be sent out of. It's non-nil on Linux and Windows.
+var platformInterfaceIndex func(netip.Addr) (int, error)
+
+// policyValue wraps a Policy, which may be nil, for storing in an
+// AtomicValue.
+type policyValue struct {
+	p Policy
+}
+
+var globalPolicy syncs.AtomicValue[policyValue]
+
+// SetPolicy sets the Policy used by sockets that weren't given their own
+// with ListenerWithPolicy or FromDialerWithPolicy. A nil p restores the
+// default: SoftIsolation if soft isolation is enabled, else AlwaysBind.
+func SetPolicy(p Policy) {
+	globalPolicy.Store(policyValue{p})
+}
+
+// policyOrDefault returns p, if non-nil, or else the Policy set by
+// SetPolicy, or else the default.
+func policyOrDefault(p Policy) Policy {
+	if p != nil {
+		return p
+	}
+	if p := globalPolicy.Load().p; p != nil {
+		return p
+	}
+	if coderSoftIsolation.Load() {
+		return SoftIsolation
+	}
+	return AlwaysBind
+}
+
+// ListenerWithPolicy is like Listener, but uses p, rather than the Policy
+// set by SetPolicy, to decide whether to bind sockets. A nil p is the
+// same as Listener.
+func ListenerWithPolicy(logf logger.Logf, netMon *netmon.Monitor, p Policy) *net.ListenConfig {
+	if disabled.Load() {
+		return new(net.ListenConfig)
+	}
+	return &net.ListenConfig{Control: control(logf, netMon, p)}
+}
+
+// FromDialerWithPolicy is like FromDialer, but uses p, rather than the
+// Policy set by SetPolicy, to decide whether to bind sockets. A nil p is
+// the same as FromDialer.
+func FromDialerWithPolicy(logf logger.Logf, netMon *netmon.Monitor, d *net.Dialer, p Policy) Dialer {
+	if disabled.Load() {
+		return d
+	}
+	d.Control = control(logf, netMon, p)
+	if wrapDialer != nil {
+		return wrapDialer(d)
+	}
+	return d
+}
@@ -63,13 +63,27 @@ type Pinger struct {
 	id      uint16 // uint16 per RFC 792
 	wg      sync.WaitGroup
 
+	// Unprivileged, if set, makes the Pinger fall back to unprivileged
+	// datagram ICMP sockets (as supported by macOS, and by Linux if the
+	// process's group is in net.ipv4.ping_group_range) when it can't
+	// open raw ICMP sockets, such as when not running as root. Those
+	// sockets aren't created by the ListenPacketer.
+	Unprivileged bool
+
+	// listenUnprivileged opens an unprivileged ICMP socket; it's
+	// icmp.ListenPacket, except in tests.
+	listenUnprivileged func(network, addr string) (net.PacketConn, error)
+
 	// Following fields protected by mu
 	mu sync.Mutex
 	// conns is a map of "type" to net.PacketConn, type is either
 	// "ip4:icmp" or "ip6:icmp"
 	conns map[string]net.PacketConn
-	seq   uint16 // uint16 per RFC 792
-	pings map[uint16]outstanding
+	// datagram is the set of types of conns that are unprivileged
+	// datagram sockets. See Unprivileged.
+	datagram map[string]bool
+	seq      uint16 // uint16 per RFC 792
+	pings    map[uint16]outstanding
 }
 
 // New creates a new Pinger. The Context provided will be used to create
@@ -86,6 +100,9 @@ func New(ctx context.Context, logf logger.Logf, lp ListenPacketer) *Pinger {
 		timeNow: time.Now,
 		id:      binary.LittleEndian.Uint16(id[:]),
 		pings:   make(map[uint16]outstanding),
+		listenUnprivileged: func(network, addr string) (net.PacketConn, error) {
+			return icmp.ListenPacket(network, addr)
+		},
 	}
 }
 
@@ -95,6 +112,19 @@ func (p *Pinger) mkconn(ctx context.Context, typ, addr string) (net.PacketConn,
 	}
 
 	c, err := p.lp.ListenPacket(ctx, typ, addr)
+	if err != nil && p.Unprivileged {
+		network := "udp4"
+		if typ == v6Type {
+			network = "udp6"
+		}
+		var err2 error
+		if c, err2 = p.listenUnprivileged(network, addr); err2 != nil {
+			return nil, fmt.Errorf("%w; unprivileged fallback: %v", err, err2)
+		}
+		p.vlogf("using unprivileged %s socket: %v", network, err)
+		mak.Set(&p.datagram, typ, true)
+		err = nil
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -176,6 +206,7 @@ func (p *Pinger) run(ctx context.Context, conn net.PacketConn, typ string) {
 		conn.Close()
 		p.mu.Lock()
 		delete(p.conns, typ)
+		delete(p.datagram, typ)
 		p.mu.Unlock()
 	}()
 	buf := make([]byte, 1500)
@@ -241,15 +272,17 @@ func (p *Pinger) handleResponse(buf []byte, now time.Time, typ string) {
 		return
 	}
 
-	// We assume we sent this if the ID in the response is ours.
-	if uint16(resp.ID) != p.id {
-		p.vlogf("handleResponse: wanted ID=%d; got %d", p.id, resp.ID)
-		return
-	}
-
 	// Search for existing running echo request
 	var o outstanding
 	p.mu.Lock()
+	// We assume we sent this if the ID in the response is ours. The
+	// kernel sets the ID of echo requests sent over datagram sockets,
+	// and only delivers their replies to those sockets.
+	if !p.datagram[typ] && uint16(resp.ID) != p.id {
+		p.mu.Unlock()
+		p.vlogf("handleResponse: wanted ID=%d; got %d", p.id, resp.ID)
+		return
+	}
 	if o, ok = p.pings[uint16(resp.Seq)]; ok {
 		// Ensure that the data matches before we delete from our map,
 		// so a future correct packet will be handled correctly.
@@ -291,15 +324,22 @@ func (p *Pinger) Send(ctx context.Context, dest net.Addr, data []byte) (time.Dur
 	if err != nil {
 		return 0, err
 	}
+	typ := v4Type
 	if ap.Is6() {
 		icmpType = ipv6.ICMPTypeEchoRequest
-		conn, err = p.getConn(ctx, v6Type)
-	} else {
-		conn, err = p.getConn(ctx, v4Type)
+		typ = v6Type
 	}
+	conn, err = p.getConn(ctx, typ)
 	if err != nil {
 		return 0, err
 	}
+	p.mu.Lock()
+	datagram := p.datagram[typ]
+	p.mu.Unlock()
+	if datagram {
+		// Datagram sockets take UDP addresses; the port is ignored.
+		dest = &net.UDPAddr{IP: ap.AsSlice(), Zone: ap.Zone()}
+	}
 
 	m := icmp.Message{
 		Type: icmpType,
@@ -160,6 +160,74 @@ func TestPingerTimeout(t *testing.T) {
 	}
 }
 
+type failingListener struct{}
+
+func (failingListener) ListenPacket(ctx context.Context, typ, addr string) (net.PacketConn, error) {
+	return nil, errors.New("permission denied")
+}
+
+// recordingPacketConn is a PacketConn recording the destinations of its
+// writes.
+type recordingPacketConn struct {
+	net.PacketConn
+	dests chan net.Addr
+}
+
+func (c *recordingPacketConn) WriteTo(b []byte, dest net.Addr) (int, error) {
+	c.dests <- dest
+	return len(b), nil
+}
+
+func TestPingerUnprivileged(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clock := &tstest.Clock{}
+	p := New(ctx, t.Logf, failingListener{})
+	p.timeNow = clock.Now
+	p.Unprivileged = true
+	conn := &recordingPacketConn{dests: make(chan net.Addr, 1)}
+	var gotNetwork string
+	p.listenUnprivileged = func(network, addr string) (net.PacketConn, error) {
+		gotNetwork = network
+		uc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		conn.PacketConn = uc
+		return conn, err
+	}
+	defer p.Close()
+
+	bodyData := []byte("data goes here")
+	r := make(chan error, 1)
+	go func() {
+		_, err := p.Send(ctx, localhost, bodyData)
+		r <- err
+	}()
+	p.waitOutstanding(t, ctx, 1)
+
+	if gotNetwork != "udp4" {
+		t.Errorf("unprivileged network = %q; want udp4", gotNetwork)
+	}
+	if dest := <-conn.dests; dest.String() != "127.0.0.1:0" {
+		t.Errorf("wrote to %v (%T); want UDP address 127.0.0.1:0", dest, dest)
+	}
+
+	// The kernel picks the echo ID for datagram sockets, so a reply
+	// with another ID must still match.
+	fakeResponse := mustMarshal(t, &icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Code: ipv4.ICMPTypeEchoReply.Protocol(),
+		Body: &icmp.Echo{
+			ID:   int(p.id + 1),
+			Seq:  1,
+			Data: bodyData,
+		},
+	})
+	p.handleResponse(fakeResponse, clock.Now(), v4Type)
+	if err := <-r; err != nil {
+		t.Errorf("p.Send: %v", err)
+	}
+}
+
 func TestPingerMismatch(t *testing.T) {
 	clock := &tstest.Clock{}
 
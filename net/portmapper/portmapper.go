@@ -92,6 +92,10 @@ type Client struct {
 
 	localPort uint16
 
+	// wantExternalPort, if non-zero, is the external port to ask for
+	// when creating or renewing a mapping, as set by RequestMapping.
+	wantExternalPort uint16
+
 	mapping mapping // non-nil if we have a mapping
 }
 
@@ -111,6 +115,9 @@ type mapping interface {
 	RenewAfter() time.Time
 	// External indicates what port the mapping can be reached from on the outside.
 	External() netip.AddrPort
+	// MappingType returns the protocol the mapping was made with:
+	// "pmp", "pcp" or "upnp".
+	MappingType() string
 }
 
 // HaveMapping reports whether we have a current valid mapping.
@@ -120,6 +127,58 @@ func (c *Client) HaveMapping() bool {
 	return c.mapping != nil && c.mapping.GoodUntil().After(time.Now())
 }
 
+// MappingStatus describes a port mapping.
+type MappingStatus struct {
+	// External is the mapping's address on the outside of the NAT.
+	External netip.AddrPort
+	// Protocol is the protocol the mapping was made with: "pmp", "pcp"
+	// or "upnp".
+	Protocol string
+	// GoodUntil is when the mapping's lease expires.
+	GoodUntil time.Time
+	// RenewAfter is when the mapping is due to be renewed, which is
+	// done the next time it's wanted after then.
+	RenewAfter time.Time
+}
+
+// Mapping returns the current port mapping, if any. Unlike HaveMapping,
+// it reports a mapping whose lease has expired but that hasn't yet been
+// replaced.
+func (c *Client) Mapping() (ms MappingStatus, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := c.mapping
+	if m == nil {
+		return ms, false
+	}
+	return MappingStatus{
+		External:   m.External(),
+		Protocol:   m.MappingType(),
+		GoodUntil:  m.GoodUntil(),
+		RenewAfter: m.RenewAfter(),
+	}, true
+}
+
+// RequestMapping creates a port mapping now, or renews the current one
+// even if it's not yet due, and returns its external address. If
+// externalPort is non-zero, it's asked for as the external port of this
+// and later mappings, though NATs needn't honor it. The onChange hook
+// registered with NewClient (if any) fires on success.
+//
+// If no mapping is available, the error will be of type NoMappingError;
+// see IsNoMappingError.
+func (c *Client) RequestMapping(ctx context.Context, externalPort uint16) (external netip.AddrPort, err error) {
+	c.mu.Lock()
+	c.wantExternalPort = externalPort
+	c.mu.Unlock()
+
+	external, err = c.createOrRenewMapping(ctx, true)
+	if err == nil && c.onChange != nil {
+		go c.onChange()
+	}
+	return external, err
+}
+
 // pmpMapping is an already-created PMP mapping.
 //
 // All fields are immutable once created.
@@ -141,6 +200,7 @@ func (m *pmpMapping) externalValid() bool {
 func (p *pmpMapping) GoodUntil() time.Time     { return p.goodUntil }
 func (p *pmpMapping) RenewAfter() time.Time    { return p.renewAfter }
 func (p *pmpMapping) External() netip.AddrPort { return p.external }
+func (p *pmpMapping) MappingType() string      { return "pmp" }
 
 // Release does a best effort fire-and-forget release of the PMP mapping m.
 func (m *pmpMapping) Release(ctx context.Context) {
@@ -423,6 +483,12 @@ func (c *Client) createMapping(ctx context.Context) {
 // If no mapping is available, the error will be of type
 // NoMappingError; see IsNoMappingError.
 func (c *Client) createOrGetMapping(ctx context.Context) (external netip.AddrPort, err error) {
+	return c.createOrRenewMapping(ctx, false)
+}
+
+// createOrRenewMapping is like createOrGetMapping, but if renew is set, a
+// cached mapping is renewed even if it's not yet due.
+func (c *Client) createOrRenewMapping(ctx context.Context, renew bool) (external netip.AddrPort, err error) {
 	if c.debug.DisableUPnP && c.debug.DisablePCP && c.debug.DisablePMP {
 		return netip.AddrPort{}, NoMappingError{ErrNoPortMappingServices}
 	}
@@ -445,13 +511,16 @@ func (c *Client) createOrGetMapping(ctx context.Context) (external netip.AddrPor
 	// Do we have an existing mapping that's valid?
 	now := time.Now()
 	if m := c.mapping; m != nil {
-		if now.Before(m.RenewAfter()) {
+		if now.Before(m.RenewAfter()) && !renew {
 			defer c.mu.Unlock()
 			return m.External(), nil
 		}
 		// The mapping might still be valid, so just try to renew it.
 		prevPort = m.External().Port()
 	}
+	if c.wantExternalPort != 0 {
+		prevPort = c.wantExternalPort
+	}
 
 	if c.debug.DisablePCP && c.debug.DisablePMP {
 		c.mu.Unlock()
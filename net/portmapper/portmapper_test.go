@@ -121,4 +121,17 @@ func TestPCPIntegration(t *testing.T) {
 	if c.mapping == nil {
 		t.Errorf("got nil mapping after successful createOrGetMapping")
 	}
+	ms, ok := c.Mapping()
+	if !ok || ms.External != external || ms.Protocol != "pcp" || !ms.GoodUntil.After(ms.RenewAfter) {
+		t.Errorf("Mapping = %+v, %v; want pcp mapping of %v", ms, ok, external)
+	}
+
+	// Force a renewal, which isn't due yet.
+	renewed, err := c.RequestMapping(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("RequestMapping: %v", err)
+	}
+	if ms, ok := c.Mapping(); !ok || ms.External != renewed {
+		t.Errorf("Mapping after RequestMapping = %+v, %v; want %v", ms, ok, renewed)
+	}
 }
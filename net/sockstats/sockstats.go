@@ -12,6 +12,7 @@
 	"context"
 
 	"tailscale.com/net/netmon"
+	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 )
 
@@ -107,6 +108,27 @@ func GetValidation() *ValidationSockStats {
 	return getValidation()
 }
 
+// PeerSockStats contains statistics for sockets instrumented with the
+// WithSockStats() function, broken down by the peer the bytes were
+// exchanged with. Only bytes reported with AddPeerBytes are included, so
+// the statistics are a subset of the total.
+type PeerSockStats struct {
+	Stats map[Label]map[key.NodePublic]SockStat
+}
+
+// AddPeerBytes attributes tx bytes sent and rx bytes received on the
+// socket labeled label to the peer with node key peer, for sockets such as
+// magicsock's that exchange packets with many peers.
+func AddPeerBytes(label Label, peer key.NodePublic, tx, rx int) {
+	addPeerBytes(label, peer, tx, rx)
+}
+
+// GetPeers is a variant of Get that returns the socket statistics reported
+// by AddPeerBytes, broken down by peer.
+func GetPeers() *PeerSockStats {
+	return getPeers()
+}
+
 // SetNetMon configures the sockstats package to monitor the active
 // interface, so that per-interface stats can be collected.
 func SetNetMon(netMon *netmon.Monitor) {
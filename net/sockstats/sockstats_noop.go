@@ -9,6 +9,7 @@
 	"context"
 
 	"tailscale.com/net/netmon"
+	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 )
 
@@ -30,6 +31,13 @@ func getValidation() *ValidationSockStats {
 	return nil
 }
 
+func addPeerBytes(label Label, peer key.NodePublic, tx, rx int) {
+}
+
+func getPeers() *PeerSockStats {
+	return nil
+}
+
 func setNetMon(netMon *netmon.Monitor) {
 }
 
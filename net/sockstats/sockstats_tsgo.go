@@ -17,6 +17,8 @@
 
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netmon"
+	"tailscale.com/syncs"
+	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/clientmetric"
 )
@@ -249,6 +251,54 @@ func getValidation() *ValidationSockStats {
 	return r
 }
 
+// peerLabel identifies the bytes exchanged with a peer on a socket.
+type peerLabel struct {
+	label Label
+	peer  key.NodePublic
+}
+
+type peerSockStatCounters struct {
+	txBytes, rxBytes atomic.Uint64
+}
+
+// peerSockStats holds the counters of AddPeerBytes. It's separate from
+// sockStats so that it can be updated for every packet without holding
+// sockStats.mu.
+var peerSockStats syncs.Map[peerLabel, *peerSockStatCounters]
+
+func addPeerBytes(label Label, peer key.NodePublic, tx, rx int) {
+	k := peerLabel{label, peer}
+	counters, ok := peerSockStats.Load(k)
+	if !ok {
+		counters, _ = peerSockStats.LoadOrStore(k, new(peerSockStatCounters))
+	}
+	if tx > 0 {
+		counters.txBytes.Add(uint64(tx))
+	}
+	if rx > 0 {
+		counters.rxBytes.Add(uint64(rx))
+	}
+}
+
+func getPeers() *PeerSockStats {
+	r := &PeerSockStats{
+		Stats: make(map[Label]map[key.NodePublic]SockStat),
+	}
+	peerSockStats.Range(func(k peerLabel, counters *peerSockStatCounters) bool {
+		byPeer := r.Stats[k.label]
+		if byPeer == nil {
+			byPeer = make(map[key.NodePublic]SockStat)
+			r.Stats[k.label] = byPeer
+		}
+		byPeer[k.peer] = SockStat{
+			TxBytes: counters.txBytes.Load(),
+			RxBytes: counters.rxBytes.Load(),
+		}
+		return true
+	})
+	return r
+}
+
 func setNetMon(netMon *netmon.Monitor) {
 	sockStats.mu.Lock()
 	defer sockStats.mu.Unlock()
@@ -8,6 +8,8 @@
 import (
 	"testing"
 	"time"
+
+	"tailscale.com/types/key"
 )
 
 type testTime struct {
@@ -100,3 +102,24 @@ func(tt *testTime, rm *radioMonitor) {
 		})
 	}
 }
+
+func TestPeerBytes(t *testing.T) {
+	a, b := key.NewNode().Public(), key.NewNode().Public()
+	AddPeerBytes(LabelMagicsockConnUDP4, a, 100, 0)
+	AddPeerBytes(LabelMagicsockConnUDP4, a, 0, 50)
+	AddPeerBytes(LabelMagicsockConnUDP6, a, 10, 0)
+	AddPeerBytes(LabelMagicsockConnUDP4, b, 0, 7)
+
+	got := GetPeers().Stats
+	want := map[Label]map[key.NodePublic]SockStat{
+		LabelMagicsockConnUDP4: {a: {TxBytes: 100, RxBytes: 50}, b: {RxBytes: 7}},
+		LabelMagicsockConnUDP6: {a: {TxBytes: 10}},
+	}
+	for label, byPeer := range want {
+		for peer, stat := range byPeer {
+			if got[label][peer] != stat {
+				t.Errorf("%v %v = %+v; want %+v", label, peer.ShortString(), got[label][peer], stat)
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tsdial
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+	"tailscale.com/net/tshttpproxy"
+)
+
+// ProxyDial connects to addr through the proxy at proxyURL, reaching the
+// proxy itself with SystemDial.
+//
+// The proxyURL scheme selects the protocol: "socks5" and "socks5h" use a
+// SOCKS5 CONNECT, "http" and "https" use an HTTP CONNECT request. Only TCP
+// networks are supported.
+func (d *Dialer) ProxyDial(ctx context.Context, proxyURL *url.URL, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("proxy dial requires tcp; %q not supported", network)
+	}
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		return d.dialSOCKS5(ctx, proxyURL, network, addr)
+	case "http", "https":
+		return d.dialHTTPConnect(ctx, proxyURL, addr)
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+}
+
+// systemContextDialer adapts Dialer.SystemDial to proxy.ContextDialer.
+type systemContextDialer struct {
+	d *Dialer
+}
+
+func (sd systemContextDialer) Dial(network, addr string) (net.Conn, error) {
+	return sd.d.SystemDial(context.Background(), network, addr)
+}
+
+func (sd systemContextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return sd.d.SystemDial(ctx, network, addr)
+}
+
+func (d *Dialer) dialSOCKS5(ctx context.Context, proxyURL *url.URL, network, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if u := proxyURL.User; u != nil {
+		auth = &proxy.Auth{User: u.Username()}
+		auth.Password, _ = u.Password()
+	}
+	pd, err := proxy.SOCKS5("tcp", hostPortOrDefault(proxyURL, "1080"), auth, systemContextDialer{d})
+	if err != nil {
+		return nil, err
+	}
+	cd, ok := pd.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("SOCKS5 dialer %T does not support contexts", pd)
+	}
+	return cd.DialContext(ctx, network, addr)
+}
+
+func (d *Dialer) dialHTTPConnect(ctx context.Context, proxyURL *url.URL, addr string) (proxyConn net.Conn, err error) {
+	defPort := "80"
+	if proxyURL.Scheme == "https" {
+		defPort = "443"
+	}
+	proxyConn, err = d.SystemDial(ctx, "tcp", hostPortOrDefault(proxyURL, defPort))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			proxyConn.Close()
+		}
+	}()
+	if proxyURL.Scheme == "https" {
+		tc := tls.Client(proxyConn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		proxyConn = tc
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			proxyConn.Close()
+		}
+	}()
+
+	var authHeader string
+	if v, err := tshttpproxy.GetAuthHeader(proxyURL); err != nil {
+		d.logf("tsdial: error getting proxy auth header for %v: %v", proxyURL.Redacted(), err)
+	} else if v != "" {
+		authHeader = fmt.Sprintf("Proxy-Authorization: %s\r\n", v)
+	}
+	if _, err := fmt.Fprintf(proxyConn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", addr, addr, authHeader); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	br := bufio.NewReader(proxyConn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("invalid response status from HTTP proxy %s on CONNECT to %s: %v", proxyURL.Redacted(), addr, res.Status)
+	}
+	if br.Buffered() > 0 {
+		return nil, fmt.Errorf("HTTP proxy %s sent unexpected data after CONNECT response", proxyURL.Redacted())
+	}
+	return proxyConn, nil
+}
+
+// hostPortOrDefault returns the host:port of u, using defPort if u
+// doesn't specify a port.
+func hostPortOrDefault(u *url.URL, defPort string) string {
+	port := u.Port()
+	if port == "" {
+		port = defPort
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func (d *Dialer) logf(format string, args ...any) {
+	if d.Logf != nil {
+		d.Logf(format, args...)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tsdial
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"tailscale.com/net/socks5"
+)
+
+// startEchoServer starts a TCP server that echoes back what it reads and
+// returns its address.
+func startEchoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startConnectProxy starts a minimal HTTP CONNECT proxy and returns its
+// address.
+func startConnectProxy(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil || req.Method != "CONNECT" {
+					return
+				}
+				backend, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer backend.Close()
+				io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n")
+				go io.Copy(backend, c)
+				io.Copy(c, backend)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestProxyDial(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	socksLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socksSrv := &socks5.Server{Logf: t.Logf}
+	go socksSrv.Serve(socksLn)
+	t.Cleanup(func() { socksLn.Close() })
+
+	tests := []struct {
+		name     string
+		proxyURL string
+	}{
+		{"socks5", "socks5://" + socksLn.Addr().String()},
+		{"http", "http://" + startConnectProxy(t)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Dialer{Logf: t.Logf}
+			defer d.Close()
+			u, err := url.Parse(tt.proxyURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			c, err := d.ProxyDial(ctx, u, "tcp", echoAddr)
+			if err != nil {
+				t.Fatalf("ProxyDial: %v", err)
+			}
+			defer c.Close()
+			const msg = "hello"
+			if _, err := io.WriteString(c, msg); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(c, buf); err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != msg {
+				t.Errorf("got %q; want %q", buf, msg)
+			}
+		})
+	}
+}
+
+func TestProxyDialUnsupported(t *testing.T) {
+	d := &Dialer{Logf: t.Logf}
+	defer d.Close()
+	ctx := context.Background()
+	if _, err := d.ProxyDial(ctx, &url.URL{Scheme: "ftp", Host: "127.0.0.1:1"}, "tcp", "127.0.0.1:2"); err == nil {
+		t.Error("ProxyDial with ftp scheme succeeded; want error")
+	}
+	if _, err := d.ProxyDial(ctx, &url.URL{Scheme: "socks5", Host: "127.0.0.1:1"}, "udp", "127.0.0.1:2"); err == nil {
+		t.Error("ProxyDial with udp network succeeded; want error")
+	}
+}
@@ -22,6 +22,7 @@
 	"go4.org/mem"
 	"golang.org/x/exp/slices"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/stack/gro"
 	"tailscale.com/disco"
 	"tailscale.com/net/connstats"
 	"tailscale.com/net/packet"
@@ -153,6 +154,15 @@ type Wrapper struct {
 	PreFilterPacketInboundFromWireGuard FilterFunc
 	// PostFilterPacketInboundFromWireGaurd is the inbound filter function that runs after the main filter.
 	PostFilterPacketInboundFromWireGaurd FilterFunc
+	// PostFilterPacketInboundFromWireGuardGRO, if non-nil, is used in place of
+	// PostFilterPacketInboundFromWireGaurd by a hook that coalesces the packets
+	// of each vector Write is passed with GRO. It's passed the GRO it returned
+	// for the vector's previous packet, or nil for its first.
+	PostFilterPacketInboundFromWireGuardGRO func(*packet.Parsed, *Wrapper, *gro.GRO) (filter.Response, *gro.GRO)
+	// EndPacketVectorInboundFromWireGuardFlush is called with the GRO returned by
+	// PostFilterPacketInboundFromWireGuardGRO for the last packet of a vector,
+	// if non-nil, to flush it. It must be set if PostFilterPacketInboundFromWireGuardGRO is.
+	EndPacketVectorInboundFromWireGuardFlush func(*gro.GRO)
 	// PreFilterPacketOutboundToWireGuardNetstackIntercept is a filter function that runs before the main filter
 	// for packets from the local system. This filter is populated by netstack to hook
 	// packets that should be handled by netstack. If set, this filter runs before
@@ -188,6 +198,8 @@ type Wrapper struct {
 	stats atomic.Pointer[connstats.Statistics]
 
 	captureHook syncs.AtomicValue[capture.Callback]
+	// captureFilter is the filter of captureHook, if any.
+	captureFilter atomic.Pointer[capture.Filter]
 }
 
 // tunInjectedRead is an injected packet pretending to be a tun.Read().
@@ -753,7 +765,7 @@ func (t *Wrapper) Read(buffs [][]byte, sizes []int, offset int) (int, error) {
 				fn()
 			}
 		}
-		if captHook != nil {
+		if captHook != nil && t.captureMatches(capture.FromLocal, p) {
 			captHook(capture.FromLocal, t.now(), p.Buffer(), p.CaptureMeta)
 		}
 		if !t.disableFilter {
@@ -819,8 +831,8 @@ func (t *Wrapper) injectedRead(res tunInjectedRead, buf []byte, offset int) (int
 	return n, nil
 }
 
-func (t *Wrapper) filterPacketInboundFromWireGuard(p *packet.Parsed, captHook capture.Callback) filter.Response {
-	if captHook != nil {
+func (t *Wrapper) filterPacketInboundFromWireGuard(p *packet.Parsed, captHook capture.Callback, g *gro.GRO) (filter.Response, *gro.GRO) {
+	if captHook != nil && t.captureMatches(capture.FromPeer, p) {
 		captHook(capture.FromPeer, t.now(), p.Buffer(), p.CaptureMeta)
 	}
 
@@ -828,7 +840,7 @@ func (t *Wrapper) filterPacketInboundFromWireGuard(p *packet.Parsed, captHook ca
 		if pingReq, ok := p.AsTSMPPing(); ok {
 			t.noteActivity()
 			t.injectOutboundPong(p, pingReq)
-			return filter.DropSilently
+			return filter.DropSilently, g
 		} else if data, ok := p.AsTSMPPong(); ok {
 			if f := t.OnTSMPPongReceived; f != nil {
 				f(data)
@@ -840,7 +852,7 @@ func (t *Wrapper) filterPacketInboundFromWireGuard(p *packet.Parsed, captHook ca
 		if f := t.OnICMPEchoResponseReceived; f != nil && f(p) {
 			// Note: this looks dropped in metrics, even though it was
 			// handled internally.
-			return filter.DropSilently
+			return filter.DropSilently, g
 		}
 	}
 
@@ -852,18 +864,18 @@ func (t *Wrapper) filterPacketInboundFromWireGuard(p *packet.Parsed, captHook ca
 		t.isSelfDisco(p) {
 		t.limitedLogf("[unexpected] received self disco in packet over tstun; dropping")
 		metricPacketInDropSelfDisco.Add(1)
-		return filter.DropSilently
+		return filter.DropSilently, g
 	}
 
 	if t.PreFilterPacketInboundFromWireGuard != nil {
 		if res := t.PreFilterPacketInboundFromWireGuard(p, t); res.IsDrop() {
-			return res
+			return res, g
 		}
 	}
 
 	filt := t.filter.Load()
 	if filt == nil {
-		return filter.Drop
+		return filter.Drop, g
 	}
 
 	outcome := filt.RunIn(p, t.filterFlags)
@@ -904,21 +916,26 @@ func (t *Wrapper) filterPacketInboundFromWireGuard(p *packet.Parsed, captHook ca
 			// TODO(bradfitz): also send a TCP RST, after the TSMP message.
 		}
 
-		return filter.Drop
+		return filter.Drop, g
 	}
 
-	if t.PostFilterPacketInboundFromWireGaurd != nil {
-		if res := t.PostFilterPacketInboundFromWireGaurd(p, t); res.IsDrop() {
-			if res == filter.DropSilently {
-				if stats := t.stats.Load(); stats != nil {
-					stats.UpdateRxVirtual(p.Buffer())
-				}
+	res := filter.Accept
+	switch {
+	case t.PostFilterPacketInboundFromWireGuardGRO != nil:
+		res, g = t.PostFilterPacketInboundFromWireGuardGRO(p, t, g)
+	case t.PostFilterPacketInboundFromWireGaurd != nil:
+		res = t.PostFilterPacketInboundFromWireGaurd(p, t)
+	}
+	if res.IsDrop() {
+		if res == filter.DropSilently {
+			if stats := t.stats.Load(); stats != nil {
+				stats.UpdateRxVirtual(p.Buffer())
 			}
-			return res
 		}
+		return res, g
 	}
 
-	return filter.Accept
+	return filter.Accept, g
 }
 
 // Write accepts incoming packets. The packets begins at buffs[:][offset:],
@@ -929,11 +946,13 @@ func (t *Wrapper) Write(buffs [][]byte, offset int) (int, error) {
 	p := parsedPacketPool.Get().(*packet.Parsed)
 	defer parsedPacketPool.Put(p)
 	captHook := t.captureHook.Load()
+	var g *gro.GRO
 	for _, buff := range buffs {
 		p.Decode(buff[offset:])
 		t.dnatV4(p)
 		if !t.disableFilter {
-			if t.filterPacketInboundFromWireGuard(p, captHook) != filter.Accept {
+			var res filter.Response
+			if res, g = t.filterPacketInboundFromWireGuard(p, captHook, g); res != filter.Accept {
 				metricPacketInDrop.Add(1)
 			} else {
 				buffs[i] = buff
@@ -941,6 +960,9 @@ func (t *Wrapper) Write(buffs [][]byte, offset int) (int, error) {
 			}
 		}
 	}
+	if g != nil {
+		t.EndPacketVectorInboundFromWireGuardFlush(g)
+	}
 	if t.disableFilter {
 		i = len(buffs)
 	}
@@ -993,7 +1015,7 @@ func (t *Wrapper) InjectInboundPacketBuffer(pkt *stack.PacketBuffer) error {
 	defer parsedPacketPool.Put(p)
 	p.Decode(buf[PacketStartOffset:])
 	captHook := t.captureHook.Load()
-	if captHook != nil {
+	if captHook != nil && t.captureMatches(capture.SynthesizedToLocal, p) {
 		captHook(capture.SynthesizedToLocal, t.now(), p.Buffer(), p.CaptureMeta)
 	}
 	t.dnatV4(p)
@@ -1097,8 +1119,14 @@ func (t *Wrapper) InjectOutboundPacketBuffer(pkt *stack.PacketBuffer) error {
 		return nil
 	}
 	if capt := t.captureHook.Load(); capt != nil {
-		b := pkt.ToBuffer()
-		capt(capture.SynthesizedToPeer, t.now(), b.Flatten(), packet.CaptureMeta{})
+		// Check what can be before flattening the packet.
+		if f := t.captureFilter.Load(); f.Match(capture.SynthesizedToPeer, size) {
+			buf := pkt.ToBuffer()
+			b := buf.Flatten()
+			if captureAddrsMatch(f, b) {
+				capt(capture.SynthesizedToPeer, t.now(), b, packet.CaptureMeta{})
+			}
+		}
 	}
 
 	t.injectOutbound(tunInjectedRead{packet: pkt})
@@ -1133,5 +1161,31 @@ func (t *Wrapper) SetStatistics(stats *connstats.Statistics) {
 )
 
 func (t *Wrapper) InstallCaptureHook(cb capture.Callback) {
+	t.InstallFilteredCaptureHook(cb, nil)
+}
+
+// InstallFilteredCaptureHook is like InstallCaptureHook, but cb is only
+// called for the packets f matches, by their path, size and addresses;
+// f's Peers don't apply. A nil f matches all packets.
+func (t *Wrapper) InstallFilteredCaptureHook(cb capture.Callback, f *capture.Filter) {
+	t.captureFilter.Store(f)
 	t.captureHook.Store(cb)
 }
+
+// captureMatches reports whether p, on path, matches the capture filter.
+func (t *Wrapper) captureMatches(path capture.Path, p *packet.Parsed) bool {
+	f := t.captureFilter.Load()
+	return f.Match(path, len(p.Buffer())) && f.MatchAddrs(p.Src.Addr(), p.Dst.Addr())
+}
+
+// captureAddrsMatch reports whether the addresses of the IP packet b match
+// f, decoding b only if f needs them.
+func captureAddrsMatch(f *capture.Filter, b []byte) bool {
+	if f == nil || len(f.Addrs) == 0 {
+		return true
+	}
+	p := parsedPacketPool.Get().(*packet.Parsed)
+	defer parsedPacketPool.Put(p)
+	p.Decode(b)
+	return f.MatchAddrs(p.Src.Addr(), p.Dst.Addr())
+}
@@ -25,6 +25,7 @@
 	"go4.org/netipx"
 	"gvisor.dev/gvisor/pkg/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/stack/gro"
 	"tailscale.com/disco"
 	"tailscale.com/net/connstats"
 	"tailscale.com/net/netaddr"
@@ -551,7 +552,7 @@ func TestPeerAPIBypass(t *testing.T) {
 			tt.w.SetFilter(tt.filter)
 			tt.w.disableTSMPRejected = true
 			tt.w.logf = t.Logf
-			if got := tt.w.filterPacketInboundFromWireGuard(p, nil); got != tt.want {
+			if got, _ := tt.w.filterPacketInboundFromWireGuard(p, nil, nil); got != tt.want {
 				t.Errorf("got = %v; want %v", got, tt.want)
 			}
 		})
@@ -581,7 +582,7 @@ func TestFilterDiscoLoop(t *testing.T) {
 
 	p := new(packet.Parsed)
 	p.Decode(pkt)
-	got := tw.filterPacketInboundFromWireGuard(p, nil)
+	got, _ := tw.filterPacketInboundFromWireGuard(p, nil, nil)
 	if got != filter.DropSilently {
 		t.Errorf("got %v; want DropSilently", got)
 	}
@@ -884,3 +885,30 @@ type captureRecord struct {
 			captured, want)
 	}
 }
+
+func TestWriteGRO(t *testing.T) {
+	_, tun := newFakeTUN(t.Logf, true)
+	defer tun.Close()
+
+	want := new(gro.GRO)
+	var passed []*gro.GRO
+	tun.PostFilterPacketInboundFromWireGuardGRO = func(p *packet.Parsed, _ *Wrapper, g *gro.GRO) (filter.Response, *gro.GRO) {
+		passed = append(passed, g)
+		return filter.DropSilently, want
+	}
+	var flushed []*gro.GRO
+	tun.EndPacketVectorInboundFromWireGuardFlush = func(g *gro.GRO) {
+		flushed = append(flushed, g)
+	}
+
+	pkt := udp4("5.6.7.8", "1.2.3.4", 98, 89)
+	if _, err := tun.Write([][]byte{pkt, bytes.Clone(pkt), bytes.Clone(pkt)}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(passed) != 3 || passed[0] != nil || passed[1] != want || passed[2] != want {
+		t.Errorf("GROs passed to hook = %p; want [nil %p %p]", passed, want, want)
+	}
+	if len(flushed) != 1 || flushed[0] != want {
+		t.Errorf("GROs flushed = %p; want [%p]", flushed, want)
+	}
+}
@@ -105,7 +105,8 @@
 //   - 65: 2023-07-12: Client understands DERPMap.HomeParams + incremental DERPMap updates with params
 //   - 66: 2023-07-23: UserProfile.Groups added (available via WhoIs)
 //   - 67: 2023-07-25: Client understands PeerCapMap
-const CurrentCapabilityVersion CapabilityVersion = 67
+//   - 68: 2026-10-16: Client understands Node.ProbeOnly
+const CurrentCapabilityVersion CapabilityVersion = 68
 
 type StableID string
 
@@ -335,6 +336,11 @@ type Node struct {
 	// order to be reachable. TODO(#7826): 2023-04-06: only the first parseable
 	// Endpoint is used, see #7826 for updates.
 	IsWireGuardOnly bool `json:",omitempty"`
+
+	// ProbeOnly indicates that this peer is only measured: the client runs
+	// discovery and latency probes to it, but never configures it in
+	// WireGuard, so no traffic is sent to it.
+	ProbeOnly bool `json:",omitempty"`
 }
 
 // DisplayName returns the user-facing name for a node which should
@@ -735,6 +741,11 @@ type NetInfo struct {
 	// the control plane.
 	DERPLatency map[string]float64 `json:",omitempty"`
 
+	// CaptivePortalURL, if non-empty, is where a captive portal
+	// intercepting the node's HTTP traffic redirected it, typically
+	// so the user logs in.
+	CaptivePortalURL string `json:",omitempty"`
+
 	// Update BasicallyEqual when adding fields.
 }
 
@@ -793,7 +804,8 @@ func (ni *NetInfo) BasicallyEqual(ni2 *NetInfo) bool {
 		ni.PMP == ni2.PMP &&
 		ni.PCP == ni2.PCP &&
 		ni.PreferredDERP == ni2.PreferredDERP &&
-		ni.LinkType == ni2.LinkType
+		ni.LinkType == ni2.LinkType &&
+		ni.CaptivePortalURL == ni2.CaptivePortalURL
 }
 
 // Equal reports whether h and h2 are equal.
@@ -1036,6 +1048,7 @@ type RegisterResponse struct {
 	EndpointSTUN           = EndpointType(2)
 	EndpointPortmapped     = EndpointType(3)
 	EndpointSTUN4LocalPort = EndpointType(4) // hard NAT: STUN'ed IPv4 address + local fixed port
+	EndpointExplicitConf   = EndpointType(5) // explicitly configured by the embedder (e.g. a load balancer's DNAT'd port)
 )
 
 func (et EndpointType) String() string {
@@ -1050,6 +1063,8 @@ func (et EndpointType) String() string {
 		return "portmap"
 	case EndpointSTUN4LocalPort:
 		return "stun4localport"
+	case EndpointExplicitConf:
+		return "explicitconf"
 	}
 	return "other"
 }
@@ -1863,7 +1878,8 @@ func (n *Node) Equal(n2 *Node) bool {
 		eqStrings(n.Tags, n2.Tags) &&
 		n.Expired == n2.Expired &&
 		eqPtr(n.SelfNodeV4MasqAddrForThisPeer, n2.SelfNodeV4MasqAddrForThisPeer) &&
-		n.IsWireGuardOnly == n2.IsWireGuardOnly
+		n.IsWireGuardOnly == n2.IsWireGuardOnly &&
+		n.ProbeOnly == n2.ProbeOnly
 }
 
 func eqPtr[T comparable](a, b *T) bool {
@@ -104,6 +104,7 @@ func (src *Node) Clone() *Node {
 	Expired                       bool
 	SelfNodeV4MasqAddrForThisPeer *netip.Addr
 	IsWireGuardOnly               bool
+	ProbeOnly                     bool
 }{})
 
 // Clone makes a deep copy of Hostinfo.
@@ -196,6 +197,7 @@ func (src *NetInfo) Clone() *NetInfo {
 	PreferredDERP         int
 	LinkType              string
 	DERPLatency           map[string]float64
+	CaptivePortalURL      string
 }{})
 
 // Clone makes a deep copy of Login.
@@ -352,7 +352,7 @@ func TestNodeEqual(t *testing.T) {
 		"UnsignedPeerAPIOnly",
 		"ComputedName", "computedHostIfDifferent", "ComputedNameWithHost",
 		"DataPlaneAuditLogID", "Expired", "SelfNodeV4MasqAddrForThisPeer",
-		"IsWireGuardOnly",
+		"IsWireGuardOnly", "ProbeOnly",
 	}
 	if have := fieldsOf(reflect.TypeOf(Node{})); !reflect.DeepEqual(have, nodeHandles) {
 		t.Errorf("Node.Equal check might be out of sync\nfields: %q\nhandled: %q\n",
@@ -571,6 +571,7 @@ func TestNetInfoFields(t *testing.T) {
 		"PreferredDERP",
 		"LinkType",
 		"DERPLatency",
+		"CaptivePortalURL",
 	}
 	if have := fieldsOf(reflect.TypeOf(NetInfo{})); !reflect.DeepEqual(have, handled) {
 		t.Errorf("NetInfo.Clone/BasicallyEqually check might be out of sync\nfields: %q\nhandled: %q\n",
@@ -671,12 +672,13 @@ func TestEndpointTypeMarshal(t *testing.T) {
 		EndpointSTUN,
 		EndpointPortmapped,
 		EndpointSTUN4LocalPort,
+		EndpointExplicitConf,
 	}
 	got, err := json.Marshal(eps)
 	if err != nil {
 		t.Fatal(err)
 	}
-	const want = `[0,1,2,3,4]`
+	const want = `[0,1,2,3,4,5]`
 	if string(got) != want {
 		t.Errorf("got %s; want %s", got, want)
 	}
@@ -185,6 +185,7 @@ func (v NodeView) SelfNodeV4MasqAddrForThisPeer() *netip.Addr {
 }
 
 func (v NodeView) IsWireGuardOnly() bool  { return v.ж.IsWireGuardOnly }
+func (v NodeView) ProbeOnly() bool        { return v.ж.ProbeOnly }
 func (v NodeView) Equal(v2 NodeView) bool { return v.ж.Equal(v2.ж) }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
@@ -221,6 +222,7 @@ func (v NodeView) Equal(v2 NodeView) bool { return v.ж.Equal(v2.ж) }
 	Expired                       bool
 	SelfNodeV4MasqAddrForThisPeer *netip.Addr
 	IsWireGuardOnly               bool
+	ProbeOnly                     bool
 }{})
 
 // View returns a readonly view of Hostinfo.
@@ -410,6 +412,7 @@ func (v NetInfoView) PreferredDERP() int              { return v.ж.PreferredDER
 func (v NetInfoView) LinkType() string                { return v.ж.LinkType }
 
 func (v NetInfoView) DERPLatency() views.Map[string, float64] { return views.MapOf(v.ж.DERPLatency) }
+func (v NetInfoView) CaptivePortalURL() string                { return v.ж.CaptivePortalURL }
 func (v NetInfoView) String() string                          { return v.ж.String() }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
@@ -427,6 +430,7 @@ func (v NetInfoView) String() string                          { return v.ж.Stri
 	PreferredDERP         int
 	LinkType              string
 	DERPLatency           map[string]float64
+	CaptivePortalURL      string
 }{})
 
 // View returns a readonly view of Login.
@@ -13,6 +13,7 @@
 package mono
 
 import (
+	"encoding/json"
 	"fmt"
 	"sync/atomic"
 	"time"
@@ -102,6 +103,12 @@ func (t Time) WallTime() time.Time {
 	return time.Time{}
 }
 
+// FromWall returns the Time approximately corresponding to the wall time t.
+// It's the inverse of WallTime, and is as approximate.
+func FromWall(t time.Time) Time {
+	return baseMono.Add(t.Sub(baseWall))
+}
+
 // MarshalJSON formats t for JSON as if it were a time.Time.
 // We format Time this way for backwards-compatibility.
 // Time does not survive a MarshalJSON/UnmarshalJSON round trip unchanged
@@ -126,6 +133,61 @@ func (t *Time) UnmarshalJSON(data []byte) error {
 		*t = 0
 		return nil
 	}
-	*t = baseMono.Add(tt.Sub(baseWall))
+	*t = FromWall(tt)
+	return nil
+}
+
+// Stamp is an instant recorded on both the monotonic clock and the wall
+// clock. Time.WallTime only estimates the wall time from the process start,
+// which drifts once the machine has been suspended (the monotonic clock
+// doesn't advance while suspended on most platforms). A Stamp reads both
+// clocks when the event happens, so its Wall can be correlated with
+// external logs while its Mono gives durations immune to wall clock steps.
+type Stamp struct {
+	Mono Time
+	Wall time.Time // without a monotonic clock reading
+}
+
+// NowStamp returns a Stamp for the current instant.
+func NowStamp() Stamp {
+	return Stamp{Mono: Now(), Wall: time.Now().Round(0)}
+}
+
+// IsZero reports whether s is the zero Stamp.
+func (s Stamp) IsZero() bool {
+	return s.Mono.IsZero() && s.Wall.IsZero()
+}
+
+// Sub returns the monotonic duration s-n.
+func (s Stamp) Sub(n Stamp) time.Duration {
+	return s.Mono.Sub(n.Mono)
+}
+
+// String returns s's wall time followed by its monotonic time.
+func (s Stamp) String() string {
+	return fmt.Sprintf("%v (mono=%d)", s.Wall, int64(s.Mono))
+}
+
+// stampJSON is the JSON representation of a Stamp. Unlike Time, the
+// monotonic time is encoded in nanoseconds, since Wall carries the wall
+// clock time.
+type stampJSON struct {
+	Mono int64
+	Wall time.Time
+}
+
+// MarshalJSON encodes s as an object with its monotonic time in
+// nanoseconds and its wall time.
+func (s Stamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(stampJSON{Mono: int64(s.Mono), Wall: s.Wall})
+}
+
+// UnmarshalJSON sets s from data, as produced by MarshalJSON.
+func (s *Stamp) UnmarshalJSON(data []byte) error {
+	var sj stampJSON
+	if err := json.Unmarshal(data, &sj); err != nil {
+		return err
+	}
+	*s = Stamp{Mono: Time(sj.Mono), Wall: sj.Wall}
 	return nil
 }
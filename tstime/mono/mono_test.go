@@ -48,6 +48,41 @@ func TestJSONRoundtrip(t *testing.T) {
 	}
 }
 
+func TestStamp(t *testing.T) {
+	s0 := NowStamp()
+	time.Sleep(10 * time.Millisecond)
+	s1 := NowStamp()
+	if d := s1.Sub(s0); d < 10*time.Millisecond {
+		t.Errorf("Sub = %v; want >= 10ms", d)
+	}
+	if !s1.Wall.After(s0.Wall) {
+		t.Errorf("wall times not increasing: %v, %v", s0.Wall, s1.Wall)
+	}
+
+	b, err := json.Marshal(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Stamp
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Mono != s1.Mono || !got.Wall.Equal(s1.Wall) {
+		t.Errorf("JSON round trip = %v; want %v", got, s1)
+	}
+}
+
+func TestFromWall(t *testing.T) {
+	m := Now()
+	if got := FromWall(m.WallTime()); got.Sub(m).Abs() > time.Microsecond {
+		t.Errorf("FromWall(WallTime()) = %v; want %v", got, m)
+	}
+	wall := time.Now()
+	if got := FromWall(wall.Add(time.Hour)).Sub(FromWall(wall)); got != time.Hour {
+		t.Errorf("FromWall difference = %v; want 1h", got)
+	}
+}
+
 func BenchmarkMonoNow(b *testing.B) {
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
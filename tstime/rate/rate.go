@@ -65,17 +65,7 @@ func (lim *Limiter) allow(now mono.Time) bool {
 	lim.mu.Lock()
 	defer lim.mu.Unlock()
 
-	// If time has moved backwards, look around awkwardly and pretend nothing happened.
-	if now.Before(lim.last) {
-		lim.last = now
-	}
-
-	// Calculate the new number of tokens available due to the passage of time.
-	elapsed := now.Sub(lim.last)
-	tokens := lim.tokens + float64(lim.limit)*elapsed.Seconds()
-	if tokens > lim.burst {
-		tokens = lim.burst
-	}
+	tokens := lim.advanceLocked(now)
 
 	// Consume a token.
 	tokens--
@@ -88,3 +78,31 @@ func (lim *Limiter) allow(now mono.Time) bool {
 	}
 	return ok
 }
+
+// Tokens returns the number of tokens available now, without consuming any.
+// An event may happen if it's at least 1.
+func (lim *Limiter) Tokens() float64 {
+	return lim.tokensAt(mono.Now())
+}
+
+func (lim *Limiter) tokensAt(now mono.Time) float64 {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	return lim.advanceLocked(now)
+}
+
+// advanceLocked returns the number of tokens in the bucket at now.
+func (lim *Limiter) advanceLocked(now mono.Time) float64 {
+	// If time has moved backwards, look around awkwardly and pretend nothing happened.
+	if now.Before(lim.last) {
+		lim.last = now
+	}
+
+	// Calculate the new number of tokens available due to the passage of time.
+	elapsed := now.Sub(lim.last)
+	tokens := lim.tokens + float64(lim.limit)*elapsed.Seconds()
+	if tokens > lim.burst {
+		tokens = lim.burst
+	}
+	return tokens
+}
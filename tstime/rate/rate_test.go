@@ -110,6 +110,28 @@ func TestLimiterJumpBackwards(t *testing.T) {
 	})
 }
 
+func TestLimiterTokens(t *testing.T) {
+	lim := NewLimiter(10, 2)
+	if got := lim.tokensAt(t0); got != 2 {
+		t.Errorf("tokens at start = %v; want 2", got)
+	}
+	// Looking at the tokens doesn't consume any.
+	if got := lim.tokensAt(t0); got != 2 {
+		t.Errorf("tokens after looking = %v; want 2", got)
+	}
+	lim.allow(t0)
+	lim.allow(t0)
+	if got := lim.tokensAt(t0); got != 0 {
+		t.Errorf("tokens after 2 events = %v; want 0", got)
+	}
+	if got := lim.tokensAt(t1); got != 1 {
+		t.Errorf("tokens after refill = %v; want 1", got)
+	}
+	if got := lim.tokensAt(t9); got != 2 {
+		t.Errorf("tokens after long refill = %v; want 2 (burst)", got)
+	}
+}
+
 // Ensure that tokensFromDuration doesn't produce
 // rounding errors by truncating nanoseconds.
 // See golang.org/issues/34861.
@@ -14,6 +14,10 @@
 )
 
 const (
+	// discoPrivateHexPrefix is the prefix used to identify a
+	// hex-encoded disco private key.
+	discoPrivateHexPrefix = "discoprivkey:"
+
 	// discoPublicHexPrefix is the prefix used to identify a
 	// hex-encoded disco public key.
 	//
@@ -51,6 +55,16 @@ func (k DiscoPrivate) Equal(other DiscoPrivate) bool {
 	return subtle.ConstantTimeCompare(k.k[:], other.k[:]) == 1
 }
 
+// MarshalText implements encoding.TextMarshaler.
+func (k DiscoPrivate) MarshalText() ([]byte, error) {
+	return toHex(k.k[:], discoPrivateHexPrefix), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (k *DiscoPrivate) UnmarshalText(b []byte) error {
+	return parseHex(k.k[:], mem.B(b), mem.S(discoPrivateHexPrefix))
+}
+
 // Public returns the DiscoPublic for k.
 // Panics if DiscoPrivate is zero.
 func (k DiscoPrivate) Public() DiscoPublic {
@@ -81,3 +81,24 @@ func TestDiscoShared(t *testing.T) {
 		t.Error("k1.Shared(k2) != k2.Shared(k1)")
 	}
 }
+
+func TestDiscoPrivateSerialization(t *testing.T) {
+	k := NewDisco()
+	bs, err := json.Marshal(struct{ Priv DiscoPrivate }{k})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(bs, []byte(`"discoprivkey:`)) {
+		t.Errorf("serialized key %s lacks discoprivkey: prefix", bs)
+	}
+	var got struct{ Priv DiscoPrivate }
+	if err := json.Unmarshal(bs, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Priv.Equal(k) {
+		t.Error("json serialization doesn't roundtrip")
+	}
+	if got.Priv.Public() != k.Public() {
+		t.Error("roundtripped key has a different public key")
+	}
+}
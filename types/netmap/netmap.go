@@ -322,6 +322,12 @@ func (nm *NetworkMap) JSON() string {
 const (
 	AllowSingleHosts WGConfigFlags = 1 << iota
 	AllowSubnetRoutes
+
+	// KeepAliveAllPeers sets a WireGuard persistent keepalive for
+	// every peer, not just those with tailcfg.Node.KeepAlive. It's for
+	// use with magicsock's silent disco, which leaves keeping NAT
+	// mappings open to WireGuard.
+	KeepAliveAllPeers
 )
 
 // eqStringsIgnoreNil reports whether a and b have the same length and
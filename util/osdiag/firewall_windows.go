@@ -0,0 +1,388 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package osdiag
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	"golang.org/x/sys/windows/registry"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"inet.af/wf"
+)
+
+const firewallPolicyKey = `SYSTEM\CurrentControlSet\Services\SharedAccess\Parameters\FirewallPolicy`
+
+// firewallRuleKeys are the registry keys holding the Windows Firewall
+// rules, by where they come from.
+var firewallRuleKeys = []struct {
+	source string
+	subKey string
+}{
+	{"local", firewallPolicyKey + `\FirewallRules`},
+	{"policy", `SOFTWARE\Policies\Microsoft\WindowsFirewall\FirewallRules`},
+}
+
+// firewallProfileKeys are the registry keys of the Windows Firewall
+// profiles, by the profile names shown to users.
+var firewallProfileKeys = map[string]string{
+	"domain":  firewallPolicyKey + `\DomainProfile`,
+	"private": firewallPolicyKey + `\StandardProfile`,
+	"public":  firewallPolicyKey + `\PublicProfile`,
+}
+
+// firewallTarget is what the support info reports the firewall rules and
+// WFP filters affecting: tailscaled's executable, UDP port and TUN
+// interface. Its zero fields are unknown and match nothing.
+type firewallTarget struct {
+	exe     string // path of the executable, lowercased
+	port    uint16
+	tunName string
+	tunLUID uint64
+	tunGUID string // in braces, lowercased
+}
+
+func getFirewallTarget() firewallTarget {
+	ni := networkInfo.Load()
+	t := firewallTarget{
+		port:    ni.UDPPort,
+		tunName: ni.TUNName,
+	}
+	if exe, err := os.Executable(); err == nil {
+		t.exe = strings.ToLower(exe)
+	}
+	if t.tunName == "" {
+		return t
+	}
+	ifc, err := net.InterfaceByName(t.tunName)
+	if err != nil {
+		return t
+	}
+	luid, err := winipcfg.LUIDFromIndex(uint32(ifc.Index))
+	if err != nil {
+		return t
+	}
+	t.tunLUID = uint64(luid)
+	if guid, err := luid.GUID(); err == nil {
+		t.tunGUID = strings.ToLower(guid.String())
+	}
+	return t
+}
+
+// matchesExe reports whether path, a Windows path or an NT device path
+// such as WFP uses, is that of t's executable.
+func (t firewallTarget) matchesExe(path string) bool {
+	if t.exe == "" || path == "" {
+		return false
+	}
+	path = strings.ToLower(path)
+	if path == t.exe {
+		return true
+	}
+	// An NT device path names the volume differently from its drive
+	// letter, so compare the rest.
+	rest := t.exe[len(filepath.VolumeName(t.exe)):]
+	return strings.HasPrefix(path, `\device\`) && strings.HasSuffix(path, rest)
+}
+
+type firewallProfile struct {
+	Enabled       bool `json:"enabled"`
+	BlockInbound  bool `json:"blockInbound"`
+	BlockOutbound bool `json:"blockOutbound"`
+}
+
+// firewallRule is a Windows Firewall rule.
+type firewallRule struct {
+	Name   string `json:"name"`
+	Source string `json:"source"` // "local" or "policy"; see firewallRuleKeys
+	Action string `json:"action"` // "Allow" or "Block"
+	Dir    string `json:"dir"`    // "In" or "Out"
+	// Conditions are the rule's other fields, such as Protocol, LPort, App
+	// and Profile, by name.
+	Conditions map[string][]string `json:"conditions,omitempty"`
+
+	active bool
+}
+
+type firewallInfo struct {
+	UDPPort  uint16                     `json:"udpPort,omitempty"`
+	TUN      string                     `json:"tun,omitempty"`
+	Profiles map[string]firewallProfile `json:"profiles"`
+	Rules    []firewallRule             `json:"rules"`
+}
+
+// getFirewallInfo returns the state of the Windows Firewall profiles and
+// the active rules affecting t.
+func getFirewallInfo(t firewallTarget) (*firewallInfo, error) {
+	fi := &firewallInfo{
+		UDPPort:  t.port,
+		TUN:      t.tunName,
+		Profiles: make(map[string]firewallProfile),
+		Rules:    []firewallRule{},
+	}
+	for name, subKey := range firewallProfileKeys {
+		p, err := getFirewallProfile(subKey)
+		if err != nil {
+			return nil, err
+		}
+		fi.Profiles[name] = p
+	}
+	for _, rk := range firewallRuleKeys {
+		rules, err := getFirewallRules(rk.subKey)
+		if err != nil {
+			if errors.Is(err, registry.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		for _, r := range rules {
+			if t.affectedByFirewallRule(r) {
+				r.Source = rk.source
+				fi.Rules = append(fi.Rules, r)
+			}
+		}
+	}
+	return fi, nil
+}
+
+func getFirewallProfile(subKey string) (firewallProfile, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, subKey, registry.QUERY_VALUE)
+	if err != nil {
+		if errors.Is(err, registry.ErrNotExist) {
+			// Never configured, so at its defaults.
+			return firewallProfile{Enabled: true, BlockInbound: true}, nil
+		}
+		return firewallProfile{}, fmt.Errorf("opening %q: %w", keyString(registry.LOCAL_MACHINE, subKey), err)
+	}
+	defer k.Close()
+	dword := func(name string, def uint64) uint64 {
+		v, _, err := k.GetIntegerValue(name)
+		if err != nil {
+			return def
+		}
+		return v
+	}
+	return firewallProfile{
+		Enabled:       dword("EnableFirewall", 1) != 0,
+		BlockInbound:  dword("DefaultInboundAction", 1) != 0,
+		BlockOutbound: dword("DefaultOutboundAction", 0) != 0,
+	}, nil
+}
+
+func getFirewallRules(subKey string) ([]firewallRule, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, subKey, registry.QUERY_VALUE)
+	if err != nil {
+		return nil, fmt.Errorf("opening %q: %w", keyString(registry.LOCAL_MACHINE, subKey), err)
+	}
+	defer k.Close()
+	names, err := k.ReadValueNames(0)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]firewallRule, 0, len(names))
+	for _, name := range names {
+		v, _, err := k.GetStringValue(name)
+		if err != nil {
+			continue
+		}
+		rules = append(rules, parseFirewallRule(v))
+	}
+	return rules, nil
+}
+
+// parseFirewallRule parses s, a Windows Firewall rule in the format of the
+// registry, such as
+// "v2.30|Action=Block|Active=TRUE|Dir=In|Protocol=17|LPort=41641|Name=Foo|".
+func parseFirewallRule(s string) firewallRule {
+	var r firewallRule
+	for _, f := range strings.Split(s, "|") {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			continue // the version, or the empty field after the last "|"
+		}
+		switch k {
+		case "Name":
+			r.Name = v
+		case "Action":
+			r.Action = v
+		case "Dir":
+			r.Dir = v
+		case "Active":
+			r.active = strings.EqualFold(v, "TRUE")
+		case "Desc", "EmbedCtxt":
+			// Not useful for diagnosis.
+		default:
+			if r.Conditions == nil {
+				r.Conditions = make(map[string][]string)
+			}
+			r.Conditions[k] = append(r.Conditions[k], v)
+		}
+	}
+	return r
+}
+
+// affectedByFirewallRule reports whether r is active and can match t's UDP
+// traffic: it's for its executable, UDP port or TUN interface, or it
+// blocks all UDP traffic.
+func (t firewallTarget) affectedByFirewallRule(r firewallRule) bool {
+	if !r.active {
+		return false
+	}
+	if protos, ok := r.Conditions["Protocol"]; ok && !slices.Contains(protos, "17") {
+		return false
+	}
+	for _, app := range r.Conditions["App"] {
+		if expanded, err := registry.ExpandString(app); err == nil {
+			app = expanded
+		}
+		if t.matchesExe(app) {
+			return true
+		}
+	}
+	for _, k := range []string{"LPort", "RPort"} {
+		for _, p := range r.Conditions[k] {
+			if portInFirewallRange(t.port, p) {
+				return true
+			}
+		}
+	}
+	if t.tunGUID != "" {
+		for _, ifc := range r.Conditions["IF"] {
+			if strings.EqualFold(ifc, t.tunGUID) {
+				return true
+			}
+		}
+	}
+	if r.Action == "Block" {
+		for _, k := range []string{"App", "Svc", "LPort", "RPort", "IF"} {
+			if _, ok := r.Conditions[k]; ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// portInFirewallRange reports whether port is non-zero and in s, a port or
+// range of ports ("1000-2000") of a Windows Firewall rule.
+func portInFirewallRange(port uint16, s string) bool {
+	if port == 0 {
+		return false
+	}
+	lo, hi, ok := strings.Cut(s, "-")
+	if !ok {
+		hi = lo
+	}
+	first, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return false // a keyword such as "RPC"
+	}
+	last, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil {
+		return false
+	}
+	return uint64(port) >= first && uint64(port) <= last
+}
+
+// wfpFilter is a WFP filter. Windows Firewall rules show up as filters
+// too, along with those of other software such as VPNs and antivirus.
+type wfpFilter struct {
+	Name       string   `json:"name"`
+	Layer      string   `json:"layer"`
+	Sublayer   string   `json:"sublayer"`
+	Weight     uint64   `json:"weight"`
+	Action     string   `json:"action"`
+	Conditions []string `json:"conditions,omitempty"`
+}
+
+// aleAuthLayers are the WFP layers where filters permit or block
+// connections, including UDP flows.
+var aleAuthLayers = map[wf.LayerID]bool{
+	wf.LayerALEAuthConnectV4:    true,
+	wf.LayerALEAuthConnectV6:    true,
+	wf.LayerALEAuthRecvAcceptV4: true,
+	wf.LayerALEAuthRecvAcceptV6: true,
+}
+
+// getWFPFilters returns the WFP filters affecting t.
+func getWFPFilters(t firewallTarget) ([]wfpFilter, error) {
+	session, err := wf.New(&wf.Options{
+		Name:    "Tailscale support info",
+		Dynamic: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	rules, err := session.Rules()
+	if err != nil {
+		return nil, err
+	}
+	result := []wfpFilter{}
+	for _, r := range rules {
+		if !t.affectedByWFPFilter(r) {
+			continue
+		}
+		f := wfpFilter{
+			Name:     r.Name,
+			Layer:    fmt.Sprint(r.Layer),
+			Sublayer: fmt.Sprint(r.Sublayer),
+			Weight:   r.Weight,
+			Action:   fmt.Sprint(r.Action),
+		}
+		for _, m := range r.Conditions {
+			f.Conditions = append(f.Conditions, fmt.Sprint(m))
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+// affectedByWFPFilter reports whether r can match t's traffic: one of its
+// conditions is on its executable, UDP port or TUN interface, or it
+// blocks all connections.
+func (t firewallTarget) affectedByWFPFilter(r *wf.Rule) bool {
+	if len(r.Conditions) == 0 {
+		return r.Action == wf.ActionBlock && aleAuthLayers[r.Layer]
+	}
+	for _, m := range r.Conditions {
+		switch m.Field {
+		case wf.FieldALEAppID:
+			if app, ok := m.Value.(string); ok && t.matchesExe(app) {
+				return true
+			}
+		case wf.FieldIPLocalPort, wf.FieldIPRemotePort:
+			if t.port != 0 && wfpValueMatchesPort(m.Value, t.port) {
+				return true
+			}
+		case wf.FieldIPLocalInterface:
+			if luid, ok := m.Value.(uint64); ok && t.tunLUID != 0 && luid == t.tunLUID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wfpValueMatchesPort reports whether v, the value of a WFP port condition,
+// is or includes port.
+func wfpValueMatchesPort(v any, port uint16) bool {
+	switch v := v.(type) {
+	case uint16:
+		return v == port
+	case wf.Range:
+		from, ok1 := v.From.(uint16)
+		to, ok2 := v.To.(uint16)
+		return ok1 && ok2 && port >= from && port <= to
+	}
+	return false
+}
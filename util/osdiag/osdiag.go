@@ -4,7 +4,10 @@
 // Package osdiag provides loggers for OS-specific diagnostic information.
 package osdiag
 
-import "tailscale.com/types/logger"
+import (
+	"tailscale.com/syncs"
+	"tailscale.com/types/logger"
+)
 
 // LogSupportInfoReason is an enumeration indicating the reason for logging
 // support info.
@@ -15,6 +18,33 @@
 	LogSupportInfoReasonBugReport                                 // a bugreport is in the process of being gathered.
 )
 
+// Keys of the sections of the support info JSON object. Each OS collects
+// those that apply to it.
+const (
+	supportInfoKeyModules  = "modules"
+	supportInfoKeyRegistry = "registry"
+	supportInfoKeySysctl   = "sysctl"
+	supportInfoKeyDNS      = "dns"
+	supportInfoKeyOffloads = "offloads"
+	supportInfoKeyFirewall = "firewall"
+	supportInfoKeyWFP      = "wfp"
+)
+
+// NetworkInfo is tailscaled's network configuration. The support info
+// reports the firewall rules affecting it, on the OSes where it can.
+type NetworkInfo struct {
+	UDPPort uint16 // the local UDP port of WireGuard and disco, or zero if unknown
+	TUNName string // the name of the TUN interface, or empty if unknown or none
+}
+
+var networkInfo syncs.AtomicValue[NetworkInfo]
+
+// SetNetworkInfo sets the network configuration that subsequently logged
+// support info reports the firewall rules affecting.
+func SetNetworkInfo(ni NetworkInfo) {
+	networkInfo.Store(ni)
+}
+
 // LogSupportInfo obtains OS-specific diagnostic information useful for
 // troubleshooting and support, and writes it to logf. The reason argument is
 // useful for governing the verbosity of this function's output.
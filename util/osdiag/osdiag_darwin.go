@@ -0,0 +1,130 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package osdiag
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var supportInfoSections = []supportInfoSection{
+	{key: supportInfoKeySysctl, get: func() (any, error) { return getSysctls(sysctlNames), nil }},
+	{key: supportInfoKeyDNS, bugReportOnly: true, get: func() (any, error) { return getDNSInfo() }},
+	{key: supportInfoKeyOffloads, bugReportOnly: true, get: func() (any, error) { return getOffloads() }},
+}
+
+// sysctlNames are the sysctls in the support info: socket buffer limits,
+// the ephemeral port range and forwarding.
+var sysctlNames = []string{
+	"kern.ipc.maxsockbuf",
+	"net.inet.udp.recvspace",
+	"net.inet.udp.maxdgram",
+	"net.inet.ip.portrange.first",
+	"net.inet.ip.portrange.last",
+	"net.inet.ip.forwarding",
+	"net.inet6.ip6.forwarding",
+}
+
+// getSysctls returns the values of the integer sysctls in names that
+// exist.
+func getSysctls(names []string) map[string]string {
+	result := make(map[string]string)
+	for _, name := range names {
+		v, err := unix.SysctlUint32(name)
+		if err != nil {
+			continue
+		}
+		result[name] = strconv.FormatUint(uint64(v), 10)
+	}
+	return result
+}
+
+// commandTimeout is how long the commands run to collect support info may
+// take.
+const commandTimeout = 5 * time.Second
+
+// commandLines runs name with args and returns the lines of its output.
+func commandLines(name string, args ...string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSpace(string(out)), "\n"), nil
+}
+
+type dnsInfo struct {
+	// ResolvConf is /etc/resolv.conf, which only reflects the primary
+	// resolver.
+	ResolvConf *resolvConf `json:"resolvConf,omitempty"`
+	// ResolvConfErr is why ResolvConf couldn't be read.
+	ResolvConfErr string `json:"resolvConfErr,omitempty"`
+	// Scutil is the output of "scutil --dns": all the resolvers,
+	// including per-domain ones.
+	Scutil []string `json:"scutil,omitempty"`
+	// ScutilErr is why Scutil couldn't be run.
+	ScutilErr string `json:"scutilErr,omitempty"`
+}
+
+func getDNSInfo() (*dnsInfo, error) {
+	di := &dnsInfo{}
+	rc, err := readResolvConf("/etc/resolv.conf")
+	if err != nil {
+		di.ResolvConfErr = err.Error()
+	} else {
+		di.ResolvConf = rc
+	}
+	di.Scutil, err = commandLines("scutil", "--dns")
+	if err != nil {
+		di.ScutilErr = err.Error()
+	}
+	return di, nil
+}
+
+// getOffloads returns the options, such as TSO4 and CHANNEL_IO, that
+// ifconfig reports for each interface that has any.
+func getOffloads() (map[string]map[string]bool, error) {
+	lines, err := commandLines("ifconfig")
+	if err != nil {
+		return nil, err
+	}
+	return parseIfconfigOptions(lines), nil
+}
+
+// parseIfconfigOptions returns the options of each interface in lines,
+// the output of ifconfig.
+func parseIfconfigOptions(lines []string) map[string]map[string]bool {
+	result := make(map[string]map[string]bool)
+	var ifName string
+	for _, line := range lines {
+		if line != "" && line[0] != '\t' && line[0] != ' ' {
+			ifName, _, _ = strings.Cut(line, ":")
+			continue
+		}
+		opts, ok := strings.CutPrefix(strings.TrimSpace(line), "options=")
+		if !ok || ifName == "" {
+			continue
+		}
+		// options=6463<RXCSUM,TXCSUM,TSO4,TSO6,CHANNEL_IO>
+		_, opts, ok = strings.Cut(opts, "<")
+		if !ok {
+			continue
+		}
+		opts = strings.TrimSuffix(opts, ">")
+		m := make(map[string]bool)
+		for _, o := range strings.Split(opts, ",") {
+			if o != "" {
+				m[o] = true
+			}
+		}
+		result[ifName] = m
+	}
+	return result
+}
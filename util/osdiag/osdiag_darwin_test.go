@@ -0,0 +1,29 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package osdiag
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseIfconfigOptions(t *testing.T) {
+	const ifconfig = `lo0: flags=8049<UP,LOOPBACK,RUNNING,MULTICAST> mtu 16384
+	options=1203<RXCSUM,TXCSUM,TXSTATUS,SW_TIMESTAMP>
+	inet 127.0.0.1 netmask 0xff000000
+en0: flags=8863<UP,BROADCAST,SMART,RUNNING,SIMPLEX,MULTICAST> mtu 1500
+	options=6463<RXCSUM,TXCSUM,TSO4,TSO6,CHANNEL_IO,PARTIAL_CSUM,ZEROINVERT_CSUM>
+	ether 00:00:00:00:00:00
+utun3: flags=8051<UP,POINTOPOINT,RUNNING,MULTICAST> mtu 1280
+	inet 100.64.0.1 --> 100.64.0.1 netmask 0xffffffff`
+	got := parseIfconfigOptions(strings.Split(ifconfig, "\n"))
+	want := map[string]map[string]bool{
+		"lo0": {"RXCSUM": true, "TXCSUM": true, "TXSTATUS": true, "SW_TIMESTAMP": true},
+		"en0": {"RXCSUM": true, "TXCSUM": true, "TSO4": true, "TSO6": true, "CHANNEL_IO": true, "PARTIAL_CSUM": true, "ZEROINVERT_CSUM": true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseIfconfigOptions = %v; want %v", got, want)
+	}
+}
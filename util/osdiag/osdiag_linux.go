@@ -0,0 +1,303 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package osdiag
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var supportInfoSections = []supportInfoSection{
+	{key: supportInfoKeySysctl, get: func() (any, error) { return getSysctls(sysctlNames), nil }},
+	{key: supportInfoKeyDNS, get: func() (any, error) { return getDNSInfo() }},
+	{key: supportInfoKeyModules, bugReportOnly: true, get: func() (any, error) { return getModuleInfo() }},
+	{key: supportInfoKeyOffloads, bugReportOnly: true, get: func() (any, error) { return getOffloads() }},
+}
+
+// sysctlNames are the sysctls in the support info: socket buffer limits,
+// forwarding, reverse path filtering and conntrack limits, which commonly
+// break or slow down UDP and subnet routing.
+var sysctlNames = []string{
+	"net.core.rmem_default",
+	"net.core.rmem_max",
+	"net.core.wmem_default",
+	"net.core.wmem_max",
+	"net.ipv4.udp_mem",
+	"net.ipv4.ip_forward",
+	"net.ipv6.conf.all.forwarding",
+	"net.ipv4.conf.all.rp_filter",
+	"net.netfilter.nf_conntrack_count",
+	"net.netfilter.nf_conntrack_max",
+	"net.netfilter.nf_conntrack_udp_timeout",
+	"net.netfilter.nf_conntrack_udp_timeout_stream",
+}
+
+// getSysctls returns the values of the sysctls in names that exist.
+func getSysctls(names []string) map[string]string {
+	result := make(map[string]string)
+	for _, name := range names {
+		b, err := os.ReadFile("/proc/sys/" + strings.ReplaceAll(name, ".", "/"))
+		if err != nil {
+			continue
+		}
+		result[name] = strings.Join(strings.Fields(string(b)), " ")
+	}
+	return result
+}
+
+type dnsInfo struct {
+	// ResolvConf is /etc/resolv.conf.
+	ResolvConf *resolvConf `json:"resolvConf,omitempty"`
+	// ResolvConfErr is why ResolvConf couldn't be read.
+	ResolvConfErr string `json:"resolvConfErr,omitempty"`
+	// SystemdResolved is whether systemd-resolved is running.
+	SystemdResolved bool `json:"systemdResolved"`
+	// ResolvedUpstream is the resolv.conf systemd-resolved writes with
+	// its upstream nameservers, if it's running.
+	ResolvedUpstream *resolvConf `json:"resolvedUpstream,omitempty"`
+}
+
+func getDNSInfo() (*dnsInfo, error) {
+	di := &dnsInfo{}
+	rc, err := readResolvConf("/etc/resolv.conf")
+	if err != nil {
+		di.ResolvConfErr = err.Error()
+	} else {
+		di.ResolvConf = rc
+	}
+	if _, err := os.Stat("/run/systemd/resolve/io.systemd.Resolve"); err == nil {
+		di.SystemdResolved = true
+		di.ResolvedUpstream, _ = readResolvConf("/run/systemd/resolve/resolv.conf")
+	}
+	return di, nil
+}
+
+// kernelModuleInfo is a loaded kernel module, per /proc/modules.
+type kernelModuleInfo struct {
+	Size     uint64   `json:"size"`
+	RefCount int      `json:"refCount"`
+	UsedBy   []string `json:"usedBy,omitempty"`
+	State    string   `json:"state"`
+}
+
+// networkingModules are the kernel modules in the support info, along with
+// those whose name starts with one of them and an underscore.
+var networkingModules = []string{
+	"tun",
+	"wireguard",
+	"udp_tunnel",
+	"ip6_udp_tunnel",
+	"nf_conntrack",
+	"nf_nat",
+	"nf_tables",
+	"nft",
+	"x_tables",
+	"xt",
+	"ip_tables",
+	"ip6_tables",
+	"iptable",
+	"ip6table",
+	"br_netfilter",
+}
+
+func isNetworkingModule(name string) bool {
+	for _, m := range networkingModules {
+		if name == m || strings.HasPrefix(name, m+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+func getModuleInfo() (map[string]kernelModuleInfo, error) {
+	f, err := os.Open("/proc/modules")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseProcModules(f)
+}
+
+// parseProcModules returns the networking modules listed in r, in the
+// format of /proc/modules.
+func parseProcModules(r io.Reader) (map[string]kernelModuleInfo, error) {
+	result := make(map[string]kernelModuleInfo)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		// name size refcount used-by state address
+		f := strings.Fields(sc.Text())
+		if len(f) < 5 {
+			continue
+		}
+		if !isNetworkingModule(f[0]) {
+			continue
+		}
+		size, err := strconv.ParseUint(f[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("module %q: bad size %q", f[0], f[1])
+		}
+		refs, err := strconv.Atoi(f[2])
+		if err != nil {
+			return nil, fmt.Errorf("module %q: bad refcount %q", f[0], f[2])
+		}
+		mi := kernelModuleInfo{
+			Size:     size,
+			RefCount: refs,
+			State:    f[4],
+		}
+		if f[3] != "-" {
+			mi.UsedBy = strings.FieldsFunc(f[3], func(r rune) bool { return r == ',' })
+		}
+		result[f[0]] = mi
+	}
+	return result, sc.Err()
+}
+
+// offloadFeatures are the ethtool features in the support info, those of
+// segmentation and receive offloads that WireGuard over UDP relies on
+// for throughput.
+var offloadFeatures = []string{
+	"tx-generic-segmentation",
+	"tx-udp-segmentation",
+	"rx-gro",
+	"rx-gro-list",
+	"rx-udp-gro-forwarding",
+	"tx-checksum-ip-generic",
+	"rx-checksum",
+}
+
+// getOffloads returns whether each of offloadFeatures is active on each
+// of the up, non-loopback interfaces, per ethtool.
+func getOffloads() (map[string]map[string]bool, error) {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := genetlink.Dial(&netlink.Config{Strict: true})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	f, err := conn.GetFamily(unix.ETHTOOL_GENL_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]map[string]bool)
+	var errs []error
+	for _, ifc := range ifs {
+		if ifc.Flags&net.FlagUp == 0 || ifc.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		active, err := getActiveFeatures(conn, f, ifc.Name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ifc.Name, err))
+			continue
+		}
+		features := make(map[string]bool)
+		for _, name := range offloadFeatures {
+			features[name] = active[name]
+		}
+		result[ifc.Name] = features
+	}
+	if len(result) == 0 && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return result, nil
+}
+
+// getActiveFeatures returns the names of the active ethtool features of
+// the interface named ifName.
+func getActiveFeatures(conn *genetlink.Conn, f genetlink.Family, ifName string) (map[string]bool, error) {
+	ae := netlink.NewAttributeEncoder()
+	ae.Nested(unix.ETHTOOL_A_FEATURES_HEADER, func(nae *netlink.AttributeEncoder) error {
+		nae.String(unix.ETHTOOL_A_HEADER_DEV_NAME, ifName)
+		return nil
+	})
+	b, err := ae.Encode()
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := conn.Execute(
+		genetlink.Message{
+			Header: genetlink.Header{
+				Command: unix.ETHTOOL_MSG_FEATURES_GET,
+				Version: unix.ETHTOOL_GENL_VERSION,
+			},
+			Data: b,
+		},
+		f.ID,
+		netlink.Request,
+	)
+	if err != nil {
+		return nil, err
+	}
+	active := make(map[string]bool)
+	for _, m := range msgs {
+		ad, err := netlink.NewAttributeDecoder(m.Data)
+		if err != nil {
+			return nil, err
+		}
+		for ad.Next() {
+			if ad.Type() == unix.ETHTOOL_A_FEATURES_ACTIVE {
+				ad.Nested(func(nad *netlink.AttributeDecoder) error {
+					return decodeBitset(nad, active)
+				})
+			}
+		}
+		if err := ad.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return active, nil
+}
+
+// decodeBitset adds the names of the bits set in the verbose ethtool
+// bitset ad to set.
+func decodeBitset(ad *netlink.AttributeDecoder, set map[string]bool) error {
+	noMask := false
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.ETHTOOL_A_BITSET_NOMASK:
+			noMask = true
+		case unix.ETHTOOL_A_BITSET_BITS:
+			ad.Nested(func(bits *netlink.AttributeDecoder) error {
+				for bits.Next() {
+					if bits.Type() != unix.ETHTOOL_A_BITSET_BITS_BIT {
+						continue
+					}
+					bits.Nested(func(bit *netlink.AttributeDecoder) error {
+						var name string
+						value := false
+						for bit.Next() {
+							switch bit.Type() {
+							case unix.ETHTOOL_A_BITSET_BIT_NAME:
+								name = bit.String()
+							case unix.ETHTOOL_A_BITSET_BIT_VALUE:
+								value = true
+							}
+						}
+						// Without a mask, only the set bits are listed.
+						if name != "" && (value || noMask) {
+							set[name] = true
+						}
+						return bit.Err()
+					})
+				}
+				return bits.Err()
+			})
+		}
+	}
+	return ad.Err()
+}
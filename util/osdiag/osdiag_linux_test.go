@@ -0,0 +1,71 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package osdiag
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProcModules(t *testing.T) {
+	const procModules = `nf_conntrack_netlink 57344 0 - Live 0x0000000000000000
+xt_conntrack 16384 2 - Live 0x0000000000000000
+nf_conntrack 176128 3 nf_conntrack_netlink,xt_conntrack,nf_nat, Live 0x0000000000000000
+snd_hda_codec 188416 1 snd_hda_intel, Live 0x0000000000000000
+tun 61440 4 - Live 0x0000000000000000
+tunnel4 16384 0 - Loading 0x0000000000000000
+wireguard 98304 0 - Live 0x0000000000000000
+`
+	got, err := parseProcModules(strings.NewReader(procModules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]kernelModuleInfo{
+		"nf_conntrack_netlink": {Size: 57344, State: "Live"},
+		"xt_conntrack":         {Size: 16384, RefCount: 2, State: "Live"},
+		"nf_conntrack":         {Size: 176128, RefCount: 3, UsedBy: []string{"nf_conntrack_netlink", "xt_conntrack", "nf_nat"}, State: "Live"},
+		"tun":                  {Size: 61440, RefCount: 4, State: "Live"},
+		"wireguard":            {Size: 98304, State: "Live"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseProcModules = %+v; want %+v", got, want)
+	}
+
+	if _, err := parseProcModules(strings.NewReader("tun big 4 - Live 0x0\n")); err == nil {
+		t.Error("parseProcModules accepted a bad size")
+	}
+}
+
+func TestSupportInfo(t *testing.T) {
+	for _, tt := range []struct {
+		reason LogSupportInfoReason
+		want   []string
+	}{
+		{LogSupportInfoReasonStartup, []string{supportInfoKeyDNS, supportInfoKeySysctl}},
+		{LogSupportInfoReasonBugReport, []string{supportInfoKeyDNS, supportInfoKeyModules, supportInfoKeyOffloads, supportInfoKeySysctl}},
+	} {
+		var b strings.Builder
+		if err := getSupportInfo(&b, tt.reason); err != nil {
+			t.Fatal(err)
+		}
+		var output map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(b.String()), &output); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for k := range output {
+			got = append(got, k)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("reason %v: got sections %q; want %q", tt.reason, got, tt.want)
+		}
+		for _, k := range tt.want {
+			if _, ok := output[k]; !ok {
+				t.Errorf("reason %v: missing section %q in %s", tt.reason, k, b.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || darwin
+
+package osdiag
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	"tailscale.com/types/logger"
+)
+
+func logSupportInfo(logf logger.Logf, reason LogSupportInfoReason) {
+	var b strings.Builder
+	if err := getSupportInfo(&b, reason); err != nil {
+		logf("error encoding support info: %v", err)
+		return
+	}
+	logf("%s", b.String())
+}
+
+// supportInfoSection is a section of the support info JSON object, under
+// key. get returns its value. Sections that are slow or verbose to
+// collect are only included in bug reports.
+type supportInfoSection struct {
+	key           string
+	bugReportOnly bool
+	get           func() (any, error)
+}
+
+// getSupportInfo writes the OS's supportInfoSections for reason to w as a
+// JSON object, with the error message in place of the value of those that
+// failed.
+func getSupportInfo(w io.Writer, reason LogSupportInfoReason) error {
+	output := make(map[string]any)
+	for _, s := range supportInfoSections {
+		if s.bugReportOnly && reason != LogSupportInfoReasonBugReport {
+			continue
+		}
+		v, err := s.get()
+		if err != nil {
+			output[s.key] = err.Error()
+		} else {
+			output[s.key] = v
+		}
+	}
+	enc := json.NewEncoder(w)
+	return enc.Encode(output)
+}
+
+// resolvConf is the DNS configuration in an /etc/resolv.conf style file.
+type resolvConf struct {
+	// Target is where the file links to, if it's a symlink, which tells
+	// what manages it.
+	Target string `json:"target,omitempty"`
+
+	// Lines are the file's lines, other than blank lines and comments.
+	Lines []string `json:"lines"`
+}
+
+// readResolvConf reads the resolv.conf style file at path.
+func readResolvConf(path string) (*resolvConf, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rc := &resolvConf{
+		Lines: []string{},
+	}
+	rc.Target, _ = os.Readlink(path)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		rc.Lines = append(rc.Lines, line)
+	}
+	return rc, sc.Err()
+}
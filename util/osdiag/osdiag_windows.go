@@ -37,11 +37,6 @@ func logSupportInfo(logf logger.Logf, reason LogSupportInfoReason) {
 	logf("%s", b.String())
 }
 
-const (
-	supportInfoKeyModules  = "modules"
-	supportInfoKeyRegistry = "registry"
-)
-
 func getSupportInfo(w io.Writer, reason LogSupportInfoReason) error {
 	output := make(map[string]any)
 
@@ -59,6 +54,21 @@ func getSupportInfo(w io.Writer, reason LogSupportInfoReason) error {
 		} else {
 			output[supportInfoKeyModules] = err
 		}
+
+		target := getFirewallTarget()
+		fwInfo, err := getFirewallInfo(target)
+		if err == nil {
+			output[supportInfoKeyFirewall] = fwInfo
+		} else {
+			output[supportInfoKeyFirewall] = err
+		}
+
+		wfpInfo, err := getWFPFilters(target)
+		if err == nil {
+			output[supportInfoKeyWFP] = wfpInfo
+		} else {
+			output[supportInfoKeyWFP] = err
+		}
 	}
 
 	enc := json.NewEncoder(w)
@@ -10,6 +10,7 @@
 	"testing"
 
 	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 	"golang.org/x/sys/windows/registry"
 )
 
@@ -126,3 +127,51 @@ func() {
 		t.Errorf("Compare error: want\n%s,\ngot %s", want, got)
 	}
 }
+
+func TestFirewallRules(t *testing.T) {
+	target := firewallTarget{
+		exe:     `c:\program files\tailscale\tailscaled.exe`,
+		port:    41641,
+		tunGUID: "{01234567-89ab-cdef-0123-456789abcdef}",
+	}
+	tests := []struct {
+		name string
+		rule string
+		want bool
+	}{
+		{"port", "v2.30|Action=Block|Active=TRUE|Dir=In|Protocol=17|LPort=41641|Name=Block WireGuard|", true},
+		{"port range", "v2.30|Action=Allow|Active=TRUE|Dir=In|Protocol=17|LPort=41000-42000|Name=Range|", true},
+		{"other port", "v2.30|Action=Allow|Active=TRUE|Dir=In|Protocol=17|LPort=53|Name=DNS|", false},
+		{"tcp", "v2.30|Action=Block|Active=TRUE|Dir=In|Protocol=6|LPort=41641|Name=TCP|", false},
+		{"inactive", "v2.30|Action=Block|Active=FALSE|Dir=In|Protocol=17|LPort=41641|Name=Off|", false},
+		{"app", `v2.30|Action=Allow|Active=TRUE|Dir=In|App=C:\Program Files\Tailscale\tailscaled.exe|Name=Tailscale|`, true},
+		{"other app", `v2.30|Action=Allow|Active=TRUE|Dir=In|App=C:\Windows\system32\svchost.exe|Name=Other|`, false},
+		{"tun", "v2.30|Action=Block|Active=TRUE|Dir=Out|IF={01234567-89AB-CDEF-0123-456789ABCDEF}|Name=TUN|", true},
+		{"block all udp", "v2.30|Action=Block|Active=TRUE|Dir=In|Protocol=17|Profile=Public|Name=Block UDP|", true},
+		{"allow all udp", "v2.30|Action=Allow|Active=TRUE|Dir=In|Protocol=17|Name=Allow UDP|", false},
+		{"port keyword", "v2.30|Action=Allow|Active=TRUE|Dir=In|Protocol=17|LPort=RPC|Name=RPC|", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := parseFirewallRule(tt.rule)
+			if got := target.affectedByFirewallRule(r); got != tt.want {
+				t.Errorf("affectedByFirewallRule(%+v) = %v; want %v", r, got, tt.want)
+			}
+		})
+	}
+
+	r := parseFirewallRule("v2.30|Action=Block|Active=TRUE|Dir=In|Protocol=17|LPort=41641|LPort=41642|Name=Two ports|Desc=Some text|")
+	if r.Name != "Two ports" || r.Action != "Block" || r.Dir != "In" {
+		t.Errorf("parseFirewallRule fields = %+v", r)
+	}
+	if got, want := r.Conditions["LPort"], []string{"41641", "41642"}; !slices.Equal(got, want) {
+		t.Errorf("LPort = %q; want %q", got, want)
+	}
+	if _, ok := r.Conditions["Desc"]; ok {
+		t.Error("Desc kept in conditions")
+	}
+
+	if !target.matchesExe(`\device\harddiskvolume3\program files\tailscale\tailscaled.exe`) {
+		t.Error("matchesExe failed on an NT device path")
+	}
+}
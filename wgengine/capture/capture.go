@@ -76,6 +76,16 @@ func writePktHeader(w *bytes.Buffer, when time.Time, length int) {
 
 	// PathDisco indicates the packet is information about a disco frame.
 	PathDisco Path = 254
+	// PathDiscoToPeer is like PathDisco, but for a disco frame sent to a
+	// peer rather than received from one. The frame's address is the
+	// peer's.
+	PathDiscoToPeer Path = 253
+	// PathWireGuardFromPeer indicates the packet is a WireGuard message
+	// received from a peer, framed like a disco frame.
+	PathWireGuardFromPeer Path = 252
+	// PathWireGuardToPeer is like PathWireGuardFromPeer, but for a
+	// WireGuard message sent to a peer.
+	PathWireGuardToPeer Path = 251
 )
 
 // New creates a new capture sink.
@@ -171,6 +181,24 @@ func customDataLen(meta packet.CaptureMeta) int {
 	return length
 }
 
+// writeCustomData writes the Tailscale debugging data that precedes each
+// packet in the capture.
+func writeCustomData(b *bytes.Buffer, path Path, meta packet.CaptureMeta) {
+	binary.Write(b, binary.LittleEndian, uint16(path))
+	if meta.DidSNAT {
+		binary.Write(b, binary.LittleEndian, uint8(meta.OriginalSrc.Addr().BitLen()/8))
+		b.Write(meta.OriginalSrc.Addr().AsSlice())
+	} else {
+		binary.Write(b, binary.LittleEndian, uint8(0)) // SNAT addr len == 0
+	}
+	if meta.DidDNAT {
+		binary.Write(b, binary.LittleEndian, uint8(meta.OriginalDst.Addr().BitLen()/8))
+		b.Write(meta.OriginalDst.Addr().AsSlice())
+	} else {
+		binary.Write(b, binary.LittleEndian, uint8(0)) // DNAT addr len == 0
+	}
+}
+
 // LogPacket is called to insert a packet into the capture.
 //
 // This function does not take ownership of the provided data slice.
@@ -188,22 +216,7 @@ func (s *Sink) LogPacket(path Path, when time.Time, data []byte, meta packet.Cap
 	defer bufferPool.Put(b)
 
 	writePktHeader(b, when, len(data)+extraLen)
-
-	// Custom tailscale debugging data
-	binary.Write(b, binary.LittleEndian, uint16(path))
-	if meta.DidSNAT {
-		binary.Write(b, binary.LittleEndian, uint8(meta.OriginalSrc.Addr().BitLen()/8))
-		b.Write(meta.OriginalSrc.Addr().AsSlice())
-	} else {
-		binary.Write(b, binary.LittleEndian, uint8(0)) // SNAT addr len == 0
-	}
-	if meta.DidDNAT {
-		binary.Write(b, binary.LittleEndian, uint8(meta.OriginalDst.Addr().BitLen()/8))
-		b.Write(meta.OriginalDst.Addr().AsSlice())
-	} else {
-		binary.Write(b, binary.LittleEndian, uint8(0)) // DNAT addr len == 0
-	}
-
+	writeCustomData(b, path, meta)
 	b.Write(data)
 
 	s.mu.Lock()
@@ -0,0 +1,104 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capture
+
+import (
+	"net/netip"
+
+	"tailscale.com/types/key"
+	"tailscale.com/util/set"
+)
+
+// Direction is which way a captured packet was going.
+type Direction uint8
+
+const (
+	// AnyDirection, in a Filter, matches packets going either way.
+	AnyDirection Direction = iota
+	// Inbound is a packet from a peer, or synthesized to the local host.
+	Inbound
+	// Outbound is a packet to a peer, or from the local host.
+	Outbound
+)
+
+// Direction returns the direction of packets captured on p.
+func (p Path) Direction() Direction {
+	switch p {
+	case FromLocal, SynthesizedToPeer, PathDiscoToPeer, PathWireGuardToPeer:
+		return Outbound
+	}
+	return Inbound
+}
+
+// Filter selects the packets a capture hook is called for. It's checked
+// before any packet data is copied or framed, so a long-running capture
+// of a few packets doesn't slow down the rest. The zero value, like a nil
+// *Filter, matches every packet. A Filter must not be modified once
+// installed.
+type Filter struct {
+	// Peers, if non-empty, limits the capture to packets to and from
+	// these peers. It only applies where the peer is known, to disco
+	// and WireGuard frames; IP packets are matched by Addrs instead.
+	Peers set.Set[key.NodePublic]
+
+	// Addrs, if non-empty, limits the capture of IP packets to those
+	// with a source or destination in one of the prefixes. Engines set
+	// it from the Tailscale addresses of Peers.
+	Addrs []netip.Prefix
+
+	// Paths, if non-empty, limits the capture to packets on these
+	// paths.
+	Paths []Path
+
+	// Direction, if not AnyDirection, limits the capture to packets
+	// going that way.
+	Direction Direction
+
+	// MinSize and MaxSize, if non-zero, limit the capture to packets of
+	// at least and at most this many bytes, respectively.
+	MinSize int
+	MaxSize int
+}
+
+// Match reports whether f matches a packet of size bytes captured on
+// path, other than by its peer or addresses.
+func (f *Filter) Match(path Path, size int) bool {
+	if f == nil {
+		return true
+	}
+	if f.Direction != AnyDirection && path.Direction() != f.Direction {
+		return false
+	}
+	if f.MinSize != 0 && size < f.MinSize || f.MaxSize != 0 && size > f.MaxSize {
+		return false
+	}
+	if len(f.Paths) == 0 {
+		return true
+	}
+	for _, p := range f.Paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchPeer reports whether f matches a packet to or from peer. A zero
+// peer, one that isn't known, only matches if Peers is empty.
+func (f *Filter) MatchPeer(peer key.NodePublic) bool {
+	return f == nil || len(f.Peers) == 0 || f.Peers.Contains(peer)
+}
+
+// MatchAddrs reports whether f matches an IP packet from src to dst.
+func (f *Filter) MatchAddrs(src, dst netip.Addr) bool {
+	if f == nil || len(f.Addrs) == 0 {
+		return true
+	}
+	for _, p := range f.Addrs {
+		if p.Contains(src) || p.Contains(dst) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capture
+
+import (
+	"net/netip"
+	"testing"
+
+	"tailscale.com/types/key"
+	"tailscale.com/util/set"
+)
+
+func TestFilter(t *testing.T) {
+	peer := key.NewNode().Public()
+	other := key.NewNode().Public()
+	tests := []struct {
+		name string
+		f    *Filter
+		path Path
+		size int
+		peer key.NodePublic
+		want bool
+	}{
+		{"nil", nil, FromPeer, 100, other, true},
+		{"zero", &Filter{}, FromPeer, 100, key.NodePublic{}, true},
+		{"peer", &Filter{Peers: set.Set[key.NodePublic]{peer: {}}}, PathDisco, 100, peer, true},
+		{"other-peer", &Filter{Peers: set.Set[key.NodePublic]{peer: {}}}, PathDisco, 100, other, false},
+		{"unknown-peer", &Filter{Peers: set.Set[key.NodePublic]{peer: {}}}, PathDisco, 100, key.NodePublic{}, false},
+		{"path", &Filter{Paths: []Path{PathDisco, PathDiscoToPeer}}, PathDiscoToPeer, 100, peer, true},
+		{"other-path", &Filter{Paths: []Path{PathDisco}}, PathWireGuardFromPeer, 100, peer, false},
+		{"inbound", &Filter{Direction: Inbound}, PathWireGuardFromPeer, 100, peer, true},
+		{"not-inbound", &Filter{Direction: Inbound}, FromLocal, 100, peer, false},
+		{"outbound", &Filter{Direction: Outbound}, SynthesizedToPeer, 100, peer, true},
+		{"min", &Filter{MinSize: 100}, FromPeer, 100, peer, true},
+		{"too-small", &Filter{MinSize: 101}, FromPeer, 100, peer, false},
+		{"max", &Filter{MaxSize: 100}, FromPeer, 100, peer, true},
+		{"too-big", &Filter{MaxSize: 99}, FromPeer, 100, peer, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.f.Match(tt.path, tt.size) && tt.f.MatchPeer(tt.peer); got != tt.want {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterMatchAddrs(t *testing.T) {
+	f := &Filter{Addrs: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")}}
+	peerIP := netip.MustParseAddr("100.64.0.1")
+	otherIP := netip.MustParseAddr("100.64.0.2")
+	if !f.MatchAddrs(otherIP, peerIP) || !f.MatchAddrs(peerIP, otherIP) {
+		t.Error("packet to or from a filtered address didn't match")
+	}
+	if f.MatchAddrs(otherIP, otherIP) {
+		t.Error("packet between other addresses matched")
+	}
+	none := &Filter{Addrs: []netip.Prefix{{}}}
+	if none.MatchAddrs(peerIP, otherIP) {
+		t.Error("invalid prefix matched")
+	}
+}
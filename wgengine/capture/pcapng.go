@@ -0,0 +1,120 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"tailscale.com/net/packet"
+)
+
+// pcapng block types and options. See
+// https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html.
+const (
+	pcapngSectionHeader     = 0x0A0D0D0A
+	pcapngInterfaceDesc     = 0x00000001
+	pcapngEnhancedPacket    = 0x00000006
+	pcapngByteOrderMagic    = 0x1A2B3C4D
+	pcapngOptEndOfOpt       = 0
+	pcapngOptIfTSResol      = 9
+	pcapngLinkTypeUser0     = 147
+	pcapngEnhancedPacketLen = 32 // without packet data
+)
+
+// PcapngWriter writes packets to an io.Writer as a pcapng stream, in the
+// same format as Sink (including the Tailscale debugging data read by
+// the dissector in DissectorLua), with nanosecond timestamps.
+//
+// Unlike Sink, it writes each packet straight to its io.Writer, which it
+// never flushes or closes.
+type PcapngWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error // first write error, after which packets are dropped
+}
+
+// NewPcapngWriter returns a PcapngWriter writing to w, having written the
+// stream's header. If that fails, the error is reported by Err and all
+// packets are dropped.
+func NewPcapngWriter(w io.Writer) *PcapngWriter {
+	pw := &PcapngWriter{w: w}
+
+	var b bytes.Buffer
+	// Section header block.
+	binary.Write(&b, binary.LittleEndian, uint32(pcapngSectionHeader))
+	binary.Write(&b, binary.LittleEndian, uint32(28)) // block length
+	binary.Write(&b, binary.LittleEndian, uint32(pcapngByteOrderMagic))
+	binary.Write(&b, binary.LittleEndian, uint16(1))  // version major
+	binary.Write(&b, binary.LittleEndian, uint16(0))  // version minor
+	binary.Write(&b, binary.LittleEndian, int64(-1))  // section length: unknown
+	binary.Write(&b, binary.LittleEndian, uint32(28)) // block length
+
+	// Interface description block, with if_tsresol set to nanoseconds.
+	binary.Write(&b, binary.LittleEndian, uint32(pcapngInterfaceDesc))
+	binary.Write(&b, binary.LittleEndian, uint32(32)) // block length
+	binary.Write(&b, binary.LittleEndian, uint16(pcapngLinkTypeUser0))
+	binary.Write(&b, binary.LittleEndian, uint16(0)) // reserved
+	binary.Write(&b, binary.LittleEndian, uint32(0)) // snap length: unlimited
+	binary.Write(&b, binary.LittleEndian, uint16(pcapngOptIfTSResol))
+	binary.Write(&b, binary.LittleEndian, uint16(1))                 // option length
+	b.Write([]byte{9, 0, 0, 0})                                      // 10^-9 seconds, padded
+	binary.Write(&b, binary.LittleEndian, uint32(pcapngOptEndOfOpt)) // code and length
+	binary.Write(&b, binary.LittleEndian, uint32(32))                // block length
+
+	_, pw.err = w.Write(b.Bytes())
+	return pw
+}
+
+// Err returns the error that stopped pw writing packets, if any.
+func (pw *PcapngWriter) Err() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.err
+}
+
+// LogPacket writes a packet to the stream. It has the signature of a
+// Callback, so it may be installed as one.
+//
+// This function does not take ownership of the provided data slice.
+func (pw *PcapngWriter) LogPacket(path Path, when time.Time, data []byte, meta packet.CaptureMeta) {
+	pw.LogTruncatedPacket(path, when, data, len(data), meta)
+}
+
+// LogTruncatedPacket is like LogPacket, but for a packet of which only the
+// first len(data) of origLen bytes were captured.
+func (pw *PcapngWriter) LogTruncatedPacket(path Path, when time.Time, data []byte, origLen int, meta packet.CaptureMeta) {
+	extraLen := customDataLen(meta)
+	capLen := extraLen + len(data)
+	pad := -capLen & 3
+	blockLen := pcapngEnhancedPacketLen + capLen + pad
+
+	b := bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	b.Grow(blockLen)
+	defer bufferPool.Put(b)
+
+	ts := uint64(when.UnixNano())
+	binary.Write(b, binary.LittleEndian, uint32(pcapngEnhancedPacket))
+	binary.Write(b, binary.LittleEndian, uint32(blockLen))
+	binary.Write(b, binary.LittleEndian, uint32(0)) // interface ID
+	binary.Write(b, binary.LittleEndian, uint32(ts>>32))
+	binary.Write(b, binary.LittleEndian, uint32(ts))
+	binary.Write(b, binary.LittleEndian, uint32(capLen))
+	binary.Write(b, binary.LittleEndian, uint32(extraLen+origLen))
+	writeCustomData(b, path, meta)
+	b.Write(data)
+	b.Write(make([]byte, pad))
+	binary.Write(b, binary.LittleEndian, uint32(blockLen))
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.err != nil {
+		return
+	}
+	_, pw.err = pw.w.Write(b.Bytes())
+}
@@ -0,0 +1,78 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"tailscale.com/net/packet"
+)
+
+func TestPcapngWriter(t *testing.T) {
+	var buf bytes.Buffer
+	pw := NewPcapngWriter(&buf)
+	when := time.Unix(1700000000, 123456789)
+	pw.LogPacket(FromPeer, when, []byte{1, 2, 3}, packet.CaptureMeta{})
+	pw.LogTruncatedPacket(PathWireGuardToPeer, when, []byte{1, 2, 3, 4}, 100, packet.CaptureMeta{})
+	if err := pw.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	type block struct {
+		typ  uint32
+		body []byte
+	}
+	var blocks []block
+	b := buf.Bytes()
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("trailing %d bytes", len(b))
+		}
+		typ := binary.LittleEndian.Uint32(b)
+		n := binary.LittleEndian.Uint32(b[4:])
+		if n%4 != 0 || int(n) > len(b) {
+			t.Fatalf("block %d: bad length %d", len(blocks), n)
+		}
+		if trailer := binary.LittleEndian.Uint32(b[n-4:]); trailer != n {
+			t.Fatalf("block %d: trailing length %d; want %d", len(blocks), trailer, n)
+		}
+		blocks = append(blocks, block{typ, b[8 : n-4]})
+		b = b[n:]
+	}
+
+	wantTypes := []uint32{pcapngSectionHeader, pcapngInterfaceDesc, pcapngEnhancedPacket, pcapngEnhancedPacket}
+	if len(blocks) != len(wantTypes) {
+		t.Fatalf("got %d blocks; want %d", len(blocks), len(wantTypes))
+	}
+	for i, want := range wantTypes {
+		if blocks[i].typ != want {
+			t.Errorf("block %d type = %#x; want %#x", i, blocks[i].typ, want)
+		}
+	}
+
+	for i, tt := range []struct {
+		path            Path
+		capLen, origLen uint32
+	}{
+		{FromPeer, 4 + 3, 4 + 3},
+		{PathWireGuardToPeer, 4 + 4, 4 + 100},
+	} {
+		epb := blocks[2+i].body
+		ts := uint64(binary.LittleEndian.Uint32(epb[4:]))<<32 | uint64(binary.LittleEndian.Uint32(epb[8:]))
+		if ts != uint64(when.UnixNano()) {
+			t.Errorf("packet %d: timestamp = %d; want %d", i, ts, when.UnixNano())
+		}
+		capLen := binary.LittleEndian.Uint32(epb[12:])
+		origLen := binary.LittleEndian.Uint32(epb[16:])
+		if capLen != tt.capLen || origLen != tt.origLen {
+			t.Errorf("packet %d: lengths = %d, %d; want %d, %d", i, capLen, origLen, tt.capLen, tt.origLen)
+		}
+		if path := Path(binary.LittleEndian.Uint16(epb[20:])); path != tt.path {
+			t.Errorf("packet %d: path = %d; want %d", i, path, tt.path)
+		}
+	}
+}
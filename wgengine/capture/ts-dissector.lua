@@ -22,6 +22,9 @@ function tsdebug_ll.dissector(buffer, pinfo, tree)
     elseif path_id == 1   then subtree:add(PATH, "FromPeer")
     elseif path_id == 2   then subtree:add(PATH, "Synthesized (Inbound / ToLocal)")
     elseif path_id == 3   then subtree:add(PATH, "Synthesized (Outbound / ToPeer)")
+    elseif path_id == 251 then subtree:add(PATH, "WireGuard (Outbound / ToPeer)")
+    elseif path_id == 252 then subtree:add(PATH, "WireGuard (Inbound / FromPeer)")
+    elseif path_id == 253 then subtree:add(PATH, "Disco frame (Outbound / ToPeer)")
     elseif path_id == 254 then subtree:add(PATH, "Disco frame")
     end
     offset = offset + 2
@@ -42,8 +45,10 @@ function tsdebug_ll.dissector(buffer, pinfo, tree)
 
     -- -- Handover rest of data to lower-level dissector
     local data_buffer = buffer:range(offset, packet_length-offset):tvb()
-    if path_id == 254 then
+    if path_id == 253 or path_id == 254 then
         Dissector.get("tsdisco"):call(data_buffer, pinfo, tree)
+    elseif path_id == 251 or path_id == 252 then
+        Dissector.get("tswg"):call(data_buffer, pinfo, tree)
     else
         Dissector.get("ip"):call(data_buffer, pinfo, tree)
     end
@@ -68,11 +73,13 @@ DISCO_SRC_PORT = ProtoField.uint16("tsdisco.SRC_PORT","Source port", base.DEC)
 DISCO_DERP_PUB = ProtoField.bytes("tsdisco.DERP_PUB", "DERP public key", base.SPACE)
 tsdisco_meta.fields = {DISCO_IS_DERP, DISCO_SRC_PORT, DISCO_DERP_PUB, DISCO_SRC_IP_4, DISCO_SRC_IP_6}
 
-function tsdisco_meta.dissector(buffer, pinfo, tree)
-    pinfo.cols.protocol = tsdisco_meta.name
+-- Dissects the metadata before a disco or WireGuard frame, returning the
+-- offset of the frame itself.
+function dissect_frame_meta(proto, title, buffer, pinfo, tree)
+    pinfo.cols.protocol = proto.name
     packet_length = buffer:len()
     local offset = 0
-    local subtree = tree:add(tsdisco_meta, buffer(), "DISCO metadata")
+    local subtree = tree:add(proto, buffer(), title)
 
     -- Parse flags
     local from_derp = hasbit(buffer(offset, 1):le_uint(), 0)
@@ -96,14 +103,35 @@ function tsdisco_meta.dissector(buffer, pinfo, tree)
     end
     offset = offset + addr_len
 
+    return offset + 2 -- skip over payload len
+end
+
+function tsdisco_meta.dissector(buffer, pinfo, tree)
+    local offset = dissect_frame_meta(tsdisco_meta, "DISCO metadata", buffer, pinfo, tree)
+
     -- Handover to the actual disco frame dissector
-    offset = offset + 2 -- skip over payload len
-    local data_buffer = buffer:range(offset, packet_length-offset):tvb()
+    local data_buffer = buffer:range(offset, buffer:len()-offset):tvb()
     Dissector.get("disco"):call(data_buffer, pinfo, tree)
 end
 
 ts_dissectors:add(1, tsdisco_meta)
 
+--
+-- WireGuard metadata dissector
+--
+-- WireGuard frames carry the same metadata as disco frames; the address
+-- is the peer's.
+tswg_meta = Proto("tswg", "Tailscale WireGuard metadata")
+
+function tswg_meta.dissector(buffer, pinfo, tree)
+    local offset = dissect_frame_meta(tswg_meta, "WireGuard metadata", buffer, pinfo, tree)
+
+    -- Handover to Wireshark's WireGuard dissector. Frames captured
+    -- headers-only are truncated after the transport header.
+    local data_buffer = buffer:range(offset, buffer:len()-offset):tvb()
+    Dissector.get("wg"):call(data_buffer, pinfo, tree)
+end
+
 --
 -- DISCO frame dissector
 --
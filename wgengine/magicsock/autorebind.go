@@ -0,0 +1,185 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"sync"
+	"time"
+
+	"tailscale.com/net/interfaces"
+	"tailscale.com/tstime"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/util/clientmetric"
+)
+
+const (
+	// defaultAutoRebindDebounce is the Options.AutoRebindDebounce used if
+	// none is set.
+	defaultAutoRebindDebounce = time.Second
+
+	// autoRebindMaxDelayFactor bounds, as a multiple of the debounce
+	// window, how long a storm of network changes can put off acting on
+	// them.
+	autoRebindMaxDelayFactor = 5
+)
+
+// autoRebind debounces the network changes reported by Options.NetMon, for
+// Options.AutoRebind.
+type autoRebind struct {
+	c        *Conn
+	debounce time.Duration
+	// apply acts on the changes; applyNetworkChange, except in tests.
+	apply func(major bool, st *interfaces.State)
+
+	mu         sync.Mutex
+	timer      tstime.TimerController // nil if nothing is scheduled
+	timerGen   int                    // bumped for each timer, to tell stale ones
+	pending    bool                   // whether changes are waiting to be applied
+	major      bool                   // whether any of them was major
+	state      *interfaces.State      // the latest state
+	since      mono.Time              // when the first of them arrived
+	suppressed int                    // outstanding SuppressAutoRebind calls
+}
+
+func newAutoRebind(c *Conn, debounce time.Duration) *autoRebind {
+	if debounce <= 0 {
+		debounce = defaultAutoRebindDebounce
+	}
+	return &autoRebind{c: c, debounce: debounce, apply: c.applyNetworkChange}
+}
+
+// onChange is the netmon.ChangeFunc of Options.AutoRebind. It waits for
+// changes to stop for the debounce window before applying them all at
+// once, but no longer than autoRebindMaxDelayFactor windows since the
+// first, lest a flapping interface keep the Conn on stale sockets.
+func (a *autoRebind) onChange(changed bool, st *interfaces.State) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.c.monoNow()
+	if !a.pending {
+		a.since = now
+	} else {
+		metricAutoRebindDebounced.Add(1)
+	}
+	a.pending = true
+	a.major = a.major || changed
+	a.state = st
+	if a.suppressed > 0 {
+		metricAutoRebindSuppressed.Add(1)
+		return
+	}
+	a.scheduleLocked(now)
+}
+
+// scheduleLocked (re)starts the timer applying the pending changes.
+//
+// a.mu must be held.
+func (a *autoRebind) scheduleLocked(now mono.Time) {
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	d := a.debounce
+	if left := a.since.Add(autoRebindMaxDelayFactor * a.debounce).Sub(now); left < d {
+		d = max(left, 0)
+	}
+	a.timerGen++
+	gen := a.timerGen
+	a.timer = a.c.afterFunc(d, func() { a.fire(gen) })
+}
+
+// fire applies the pending changes, if gen is the latest timer; an older
+// one may have gone off just as it was replaced.
+func (a *autoRebind) fire(gen int) {
+	a.mu.Lock()
+	if gen != a.timerGen {
+		a.mu.Unlock()
+		return
+	}
+	a.timer = nil
+	if !a.pending || a.suppressed > 0 {
+		a.mu.Unlock()
+		return
+	}
+	major, st := a.major, a.state
+	a.pending, a.major, a.state = false, false, nil
+	a.mu.Unlock()
+
+	if a.c.closing.Load() {
+		return
+	}
+	a.apply(major, st)
+}
+
+// stop cancels any pending changes, at Close.
+func (a *autoRebind) stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	a.pending = false
+}
+
+// SuppressAutoRebind holds off Options.AutoRebind, such as while the
+// embedder reconfigures the network itself, until the returned func is
+// called. Changes reported meanwhile are applied then, after the debounce
+// window. Calls may overlap; changes are applied once all are released.
+// It does nothing if AutoRebind isn't set.
+func (c *Conn) SuppressAutoRebind() (release func()) {
+	a := c.autoRebind
+	if a == nil {
+		return func() {}
+	}
+	a.mu.Lock()
+	a.suppressed++
+	a.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.suppressed--
+			if a.suppressed == 0 && a.pending {
+				// Wait out a whole window, as if the changes
+				// just arrived.
+				now := a.c.monoNow()
+				a.since = now
+				a.scheduleLocked(now)
+			}
+		})
+	}
+}
+
+// applyNetworkChange responds to a network change as wgengine does: a
+// major change, such as to the default route or interface addresses,
+// rebinds the Conn's sockets and refreshes all its endpoints, while a
+// minor one only checks its public addresses.
+func (c *Conn) applyNetworkChange(major bool, st *interfaces.State) {
+	up := st == nil || st.AnyInterfaceUp()
+	c.SetNetworkUp(up)
+	if !up {
+		c.logf("magicsock: network change: all links down")
+		return
+	}
+	why, scope := "netmon-minor", RefreshHomeDERP
+	if major {
+		c.logf("magicsock: major network change; rebinding")
+		why, scope = "netmon-major", RefreshFull
+		c.Rebind()
+	}
+	metricAutoRebindApplied.Add(1)
+	c.RefreshEndpoints(scope, why)
+}
+
+var (
+	// metricAutoRebindApplied counts the network changes acted on by
+	// Options.AutoRebind, metricAutoRebindDebounced those merged into
+	// one already pending, and metricAutoRebindSuppressed those reported
+	// while suppressed by SuppressAutoRebind.
+	metricAutoRebindApplied    = clientmetric.NewCounter("magicsock_autorebind_applied")
+	metricAutoRebindDebounced  = clientmetric.NewCounter("magicsock_autorebind_debounced")
+	metricAutoRebindSuppressed = clientmetric.NewCounter("magicsock_autorebind_suppressed")
+)
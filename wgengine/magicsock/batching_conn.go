@@ -42,6 +42,7 @@ type batchingUDPConn struct {
 	setGSOSizeInControl   func(control *[]byte, gsoSize uint16) // typically setGSOSizeInControl(); swappable for testing
 	getGSOSizeFromControl func(control []byte) (int, error)     // typically getGSOSizeFromControl(); swappable for testing
 	sendBatchPool         sync.Pool
+	rxTune                *batchTuner // for reads without rxOffload
 }
 
 func (c *batchingUDPConn) ReadFromUDPAddrPort(p []byte) (n int, addr netip.AddrPort, err error) {
@@ -84,7 +85,12 @@ func (c *batchingUDPConn) SetWriteDeadline(t time.Time) error {
 
 // coalesceMessages iterates msgs, coalescing them where possible while
 // maintaining datagram order. All msgs have their Addr field set to addr.
-func (c *batchingUDPConn) coalesceMessages(addr *net.UDPAddr, buffs [][]byte, msgs []ipv6.Message) int {
+// At most maxSegments datagrams are coalesced into a single msg; if
+// maxSegments is zero, udpSegmentMaxDatagrams is used.
+func (c *batchingUDPConn) coalesceMessages(addr *net.UDPAddr, buffs [][]byte, msgs []ipv6.Message, maxSegments int) int {
+	if maxSegments <= 0 || maxSegments > udpSegmentMaxDatagrams {
+		maxSegments = udpSegmentMaxDatagrams
+	}
 	var (
 		base     = -1 // index of msg we are currently coalescing into
 		gsoSize  int  // segmentation size of msgs[base]
@@ -103,7 +109,7 @@ func (c *batchingUDPConn) coalesceMessages(addr *net.UDPAddr, buffs [][]byte, ms
 			if msgLen+baseLenBefore <= maxPayloadLen &&
 				msgLen <= gsoSize &&
 				msgLen <= freeBaseCap &&
-				dgramCnt < udpSegmentMaxDatagrams &&
+				dgramCnt < maxSegments &&
 				!endBatch {
 				msgs[base].Buffers[0] = append(msgs[base].Buffers[0], make([]byte, msgLen)...)
 				copy(msgs[base].Buffers[0][baseLenBefore:], buff)
@@ -152,7 +158,21 @@ func (c *batchingUDPConn) putSendBatch(batch *sendBatch) {
 	c.sendBatchPool.Put(batch)
 }
 
-func (c *batchingUDPConn) WriteBatchTo(buffs [][]byte, addr netip.AddrPort) error {
+// coalescedSendError is returned by batchingUDPConn.WriteBatchTo when a
+// send that coalesced datagrams failed.
+type coalescedSendError struct {
+	err  error
+	sent int // number of leading buffs sent before the failure
+}
+
+func (e coalescedSendError) Error() string { return e.err.Error() }
+func (e coalescedSendError) Unwrap() error { return e.err }
+
+// WriteBatchTo writes buffs to addr. If tx offload is supported, up to
+// maxSegments datagrams are coalesced into a single send; zero means the
+// platform maximum, and one disables coalescing. If a send that coalesced
+// datagrams fails, the error is a coalescedSendError.
+func (c *batchingUDPConn) WriteBatchTo(buffs [][]byte, addr netip.AddrPort, maxSegments int) error {
 	batch := c.getSendBatch()
 	defer c.putSendBatch(batch)
 	if addr.Addr().Is6() {
@@ -166,12 +186,14 @@ func (c *batchingUDPConn) WriteBatchTo(buffs [][]byte, addr netip.AddrPort) erro
 	}
 	batch.ua.Port = int(addr.Port())
 	var (
-		n       int
-		retried bool
+		n         int
+		coalesced bool
+		retried   bool
 	)
 retry:
-	if c.txOffload.Load() {
-		n = c.coalesceMessages(batch.ua, buffs, batch.msgs)
+	if c.txOffload.Load() && maxSegments != 1 {
+		n = c.coalesceMessages(batch.ua, buffs, batch.msgs, maxSegments)
+		coalesced = n < len(buffs)
 	} else {
 		for i := range buffs {
 			batch.msgs[i].Buffers[0] = buffs[i]
@@ -179,13 +201,29 @@ func (c *batchingUDPConn) WriteBatchTo(buffs [][]byte, addr netip.AddrPort) erro
 			batch.msgs[i].OOB = batch.msgs[i].OOB[:0]
 		}
 		n = len(buffs)
+		coalesced = false
 	}
 
-	err := c.writeBatch(batch.msgs[:n])
-	if err != nil && c.txOffload.Load() && neterror.ShouldDisableUDPGSO(err) {
-		c.txOffload.Store(false)
-		retried = true
-		goto retry
+	sent, err := c.writeBatch(batch.msgs[:n])
+	if err != nil && coalesced {
+		// Each coalesced msg holds a run of consecutive buffs, so count
+		// the bytes written to find the buffs that made it out.
+		var sentBytes int
+		for _, msg := range batch.msgs[:sent] {
+			sentBytes += len(msg.Buffers[0])
+		}
+		sentBuffs := 0
+		for sentBuffs < len(buffs) && sentBytes >= len(buffs[sentBuffs]) {
+			sentBytes -= len(buffs[sentBuffs])
+			sentBuffs++
+		}
+		if c.txOffload.Load() && neterror.ShouldDisableUDPGSO(err) {
+			c.txOffload.Store(false)
+			retried = true
+			buffs = buffs[sentBuffs:]
+			goto retry
+		}
+		err = coalescedSendError{err: err, sent: sentBuffs}
 	}
 	if retried {
 		return neterror.ErrUDPGSODisabled{OnLaddr: c.pc.LocalAddr().String(), RetryErr: err}
@@ -0,0 +1,84 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import "tailscale.com/util/clientmetric"
+
+const (
+	// maxReceiveBatchSize is the most that Options.ReceiveBatchSize can
+	// be, the kernel's limit on the messages of a recvmmsg call
+	// (UIO_MAXIOV).
+	maxReceiveBatchSize = 1024
+
+	// minTunedBatchSize is the number of messages a batchTuner starts
+	// reading at once, if its maximum isn't smaller.
+	minTunedBatchSize = 8
+
+	// batchGrowAfter is the number of consecutive reads filling their
+	// batch after which a batchTuner doubles its size, and
+	// batchShrinkAfter the number of consecutive reads using at most a
+	// quarter of it after which it halves it.
+	batchGrowAfter   = 4
+	batchShrinkAfter = 256
+)
+
+// batchTuner tunes how many messages are read from a UDP socket at once.
+// It starts at minTunedBatchSize and grows, up to max, while reads keep
+// filling their batch, so a busy socket is drained in few reads, and
+// shrinks back while they don't. It's not safe for concurrent use: each
+// socket has a single reader.
+//
+// A nil batchTuner doesn't tune.
+type batchTuner struct {
+	max    int
+	cur    int
+	full   int // consecutive reads that filled cur
+	sparse int // consecutive reads that used at most cur/4
+}
+
+func newBatchTuner(max int) *batchTuner {
+	return &batchTuner{max: max, cur: min(max, minTunedBatchSize)}
+}
+
+// size returns the number of messages to read next, of at most n.
+func (t *batchTuner) size(n int) int {
+	if t == nil {
+		return n
+	}
+	return max(min(n, t.cur), 1)
+}
+
+// note records that a read of size messages returned n of them.
+func (t *batchTuner) note(n, size int) {
+	if t == nil || size < t.cur {
+		// Reads the caller limited don't say anything about how
+		// busy the socket is.
+		return
+	}
+	switch {
+	case n >= t.cur:
+		t.sparse = 0
+		t.full++
+		if t.full >= batchGrowAfter && t.cur < t.max {
+			t.cur = min(t.cur*2, t.max)
+			t.full = 0
+			metricRecvBatchGrow.Add(1)
+		}
+	case n <= t.cur/4:
+		t.full = 0
+		t.sparse++
+		if t.sparse >= batchShrinkAfter && t.cur > minTunedBatchSize {
+			t.cur = max(t.cur/2, minTunedBatchSize)
+			t.sparse = 0
+			metricRecvBatchShrink.Add(1)
+		}
+	default:
+		t.full, t.sparse = 0, 0
+	}
+}
+
+var (
+	metricRecvBatchGrow   = clientmetric.NewCounter("magicsock_recv_batch_grow")
+	metricRecvBatchShrink = clientmetric.NewCounter("magicsock_recv_batch_shrink")
+)
@@ -0,0 +1,119 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"tailscale.com/tstime/mono"
+	"tailscale.com/util/clientmetric"
+)
+
+const (
+	// quarantineSendErrs is the number of consecutive UDP sends to an
+	// address that must fail for it to be quarantined.
+	quarantineSendErrs = 3
+
+	// quarantineMin and quarantineMax bound how long an address is
+	// quarantined. Each quarantine of an address doubles the last one,
+	// unless the address went quarantineMax without one.
+	quarantineMin = 5 * time.Second
+	quarantineMax = 2 * time.Minute
+)
+
+// quarantinedLocked reports whether st is quarantined at now.
+// endpoint.mu must be held.
+func (st *endpointState) quarantinedLocked(now mono.Time) bool {
+	return !st.quarantinedUntil.IsZero() && now.Before(st.quarantinedUntil)
+}
+
+// noteUDPSendToAddrLocked records whether a UDP send to addr failed and
+// quarantines addr, the circuit breaker of the peer's paths, once
+// quarantineSendErrs sends in a row have. Without it, a path that the OS
+// refuses to send to keeps being used until WireGuard's retransmits give
+// up and the pings time out.
+//
+// de.mu must be held.
+func (de *endpoint) noteUDPSendToAddrLocked(addr netip.AddrPort, failed bool) {
+	st, ok := de.endpointState[addr]
+	if !ok || de.isWireguardOnly {
+		return
+	}
+	if !failed {
+		st.sendErrs = 0
+		return
+	}
+	st.sendErrs++
+	if st.sendErrs >= quarantineSendErrs {
+		de.quarantineLocked(addr, st, ChangeBestAddrQuarantined)
+	}
+}
+
+// quarantineLocked stops addr, whose state is st, from being used as the
+// best address for a backoff period, switching at once to the next-best
+// path, which is DERP if there's no other. reason is why, for the
+// EndpointChange.
+//
+// de.mu must be held.
+func (de *endpoint) quarantineLocked(addr netip.AddrPort, st *endpointState, reason EndpointChangeReason) {
+	now := de.c.monoNow()
+	if now.Sub(st.quarantinedUntil) > quarantineMax {
+		st.quarantines = 0
+	}
+	d := min(quarantineMin<<st.quarantines, quarantineMax)
+	if d < quarantineMax {
+		st.quarantines++
+	}
+	st.quarantinedUntil = now.Add(d)
+	st.sendErrs = 0
+	metricEndpointQuarantined.Add(1)
+	de.logPeer(slog.LevelInfo, "disco: quarantining endpoint", LogKeyEndpoint, addr, "reason", reason.String(), "for", d)
+
+	if de.bestAddr.AddrPort != addr {
+		return
+	}
+	next, pongAt := de.nextBestAddrLocked(now)
+	de.addDebugUpdate(EndpointChange{
+		What:   "quarantineLocked-bestAddr",
+		Reason: reason,
+		From:   de.bestAddr,
+		To:     next,
+	})
+	de.bestAddr = next
+	de.udpSendErrs = 0
+	de.quality.notePathChange(now)
+	if !next.IsValid() {
+		de.logPeer(slog.LevelInfo, "disco: now using DERP only (endpoint quarantined)")
+		return
+	}
+	de.logPeer(slog.LevelInfo, "disco: now using next-best endpoint", LogKeyEndpoint, next.AddrPort, LogKeyPath, "udp")
+	// Trust it as long as its last pong would have, or else for the
+	// grace period of derpFallbackLocked while it's pinged again.
+	de.bestAddrAt = pongAt
+	de.trustBestAddrUntil = max(pongAt.Add(trustUDPAddrDuration), now)
+}
+
+// nextBestAddrLocked returns the best of de's addresses that isn't
+// quarantined and answered a ping, by the Conn's PathSelector, and when it
+// last did. It returns the zero addrLatency if there's none.
+//
+// de.mu must be held.
+func (de *endpoint) nextBestAddrLocked(now mono.Time) (best addrLatency, pongAt mono.Time) {
+	for ipp, st := range de.endpointState {
+		latency, ok := st.latencyLocked()
+		if !ok || st.quarantinedLocked(now) {
+			continue
+		}
+		if al := (addrLatency{ipp, latency}); de.betterAddrLocked(al, best) {
+			best, pongAt = al, st.recentPongs[st.recentPong].pongAt
+		}
+	}
+	return best, pongAt
+}
+
+// metricEndpointQuarantined counts the addresses quarantined after
+// repeated send errors.
+var metricEndpointQuarantined = clientmetric.NewCounter("magicsock_endpoint_quarantined")
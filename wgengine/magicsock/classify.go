@@ -0,0 +1,85 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"tailscale.com/disco"
+	"tailscale.com/net/stun"
+	"tailscale.com/util/clientmetric"
+)
+
+// packetKind is the kind of a packet received by magicsock, as determined
+// by classifyPacket.
+type packetKind uint8
+
+const (
+	packetDrop      packetKind = iota // not valid on its receive path
+	packetSTUN                        // STUN, for netcheck
+	packetDisco                       // disco, plain or obfuscated
+	packetWireGuard                   // for wireguard-go
+)
+
+func (k packetKind) String() string {
+	switch k {
+	case packetDrop:
+		return "drop"
+	case packetSTUN:
+		return "STUN"
+	case packetDisco:
+		return "disco"
+	case packetWireGuard:
+		return "WireGuard"
+	}
+	return "unknown"
+}
+
+// classifyPacket returns the kind of packet b, received via path via. It's
+// shared by the UDP, raw socket and DERP receive paths so that they agree
+// on what they accept:
+//
+//   - STUN is only accepted from the UDP sockets, where netcheck's probes
+//     are answered.
+//   - Disco is accepted from all paths. Obfuscated disco, if obfuscated is
+//     set, isn't accepted from DERP, which never obfuscates.
+//   - WireGuard packets are accepted from UDP and DERP, but not from the
+//     raw socket, whose BPF filter only matches disco, and not if
+//     haveKey is false, as we're logged out or stopped and wireguard-go
+//     would only complain about them (issue 1167).
+//
+// The caller must still validate disco packets with handleDiscoMessage.
+func classifyPacket(b []byte, via discoRXPath, obfuscated, haveKey bool) packetKind {
+	k := packetKindOf(b, via, obfuscated, haveKey)
+	metricClassified[k].Add(1)
+	return k
+}
+
+func packetKindOf(b []byte, via discoRXPath, obfuscated, haveKey bool) packetKind {
+	switch {
+	case stun.Is(b):
+		if via == discoRXPathUDP {
+			return packetSTUN
+		}
+		return packetDrop
+	case len(b) >= len(disco.Magic) && string(b[:len(disco.Magic)]) == disco.Magic:
+		return packetDisco
+	case obfuscated && via != discoRXPathDERP && looksObfuscated(b):
+		return packetDisco
+	case via == discoRXPathRawSocket || !haveKey || len(b) == 0:
+		return packetDrop
+	}
+	return packetWireGuard
+}
+
+// classifyRecv is classifyPacket with c's disco obfuscation and key state.
+func (c *Conn) classifyRecv(b []byte, via discoRXPath) packetKind {
+	return classifyPacket(b, via, c.discoObfuscator.Load() != nil, c.havePrivateKey.Load())
+}
+
+// metricClassified counts the received packets by their packetKind.
+var metricClassified = [...]*clientmetric.Metric{
+	packetDrop:      clientmetric.NewCounter("magicsock_recv_classify_drop"),
+	packetSTUN:      clientmetric.NewCounter("magicsock_recv_classify_stun"),
+	packetDisco:     clientmetric.NewCounter("magicsock_recv_classify_disco"),
+	packetWireGuard: clientmetric.NewCounter("magicsock_recv_classify_wireguard"),
+}
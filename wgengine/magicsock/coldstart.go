@@ -0,0 +1,59 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"tailscale.com/util/clientmetric"
+)
+
+// startProvisionalDERPHome starts connecting to a DERP home, if there's
+// none yet, without waiting for a netcheck report.
+//
+// At cold start, and after the home was dropped, the home DERP connection
+// otherwise only starts once the first full netcheck completes, which can
+// take seconds, so peers can't reach the node at all meanwhile. Instead,
+// updateNetInfo calls this before netcheck runs, and the report's
+// preferred region replaces the provisional home when it completes, as on
+// any later netcheck. The portmapper probe was already started by then, by
+// determineEndpoints, so all three run concurrently.
+//
+// c.mu must NOT be held.
+func (c *Conn) startProvisionalDERPHome() {
+	c.mu.Lock()
+	if c.myDerp != 0 || !c.wantDerpLocked() || c.privateKey.IsZero() {
+		c.mu.Unlock()
+		return
+	}
+	regionID := c.provisionalDERPHomeLocked()
+	c.mu.Unlock()
+
+	if regionID == 0 {
+		regionID = c.pickDERPFallback()
+	}
+	if regionID == 0 || !c.setNearestDERP(regionID) {
+		return
+	}
+	metricDERPProvisionalHome.Add(1)
+	c.dlogf("[v1] magicsock: provisional home derp-%d until netcheck completes", regionID)
+}
+
+// provisionalDERPHomeLocked returns the DERP region the next netcheck is
+// most likely to pick as home: the one pinned by SetPreferredDERPRegion,
+// or else the last report's preferred one, if it's still in the DERP map.
+// It returns zero if there's no such region.
+//
+// c.mu must be held.
+func (c *Conn) provisionalDERPHomeLocked() int {
+	if pin := c.pinnedDERP; pin != 0 && c.derpMap.Regions[pin] != nil {
+		return pin
+	}
+	if r := c.lastNetCheckReport.Load(); r != nil && r.PreferredDERP != 0 && c.derpMap.Regions[r.PreferredDERP] != nil {
+		return r.PreferredDERP
+	}
+	return 0
+}
+
+// metricDERPProvisionalHome counts the DERP homes connected to before a
+// netcheck report picked one.
+var metricDERPProvisionalHome = clientmetric.NewCounter("magicsock_derp_provisional_home")
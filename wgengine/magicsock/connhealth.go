@@ -0,0 +1,204 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"tailscale.com/util/set"
+)
+
+// ConnHealth is the readiness and liveness of a Conn's subsystems. See
+// Conn.Health.
+type ConnHealth struct {
+	// Ready is whether peers can reach the Conn: it has a private key
+	// and is connected to its home DERP region or, if DERP is disabled,
+	// has a bound UDP socket and has discovered its endpoints.
+	Ready bool
+
+	// Problems describes, for humans, what keeps the Conn from being
+	// Ready or fully healthy. It's empty if it's both.
+	Problems []string
+
+	// UDP4Bound and UDP6Bound are whether the Conn has an IPv4 and
+	// IPv6 UDP socket bound, respectively.
+	UDP4Bound bool
+	UDP6Bound bool
+
+	// DERPHome is the Conn's home DERP region, or zero if it has
+	// none, and DERPHomeConnected is whether it's connected to it.
+	DERPHome          int
+	DERPHomeConnected bool
+
+	// LastNetcheck is the time of the last completed netcheck, or
+	// zero if there was none, and NetcheckAge its age when Health
+	// was called.
+	LastNetcheck time.Time
+	NetcheckAge  time.Duration
+
+	// PortMapped is whether the portmapper has a port mapping.
+	PortMapped bool
+
+	// LastEndpointsUpdate is the last time the Conn's endpoints were
+	// discovered, or zero if they never were. EndpointsStale is
+	// whether that's zero or longer ago than StaleHealthAfter.
+	// Endpoint discovery stops while the Conn is idle, so endpoints
+	// going stale then doesn't mean it's unhealthy.
+	LastEndpointsUpdate time.Time
+	EndpointsStale      bool
+}
+
+// StaleHealthAfter is the age after which a netcheck or endpoint
+// discovery is reported stale by Conn.Health.
+const StaleHealthAfter = 5 * time.Minute
+
+// equal reports whether h and h2 are equal, ignoring NetcheckAge.
+func (h ConnHealth) equal(h2 ConnHealth) bool {
+	h.NetcheckAge, h2.NetcheckAge = 0, 0
+	return reflect.DeepEqual(h, h2)
+}
+
+// Health returns the readiness and liveness of c's subsystems. Embedders
+// should prefer it to the process-wide state of the health package.
+func (c *Conn) Health() ConnHealth {
+	c.mu.Lock()
+	h := ConnHealth{
+		DERPHome:            c.myDerp,
+		DERPHomeConnected:   c.myDerp != 0 && c.derpConnected.Contains(c.myDerp),
+		LastNetcheck:        c.lastNetCheckTime,
+		LastEndpointsUpdate: c.lastEndpointsTime,
+	}
+	closed, haveKey, wantDERP := c.closed, !c.privateKey.IsZero(), c.wantDerpLocked()
+	c.mu.Unlock()
+
+	now := c.now()
+	h.UDP4Bound = c.pconn4.isBound()
+	h.UDP6Bound = c.pconn6.isBound()
+	if c.portMapper != nil {
+		h.PortMapped = c.portMapper.HaveMapping()
+	}
+	if !h.LastNetcheck.IsZero() {
+		h.NetcheckAge = now.Sub(h.LastNetcheck)
+	}
+	h.EndpointsStale = h.LastEndpointsUpdate.IsZero() || now.Sub(h.LastEndpointsUpdate) > StaleHealthAfter
+
+	problem := func(format string, args ...any) {
+		h.Problems = append(h.Problems, fmt.Sprintf(format, args...))
+	}
+	switch {
+	case closed:
+		problem("closed")
+	case !haveKey:
+		problem("no private key")
+	}
+	if !h.UDP4Bound && !h.UDP6Bound {
+		problem("no UDP socket bound")
+	}
+	if wantDERP {
+		switch {
+		case h.DERPHome == 0:
+			problem("no home DERP region")
+		case !h.DERPHomeConnected:
+			problem("not connected to home DERP region %d", h.DERPHome)
+		}
+	}
+	switch {
+	case h.LastNetcheck.IsZero():
+		if wantDERP {
+			problem("no netcheck yet")
+		}
+	case h.NetcheckAge > StaleHealthAfter:
+		problem("last netcheck %v ago", h.NetcheckAge.Round(time.Second))
+	}
+	switch {
+	case h.LastEndpointsUpdate.IsZero():
+		problem("endpoints not discovered yet")
+	case h.EndpointsStale:
+		problem("endpoints last discovered %v ago", now.Sub(h.LastEndpointsUpdate).Round(time.Second))
+	}
+
+	h.Ready = !closed && haveKey
+	if wantDERP {
+		h.Ready = h.Ready && h.DERPHomeConnected
+	} else {
+		h.Ready = h.Ready && (h.UDP4Bound || h.UDP6Bound) && !h.LastEndpointsUpdate.IsZero()
+	}
+	return h
+}
+
+// WatchHealth returns a channel receiving c's Health, first as it is now
+// and then whenever it changes, until stop is called or c is closed, when
+// the channel is closed. A slow receiver only gets the latest Health.
+func (c *Conn) WatchHealth() (ch <-chan ConnHealth, stop func()) {
+	out := make(chan ConnHealth, 1)
+	poke := make(chan struct{}, 1)
+	done := make(chan struct{})
+	c.healthWatchers.add(poke)
+	poke <- struct{}{}
+
+	go func() {
+		defer close(out)
+		defer c.healthWatchers.remove(poke)
+		var last ConnHealth
+		first := true
+		for {
+			select {
+			case <-poke:
+			case <-done:
+				return
+			case <-c.donec:
+				return
+			}
+			h := c.Health()
+			if !first && h.equal(last) {
+				continue
+			}
+			first, last = false, h
+			select {
+			case <-out: // drop the stale one
+			default:
+			}
+			out <- h
+		}
+	}()
+	var once sync.Once
+	return out, func() { once.Do(func() { close(done) }) }
+}
+
+// healthWatchers are the channels poked when a Conn's Health may have
+// changed. Its mutex is a leaf lock, so it may be poked with Conn.mu held.
+type healthWatchers struct {
+	mu sync.Mutex
+	m  set.Set[chan struct{}]
+}
+
+func (w *healthWatchers) add(ch chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.m == nil {
+		w.m = make(set.Set[chan struct{}])
+	}
+	w.m.Add(ch)
+}
+
+func (w *healthWatchers) remove(ch chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.m, ch)
+}
+
+// poke notifies the watchers, without blocking.
+func (w *healthWatchers) poke() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.m {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
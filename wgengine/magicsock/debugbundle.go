@@ -0,0 +1,72 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"tailscale.com/net/netcheck"
+	"tailscale.com/types/key"
+)
+
+// DebugBundle is the state of a Conn exported by ExportDebugBundle, for
+// attaching to bug reports. Like EndpointChange, it's not a stable
+// format.
+type DebugBundle struct {
+	Time     time.Time         // when it was exported
+	Netcheck *netcheck.Report  `json:",omitempty"` // the last netcheck report
+	Peers    []DebugBundlePeer // sorted by NodeKey
+}
+
+// DebugBundlePeer is a peer's state in a DebugBundle.
+type DebugBundlePeer struct {
+	NodeKey key.NodePublic
+	Changes []EndpointChange // oldest first
+}
+
+// ExportDebugBundle writes the recent EndpointChanges of all of c's peers
+// and its last netcheck report to w, as gzipped JSON. It can be read back
+// with ReadDebugBundle.
+func (c *Conn) ExportDebugBundle(w io.Writer) error {
+	b := DebugBundle{
+		Time:     c.now(),
+		Netcheck: c.lastNetCheckReport.Load(),
+	}
+	c.mu.Lock()
+	c.peerMap.forEachEndpoint(func(ep *endpoint) {
+		b.Peers = append(b.Peers, DebugBundlePeer{
+			NodeKey: ep.publicKey,
+			Changes: ep.debugUpdates.GetAll(),
+		})
+	})
+	c.mu.Unlock()
+	sort.Slice(b.Peers, func(i, j int) bool { return b.Peers[i].NodeKey.Less(b.Peers[j].NodeKey) })
+
+	zw := gzip.NewWriter(w)
+	if err := json.NewEncoder(zw).Encode(b); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ReadDebugBundle reads a DebugBundle written by ExportDebugBundle, for
+// tools replaying it. The From and To of its EndpointChanges are decoded
+// as whatever JSON they were; their OldAddr, NewAddr and latencies keep
+// their types.
+func ReadDebugBundle(r io.Reader) (*DebugBundle, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	b := new(DebugBundle)
+	if err := json.NewDecoder(zr).Decode(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
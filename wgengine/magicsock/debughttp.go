@@ -27,7 +27,7 @@ func (c *Conn) ServeHTTPDebug(w http.ResponseWriter, r *http.Request) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	now := time.Now()
+	now := c.now()
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	fmt.Fprintf(w, "<h1>magicsock</h1>")
@@ -73,15 +73,15 @@ type D struct {
 	{
 		type kv struct {
 			ipp netip.AddrPort
-			pi  *peerInfo
-		}
-		ent := make([]kv, 0, len(c.peerMap.byIPPort))
-		for k, v := range c.peerMap.byIPPort {
-			ent = append(ent, kv{k, v})
+			ep  *endpoint
 		}
+		var ent []kv
+		c.peerMap.forEachIPPort(func(ipp netip.AddrPort, ep *endpoint) {
+			ent = append(ent, kv{ipp, ep})
+		})
 		sort.Slice(ent, func(i, j int) bool { return ipPortLess(ent[i].ipp, ent[j].ipp) })
 		for _, e := range ent {
-			ep := e.pi.ep
+			ep := e.ep
 			shortStr := ep.publicKey.ShortString()
 			fmt.Fprintf(w, "<li>%v: <a href='#%v'>%v</a></li>\n", e.ipp, strings.Trim(shortStr, "[]"), shortStr)
 		}
@@ -93,12 +93,12 @@ type kv struct {
 	{
 		type kv struct {
 			pub key.NodePublic
-			pi  *peerInfo
-		}
-		ent := make([]kv, 0, len(c.peerMap.byNodeKey))
-		for k, v := range c.peerMap.byNodeKey {
-			ent = append(ent, kv{k, v})
+			ep  *endpoint
 		}
+		ent := make([]kv, 0, c.peerMap.nodeCount())
+		c.peerMap.forEachEndpoint(func(ep *endpoint) {
+			ent = append(ent, kv{ep.publicKey, ep})
+		})
 		sort.Slice(ent, func(i, j int) bool { return ent[i].pub.Less(ent[j].pub) })
 
 		peers := map[key.NodePublic]*tailcfg.Node{}
@@ -109,7 +109,7 @@ type kv struct {
 		}
 
 		for _, e := range ent {
-			ep := e.pi.ep
+			ep := e.ep
 			shortStr := e.pub.ShortString()
 			name := peerDebugName(peers[e.pub])
 			fmt.Fprintf(w, "<h3 id=%v><a href='#%v'>%v</a> - %s</h3>\n",
@@ -132,8 +132,8 @@ func printEndpointHTML(w io.Writer, ep *endpoint) {
 		return // no activity ever
 	}
 
-	now := time.Now()
-	mnow := mono.Now()
+	now := ep.c.now()
+	mnow := ep.c.monoNow()
 	fmtMono := func(m mono.Time) string {
 		if m == 0 {
 			return "-"
@@ -204,3 +204,87 @@ func ipPortLess(a, b netip.AddrPort) bool {
 	}
 	return a.Port() < b.Port()
 }
+
+// PeerDebugState is a snapshot of a peer's path state, for debugging. See
+// Conn.DebugPeerState.
+type PeerDebugState struct {
+	NodeKey  key.NodePublic
+	DiscoKey key.DiscoPublic `json:",omitempty"`
+
+	// BestAddr is the peer's best UDP path, if any, its latency, and
+	// how long it's trusted for.
+	BestAddr        netip.AddrPort `json:",omitempty"`
+	BestAddrLatency time.Duration  `json:",omitempty"`
+	TrustBestAddr   time.Duration  `json:",omitempty"`
+
+	// DERPAddr is the peer's DERP (fallback) address, if any.
+	DERPAddr netip.AddrPort `json:",omitempty"`
+
+	// LastSend and LastRecv are how long ago traffic was last sent to
+	// and received from the peer, or zero if never.
+	LastSend time.Duration `json:",omitempty"`
+	LastRecv time.Duration `json:",omitempty"`
+
+	Heartbeating bool
+	Endpoints    []PeerEndpointDebugState
+	Changes      []EndpointChange
+}
+
+// PeerEndpointDebugState is the state of one of a peer's candidate UDP
+// endpoints. See PeerDebugState.
+type PeerEndpointDebugState struct {
+	Addr    netip.AddrPort
+	Latency time.Duration `json:",omitempty"` // of the latest pong
+	Loss    float64       `json:",omitempty"` // fraction of recent pings lost
+	// LastPing is how long ago the endpoint was last pinged, or zero if
+	// never.
+	LastPing time.Duration `json:",omitempty"`
+}
+
+// DebugPeerState returns the path state of the peer with node key nk.
+func (c *Conn) DebugPeerState(nk key.NodePublic) (PeerDebugState, error) {
+	c.mu.Lock()
+	ep, ok := c.peerMap.endpointForNodeKey(nk)
+	c.mu.Unlock()
+	if !ok {
+		return PeerDebugState{}, fmt.Errorf("unknown peer %v", nk.ShortString())
+	}
+
+	mnow := c.monoNow()
+	since := func(m mono.Time) time.Duration {
+		if m == 0 {
+			return 0
+		}
+		return mnow.Sub(m)
+	}
+	st := PeerDebugState{
+		NodeKey:  nk,
+		LastRecv: since(ep.lastRecv.LoadAtomic()),
+		Changes:  ep.debugUpdates.GetAll(),
+	}
+	if d := ep.disco.Load(); d != nil {
+		st.DiscoKey = d.key
+	}
+
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	st.BestAddr = ep.bestAddr.AddrPort
+	if st.BestAddr.IsValid() {
+		st.BestAddrLatency = ep.bestAddr.latency
+		st.TrustBestAddr = max(ep.trustBestAddrUntil.Sub(mnow), 0)
+	}
+	st.DERPAddr = ep.derpAddr
+	st.LastSend = since(ep.lastSend)
+	st.Heartbeating = ep.heartBeatTimer != nil
+	for ipp, s := range ep.endpointState {
+		es := PeerEndpointDebugState{
+			Addr:     ipp,
+			LastPing: since(s.lastPing),
+		}
+		es.Latency, _ = s.latencyLocked()
+		es.Loss, _ = s.lossLocked()
+		st.Endpoints = append(st.Endpoints, es)
+	}
+	sort.Slice(st.Endpoints, func(i, j int) bool { return ipPortLess(st.Endpoints[i].Addr, st.Endpoints[j].Addr) })
+	return st, nil
+}
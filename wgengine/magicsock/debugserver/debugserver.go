@@ -0,0 +1,289 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package debugserver serves debug commands for a running magicsock.Conn
+// over HTTP on a unix socket, so operators can poke it without the
+// embedder adding its own RPCs.
+//
+// It's opt-in: embedders that want it create a Server and serve it on a
+// listener from Listen. The commands are:
+//
+//	POST /restun?why=...[&scope=...] Conn.RefreshEndpoints, with a
+//	                                 magicsock.RefreshScope name,
+//	                                 full by default
+//	POST /rebind                     Conn.Rebind
+//	POST /block-endpoints?block=bool[&family=4|6]
+//	                                 Conn.SetBlockEndpoints, or
+//	                                 SetBlockEndpointsV4 or V6
+//	GET  /peer?key=nodekey:...       Conn.DebugPeerState, as JSON
+//	GET  /capture[?data=bool&headers-only=bool]
+//	                                 a pcapng stream from
+//	                                 Conn.StartPacketCapture, until the
+//	                                 client disconnects
+//	GET  /bundle                     Conn.ExportDebugBundle
+//
+// Every request needs HTTP basic auth with the Server's password; the
+// username is ignored.
+package debugserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/magicsock"
+)
+
+// Server is an http.Handler serving debug commands for a Conn.
+type Server struct {
+	conn     *magicsock.Conn
+	password string
+	logf     logger.Logf
+}
+
+// New returns a Server for conn that requires password, which must be
+// non-empty, in every request.
+func New(conn *magicsock.Conn, password string, logf logger.Logf) (*Server, error) {
+	if password == "" {
+		return nil, errors.New("debugserver: empty password")
+	}
+	return &Server{
+		conn:     conn,
+		password: password,
+		logf:     logger.WithPrefix(logf, "magicsock debugserver: "),
+	}, nil
+}
+
+// Listen listens on the unix socket at path, replacing a stale socket
+// file there, and makes the socket accessible only to its owner.
+func Listen(path string) (net.Listener, error) {
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("%v: address already in use", path)
+	}
+	_ = os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Serve serves s on ln until ln is closed.
+func (s *Server) Serve(ln net.Listener) error {
+	return http.Serve(ln, s)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, pass, ok := r.BasicAuth()
+	if !ok {
+		http.Error(w, "auth required", http.StatusUnauthorized)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(pass), []byte(s.password)) != 1 {
+		http.Error(w, "bad password", http.StatusForbidden)
+		return
+	}
+	switch r.URL.Path {
+	case "/restun":
+		s.serveReSTUN(w, r)
+	case "/rebind":
+		s.serveRebind(w, r)
+	case "/block-endpoints":
+		s.serveBlockEndpoints(w, r)
+	case "/peer":
+		s.servePeer(w, r)
+	case "/capture":
+		s.serveCapture(w, r)
+	case "/bundle":
+		s.serveBundle(w, r)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *Server) serveReSTUN(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	why := r.FormValue("why")
+	if why == "" {
+		why = "debugserver"
+	}
+	var scope magicsock.RefreshScope
+	if v := r.FormValue("scope"); v != "" {
+		if err := scope.UnmarshalText([]byte(v)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	s.logf("RefreshEndpoints(%v, %q)", scope, why)
+	s.conn.RefreshEndpoints(scope, why)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) serveRebind(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	s.logf("Rebind")
+	s.conn.Rebind()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) serveBlockEndpoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	block, err := strconv.ParseBool(r.FormValue("block"))
+	if err != nil {
+		http.Error(w, "missing or invalid 'block' parameter, a bool", http.StatusBadRequest)
+		return
+	}
+	switch family := r.FormValue("family"); family {
+	case "":
+		s.logf("SetBlockEndpoints(%v)", block)
+		s.conn.SetBlockEndpoints(block)
+	case "4":
+		s.logf("SetBlockEndpointsV4(%v)", block)
+		s.conn.SetBlockEndpointsV4(block)
+	case "6":
+		s.logf("SetBlockEndpointsV6(%v)", block)
+		s.conn.SetBlockEndpointsV6(block)
+	default:
+		http.Error(w, "invalid 'family' parameter, 4 or 6", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) servePeer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+	var nk key.NodePublic
+	if err := nk.UnmarshalText([]byte(r.FormValue("key"))); err != nil {
+		http.Error(w, "missing or invalid 'key' parameter, a node key", http.StatusBadRequest)
+		return
+	}
+	st, err := s.conn.DebugPeerState(nk)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(st)
+}
+
+func (s *Server) serveBundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	if err := s.conn.ExportDebugBundle(w); err != nil {
+		s.logf("ExportDebugBundle: %v", err)
+	}
+}
+
+func (s *Server) serveCapture(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+	var opts magicsock.CaptureOpts
+	for name, dst := range map[string]*bool{"data": &opts.Data, "headers-only": &opts.HeadersOnly} {
+		if v := r.FormValue(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %q parameter, a bool", name), http.StatusBadRequest)
+				return
+			}
+			*dst = b
+		}
+	}
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.WriteHeader(http.StatusOK)
+
+	cw := &captureWriter{w: w}
+	if f, ok := w.(http.Flusher); ok {
+		cw.f = f
+	}
+	s.logf("capture started")
+	stop := s.conn.StartPacketCapture(cw, opts)
+	select {
+	case <-r.Context().Done():
+	case <-cw.failed():
+	}
+	stop()
+	cw.close()
+	s.logf("capture stopped")
+}
+
+// captureWriter writes a capture to an HTTP response, flushing each write,
+// until it's closed. Packets may still be written after the capture is
+// stopped, so it guards the response from writes after the handler
+// returns.
+type captureWriter struct {
+	f http.Flusher // or nil
+
+	mu      sync.Mutex
+	w       http.ResponseWriter // nil once closed
+	failedc chan struct{}       // closed on a write error; lazily made
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.w == nil {
+		return 0, net.ErrClosed
+	}
+	n, err := cw.w.Write(p)
+	if err != nil {
+		close(cw.failedLocked())
+		cw.w = nil
+		return n, err
+	}
+	if cw.f != nil {
+		cw.f.Flush()
+	}
+	return n, nil
+}
+
+func (cw *captureWriter) failedLocked() chan struct{} {
+	if cw.failedc == nil {
+		cw.failedc = make(chan struct{})
+	}
+	return cw.failedc
+}
+
+// failed returns a channel closed when a write fails.
+func (cw *captureWriter) failed() <-chan struct{} {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.failedLocked()
+}
+
+func (cw *captureWriter) close() {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.w = nil
+}
@@ -0,0 +1,100 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package debugserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tailscale.com/types/key"
+	"tailscale.com/wgengine/magicsock"
+)
+
+func TestServer(t *testing.T) {
+	conn, err := magicsock.NewConn(magicsock.Options{Logf: t.Logf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := New(conn, "", t.Logf); err == nil {
+		t.Fatal("New with empty password succeeded")
+	}
+	s, err := New(conn, "hunter2", t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "magicsock.sock")
+	ln, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.Serve(ln)
+
+	if _, err := Listen(path); err == nil {
+		t.Fatal("second Listen succeeded")
+	}
+
+	hc := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	do := func(method, target, password string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://local"+target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if password != "" {
+			req.SetBasicAuth("", password)
+		}
+		res, err := hc.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		password string
+		want     int
+	}{
+		{"no-auth", "POST", "/rebind", "", http.StatusUnauthorized},
+		{"bad-password", "POST", "/rebind", "hunter3", http.StatusForbidden},
+		{"rebind", "POST", "/rebind", "hunter2", http.StatusNoContent},
+		{"rebind-get", "GET", "/rebind", "hunter2", http.StatusMethodNotAllowed},
+		{"restun", "POST", "/restun?why=test", "hunter2", http.StatusNoContent},
+		{"block", "POST", "/block-endpoints?block=true", "hunter2", http.StatusNoContent},
+		{"block-invalid", "POST", "/block-endpoints?block=maybe", "hunter2", http.StatusBadRequest},
+		{"block-v6", "POST", "/block-endpoints?block=true&family=6", "hunter2", http.StatusNoContent},
+		{"block-bad-family", "POST", "/block-endpoints?block=true&family=5", "hunter2", http.StatusBadRequest},
+		{"peer-invalid", "GET", "/peer?key=foo", "hunter2", http.StatusBadRequest},
+		{"peer-unknown", "GET", "/peer?key=" + key.NewNode().Public().String(), "hunter2", http.StatusNotFound},
+		{"capture-invalid", "GET", "/capture?data=maybe", "hunter2", http.StatusBadRequest},
+		{"bundle", "GET", "/bundle", "hunter2", http.StatusOK},
+		{"not-found", "GET", "/foo", "hunter2", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, body := do(tt.method, tt.target, tt.password); got != tt.want {
+				t.Errorf("status = %v (%q); want %v", got, strings.TrimSpace(body), tt.want)
+			}
+		})
+	}
+}
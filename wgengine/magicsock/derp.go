@@ -15,6 +15,7 @@
 	"runtime"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tailscale/wireguard-go/conn"
@@ -24,13 +25,17 @@
 	"tailscale.com/health"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/dnscache"
+	"tailscale.com/net/netcheck"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tstime/mono"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/cmpx"
 	"tailscale.com/util/mak"
 	"tailscale.com/util/sysresources"
+	"tailscale.com/wgengine/capture"
 )
 
 // useDerpRoute reports whether magicsock should enable the DERP
@@ -71,14 +76,68 @@ func (c *Conn) removeDerpPeerRoute(peer key.NodePublic, derpID int, dc *derphttp
 func (c *Conn) addDerpPeerRoute(peer key.NodePublic, derpID int, dc *derphttp.Client) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.isSecondaryDerpLocked(dc) {
+		return
+	}
 	mak.Set(&c.derpRoute, peer, derpRoute{derpID, dc})
 }
 
+// derpRouteVerifyInterval is the minimum time between pings to a peer to
+// verify a DERP route learned from its data packets.
+const derpRouteVerifyInterval = 10 * time.Second
+
+// noteDERPDataRouteLocked is called when a WireGuard data packet from ep
+// arrives via DERP region regionID on dc. Peers usually reach us via our
+// home region, but if ep's packets switch to another region (such as when
+// either side moved home) while ours still use the old one, the path is
+// relayed asymmetrically. So, like disco messages, data packets update
+// ep's DERP route, and a changed route is verified by a ping over it, at
+// most once per derpRouteVerifyInterval. A route whose ping times out is
+// forgotten by forgetDERPDataRoute.
+//
+// c.mu must be held.
+func (c *Conn) noteDERPDataRouteLocked(ep *endpoint, regionID int, dc *derphttp.Client) {
+	r2 := derpRoute{regionID, dc}
+	if r, ok := c.derpRoute[ep.publicKey]; ok && r == r2 {
+		return
+	}
+	mak.Set(&c.derpRoute, ep.publicKey, r2)
+	metricDERPRouteFromData.Add(1)
+
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if int(ep.derpAddr.Port()) == regionID {
+		// The peer's home; we'd send via it anyway.
+		return
+	}
+	now := c.monoNow()
+	if ep.lastDERPRoutePing != 0 && now.Sub(ep.lastDERPRoutePing) < derpRouteVerifyInterval {
+		return
+	}
+	ep.lastDERPRoutePing = now
+	metricDERPRouteVerifyPing.Add(1)
+	ep.startDiscoPingLocked(netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, uint16(regionID)), now, pingDERPRoute)
+}
+
+// forgetDERPDataRoute removes peer's DERP route via regionID, if any, after
+// a ping to verify it timed out.
+func (c *Conn) forgetDERPDataRoute(peer key.NodePublic, regionID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r, ok := c.derpRoute[peer]; ok && r.derpID == regionID {
+		delete(c.derpRoute, peer)
+		metricDERPRouteVerifyFailed.Add(1)
+	}
+}
+
 // activeDerp contains fields for an active DERP connection.
 type activeDerp struct {
 	c       *derphttp.Client
 	cancel  context.CancelFunc
-	writeCh chan<- derpWriteRequest
+	writeCh chan derpWriteRequest // receive side is only for dropping queued writes; see enqueueDerpWrite
+	// discoWriteCh is the write queue for disco messages, which
+	// runDerpWriter sends ahead of any backlog in writeCh.
+	discoWriteCh chan derpWriteRequest
 	// lastWrite is the time of the last request for its write
 	// channel (currently even if there was no write).
 	// It is always non-nil and initialized to a non-zero Time.
@@ -137,6 +196,24 @@ func (c *Conn) derpRegionCodeLocked(regionID int) string {
 	return ""
 }
 
+// setDERPConnected records whether the connection to regionID is up, for
+// Health.
+//
+// c.mu must NOT be held.
+func (c *Conn) setDERPConnected(regionID int, connected bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.derpConnected.Contains(regionID) == connected {
+		return
+	}
+	if connected {
+		mak.Set(&c.derpConnected, regionID, struct{}{})
+	} else {
+		delete(c.derpConnected, regionID)
+	}
+	c.healthWatchers.poke()
+}
+
 // c.mu must NOT be held.
 func (c *Conn) setNearestDERP(derpNum int) (wantDERP bool) {
 	c.mu.Lock()
@@ -155,6 +232,7 @@ func (c *Conn) setNearestDERP(derpNum int) (wantDERP bool) {
 	}
 	c.myDerp = derpNum
 	health.SetMagicSockDERPHome(derpNum)
+	c.healthWatchers.poke()
 
 	if c.privateKey.IsZero() {
 		// No private key yet, so DERP connections won't come up anyway.
@@ -174,6 +252,7 @@ func (c *Conn) setNearestDERP(derpNum int) (wantDERP bool) {
 		go ad.c.NotePreferred(i == c.myDerp)
 	}
 	c.goDerpConnect(derpNum)
+	c.updateDerpAltLocked()
 	return true
 }
 
@@ -182,6 +261,7 @@ func (c *Conn) setNearestDERP(derpNum int) (wantDERP bool) {
 // c.mu must be held.
 func (c *Conn) startDerpHomeConnectLocked() {
 	c.goDerpConnect(c.myDerp)
+	c.updateDerpAltLocked()
 }
 
 // goDerpConnect starts a goroutine to start connecting to the given
@@ -192,7 +272,7 @@ func (c *Conn) goDerpConnect(node int) {
 	if node == 0 {
 		return
 	}
-	go c.derpWriteChanOfAddr(netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, uint16(node)), key.NodePublic{})
+	go c.derpWriteChanOfAddr(netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, uint16(node)), key.NodePublic{}, derpLaneData)
 }
 
 var (
@@ -249,13 +329,282 @@ func bufferedDerpWritesBeforeDrop() int {
 	return bufferedDerpWrites
 }
 
-// derpWriteChanOfAddr returns a DERP client for fake UDP addresses that
-// represent DERP servers, creating them as necessary. For real UDP
-// addresses, it returns nil.
+// DERPDropPolicy is what a Conn does with packets for a DERP server whose
+// write queue is full. See Options.DERPDropPolicy.
+type DERPDropPolicy int
+
+const (
+	// DERPDropNewest drops the packets being sent.
+	DERPDropNewest DERPDropPolicy = iota
+	// DERPDropOldest drops the longest-queued write to make room for
+	// the packets being sent, so a bulk transfer's latest packets (and
+	// WireGuard's retransmits of earlier ones) aren't the ones lost.
+	DERPDropOldest
+	// DERPBlock waits up to Options.DERPBlockTimeout for room in the
+	// queue, then drops the packets being sent.
+	DERPBlock
+)
+
+func (p DERPDropPolicy) String() string {
+	switch p {
+	case DERPDropNewest:
+		return "drop-newest"
+	case DERPDropOldest:
+		return "drop-oldest"
+	case DERPBlock:
+		return "block"
+	}
+	return fmt.Sprintf("DERPDropPolicy(%d)", int(p))
+}
+
+// defaultDERPBlockTimeout is the DERPBlockTimeout used if none is set.
+const defaultDERPBlockTimeout = 100 * time.Millisecond
+
+// DERPDialPolicy configures how a Conn connects and reconnects to DERP
+// servers. Zero fields mean the defaults. See Options.DERPDial.
+type DERPDialPolicy struct {
+	// ConnectTimeout limits the time to establish a DERP connection,
+	// from DNS through the DERP handshake. The default is 10 seconds.
+	ConnectTimeout time.Duration
+	// DialTimeout limits the time to make a TCP connection to each
+	// DERP node. The default is 1.5 seconds.
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout limits the time to do the TLS handshake. By
+	// default it's only limited by ConnectTimeout.
+	TLSHandshakeTimeout time.Duration
+	// MaxBackoff is the longest to wait between attempts to reconnect
+	// to a DERP server. The wait grows with each consecutive failure,
+	// up to MaxBackoff. The default is 5 seconds.
+	MaxBackoff time.Duration
+}
+
+// defaultDERPMaxBackoff is the DERPDialPolicy.MaxBackoff used if none is
+// set.
+const defaultDERPMaxBackoff = 5 * time.Second
+
+// configureDERPClient applies c's DERP dial settings to dc, a new
+// client.
+func (c *Conn) configureDERPClient(dc *derphttp.Client) {
+	dc.ConnectTimeout = c.derpDial.ConnectTimeout
+	dc.DialTimeout = c.derpDial.DialTimeout
+	dc.TLSHandshakeTimeout = c.derpDial.TLSHandshakeTimeout
+	dc.DNSCache = dnscache.Get()
+	header := c.derpHeader.Load()
+	if header != nil {
+		dc.Header = header.Clone()
+	}
+	dc.ForceWebsockets = c.derpForceWebsockets.Load()
+	dialer := c.derpRegionDialer.Load()
+	if dialer != nil {
+		dc.SetRegionDialer(*dialer)
+	}
+}
+
+// SetDERPRetryCallback sets a callback called each time a connection to
+// a DERP server fails and is about to be retried, with the region's ID,
+// the number of consecutive failures and the error. It's called from
+// the region's reader goroutine, so it must not block.
+func (c *Conn) SetDERPRetryCallback(fn func(region, attempt int, err error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.derpRetryFunc = fn
+}
+
+// SetPreferredDERPRegion sets the DERP region to use as home, overriding
+// the nearest region found by netcheck, such as to keep relayed traffic
+// in a particular jurisdiction. A regionID of zero removes the override.
+//
+// If sticky, the region is the home whatever its latency, as long as
+// it's in the DERP map. Otherwise it's only a bias: it's the home when
+// netcheck could reach it (or couldn't reach any region), and netcheck's
+// choice is used when it couldn't.
+func (c *Conn) SetPreferredDERPRegion(regionID int, sticky bool) {
+	c.mu.Lock()
+	changed := c.pinnedDERP != regionID || c.pinnedDERPSticky != sticky
+	c.pinnedDERP = regionID
+	c.pinnedDERPSticky = sticky
+	c.derpHomeHeldWant = 0
+	apply := sticky && regionID != 0 && c.derpMap != nil && c.derpMap.Regions[regionID] != nil
+	c.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if apply {
+		c.setNearestDERP(regionID)
+	}
+	c.RefreshEndpoints(RefreshFull, "preferred-derp-change")
+}
+
+// SetDERPHomeHeldCallback sets a callback called when a sticky region set
+// by SetPreferredDERPRegion keeps the home DERP region from moving to
+// wanted, the region netcheck found best. It's called again only if
+// netcheck's choice changes. It must not block.
+func (c *Conn) SetDERPHomeHeldCallback(fn func(home, wanted int)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.derpHomeHeldFunc = fn
+}
+
+// applyPinnedDERP returns the home DERP region to use given report,
+// which is report.PreferredDERP unless overridden by
+// SetPreferredDERPRegion. Zero means netcheck found no region and
+// nothing overrode it.
+//
+// c.mu must NOT be held.
+func (c *Conn) applyPinnedDERP(report *netcheck.Report) int {
+	want := report.PreferredDERP
+
+	c.mu.Lock()
+	pin := c.pinnedDERP
+	if pin == 0 || c.derpMap == nil || c.derpMap.Regions[pin] == nil {
+		c.derpHomeHeldWant = 0
+		c.mu.Unlock()
+		return want
+	}
+	if !c.pinnedDERPSticky {
+		c.mu.Unlock()
+		if _, ok := report.RegionLatency[pin]; ok || want == 0 {
+			return pin
+		}
+		return want
+	}
+	held := want != 0 && want != pin && want != c.derpHomeHeldWant
+	if held {
+		c.derpHomeHeldWant = want
+	}
+	heldFunc := c.derpHomeHeldFunc
+	c.mu.Unlock()
+
+	if held {
+		c.logf("magicsock: staying on pinned home derp-%d; netcheck prefers derp-%d", pin, want)
+		if heldFunc != nil {
+			heldFunc(pin, want)
+		}
+	}
+	return pin
+}
+
+// derpWriteQueueSize returns the capacity of each DERP server's write
+// queue.
+func (c *Conn) derpWriteQueueSize() int {
+	if c.derpWriteQueueDepth > 0 {
+		return c.derpWriteQueueDepth
+	}
+	return bufferedDerpWritesBeforeDrop()
+}
+
+// derpLane is one of the write queues of a DERP connection.
+type derpLane int
+
+const (
+	derpLaneData  derpLane = iota // WireGuard packets: activeDerp.writeCh
+	derpLaneDisco                 // disco messages: activeDerp.discoWriteCh
+)
+
+// derpDiscoWriteQueueSize is the capacity of each DERP server's disco
+// write queue. Disco messages are few and small, and are written ahead of
+// data, so it only needs to hold a burst of them, such as the pings and
+// CallMeMaybe of a path upgrade.
+const derpDiscoWriteQueueSize = 32
+
+// writeChan returns the write queue of ad for lane.
+func (ad *activeDerp) writeChan(lane derpLane) chan derpWriteRequest {
+	if lane == derpLaneDisco {
+		return ad.discoWriteCh
+	}
+	return ad.writeCh
+}
+
+// enqueueDerpWrite queues wr on ch, the write queue of a DERP server. If
+// it's full, it waits for room until ctx is done, if ctx can be canceled,
+// or else applies c's DERPDropPolicy. It reports whether wr was queued.
+func (c *Conn) enqueueDerpWrite(ctx context.Context, ch chan derpWriteRequest, wr derpWriteRequest) (queued bool, err error) {
+	select {
+	case <-c.donec:
+		return false, errConnClosed
+	case ch <- wr:
+		return true, nil
+	default:
+	}
+
+	if done := ctx.Done(); done != nil {
+		metricSendDERPQueueWait.Add(1)
+		select {
+		case <-c.donec:
+			return false, errConnClosed
+		case ch <- wr:
+			return true, nil
+		case <-done:
+			c.noteDerpDrops(wr.pubKey, len(wr.pkts))
+			return false, fmt.Errorf("%w: %w", errDropDerpPacket, ctx.Err())
+		}
+	}
+
+	switch c.derpDropPolicy {
+	case DERPDropOldest:
+		select {
+		case old := <-ch:
+			c.noteDerpDrops(old.pubKey, len(old.pkts))
+		default:
+			// The writer emptied it meanwhile.
+		}
+		select {
+		case ch <- wr:
+			return true, nil
+		default:
+		}
+	case DERPBlock:
+		d := c.derpBlockTimeout
+		if d <= 0 {
+			d = defaultDERPBlockTimeout
+		}
+		t, tc := c.newTimer(d)
+		defer t.Stop()
+		select {
+		case <-c.donec:
+			return false, errConnClosed
+		case ch <- wr:
+			return true, nil
+		case <-tc:
+		}
+	}
+	c.noteDerpDrops(wr.pubKey, len(wr.pkts))
+	return false, errDropDerpPacket
+}
+
+// noteDerpDrops records that n packets to peer were dropped because their
+// DERP server's write queue was full.
+func (c *Conn) noteDerpDrops(peer key.NodePublic, n int) {
+	metricSendDERPErrorQueue.Add(int64(n))
+	if peer.IsZero() {
+		return
+	}
+	cnt, ok := c.derpDrops.Load(peer)
+	if !ok {
+		cnt, _ = c.derpDrops.LoadOrStore(peer, new(atomic.Int64))
+	}
+	cnt.Add(int64(n))
+}
+
+// DERPDropsByPeer returns, for each peer with any, the number of packets
+// to it dropped because their DERP server's write queue was full.
+func (c *Conn) DERPDropsByPeer() map[key.NodePublic]int64 {
+	m := make(map[key.NodePublic]int64)
+	c.derpDrops.Range(func(k key.NodePublic, v *atomic.Int64) bool {
+		m[k] = v.Load()
+		return true
+	})
+	return m
+}
+
+// derpWriteChanOfAddr returns the write queue for lane of a DERP client
+// for fake UDP addresses that represent DERP servers, creating them as
+// necessary. For real UDP addresses, it returns nil.
 //
 // If peer is non-zero, it can be used to find an active reverse
 // path, without using addr.
-func (c *Conn) derpWriteChanOfAddr(addr netip.AddrPort, peer key.NodePublic) chan<- derpWriteRequest {
+func (c *Conn) derpWriteChanOfAddr(addr netip.AddrPort, peer key.NodePublic, lane derpLane) chan derpWriteRequest {
 	if addr.Addr() != tailcfg.DerpMagicIPAddr {
 		return nil
 	}
@@ -284,9 +633,18 @@ func (c *Conn) derpWriteChanOfAddr(addr netip.AddrPort, peer key.NodePublic) cha
 	// below when we have both.)
 	ad, ok := c.activeDerp[regionID]
 	if ok {
-		*ad.lastWrite = time.Now()
+		*ad.lastWrite = c.now()
 		c.setPeerLastDerpLocked(peer, regionID, regionID)
-		return ad.writeCh
+		return ad.writeChan(lane)
+	}
+
+	// If the server of another region we're connected to also serves
+	// this one, use that connection. See noteDERPRegionsServed.
+	if hostRegion, ad, ok := c.coalescedDERPLocked(regionID); ok {
+		*ad.lastWrite = c.now()
+		c.setPeerLastDerpLocked(peer, hostRegion, regionID)
+		metricDERPCoalesced.Add(1)
+		return ad.writeChan(lane)
 	}
 
 	// If we don't have an open connection to the peer's home DERP
@@ -299,8 +657,8 @@ func (c *Conn) derpWriteChanOfAddr(addr netip.AddrPort, peer key.NodePublic) cha
 		if r, ok := c.derpRoute[peer]; ok {
 			if ad, ok := c.activeDerp[r.derpID]; ok && ad.c == r.dc {
 				c.setPeerLastDerpLocked(peer, r.derpID, regionID)
-				*ad.lastWrite = time.Now()
-				return ad.writeCh
+				*ad.lastWrite = c.now()
+				return ad.writeChan(lane)
 			}
 		}
 	}
@@ -343,29 +701,23 @@ func (c *Conn) derpWriteChanOfAddr(addr netip.AddrPort, peer key.NodePublic) cha
 	})
 
 	dc.SetCanAckPings(true)
+	dc.SetCanCoalesceRegions(true)
 	dc.NotePreferred(c.myDerp == regionID)
 	dc.SetAddressFamilySelector(derpAddrFamSelector{c})
 	dc.SetForcedWebsocketCallback(c.derpForcedWebsocketFunc)
-	dc.DNSCache = dnscache.Get()
-	header := c.derpHeader.Load()
-	if header != nil {
-		dc.Header = header.Clone()
-	}
-	dc.ForceWebsockets = c.derpForceWebsockets.Load()
-	dialer := c.derpRegionDialer.Load()
-	if dialer != nil {
-		dc.SetRegionDialer(*dialer)
-	}
+	c.configureDERPClient(dc)
 
 	ctx, cancel := context.WithCancel(c.connCtx)
-	ch := make(chan derpWriteRequest, bufferedDerpWritesBeforeDrop())
+	ch := make(chan derpWriteRequest, c.derpWriteQueueSize())
+	discoCh := make(chan derpWriteRequest, derpDiscoWriteQueueSize)
 
 	ad.c = dc
 	ad.writeCh = ch
+	ad.discoWriteCh = discoCh
 	ad.cancel = cancel
 	ad.lastWrite = new(time.Time)
-	*ad.lastWrite = time.Now()
-	ad.createTime = time.Now()
+	*ad.lastWrite = c.now()
+	ad.createTime = c.now()
 	c.activeDerp[regionID] = ad
 	metricNumDERPConns.Set(int64(len(c.activeDerp)))
 	c.logActiveDerpLocked()
@@ -390,16 +742,16 @@ func (c *Conn) derpWriteChanOfAddr(addr netip.AddrPort, peer key.NodePublic) cha
 			dc.Connect(ctx)
 			c.mu.Lock()
 			defer c.mu.Unlock()
-			close(c.derpStarted)
+			c.closeDerpStartedLocked()
 			c.muCond.Broadcast()
 		}()
 	}
 
 	go c.runDerpReader(ctx, addr, dc, wg, startGate)
-	go c.runDerpWriter(ctx, dc, ch, wg, startGate)
+	go c.runDerpWriter(ctx, dc, ch, discoCh, wg, startGate)
 	go c.derpActiveFunc()
 
-	return ad.writeCh
+	return ad.writeChan(lane)
 }
 
 // setPeerLastDerpLocked notes that peer is now being written to via
@@ -446,7 +798,8 @@ func (c *Conn) setPeerLastDerpLocked(peer key.NodePublic, regionID, homeID int)
 // out, which also releases the buffer.
 type derpReadResult struct {
 	regionID int
-	n        int // length of data received
+	dc       *derphttp.Client // the connection it was received on
+	n        int              // length of data received
 	src      key.NodePublic
 	// copyBuf is called to copy the data to dst.  It returns how
 	// much data was copied, which will be n if dst is large
@@ -461,6 +814,7 @@ type derpReadResult struct {
 func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netip.AddrPort, dc *derphttp.Client, wg *syncs.WaitGroupChan, startGate <-chan struct{}) {
 	defer wg.Decr()
 	defer dc.Close()
+	defer c.forgetRetiredDerp(dc)
 
 	select {
 	case <-startGate:
@@ -470,7 +824,7 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netip.AddrPort, d
 
 	didCopy := make(chan struct{}, 1)
 	regionID := int(derpFakeAddr.Port())
-	res := derpReadResult{regionID: regionID}
+	res := derpReadResult{regionID: regionID, dc: dc}
 	var pkt derp.ReceivedPacket
 	res.copyBuf = func(dst []byte) int {
 		n := copy(dst, pkt.Data)
@@ -478,20 +832,45 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netip.AddrPort, d
 		return n
 	}
 
-	defer health.SetDERPRegionConnectedState(regionID, false)
-	defer health.SetDERPRegionHealth(regionID, "")
+	// A connection retired by a key rotation doesn't report its region's
+	// state; its replacement does. Nor does a second connection to the
+	// home region.
+	defer func() {
+		if c.isSecondaryDerp(dc) {
+			return
+		}
+		c.setDERPConnected(regionID, false)
+		health.SetDERPRegionHealth(regionID, "")
+		health.SetDERPRegionConnectedState(regionID, false)
+	}()
 
 	// peerPresent is the set of senders we know are present on this
 	// connection, based on messages we've received from the server.
 	peerPresent := map[key.NodePublic]bool{}
-	bo := backoff.NewBackoff(fmt.Sprintf("derp-%d", regionID), c.logf, 5*time.Second)
+	bo := backoff.NewBackoff(fmt.Sprintf("derp-%d", regionID), c.logf, cmpx.Or(c.derpDial.MaxBackoff, defaultDERPMaxBackoff))
+	var failures int // consecutive
 	var lastPacketTime time.Time
 	var lastPacketSrc key.NodePublic
+	announced := false // whether DERPConnecting was noted for the current connection
 
 	for {
+		if !announced && !c.isSecondaryDerp(dc) {
+			announced = true
+			c.noteDERPState(DERPStateEvent{Region: regionID, State: DERPConnecting})
+		}
 		msg, connGen, err := dc.RecvDetail()
 		if err != nil {
-			health.SetDERPRegionConnectedState(regionID, false)
+			announced = false
+			if !c.isSecondaryDerp(dc) {
+				health.SetDERPRegionConnectedState(regionID, false)
+				c.setDERPConnected(regionID, false)
+				c.noteDERPState(DERPStateEvent{
+					Region:   regionID,
+					State:    DERPDisconnected,
+					Err:      err,
+					ErrClass: c.derpErrClass(ctx, err),
+				})
+			}
 			// Forget that all these peers have routes.
 			for peer := range peerPresent {
 				delete(peerPresent, peer)
@@ -514,20 +893,33 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netip.AddrPort, d
 
 			// If our DERP connection broke, it might be because our network
 			// conditions changed. Start that check.
-			c.ReSTUN("derp-recv-error")
+			c.RefreshEndpoints(RefreshFull, "derp-recv-error")
+
+			failures++
+			c.mu.Lock()
+			retryFunc := c.derpRetryFunc
+			c.mu.Unlock()
+			if retryFunc != nil {
+				retryFunc(regionID, failures, err)
+			}
 
 			// Back off a bit before reconnecting.
+			start := c.now()
 			bo.BackOff(ctx, err)
 			select {
 			case <-ctx.Done():
 				return
 			default:
 			}
+			if !c.isSecondaryDerp(dc) {
+				c.noteDERPState(DERPStateEvent{Region: regionID, State: DERPBackoff, Backoff: c.now().Sub(start)})
+			}
 			continue
 		}
 		bo.BackOff(ctx, nil) // reset
+		failures = 0
 
-		now := time.Now()
+		now := c.now()
 		if lastPacketTime.IsZero() || now.Sub(lastPacketTime) > 5*time.Second {
 			health.NoteDERPRegionReceivedFrame(regionID)
 			lastPacketTime = now
@@ -535,9 +927,16 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netip.AddrPort, d
 
 		switch m := msg.(type) {
 		case derp.ServerInfoMessage:
-			health.SetDERPRegionConnectedState(regionID, true)
-			health.SetDERPRegionHealth(regionID, "") // until declared otherwise
+			if !c.isSecondaryDerp(dc) {
+				health.SetDERPRegionConnectedState(regionID, true)
+				health.SetDERPRegionHealth(regionID, "") // until declared otherwise
+				c.setDERPConnected(regionID, true)
+				c.noteDERPState(DERPStateEvent{Region: regionID, State: DERPConnected})
+			}
 			c.logf("magicsock: derp-%d connected; connGen=%v", regionID, connGen)
+			if len(m.Regions) > 0 && !c.isSecondaryDerp(dc) {
+				c.noteDERPRegionsServed(regionID, dc, m.Regions)
+			}
 			continue
 		case derp.ReceivedPacket:
 			pkt = m
@@ -565,7 +964,9 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netip.AddrPort, d
 			}()
 			continue
 		case derp.HealthMessage:
-			health.SetDERPRegionHealth(regionID, m.Problem)
+			if !c.isSecondaryDerp(dc) {
+				health.SetDERPRegionHealth(regionID, m.Problem)
+			}
 		case derp.PeerGoneMessage:
 			switch m.Reason {
 			case derp.PeerGoneReasonDisconnected:
@@ -603,12 +1004,22 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netip.AddrPort, d
 type derpWriteRequest struct {
 	addr   netip.AddrPort
 	pubKey key.NodePublic
-	b      []byte // copied; ownership passed to receiver
+	pkts   [][]byte // copied; ownership passed to receiver
+	queued mono.Time
+
+	// flushed, if non-nil, marks a request with no packets that's only
+	// for runDerpWriter to close flushed once the requests queued
+	// before it have been sent. See drainDerpLocked.
+	flushed chan struct{}
 }
 
 // runDerpWriter runs in a goroutine for the life of a DERP
 // connection, handling received packets.
-func (c *Conn) runDerpWriter(ctx context.Context, dc *derphttp.Client, ch <-chan derpWriteRequest, wg *syncs.WaitGroupChan, startGate <-chan struct{}) {
+//
+// It writes the requests in discoCh ahead of those in ch, so that disco
+// messages, such as the CallMeMaybe of a path upgrade, aren't stuck behind
+// a backlog of data during a large transfer. Either may be nil.
+func (c *Conn) runDerpWriter(ctx context.Context, dc *derphttp.Client, ch, discoCh <-chan derpWriteRequest, wg *syncs.WaitGroupChan, startGate <-chan struct{}) {
 	defer wg.Decr()
 	select {
 	case <-startGate:
@@ -617,18 +1028,51 @@ func (c *Conn) runDerpWriter(ctx context.Context, dc *derphttp.Client, ch <-chan
 	}
 
 	for {
-		select {
-		case <-ctx.Done():
+		wr, ok := nextDerpWrite(ctx, ch, discoCh)
+		if !ok {
 			return
-		case wr := <-ch:
-			err := dc.Send(wr.pubKey, wr.b)
-			if err != nil {
-				c.logf("magicsock: derp.Send(%v): %v", wr.addr, err)
-				metricSendDERPError.Add(1)
-			} else {
-				metricSendDERP.Add(1)
-			}
 		}
+		if wr.flushed != nil {
+			close(wr.flushed)
+			continue
+		}
+		if !wr.queued.IsZero() {
+			histDERPWriteQueueWait.Observe(mono.Since(wr.queued).Seconds())
+		}
+		var err error
+		if len(wr.pkts) == 1 {
+			err = dc.Send(wr.pubKey, wr.pkts[0])
+		} else {
+			err = dc.SendBatch(wr.pubKey, wr.pkts)
+		}
+		if err != nil {
+			c.logfSampled("derp-send", "magicsock: derp.Send(%v): %v", wr.addr, err)
+			metricSendDERPError.Add(int64(len(wr.pkts)))
+		} else {
+			metricSendDERP.Add(int64(len(wr.pkts)))
+			c.noteDERPSent(int(wr.addr.Port()), wr.pkts)
+		}
+	}
+}
+
+// nextDerpWrite returns the next request for runDerpWriter to write: the
+// first queued in discoCh if any, or else the first to arrive in either
+// queue. It returns false once ctx is done.
+func nextDerpWrite(ctx context.Context, ch, discoCh <-chan derpWriteRequest) (wr derpWriteRequest, ok bool) {
+	select {
+	case wr := <-discoCh:
+		metricSendDERPDiscoLane.Add(1)
+		return wr, true
+	default:
+	}
+	select {
+	case <-ctx.Done():
+		return wr, false
+	case wr := <-discoCh:
+		metricSendDERPDiscoLane.Add(1)
+		return wr, true
+	case wr := <-ch:
+		return wr, true
 	}
 }
 
@@ -662,18 +1106,29 @@ func (c *Conn) processDERPReadResult(dm derpReadResult, b []byte) (n int, ep *en
 	ncopy := dm.copyBuf(b)
 	if ncopy != n {
 		err := fmt.Errorf("received DERP packet of length %d that's too big for WireGuard buf size %d", n, ncopy)
-		c.logf("magicsock: %v", err)
+		c.logfSampled("derp-recv-too-big", "magicsock: %v", err)
 		return 0, nil
 	}
 
 	ipp := netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, uint16(regionID))
-	if c.handleDiscoMessage(b[:n], ipp, dm.src, discoRXPathDERP) {
+	kind := c.classifyRecv(b[:n], discoRXPathDERP)
+	if kind != packetDrop {
+		c.noteDERPRecv(regionID, b[:n])
+	}
+	switch kind {
+	case packetDisco:
+		c.handleDiscoMessage(b[:n], ipp, dm.src, discoRXPathDERP)
+		return 0, nil
+	case packetDrop:
 		return 0, nil
 	}
 
 	var ok bool
 	c.mu.Lock()
 	ep, ok = c.peerMap.endpointForNodeKey(dm.src)
+	if ok && dm.dc != nil && !c.isSecondaryDerpLocked(dm.dc) {
+		c.noteDERPDataRouteLocked(ep, regionID, dm.dc)
+	}
 	c.mu.Unlock()
 	if !ok {
 		// We don't know anything about this node key, nothing to
@@ -685,6 +1140,7 @@ func (c *Conn) processDERPReadResult(dm derpReadResult, b []byte) (n int, ep *en
 	if stats := c.stats.Load(); stats != nil {
 		stats.UpdateRxPhysical(ep.nodeAddr, ipp, dm.n)
 	}
+	c.captureWireGuard(capture.PathWireGuardFromPeer, ipp, dm.src, b[:n])
 	return n, ep
 }
 
@@ -747,12 +1203,14 @@ func (c *Conn) SetDERPMap(dm *tailcfg.DERPMap) {
 		}
 	}
 
-	go c.ReSTUN("derp-map-update")
+	go c.RefreshEndpoints(RefreshFull, "derp-map-update")
 }
 func (c *Conn) wantDerpLocked() bool { return c.derpMap != nil }
 
 // c.mu must be held.
 func (c *Conn) closeAllDerpLocked(why string) {
+	c.closeRetiredDerpLocked(why)
+	c.closeDerpAltLocked(why)
 	if len(c.activeDerp) == 0 {
 		return // without the useless log statement
 	}
@@ -809,11 +1267,52 @@ func (c *Conn) closeOrReconnectDERPLocked(regionID int, why string) {
 	}
 }
 
+// derpDrainTimeout is how long drainDerpLocked waits for a DERP
+// connection's queued writes to be sent before closing it anyway.
+const derpDrainTimeout = 5 * time.Second
+
+// drainDerpLocked removes the DERP connection to regionID from
+// c.activeDerp, so that new writes open a new connection, and closes it
+// once the writes already queued on it have been sent, or after
+// derpDrainTimeout. The new connection to the region only starts once
+// the old one is closed, as for closeDerpLocked.
+//
+// c.mu must be held.
+// It is the responsibility of the caller to call logActiveDerpLocked after any set of drains.
+func (c *Conn) drainDerpLocked(regionID int, why string) {
+	ad, ok := c.activeDerp[regionID]
+	if !ok {
+		return
+	}
+	c.logf("magicsock: draining connection to derp-%v (%v), age %v", regionID, why, c.now().Sub(ad.createTime).Round(time.Second))
+	delete(c.activeDerp, regionID)
+	metricNumDERPConns.Set(int64(len(c.activeDerp)))
+	go func() {
+		defer ad.c.Close()
+		defer ad.cancel()
+		timer := time.NewTimer(derpDrainTimeout)
+		defer timer.Stop()
+		flushed := make(chan struct{})
+		select {
+		case ad.writeCh <- derpWriteRequest{flushed: flushed}:
+		case <-timer.C:
+			return
+		}
+		select {
+		case <-flushed:
+		case <-timer.C:
+		}
+	}()
+}
+
 // c.mu must be held.
 // It is the responsibility of the caller to call logActiveDerpLocked after any set of closes.
 func (c *Conn) closeDerpLocked(regionID int, why string) {
+	if c.derpAlt != nil && c.derpAlt.regionID == regionID {
+		c.closeDerpAltLocked(why)
+	}
 	if ad, ok := c.activeDerp[regionID]; ok {
-		c.logf("magicsock: closing connection to derp-%v (%v), age %v", regionID, why, time.Since(ad.createTime).Round(time.Second))
+		c.logf("magicsock: closing connection to derp-%v (%v), age %v", regionID, why, c.now().Sub(ad.createTime).Round(time.Second))
 		go ad.c.Close()
 		ad.cancel()
 		delete(c.activeDerp, regionID)
@@ -823,7 +1322,7 @@ func (c *Conn) closeDerpLocked(regionID int, why string) {
 
 // c.mu must be held.
 func (c *Conn) logActiveDerpLocked() {
-	now := time.Now()
+	now := c.now()
 	c.logf("magicsock: %v active derp conns%s", len(c.activeDerp), logger.ArgWriter(func(buf *bufio.Writer) {
 		if len(c.activeDerp) == 0 {
 			return
@@ -861,7 +1360,7 @@ func (c *Conn) cleanStaleDerp() {
 	}
 	c.derpCleanupTimerArmed = false
 
-	tooOld := time.Now().Add(-derpInactiveCleanupTime)
+	tooOld := c.now().Add(-derpInactiveCleanupTime)
 	dirty := false
 	someNonHomeOpen := false
 	for i, ad := range c.activeDerp {
@@ -894,7 +1393,7 @@ func (c *Conn) scheduleCleanStaleDerpLocked() {
 	if c.derpCleanupTimer != nil {
 		c.derpCleanupTimer.Reset(derpCleanStaleInterval)
 	} else {
-		c.derpCleanupTimer = time.AfterFunc(derpCleanStaleInterval, c.cleanStaleDerp)
+		c.derpCleanupTimer = c.afterFunc(derpCleanStaleInterval, c.cleanStaleDerp)
 	}
 }
 
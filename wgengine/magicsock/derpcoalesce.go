@@ -0,0 +1,77 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/util/clientmetric"
+)
+
+// derpCoalesce is the connection to another DERP region whose server said
+// it also serves a region, per derp.ServerInfoMessage.Regions.
+type derpCoalesce struct {
+	regionID int
+	dc       *derphttp.Client
+}
+
+// noteDERPRegionsServed records that the server at the other end of dc,
+// the connection to regionID, also serves regions, so that packets to
+// peers homed in them go over dc rather than a connection of their own.
+// That's common when several regions point at one frontend, such as in
+// single-host deployments.
+//
+// c.mu must NOT be held.
+func (c *Conn) noteDERPRegionsServed(regionID int, dc *derphttp.Client, regions []int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ad, ok := c.activeDerp[regionID]; !ok || ad.c != dc {
+		return // closed meanwhile
+	}
+	for _, r := range regions {
+		if r == regionID || c.derpMap == nil || c.derpMap.Regions[r] == nil {
+			continue
+		}
+		if cur, ok := c.derpCoalesced[r]; ok && cur.regionID != regionID && c.coalescedDERPLiveLocked(cur) {
+			continue // keep the first server to say so
+		}
+		if c.derpCoalesced == nil {
+			c.derpCoalesced = make(map[int]derpCoalesce)
+		}
+		c.derpCoalesced[r] = derpCoalesce{regionID, dc}
+	}
+	c.logf("magicsock: derp-%d also serves regions %v", regionID, regions)
+}
+
+// coalescedDERPLocked returns the connection, and its region, that
+// packets to peers homed in regionID can be sent over instead of one of
+// its own, if any. The home region always gets its own connection, so
+// that its health and presence are tracked as usual.
+//
+// c.mu must be held.
+func (c *Conn) coalescedDERPLocked(regionID int) (hostRegion int, ad activeDerp, ok bool) {
+	if regionID == c.myDerp {
+		return 0, activeDerp{}, false
+	}
+	co, ok := c.derpCoalesced[regionID]
+	if !ok {
+		return 0, activeDerp{}, false
+	}
+	if !c.coalescedDERPLiveLocked(co) {
+		delete(c.derpCoalesced, regionID)
+		return 0, activeDerp{}, false
+	}
+	return co.regionID, c.activeDerp[co.regionID], true
+}
+
+// coalescedDERPLiveLocked reports whether co's connection is still open.
+//
+// c.mu must be held.
+func (c *Conn) coalescedDERPLiveLocked(co derpCoalesce) bool {
+	ad, ok := c.activeDerp[co.regionID]
+	return ok && ad.c == co.dc
+}
+
+// metricDERPCoalesced counts the DERP writes sent over another region's
+// connection whose server also serves their region.
+var metricDERPCoalesced = clientmetric.NewCounter("magicsock_derp_coalesced")
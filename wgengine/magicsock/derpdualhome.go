@@ -0,0 +1,162 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/syncs"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/key"
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/mak"
+)
+
+// derpAlt is the second connection to the home DERP region kept when
+// Options.DERPDualHome is set. It prefers a different node of the region
+// than the main connection, and disco messages sent via the home region
+// are duplicated to it, so that path negotiation doesn't wait for the
+// main connection to time out and reconnect if its node fails.
+//
+// Like a connection retired by a key rotation, it receives packets but
+// doesn't report its region's state or add DERP routes.
+type derpAlt struct {
+	activeDerp
+	regionID int
+}
+
+// updateDerpAltLocked starts, replaces or closes c.derpAlt to match the
+// home DERP region. c.mu must be held.
+func (c *Conn) updateDerpAltLocked() {
+	regionID := c.myDerp
+	var r *tailcfg.DERPRegion
+	if c.derpDualHome && !c.closed && !c.privateKey.IsZero() && c.derpMap != nil {
+		r = c.derpMap.Regions[regionID]
+	}
+	if r == nil || len(r.Nodes) < 2 {
+		c.closeDerpAltLocked("no-dual-home")
+		return
+	}
+	if alt := c.derpAlt; alt != nil {
+		if alt.regionID == regionID && alt.c.SelfPublicKey() == c.privateKey.Public() {
+			return
+		}
+		c.closeDerpAltLocked("home-changed")
+	}
+
+	dc := derphttp.NewRegionClient(c.privateKey, c.logf, c.netMon, func() *tailcfg.DERPRegion {
+		// As in derpWriteChanOfAddr, c.mu can't be acquired here.
+		if c.connCtx.Err() != nil {
+			return nil
+		}
+		derpMap := c.derpMapAtomic.Load()
+		if derpMap == nil {
+			return nil
+		}
+		return altDERPRegion(derpMap.Regions[regionID])
+	})
+	dc.SetCanAckPings(true)
+	dc.SetAddressFamilySelector(derpAddrFamSelector{c})
+	c.configureDERPClient(dc)
+
+	ctx, cancel := context.WithCancel(c.connCtx)
+	ch := make(chan derpWriteRequest, c.derpWriteQueueSize())
+	discoCh := make(chan derpWriteRequest, derpDiscoWriteQueueSize)
+	lastWrite := new(time.Time)
+	*lastWrite = c.now()
+	c.derpAlt = &derpAlt{
+		activeDerp: activeDerp{
+			c:            dc,
+			cancel:       cancel,
+			writeCh:      ch,
+			discoWriteCh: discoCh,
+			lastWrite:    lastWrite,
+			createTime:   c.now(),
+		},
+		regionID: regionID,
+	}
+	c.logf("magicsock: adding second connection to home derp-%v", regionID)
+
+	wg := syncs.NewWaitGroupChan()
+	wg.Add(2)
+	addr := netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, uint16(regionID))
+	go c.runDerpReader(ctx, addr, dc, wg, syncs.ClosedChan())
+	go c.runDerpWriter(ctx, dc, ch, discoCh, wg, syncs.ClosedChan())
+}
+
+// closeDerpAltLocked closes c.derpAlt, if any. c.mu must be held.
+func (c *Conn) closeDerpAltLocked(why string) {
+	alt := c.derpAlt
+	if alt == nil {
+		return
+	}
+	c.logf("magicsock: closing second connection to derp-%v (%v), age %v", alt.regionID, why, c.now().Sub(alt.createTime).Round(time.Second))
+	go alt.c.Close()
+	alt.cancel()
+	c.derpAlt = nil
+	// Until its reader exits, it's known to be secondary like a closed
+	// retired connection, so it doesn't mark the region disconnected.
+	mak.Set(&c.retiredDerp, alt.c, retiredDerp{activeDerp: alt.activeDerp, closed: true})
+}
+
+// isSecondaryDerp reports whether dc is a DERP connection that doesn't
+// update the state of its region or DERP routes: one retired by a key
+// rotation, or c.derpAlt.
+func (c *Conn) isSecondaryDerp(dc *derphttp.Client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.isSecondaryDerpLocked(dc)
+}
+
+// c.mu must be held.
+func (c *Conn) isSecondaryDerpLocked(dc *derphttp.Client) bool {
+	if _, ok := c.retiredDerp[dc]; ok {
+		return true
+	}
+	return c.derpAlt != nil && c.derpAlt.c == dc
+}
+
+// sendDERPAlt queues pkt, a disco message sent to pubKey via the DERP
+// region at dst, on c.derpAlt too, if dst is its region. It never blocks:
+// if the queue is full, the main connection's copy has to do.
+func (c *Conn) sendDERPAlt(dst netip.AddrPort, pubKey key.NodePublic, pkt []byte) {
+	c.mu.Lock()
+	alt := c.derpAlt
+	if alt != nil {
+		*alt.lastWrite = c.now()
+	}
+	c.mu.Unlock()
+	if alt == nil || int(dst.Port()) != alt.regionID {
+		return
+	}
+	select {
+	case alt.discoWriteCh <- derpWriteRequest{addr: dst, pubKey: pubKey, pkts: [][]byte{bytes.Clone(pkt)}, queued: mono.Now()}:
+		metricDERPDualHomeSent.Add(1)
+	default:
+		metricDERPDualHomeDropped.Add(1)
+	}
+}
+
+// altDERPRegion returns r with its nodes rotated by one, so that a
+// connection to it prefers a different node than the main connection
+// to r, or nil if r has fewer than two nodes.
+func altDERPRegion(r *tailcfg.DERPRegion) *tailcfg.DERPRegion {
+	if r == nil || len(r.Nodes) < 2 {
+		return nil
+	}
+	r2 := *r
+	r2.Nodes = append(slices.Clone(r.Nodes[1:]), r.Nodes[0])
+	return &r2
+}
+
+var (
+	metricDERPDualHomeSent    = clientmetric.NewCounter("magicsock_derp_dual_home_sent")
+	metricDERPDualHomeDropped = clientmetric.NewCounter("magicsock_derp_dual_home_dropped")
+)
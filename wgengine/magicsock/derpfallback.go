@@ -0,0 +1,183 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"tailscale.com/tstime/mono"
+	"tailscale.com/util/clientmetric"
+)
+
+// derpFallbackReason is why an endpoint with a best UDP address also
+// sends via DERP. See derpFallbackLocked.
+type derpFallbackReason uint8
+
+const (
+	derpFallbackNone         derpFallbackReason = iota // best UDP address used alone
+	derpFallbackTrustExpired                           // no pong for too long
+	derpFallbackPongLoss                               // pings to the best address were lost
+	derpFallbackSendErrors                             // UDP sends to the best address failed
+)
+
+func (r derpFallbackReason) String() string {
+	switch r {
+	case derpFallbackNone:
+		return "none"
+	case derpFallbackTrustExpired:
+		return "trust-expired"
+	case derpFallbackPongLoss:
+		return "pong-loss"
+	case derpFallbackSendErrors:
+		return "send-errors"
+	}
+	return "unknown"
+}
+
+const (
+	// derpFallbackLostPongs is the number of consecutive pings to the
+	// best address that must be lost to fall back to DERP, even if the
+	// address is still trusted.
+	derpFallbackLostPongs = 3
+
+	// derpFallbackSendErrs is the number of consecutive UDP sends to
+	// the best address that must fail to fall back to DERP.
+	derpFallbackSendErrs = 3
+
+	// derpFallbackGrace is how long past trustBestAddrUntil the best
+	// address is still used alone if at most one ping to it was lost,
+	// so a single lost pong doesn't bounce the peer to DERP.
+	derpFallbackGrace = 5 * time.Second
+
+	// derpFallbackRecoverPongs is the number of consecutive pongs from
+	// the best address needed to stop a fallback for pong loss or send
+	// errors.
+	derpFallbackRecoverPongs = 2
+)
+
+// derpFallbackLocked returns why de, which has a best address, should also
+// send via DERP, or derpFallbackNone if it shouldn't. Fallbacks for pong
+// loss or send errors last until the best address recovers, so a path
+// that's merely flaky doesn't flap between UDP and DERP.
+//
+// de.mu must be held.
+func (de *endpoint) derpFallbackLocked(now mono.Time) derpFallbackReason {
+	st := de.endpointState[de.bestAddr.AddrPort]
+	switch {
+	case de.udpSendErrs >= derpFallbackSendErrs:
+		return derpFallbackSendErrors
+	case st != nil && st.lastPingsLostLocked(derpFallbackLostPongs):
+		return derpFallbackPongLoss
+	}
+	if r := de.derpFallback; r == derpFallbackPongLoss || r == derpFallbackSendErrors {
+		if de.udpSendErrs > 0 || st == nil || !st.lastPingsOKLocked(derpFallbackRecoverPongs) {
+			return r
+		}
+	}
+	if !now.After(de.trustBestAddrUntil) {
+		return derpFallbackNone
+	}
+	if de.trustBestAddrUntil != 0 && now.Before(de.trustBestAddrUntil.Add(derpFallbackGrace)) &&
+		(st == nil || !st.lastPingsLostLocked(2)) {
+		if !de.derpFallbackDeferred {
+			de.derpFallbackDeferred = true
+			metricDERPFallbackDeferred.Add(1)
+		}
+		return derpFallbackNone
+	}
+	return derpFallbackTrustExpired
+}
+
+// updateDERPFallbackLocked is derpFallbackLocked, also logging and counting
+// the fallbacks it starts and ends. de.mu must be held.
+func (de *endpoint) updateDERPFallbackLocked(now mono.Time) derpFallbackReason {
+	r := de.derpFallbackLocked(now)
+	if !now.After(de.trustBestAddrUntil) {
+		de.derpFallbackDeferred = false
+	}
+	if r == de.derpFallback {
+		return r
+	}
+	prev := de.derpFallback
+	de.derpFallback = r
+	switch r {
+	case derpFallbackNone:
+		metricDERPFallbackRecovered.Add(1)
+		de.logPeer(slog.LevelInfo, "disco: stopped falling back to DERP", "was", prev.String(), LogKeyPath, de.bestAddr.AddrPort)
+		return r
+	case derpFallbackTrustExpired:
+		metricDERPFallbackTrustExpired.Add(1)
+	case derpFallbackPongLoss:
+		metricDERPFallbackPongLoss.Add(1)
+	case derpFallbackSendErrors:
+		metricDERPFallbackSendErrors.Add(1)
+	}
+	de.logPeer(slog.LevelInfo, "disco: falling back to DERP", "reason", r.String(), LogKeyPath, de.bestAddr.AddrPort)
+	return r
+}
+
+// noteUDPSendResult records whether a UDP send to addr, de's best address
+// when sent, failed, for derpFallbackLocked and the circuit breaker of
+// noteUDPSendToAddrLocked.
+func (de *endpoint) noteUDPSendResult(addr netip.AddrPort, failed bool) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	if failed {
+		de.udpSendErrs++
+	} else {
+		de.udpSendErrs = 0
+	}
+	de.noteUDPSendToAddrLocked(addr, failed)
+}
+
+// minDirectPathMTU is the smallest path MTU that carries WireGuard
+// packets of the default TUN MTU, 1280, with their WireGuard and IPv6 and
+// UDP overhead.
+const minDirectPathMTU = 1280 + 80
+
+// derpReasonLocked returns why de, which addrForSendLocked said to send to
+// via udpAddr and derpAddr, is on DERP, for PeerStatus.DERPReason, or ""
+// if it isn't.
+//
+// de.c.mu and de.mu must be held.
+func (de *endpoint) derpReasonLocked(now mono.Time, udpAddr, derpAddr netip.AddrPort) string {
+	switch {
+	case !derpAddr.IsValid():
+		return ""
+	case udpAddr.IsValid():
+		// Set by addrForSendLocked.
+		return de.derpFallback.String()
+	case de.preferDERP:
+		return "derp-faster"
+	case de.c.blockEndpoints4 && de.c.blockEndpoints6:
+		return "endpoints-blocked"
+	case len(de.endpointState) == 0:
+		return "no-endpoints"
+	case de.pathMTU != 0 && de.pathMTU < minDirectPathMTU:
+		return "mtu-too-small"
+	}
+	for _, st := range de.endpointState {
+		if !st.quarantinedLocked(now) {
+			return "pings-failed"
+		}
+	}
+	return "send-errors"
+}
+
+// lastPingsOKLocked reports whether the last n pings to st were answered.
+// endpoint.mu must be held.
+func (st *endpointState) lastPingsOKLocked(n int) bool {
+	mask := uint32(1)<<n - 1
+	return int(st.pingsCounted) >= n && st.pingLost&mask == 0
+}
+
+var (
+	metricDERPFallbackTrustExpired = clientmetric.NewCounter("magicsock_derp_fallback_trust_expired")
+	metricDERPFallbackPongLoss     = clientmetric.NewCounter("magicsock_derp_fallback_pong_loss")
+	metricDERPFallbackSendErrors   = clientmetric.NewCounter("magicsock_derp_fallback_send_errors")
+	metricDERPFallbackRecovered    = clientmetric.NewCounter("magicsock_derp_fallback_recovered")
+	metricDERPFallbackDeferred     = clientmetric.NewCounter("magicsock_derp_fallback_deferred")
+)
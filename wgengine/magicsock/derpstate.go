@@ -0,0 +1,181 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/mak"
+)
+
+// DERPState is a state of the connection to a DERP region.
+type DERPState int
+
+const (
+	// DERPConnecting means a connection to the region is being
+	// established.
+	DERPConnecting DERPState = iota
+	// DERPConnected means the region's server finished the DERP
+	// handshake.
+	DERPConnected
+	// DERPDisconnected means the connection failed, or broke while
+	// reading, with an error of DERPStateEvent.ErrClass.
+	DERPDisconnected
+	// DERPBackoff means the reconnection waited DERPStateEvent.Backoff
+	// after a failure.
+	DERPBackoff
+)
+
+var derpStateNames = [...]string{
+	DERPConnecting:   "connecting",
+	DERPConnected:    "connected",
+	DERPDisconnected: "disconnected",
+	DERPBackoff:      "backoff",
+}
+
+func (s DERPState) String() string {
+	if s < 0 || int(s) >= len(derpStateNames) {
+		return fmt.Sprintf("DERPState(%d)", int(s))
+	}
+	return derpStateNames[s]
+}
+
+// DERPStateEvent is a transition of the connection to a DERP region.
+type DERPStateEvent struct {
+	Region int
+	State  DERPState
+	// Err and ErrClass are the error and its class, one of "closed",
+	// "canceled", "network_down", "timeout", "eof", "refused", "reset",
+	// "dns", "tls" or "other", of a DERPDisconnected event.
+	Err      error
+	ErrClass string
+	// Backoff is the time waited by a DERPBackoff event.
+	Backoff time.Duration
+}
+
+// SetDERPStateCallback sets a callback called on each transition of the
+// connections to DERP regions, except the second connection to the home
+// region kept by Options.DERPDualHome. It's called from the region's
+// reader goroutine, so it must not block.
+//
+// The transitions are also counted in clientmetrics named for the
+// region, such as magicsock_derp_region_1_connected.
+func (c *Conn) SetDERPStateCallback(fn func(DERPStateEvent)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.derpStateFunc = fn
+}
+
+// noteDERPState counts ev and passes it to the DERPStateCallback, if
+// any. c.mu must NOT be held.
+func (c *Conn) noteDERPState(ev DERPStateEvent) {
+	m := derpRegionMetricsFor(ev.Region)
+	switch ev.State {
+	case DERPConnecting:
+		m.connecting.Add(1)
+	case DERPConnected:
+		m.connected.Add(1)
+	case DERPDisconnected:
+		m.disconnected.Add(1)
+		derpDisconnectMetric(ev.ErrClass).Add(1)
+	case DERPBackoff:
+		m.backoffMs.Add(ev.Backoff.Milliseconds())
+	}
+
+	c.mu.Lock()
+	fn := c.derpStateFunc
+	c.mu.Unlock()
+	if fn != nil {
+		fn(ev)
+	}
+}
+
+// derpErrClass returns the class of err, an error reading from a DERP
+// connection, for DERPStateEvent.ErrClass.
+func (c *Conn) derpErrClass(ctx context.Context, err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var hostErr x509.HostnameError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.Is(err, derphttp.ErrClientClosed):
+		return "closed"
+	case ctx.Err() != nil:
+		return "canceled"
+	case c.networkDown():
+		return "network_down"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &certErr), errors.As(err, &hostErr), errors.As(err, &recordErr):
+		return "tls"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
+
+// derpRegionMetrics are the clientmetrics of the connection to a DERP
+// region.
+type derpRegionMetrics struct {
+	connecting   *clientmetric.Metric
+	connected    *clientmetric.Metric
+	disconnected *clientmetric.Metric
+	backoffMs    *clientmetric.Metric
+}
+
+var (
+	derpMetricsMu       sync.Mutex
+	derpRegionMetricsOf map[int]*derpRegionMetrics
+	derpDisconnectOf    map[string]*clientmetric.Metric
+)
+
+// derpRegionMetricsFor returns the metrics of regionID, creating them
+// the first time it's seen.
+func derpRegionMetricsFor(regionID int) *derpRegionMetrics {
+	derpMetricsMu.Lock()
+	defer derpMetricsMu.Unlock()
+	if m, ok := derpRegionMetricsOf[regionID]; ok {
+		return m
+	}
+	prefix := fmt.Sprintf("magicsock_derp_region_%d_", regionID)
+	m := &derpRegionMetrics{
+		connecting:   clientmetric.NewCounter(prefix + "connecting"),
+		connected:    clientmetric.NewCounter(prefix + "connected"),
+		disconnected: clientmetric.NewCounter(prefix + "disconnected"),
+		backoffMs:    clientmetric.NewCounter(prefix + "backoff_ms"),
+	}
+	mak.Set(&derpRegionMetricsOf, regionID, m)
+	return m
+}
+
+// derpDisconnectMetric returns the counter of DERP disconnections with
+// an error of class, across regions.
+func derpDisconnectMetric(class string) *clientmetric.Metric {
+	derpMetricsMu.Lock()
+	defer derpMetricsMu.Unlock()
+	if m, ok := derpDisconnectOf[class]; ok {
+		return m
+	}
+	m := clientmetric.NewCounter("magicsock_derp_disconnect_" + class)
+	mak.Set(&derpDisconnectOf, class, m)
+	return m
+}
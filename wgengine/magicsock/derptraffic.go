@@ -0,0 +1,127 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"fmt"
+
+	"github.com/tailscale/wireguard-go/device"
+	"tailscale.com/disco"
+	"tailscale.com/util/clientmetric"
+)
+
+// DERPTrafficClass is a class of the packets exchanged with peers via
+// DERP, for accounting. See SetDERPTrafficCallback.
+type DERPTrafficClass int
+
+const (
+	// DERPTrafficDisco is disco messages.
+	DERPTrafficDisco DERPTrafficClass = iota
+	// DERPTrafficHandshake is WireGuard handshake initiations, responses
+	// and cookie replies.
+	DERPTrafficHandshake
+	// DERPTrafficData is WireGuard transport data, including keepalives.
+	DERPTrafficData
+
+	numDERPTrafficClasses
+)
+
+var derpTrafficClassNames = [...]string{
+	DERPTrafficDisco:     "disco",
+	DERPTrafficHandshake: "handshake",
+	DERPTrafficData:      "data",
+}
+
+func (k DERPTrafficClass) String() string {
+	if k < 0 || k >= numDERPTrafficClasses {
+		return fmt.Sprintf("DERPTrafficClass(%d)", int(k))
+	}
+	return derpTrafficClassNames[k]
+}
+
+// DERPTraffic is the bytes of a class of packets sent to or received from
+// peers via a DERP region. They're the bytes of the packets themselves,
+// without DERP's framing.
+type DERPTraffic struct {
+	Region  int
+	Class   DERPTrafficClass
+	TxBytes int
+	RxBytes int
+}
+
+// SetDERPTrafficCallback sets a callback called with the bytes of each
+// packet, or batch of packets, sent or received via DERP, by region and
+// class, such as to account for the traffic that isn't sent directly. It's
+// called from the DERP connections' goroutines, so it must be quick and
+// not block. A nil fn removes it.
+//
+// The bytes are also counted by class in clientmetrics, such as
+// magicsock_derp_tx_bytes_data.
+func (c *Conn) SetDERPTrafficCallback(fn func(DERPTraffic)) {
+	if fn == nil {
+		c.derpTrafficFunc.Store(nil)
+		return
+	}
+	c.derpTrafficFunc.Store(&fn)
+}
+
+// derpTrafficClassOf returns the class of b, a packet sent or received via
+// DERP, which never carries obfuscated disco.
+func derpTrafficClassOf(b []byte) DERPTrafficClass {
+	switch {
+	case len(b) >= len(disco.Magic) && string(b[:len(disco.Magic)]) == disco.Magic:
+		return DERPTrafficDisco
+	case len(b) == 0:
+		return DERPTrafficData
+	}
+	switch b[0] {
+	case device.MessageInitiationType, device.MessageResponseType, device.MessageCookieReplyType:
+		return DERPTrafficHandshake
+	}
+	return DERPTrafficData
+}
+
+// noteDERPSent counts pkts, sent via DERP region regionID, and passes
+// them on to the DERPTrafficCallback, if any.
+func (c *Conn) noteDERPSent(regionID int, pkts [][]byte) {
+	var tx [numDERPTrafficClasses]int
+	for _, b := range pkts {
+		tx[derpTrafficClassOf(b)] += len(b)
+	}
+	fn := c.derpTrafficFunc.Load()
+	for class, n := range tx {
+		if n == 0 {
+			continue
+		}
+		metricDERPTxBytes[class].Add(int64(n))
+		if fn != nil {
+			(*fn)(DERPTraffic{Region: regionID, Class: DERPTrafficClass(class), TxBytes: n})
+		}
+	}
+}
+
+// noteDERPRecv counts b, received via DERP region regionID, and passes it
+// on to the DERPTrafficCallback, if any.
+func (c *Conn) noteDERPRecv(regionID int, b []byte) {
+	class := derpTrafficClassOf(b)
+	metricDERPRxBytes[class].Add(int64(len(b)))
+	if fn := c.derpTrafficFunc.Load(); fn != nil {
+		(*fn)(DERPTraffic{Region: regionID, Class: class, RxBytes: len(b)})
+	}
+}
+
+// metricDERPTxBytes and metricDERPRxBytes count the bytes of the packets
+// sent and received via DERP by DERPTrafficClass.
+var (
+	metricDERPTxBytes = [...]*clientmetric.Metric{
+		DERPTrafficDisco:     clientmetric.NewCounter("magicsock_derp_tx_bytes_disco"),
+		DERPTrafficHandshake: clientmetric.NewCounter("magicsock_derp_tx_bytes_handshake"),
+		DERPTrafficData:      clientmetric.NewCounter("magicsock_derp_tx_bytes_data"),
+	}
+	metricDERPRxBytes = [...]*clientmetric.Metric{
+		DERPTrafficDisco:     clientmetric.NewCounter("magicsock_derp_rx_bytes_disco"),
+		DERPTrafficHandshake: clientmetric.NewCounter("magicsock_derp_rx_bytes_handshake"),
+		DERPTrafficData:      clientmetric.NewCounter("magicsock_derp_rx_bytes_data"),
+	}
+)
@@ -0,0 +1,49 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"tailscale.com/disco"
+	"tailscale.com/types/key"
+)
+
+// Disco capabilities are how optional disco features are negotiated: each
+// gets a disco.Capability, which magicsock advertises in its pings once it
+// handles the feature, and which a sender checks with
+// peerHasDiscoCapLocked before using the feature with a peer.
+const (
+	// localDiscoCaps are the disco capabilities this node advertises.
+	localDiscoCaps = disco.CapPortPredict
+
+	// legacyDiscoCaps are the disco capabilities that predate their
+	// negotiation. They're assumed of peers that haven't advertised
+	// any, which may be old nodes that handle them without saying so.
+	// Newer features must not be added here.
+	legacyDiscoCaps = disco.CapPortPredict
+)
+
+// noteDiscoCapsLocked records the capabilities advertised in a ping from
+// di's peer.
+//
+// c.mu must be held.
+func (c *Conn) noteDiscoCapsLocked(di *discoInfo, caps disco.Capability) {
+	if di.peerCaps == caps {
+		return
+	}
+	di.peerCaps = caps
+	c.dlogf("[v1] magicsock: disco: %v advertises capabilities %v", di.discoShort, caps)
+}
+
+// peerHasDiscoCapLocked reports whether the peer with disco key dk handles
+// the disco features of cap, going by the capabilities in its last ping,
+// or by legacyDiscoCaps if it didn't advertise any.
+//
+// c.mu must be held.
+func (c *Conn) peerHasDiscoCapLocked(dk key.DiscoPublic, cap disco.Capability) bool {
+	caps := legacyDiscoCaps
+	if di, ok := c.discoInfo[dk]; ok && di.peerCaps != 0 {
+		caps = di.peerCaps
+	}
+	return caps.Has(cap)
+}
@@ -0,0 +1,226 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/tstime/mono"
+	"tailscale.com/tstime/rate"
+	"tailscale.com/types/key"
+)
+
+// DiscoSendLimits configures the process-wide limit on outgoing disco
+// messages (pings, pongs and call-me-maybes), shared by all Conns.
+//
+// Messages over the limit are dropped rather than queued, as disco
+// already retries on its own schedule.
+type DiscoSendLimits struct {
+	// Rate is the number of disco messages per second that may be
+	// sent across all peers. Zero means unlimited.
+	Rate rate.Limit
+	// Burst is the number of messages that may be sent at once
+	// across all peers before Rate applies. It must be at least 1 if
+	// Rate is non-zero.
+	Burst int
+
+	// PeerRate and PeerBurst are the same, but for the messages sent
+	// to any single peer, so one churning peer can't use up the whole
+	// global budget. A zero PeerRate means no per-peer limit.
+	PeerRate  rate.Limit
+	PeerBurst int
+}
+
+// DefaultDiscoSendLimits returns the limits in effect until
+// SetDiscoSendLimits is called. They're far above what a healthy node
+// sends, and only kick in during discovery storms, such as when
+// thousands of peers change endpoints at once.
+func DefaultDiscoSendLimits() DiscoSendLimits {
+	return DiscoSendLimits{
+		Rate:      1000,
+		Burst:     2000,
+		PeerRate:  50,
+		PeerBurst: 100,
+	}
+}
+
+// SetDiscoSendLimits sets the process-wide limits on outgoing disco
+// messages.
+func SetDiscoSendLimits(l DiscoSendLimits) {
+	discoLimiter.set(l)
+}
+
+// discoLimiter is the process-wide disco send limiter.
+var discoLimiter = newDiscoSendLimiter(DefaultDiscoSendLimits())
+
+// maxDiscoLimiterPeers is the number of per-peer buckets after which
+// discoSendLimiter starts pruning idle ones.
+const maxDiscoLimiterPeers = 4096
+
+// discoSendLimiter is a token bucket limiting all disco sends, plus one
+// bucket per destination disco key.
+type discoSendLimiter struct {
+	mu     sync.Mutex
+	limits DiscoSendLimits
+	global *rate.Limiter // or nil if unlimited
+	peers  map[key.DiscoPublic]*discoPeerBucket
+}
+
+type discoPeerBucket struct {
+	lim      *rate.Limiter
+	lastUsed mono.Time
+}
+
+func newDiscoSendLimiter(l DiscoSendLimits) *discoSendLimiter {
+	d := new(discoSendLimiter)
+	d.set(l)
+	return d
+}
+
+func (d *discoSendLimiter) set(l DiscoSendLimits) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.limits = l
+	d.global = nil
+	if l.Rate > 0 {
+		d.global = rate.NewLimiter(l.Rate, max(l.Burst, 1))
+	}
+	d.peers = nil
+}
+
+// allow reports whether a disco message to dst may be sent now. A message
+// is only charged to dst's bucket and the global bucket if both allow it,
+// so a peer over its share doesn't consume the others' budget, and a
+// message dropped by the global limit doesn't count against its peer.
+func (d *discoSendLimiter) allow(dst key.DiscoPublic) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var peer *rate.Limiter
+	if d.limits.PeerRate > 0 {
+		now := mono.Now()
+		b, ok := d.peers[dst]
+		if !ok {
+			if len(d.peers) >= maxDiscoLimiterPeers {
+				d.pruneLocked(now)
+			}
+			if d.peers == nil {
+				d.peers = make(map[key.DiscoPublic]*discoPeerBucket)
+			}
+			b = &discoPeerBucket{lim: rate.NewLimiter(d.limits.PeerRate, max(d.limits.PeerBurst, 1))}
+			d.peers[dst] = b
+		}
+		b.lastUsed = now
+		peer = b.lim
+	}
+	if peer != nil && peer.Tokens() < 1 {
+		metricDiscoSendThrottledPeer.Add(1)
+		return false
+	}
+	if d.global != nil && !d.global.Allow() {
+		metricDiscoSendThrottledGlobal.Add(1)
+		return false
+	}
+	if peer != nil {
+		// Can't fail: the bucket had a token and d.mu is held.
+		peer.Allow()
+	}
+	return true
+}
+
+// pruneLocked removes the buckets of peers idle long enough for their
+// bucket to have refilled, as those behave the same as new buckets.
+func (d *discoSendLimiter) pruneLocked(now mono.Time) {
+	refill := time.Duration(float64(max(d.limits.PeerBurst, 1)) / float64(d.limits.PeerRate) * float64(time.Second))
+	for k, b := range d.peers {
+		if now.Sub(b.lastUsed) > refill {
+			delete(d.peers, k)
+		}
+	}
+}
+
+const (
+	// discoRecvRate and discoRecvBurst limit the disco messages opened
+	// from each source address and disco key, per Conn. A healthy peer
+	// sends a handful of pings per path every few seconds, so this only
+	// applies to floods of garbage or replayed frames, which would
+	// otherwise each cost a naclbox open.
+	discoRecvRate  rate.Limit = 20
+	discoRecvBurst            = 40
+
+	// maxDiscoRecvSources is the number of sources tracked by a
+	// discoRecvLimiter. Past it, messages from new sources are dropped
+	// until idle sources are pruned.
+	maxDiscoRecvSources = 4096
+)
+
+// discoRecvSource is what a discoRecvLimiter limits received disco
+// messages by.
+type discoRecvSource struct {
+	src netip.AddrPort // UDP source, or DERP magic IP and region
+	key key.DiscoPublic
+}
+
+type discoRecvBucket struct {
+	lim      *rate.Limiter
+	lastUsed mono.Time
+	limited  bool // whether the last message was dropped
+}
+
+// discoRecvLimiter is a token bucket per discoRecvSource limiting the
+// incoming disco messages a Conn opens.
+type discoRecvLimiter struct {
+	mu      sync.Mutex
+	rate    rate.Limit
+	burst   int
+	sources map[discoRecvSource]*discoRecvBucket
+}
+
+func newDiscoRecvLimiter(r rate.Limit, burst int) *discoRecvLimiter {
+	return &discoRecvLimiter{rate: r, burst: burst}
+}
+
+// allow reports whether a disco message from src sealed by k may be
+// opened now. If not, first reports whether it's the first one dropped
+// since src was last allowed, so that each flood is logged once.
+func (d *discoRecvLimiter) allow(src netip.AddrPort, k key.DiscoPublic) (ok, first bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := mono.Now()
+	s := discoRecvSource{src, k}
+	b, ok := d.sources[s]
+	if !ok {
+		if len(d.sources) >= maxDiscoRecvSources {
+			d.pruneLocked(now)
+			if len(d.sources) >= maxDiscoRecvSources {
+				return false, false
+			}
+		}
+		if d.sources == nil {
+			d.sources = make(map[discoRecvSource]*discoRecvBucket)
+		}
+		b = &discoRecvBucket{lim: rate.NewLimiter(d.rate, d.burst)}
+		d.sources[s] = b
+	}
+	b.lastUsed = now
+	if b.lim.Allow() {
+		b.limited = false
+		return true, false
+	}
+	first = !b.limited
+	b.limited = true
+	return false, first
+}
+
+// pruneLocked removes the buckets of sources idle long enough for their
+// bucket to have refilled, as those behave the same as new buckets.
+func (d *discoRecvLimiter) pruneLocked(now mono.Time) {
+	refill := time.Duration(float64(d.burst) / float64(d.rate) * float64(time.Second))
+	for s, b := range d.sources {
+		if now.Sub(b.lastUsed) > refill {
+			delete(d.sources, s)
+		}
+	}
+}
@@ -4,12 +4,13 @@
 package magicsock
 
 import (
-	"bufio"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"log/slog"
 	"math"
+	"math/bits"
 	"math/rand"
 	"net"
 	"net/netip"
@@ -22,13 +23,16 @@
 	"golang.org/x/exp/maps"
 	"tailscale.com/disco"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/neterror"
+	"tailscale.com/net/sockstats"
 	"tailscale.com/net/stun"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tstime"
 	"tailscale.com/tstime/mono"
 	"tailscale.com/types/key"
-	"tailscale.com/types/logger"
 	"tailscale.com/util/mak"
 	"tailscale.com/util/ringbuffer"
+	"tailscale.com/wgengine/capture"
 )
 
 // endpoint is a wireguard/conn.Endpoint. In wireguard-go and kernel WireGuard
@@ -54,17 +58,30 @@ type endpoint struct {
 
 	disco atomic.Pointer[endpointDisco] // if the peer supports disco, the key and short string
 
+	// node is the peer's node as of the last updateFromNode, so that
+	// SetNetworkMap can skip peers whose node is unchanged. It's
+	// guarded by Conn.mu, not mu.
+	node tailcfg.NodeView
+
 	// mu protects all following fields.
 	mu sync.Mutex // Lock ordering: Conn.mu, then endpoint.mu
 
-	heartBeatTimer *time.Timer    // nil when idle
-	lastSend       mono.Time      // last time there was outgoing packets sent to this peer (from wireguard-go)
-	lastFullPing   mono.Time      // last time we pinged all disco endpoints
-	derpAddr       netip.AddrPort // fallback/bootstrap path, if non-zero (non-zero for well-behaved clients)
-
-	bestAddr           addrLatency // best non-DERP path; zero if none
-	bestAddrAt         mono.Time   // time best address re-confirmed
-	trustBestAddrUntil mono.Time   // time when bestAddr expires
+	heartBeatTimer tstime.TimerController // nil when idle
+	lastSend       mono.Time              // last time there was outgoing packets sent to this peer (from wireguard-go)
+	lastFullPing   mono.Time              // last time we pinged all disco endpoints
+	derpAddr       netip.AddrPort         // fallback/bootstrap path, if non-zero (non-zero for well-behaved clients)
+
+	bestAddr           addrLatency    // best non-DERP path; zero if none
+	bestAddrAt         mono.Time      // time best address re-confirmed
+	trustBestAddrUntil mono.Time      // time when bestAddr expires
+	migrateTo          netip.AddrPort // where the peer said it migrated, until its pong; see noteMigrationPing
+	bestAddrLearned    bool           // bestAddr is an unconfirmed path from SetLearnedPaths
+	learnedPathPinged  bool           // the learned bestAddr was pinged; see pingLearnedPathLocked
+	reportedPath       netip.AddrPort // last path passed to the SetPathLearnedCallback func
+	lastDERPRoutePing  mono.Time      // last pingDERPRoute ping; see Conn.noteDERPDataRouteLocked
+	lastSendPath       netip.AddrPort // UDP address, or else DERP address, last sent to
+	multipathPrev      netip.AddrPort // previous path also sent to until multipathUntil; see multipathAddrLocked
+	multipathUntil     mono.Time
 	sentPing           map[stun.TxID]sentPing
 	endpointState      map[netip.AddrPort]*endpointState
 	isCallMeMaybeEP    map[netip.AddrPort]bool
@@ -76,8 +93,68 @@ type endpoint struct {
 	// See #540 for background.
 	heartbeatDisabled bool
 
+	// keepaliveInterval is how often to heartbeat while the session's
+	// active. Zero means heartbeatInterval. See
+	// Conn.SetPeerKeepaliveInterval.
+	keepaliveInterval time.Duration
+
 	expired         bool // whether the node has expired
 	isWireguardOnly bool // whether the endpoint is WireGuard only
+
+	// probeOnly is whether the peer is only measured, never sent
+	// traffic, and probeTimer runs its probes. See setProbeOnlyLocked.
+	probeOnly  bool
+	probeTimer tstime.TimerController // nil unless probeOnly
+
+	// maxGSOSegments caps the number of datagrams to this peer coalesced
+	// into a single UDP send. Zero means the platform maximum; one
+	// disables coalescing. See Conn.SetPeerGSOSegments.
+	maxGSOSegments int
+	// coalescedSendErrs is the number of consecutive coalesced sends to
+	// this peer that failed but succeeded when resent uncoalesced.
+	coalescedSendErrs int
+	// pathMTU is the path MTU to the peer, beyond which datagrams aren't
+	// coalesced; zero if unknown. See Conn.SetPeerPathMTU.
+	pathMTU int
+
+	// udpSendErrs is the number of consecutive UDP sends to this peer
+	// that failed. derpFallback is why the last send also went via
+	// DERP, and derpFallbackDeferred whether the current lapse of
+	// trustBestAddrUntil was forgiven; see derpFallbackLocked.
+	udpSendErrs          int
+	derpFallback         derpFallbackReason
+	derpFallbackDeferred bool
+
+	// derpLatency is the round-trip time to the peer via DERP, measured
+	// at derpLatencyAt by a ping sent at lastDERPRTTPing, and preferDERP
+	// whether it's sent to via DERP for being faster than bestAddr. See
+	// Conn.SetPreferFasterDERP.
+	derpLatency     time.Duration
+	derpLatencyAt   mono.Time
+	lastDERPRTTPing mono.Time
+	preferDERP      bool
+
+	// handshakeFails is the number of WireGuard handshakes in a row
+	// that failed while sent to handshakeFailAddr, the last at
+	// lastHandshakeFail. See Conn.NoteHandshakeFailed.
+	handshakeFails    int
+	handshakeFailAddr netip.AddrPort
+	lastHandshakeFail mono.Time
+
+	// quality is the RTT and jitter of the current path and the recent
+	// path changes, for PeerStatus and "tailscale ping".
+	quality pathQuality
+
+	// lastPortPredict is when the last port prediction with the peer
+	// started, and portPredictTxID the TxID of the one we started, if
+	// its reply is still expected. See Options.PortPrediction.
+	lastPortPredict mono.Time
+	portPredictTxID stun.TxID
+
+	// pathKeepalive is whether the path last used to send to the peer
+	// wants WireGuard persistent keepalives. See
+	// Options.PathKeepaliveFunc.
+	pathKeepalive pathKeepalive
 }
 
 type pendingCLIPing struct {
@@ -95,7 +172,7 @@ type endpointDisco struct {
 type sentPing struct {
 	to      netip.AddrPort
 	at      mono.Time
-	timer   *time.Timer // timeout timer
+	timer   tstime.TimerController // timeout timer
 	purpose discoPingPurpose
 }
 
@@ -124,15 +201,54 @@ type endpointState struct {
 	// was advertised last via a call-me-maybe disco message.
 	callMeMaybeTime time.Time
 
+	// predictedTime, if non-zero, is the time this endpoint was last
+	// predicted by a port prediction or, after that, got a pong.
+	predictedTime time.Time
+
+	// lanTime, if non-zero, is the time this endpoint was last
+	// announced by the peer via LAN discovery.
+	lanTime time.Time
+
 	recentPongs []pongReply // ring buffer up to pongHistoryCount entries
 	recentPong  uint16      // index into recentPongs of most recent; older before, wrapped
 
+	// pingLost has a bit set for each of the last pingsCounted pings to
+	// this endpoint that timed out without a pong, the most recent ping
+	// in the low bit.
+	pingLost     uint32
+	pingsCounted uint8 // up to pingLossWindow
+
+	// sendErrs is the number of consecutive UDP sends to this endpoint
+	// that failed. Once there are quarantineSendErrs, it's quarantined
+	// until quarantinedUntil, for the quarantines'th time in a row. See
+	// noteUDPSendToAddrLocked.
+	sendErrs         int
+	quarantinedUntil mono.Time
+	quarantines      uint8
+
 	index int16 // index in nodecfg.Node.Endpoints; meaningless if lastGotPing non-zero
 }
 
 // pongHistoryCount is how many pongReply values we keep per endpointState
 const pongHistoryCount = 64
 
+// pingLossWindow is how many of the most recent pings to an endpoint are
+// used to estimate its loss. It's the number of bits in
+// endpointState.pingLost.
+const pingLossWindow = 32
+
+const (
+	// wireguardOnlyReprobeInterval is how often the addresses of a
+	// WireGuard only endpoint with several are pinged again, while
+	// sending to it, to fail over from one that stops answering.
+	wireguardOnlyReprobeInterval = 30 * time.Second
+
+	// wireguardOnlyDeadPings is how many consecutive pings to an
+	// address of a WireGuard only endpoint must be lost for it to be
+	// considered to have stopped answering.
+	wireguardOnlyDeadPings = 2
+)
+
 type pongReply struct {
 	latency time.Duration
 	pongAt  mono.Time      // when we received the pong
@@ -145,22 +261,130 @@ type pongReply struct {
 // time.
 type EndpointChange struct {
 	When time.Time // when the change occurred
-	What string    // what this change is
-	From any       `json:",omitempty"` // information about the previous state
-	To   any       `json:",omitempty"` // information about the new state
+	// WhenMono is When as read from both the monotonic and wall clocks,
+	// for ordering changes and correlating them with external logs
+	// across suspend and resume.
+	WhenMono mono.Stamp
+	What     string // what this change is
+	// Reason is What, as an enum for tools.
+	Reason EndpointChangeReason
+	From   any `json:",omitempty"` // information about the previous state
+	To     any `json:",omitempty"` // information about the new state
+	// OldAddr and NewAddr are the previous and new addresses of the
+	// change, and OldLatency and NewLatency their latencies, if From
+	// and To have them.
+	OldAddr    netip.AddrPort `json:",omitempty"`
+	NewAddr    netip.AddrPort `json:",omitempty"`
+	OldLatency time.Duration  `json:",omitempty"`
+	NewLatency time.Duration  `json:",omitempty"`
+	// Loss is the percentage of recent disco pings to the path in To
+	// that got no pong, if known.
+	Loss float64 `json:",omitempty"`
 }
 
-// shouldDeleteLocked reports whether we should delete this endpoint.
-func (st *endpointState) shouldDeleteLocked() bool {
+// EndpointChangeReason is the kind of an EndpointChange.
+type EndpointChangeReason int
+
+const (
+	ChangeUnknown                 EndpointChangeReason = iota
+	ChangeEndpointDeleted                              // a candidate endpoint was deleted
+	ChangeBestAddrDeleted                              // the best address's endpoint was deleted
+	ChangeNetmapReset                                  // the peer's disco key changed in the netmap
+	ChangeDERPRemoved                                  // the netmap removed the peer's DERP region
+	ChangeDERPUpdated                                  // the netmap changed the peer's DERP region
+	ChangeEndpointsUpdated                             // the netmap added candidate endpoints
+	ChangeBestAddrMigration                            // the peer migrated to a new address
+	ChangeBestAddrUpdated                              // a pong found a better address
+	ChangeBestAddrLatency                              // a pong re-confirmed the best address
+	ChangeCallMeMaybe                                  // a CallMeMaybe added candidate endpoints
+	ChangeStopAndReset                                 // the peer's paths were reset
+	ChangeLearnedPath                                  // a path from SetLearnedPaths was tried
+	ChangePortPredict                                  // a port prediction added candidate endpoints
+	ChangeLANDiscovery                                 // a LAN announcement added a candidate endpoint
+	ChangeBestAddrQuarantined                          // send errors quarantined the best address
+	ChangeBestAddrHandshakeFailed                      // failed WireGuard handshakes quarantined the best address
+)
+
+var endpointChangeReasonNames = [...]string{
+	ChangeUnknown:                 "unknown",
+	ChangeEndpointDeleted:         "endpoint-deleted",
+	ChangeBestAddrDeleted:         "best-addr-deleted",
+	ChangeNetmapReset:             "netmap-reset",
+	ChangeDERPRemoved:             "derp-removed",
+	ChangeDERPUpdated:             "derp-updated",
+	ChangeEndpointsUpdated:        "endpoints-updated",
+	ChangeBestAddrMigration:       "best-addr-migration",
+	ChangeBestAddrUpdated:         "best-addr-updated",
+	ChangeBestAddrLatency:         "best-addr-latency",
+	ChangeCallMeMaybe:             "call-me-maybe",
+	ChangeStopAndReset:            "stop-and-reset",
+	ChangeLearnedPath:             "learned-path",
+	ChangePortPredict:             "port-predict",
+	ChangeLANDiscovery:            "lan-discovery",
+	ChangeBestAddrQuarantined:     "best-addr-quarantined",
+	ChangeBestAddrHandshakeFailed: "best-addr-handshake-failed",
+}
+
+func (r EndpointChangeReason) String() string {
+	if r < 0 || int(r) >= len(endpointChangeReasonNames) {
+		return fmt.Sprintf("EndpointChangeReason(%d)", int(r))
+	}
+	return endpointChangeReasonNames[r]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (r EndpointChangeReason) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (r *EndpointChangeReason) UnmarshalText(b []byte) error {
+	for i, name := range endpointChangeReasonNames {
+		if string(b) == name {
+			*r = EndpointChangeReason(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown EndpointChangeReason %q", b)
+}
+
+// changeAddrLatency returns the address and latency of v, an
+// EndpointChange's From or To, if it has them.
+func changeAddrLatency(v any) (netip.AddrPort, time.Duration) {
+	switch v := v.(type) {
+	case addrLatency:
+		return v.AddrPort, v.latency
+	case netip.AddrPort:
+		return v, 0
+	}
+	return netip.AddrPort{}, 0
+}
+
+// addDebugUpdate records ch, which happened now, in de's debug updates.
+func (de *endpoint) addDebugUpdate(ch EndpointChange) {
+	ch.WhenMono = de.c.nowStamp()
+	ch.When = ch.WhenMono.Wall
+	ch.OldAddr, ch.OldLatency = changeAddrLatency(ch.From)
+	ch.NewAddr, ch.NewLatency = changeAddrLatency(ch.To)
+	de.debugUpdates.Add(ch)
+}
+
+// shouldDeleteLocked reports whether we should delete this endpoint,
+// given that it's now now.
+func (st *endpointState) shouldDeleteLocked(now time.Time) bool {
 	switch {
 	case !st.callMeMaybeTime.IsZero():
 		return false
+	case !st.predictedTime.IsZero():
+		return now.Sub(st.predictedTime) > portPredictTimeout
+	case !st.lanTime.IsZero():
+		return now.Sub(st.lanTime) > lanDiscoveryTimeout
 	case st.lastGotPing.IsZero():
 		// This was an endpoint from the network map. Is it still in the network map?
 		return st.index == indexSentinelDeleted
 	default:
 		// This was an endpoint discovered at runtime.
-		return time.Since(st.lastGotPing) > sessionActiveTimeout
+		return now.Sub(st.lastGotPing) > sessionActiveTimeout
 	}
 }
 
@@ -173,6 +397,36 @@ func (st *endpointState) latencyLocked() (lat time.Duration, ok bool) {
 	return st.recentPongs[st.recentPong].latency, true
 }
 
+// lossLocked returns the percentage of recent pings to st that timed out
+// without a pong, and whether any pings have completed to measure it.
+// endpoint.mu must be held.
+func (st *endpointState) lossLocked() (loss float64, ok bool) {
+	if st.pingsCounted == 0 {
+		return 0, false
+	}
+	return 100 * float64(bits.OnesCount32(st.pingLost)) / float64(st.pingsCounted), true
+}
+
+// lastPingsLostLocked reports whether the n most recent pings to st were
+// all lost.
+// endpoint.mu must be held.
+func (st *endpointState) lastPingsLostLocked(n int) bool {
+	mask := uint32(1)<<n - 1
+	return int(st.pingsCounted) >= n && st.pingLost&mask == mask
+}
+
+// addPingResultLocked records whether a ping to st was lost.
+// endpoint.mu must be held.
+func (st *endpointState) addPingResultLocked(lost bool) {
+	st.pingLost <<= 1
+	if lost {
+		st.pingLost |= 1
+	}
+	if st.pingsCounted < pingLossWindow {
+		st.pingsCounted++
+	}
+}
+
 // endpoint.mu must be held.
 func (st *endpointState) addPongReplyLocked(r pongReply) {
 	if n := len(st.recentPongs); n < pongHistoryCount {
@@ -189,21 +443,21 @@ func (st *endpointState) addPongReplyLocked(r pongReply) {
 }
 
 func (de *endpoint) deleteEndpointLocked(why string, ep netip.AddrPort) {
-	de.debugUpdates.Add(EndpointChange{
-		When: time.Now(),
-		What: "deleteEndpointLocked-" + why,
-		From: ep,
+	de.addDebugUpdate(EndpointChange{
+		What:   "deleteEndpointLocked-" + why,
+		Reason: ChangeEndpointDeleted,
+		From:   ep,
 	})
 	delete(de.endpointState, ep)
 	if de.bestAddr.AddrPort == ep {
-		de.c.logf("magicsock: disco: node %s %s now using DERP only (endpoint %s deleted)",
-			de.publicKey.ShortString(), de.discoShort(), ep)
-		de.debugUpdates.Add(EndpointChange{
-			When: time.Now(),
-			What: "deleteEndpointLocked-bestAddr-" + why,
-			From: de.bestAddr,
+		de.logPeer(slog.LevelInfo, "disco: now using DERP only (endpoint deleted)", LogKeyEndpoint, ep)
+		de.addDebugUpdate(EndpointChange{
+			What:   "deleteEndpointLocked-bestAddr-" + why,
+			Reason: ChangeBestAddrDeleted,
+			From:   de.bestAddr,
 		})
 		de.bestAddr = addrLatency{}
+		de.quality.notePathChange(de.c.monoNow())
 	}
 }
 
@@ -224,7 +478,7 @@ func (de *endpoint) noteRecvActivity() {
 	if de.c.noteRecvActivity == nil {
 		return
 	}
-	now := mono.Now()
+	now := de.c.monoNow()
 	elapsed := now.Sub(de.lastRecv.LoadAtomic())
 	if elapsed > 10*time.Second {
 		de.lastRecv.StoreAtomic(now)
@@ -264,19 +518,26 @@ func (de *endpoint) DstToBytes() []byte  { return packIPPort(de.fakeWGAddr) }
 func (de *endpoint) addrForSendLocked(now mono.Time) (udpAddr, derpAddr netip.AddrPort, sendWGPing bool) {
 	udpAddr = de.bestAddr.AddrPort
 
-	if udpAddr.IsValid() && !now.After(de.trustBestAddrUntil) {
-		return udpAddr, netip.AddrPort{}, false
-	}
-
 	if de.isWireguardOnly {
+		if udpAddr.IsValid() && !now.After(de.trustBestAddrUntil) {
+			return udpAddr, netip.AddrPort{}, false
+		}
 		// If the endpoint is wireguard-only, we don't have a DERP
 		// address to send to, so we have to send to the UDP address.
 		udpAddr, shouldPing := de.addrForWireGuardSendLocked(now)
 		return udpAddr, netip.AddrPort{}, shouldPing
 	}
 
-	// We had a bestAddr but it expired so send both to it
-	// and DERP.
+	if udpAddr.IsValid() && de.updateDERPFallbackLocked(now) == derpFallbackNone {
+		if de.updatePreferDERPLocked(now, true) {
+			return netip.AddrPort{}, de.derpAddr, false
+		}
+		return udpAddr, netip.AddrPort{}, false
+	}
+	de.updatePreferDERPLocked(now, false)
+
+	// We had a bestAddr but stopped trusting it (see
+	// derpFallbackLocked), so send both to it and DERP.
 	return udpAddr, de.derpAddr, false
 }
 
@@ -284,38 +545,52 @@ func (de *endpoint) addrForSendLocked(now mono.Time) (udpAddr, derpAddr netip.Ad
 // sending the next packet. If a packet has never or not recently been sent to
 // the endpoint, then a randomly selected address for the endpoint is returned,
 // as well as a bool indiciating that WireGuard discovery pings should be started.
-// If the addresses have latency information available, then the address with the
-// best latency is used.
+// If the addresses have latency information available, then the Conn's
+// PathSelector chooses between them, skipping those that stopped answering
+// pings, and the addresses are pinged again every
+// wireguardOnlyReprobeInterval to fail over if the chosen one stops.
 //
 // de.mu must be held.
 func (de *endpoint) addrForWireGuardSendLocked(now mono.Time) (udpAddr netip.AddrPort, shouldPing bool) {
-	// lowestLatency is a high duration initially, so we
-	// can be sure we're going to have a duration lower than this
-	// for the first latency retrieved.
-	lowestLatency := time.Hour
+	var paths, deadPaths []Path
 	for ipp, state := range de.endpointState {
 		if latency, ok := state.latencyLocked(); ok {
-			if latency < lowestLatency || latency == lowestLatency && ipp.Addr().Is6() {
-				// If we have the same latency,IPv6 is prioritized.
-				// TODO(catzkorn): Consider a small increase in latency to use
-				// IPv6 in comparison to IPv4, when possible.
-				lowestLatency = latency
-				udpAddr = ipp
+			loss, _ := state.lossLocked()
+			p := Path{Addr: ipp, Latency: latency, Loss: loss}
+			if state.lastPingsLostLocked(wireguardOnlyDeadPings) {
+				deadPaths = append(deadPaths, p)
+			} else {
+				paths = append(paths, p)
 			}
 		}
 	}
+	if len(paths) == 0 {
+		// Keep using what used to work until something else does.
+		paths = deadPaths
+	}
+	if best, ok := de.c.pathSelectorOrDefault().BestWireGuardOnly(de.publicKey, paths); ok {
+		udpAddr = best.Addr
+	}
 
 	if udpAddr.IsValid() {
-		// Set trustBestAddrUntil to an hour, so we will
-		// continue to use this address for a long period of time.
+		if udpAddr != de.bestAddr.AddrPort && de.bestAddr.IsValid() {
+			de.logPeer(slog.LevelInfo, "wireguard-only: now using endpoint", LogKeyEndpoint, udpAddr, "from", de.bestAddr.AddrPort)
+			metricWireGuardOnlyEndpointChange.Add(1)
+		}
 		de.bestAddr.AddrPort = udpAddr
-		de.trustBestAddrUntil = now.Add(1 * time.Hour)
-		return udpAddr, false
+		if len(de.endpointState) == 1 {
+			// With nowhere to fail over to, continue to use this
+			// address for a long period of time.
+			de.trustBestAddrUntil = now.Add(1 * time.Hour)
+			return udpAddr, false
+		}
+		de.trustBestAddrUntil = now.Add(wireguardOnlyReprobeInterval)
+		return udpAddr, true
 	}
 
 	candidates := maps.Keys(de.endpointState)
 	if len(candidates) == 0 {
-		de.c.logf("magicsock: addrForSendWireguardLocked: [unexpected] no candidates available for endpoint")
+		de.logPeer(slog.LevelWarn, "addrForSendWireguardLocked: no candidates available for endpoint")
 		return udpAddr, false
 	}
 
@@ -335,7 +610,7 @@ func (de *endpoint) addrForWireGuardSendLocked(now mono.Time) (udpAddr netip.Add
 	return udpAddr, len(candidates) > 1
 }
 
-// heartbeat is called every heartbeatInterval to keep the best UDP path alive,
+// heartbeat is called every heartbeat interval to keep the best UDP path alive,
 // or kick off discovery of other paths.
 func (de *endpoint) heartbeat() {
 	de.mu.Lock()
@@ -353,24 +628,70 @@ func (de *endpoint) heartbeat() {
 		return
 	}
 
-	if mono.Since(de.lastSend) > sessionActiveTimeout {
+	if de.c.monoNow().Sub(de.lastSend) > sessionActiveTimeout {
 		// Session's idle. Stop heartbeating.
-		de.c.dlogf("[v1] magicsock: disco: ending heartbeats for idle session to %v (%v)", de.publicKey.ShortString(), de.discoShort())
+		de.dlogPeer("disco: ending heartbeats for idle session")
 		return
 	}
 
-	now := mono.Now()
+	now := de.c.monoNow()
 	udpAddr, _, _ := de.addrForSendLocked(now)
+	if de.preferDERP {
+		// Keep measuring the direct path, to go back to it once DERP
+		// is no longer faster.
+		udpAddr = de.bestAddr.AddrPort
+	}
 	if udpAddr.IsValid() {
 		// We have a preferred path. Ping that every 2 seconds.
 		de.startDiscoPingLocked(udpAddr, now, pingHeartbeat)
 	}
+	de.pingDERPRTTLocked(now)
 
 	if de.wantFullPingLocked(now) {
 		de.sendDiscoPingsLocked(now, true)
 	}
 
-	de.heartBeatTimer = time.AfterFunc(heartbeatInterval, de.heartbeat)
+	de.heartBeatTimer = de.c.afterFunc(de.heartbeatIntervalLocked(), de.heartbeat)
+}
+
+// heartbeatIntervalLocked returns how often to heartbeat.
+//
+// de.mu must be held.
+func (de *endpoint) heartbeatIntervalLocked() time.Duration {
+	if de.keepaliveInterval > 0 {
+		return de.keepaliveInterval
+	}
+	return heartbeatInterval
+}
+
+// setKeepaliveInterval sets de.keepaliveInterval, rescheduling the next
+// heartbeat if one's due.
+func (de *endpoint) setKeepaliveInterval(d time.Duration) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	de.keepaliveInterval = d
+	// If the timer already fired, the pending heartbeat will schedule the
+	// next at the new interval itself.
+	if de.heartBeatTimer != nil && de.heartBeatTimer.Stop() {
+		de.heartBeatTimer = de.c.afterFunc(de.heartbeatIntervalLocked(), de.heartbeat)
+	}
+}
+
+// sendSilentDiscoPingsLocked does the work of heartbeat for silent disco,
+// where there are no heartbeats and pings are only sent along with data.
+// It's called when sending to the trusted address udpAddr, and pings it
+// at most every heartbeat interval to keep it trusted, and all endpoints
+// if it's time to look for a better path.
+//
+// de.mu must be held.
+func (de *endpoint) sendSilentDiscoPingsLocked(udpAddr netip.AddrPort, now mono.Time) {
+	if st, ok := de.endpointState[udpAddr]; ok && (st.lastPing.IsZero() || now.Sub(st.lastPing) >= de.heartbeatIntervalLocked()) {
+		de.startDiscoPingLocked(udpAddr, now, pingHeartbeat)
+	}
+	de.pingDERPRTTLocked(now)
+	if de.wantFullPingLocked(now) {
+		de.sendDiscoPingsLocked(now, true)
+	}
 }
 
 // wantFullPingLocked reports whether we should ping to all our peers looking for
@@ -397,9 +718,9 @@ func (de *endpoint) wantFullPingLocked(now mono.Time) bool {
 }
 
 func (de *endpoint) noteActiveLocked() {
-	de.lastSend = mono.Now()
+	de.lastSend = de.c.monoNow()
 	if de.heartBeatTimer == nil && !de.heartbeatDisabled {
-		de.heartBeatTimer = time.AfterFunc(heartbeatInterval, de.heartbeat)
+		de.heartBeatTimer = de.c.afterFunc(de.heartbeatIntervalLocked(), de.heartbeat)
 	}
 }
 
@@ -417,7 +738,7 @@ func (de *endpoint) cliPing(res *ipnstate.PingResult, cb func(*ipnstate.PingResu
 
 	de.pendingCLIPings = append(de.pendingCLIPings, pendingCLIPing{res, cb})
 
-	now := mono.Now()
+	now := de.c.monoNow()
 	udpAddr, derpAddr, _ := de.addrForSendLocked(now)
 	if derpAddr.IsValid() {
 		de.startDiscoPingLocked(derpAddr, now, pingCLI)
@@ -441,59 +762,135 @@ func (de *endpoint) cliPing(res *ipnstate.PingResult, cb func(*ipnstate.PingResu
 	errNoUDPOrDERP = errors.New("no UDP or DERP addr")
 )
 
-func (de *endpoint) send(buffs [][]byte) error {
+// send sends buffs to the peer. ctx is used for sends via DERP; see
+// Conn.SendWithContext.
+func (de *endpoint) send(ctx context.Context, buffs [][]byte) error {
 	de.mu.Lock()
 	if de.expired {
 		de.mu.Unlock()
 		return errExpired
 	}
 
-	now := mono.Now()
+	now := de.c.monoNow()
 	udpAddr, derpAddr, startWGPing := de.addrForSendLocked(now)
+	maxSegments := de.maxGSOSegments
+	maxCoalescedLen := de.maxCoalescedLenLocked(udpAddr)
+	dupAddr := de.multipathAddrLocked(now, udpAddr, derpAddr)
+	de.pingLearnedPathLocked(now)
+	hadCoalescedSendErrs := de.coalescedSendErrs > 0
+	hadUDPSendErrs := de.udpSendErrs > 0
 
 	if de.isWireguardOnly {
 		if startWGPing {
 			de.sendWireGuardOnlyPingsLocked(now)
 		}
-	} else if !udpAddr.IsValid() || now.After(de.trustBestAddrUntil) {
+	} else if de.preferDERP {
+		// The direct path is trusted, just slower; see heartbeat.
+		if de.heartbeatDisabled {
+			de.sendSilentDiscoPingsLocked(de.bestAddr.AddrPort, now)
+		}
+	} else if !udpAddr.IsValid() || derpAddr.IsValid() || now.After(de.trustBestAddrUntil) {
 		de.sendDiscoPingsLocked(now, true)
+	} else if de.heartbeatDisabled {
+		de.sendSilentDiscoPingsLocked(udpAddr, now)
 	}
 	de.noteActiveLocked()
+	de.notePathKeepaliveLocked(udpAddr, derpAddr)
 	de.mu.Unlock()
 
 	if !udpAddr.IsValid() && !derpAddr.IsValid() {
 		return errNoUDPOrDERP
 	}
+	if dupAddr.IsValid() {
+		de.sendMultipathDup(dupAddr, buffs)
+	}
 	var err error
 	if udpAddr.IsValid() {
-		_, err = de.c.sendUDPBatch(udpAddr, buffs)
+		udpBuffs := de.c.padHandshakesTo(de, buffs)
+		de.c.captureWireGuard(capture.PathWireGuardToPeer, udpAddr, de.publicKey, udpBuffs...)
+		_, err = de.c.sendUDPBatchMTU(udpAddr, de.publicKey, udpBuffs, maxSegments, maxCoalescedLen)
+		var errCoalesced coalescedSendError
+		if errors.As(err, &errCoalesced) && neterror.IsUDPGSOError(errCoalesced.err) {
+			err = de.resendUncoalesced(udpAddr, udpBuffs[errCoalesced.sent:], errCoalesced.err)
+		} else if err == nil && hadCoalescedSendErrs && len(buffs) > 1 {
+			de.noteCoalescedSendOK()
+		}
+		if err != nil || hadUDPSendErrs {
+			de.noteUDPSendResult(udpAddr, err != nil)
+		}
 		// TODO(raggi): needs updating for accuracy, as in error conditions we may have partial sends.
-		if stats := de.c.stats.Load(); err == nil && stats != nil {
+		if stats := de.c.stats.Load(); err == nil && (stats != nil || sockstats.IsAvailable) {
 			var txBytes int
 			for _, b := range buffs {
 				txBytes += len(b)
 			}
-			stats.UpdateTxPhysical(de.nodeAddr, udpAddr, txBytes)
+			if stats != nil {
+				stats.UpdateTxPhysical(de.nodeAddr, udpAddr, txBytes)
+			}
+			if sockstats.IsAvailable {
+				sockstats.AddPeerBytes(sockstatsLabelOf(udpAddr), de.publicKey, txBytes, 0)
+			}
 		}
 	}
 	if derpAddr.IsValid() {
-		allOk := true
-		for _, buff := range buffs {
-			ok, _ := de.c.sendAddr(derpAddr, de.publicKey, buff)
-			if stats := de.c.stats.Load(); stats != nil {
-				stats.UpdateTxPhysical(de.nodeAddr, derpAddr, len(buff))
-			}
-			if !ok {
-				allOk = false
+		de.c.captureWireGuard(capture.PathWireGuardToPeer, derpAddr, de.publicKey, buffs...)
+		ok, derpErr := de.c.sendDERPBatch(ctx, derpAddr, de.publicKey, buffs)
+		if stats := de.c.stats.Load(); stats != nil {
+			for _, b := range buffs {
+				stats.UpdateTxPhysical(de.nodeAddr, derpAddr, len(b))
 			}
 		}
-		if allOk {
+		if ok {
 			return nil
 		}
+		if err == nil && ctx.Done() != nil {
+			// SendWithContext reports drops, but Send doesn't, lest
+			// wireguard-go log each one.
+			err = derpErr
+		}
 	}
 	return err
 }
 
+// maxCoalescedSendErrs is the number of consecutive coalesced sends to a
+// peer that may fail, while succeeding uncoalesced, before coalescing is
+// disabled for that peer.
+const maxCoalescedSendErrs = 3
+
+// resendUncoalesced is called after a coalesced send to udpAddr failed with
+// sendErr, leaving buffs unsent. It resends buffs without coalescing and, if
+// that works, counts it against the peer, eventually disabling coalescing
+// for it. It returns the error of the resend.
+func (de *endpoint) resendUncoalesced(udpAddr netip.AddrPort, buffs [][]byte, sendErr error) error {
+	if _, err := de.c.sendUDPBatch(udpAddr, de.publicKey, buffs, 1); err != nil {
+		return err
+	}
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	de.coalescedSendErrs++
+	if de.coalescedSendErrs >= maxCoalescedSendErrs && de.maxGSOSegments != 1 {
+		de.logPeer(slog.LevelInfo, "disabling UDP send coalescing", "failures", de.coalescedSendErrs, "err", sendErr)
+		de.maxGSOSegments = 1
+		metricGSODisabledPeers.Add(1)
+	}
+	return nil
+}
+
+// noteCoalescedSendOK resets the count of consecutive coalesced send
+// failures after a send that may have been coalesced succeeded.
+func (de *endpoint) noteCoalescedSendOK() {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	de.coalescedSendErrs = 0
+}
+
+func (de *endpoint) setMaxGSOSegments(n int) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	de.maxGSOSegments = n
+	de.coalescedSendErrs = 0
+}
+
 func (de *endpoint) discoPingTimeout(txid stun.TxID) {
 	de.mu.Lock()
 	defer de.mu.Unlock()
@@ -501,8 +898,14 @@ func (de *endpoint) discoPingTimeout(txid stun.TxID) {
 	if !ok {
 		return
 	}
-	if debugDisco() || !de.bestAddr.IsValid() || mono.Now().After(de.trustBestAddrUntil) {
-		de.c.dlogf("[v1] magicsock: disco: timeout waiting for pong %x from %v (%v, %v)", txid[:6], sp.to, de.publicKey.ShortString(), de.discoShort())
+	if debugDisco() || !de.bestAddr.IsValid() || de.c.monoNow().After(de.trustBestAddrUntil) {
+		de.dlogPeer("disco: timeout waiting for pong", "tx", fmt.Sprintf("%x", txid[:6]), LogKeyEndpoint, sp.to)
+	}
+	if st, ok := de.endpointState[sp.to]; ok {
+		st.addPingResultLocked(true)
+	}
+	if sp.purpose == pingDERPRoute {
+		go de.c.forgetDERPDataRoute(de.publicKey, int(sp.to.Port()))
 	}
 	de.removeSentDiscoPingLocked(txid, sp)
 }
@@ -522,6 +925,7 @@ func (de *endpoint) removeSentDiscoPingLocked(txid stun.TxID, sp sentPing) {
 	// In the case of a timer already having fired, this is a no-op:
 	sp.timer.Stop()
 	delete(de.sentPing, txid)
+	de.c.discoPings.remove(txid)
 }
 
 // sendDiscoPing sends a ping with the provided txid to ep using de's discoKey.
@@ -531,10 +935,12 @@ func (de *endpoint) removeSentDiscoPingLocked(txid stun.TxID, sp sentPing) {
 //
 // The caller should use de.discoKey as the discoKey argument.
 // It is passed in so that sendDiscoPing doesn't need to lock de.mu.
-func (de *endpoint) sendDiscoPing(ep netip.AddrPort, discoKey key.DiscoPublic, txid stun.TxID, logLevel discoLogLevel) {
+func (de *endpoint) sendDiscoPing(ep netip.AddrPort, discoKey key.DiscoPublic, txid stun.TxID, purpose discoPingPurpose, logLevel discoLogLevel) {
 	sent, _ := de.c.sendDiscoMessage(ep, de.publicKey, discoKey, &disco.Ping{
-		TxID:    [12]byte(txid),
-		NodeKey: de.c.publicKeyAtomic.Load(),
+		TxID:      [12]byte(txid),
+		NodeKey:   de.c.publicKeyAtomic.Load(),
+		Migrating: purpose == pingMigration,
+		Caps:      localDiscoCaps,
 	}, logLevel)
 	if !sent {
 		de.forgetDiscoPing(txid)
@@ -557,6 +963,26 @@ func (de *endpoint) sendDiscoPing(ep netip.AddrPort, discoKey key.DiscoPublic, t
 	// pingCLI means that the user is running "tailscale ping"
 	// from the CLI. These types of pings can go over DERP.
 	pingCLI
+
+	// pingMigration means that the ping was sent from a new local
+	// socket, after a rebind, to tell the peer to switch to it. Its
+	// pong re-establishes the path regardless of latency.
+	pingMigration
+
+	// pingDERPRoute means that the ping was sent over DERP, via the
+	// region a data packet from the peer arrived on, to verify that
+	// the peer is still reachable there. See
+	// Conn.noteDERPDataRouteLocked.
+	pingDERPRoute
+
+	// pingProbe means that the ping measures the current path, or
+	// DERP, of a probe-only peer. See endpoint.probe.
+	pingProbe
+
+	// pingDERPRTT means that the ping was sent over DERP to measure
+	// its round-trip time against the direct path's. See
+	// endpoint.pingDERPRTTLocked.
+	pingDERPRTT
 )
 
 func (de *endpoint) startDiscoPingLocked(ep netip.AddrPort, now mono.Time, purpose discoPingPurpose) {
@@ -567,12 +993,12 @@ func (de *endpoint) startDiscoPingLocked(ep netip.AddrPort, now mono.Time, purpo
 	if epDisco == nil {
 		return
 	}
-	if purpose != pingCLI {
+	if purpose != pingCLI && purpose != pingDERPRoute && purpose != pingProbe && purpose != pingDERPRTT {
 		st, ok := de.endpointState[ep]
 		if !ok {
 			// Shouldn't happen. But don't ping an endpoint that's
 			// not active for us.
-			de.c.logf("magicsock: disco: [unexpected] attempt to ping no longer live endpoint %v", ep)
+			de.logPeer(slog.LevelWarn, "disco: attempt to ping no longer live endpoint", LogKeyEndpoint, ep)
 			return
 		}
 		st.lastPing = now
@@ -582,21 +1008,22 @@ func (de *endpoint) startDiscoPingLocked(ep netip.AddrPort, now mono.Time, purpo
 	de.sentPing[txid] = sentPing{
 		to:      ep,
 		at:      now,
-		timer:   time.AfterFunc(pingTimeoutDuration, func() { de.discoPingTimeout(txid) }),
+		timer:   de.c.afterFunc(pingTimeoutDuration, func() { de.discoPingTimeout(txid) }),
 		purpose: purpose,
 	}
+	de.c.discoPings.add(txid, de)
 	logLevel := discoLog
-	if purpose == pingHeartbeat {
+	if purpose == pingHeartbeat || purpose == pingProbe || purpose == pingDERPRTT {
 		logLevel = discoVerboseLog
 	}
-	go de.sendDiscoPing(ep, epDisco.key, txid, logLevel)
+	go de.sendDiscoPing(ep, epDisco.key, txid, purpose, logLevel)
 }
 
 func (de *endpoint) sendDiscoPingsLocked(now mono.Time, sendCallMeMaybe bool) {
 	de.lastFullPing = now
 	var sentAny bool
 	for ep, st := range de.endpointState {
-		if st.shouldDeleteLocked() {
+		if st.shouldDeleteLocked(de.c.now()) {
 			de.deleteEndpointLocked("sendPingsLocked", ep)
 			continue
 		}
@@ -611,22 +1038,40 @@ func (de *endpoint) sendDiscoPingsLocked(now mono.Time, sendCallMeMaybe bool) {
 		sentAny = true
 
 		if firstPing && sendCallMeMaybe {
-			de.c.dlogf("[v1] magicsock: disco: send, starting discovery for %v (%v)", de.publicKey.ShortString(), de.discoShort())
+			de.dlogPeer("disco: send, starting discovery")
 		}
 
 		de.startDiscoPingLocked(ep, now, pingDiscovery)
 	}
 	derpAddr := de.derpAddr
-	if sentAny && sendCallMeMaybe && derpAddr.IsValid() {
+	if sentAny && sendCallMeMaybe && (derpAddr.IsValid() || de.validatedUDPAddrLocked().IsValid()) {
 		// Have our magicsock.Conn figure out its STUN endpoint (if
 		// it doesn't know already) and then send a CallMeMaybe
-		// message to our peer via DERP informing them that we've
-		// sent so our firewall ports are probably open and now
-		// would be a good time for them to connect.
+		// message to our peer via DERP (or, if DERP is down, a
+		// validated UDP path) informing them that we've sent so our
+		// firewall ports are probably open and now would be a good
+		// time for them to connect.
 		go de.c.enqueueCallMeMaybe(derpAddr, de)
 	}
 }
 
+// validatedUDPAddr returns de's best UDP address if a pong confirmed it,
+// or the zero value. Disco control messages may be sent over it, and
+// accepted from it, when DERP is unavailable.
+func (de *endpoint) validatedUDPAddr() netip.AddrPort {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	return de.validatedUDPAddrLocked()
+}
+
+// validatedUDPAddrLocked is validatedUDPAddr with de.mu held.
+func (de *endpoint) validatedUDPAddrLocked() netip.AddrPort {
+	if de.isWireguardOnly || de.bestAddrLearned {
+		return netip.AddrPort{}
+	}
+	return de.bestAddr.AddrPort
+}
+
 // sendWireGuardOnlyPingsLocked evaluates all available addresses for
 // a WireGuard only endpoint and initates an ICMP ping for useable
 // addresses.
@@ -671,15 +1116,20 @@ func (de *endpoint) sendWireGuardOnlyPing(ipp netip.AddrPort, now mono.Time) {
 
 	p := de.c.getPinger()
 	if p == nil {
-		de.c.logf("[v2] magicsock: sendWireGuardOnlyPingLocked: pinger is nil")
+		de.logPeer(LevelVerbose2, "sendWireGuardOnlyPingLocked: pinger is nil")
 		return
 	}
 
 	latency, err := p.Send(ctx, addr, nil)
 	if err != nil {
-		de.c.logf("[v2] magicsock: sendWireGuardOnlyPingLocked: %s", err)
+		de.logPeer(LevelVerbose2, "sendWireGuardOnlyPingLocked failed", LogKeyEndpoint, ipp, "err", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			metricWireGuardOnlyPingLost.Add(1)
+			de.noteWireGuardOnlyPingLost(ipp)
+		}
 		return
 	}
+	metricWireGuardOnlyPong.Add(1)
 
 	de.mu.Lock()
 	defer de.mu.Unlock()
@@ -688,6 +1138,7 @@ func (de *endpoint) sendWireGuardOnlyPing(ipp netip.AddrPort, now mono.Time) {
 	if !ok {
 		return
 	}
+	state.addPingResultLocked(false)
 	state.addPongReplyLocked(pongReply{
 		latency: latency,
 		pongAt:  now,
@@ -696,6 +1147,23 @@ func (de *endpoint) sendWireGuardOnlyPing(ipp netip.AddrPort, now mono.Time) {
 	})
 }
 
+// noteWireGuardOnlyPingLost records that a ping to ipp, an address of a
+// WireGuard only endpoint, timed out. If ipp is the address in use and has
+// stopped answering, it stops being trusted, so the next send picks
+// another.
+func (de *endpoint) noteWireGuardOnlyPingLost(ipp netip.AddrPort) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	state, ok := de.endpointState[ipp]
+	if !ok {
+		return
+	}
+	state.addPingResultLocked(true)
+	if de.bestAddr.AddrPort == ipp && state.lastPingsLostLocked(wireguardOnlyDeadPings) {
+		de.trustBestAddrUntil = 0
+	}
+}
+
 // setLastPing sets lastPing on the endpointState to now.
 func (de *endpoint) setLastPing(ipp netip.AddrPort, now mono.Time) {
 	de.mu.Lock()
@@ -709,15 +1177,19 @@ func (de *endpoint) setLastPing(ipp netip.AddrPort, now mono.Time) {
 
 // updateFromNode updates the endpoint based on a tailcfg.Node from a NetMap
 // update.
-func (de *endpoint) updateFromNode(n *tailcfg.Node, heartbeatDisabled bool) {
-	if n == nil {
+//
+// de.c.mu must be held.
+func (de *endpoint) updateFromNode(n tailcfg.NodeView, heartbeatDisabled bool) {
+	if !n.Valid() {
 		panic("nil node when updating endpoint")
 	}
+	de.node = n
 	de.mu.Lock()
 	defer de.mu.Unlock()
 
 	de.heartbeatDisabled = heartbeatDisabled
-	de.expired = n.Expired
+	de.expired = n.Expired()
+	de.setProbeOnlyLocked(n.ProbeOnly())
 
 	epDisco := de.disco.Load()
 	var discoKey key.DiscoPublic
@@ -725,35 +1197,35 @@ func (de *endpoint) updateFromNode(n *tailcfg.Node, heartbeatDisabled bool) {
 		discoKey = epDisco.key
 	}
 
-	if discoKey != n.DiscoKey {
-		de.c.logf("[v1] magicsock: disco: node %s changed from %s to %s", de.publicKey.ShortString(), discoKey, n.DiscoKey)
+	if discoKey != n.DiscoKey() {
+		de.logPeer(LevelVerbose, "disco: node changed disco key", "new", n.DiscoKey().ShortString())
 		de.disco.Store(&endpointDisco{
-			key:   n.DiscoKey,
-			short: n.DiscoKey.ShortString(),
+			key:   n.DiscoKey(),
+			short: n.DiscoKey().ShortString(),
 		})
-		de.debugUpdates.Add(EndpointChange{
-			When: time.Now(),
-			What: "updateFromNode-resetLocked",
+		de.addDebugUpdate(EndpointChange{
+			What:   "updateFromNode-resetLocked",
+			Reason: ChangeNetmapReset,
 		})
 		de.resetLocked()
 	}
-	if n.DERP == "" {
+	if n.DERP() == "" {
 		if de.derpAddr.IsValid() {
-			de.debugUpdates.Add(EndpointChange{
-				When: time.Now(),
-				What: "updateFromNode-remove-DERP",
-				From: de.derpAddr,
+			de.addDebugUpdate(EndpointChange{
+				What:   "updateFromNode-remove-DERP",
+				Reason: ChangeDERPRemoved,
+				From:   de.derpAddr,
 			})
 		}
 		de.derpAddr = netip.AddrPort{}
 	} else {
-		newDerp, _ := netip.ParseAddrPort(n.DERP)
+		newDerp, _ := netip.ParseAddrPort(n.DERP())
 		if de.derpAddr != newDerp {
-			de.debugUpdates.Add(EndpointChange{
-				When: time.Now(),
-				What: "updateFromNode-DERP",
-				From: de.derpAddr,
-				To:   newDerp,
+			de.addDebugUpdate(EndpointChange{
+				What:   "updateFromNode-DERP",
+				Reason: ChangeDERPUpdated,
+				From:   de.derpAddr,
+				To:     newDerp,
 			})
 		}
 		de.derpAddr = newDerp
@@ -764,14 +1236,15 @@ func (de *endpoint) updateFromNode(n *tailcfg.Node, heartbeatDisabled bool) {
 	}
 
 	var newIpps []netip.AddrPort
-	for i, epStr := range n.Endpoints {
+	for i := 0; i < n.Endpoints().Len(); i++ {
 		if i > math.MaxInt16 {
 			// Seems unlikely.
 			continue
 		}
+		epStr := n.Endpoints().At(i)
 		ipp, err := netip.ParseAddrPort(epStr)
 		if err != nil {
-			de.c.logf("magicsock: bogus netmap endpoint %q", epStr)
+			de.logPeer(slog.LevelInfo, "bogus netmap endpoint", LogKeyEndpoint, epStr)
 			continue
 		}
 		if st, ok := de.endpointState[ipp]; ok {
@@ -782,17 +1255,17 @@ func (de *endpoint) updateFromNode(n *tailcfg.Node, heartbeatDisabled bool) {
 		}
 	}
 	if len(newIpps) > 0 {
-		de.debugUpdates.Add(EndpointChange{
-			When: time.Now(),
-			What: "updateFromNode-new-Endpoints",
-			To:   newIpps,
+		de.addDebugUpdate(EndpointChange{
+			What:   "updateFromNode-new-Endpoints",
+			Reason: ChangeEndpointsUpdated,
+			To:     newIpps,
 		})
 	}
 
 	// Now delete anything unless it's still in the network map or
 	// was a recently discovered endpoint.
 	for ep, st := range de.endpointState {
-		if st.shouldDeleteLocked() {
+		if st.shouldDeleteLocked(de.c.now()) {
 			de.deleteEndpointLocked("updateFromNode", ep)
 		}
 	}
@@ -818,26 +1291,26 @@ func (de *endpoint) addCandidateEndpoint(ep netip.AddrPort, forRxPingTxID stun.T
 			// Already-known endpoint from the network map.
 			return duplicatePing
 		}
-		st.lastGotPing = time.Now()
+		st.lastGotPing = de.c.now()
 		return duplicatePing
 	}
 
 	// Newly discovered endpoint. Exciting!
-	de.c.dlogf("[v1] magicsock: disco: adding %v as candidate endpoint for %v (%s)", ep, de.discoShort(), de.publicKey.ShortString())
+	de.dlogPeer("disco: adding candidate endpoint", LogKeyEndpoint, ep)
 	de.endpointState[ep] = &endpointState{
-		lastGotPing:     time.Now(),
+		lastGotPing:     de.c.now(),
 		lastGotPingTxID: forRxPingTxID,
 	}
 
 	// If for some reason this gets very large, do some cleanup.
 	if size := len(de.endpointState); size > 100 {
 		for ep, st := range de.endpointState {
-			if st.shouldDeleteLocked() {
+			if st.shouldDeleteLocked(de.c.now()) {
 				de.deleteEndpointLocked("addCandidateEndpoint", ep)
 			}
 		}
 		size2 := len(de.endpointState)
-		de.c.dlogf("[v1] magicsock: disco: addCandidateEndpoint pruned %v candidate set from %v to %v entries", size, size2)
+		de.dlogPeer("disco: addCandidateEndpoint pruned candidate set", "from", size, "to", size2)
 	}
 	return false
 }
@@ -852,6 +1325,35 @@ func (de *endpoint) noteConnectivityChange() {
 	de.trustBestAddrUntil = 0
 }
 
+// sendMigrationPing pings de's best address with a migration ping, after
+// the Conn's sockets were rebound, so the peer switches to sending to
+// the new socket as soon as it can rather than at its next discovery.
+// It does nothing if de isn't in active use.
+func (de *endpoint) sendMigrationPing() {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	now := de.c.monoNow()
+	if de.isWireguardOnly || !de.bestAddr.IsValid() || now.Sub(de.lastSend) > sessionActiveTimeout {
+		return
+	}
+	de.startDiscoPingLocked(de.bestAddr.AddrPort, now, pingMigration)
+}
+
+// noteMigrationPing is called when the peer sent a migration ping from
+// src, a new address, after rebinding its sockets. It pings src, and the
+// pong makes it the best address.
+func (de *endpoint) noteMigrationPing(src netip.AddrPort) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	if _, ok := de.endpointState[src]; !ok || de.bestAddr.AddrPort == src {
+		return
+	}
+	de.migrateTo = src
+	de.startDiscoPingLocked(src, de.c.monoNow(), pingDiscovery)
+}
+
 // handlePongConnLocked handles a Pong message (a reply to an earlier ping).
 // It should be called with the Conn.mu held.
 //
@@ -870,8 +1372,9 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netip
 	knownTxID = true // for naked returns below
 	de.removeSentDiscoPingLocked(m.TxID, sp)
 
-	now := mono.Now()
+	now := de.c.monoNow()
 	latency := now.Sub(sp.at)
+	histDiscoRTT.Observe(latency.Seconds())
 
 	if !isDerp {
 		st, ok := de.endpointState[sp.to]
@@ -882,54 +1385,92 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netip
 
 		de.c.peerMap.setNodeKeyForIPPort(src, de.publicKey)
 
+		if !st.predictedTime.IsZero() {
+			st.predictedTime = de.c.now()
+		}
+		st.addPingResultLocked(false)
 		st.addPongReplyLocked(pongReply{
 			latency: latency,
 			pongAt:  now,
 			from:    src,
 			pongSrc: m.Src,
 		})
+	} else {
+		de.derpLatency = latency
+		de.derpLatencyAt = now
 	}
 
-	if sp.purpose != pingHeartbeat {
-		de.c.dlogf("[v1] magicsock: disco: %v<-%v (%v, %v)  got pong tx=%x latency=%v pong.src=%v%v", de.c.discoShort, de.discoShort(), de.publicKey.ShortString(), src, m.TxID[:6], latency.Round(time.Millisecond), m.Src, logger.ArgWriter(func(bw *bufio.Writer) {
-			if sp.to != src {
-				fmt.Fprintf(bw, " ping.to=%v", sp.to)
-			}
-		}))
-	}
-
-	for _, pp := range de.pendingCLIPings {
-		de.c.populateCLIPingResponseLocked(pp.res, latency, sp.to)
-		go pp.cb(pp.res)
+	if sp.purpose != pingHeartbeat && sp.purpose != pingProbe && sp.purpose != pingDERPRTT {
+		args := []any{LogKeyEndpoint, src, "tx", fmt.Sprintf("%x", m.TxID[:6]), "latency", latency.Round(time.Millisecond), "pong.src", m.Src}
+		if sp.to != src {
+			args = append(args, "ping.to", sp.to)
+		}
+		de.dlogPeer("disco: got pong", args...)
 	}
-	de.pendingCLIPings = nil
 
 	// Promote this pong response to our current best address if it's lower latency.
 	// TODO(bradfitz): decide how latency vs. preference order affects decision
 	if !isDerp {
 		thisPong := addrLatency{sp.to, latency}
-		if betterAddr(thisPong, de.bestAddr) {
-			de.c.logf("magicsock: disco: node %v %v now using %v", de.publicKey.ShortString(), de.discoShort(), sp.to)
-			de.debugUpdates.Add(EndpointChange{
-				When: time.Now(),
-				What: "handlePingLocked-bestAddr-update",
-				From: de.bestAddr,
-				To:   thisPong,
+		var loss float64
+		if st, ok := de.endpointState[sp.to]; ok {
+			loss, _ = st.lossLocked()
+		}
+		// The pong to a migration ping, or to a ping to where the peer
+		// said it migrated, confirms the path that replaces the
+		// current one, however it compares.
+		migrated := sp.purpose == pingMigration || sp.to == de.migrateTo
+		if migrated {
+			de.migrateTo = netip.AddrPort{}
+		}
+		if migrated && de.bestAddr.AddrPort != thisPong.AddrPort {
+			de.logPeer(slog.LevelInfo, "disco: now using endpoint after migration", LogKeyEndpoint, sp.to, LogKeyPath, "udp")
+			de.addDebugUpdate(EndpointChange{
+				What:   "handlePingLocked-bestAddr-migration",
+				Reason: ChangeBestAddrMigration,
+				From:   de.bestAddr,
+				To:     thisPong,
+				Loss:   loss,
+			})
+			de.bestAddr = thisPong
+			de.quality.notePathChange(now)
+		} else if de.betterAddrLocked(thisPong, de.bestAddr) {
+			de.logPeer(slog.LevelInfo, "disco: now using endpoint", LogKeyEndpoint, sp.to, LogKeyPath, "udp")
+			de.addDebugUpdate(EndpointChange{
+				What:   "handlePingLocked-bestAddr-update",
+				Reason: ChangeBestAddrUpdated,
+				From:   de.bestAddr,
+				To:     thisPong,
+				Loss:   loss,
 			})
 			de.bestAddr = thisPong
+			de.quality.notePathChange(now)
 		}
 		if de.bestAddr.AddrPort == thisPong.AddrPort {
-			de.debugUpdates.Add(EndpointChange{
-				When: time.Now(),
-				What: "handlePingLocked-bestAddr-latency",
-				From: de.bestAddr,
-				To:   thisPong,
+			de.addDebugUpdate(EndpointChange{
+				What:   "handlePingLocked-bestAddr-latency",
+				Reason: ChangeBestAddrLatency,
+				From:   de.bestAddr,
+				To:     thisPong,
+				Loss:   loss,
 			})
 			de.bestAddr.latency = latency
 			de.bestAddrAt = now
 			de.trustBestAddrUntil = now.Add(trustUDPAddrDuration)
+			de.notePathConfirmedLocked(thisPong.AddrPort)
 		}
 	}
+
+	// Only pongs on the current path count towards its quality, lest
+	// the differences between paths show up as jitter.
+	if sp.to == de.bestAddr.AddrPort || isDerp && !de.bestAddr.IsValid() {
+		de.quality.addRTT(latency)
+	}
+	for _, pp := range de.pendingCLIPings {
+		de.c.populateCLIPingResponseLocked(pp.res, latency, sp.to, &de.quality, now)
+		go pp.cb(pp.res)
+	}
+	de.pendingCLIPings = nil
 	return
 }
 
@@ -943,7 +1484,35 @@ func (a addrLatency) String() string {
 	return a.AddrPort.String() + "@" + a.latency.String()
 }
 
-// betterAddr reports whether a is a better addr to use than b.
+// betterAddrLocked reports whether a is a better addr to use than b,
+// according to the Conn's PathSelector. A quarantined a never is.
+//
+// de.mu must be held.
+func (de *endpoint) betterAddrLocked(a, b addrLatency) bool {
+	if a.AddrPort == b.AddrPort || !a.IsValid() {
+		return false
+	}
+	if st, ok := de.endpointState[a.AddrPort]; ok && st.quarantinedLocked(de.c.monoNow()) {
+		return false
+	}
+	if !b.IsValid() {
+		return true
+	}
+	return de.c.pathSelectorOrDefault().Better(de.publicKey, de.pathLocked(a), de.pathLocked(b))
+}
+
+// pathLocked returns al as a Path, with its loss if known.
+// de.mu must be held.
+func (de *endpoint) pathLocked(al addrLatency) Path {
+	p := Path{Addr: al.AddrPort, Latency: al.latency}
+	if st, ok := de.endpointState[al.AddrPort]; ok {
+		p.Loss, _ = st.lossLocked()
+	}
+	return p
+}
+
+// betterAddr reports whether a is a better addr to use than b. It's the
+// policy of LatencyPathSelector.
 func betterAddr(a, b addrLatency) bool {
 	if a.AddrPort == b.AddrPort {
 		return false
@@ -1020,7 +1589,7 @@ func (de *endpoint) handleCallMeMaybe(m *disco.CallMeMaybe) {
 	de.mu.Lock()
 	defer de.mu.Unlock()
 
-	now := time.Now()
+	now := de.c.now()
 	for ep := range de.isCallMeMaybeEP {
 		de.isCallMeMaybeEP[ep] = false // mark for deletion
 	}
@@ -1041,22 +1610,13 @@ func (de *endpoint) handleCallMeMaybe(m *disco.CallMeMaybe) {
 		}
 	}
 	if len(newEPs) > 0 {
-		de.debugUpdates.Add(EndpointChange{
-			When: time.Now(),
-			What: "handleCallMeMaybe-new-endpoints",
-			To:   newEPs,
+		de.addDebugUpdate(EndpointChange{
+			What:   "handleCallMeMaybe-new-endpoints",
+			Reason: ChangeCallMeMaybe,
+			To:     newEPs,
 		})
 
-		de.c.dlogf("[v1] magicsock: disco: call-me-maybe from %v %v added new endpoints: %v",
-			de.publicKey.ShortString(), de.discoShort(),
-			logger.ArgWriter(func(w *bufio.Writer) {
-				for i, ep := range newEPs {
-					if i > 0 {
-						w.WriteString(", ")
-					}
-					w.WriteString(ep.String())
-				}
-			}))
+		de.dlogPeer("disco: call-me-maybe added new endpoints", LogKeyEndpoint, newEPs)
 	}
 
 	// Delete any prior CallMeMaybe endpoints that weren't included
@@ -1073,7 +1633,7 @@ func (de *endpoint) handleCallMeMaybe(m *disco.CallMeMaybe) {
 	for _, st := range de.endpointState {
 		st.lastPing = 0
 	}
-	de.sendDiscoPingsLocked(mono.Now(), false)
+	de.sendDiscoPingsLocked(de.c.monoNow(), false)
 }
 
 func (de *endpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
@@ -1082,16 +1642,61 @@ func (de *endpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 
 	ps.Relay = de.c.derpRegionCodeOfIDLocked(int(de.derpAddr.Port()))
 
+	now := de.c.monoNow()
+	ps.SmoothedRTTSeconds = de.quality.srtt.Seconds()
+	ps.JitterSeconds = de.quality.jitter.Seconds()
+	ps.PathChanges = de.quality.pathChanges(now)
+
+	if de.isWireguardOnly {
+		de.populateWireGuardOnlyStatusLocked(ps)
+	}
+
+	if de.probeOnly {
+		ps.ProbeOnly = true
+		if de.bestAddr.IsValid() {
+			ps.CurAddr = de.bestAddr.AddrPort.String()
+			if st, ok := de.endpointState[de.bestAddr.AddrPort]; ok {
+				ps.CurAddrLoss, _ = st.lossLocked()
+			}
+		}
+		return
+	}
+
 	if de.lastSend.IsZero() {
 		return
 	}
 
-	now := mono.Now()
 	ps.LastWrite = de.lastSend.WallTime()
 	ps.Active = now.Sub(de.lastSend) < sessionActiveTimeout
 
-	if udpAddr, derpAddr, _ := de.addrForSendLocked(now); udpAddr.IsValid() && !derpAddr.IsValid() {
+	udpAddr, derpAddr, _ := de.addrForSendLocked(now)
+	if udpAddr.IsValid() && !derpAddr.IsValid() {
 		ps.CurAddr = udpAddr.String()
+		if st, ok := de.endpointState[udpAddr]; ok {
+			ps.CurAddrLoss, _ = st.lossLocked()
+		}
+	}
+	if !de.isWireguardOnly {
+		ps.DERPReason = de.derpReasonLocked(now, udpAddr, derpAddr)
+	}
+}
+
+// populateWireGuardOnlyStatusLocked sets the latencies of the endpoints
+// of de, a WireGuard only endpoint, in ps, along with the one in use, even
+// if it's idle.
+//
+// de.mu must be held.
+func (de *endpoint) populateWireGuardOnlyStatusLocked(ps *ipnstate.PeerStatus) {
+	for ipp, st := range de.endpointState {
+		if latency, ok := st.latencyLocked(); ok {
+			mak.Set(&ps.WireGuardOnlyLatencySeconds, ipp.String(), latency.Seconds())
+		}
+	}
+	if de.bestAddr.IsValid() {
+		ps.CurAddr = de.bestAddr.AddrPort.String()
+		if st, ok := de.endpointState[de.bestAddr.AddrPort]; ok {
+			ps.CurAddrLoss, _ = st.lossLocked()
+		}
 	}
 }
 
@@ -1105,18 +1710,19 @@ func (de *endpoint) stopAndReset() {
 	defer de.mu.Unlock()
 
 	if closing := de.c.closing.Load(); !closing {
-		de.c.logf("[v1] magicsock: doing cleanup for discovery key %s", de.discoShort())
+		de.logPeer(LevelVerbose, "doing cleanup for discovery key")
 	}
 
-	de.debugUpdates.Add(EndpointChange{
-		When: time.Now(),
-		What: "stopAndReset-resetLocked",
+	de.addDebugUpdate(EndpointChange{
+		What:   "stopAndReset-resetLocked",
+		Reason: ChangeStopAndReset,
 	})
 	de.resetLocked()
 	if de.heartBeatTimer != nil {
 		de.heartBeatTimer.Stop()
 		de.heartBeatTimer = nil
 	}
+	de.stopProbeLocked()
 	de.pendingCLIPings = nil
 }
 
@@ -1126,10 +1732,24 @@ func (de *endpoint) stopAndReset() {
 func (de *endpoint) resetLocked() {
 	de.lastSend = 0
 	de.lastFullPing = 0
-	de.c.logf("magicsock: disco: node %v %v now using DERP only (reset)", de.publicKey.ShortString(), de.discoShort())
+	de.logPeer(slog.LevelInfo, "disco: now using DERP only (reset)", LogKeyPath, "derp")
+	if de.bestAddr.IsValid() {
+		de.quality.notePathChange(de.c.monoNow())
+	}
 	de.bestAddr = addrLatency{}
 	de.bestAddrAt = 0
 	de.trustBestAddrUntil = 0
+	de.migrateTo = netip.AddrPort{}
+	de.bestAddrLearned = false
+	de.multipathPrev = netip.AddrPort{}
+	de.udpSendErrs = 0
+	de.derpFallback = derpFallbackNone
+	de.derpFallbackDeferred = false
+	de.derpLatency = 0
+	de.derpLatencyAt = 0
+	de.lastDERPRTTPing = 0
+	de.preferDERP = false
+	de.handshakeFails = 0
 	for _, es := range de.endpointState {
 		es.lastPing = 0
 	}
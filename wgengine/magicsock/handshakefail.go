@@ -0,0 +1,74 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"time"
+
+	"tailscale.com/types/key"
+	"tailscale.com/util/clientmetric"
+)
+
+const (
+	// handshakeFailQuarantine is the number of WireGuard handshakes in a
+	// row sent to the best address that must fail for it to be
+	// quarantined.
+	handshakeFailQuarantine = 3
+
+	// handshakeFailGap is how long after a failed handshake the next
+	// one counts as a new run of failures. WireGuard retries every five
+	// seconds, with jitter, until a handshake completes or it gives up.
+	handshakeFailGap = 15 * time.Second
+)
+
+// NoteHandshakeFailed tells c that a WireGuard handshake to the peer with
+// node key nk went unanswered, such as when wireguard-go retries one.
+//
+// Disco pings are small, so a middlebox that drops larger or non-disco
+// datagrams can leave a best address whose pongs keep it trusted but over
+// which WireGuard never completes a handshake. Once handshakeFailQuarantine
+// handshakes in a row have failed on the same best address, it's
+// quarantined as if sends to it had failed, switching the peer to its
+// next-best path or DERP, and discovery starts over.
+func (c *Conn) NoteHandshakeFailed(nk key.NodePublic) {
+	c.mu.Lock()
+	de, ok := c.peerMap.endpointForNodeKey(nk)
+	c.mu.Unlock()
+	if ok {
+		de.noteHandshakeFailed()
+	}
+}
+
+func (de *endpoint) noteHandshakeFailed() {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	addr := de.bestAddr.AddrPort
+	if !addr.IsValid() || de.isWireguardOnly {
+		// Nothing to demote; DERP is all there is, or no disco.
+		de.handshakeFails = 0
+		return
+	}
+	now := de.c.monoNow()
+	if addr != de.handshakeFailAddr || now.Sub(de.lastHandshakeFail) > handshakeFailGap {
+		de.handshakeFails = 0
+		de.handshakeFailAddr = addr
+	}
+	de.lastHandshakeFail = now
+	de.handshakeFails++
+	if de.handshakeFails < handshakeFailQuarantine {
+		return
+	}
+	de.handshakeFails = 0
+	st, ok := de.endpointState[addr]
+	if !ok {
+		return
+	}
+	metricHandshakeFailQuarantined.Add(1)
+	de.quarantineLocked(addr, st, ChangeBestAddrHandshakeFailed)
+	de.sendDiscoPingsLocked(now, true)
+}
+
+// metricHandshakeFailQuarantined counts the best addresses quarantined
+// after repeated WireGuard handshake failures.
+var metricHandshakeFailQuarantined = clientmetric.NewCounter("magicsock_handshake_fail_quarantined")
@@ -0,0 +1,33 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"expvar"
+
+	"tailscale.com/metrics"
+)
+
+// Latency histograms, in seconds. Unlike clientmetrics, which are only
+// counters and gauges, they show tail latencies. They're published as
+// expvars, which tsweb/varz exports as Prometheus histograms.
+var (
+	// histDiscoRTT is the round-trip time of disco pings that got a
+	// pong, over UDP and DERP.
+	histDiscoRTT = metrics.NewHistogram([]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5})
+
+	// histDERPWriteQueueWait is how long packets wait in a DERP
+	// connection's write queue before being written.
+	histDERPWriteQueueWait = metrics.NewHistogram([]float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5})
+
+	// histEndpointUpdate is how long endpoint discovery takes, from
+	// the start of updateEndpoints to the endpoints being determined.
+	histEndpointUpdate = metrics.NewHistogram([]float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30})
+)
+
+func init() {
+	expvar.Publish("magicsock_disco_rtt_seconds", histDiscoRTT)
+	expvar.Publish("magicsock_derp_write_queue_wait_seconds", histDERPWriteQueueWait)
+	expvar.Publish("magicsock_endpoint_update_seconds", histEndpointUpdate)
+}
@@ -0,0 +1,92 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net/netip"
+	"time"
+)
+
+// PathImpairment degrades the UDP packets a Conn sends to an address, for
+// testing path selection without a simulated network. See
+// Conn.SetPathImpairmentForTest.
+type PathImpairment struct {
+	// Latency delays each batch of packets sent.
+	Latency time.Duration
+	// Jitter varies Latency by a uniformly random amount of up to
+	// Jitter, either way.
+	Jitter time.Duration
+	// LossRate is the probability, in [0, 1], that a packet is
+	// dropped.
+	LossRate float64
+}
+
+// SetPathImpairmentForTest sets the impairment of UDP packets c sends to
+// addr, or removes it if imp is the zero value. It's only for tests and
+// fails unless c was created with Options.TestOnlyPathImpairments.
+func (c *Conn) SetPathImpairmentForTest(addr netip.AddrPort, imp PathImpairment) error {
+	if !c.testOnlyPathImpairments {
+		return errors.New("magicsock: path impairments not enabled by Options.TestOnlyPathImpairments")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := make(map[netip.AddrPort]PathImpairment)
+	if old := c.pathImpairments.Load(); old != nil {
+		for k, v := range *old {
+			m[k] = v
+		}
+	}
+	if imp == (PathImpairment{}) {
+		delete(m, addr)
+	} else {
+		m[addr] = imp
+	}
+	if len(m) == 0 {
+		c.pathImpairments.Store(nil)
+	} else {
+		c.pathImpairments.Store(&m)
+	}
+	return nil
+}
+
+// impairedSend applies addr's PathImpairment, if any, to a send of buffs
+// by send. It reports whether it took over the send: buffs were dropped,
+// or copies of them will be passed to send after a delay. Otherwise the
+// caller sends buffs itself.
+//
+// Callers check that c.pathImpairments is non-nil first, so send isn't
+// allocated when there are no impairments.
+func (c *Conn) impairedSend(addr netip.AddrPort, buffs [][]byte, send func([][]byte)) bool {
+	m := c.pathImpairments.Load()
+	if m == nil {
+		return false
+	}
+	imp, ok := (*m)[addr]
+	if !ok {
+		return false
+	}
+	kept := make([][]byte, 0, len(buffs))
+	for _, b := range buffs {
+		if imp.LossRate > 0 && rand.Float64() < imp.LossRate {
+			continue
+		}
+		kept = append(kept, bytes.Clone(b))
+	}
+	if len(kept) == 0 {
+		return true
+	}
+	delay := imp.Latency
+	if imp.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(2*imp.Jitter))) - imp.Jitter
+	}
+	if delay <= 0 {
+		send(kept)
+		return true
+	}
+	time.AfterFunc(delay, func() { send(kept) })
+	return true
+}
@@ -0,0 +1,46 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"github.com/tailscale/wireguard-go/conn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/capture"
+)
+
+// Interface is the subset of Conn's methods that wgengine and embedders
+// use to drive a Conn. Their tests can use a fake implementation, such as
+// magicsocktest.FakeConn, instead of a Conn with real sockets.
+type Interface interface {
+	// Bind returns the wireguard-go conn.Bind to use for the Conn's
+	// peers.
+	Bind() conn.Bind
+	Send(buffs [][]byte, ep conn.Endpoint) error
+	Close() error
+
+	SetPrivateKey(key.NodePrivate) error
+	SetNetworkMap(*netmap.NetworkMap)
+	UpdatePeers(newPeers map[key.NodePublic]struct{})
+	SetDERPMap(*tailcfg.DERPMap)
+	SetNetInfoCallback(func(*tailcfg.NetInfo))
+	SetNetworkUp(up bool)
+	SetPreferredPort(port uint16)
+	SetBlockEndpoints(block bool)
+	InstallCaptureHook(capture.Callback)
+	RefreshEndpoints(scope RefreshScope, why string)
+	Rebind()
+
+	UpdateStatus(*ipnstate.StatusBuilder)
+	Ping(peer *tailcfg.Node, res *ipnstate.PingResult, cb func(*ipnstate.PingResult))
+	LastRecvActivityOfNodeKey(key.NodePublic) string
+	PathWantsKeepalive(key.NodePublic) (want, ok bool)
+	LocalPort() uint16
+	DERPs() int
+	DiscoPublicKey() key.DiscoPublic
+}
+
+var _ Interface = (*Conn)(nil)
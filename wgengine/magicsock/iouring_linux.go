@@ -0,0 +1,395 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// io_uring ABI. See include/uapi/linux/io_uring.h.
+const (
+	ioringOffSQRing = 0
+	ioringOffCQRing = 0x8000000
+	ioringOffSQEs   = 0x10000000
+
+	ioringOpSendmsg = 9
+	ioringOpRecvmsg = 10
+
+	ioringEnterGetEvents = 1 << 0
+
+	iosqeIOLink = 1 << 2
+)
+
+type ioSQRingOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioCQRingOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioURingParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFD uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  ioSQRingOffsets
+	cqOff                                                                  ioCQRingOffsets
+}
+
+type ioURingSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	msgFlags    uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFDIn  int32
+	addr3       uint64
+	_           uint64
+}
+
+type ioURingCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// ioURingEntries is the size of the rings of an ioURing, and so the most
+// messages of a batch submitted at once.
+const ioURingEntries = 64
+
+// ioURing is an io_uring instance, with the message headers of the batch
+// it's processing. Its methods must be called with mu held.
+type ioURing struct {
+	mu sync.Mutex
+	fd int
+
+	sqRing, cqRing, sqeMem []byte // mmapped
+	sqTail, sqMask         *uint32
+	sqArray                []uint32
+	sqes                   []ioURingSQE
+	cqHead, cqTail, cqMask *uint32
+	cqes                   []ioURingCQE
+
+	hdrs  [ioURingEntries]unix.Msghdr
+	iovs  [ioURingEntries]unix.Iovec
+	addrs [ioURingEntries]unix.RawSockaddrInet6 // big enough for either family
+	res   [ioURingEntries]int32
+}
+
+func newIOURing() (_ *ioURing, err error) {
+	var p ioURingParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, ioURingEntries, uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	r := &ioURing{fd: int(fd)}
+	defer func() {
+		if err != nil {
+			r.close()
+		}
+	}()
+	mmap := func(off int64, size int) ([]byte, error) {
+		b, err := unix.Mmap(r.fd, off, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+		if err != nil {
+			return nil, fmt.Errorf("mmap io_uring: %w", err)
+		}
+		return b, nil
+	}
+	if r.sqRing, err = mmap(ioringOffSQRing, int(p.sqOff.array+p.sqEntries*4)); err != nil {
+		return nil, err
+	}
+	if r.cqRing, err = mmap(ioringOffCQRing, int(p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(ioURingCQE{})))); err != nil {
+		return nil, err
+	}
+	if r.sqeMem, err = mmap(ioringOffSQEs, int(p.sqEntries*uint32(unsafe.Sizeof(ioURingSQE{})))); err != nil {
+		return nil, err
+	}
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array])), p.sqEntries)
+	r.sqes = unsafe.Slice((*ioURingSQE)(unsafe.Pointer(&r.sqeMem[0])), p.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*ioURingCQE)(unsafe.Pointer(&r.cqRing[p.cqOff.cqes])), p.cqEntries)
+	return r, nil
+}
+
+func (r *ioURing) close() {
+	for _, b := range [][]byte{r.sqRing, r.cqRing, r.sqeMem} {
+		if b != nil {
+			unix.Munmap(b)
+		}
+	}
+	r.sqRing, r.cqRing, r.sqeMem = nil, nil, nil
+	if r.fd >= 0 {
+		unix.Close(r.fd)
+		r.fd = -1
+	}
+}
+
+// run submits n linked requests, whose SQEs (at the same indexes as
+// their headers) were filled in by the caller, waits for their
+// completion, and records their results in r.res. As the requests are
+// linked, they run in order, and those after a failure are canceled.
+func (r *ioURing) run(n int) error {
+	tail := atomic.LoadUint32(r.sqTail)
+	for i := 0; i < n; i++ {
+		r.sqArray[(tail+uint32(i))&*r.sqMask] = uint32(i)
+	}
+	atomic.StoreUint32(r.sqTail, tail+uint32(n))
+
+	for submitted, completed := 0, 0; completed < n; {
+		toSubmit := n - submitted
+		ret, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), 1, ioringEnterGetEvents, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return os.NewSyscallError("io_uring_enter", errno)
+		}
+		submitted += int(ret)
+		head := atomic.LoadUint32(r.cqHead)
+		for t := atomic.LoadUint32(r.cqTail); head != t; head++ {
+			cqe := &r.cqes[head&*r.cqMask]
+			if cqe.userData < uint64(n) {
+				r.res[cqe.userData] = cqe.res
+			}
+			completed++
+		}
+		atomic.StoreUint32(r.cqHead, head)
+	}
+	return nil
+}
+
+// prepare fills in the SQE at index i for op on fd with r.hdrs[i].
+func (r *ioURing) prepare(i int, op uint8, fd uintptr, msgFlags uint32, last bool) {
+	sqe := &r.sqes[i]
+	*sqe = ioURingSQE{
+		opcode:   op,
+		fd:       int32(fd),
+		addr:     uint64(uintptr(unsafe.Pointer(&r.hdrs[i]))),
+		len:      1,
+		msgFlags: msgFlags,
+		userData: uint64(i),
+	}
+	if !last {
+		sqe.flags = iosqeIOLink
+	}
+}
+
+// ioURingConn implements the batched I/O of a UDP socket with io_uring.
+// It uses the Go runtime's poller to wait for the socket to be ready,
+// then submits a batch's recvmsg or sendmsg calls with one io_uring_enter,
+// rather than recvmmsg or sendmmsg.
+type ioURingConn struct {
+	rc     syscall.RawConn
+	is6    bool
+	rx, tx *ioURing
+}
+
+// newIOURingConn returns an ioURingConn for uc, a socket of network
+// "udp4" or "udp6", or an error if io_uring isn't available.
+func newIOURingConn(uc *net.UDPConn, network string) (*ioURingConn, error) {
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	rx, err := newIOURing()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := newIOURing()
+	if err != nil {
+		rx.close()
+		return nil, err
+	}
+	return &ioURingConn{rc: rc, is6: network == "udp6", rx: rx, tx: tx}, nil
+}
+
+// release frees the io_uring instances of c, after its socket is closed.
+func (c *ioURingConn) release() {
+	for _, r := range []*ioURing{c.rx, c.tx} {
+		r.mu.Lock()
+		r.close()
+		r.mu.Unlock()
+	}
+}
+
+var errIOURingClosed = errors.New("io_uring closed")
+
+func (c *ioURingConn) ReadBatch(msgs []ipv6.Message, _ int) (int, error) {
+	r := c.rx
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fd < 0 {
+		return 0, errIOURingClosed
+	}
+	n := min(len(msgs), ioURingEntries)
+	for i := range msgs[:n] {
+		m := &msgs[i]
+		if len(m.Buffers) == 0 || len(m.Buffers[0]) == 0 {
+			n = i
+			break
+		}
+		r.iovs[i] = unix.Iovec{Base: &m.Buffers[0][0]}
+		r.iovs[i].SetLen(len(m.Buffers[0]))
+		r.hdrs[i] = unix.Msghdr{
+			Name:    (*byte)(unsafe.Pointer(&r.addrs[i])),
+			Namelen: uint32(unsafe.Sizeof(r.addrs[i])),
+			Iov:     &r.iovs[i],
+		}
+		r.hdrs[i].SetIovlen(1)
+		if len(m.OOB) > 0 {
+			r.hdrs[i].Control = &m.OOB[0]
+			r.hdrs[i].SetControllen(len(m.OOB))
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	var got int
+	var opErr error
+	err := c.rc.Read(func(fd uintptr) bool {
+		for i := 0; i < n; i++ {
+			r.prepare(i, ioringOpRecvmsg, fd, unix.MSG_DONTWAIT, i == n-1)
+		}
+		if opErr = r.run(n); opErr != nil {
+			return true
+		}
+		for got = 0; got < n && r.res[got] >= 0; got++ {
+			m := &msgs[got]
+			m.N = int(r.res[got])
+			m.NN = int(r.hdrs[got].Controllen)
+			m.Flags = int(r.hdrs[got].Flags)
+			m.Addr = sockaddrToUDPAddr(&r.addrs[got])
+		}
+		if got == 0 {
+			if errno := syscall.Errno(-r.res[0]); errno != unix.EAGAIN {
+				opErr = os.NewSyscallError("recvmsg", errno)
+			} else {
+				return false // wait until readable
+			}
+		}
+		return true
+	})
+	runtime.KeepAlive(msgs)
+	if err != nil {
+		return 0, err
+	}
+	return got, opErr
+}
+
+func (c *ioURingConn) WriteBatch(msgs []ipv6.Message, _ int) (int, error) {
+	r := c.tx
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fd < 0 {
+		return 0, errIOURingClosed
+	}
+	n := min(len(msgs), ioURingEntries)
+	for i := range msgs[:n] {
+		m := &msgs[i]
+		ua, ok := m.Addr.(*net.UDPAddr)
+		if !ok {
+			return i, fmt.Errorf("io_uring: unsupported address %T", m.Addr)
+		}
+		namelen := c.putSockaddr(&r.addrs[i], ua)
+		r.hdrs[i] = unix.Msghdr{
+			Name:    (*byte)(unsafe.Pointer(&r.addrs[i])),
+			Namelen: namelen,
+		}
+		if len(m.Buffers) > 0 && len(m.Buffers[0]) > 0 {
+			r.iovs[i] = unix.Iovec{Base: &m.Buffers[0][0]}
+			r.iovs[i].SetLen(len(m.Buffers[0]))
+			r.hdrs[i].Iov = &r.iovs[i]
+			r.hdrs[i].SetIovlen(1)
+		}
+		if len(m.OOB) > 0 {
+			r.hdrs[i].Control = &m.OOB[0]
+			r.hdrs[i].SetControllen(len(m.OOB))
+		}
+	}
+
+	var sent int
+	var opErr error
+	err := c.rc.Write(func(fd uintptr) bool {
+		for i := 0; i < n; i++ {
+			r.prepare(i, ioringOpSendmsg, fd, unix.MSG_DONTWAIT, i == n-1)
+		}
+		if opErr = r.run(n); opErr != nil {
+			return true
+		}
+		for sent = 0; sent < n && r.res[sent] >= 0; sent++ {
+			msgs[sent].N = int(r.res[sent])
+		}
+		if sent < n {
+			errno := syscall.Errno(-r.res[sent])
+			if errno == unix.EAGAIN {
+				// Wait until writable if nothing was sent, else
+				// report the partial write.
+				return sent > 0
+			}
+			opErr = os.NewSyscallError("sendmsg", errno)
+		}
+		return true
+	})
+	runtime.KeepAlive(msgs)
+	if err != nil {
+		return sent, err
+	}
+	return sent, opErr
+}
+
+// putSockaddr writes ua to sa as a sockaddr of c's family, returning its
+// length.
+func (c *ioURingConn) putSockaddr(sa *unix.RawSockaddrInet6, ua *net.UDPAddr) uint32 {
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	if !c.is6 {
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+		*sa4 = unix.RawSockaddrInet4{Family: unix.AF_INET}
+		copy(sa4.Addr[:], ua.IP.To4())
+		binary.BigEndian.PutUint16(port[:], uint16(ua.Port))
+		return unix.SizeofSockaddrInet4
+	}
+	*sa = unix.RawSockaddrInet6{Family: unix.AF_INET6}
+	copy(sa.Addr[:], ua.IP.To16())
+	binary.BigEndian.PutUint16(port[:], uint16(ua.Port))
+	return unix.SizeofSockaddrInet6
+}
+
+// sockaddrToUDPAddr returns the address of sa, a sockaddr_in or
+// sockaddr_in6.
+func sockaddrToUDPAddr(sa *unix.RawSockaddrInet6) *net.UDPAddr {
+	port := int(binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:]))
+	if sa.Family == unix.AF_INET {
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+		ip := make(net.IP, 4)
+		copy(ip, sa4.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: port}
+	}
+	ua := &net.UDPAddr{IP: make(net.IP, 16), Port: port}
+	copy(ua.IP, sa.Addr[:])
+	return ua
+}
@@ -0,0 +1,85 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"time"
+
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/util/mak"
+)
+
+// retiredDerp is a DERP connection retired by a key rotation.
+type retiredDerp struct {
+	activeDerp
+	closed bool // whether closeRetiredDerpLocked closed it
+}
+
+// retireDerpLocked moves c's DERP connections, authenticated with the
+// private key being replaced, out of c.activeDerp, so new ones are made
+// with the new key. They keep receiving packets sent to the old key by
+// peers that haven't learned the new one yet, until
+// Options.KeyRotationWindow passes. c.mu must be held.
+func (c *Conn) retireDerpLocked() {
+	// Only the previous key's connections are kept.
+	c.closeRetiredDerpLocked("key-rotated-again")
+	// The second home connection isn't kept; it's only for sending.
+	c.closeDerpAltLocked("key-rotated")
+	for regionID, ad := range c.activeDerp {
+		c.logf("magicsock: retiring connection to derp-%v for %v (key rotated)", regionID, c.keyRotationWindow)
+		mak.Set(&c.retiredDerp, ad.c, retiredDerp{activeDerp: ad})
+		delete(c.activeDerp, regionID)
+		// The new key's connection needn't wait for this one to
+		// close, as the server sees them as different clients.
+		delete(c.prevDerp, regionID)
+	}
+	metricNumDERPConns.Set(int64(len(c.activeDerp)))
+	if len(c.retiredDerp) == 0 {
+		return
+	}
+	c.retiredDerpTimer = c.afterFunc(c.keyRotationWindow, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.closeRetiredDerpLocked("key-rotation-window-over")
+	})
+}
+
+// closeRetiredDerpLocked closes the DERP connections retired by
+// retireDerpLocked. c.mu must be held.
+func (c *Conn) closeRetiredDerpLocked(why string) {
+	if c.retiredDerpTimer != nil {
+		c.retiredDerpTimer.Stop()
+		c.retiredDerpTimer = nil
+	}
+	for dc, rd := range c.retiredDerp {
+		if rd.closed {
+			continue
+		}
+		c.logf("magicsock: closing retired connection to derp (%v), age %v", why, c.now().Sub(rd.createTime).Round(time.Second))
+		go dc.Close()
+		rd.cancel()
+		rd.closed = true
+		c.retiredDerp[dc] = rd
+	}
+	// Entries are deleted by forgetRetiredDerp when their readers
+	// exit, so those know they're retired until then.
+}
+
+// isRetiredDerp reports whether dc is a DERP connection retired by a key
+// rotation. Retired connections don't update the state of their region
+// or DERP routes; their replacements do.
+func (c *Conn) isRetiredDerp(dc *derphttp.Client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.retiredDerp[dc]
+	return ok
+}
+
+// forgetRetiredDerp is called when dc's reader exits, to forget it if it
+// was retired.
+func (c *Conn) forgetRetiredDerp(dc *derphttp.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.retiredDerp, dc)
+}
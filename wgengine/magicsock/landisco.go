@@ -0,0 +1,227 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"time"
+
+	"go4.org/mem"
+	"golang.org/x/net/ipv4"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/types/key"
+	"tailscale.com/util/clientmetric"
+)
+
+// LAN discovery lets peers on the same LAN find each other's local
+// endpoints without waiting for them to come via the netmap or a
+// CallMeMaybe over DERP. Each Conn periodically multicasts an
+// announcement of its node key, disco key and UDP port on its LAN
+// interfaces, and adds the source of a peer's announcement as a
+// candidate endpoint of that peer. See Options.LANDiscovery.
+//
+// Announcements aren't authenticated: node and disco keys can only
+// seal boxes for a known recipient, not sign a message to everyone on
+// the LAN. Instead, a candidate is only used once a disco ping to it,
+// sealed for the peer's disco key from the netmap, gets a pong, so a
+// forged announcement can at most cost a few pings. The peer learns our
+// endpoint from that ping, so announcements need no reply.
+
+const (
+	// lanAnnounceMagic starts every LAN announcement.
+	lanAnnounceMagic = "TSLAN1"
+
+	// lanAnnounceLen is the length of a LAN announcement: the magic,
+	// node key, disco key and big-endian UDP port.
+	lanAnnounceLen = len(lanAnnounceMagic) + 32 + key.DiscoPublicRawLen + 2
+
+	// lanAnnounceInterval is how often a Conn announces itself.
+	lanAnnounceInterval = 30 * time.Second
+
+	// lanDiscoveryTimeout is how long an endpoint from an announcement
+	// lasts without another.
+	lanDiscoveryTimeout = 2 * time.Minute
+)
+
+// lanDiscoveryGroup is the multicast group and port announcements are
+// sent to, in the administratively scoped range.
+var lanDiscoveryGroup = netip.AddrPortFrom(netip.AddrFrom4([4]byte{239, 255, 41, 64}), 41640)
+
+// lanAnnounce is the content of a LAN announcement.
+type lanAnnounce struct {
+	node  key.NodePublic
+	disco key.DiscoPublic
+	port  uint16
+}
+
+// appendLANAnnounce appends the encoding of a to b.
+func appendLANAnnounce(b []byte, a lanAnnounce) []byte {
+	b = append(b, lanAnnounceMagic...)
+	b = a.node.AppendTo(b)
+	b = a.disco.AppendTo(b)
+	return binary.BigEndian.AppendUint16(b, a.port)
+}
+
+// parseLANAnnounce parses the LAN announcement in b.
+func parseLANAnnounce(b []byte) (a lanAnnounce, ok bool) {
+	if len(b) != lanAnnounceLen || string(b[:len(lanAnnounceMagic)]) != lanAnnounceMagic {
+		return a, false
+	}
+	b = b[len(lanAnnounceMagic):]
+	a.node = key.NodePublicFromRaw32(mem.B(b[:32]))
+	a.disco = key.DiscoPublicFromRaw32(mem.B(b[32:64]))
+	a.port = binary.BigEndian.Uint16(b[64:])
+	if a.node.IsZero() || a.disco.IsZero() || a.port == 0 {
+		return a, false
+	}
+	return a, true
+}
+
+// runLANDiscovery announces c on its LAN interfaces and handles peers'
+// announcements until ctx is done.
+func (c *Conn) runLANDiscovery(ctx context.Context) {
+	group := net.UDPAddrFromAddrPort(lanDiscoveryGroup)
+	uc, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		c.logf("magicsock: LAN discovery disabled: %v", err)
+		return
+	}
+	pc := ipv4.NewPacketConn(uc)
+	pc.SetMulticastTTL(1)
+	pc.SetMulticastLoopback(false)
+	go func() {
+		<-ctx.Done()
+		uc.Close()
+	}()
+	go c.readLANAnnounces(uc)
+
+	t := time.NewTicker(lanAnnounceInterval)
+	defer t.Stop()
+	for {
+		c.sendLANAnnounce(pc, group)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// sendLANAnnounce joins the LAN discovery group on, and sends an
+// announcement out of, each of c's LAN interfaces. Joining again each
+// time picks up interfaces that came up since.
+func (c *Conn) sendLANAnnounce(pc *ipv4.PacketConn, group *net.UDPAddr) {
+	node := c.publicKeyAtomic.Load()
+	if node.IsZero() || c.disableIPv4.Load() {
+		return
+	}
+	pkt := appendLANAnnounce(make([]byte, 0, lanAnnounceLen), lanAnnounce{
+		node:  node,
+		disco: c.discoPublic,
+		port:  uint16(c.pconn4.LocalAddr().Port),
+	})
+	err := interfaces.ForeachInterface(func(iface interfaces.Interface, pfxs []netip.Prefix) {
+		if !iface.IsUp() || iface.IsLoopback() || iface.Flags&net.FlagMulticast == 0 || !hasLANAddr4(pfxs) {
+			return
+		}
+		pc.JoinGroup(iface.Interface, group) // errors if already joined
+		if err := pc.SetMulticastInterface(iface.Interface); err != nil {
+			return
+		}
+		if _, err := pc.WriteTo(pkt, nil, group); err != nil {
+			c.dlogf("[v1] magicsock: LAN announce on %s: %v", iface.Name, err)
+			return
+		}
+		metricLANAnnounceSent.Add(1)
+	})
+	if err != nil {
+		c.dlogf("[v1] magicsock: LAN announce: %v", err)
+	}
+}
+
+// hasLANAddr4 reports whether pfxs, the addresses of an interface, have
+// an IPv4 address that isn't a Tailscale one.
+func hasLANAddr4(pfxs []netip.Prefix) bool {
+	for _, pfx := range pfxs {
+		if pfx.Addr().Is4() && !tsaddr.IsTailscaleIP(pfx.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// readLANAnnounces handles the announcements read from uc until it's
+// closed.
+func (c *Conn) readLANAnnounces(uc *net.UDPConn) {
+	buf := make([]byte, 128)
+	for {
+		n, src, err := uc.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		if a, ok := parseLANAnnounce(buf[:n]); ok {
+			c.handleLANAnnounce(a, src.Addr().Unmap())
+		}
+	}
+}
+
+// handleLANAnnounce adds the endpoint in a, an announcement received
+// from src, to the peer it names, if a's keys match the peer's in the
+// netmap.
+func (c *Conn) handleLANAnnounce(a lanAnnounce, src netip.Addr) {
+	if !src.Is4() || !src.IsGlobalUnicast() && !src.IsLinkLocalUnicast() || tsaddr.IsTailscaleIP(src) {
+		return
+	}
+	if a.node == c.publicKeyAtomic.Load() {
+		return
+	}
+	metricLANAnnounceRecv.Add(1)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	de, ok := c.peerMap.endpointForNodeKey(a.node)
+	if !ok || de.isWireguardOnly {
+		return
+	}
+	if d := de.disco.Load(); d == nil || d.key != a.disco {
+		return
+	}
+	de.addLANEndpoint(netip.AddrPortFrom(src, a.port))
+}
+
+// addLANEndpoint adds ep, announced by the peer on the LAN, to de's
+// candidate endpoints, or refreshes it if it was already announced.
+func (de *endpoint) addLANEndpoint(ep netip.AddrPort) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	now := de.c.now()
+	if st, ok := de.endpointState[ep]; ok {
+		if !st.lanTime.IsZero() {
+			st.lanTime = now
+		}
+		return
+	}
+	de.endpointState[ep] = &endpointState{lanTime: now}
+	metricLANDiscoveryEndpoints.Add(1)
+	de.addDebugUpdate(EndpointChange{
+		What:   "addLANEndpoint",
+		Reason: ChangeLANDiscovery,
+		To:     ep,
+	})
+	de.dlogPeer("disco: LAN announce added endpoint", LogKeyEndpoint, ep)
+	de.startDiscoPingLocked(ep, de.c.monoNow(), pingDiscovery)
+}
+
+var (
+	metricLANAnnounceSent       = clientmetric.NewCounter("magicsock_lan_announce_sent")
+	metricLANAnnounceRecv       = clientmetric.NewCounter("magicsock_lan_announce_recv")
+	metricLANDiscoveryEndpoints = clientmetric.NewCounter("magicsock_lan_discovery_endpoints")
+)
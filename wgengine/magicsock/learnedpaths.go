@@ -0,0 +1,107 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"net/netip"
+	"time"
+
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/key"
+	"tailscale.com/util/mak"
+)
+
+// learnedPathTrustDuration is how long a path learned in a previous
+// session is trusted as a peer's exclusive path before it's confirmed by
+// a pong. It's shorter than trustUDPAddrDuration, so a path that stopped
+// working soon falls back to DERP and full discovery.
+const learnedPathTrustDuration = 2 * time.Second
+
+// SetPathLearnedCallback sets fn to be called when a UDP path to a peer is
+// confirmed and differs from the one last reported for the peer, so the
+// embedder can persist it and pass it to SetLearnedPaths in a later
+// session. fn is called in its own goroutine.
+func (c *Conn) SetPathLearnedCallback(fn func(peer key.NodePublic, addr netip.AddrPort)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pathLearnedFunc = fn
+}
+
+// SetLearnedPaths sets the UDP paths to peers that worked in a previous
+// session, as reported to the SetPathLearnedCallback func. It should be
+// called before the first SetNetworkMap.
+//
+// When a peer without a path is added by SetNetworkMap, and its learned
+// path is still one of its endpoints, that path is tried first: it's
+// used alone for learnedPathTrustDuration while pinged, rather than
+// waiting for DERP and discovery. Each learned path is only tried once.
+func (c *Conn) SetLearnedPaths(paths map[key.NodePublic]netip.AddrPort) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.learnedPaths = nil
+	for k, ap := range paths {
+		if ap.IsValid() {
+			mak.Set(&c.learnedPaths, k, ap)
+		}
+	}
+}
+
+// tryLearnedPathLocked makes de's learned path, if any, its best address.
+// c.mu must be held.
+func (c *Conn) tryLearnedPathLocked(de *endpoint) {
+	ap, ok := c.learnedPaths[de.publicKey]
+	if !ok {
+		return
+	}
+	delete(c.learnedPaths, de.publicKey)
+
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	if de.isWireguardOnly || de.bestAddr.IsValid() {
+		return
+	}
+	if _, ok := de.endpointState[ap]; !ok {
+		return
+	}
+	now := c.monoNow()
+	de.addDebugUpdate(EndpointChange{
+		What:   "tryLearnedPath",
+		Reason: ChangeLearnedPath,
+		To:     ap,
+	})
+	// Any pong, even a slow one, is better than an unconfirmed path.
+	de.bestAddr = addrLatency{AddrPort: ap, latency: time.Hour}
+	de.quality.notePathChange(now)
+	de.bestAddrAt = now
+	de.trustBestAddrUntil = now.Add(learnedPathTrustDuration)
+	de.bestAddrLearned = true
+	metricLearnedPathTried.Add(1)
+}
+
+// pingLearnedPathLocked pings de's best address, if it's an unconfirmed
+// learned path, when de is first sent to. de.mu must be held.
+func (de *endpoint) pingLearnedPathLocked(now mono.Time) {
+	if !de.bestAddrLearned || de.learnedPathPinged {
+		return
+	}
+	de.learnedPathPinged = true
+	de.startDiscoPingLocked(de.bestAddr.AddrPort, now, pingDiscovery)
+}
+
+// notePathConfirmedLocked is called when ap, de's best address, is
+// confirmed by a pong. It reports it to the SetPathLearnedCallback func,
+// if it changed. c.mu and de.mu must be held.
+func (de *endpoint) notePathConfirmedLocked(ap netip.AddrPort) {
+	if de.bestAddrLearned {
+		de.bestAddrLearned = false
+		metricLearnedPathConfirmed.Add(1)
+	}
+	if ap == de.reportedPath {
+		return
+	}
+	de.reportedPath = ap
+	if fn := de.c.pathLearnedFunc; fn != nil {
+		go fn(de.publicKey, ap)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+// Keys of the attributes of a Conn's log records about a peer or path.
+// See Options.LogHandler.
+const (
+	LogKeyPeer     = "peer"     // the peer's node key, abbreviated
+	LogKeyDisco    = "disco"    // the peer's disco key, abbreviated
+	LogKeyEndpoint = "endpoint" // a UDP ip:port, or a DERP region as "derp-N"
+	LogKeyPath     = "path"     // "udp" or "derp"
+)
+
+// Levels of a Conn's verbose log records. Logged as Logf lines, they're
+// marked with the prefixes "[v1] " and "[v2] " respectively. Records of
+// unexpected conditions are logged at slog.LevelWarn, marked
+// "[unexpected] ".
+const (
+	LevelVerbose  = slog.LevelDebug
+	LevelVerbose2 = slog.LevelDebug - 4
+)
+
+// newLogger returns the structured logger for a Conn made with opts, and
+// the Logf for code (including subsystems) that only speaks Logf.
+//
+// With Options.LogHandler set, both log to it, with the level of Logf
+// lines parsed from their prefixes. Otherwise both log to Options.Logf,
+// with structured records formatted as Logf lines.
+func (o *Options) newLogger() (*slog.Logger, logger.Logf) {
+	if h := o.LogHandler; h != nil {
+		return slog.New(h), handlerLogf(h)
+	}
+	logf := o.logf()
+	return slog.New(&logfHandler{logf: logf}), logf
+}
+
+// handlerLogf returns a Logf logging to h.
+func handlerLogf(h slog.Handler) logger.Logf {
+	return func(format string, args ...any) {
+		msg := fmt.Sprintf(format, args...)
+		level := slog.LevelInfo
+		if rest, ok := strings.CutPrefix(msg, "[v1] "); ok {
+			level, msg = LevelVerbose, rest
+		} else if rest, ok := strings.CutPrefix(msg, "[v2] "); ok {
+			level, msg = LevelVerbose2, rest
+		} else if strings.Contains(msg, "[unexpected]") {
+			level = slog.LevelWarn
+		}
+		ctx := context.Background()
+		if !h.Enabled(ctx, level) {
+			return
+		}
+		msg = strings.TrimPrefix(msg, "magicsock: ")
+		h.Handle(ctx, slog.NewRecord(time.Now(), level, msg, 0))
+	}
+}
+
+// logfHandler is a slog.Handler formatting records as Logf lines, like
+// "[v1] magicsock: msg key=value".
+type logfHandler struct {
+	logf   logger.Logf
+	attrs  string // preformatted, from WithAttrs
+	prefix string // key prefix, from WithGroup
+}
+
+func (h *logfHandler) Enabled(context.Context, slog.Level) bool {
+	// Logf has no levels; verbose lines are filtered downstream by
+	// their prefixes.
+	return true
+}
+
+func (h *logfHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	switch {
+	case r.Level <= LevelVerbose2:
+		b.WriteString("[v2] ")
+	case r.Level <= LevelVerbose:
+		b.WriteString("[v1] ")
+	case r.Level >= slog.LevelWarn:
+		b.WriteString("[unexpected] ")
+	}
+	b.WriteString("magicsock: ")
+	b.WriteString(r.Message)
+	b.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&b, h.prefix, a)
+		return true
+	})
+	h.logf("%s", b.String())
+	return nil
+}
+
+func (h *logfHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	b.WriteString(h.attrs)
+	for _, a := range attrs {
+		appendAttr(&b, h.prefix, a)
+	}
+	h2 := *h
+	h2.attrs = b.String()
+	return &h2
+}
+
+func (h *logfHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix += name + "."
+	return &h2
+}
+
+// appendAttr appends a to b as " key=value", with key prefixed by prefix.
+func appendAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		for _, ga := range v.Group() {
+			appendAttr(b, prefix+a.Key+".", ga)
+		}
+		return
+	}
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	fmt.Fprintf(b, " %s%s=%v", prefix, a.Key, v.Any())
+}
+
+// log returns c's structured logger.
+func (c *Conn) log() *slog.Logger {
+	if c.slogger == nil {
+		// A Conn made without NewConn, in tests.
+		return slog.New(&logfHandler{logf: c.logf})
+	}
+	return c.slogger
+}
+
+// logPeer logs a record about de's peer at level, with the peer's node
+// and disco keys as attributes.
+func (de *endpoint) logPeer(level slog.Level, msg string, args ...any) {
+	l := de.c.log()
+	ctx := context.Background()
+	if !l.Enabled(ctx, level) {
+		return
+	}
+	l.With(LogKeyPeer, de.publicKey.ShortString(), LogKeyDisco, de.discoShort()).Log(ctx, level, msg, args...)
+}
+
+// dlogPeer is like logPeer at LevelVerbose, but only logs if debug logging
+// is enabled, like Conn.dlogf.
+func (de *endpoint) dlogPeer(msg string, args ...any) {
+	if de.c.debugLogging.Load() {
+		de.logPeer(LevelVerbose, msg, args...)
+	}
+}
+
+// dlog logs a record at LevelVerbose, if debug logging is enabled, like
+// dlogf.
+func (c *Conn) dlog(msg string, args ...any) {
+	if c.debugLogging.Load() {
+		c.log().Log(context.Background(), LevelVerbose, msg, args...)
+	}
+}
+
+// pathAttrs returns the LogKeyEndpoint and LogKeyPath attributes of a
+// packet sent to or received from ap.
+func pathAttrs(ap netip.AddrPort) []any {
+	if ap.Addr() == tailcfg.DerpMagicIPAddr {
+		return []any{LogKeyEndpoint, derpStr(ap.String()), LogKeyPath, "derp"}
+	}
+	return []any{LogKeyEndpoint, ap, LogKeyPath, "udp"}
+}
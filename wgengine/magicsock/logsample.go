@@ -0,0 +1,92 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"sync"
+	"time"
+
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/mak"
+)
+
+const (
+	// logSampleWindow is the period of Options.LogSamplesPerMinute.
+	logSampleWindow = time.Minute
+
+	// defaultLogSamplesPerMinute is the Options.LogSamplesPerMinute used
+	// if none is set.
+	defaultLogSamplesPerMinute = 10
+)
+
+// logSampler limits the log lines of each class of high-frequency event
+// to a number per logSampleWindow, counting the rest. Unlike the rate
+// limiting of logger.RateLimitedFn, which keys on format strings and
+// exempts disco messages, a class covers all the lines of an event,
+// whatever peer or address they name.
+type logSampler struct {
+	// limit is the number of lines per window: zero means
+	// defaultLogSamplesPerMinute, and negative no limit.
+	limit int
+
+	mu      sync.Mutex
+	classes map[string]*logSampleClass
+}
+
+// logSampleClass is the state of a logSampler's class in the current
+// window.
+type logSampleClass struct {
+	start      time.Time
+	logged     int
+	suppressed int
+}
+
+// allow reports whether a line of class may be logged at now. If a
+// window of class ended with lines suppressed, it also returns their
+// number, to be logged first.
+func (s *logSampler) allow(class string, now time.Time) (ok bool, suppressed int) {
+	limit := s.limit
+	if limit < 0 {
+		return true, 0
+	}
+	if limit == 0 {
+		limit = defaultLogSamplesPerMinute
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.classes[class]
+	if !ok {
+		st = &logSampleClass{start: now}
+		mak.Set(&s.classes, class, st)
+	}
+	if now.Sub(st.start) >= logSampleWindow {
+		suppressed = st.suppressed
+		*st = logSampleClass{start: now}
+	}
+	if st.logged >= limit {
+		st.suppressed++
+		metricLogSuppressed.Add(1)
+		return false, suppressed
+	}
+	st.logged++
+	return true, suppressed
+}
+
+// logfSampled is like logf for a line of class, a high-frequency event
+// such as a failure to send, limited by Options.LogSamplesPerMinute. The
+// lines suppressed in a minute are summarized before the class's first
+// line of a later one.
+func (c *Conn) logfSampled(class, format string, args ...any) {
+	ok, suppressed := c.logSampler.allow(class, c.now())
+	if suppressed > 0 {
+		c.logf("magicsock: suppressed %d %q log lines in the previous minute", suppressed, class)
+	}
+	if ok {
+		c.logf(format, args...)
+	}
+}
+
+// metricLogSuppressed counts the log lines suppressed by logfSampled.
+var metricLogSuppressed = clientmetric.NewCounter("magicsock_log_suppressed")
@@ -7,10 +7,12 @@
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/netip"
@@ -24,8 +26,10 @@
 
 	"github.com/tailscale/wireguard-go/conn"
 	"go4.org/mem"
+	"golang.org/x/exp/slices"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
+	"tailscale.com/derp/derphttp"
 	"tailscale.com/disco"
 	"tailscale.com/envknob"
 	"tailscale.com/health"
@@ -51,6 +55,7 @@
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/nettype"
+	"tailscale.com/types/views"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/mak"
 	"tailscale.com/util/ringbuffer"
@@ -80,13 +85,27 @@ type Conn struct {
 	// This block mirrors the contents and field order of the Options
 	// struct. Initialized once at construction, then constant.
 
-	logf                   logger.Logf
-	epFunc                 func([]tailcfg.Endpoint)
-	derpActiveFunc         func()
-	idleFunc               func() time.Duration // nil means unknown
-	testOnlyPacketListener nettype.PacketListener
-	noteRecvActivity       func(key.NodePublic) // or nil, see Options.NoteRecvActivity
-	netMon                 *netmon.Monitor      // or nil
+	logf                    logger.Logf
+	slogger                 *slog.Logger // structured logger; see Options.LogHandler
+	epFunc                  func([]tailcfg.Endpoint)
+	derpActiveFunc          func()
+	idleFunc                func() time.Duration // nil means unknown
+	testOnlyPacketListener  nettype.PacketListener
+	testOnlyPathImpairments bool
+	noteRecvActivity        func(key.NodePublic) // or nil, see Options.NoteRecvActivity
+	netmapDiffFunc          func(NetmapDiff)     // or nil, see Options.NetmapDiffFunc
+	pathKeepaliveFunc       func(key.NodePublic) // or nil, see Options.PathKeepaliveFunc
+	netMon                  *netmon.Monitor      // or nil
+	autoRebind              *autoRebind          // nil unless Options.AutoRebind
+	netMonUnregister        func()               // or nil
+	clock                   tstime.Clock         // or nil for the real clock
+	silentDisco             bool
+	pathSelector            PathSelector // or nil for LatencyPathSelector
+	derpWriteQueueDepth     int          // 0 means bufferedDerpWritesBeforeDrop
+	derpDropPolicy          DERPDropPolicy
+	derpBlockTimeout        time.Duration // 0 means defaultDERPBlockTimeout
+	derpDial                DERPDialPolicy
+	packetConns             PacketConns
 
 	// ================================================================
 	// No locking required to access these fields, either because
@@ -103,13 +122,43 @@ type Conn struct {
 	pconn4 RebindingUDPConn
 	pconn6 RebindingUDPConn
 
+	// peerPorts is Options.PeerPorts, and peerPorts4 and peerPorts6 the
+	// peers' own sockets it binds. peerPortRecvCh carries the WireGuard
+	// packets read from them to receivePeerPorts.
+	peerPorts      PeerPorts
+	peerPorts4     peerPortSet
+	peerPorts6     peerPortSet
+	peerPortRecvCh chan peerPortReadResult
+
 	receiveBatchPool sync.Pool
+	batchSize        int // set before binding; see Options.ReceiveBatchSize
+
+	// portPrediction is whether port prediction is enabled. See
+	// Options.PortPrediction.
+	portPrediction bool
+
+	// derpDualHome is whether to keep a second connection to the home
+	// DERP region. See Options.DERPDualHome.
+	derpDualHome bool
+
+	// preferFasterDERP is whether peers are sent to via DERP when it's
+	// faster than their direct path. See Options.PreferFasterDERP.
+	preferFasterDERP atomic.Bool
 
+	// lanDiscovery is whether to announce the Conn to, and discover
+	// peers on, the LAN. See Options.LANDiscovery.
+	lanDiscovery bool
+
+	// rawDiscoMu guards the raw disco receiver fields below.
+	rawDiscoMu sync.Mutex
 	// closeDisco4 and closeDisco6 are io.Closers to shut down the raw
 	// disco packet receivers. If nil, no raw disco receiver is
 	// running for the given family.
 	closeDisco4 io.Closer
 	closeDisco6 io.Closer
+	// rawDiscoDisabled is whether the raw disco receivers are turned
+	// off, by Options.DisableRawDisco or SetRawDiscoEnabled.
+	rawDiscoDisabled bool
 
 	// netChecker is the prober that discovers local network
 	// conditions, including the closest DERP relay and NAT mappings.
@@ -123,6 +172,10 @@ type Conn struct {
 	// Its Loaded value is always non-nil.
 	stunReceiveFunc syncs.AtomicValue[func(p []byte, fromAddr netip.AddrPort)]
 
+	// staticEndpoints are the endpoints always advertised, from
+	// Options.StaticEndpoints or SetStaticEndpoints.
+	staticEndpoints syncs.AtomicValue[views.Slice[netip.AddrPort]]
+
 	// derpRecvCh is used by receiveDERP to read DERP messages.
 	// It must have buffer size > 0; see issue 3736.
 	derpRecvCh chan derpReadResult
@@ -140,6 +193,11 @@ type Conn struct {
 	// logging.
 	noV4, noV6 atomic.Bool
 
+	// disableIPv4 and disableIPv6 are Options.DisableIPv4 and
+	// Options.DisableIPv6, as updated by SetDisableIPv4 and
+	// SetDisableIPv6.
+	disableIPv4, disableIPv6 atomic.Bool
+
 	// noV4Send is whether IPv4 UDP is known to be unable to transmit
 	// at all. This could happen if the socket is in an invalid state
 	// (as can happen on darwin after a network link status change).
@@ -174,16 +232,55 @@ type Conn struct {
 	derpForceWebsockets atomic.Bool
 
 	// derpRegionDialer is passed to the DERP client
-	derpRegionDialer atomic.Pointer[func(ctx context.Context, region *tailcfg.DERPRegion) net.Conn]
+	derpRegionDialer atomic.Pointer[func(ctx context.Context, region *tailcfg.DERPRegion, node *tailcfg.DERPNode) net.Conn]
+
+	// derpTrafficFunc, if non-nil, is called with the bytes sent and
+	// received via DERP. See SetDERPTrafficCallback.
+	derpTrafficFunc atomic.Pointer[func(DERPTraffic)]
 
 	// stats maintains per-connection counters.
 	stats atomic.Pointer[connstats.Statistics]
 
+	// derpDrops counts, per peer, the packets dropped because their
+	// DERP server's write queue was full.
+	derpDrops syncs.Map[key.NodePublic, *atomic.Int64]
+
 	// captureHook, if non-nil, is the pcap logging callback when capturing.
 	captureHook syncs.AtomicValue[capture.Callback]
+	// captureFilter is the filter of captureHook, if any.
+	captureFilter atomic.Pointer[capture.Filter]
+
+	// packetCapture, if non-nil, is the capture started by
+	// StartPacketCapture.
+	packetCapture atomic.Pointer[packetCapture]
+
+	// discoObfuscator, if non-nil, obfuscates disco messages sent over
+	// UDP. See SetDiscoObfuscation.
+	discoObfuscator atomic.Pointer[discoObfuscator]
+
+	// healthWatchers are poked when Health may have changed.
+	healthWatchers healthWatchers
+
+	// sendPacing is the pacing of UDP sends. See SetSendPacing.
+	sendPacing syncs.AtomicValue[SendPacing]
+
+	// pathImpairments, if non-nil, are the impairments of UDP sends
+	// by destination. See SetPathImpairmentForTest.
+	pathImpairments atomic.Pointer[map[netip.AddrPort]PathImpairment]
+
+	// multipathWindow is how long packets are also sent on a peer's
+	// previous path after it changes. See SetMultipathWindow.
+	multipathWindow syncs.AtomicValue[time.Duration]
+
+	// reusePort is Options.ReusePort, and reusePortBPF the BPF program
+	// attached to the sockets' SO_REUSEPORT groups, or zero for none.
+	// See Conn.AttachReusePortBPF.
+	reusePort    ReusePort
+	reusePortBPF syncs.AtomicValue[int]
 
 	// discoPrivate is the private naclbox key used for active
-	// discovery traffic. It is always present, and immutable.
+	// discovery traffic, from Options.DiscoPrivateKey or else random.
+	// It is always present, and immutable.
 	discoPrivate key.DiscoPrivate
 	// public of discoPrivate. It is always present and immutable.
 	discoPublic key.DiscoPublic
@@ -191,6 +288,10 @@ type Conn struct {
 	// present and immutable.
 	discoShort string
 
+	// discoRecvLimit limits the incoming disco messages opened per
+	// source. It is always present and immutable.
+	discoRecvLimit *discoRecvLimiter
+
 	// ============================================================
 	// mu guards all following fields; see userspaceEngine lock
 	// ordering rules against the engine. For derphttp, mu must
@@ -204,7 +305,19 @@ type Conn struct {
 	// derpCleanupTimer is the timer that fires to occasionally clean
 	// up idle DERP connections. It's only used when there is a non-home
 	// DERP connection in use.
-	derpCleanupTimer *time.Timer
+	derpCleanupTimer tstime.TimerController
+
+	// keyRotationWindow is how long DERP connections using a replaced
+	// private key are kept. See Options.KeyRotationWindow.
+	keyRotationWindow time.Duration
+	// retiredDerp are the DERP connections kept after a key rotation,
+	// until retiredDerpTimer fires. See retireDerpLocked.
+	retiredDerp      map[*derphttp.Client]retiredDerp
+	retiredDerpTimer tstime.TimerController
+
+	// derpAlt is the second connection to the home DERP region, if
+	// Options.DERPDualHome is set and the region has several nodes.
+	derpAlt *derpAlt
 
 	// derpCleanupTimerArmed is whether derpCleanupTimer is
 	// scheduled to fire within derpCleanStaleInterval.
@@ -212,12 +325,13 @@ type Conn struct {
 
 	// periodicReSTUNTimer, when non-nil, is an AfterFunc timer
 	// that will call Conn.doPeriodicSTUN.
-	periodicReSTUNTimer *time.Timer
+	periodicReSTUNTimer tstime.TimerController
 
-	// blockEndpoints is whether to avoid capturing, storing and sending
-	// endpoints gathered from local interfaces or STUN. Only DERP endpoints
+	// blockEndpoints4 and blockEndpoints6 are whether to avoid capturing,
+	// storing and sending IPv4 and IPv6 endpoints, respectively, gathered
+	// from local interfaces or STUN. With both set, only DERP endpoints
 	// will be sent.
-	blockEndpoints bool
+	blockEndpoints4, blockEndpoints6 bool
 	// endpointsUpdateActive indicates that updateEndpoints is
 	// currently running. It's used to deduplicate concurrent endpoint
 	// update requests.
@@ -226,7 +340,8 @@ type Conn struct {
 	// update should begin immediately after the currently-running one
 	// completes. It can only be non-empty if
 	// endpointsUpdateActive==true.
-	wantEndpointsUpdate string // true if non-empty; string is reason
+	wantEndpointsUpdate string       // true if non-empty; string is reason
+	wantEndpointsScope  RefreshScope // scope of wantEndpointsUpdate
 	// lastEndpoints records the endpoints found during the previous
 	// endpoint discovery. It's used to avoid duplicate endpoint
 	// change notifications.
@@ -272,6 +387,17 @@ type Conn struct {
 	// magicsock could do with any complexity reduction it can get.
 	netInfoLast *tailcfg.NetInfo
 
+	// captivePortalURL is the URL a captive portal redirected the
+	// last full netcheck to, or empty.
+	captivePortalURL string
+
+	// lastNetCheckTime is when the last netcheck completed, or zero.
+	lastNetCheckTime time.Time
+
+	// derpConnected is the set of DERP regions whose connection is
+	// up, as of the last message or error read from it.
+	derpConnected set.Set[int]
+
 	derpMap     *tailcfg.DERPMap // nil (or zero regions/nodes) means DERP is disabled
 	netMap      *netmap.NetworkMap
 	privateKey  key.NodePrivate    // WireGuard private key for this node
@@ -290,6 +416,19 @@ type Conn struct {
 	// creating a new DERP connection back to their home.
 	derpRoute map[key.NodePublic]derpRoute
 
+	// derpCoalesced maps DERP regions to the connections of other
+	// regions whose servers said they also serve them, to use instead of
+	// connections of their own. See noteDERPRegionsServed.
+	derpCoalesced map[int]derpCoalesce
+
+	// peerKeepalive is the heartbeat interval of peers set by
+	// SetPeerKeepaliveInterval, including ones not yet known.
+	peerKeepalive map[key.NodePublic]time.Duration
+
+	// selfTestPings are the disco pings SelfTest sent to c's own
+	// endpoints and is waiting for, closing each chan on receipt.
+	selfTestPings map[stun.TxID]chan struct{}
+
 	// peerLastDerp tracks which DERP node we last used to speak with a
 	// peer. It's only used to quiet logging, so we only log on change.
 	peerLastDerp map[key.NodePublic]int
@@ -298,6 +437,43 @@ type Conn struct {
 	// connection is forced to use WebSockets.
 	derpForcedWebsocketFunc func(region int, reason string)
 
+	// pathLearnedFunc, if non-nil, is called when a peer's UDP path
+	// is confirmed. See SetPathLearnedCallback.
+	pathLearnedFunc func(key.NodePublic, netip.AddrPort)
+
+	// learnedPaths are the paths to peers from previous sessions not
+	// yet tried. See SetLearnedPaths.
+	learnedPaths map[key.NodePublic]netip.AddrPort
+
+	// derpRetryFunc, if non-nil, is called when a DERP connection
+	// fails and is about to be retried. See SetDERPRetryCallback.
+	derpRetryFunc func(region, attempt int, err error)
+
+	// derpStateFunc, if non-nil, is called on each transition of a
+	// DERP connection. See SetDERPStateCallback.
+	derpStateFunc func(DERPStateEvent)
+
+	// logSampler limits the log lines of high-frequency events. See
+	// Options.LogSamplesPerMinute.
+	logSampler logSampler
+
+	// discoPings maps the TxIDs of outstanding disco pings to the
+	// endpoints that sent them.
+	discoPings discoPingOwners
+
+	// pinnedDERP is the home DERP region set by SetPreferredDERPRegion,
+	// or zero. If pinnedDERPSticky, it's the home whatever netcheck
+	// says; otherwise it's only preferred over netcheck's choice.
+	pinnedDERP       int
+	pinnedDERPSticky bool
+	// derpHomeHeldFunc, if non-nil, is called when a sticky pinnedDERP
+	// keeps the home from moving. See SetDERPHomeHeldCallback.
+	derpHomeHeldFunc func(home, wanted int)
+	// derpHomeHeldWant is the region netcheck last wanted as home,
+	// while held on pinnedDERP, so derpHomeHeldFunc is only called
+	// when it changes.
+	derpHomeHeldWant int
+
 	// wgPinger is the WireGuard only pinger used for latency measurements.
 	wgPinger lazy.SyncValue[*ping.Pinger]
 }
@@ -313,6 +489,53 @@ func (c *Conn) SetDebugLoggingEnabled(v bool) {
 	c.debugLogging.Store(v)
 }
 
+// now returns the current time according to c's clock.
+func (c *Conn) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
+}
+
+// monoNow returns the current monotonic time according to c's clock.
+func (c *Conn) monoNow() mono.Time {
+	if c.clock == nil {
+		return mono.Now()
+	}
+	return mono.FromWall(c.clock.Now())
+}
+
+// nowStamp returns a mono.Stamp of the current instant according to c's
+// clock.
+func (c *Conn) nowStamp() mono.Stamp {
+	if c.clock == nil {
+		return mono.NowStamp()
+	}
+	now := c.clock.Now()
+	return mono.Stamp{Mono: mono.FromWall(now), Wall: now.Round(0)}
+}
+
+// afterFunc is like time.AfterFunc, but uses c's clock.
+//
+// Like time.AfterFunc, f runs in its own goroutine. Simulated clocks like
+// tstest.Clock may call their AfterFunc funcs synchronously with their
+// lock held, and f would deadlock if it read the time.
+func (c *Conn) afterFunc(d time.Duration, f func()) tstime.TimerController {
+	if c.clock == nil {
+		return time.AfterFunc(d, f)
+	}
+	return c.clock.AfterFunc(d, func() { go f() })
+}
+
+// newTimer is like time.NewTimer, but uses c's clock.
+func (c *Conn) newTimer(d time.Duration) (tstime.TimerController, <-chan time.Time) {
+	if c.clock == nil {
+		t := time.NewTimer(d)
+		return t, t.C
+	}
+	return c.clock.NewTimer(d)
+}
+
 // dlogf logs a debug message if debug logging is enabled via SetDebugLoggingEnabled.
 func (c *Conn) dlogf(format string, a ...any) {
 	if c.debugLogging.Load() {
@@ -323,7 +546,7 @@ func (c *Conn) dlogf(format string, a ...any) {
 // Options contains options for Listen.
 type Options struct {
 	// Logf optionally provides a log function to use.
-	// Must not be nil.
+	// Must not be nil, unless LogHandler is set.
 	Logf logger.Logf
 
 	// Port is the port to listen on.
@@ -341,6 +564,14 @@ type Options struct {
 	// setting can be toggled at runtime.
 	BlockEndpoints bool
 
+	// BlockEndpointsV4 and BlockEndpointsV6 are like BlockEndpoints, but
+	// only for the IPv4 or IPv6 endpoints, such as on networks where
+	// only IPv6 (ULA) endpoints may be exchanged while IPv4 must stay
+	// relayed. They can be changed later with Conn.SetBlockEndpointsV4
+	// and Conn.SetBlockEndpointsV6.
+	BlockEndpointsV4 bool
+	BlockEndpointsV6 bool
+
 	// DERPActiveFunc optionally provides a func to be called when
 	// a connection is made to a DERP server.
 	DERPActiveFunc func()
@@ -353,6 +584,10 @@ type Options struct {
 	// Only used by tests.
 	TestOnlyPacketListener nettype.PacketListener
 
+	// TestOnlyPathImpairments enables Conn.SetPathImpairmentForTest.
+	// Only used by tests.
+	TestOnlyPathImpairments bool
+
 	// NoteRecvActivity, if provided, is a func for magicsock to call
 	// whenever it receives a packet from a a peer if it's been more
 	// than ~10 seconds since the last one. (10 seconds is somewhat
@@ -365,14 +600,243 @@ type Options struct {
 	// not hold Conn.mu while calling it.
 	NoteRecvActivity func(key.NodePublic)
 
+	// PathKeepaliveFunc optionally provides a func to be called, in its
+	// own goroutine, when whether the path used to send to a peer wants
+	// WireGuard persistent keepalives changes, as reported by
+	// Conn.PathWantsKeepalive. Only a direct path through a NAT does; a
+	// DERP path's relay connection is already kept up. The embedder can
+	// use it to configure keepalives only while they're useful.
+	PathKeepaliveFunc func(key.NodePublic)
+
 	// NetMon is the network monitor to use.
 	// With one, the portmapper won't be used.
 	NetMon *netmon.Monitor
+
+	// AutoRebind, if true, makes the Conn respond to the network changes
+	// reported by NetMon itself, as wgengine does: a major change, such
+	// as to the default route or interface addresses, rebinds its
+	// sockets and refreshes all its endpoints, and a minor one only
+	// checks its public addresses. Embedders that handle NetMon changes
+	// themselves, like wgengine, leave it false. It requires NetMon.
+	// See also Conn.SuppressAutoRebind.
+	AutoRebind bool
+
+	// AutoRebindDebounce is how long AutoRebind waits for network
+	// changes to settle before acting on them all at once, so that a
+	// flapping interface doesn't cause a storm of rebinds. A steady
+	// stream of changes is acted on after five times as long. Zero
+	// means one second.
+	AutoRebindDebounce time.Duration
+
+	// Clock optionally specifies the clock to use for timekeeping
+	// (trust and heartbeat timeouts, endpoint expiry, timers and so
+	// on), so tests can control time. Nil means the real clock.
+	Clock tstime.Clock
+
+	// SilentDisco is whether to use silent disco for all peers: no
+	// periodic heartbeats, with disco pings only sent along with data.
+	// Keeping NAT mappings open is left to WireGuard's persistent
+	// keepalives; see netmap.KeepAliveAllPeers. It can also be enabled
+	// by the control plane, with tailcfg.Debug.EnableSilentDisco.
+	SilentDisco bool
+
+	// PathSelector optionally specifies how to choose between a peer's
+	// UDP paths. Nil means LatencyPathSelector.
+	PathSelector PathSelector
+
+	// DERPWriteQueueDepth optionally specifies how many writes may be
+	// queued for each DERP server before DERPDropPolicy applies.
+	// Zero means a default based on the platform and system memory.
+	DERPWriteQueueDepth int
+
+	// DERPDropPolicy is what to do with packets for a DERP server
+	// whose write queue is full. The zero value drops them.
+	DERPDropPolicy DERPDropPolicy
+
+	// DERPBlockTimeout is how long a send may wait for room in a DERP
+	// server's write queue when DERPDropPolicy is DERPBlock.
+	// Zero means 100ms.
+	DERPBlockTimeout time.Duration
+
+	// DERPDial optionally configures the timeouts and backoff used
+	// when connecting to DERP servers, such as to give up sooner on
+	// a proxy that stalls connections.
+	DERPDial DERPDialPolicy
+
+	// StaticEndpoints optionally specifies endpoints to always
+	// advertise, whatever STUN and port mapping find, such as a load
+	// balancer's port that's DNAT'd to this Conn's port. They have type
+	// tailcfg.EndpointExplicitConf. See also Conn.SetStaticEndpoints.
+	StaticEndpoints []netip.AddrPort
+
+	// PacketConns optionally specifies UDP sockets for the Conn to use
+	// rather than binding its own, such as sockets passed by systemd
+	// socket activation or opened by a privileged parent process.
+	PacketConns PacketConns
+
+	// LogHandler optionally receives the Conn's logs as leveled,
+	// structured records, rather than as lines logged to Logf. Records
+	// about a peer or path carry the attributes named by the LogKey
+	// constants, and verbose records are at LevelVerbose and
+	// LevelVerbose2. Lines the Conn and its subsystems still log in
+	// Logf form are converted to records, with their "[v1] " and
+	// "[v2] " prefixes converted to levels.
+	LogHandler slog.Handler
+
+	// DiscoObfuscation optionally configures the obfuscation of disco
+	// messages sent over UDP. It can be changed later with
+	// Conn.SetDiscoObfuscation.
+	DiscoObfuscation DiscoObfuscation
+
+	// SendPacing optionally paces the batches of packets sent over
+	// UDP. It can be changed later with Conn.SetSendPacing.
+	SendPacing SendPacing
+
+	// KeyRotationWindow optionally sets how long, after SetPrivateKey
+	// replaces a private key with another, DERP connections using the
+	// old key are kept open, alongside new ones using the new key. Peers
+	// still sending to the old node key via DERP then reach the Conn
+	// until the network map with the new key propagates, rather than all
+	// DERP connections being cut at once. Zero closes them immediately.
+	KeyRotationWindow time.Duration
+
+	// NetmapDiffFunc optionally provides a func to be called by
+	// SetNetworkMap with a summary of how the peers changed, if they
+	// did. It's called synchronously, without the Conn's lock held.
+	NetmapDiffFunc func(NetmapDiff)
+
+	// MultipathWindow optionally sets how long packets to a peer are
+	// also sent on its previous path after it changes. It can be
+	// changed later with Conn.SetMultipathWindow.
+	MultipathWindow time.Duration
+
+	// UDPIOBackend optionally selects an experimental implementation of
+	// batched UDP I/O, on Linux. The TS_DEBUG_UDP_IO_BACKEND
+	// environment variable overrides it.
+	UDPIOBackend UDPIOBackend
+
+	// ReusePort optionally has the Conn's UDP sockets join an
+	// SO_REUSEPORT group, so processes can share a port. It's ignored
+	// with PacketConns.
+	ReusePort ReusePort
+
+	// PeerPorts optionally exchanges packets with each peer over UDP
+	// sockets of its own, on ports from a configurable range, rather
+	// than the shared ones. It's ignored with PacketConns.
+	PeerPorts PeerPorts
+
+	// DisableIPv4 and DisableIPv6 optionally disable an address
+	// family: its UDP socket isn't bound, and its endpoints are
+	// neither advertised, probed by netcheck, nor pinged. At least
+	// one family should be left enabled. They can be changed later
+	// with Conn.SetDisableIPv4 and Conn.SetDisableIPv6.
+	DisableIPv4 bool
+	DisableIPv6 bool
+
+	// ReceiveBatchSize optionally sets the most packets read from a UDP
+	// socket at once, which is also the Conn's BatchSize for
+	// wireguard-go. Zero means the platform default: conn.IdealBatchSize
+	// where batched reads are supported, and 1 elsewhere. It's capped at
+	// maxReceiveBatchSize. How many packets are actually read at once is
+	// tuned at runtime, starting smaller and growing while reads keep
+	// filling their batch.
+	ReceiveBatchSize int
+
+	// PortPrediction optionally enables port prediction with peers
+	// when both the Conn and the peer are behind NATs whose mapping
+	// varies by destination, which CallMeMaybe can't traverse. Each
+	// attempt briefly opens a burst of UDP sockets to measure how the
+	// NAT allocates ports, and then pings dozens of predicted ports, so
+	// it's off by default.
+	PortPrediction bool
+
+	// DiscoPrivateKey optionally sets the Conn's disco private key.
+	// Zero means a new random key. Peers discard the path state they
+	// learned for a disco key when it changes, so an embedder that
+	// persists the key and passes it back on restart lets them resume
+	// with their known paths instead of discovering them again.
+	DiscoPrivateKey key.DiscoPrivate
+
+	// DERPDualHome optionally keeps a second connection to the home
+	// DERP region, when it has more than one node, preferring a
+	// different node than the main connection. Disco messages sent via
+	// the home region are sent on both, so that a failed node doesn't
+	// hold up path negotiation until the main connection reconnects.
+	// Data packets only use the main connection.
+	DERPDualHome bool
+
+	// PreferFasterDERP optionally sends to peers via DERP rather than
+	// their direct path when the round-trip time via DERP, measured
+	// every 30 seconds, is meaningfully lower, such as when the DERP
+	// servers are colocated with the peers. The direct path is still
+	// pinged, and used again once it's no longer slower. It can be
+	// changed later with SetPreferFasterDERP.
+	PreferFasterDERP bool
+
+	// LANDiscovery optionally enables discovery of peers on the same
+	// LAN. The Conn multicasts an announcement of its node key, disco
+	// key and UDP port on its LAN interfaces every 30 seconds, and adds
+	// the source of a netmap peer's announcement as a candidate
+	// endpoint of that peer, to be confirmed by disco pings like any
+	// other. It's IPv4 only.
+	LANDiscovery bool
+
+	// NetcheckConcurrency optionally limits how many DERP regions a
+	// netcheck probes at once. Zero means no limit.
+	NetcheckConcurrency int
+
+	// NetcheckBudget optionally specifies how long a netcheck may take,
+	// instead of 2 seconds. Whatever regions it measured by then are
+	// used, so a slow link that never completes a full report still
+	// gets the latencies it could measure, and keeps its home DERP
+	// region if there wasn't time to measure it.
+	NetcheckBudget time.Duration
+
+	// LogSamplesPerMinute optionally limits how many lines a minute
+	// are logged for each class of high-frequency event, such as
+	// failures to send disco or DERP packets. Lines over the limit are
+	// counted, and summarized before the class's next logged line.
+	// Zero means 10; negative means no limit.
+	LogSamplesPerMinute int
+
+	// DisableRawDisco is whether not to start the raw socket disco
+	// receivers on Linux, where disco packets are otherwise read with a
+	// BPF filter, so they're received even if a firewall drops them
+	// before the UDP sockets. See Conn.SetRawDiscoEnabled.
+	DisableRawDisco bool
+}
+
+// PacketConns are UDP sockets opened by the embedder for a Conn to use.
+// See Options.PacketConns.
+//
+// If either is set, the Conn binds no sockets of its own: it keeps
+// using these across rebinds, ignores Options.Port and SetPreferredPort,
+// and leaves a family without a socket unbound. The Conn takes ownership
+// of them and closes them when it's closed.
+//
+// Their LocalAddr methods must return a *net.UDPAddr, as *net.UDPConn's
+// do.
+type PacketConns struct {
+	UDP4 nettype.PacketConn // IPv4 socket, or nil
+	UDP6 nettype.PacketConn // IPv6 socket, or nil
+}
+
+// isZero reports whether pc has no sockets.
+func (pc PacketConns) isZero() bool {
+	return pc.UDP4 == nil && pc.UDP6 == nil
+}
+
+// forNetwork returns pc's socket for network, "udp4" or "udp6".
+func (pc PacketConns) forNetwork(network string) nettype.PacketConn {
+	if network == "udp6" {
+		return pc.UDP6
+	}
+	return pc.UDP4
 }
 
 func (o *Options) logf() logger.Logf {
 	if o.Logf == nil {
-		panic("must provide magicsock.Options.logf")
+		panic("must provide magicsock.Options.Logf or LogHandler")
 	}
 	return o.Logf
 }
@@ -384,6 +848,17 @@ func (o *Options) endpointsFunc() func([]tailcfg.Endpoint) {
 	return o.EndpointsFunc
 }
 
+// defaultNetcheckBudget is how long a netcheck may take without
+// Options.NetcheckBudget.
+const defaultNetcheckBudget = 2 * time.Second
+
+func (o *Options) netcheckBudget() time.Duration {
+	if o == nil || o.NetcheckBudget <= 0 {
+		return defaultNetcheckBudget
+	}
+	return o.NetcheckBudget
+}
+
 func (o *Options) derpActiveFunc() func() {
 	if o == nil || o.DERPActiveFunc == nil {
 		return func() {}
@@ -396,16 +871,17 @@ func (o *Options) derpActiveFunc() func() {
 func newConn() *Conn {
 	discoPrivate := key.NewDisco()
 	c := &Conn{
-		derpRecvCh:   make(chan derpReadResult, 1), // must be buffered, see issue 3736
-		derpStarted:  make(chan struct{}),
-		peerLastDerp: make(map[key.NodePublic]int),
-		peerMap:      newPeerMap(),
-		discoInfo:    make(map[key.DiscoPublic]*discoInfo),
-		discoPrivate: discoPrivate,
-		discoPublic:  discoPrivate.Public(),
+		derpRecvCh:     make(chan derpReadResult, 1), // must be buffered, see issue 3736
+		derpStarted:    make(chan struct{}),
+		peerLastDerp:   make(map[key.NodePublic]int),
+		discoInfo:      make(map[key.DiscoPublic]*discoInfo),
+		discoRecvLimit: newDiscoRecvLimiter(discoRecvRate, discoRecvBurst),
+		discoPrivate:   discoPrivate,
+		discoPublic:    discoPrivate.Public(),
 	}
 	c.discoShort = c.discoPublic.ShortString()
 	c.bind = &connBind{Conn: c, closed: true}
+	c.batchSize = defaultBatchSize()
 	c.receiveBatchPool = sync.Pool{New: func() any {
 		msgs := make([]ipv6.Message, c.bind.BatchSize())
 		for i := range msgs {
@@ -419,6 +895,8 @@ func newConn() *Conn {
 	}}
 	c.muCond = sync.NewCond(&c.mu)
 	c.networkUp.Store(true) // assume up until told otherwise
+	c.connCtx, c.connCtxCancel = context.WithCancel(context.Background())
+	c.donec = c.connCtx.Done()
 	return c
 }
 
@@ -427,34 +905,91 @@ func newConn() *Conn {
 // callback opts.EndpointsFunc is called.
 func NewConn(opts Options) (*Conn, error) {
 	c := newConn()
+	if k := opts.DiscoPrivateKey; !k.IsZero() {
+		c.discoPrivate = k
+		c.discoPublic = k.Public()
+		c.discoShort = c.discoPublic.ShortString()
+	}
 	c.port.Store(uint32(opts.Port))
-	c.logf = opts.logf()
+	c.slogger, c.logf = opts.newLogger()
 	c.epFunc = opts.endpointsFunc()
 	c.derpActiveFunc = opts.derpActiveFunc()
-	c.blockEndpoints = opts.BlockEndpoints
+	c.blockEndpoints4 = opts.BlockEndpoints || opts.BlockEndpointsV4
+	c.blockEndpoints6 = opts.BlockEndpoints || opts.BlockEndpointsV6
 	c.idleFunc = opts.IdleFunc
 	c.testOnlyPacketListener = opts.TestOnlyPacketListener
+	c.testOnlyPathImpairments = opts.TestOnlyPathImpairments
+	c.netmapDiffFunc = opts.NetmapDiffFunc
 	c.noteRecvActivity = opts.NoteRecvActivity
+	c.pathKeepaliveFunc = opts.PathKeepaliveFunc
 	c.portMapper = portmapper.NewClient(logger.WithPrefix(c.logf, "portmapper: "), opts.NetMon, nil, c.onPortMapChanged)
 	if opts.NetMon != nil {
 		c.portMapper.SetGatewayLookupFunc(opts.NetMon.GatewayAndSelfIP)
 	}
 	c.netMon = opts.NetMon
+	c.clock = opts.Clock
+	c.silentDisco = opts.SilentDisco
+	c.pathSelector = opts.PathSelector
+	c.derpWriteQueueDepth = opts.DERPWriteQueueDepth
+	c.derpDropPolicy = opts.DERPDropPolicy
+	c.derpBlockTimeout = opts.DERPBlockTimeout
+	c.derpDial = opts.DERPDial
+	c.packetConns = opts.PacketConns
+	c.discoObfuscator.Store(newDiscoObfuscator(opts.DiscoObfuscation))
+	c.sendPacing.Store(opts.SendPacing)
+	c.SetMultipathWindow(opts.MultipathWindow)
+	c.keyRotationWindow = opts.KeyRotationWindow
+	c.reusePort = opts.ReusePort
+	c.reusePortBPF.Store(opts.ReusePort.BPFProgFD)
+	if opts.PeerPorts.Enabled {
+		if err := opts.PeerPorts.checkRange(); err != nil {
+			return nil, err
+		}
+		c.peerPorts = opts.PeerPorts
+		c.peerPortRecvCh = make(chan peerPortReadResult, 1)
+	}
+	c.disableIPv4.Store(opts.DisableIPv4)
+	c.disableIPv6.Store(opts.DisableIPv6)
+	c.noV4.Store(opts.DisableIPv4)
+	c.noV6.Store(opts.DisableIPv6)
+	c.portPrediction = opts.PortPrediction
+	c.derpDualHome = opts.DERPDualHome
+	c.preferFasterDERP.Store(opts.PreferFasterDERP)
+	c.lanDiscovery = opts.LANDiscovery
+	c.logSampler.limit = opts.LogSamplesPerMinute
+	if opts.ReceiveBatchSize > 0 {
+		c.batchSize = min(opts.ReceiveBatchSize, maxReceiveBatchSize)
+	}
+	for _, ruc := range []*RebindingUDPConn{&c.pconn4, &c.pconn6} {
+		ruc.ioBackend = udpIOBackend(opts.UDPIOBackend)
+		ruc.logf = c.logf
+	}
+	c.staticEndpoints.Store(views.SliceOf(slices.Clone(opts.StaticEndpoints)))
 
 	if err := c.rebind(keepCurrentPort); err != nil {
 		return nil, err
 	}
 
-	c.connCtx, c.connCtxCancel = context.WithCancel(context.Background())
-	c.donec = c.connCtx.Done()
 	c.netChecker = &netcheck.Client{
-		Logf:                logger.WithPrefix(c.logf, "netcheck: "),
-		NetMon:              c.netMon,
-		GetSTUNConn4:        func() netcheck.STUNConn { return &c.pconn4 },
-		GetSTUNConn6:        func() netcheck.STUNConn { return &c.pconn6 },
+		Logf:   logger.WithPrefix(c.logf, "netcheck: "),
+		NetMon: c.netMon,
+		GetSTUNConn4: func() netcheck.STUNConn {
+			if c.disableIPv4.Load() {
+				return nil
+			}
+			return &c.pconn4
+		},
+		GetSTUNConn6: func() netcheck.STUNConn {
+			if c.disableIPv6.Load() {
+				return nil
+			}
+			return &c.pconn6
+		},
 		SkipExternalNetwork: inTest(),
 		PortMapper:          c.portMapper,
 		UseDNSCache:         true,
+		MaxConcurrentProbes: opts.NetcheckConcurrency,
+		ProbeBudget:         opts.netcheckBudget(),
 		GetDERPHeaders: func() http.Header {
 			h := c.derpHeader.Load()
 			if h == nil {
@@ -466,17 +1001,20 @@ func NewConn(opts Options) (*Conn, error) {
 
 	c.ignoreSTUNPackets()
 
-	if d4, err := c.listenRawDisco("ip4"); err == nil {
-		c.logf("[v1] using BPF disco receiver for IPv4")
-		c.closeDisco4 = d4
-	} else {
-		c.logf("[v1] couldn't create raw v4 disco listener, using regular listener instead: %v", err)
+	if c.lanDiscovery {
+		go c.runLANDiscovery(c.connCtx)
 	}
-	if d6, err := c.listenRawDisco("ip6"); err == nil {
-		c.logf("[v1] using BPF disco receiver for IPv6")
-		c.closeDisco6 = d6
-	} else {
-		c.logf("[v1] couldn't create raw v6 disco listener, using regular listener instead: %v", err)
+
+	c.rawDiscoMu.Lock()
+	c.rawDiscoDisabled = opts.DisableRawDisco
+	if !c.rawDiscoDisabled {
+		c.startRawDiscoLocked()
+	}
+	c.rawDiscoMu.Unlock()
+
+	if opts.AutoRebind && c.netMon != nil {
+		c.autoRebind = newAutoRebind(c, opts.AutoRebindDebounce)
+		c.netMonUnregister = c.netMon.RegisterChangeCallback(c.autoRebind.onChange)
 	}
 
 	c.logf("magicsock: disco key = %v", c.discoShort)
@@ -498,7 +1036,7 @@ func (c *Conn) ignoreSTUNPackets() {
 
 // doPeriodicSTUN is called (in a new goroutine) by
 // periodicReSTUNTimer when periodic STUNs are active.
-func (c *Conn) doPeriodicSTUN() { c.ReSTUN("periodic") }
+func (c *Conn) doPeriodicSTUN() { c.RefreshEndpoints(RefreshFull, "periodic") }
 
 func (c *Conn) stopPeriodicReSTUNTimerLocked() {
 	if t := c.periodicReSTUNTimer; t != nil {
@@ -508,16 +1046,16 @@ func (c *Conn) stopPeriodicReSTUNTimerLocked() {
 }
 
 // c.mu must NOT be held.
-func (c *Conn) updateEndpoints(why string) {
+func (c *Conn) updateEndpoints(scope RefreshScope, why string) {
 	metricUpdateEndpoints.Add(1)
 	defer func() {
 		c.mu.Lock()
 		defer c.mu.Unlock()
-		why := c.wantEndpointsUpdate
+		why, scope := c.wantEndpointsUpdate, c.wantEndpointsScope
 		c.wantEndpointsUpdate = ""
 		if !c.closed {
 			if why != "" {
-				go c.updateEndpoints(why)
+				go c.updateEndpoints(scope, why)
 				return
 			}
 			if c.shouldDoPeriodicReSTUNLocked() {
@@ -535,7 +1073,7 @@ func (c *Conn) updateEndpoints(why string) {
 					if debugReSTUNStopOnIdle() {
 						c.logf("scheduling periodicSTUN to run in %v", d)
 					}
-					c.periodicReSTUNTimer = time.AfterFunc(d, c.doPeriodicSTUN)
+					c.periodicReSTUNTimer = c.afterFunc(d, c.doPeriodicSTUN)
 				}
 			} else {
 				if debugReSTUNStopOnIdle() {
@@ -547,7 +1085,7 @@ func (c *Conn) updateEndpoints(why string) {
 		c.endpointsUpdateActive = false
 		c.muCond.Broadcast()
 	}()
-	c.dlogf("[v1] magicsock: starting endpoint update (%s)", why)
+	c.dlogf("[v1] magicsock: starting endpoint update (%s, %v)", why, scope)
 	if c.noV4Send.Load() && c.shouldRebindOnFailedNetcheckV4Send() && runtime.GOOS != "js" {
 		c.mu.Lock()
 		closed := c.closed
@@ -558,7 +1096,9 @@ func (c *Conn) updateEndpoints(why string) {
 		}
 	}
 
-	endpoints, err := c.determineEndpoints(c.connCtx)
+	start := mono.Now()
+	endpoints, err := c.determineEndpoints(c.connCtx, scope)
+	histEndpointUpdate.Observe(mono.Since(start).Seconds())
 	if err != nil {
 		c.logf("magicsock: endpoint update (%s) failed: %v", why, err)
 		// TODO(crawshaw): are there any conditions under which
@@ -576,12 +1116,27 @@ func (c *Conn) updateEndpoints(why string) {
 func (c *Conn) shouldRebindOnFailedNetcheckV4Send() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.derpMap != nil && c.derpMap.HasSTUN() && !c.blockEndpoints
+	return c.derpMap != nil && c.derpMap.HasSTUN() && !c.blockEndpoints4
 }
 
 // setEndpoints records the new endpoints, reporting whether they're changed.
 // It takes ownership of the slice.
 func (c *Conn) setEndpoints(endpoints []tailcfg.Endpoint) (changed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.blockEndpoints4 || c.blockEndpoints6 {
+		kept := []tailcfg.Endpoint{}
+		for _, ep := range endpoints {
+			ip := ep.Addr.Addr().Unmap()
+			if ip.Is4() && c.blockEndpoints4 || ip.Is6() && c.blockEndpoints6 {
+				continue
+			}
+			kept = append(kept, ep)
+		}
+		endpoints = kept
+	}
+
 	anySTUN := false
 	for _, ep := range endpoints {
 		if ep.Type == tailcfg.EndpointSTUN {
@@ -589,14 +1144,6 @@ func (c *Conn) setEndpoints(endpoints []tailcfg.Endpoint) (changed bool) {
 		}
 	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if c.blockEndpoints {
-		anySTUN = false
-		endpoints = []tailcfg.Endpoint{}
-	}
-
 	if !anySTUN && c.derpMap == nil && !inTest() {
 		// Don't bother storing or reporting this yet. We
 		// don't have a DERP map or any STUN entries, so we're
@@ -611,7 +1158,8 @@ func (c *Conn) setEndpoints(endpoints []tailcfg.Endpoint) (changed bool) {
 		return false
 	}
 
-	c.lastEndpointsTime = time.Now()
+	c.lastEndpointsTime = c.now()
+	c.healthWatchers.poke()
 	for de, fn := range c.onEndpointRefreshed {
 		go fn()
 		delete(c.onEndpointRefreshed, de)
@@ -650,7 +1198,9 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 		return new(netcheck.Report), nil
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	c.startProvisionalDERPHome()
+
+	ctx, cancel := context.WithTimeout(ctx, c.netChecker.ProbeBudget)
 	defer cancel()
 
 	c.stunReceiveFunc.Store(c.netChecker.ReceiveSTUNPacket)
@@ -662,8 +1212,8 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 	}
 
 	c.lastNetCheckReport.Store(report)
-	c.noV4.Store(!report.IPv4)
-	c.noV6.Store(!report.IPv6)
+	c.noV4.Store(!report.IPv4 || c.disableIPv4.Load())
+	c.noV6.Store(!report.IPv6 || c.disableIPv6.Load())
 	c.noV4Send.Store(!report.IPv4CanSend)
 
 	ni := &tailcfg.NetInfo{
@@ -682,11 +1232,26 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 		ni.DERPLatency[fmt.Sprintf("%d-v6", rid)] = d.Seconds()
 	}
 
-	ni.WorkingIPv6.Set(report.IPv6)
+	ni.WorkingIPv6.Set(report.IPv6 && !c.disableIPv6.Load())
 	ni.OSHasIPv6.Set(report.OSHasIPv6)
 	ni.WorkingUDP.Set(report.UDP)
 	ni.WorkingICMPv4.Set(report.ICMPv4)
-	ni.PreferredDERP = report.PreferredDERP
+	ni.PreferredDERP = c.applyPinnedDERP(report)
+
+	// Only full reports check for a captive portal; keep the last
+	// result until the next one.
+	c.mu.Lock()
+	if found, ok := report.CaptivePortal.Get(); ok {
+		c.captivePortalURL = ""
+		if found {
+			c.captivePortalURL = report.CaptivePortalURL
+		}
+		health.SetCaptivePortal(found, c.captivePortalURL)
+	}
+	ni.CaptivePortalURL = c.captivePortalURL
+	c.lastNetCheckTime = c.now()
+	c.mu.Unlock()
+	c.healthWatchers.poke()
 
 	if ni.PreferredDERP == 0 {
 		// Perhaps UDP is blocked. Pick a deterministic but arbitrary
@@ -776,7 +1341,7 @@ func (c *Conn) LastRecvActivityOfNodeKey(nk key.NodePublic) string {
 	if saw == 0 {
 		return "never"
 	}
-	return mono.Since(saw).Round(time.Second).String()
+	return c.monoNow().Sub(saw).Round(time.Second).String()
 }
 
 // Ping handles a "tailscale ping" CLI query.
@@ -808,8 +1373,11 @@ func (c *Conn) Ping(peer *tailcfg.Node, res *ipnstate.PingResult, cb func(*ipnst
 }
 
 // c.mu must be held
-func (c *Conn) populateCLIPingResponseLocked(res *ipnstate.PingResult, latency time.Duration, ep netip.AddrPort) {
+func (c *Conn) populateCLIPingResponseLocked(res *ipnstate.PingResult, latency time.Duration, ep netip.AddrPort, q *pathQuality, now mono.Time) {
 	res.LatencySeconds = latency.Seconds()
+	res.SmoothedRTTSeconds = q.srtt.Seconds()
+	res.JitterSeconds = q.jitter.Seconds()
+	res.PathChanges = q.pathChanges(now)
 	if ep.Addr() != tailcfg.DerpMagicIPAddr {
 		res.Endpoint = ep.String()
 		return
@@ -838,48 +1406,204 @@ func (c *Conn) GetEndpointChanges(peer *tailcfg.Node) ([]EndpointChange, error)
 	return ep.debugUpdates.GetAll(), nil
 }
 
+// SetPeerGSOSegments caps the number of datagrams to the peer with node key
+// nk that are coalesced into a single UDP GSO send. Zero restores the
+// default (the platform maximum) and one disables coalescing for the peer,
+// which is useful for destinations behind middleboxes that mishandle large
+// GSO bursts. Coalescing for other peers is unaffected.
+func (c *Conn) SetPeerGSOSegments(nk key.NodePublic, n int) error {
+	if n < 0 {
+		return fmt.Errorf("invalid GSO segment count %d", n)
+	}
+	c.mu.Lock()
+	de, ok := c.peerMap.endpointForNodeKey(nk)
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown peer")
+	}
+	de.setMaxGSOSegments(n)
+	return nil
+}
+
+// PortMapStatus returns c's current NAT port mapping, made with UPnP,
+// NAT-PMP or PCP, if any. The mapping may have expired, if it couldn't
+// be renewed.
+func (c *Conn) PortMapStatus() (ms portmapper.MappingStatus, ok bool) {
+	return c.portMapper.Mapping()
+}
+
+// RequestPortMap asks the NAT for a port mapping to c's port now, rather
+// than waiting for one to be wanted or due for renewal, and returns its
+// external address. If port is non-zero, it's asked for as the external
+// port, though the NAT needn't honor it. On success, c's endpoints are
+// re-advertised.
+func (c *Conn) RequestPortMap(ctx context.Context, port uint16) (netip.AddrPort, error) {
+	return c.portMapper.RequestMapping(ctx, port)
+}
+
+// SetStaticEndpoints replaces the endpoints always advertised, set
+// initially by Options.StaticEndpoints, and re-advertises c's endpoints
+// if they changed.
+func (c *Conn) SetStaticEndpoints(eps []netip.AddrPort) {
+	old := c.staticEndpoints.Swap(views.SliceOf(slices.Clone(eps)))
+	if views.SliceEqualAnyOrder(old, views.SliceOf(eps)) {
+		return
+	}
+	c.RefreshEndpoints(RefreshPortmap, "static-endpoint-change")
+}
+
+// SetPeerKeepaliveInterval sets how often disco pings are sent to keep
+// the path to the peer with node key nk alive while traffic is flowing,
+// overriding the default of every 3 seconds. A d of zero or less restores
+// the default. It may be called before the peer is known.
+//
+// An interval longer than a few seconds lets trust in the peer's UDP path
+// lapse between pings, so sends to it go via DERP too until the next pong.
+// It suits peers that are mostly idle.
+func (c *Conn) SetPeerKeepaliveInterval(nk key.NodePublic, d time.Duration) {
+	d = max(d, 0)
+	c.mu.Lock()
+	if d == 0 {
+		delete(c.peerKeepalive, nk)
+	} else {
+		mak.Set(&c.peerKeepalive, nk, d)
+	}
+	de, ok := c.peerMap.endpointForNodeKey(nk)
+	c.mu.Unlock()
+	if ok {
+		de.setKeepaliveInterval(d)
+	}
+}
+
+// PeerGSOSegments reports the cap on coalesced datagrams per send for the
+// peer with node key nk, as set by SetPeerGSOSegments or by coalescing
+// being disabled after repeated send failures. It reports false if the
+// peer is unknown.
+func (c *Conn) PeerGSOSegments(nk key.NodePublic) (n int, ok bool) {
+	c.mu.Lock()
+	de, ok := c.peerMap.endpointForNodeKey(nk)
+	c.mu.Unlock()
+	if !ok {
+		return 0, false
+	}
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	return de.maxGSOSegments, true
+}
+
 // DiscoPublicKey returns the discovery public key.
 func (c *Conn) DiscoPublicKey() key.DiscoPublic {
 	return c.discoPublic
 }
 
-// SetBlockEndpoints sets the blockEndpoints field. If changed, endpoints will
-// be updated to apply the new settings. Existing connections may continue to
-// use the old setting until they are reestablished. Disabling endpoints does
-// not affect the UDP socket or portmapper.
+// SetBlockEndpoints sets whether endpoints of both address families are
+// blocked. If changed, endpoints will be updated to apply the new settings.
+// Existing connections may continue to use the old setting until they are
+// reestablished. Disabling endpoints does not affect the UDP socket or
+// portmapper.
 func (c *Conn) SetBlockEndpoints(block bool) {
+	c.setBlockEndpoints("SetBlockEndpoints", &block, &block)
+}
+
+// SetBlockEndpointsV4 is like SetBlockEndpoints, but only for IPv4
+// endpoints, as with Options.BlockEndpointsV4.
+func (c *Conn) SetBlockEndpointsV4(block bool) {
+	c.setBlockEndpoints("SetBlockEndpointsV4", &block, nil)
+}
+
+// SetBlockEndpointsV6 is like SetBlockEndpoints, but only for IPv6
+// endpoints, as with Options.BlockEndpointsV6.
+func (c *Conn) SetBlockEndpointsV6(block bool) {
+	c.setBlockEndpoints("SetBlockEndpointsV6", nil, &block)
+}
+
+// setBlockEndpoints sets blockEndpoints4 and blockEndpoints6 to block4
+// and block6, leaving either alone if nil.
+func (c *Conn) setBlockEndpoints(why string, block4, block6 *bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	didChange := c.blockEndpoints != block
-	c.blockEndpoints = block
+	didChange := false
+	if block4 != nil && c.blockEndpoints4 != *block4 {
+		c.blockEndpoints4 = *block4
+		didChange = true
+	}
+	if block6 != nil && c.blockEndpoints6 != *block6 {
+		c.blockEndpoints6 = *block6
+		didChange = true
+	}
 	if !didChange {
 		return
 	}
 
-	const why = "SetBlockEndpoints"
 	if c.endpointsUpdateActive {
 		if c.wantEndpointsUpdate != why {
-			c.dlogf("[v1] magicsock: SetBlockEndpoints: endpoint update active, need another later")
-			c.wantEndpointsUpdate = why
+			c.dlogf("[v1] magicsock: %s: endpoint update active, need another later", why)
+		}
+		c.queueEndpointsUpdateLocked(RefreshFull, why)
+	} else {
+		c.endpointsUpdateActive = true
+		go c.updateEndpoints(RefreshFull, why)
+	}
+}
+
+// SetDisableIPv4 sets whether IPv4 is disabled, as with
+// Options.DisableIPv4. If changed, the IPv4 socket is closed or bound, and
+// endpoints are updated.
+func (c *Conn) SetDisableIPv4(disable bool) {
+	c.setFamilyDisabled("SetDisableIPv4", &c.disableIPv4, &c.noV4, &c.pconn4, "udp4", disable)
+}
+
+// SetDisableIPv6 is like SetDisableIPv4, for IPv6.
+func (c *Conn) SetDisableIPv6(disable bool) {
+	c.setFamilyDisabled("SetDisableIPv6", &c.disableIPv6, &c.noV6, &c.pconn6, "udp6", disable)
+}
+
+func (c *Conn) setFamilyDisabled(why string, disabled, noFamily *atomic.Bool, ruc *RebindingUDPConn, network string, disable bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || disabled.Swap(disable) == disable {
+		return
+	}
+	c.logf("magicsock: %s(%v)", why, disable)
+	// Until the next netcheck says otherwise, assume a re-enabled
+	// family works, so its endpoints are pinged.
+	noFamily.Store(disable)
+	if err := c.bindSocket(ruc, network, keepCurrentPort); err != nil {
+		c.logf("magicsock: %v", err)
+	}
+	c.rebindPeerPorts(network, keepCurrentPort)
+	c.portMapper.SetLocalPort(c.LocalPort())
+
+	if c.endpointsUpdateActive {
+		if c.wantEndpointsUpdate != why {
+			c.dlogf("[v1] magicsock: %s: endpoint update active, need another later", why)
 		}
+		c.queueEndpointsUpdateLocked(RefreshFull, why)
 	} else {
 		c.endpointsUpdateActive = true
-		go c.updateEndpoints(why)
+		go c.updateEndpoints(RefreshFull, why)
 	}
 }
 
 // determineEndpoints returns the machine's endpoint addresses. It
-// does a STUN lookup (via netcheck) to determine its public address.
+// does a STUN lookup (via netcheck, for RefreshFull) to determine its
+// public address, probing as much as scope says.
 //
 // c.mu must NOT be held.
-func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, error) {
+func (c *Conn) determineEndpoints(ctx context.Context, scope RefreshScope) ([]tailcfg.Endpoint, error) {
 	var havePortmap bool
 	var portmapExt netip.AddrPort
 	if runtime.GOOS != "js" {
 		portmapExt, havePortmap = c.portMapper.GetCachedMappingOrStartCreatingOne(ctx)
 	}
 
-	nr, err := c.updateNetInfo(ctx)
+	var nr *netcheck.Report
+	var err error
+	if scope == RefreshFull {
+		nr, err = c.updateNetInfo(ctx)
+	} else {
+		nr, err = c.refreshNetInfo(ctx, scope)
+	}
 	if err != nil {
 		c.logf("magicsock.Conn.determineEndpoints: updateNetInfo: %v", err)
 		return nil, err
@@ -908,6 +1632,9 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 		if !ipp.IsValid() || (debugOmitLocalAddresses() && et == tailcfg.EndpointLocal) {
 			return
 		}
+		if c.familyDisabled(ipp.Addr()) {
+			return
+		}
 		if _, ok := already[ipp]; !ok {
 			mak.Set(&already, ipp, et)
 			eps = append(eps, tailcfg.Endpoint{Addr: ipp, Type: et})
@@ -952,14 +1679,31 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 	// possible local endpoints since we determine them by looking at the
 	// set of addresses on our local interfaces.
 	//
-	// TODO(andrew): If we pull in any cached endpoints, we should probably
-	// do something to ensure we're propagating the removal of those cached
-	// endpoints if they do actually time out without being rediscovered.
-	// For now, though, rely on a minor LinkChange event causing this to
-	// re-run.
-	eps = c.endpointTracker.update(time.Now(), eps)
-
-	if localAddr := c.pconn4.LocalAddr(); localAddr.IP.IsUnspecified() {
+	// A cached endpoint that wasn't re-observed is kept so that a lost
+	// STUN response doesn't withdraw it, but if this update's probe for
+	// its kind of endpoint got an answer, just a different one, it's
+	// stale, typically from before a network change. Withdraw it now
+	// rather than advertising it until it expires.
+	if dead := c.endpointTracker.withdraw(eps, func(ep tailcfg.Endpoint) bool {
+		return probeContradicts(ep, nr, havePortmap)
+	}); len(dead) > 0 {
+		metricEndpointsWithdrawn.Add(int64(len(dead)))
+		c.logf("magicsock: withdrawing stale endpoints %v", dead)
+	}
+	eps = c.endpointTracker.update(c.now(), eps)
+
+	// Static endpoints are added after the cache update so that ones
+	// removed by SetStaticEndpoints stop being advertised immediately.
+	static := c.staticEndpoints.Load()
+	for i := 0; i < static.Len(); i++ {
+		addAddr(static.At(i), tailcfg.EndpointExplicitConf)
+	}
+
+	localAddr := c.pconn4.LocalAddr()
+	if c.disableIPv4.Load() {
+		localAddr = c.pconn6.LocalAddr()
+	}
+	if localAddr.IP.IsUnspecified() {
 		ips, loopback, err := interfaces.LocalAddresses()
 		if err != nil {
 			return nil, err
@@ -1035,9 +1779,21 @@ func (c *Conn) LocalPort() uint16 {
 		return 12345
 	}
 	laddr := c.pconn4.LocalAddr()
+	if c.disableIPv4.Load() {
+		laddr = c.pconn6.LocalAddr()
+	}
 	return uint16(laddr.Port)
 }
 
+// familyDisabled reports whether ip's address family is disabled by
+// Options.DisableIPv4 or Options.DisableIPv6.
+func (c *Conn) familyDisabled(ip netip.Addr) bool {
+	if ip.Is4() || ip.Is4In6() {
+		return c.disableIPv4.Load()
+	}
+	return c.disableIPv6.Load()
+}
+
 var errNetworkDown = errors.New("magicsock: network down")
 
 func (c *Conn) networkDown() bool { return !c.networkUp.Load() }
@@ -1052,7 +1808,29 @@ func (c *Conn) Send(buffs [][]byte, ep conn.Endpoint) error {
 		metricSendDataNetworkDown.Add(n)
 		return errNetworkDown
 	}
-	return ep.(*endpoint).send(buffs)
+	return ep.(*endpoint).send(context.Background(), buffs)
+}
+
+// SendWithContext is like Send, but for packets that matter more than
+// WireGuard data, such as an embedder's control messages. If they're sent
+// via DERP and the DERP server's write queue is full, it waits for room
+// until ctx is done, rather than dropping them per Options.DERPDropPolicy,
+// so they survive short congestion spikes. Unlike Send, it returns an
+// error if they were dropped.
+//
+// ctx should have a deadline: if it can't be canceled, SendWithContext
+// doesn't wait at all.
+func (c *Conn) SendWithContext(ctx context.Context, buffs [][]byte, ep conn.Endpoint) error {
+	n := int64(len(buffs))
+	metricSendData.Add(n)
+	if c.networkDown() {
+		metricSendDataNetworkDown.Add(n)
+		return errNetworkDown
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ep.(*endpoint).send(ctx, buffs)
 }
 
 var errConnClosed = errors.New("Conn closed")
@@ -1067,19 +1845,27 @@ func (c *Conn) Send(buffs [][]byte, ep conn.Endpoint) error {
 	_ ipv6.Message = ipv4.Message{}
 )
 
-func (c *Conn) sendUDPBatch(addr netip.AddrPort, buffs [][]byte) (sent bool, err error) {
-	isIPv6 := false
-	switch {
-	case addr.Addr().Is4():
-	case addr.Addr().Is6():
-		isIPv6 = true
-	default:
-		panic("bogus sendUDPBatch addr type")
+// sendUDPBatch sends buffs to addr, of peer if known. maxSegments caps the
+// number of datagrams coalesced into a single send; see
+// RebindingUDPConn.WriteBatchTo.
+func (c *Conn) sendUDPBatch(addr netip.AddrPort, peer key.NodePublic, buffs [][]byte, maxSegments int) (sent bool, err error) {
+	if c.pathImpairments.Load() != nil && c.impairedSend(addr, buffs, func(buffs [][]byte) { c.writeUDPBatch(addr, peer, buffs, maxSegments) }) {
+		return true, nil
 	}
-	if isIPv6 {
-		err = c.pconn6.WriteBatchTo(buffs, addr)
+	if p := c.sendPacing.Load(); p.Interval > 0 {
+		size := 0
+		for _, b := range buffs {
+			size += len(b)
+		}
+		if size > p.burstBytes() {
+			metricSendUDPBatchPaced.Add(1)
+			err = c.writeUDPBatchPaced(addr, peer, buffs, maxSegments, p)
+		} else {
+			metricSendUDPBatchImmediate.Add(1)
+			err = c.writeUDPBatch(addr, peer, buffs, maxSegments)
+		}
 	} else {
-		err = c.pconn4.WriteBatchTo(buffs, addr)
+		err = c.writeUDPBatch(addr, peer, buffs, maxSegments)
 	}
 	if err != nil {
 		var errGSO neterror.ErrUDPGSODisabled
@@ -1091,13 +1877,27 @@ func (c *Conn) sendUDPBatch(addr netip.AddrPort, buffs [][]byte) (sent bool, err
 	return err == nil, err
 }
 
-// sendUDP sends UDP packet b to ipp.
+// writeUDPBatch writes buffs to addr on the socket of addr's family, or
+// peer's own; see udpConnFor.
+func (c *Conn) writeUDPBatch(addr netip.AddrPort, peer key.NodePublic, buffs [][]byte, maxSegments int) error {
+	switch {
+	case addr.Addr().Is4(), addr.Addr().Is6():
+		return c.udpConnFor(addr, peer).WriteBatchTo(buffs, addr, maxSegments)
+	default:
+		panic("bogus sendUDPBatch addr type")
+	}
+}
+
+// sendUDP sends UDP packet b to ipp, of peer if known.
 // See sendAddr's docs on the return value meanings.
-func (c *Conn) sendUDP(ipp netip.AddrPort, b []byte) (sent bool, err error) {
+func (c *Conn) sendUDP(ipp netip.AddrPort, peer key.NodePublic, b []byte) (sent bool, err error) {
 	if runtime.GOOS == "js" {
 		return false, errNoUDP
 	}
-	sent, err = c.sendUDPStd(ipp, b)
+	if c.pathImpairments.Load() != nil && c.impairedSend(ipp, [][]byte{b}, func(buffs [][]byte) { c.sendUDPStd(ipp, peer, buffs[0]) }) {
+		return true, nil
+	}
+	sent, err = c.sendUDPStd(ipp, peer, b)
 	if err != nil {
 		metricSendUDPError.Add(1)
 	} else {
@@ -1108,17 +1908,17 @@ func (c *Conn) sendUDP(ipp netip.AddrPort, b []byte) (sent bool, err error) {
 	return
 }
 
-// sendUDP sends UDP packet b to addr.
+// sendUDP sends UDP packet b to addr, of peer if known.
 // See sendAddr's docs on the return value meanings.
-func (c *Conn) sendUDPStd(addr netip.AddrPort, b []byte) (sent bool, err error) {
+func (c *Conn) sendUDPStd(addr netip.AddrPort, peer key.NodePublic, b []byte) (sent bool, err error) {
 	switch {
 	case addr.Addr().Is4():
-		_, err = c.pconn4.WriteToUDPAddrPort(b, addr)
+		_, err = c.udpConnFor(addr, peer).WriteToUDPAddrPort(b, addr)
 		if err != nil && (c.noV4.Load() || neterror.TreatAsLostUDP(err)) {
 			return false, nil
 		}
 	case addr.Addr().Is6():
-		_, err = c.pconn6.WriteToUDPAddrPort(b, addr)
+		_, err = c.udpConnFor(addr, peer).WriteToUDPAddrPort(b, addr)
 		if err != nil && (c.noV6.Load() || neterror.TreatAsLostUDP(err)) {
 			return false, nil
 		}
@@ -1138,14 +1938,33 @@ func (c *Conn) sendUDPStd(addr netip.AddrPort, b []byte) (sent bool, err error)
 // An example of when they might be different: sending to an
 // IPv6 address when the local machine doesn't have IPv6 support
 // returns (false, nil); it's not an error, but nothing was sent.
-func (c *Conn) sendAddr(addr netip.AddrPort, pubKey key.NodePublic, b []byte) (sent bool, err error) {
+func (c *Conn) sendAddr(ctx context.Context, addr netip.AddrPort, pubKey key.NodePublic, b []byte) (sent bool, err error) {
 	if addr.Addr() != tailcfg.DerpMagicIPAddr {
-		return c.sendUDP(addr, b)
+		return c.sendUDP(addr, pubKey, b)
 	}
 
-	ch := c.derpWriteChanOfAddr(addr, pubKey)
+	return c.sendDERPBatch(ctx, addr, pubKey, [][]byte{b})
+}
+
+// sendDERPBatch sends buffs to pubKey via the DERP server addr, which must
+// be a fake UDP address representing a DERP server (see derpmap.go).
+//
+// All of buffs are queued to the DERP server's writer in one request, so
+// they're written to the DERP connection with a single flush. Like
+// sendAddr, it returns whether the packets went out at all and, if not,
+// whether that's an error. Either all of buffs are queued or none are. See
+// enqueueDerpWrite for how ctx is used if the queue is full.
+//
+// A disco message is queued on the server's disco lane, so it isn't
+// written behind queued data.
+func (c *Conn) sendDERPBatch(ctx context.Context, addr netip.AddrPort, pubKey key.NodePublic, buffs [][]byte) (sent bool, err error) {
+	lane := derpLaneData
+	if len(buffs) == 1 && disco.LooksLikeDiscoWrapper(buffs[0]) {
+		lane = derpLaneDisco
+	}
+	ch := c.derpWriteChanOfAddr(addr, pubKey, lane)
 	if ch == nil {
-		metricSendDERPErrorChan.Add(1)
+		metricSendDERPErrorChan.Add(int64(len(buffs)))
 		return false, nil
 	}
 
@@ -1154,21 +1973,19 @@ func (c *Conn) sendAddr(addr netip.AddrPort, pubKey key.NodePublic, b []byte) (s
 	// to derpWriteRequest and waited for derphttp.Client.Send to
 	// complete, but that's too slow while holding wireguard-go
 	// internal locks.
-	pkt := make([]byte, len(b))
-	copy(pkt, b)
+	pkts := make([][]byte, len(buffs))
+	for i, b := range buffs {
+		pkts[i] = bytes.Clone(b)
+	}
 
-	select {
-	case <-c.donec:
-		metricSendDERPErrorClosed.Add(1)
-		return false, errConnClosed
-	case ch <- derpWriteRequest{addr, pubKey, pkt}:
-		metricSendDERPQueued.Add(1)
-		return true, nil
-	default:
-		metricSendDERPErrorQueue.Add(1)
-		// Too many writes queued. Drop packet.
-		return false, errDropDerpPacket
+	queued, err := c.enqueueDerpWrite(ctx, ch, derpWriteRequest{addr: addr, pubKey: pubKey, pkts: pkts, queued: mono.Now()})
+	switch {
+	case queued:
+		metricSendDERPQueued.Add(int64(len(buffs)))
+	case err == errConnClosed:
+		metricSendDERPErrorClosed.Add(int64(len(buffs)))
 	}
+	return queued, err
 }
 
 type receiveBatch struct {
@@ -1239,7 +2056,7 @@ func (c *Conn) mkReceiveFunc(ruc *RebindingUDPConn, healthItem *health.ReceiveFu
 						metric.Add(1)
 					}
 					eps[i] = ep
-					sizes[i] = msg.N
+					sizes[i] = unpaddedLen(msg.Buffers[0][:msg.N])
 					reportToCaller = true
 				} else {
 					sizes[i] = 0
@@ -1257,25 +2074,20 @@ func (c *Conn) mkReceiveFunc(ruc *RebindingUDPConn, healthItem *health.ReceiveFu
 // ok is whether this read should be reported up to wireguard-go (our
 // caller).
 func (c *Conn) receiveIP(b []byte, ipp netip.AddrPort, cache *ippEndpointCache) (ep *endpoint, ok bool) {
-	if stun.Is(b) {
+	switch c.classifyRecv(b, discoRXPathUDP) {
+	case packetSTUN:
 		c.stunReceiveFunc.Load()(b, ipp)
 		return nil, false
-	}
-	if c.handleDiscoMessage(b, ipp, key.NodePublic{}, discoRXPathUDP) {
+	case packetDisco:
+		c.handleDiscoMessage(b, ipp, key.NodePublic{}, discoRXPathUDP)
 		return nil, false
-	}
-	if !c.havePrivateKey.Load() {
-		// If we have no private key, we're logged out or
-		// stopped. Don't try to pass these wireguard packets
-		// up to wireguard-go; it'll just complain (issue 1167).
+	case packetDrop:
 		return nil, false
 	}
 	if cache.ipp == ipp && cache.de != nil && cache.gen == cache.de.numStopAndReset() {
 		ep = cache.de
 	} else {
-		c.mu.Lock()
-		de, ok := c.peerMap.endpointForIPPort(ipp)
-		c.mu.Unlock()
+		de, ok := c.peerMap.endpointForIPPort(ipp) // no c.mu needed; see peerMap
 		if !ok {
 			return nil, false
 		}
@@ -1288,6 +2100,10 @@ func (c *Conn) receiveIP(b []byte, ipp netip.AddrPort, cache *ippEndpointCache)
 	if stats := c.stats.Load(); stats != nil {
 		stats.UpdateRxPhysical(ep.nodeAddr, ipp, len(b))
 	}
+	if sockstats.IsAvailable {
+		sockstats.AddPeerBytes(sockstatsLabelOf(ipp), ep.publicKey, 0, len(b))
+	}
+	c.captureWireGuard(capture.PathWireGuardFromPeer, ipp, ep.publicKey, b)
 	return ep, true
 }
 
@@ -1321,6 +2137,13 @@ func (c *Conn) sendDiscoMessage(dst netip.AddrPort, dstKey key.NodePublic, dstDi
 		time.Sleep(debugIPv4DiscoPingPenalty())
 	}
 
+	if !discoLimiter.allow(dstDisco) {
+		if logLevel == discoLog || (logLevel == discoVerboseLog && debugDisco()) {
+			c.dlog("disco: throttled", append([]any{LogKeyDisco, dstDisco.ShortString(), "msg", disco.MessageSummary(m)}, pathAttrs(dst)...)...)
+		}
+		return false, nil
+	}
+
 	c.mu.Lock()
 	if c.closed {
 		c.mu.Unlock()
@@ -1330,6 +2153,15 @@ func (c *Conn) sendDiscoMessage(dst netip.AddrPort, dstKey key.NodePublic, dstDi
 	pkt = append(pkt, disco.Magic...)
 	pkt = c.discoPublic.AppendTo(pkt)
 	di := c.discoInfoLocked(dstDisco)
+	obfuscator := c.discoObfuscator.Load()
+	obfuscate := !isDERP && c.shouldObfuscateLocked(obfuscator, di, c.monoNow())
+	if _, isPing := m.(*disco.Ping); isPing && obfuscate {
+		c.noteObfuscatedPingSentLocked(obfuscator, di, c.monoNow())
+	}
+	var capturePeer key.NodePublic
+	if c.capturing() {
+		capturePeer = c.discoPeerLocked(dstKey, dstDisco)
+	}
 	c.mu.Unlock()
 
 	if isDERP {
@@ -1338,16 +2170,28 @@ func (c *Conn) sendDiscoMessage(dst netip.AddrPort, dstKey key.NodePublic, dstDi
 		metricSendDiscoUDP.Add(1)
 	}
 
-	box := di.sharedKey.Seal(m.AppendMarshal(nil))
-	pkt = append(pkt, box...)
-	sent, err = c.sendAddr(dst, dstKey, pkt)
+	payload := m.AppendMarshal(nil)
+	box := di.sharedKey.Seal(payload)
+	if obfuscate {
+		pkt = obfuscator.seal(c.now(), c.discoPublic, box)
+		metricSendDiscoObfuscated.Add(1)
+	} else {
+		pkt = append(pkt, box...)
+	}
+	c.captureDisco(capture.PathDiscoToPeer, dst, capturePeer, payload)
+	ctx, cancel := context.WithTimeout(c.connCtx, discoDERPQueueTimeout)
+	defer cancel()
+	sent, err = c.sendAddr(ctx, dst, dstKey, pkt)
+	if isDERP && c.derpDualHome {
+		c.sendDERPAlt(dst, dstKey, pkt)
+	}
 	if sent {
 		if logLevel == discoLog || (logLevel == discoVerboseLog && debugDisco()) {
 			node := "?"
 			if !dstKey.IsZero() {
 				node = dstKey.ShortString()
 			}
-			c.dlogf("[v1] magicsock: disco: %v->%v (%v, %v) sent %v", c.discoShort, dstDisco.ShortString(), node, derpStr(dst.String()), disco.MessageSummary(m))
+			c.dlog("disco: sent", append([]any{LogKeyPeer, node, LogKeyDisco, dstDisco.ShortString(), "msg", disco.MessageSummary(m)}, pathAttrs(dst)...)...)
 		}
 		if isDERP {
 			metricSentDiscoDERP.Add(1)
@@ -1366,7 +2210,7 @@ func (c *Conn) sendDiscoMessage(dst netip.AddrPort, dstKey key.NodePublic, dstDi
 		// Can't send. (e.g. no IPv6 locally)
 	} else {
 		if !c.networkDown() {
-			c.logf("magicsock: disco: failed to send %T to %v: %v", m, dst, err)
+			c.logfSampled("disco-send", "magicsock: disco: failed to send %T to %v: %v", m, dst, err)
 		}
 	}
 	return sent, err
@@ -1380,6 +2224,24 @@ func (c *Conn) sendDiscoMessage(dst netip.AddrPort, dstKey key.NodePublic, dstDi
 	discoRXPathRawSocket discoRXPath = "raw socket"
 )
 
+// discoMinSealedLen is the length of the smallest naclbox a disco message
+// can be sealed in: its nonce plus the box overhead.
+const discoMinSealedLen = 24 + 16
+
+// validDiscoSource reports whether src is a plausible source of a disco
+// message received via via, as opposed to one spoofed or mangled: DERP
+// sources are the DERP magic IP, and others are unicast addresses with a
+// port.
+func validDiscoSource(src netip.AddrPort, via discoRXPath) bool {
+	if via == discoRXPathDERP {
+		return src.Addr() == tailcfg.DerpMagicIPAddr
+	}
+	ip := src.Addr()
+	return src.IsValid() && src.Port() != 0 &&
+		!ip.IsUnspecified() && !ip.IsMulticast() &&
+		ip != tailcfg.DerpMagicIPAddr && ip != netip.AddrFrom4([4]byte{255, 255, 255, 255})
+}
+
 // handleDiscoMessage handles a discovery message and reports whether
 // msg was a Tailscale inter-node discovery message.
 //
@@ -1396,17 +2258,37 @@ func (c *Conn) sendDiscoMessage(dst netip.AddrPort, dstKey key.NodePublic, dstDi
 // over UDP.
 func (c *Conn) handleDiscoMessage(msg []byte, src netip.AddrPort, derpNodeSrc key.NodePublic, via discoRXPath) (isDiscoMsg bool) {
 	const headerLen = len(disco.Magic) + key.DiscoPublicRawLen
-	if len(msg) < headerLen || string(msg[:len(disco.Magic)]) != disco.Magic {
+	var (
+		sender     key.DiscoPublic
+		sealedBox  []byte
+		obfuscated bool
+	)
+	obfuscator := c.discoObfuscator.Load()
+	if len(msg) >= headerLen && string(msg[:len(disco.Magic)]) == disco.Magic {
+		sender = key.DiscoPublicFromRaw32(mem.B(msg[len(disco.Magic):headerLen]))
+		sealedBox = msg[headerLen:]
+	} else if obfuscator != nil && via != discoRXPathDERP && looksObfuscated(msg) {
+		sender, sealedBox, obfuscated = obfuscator.open(c.now(), msg)
+		if !obfuscated {
+			return false
+		}
+	} else {
 		return false
 	}
 
 	// If the first four parts are the prefix of disco.Magic
-	// (0x5453f09f) then it's definitely not a valid WireGuard
-	// packet (which starts with little-endian uint32 1, 2, 3, 4).
-	// Use naked returns for all following paths.
+	// (0x5453f09f), or of an obfuscated magic (whose first byte
+	// has its high bit set), then it's definitely not a valid
+	// WireGuard packet (which starts with little-endian uint32 1,
+	// 2, 3, 4). Use naked returns for all following paths.
 	isDiscoMsg = true
 
-	sender := key.DiscoPublicFromRaw32(mem.B(msg[len(disco.Magic):headerLen]))
+	if obfuscated {
+		metricRecvDiscoObfuscated.Add(1)
+	} else if obfuscator != nil && obfuscator.cfg.Strict && via != discoRXPathDERP {
+		metricRecvDiscoPlainDropped.Add(1)
+		return
+	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -1423,7 +2305,8 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netip.AddrPort, derpNodeSrc ke
 		return
 	}
 
-	if !c.peerMap.anyEndpointForDiscoKey(sender) {
+	isSelfTest := sender == c.discoPublic && len(c.selfTestPings) > 0
+	if !c.peerMap.anyEndpointForDiscoKey(sender) && !isSelfTest {
 		metricRecvDiscoBadPeer.Add(1)
 		if debugDisco() {
 			c.logf("magicsock: disco: ignoring disco-looking frame, don't know endpoint for %v", sender.ShortString())
@@ -1431,6 +2314,21 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netip.AddrPort, derpNodeSrc ke
 		return
 	}
 
+	if !validDiscoSource(src, via) || len(sealedBox) < discoMinSealedLen {
+		metricRecvDiscoRejected.Add(1)
+		if debugDisco() {
+			c.logf("magicsock: disco: rejecting invalid disco frame from %v via %v", src, via)
+		}
+		return
+	}
+	if ok, first := c.discoRecvLimit.allow(src, sender); !ok {
+		metricRecvDiscoRateLimited.Add(1)
+		if first {
+			c.logf("magicsock: disco: rate limiting disco frames from %v claiming %v", src, sender.ShortString())
+		}
+		return
+	}
+
 	// We're now reasonably sure we're expecting communication from
 	// this peer, do the heavy crypto lifting to see what they want.
 	//
@@ -1438,7 +2336,6 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netip.AddrPort, derpNodeSrc ke
 
 	di := c.discoInfoLocked(sender)
 
-	sealedBox := msg[headerLen:]
 	payload, ok := di.sharedKey.Open(sealedBox)
 	if !ok {
 		// This might be have been intended for a previous
@@ -1457,12 +2354,22 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netip.AddrPort, derpNodeSrc ke
 		metricRecvDiscoBadKey.Add(1)
 		return
 	}
+	if via != discoRXPathDERP {
+		c.noteDiscoRecvLocked(obfuscator, di, obfuscated, c.monoNow())
+	}
 
 	// Emit information about the disco frame into the pcap stream
-	// if a capture hook is installed.
+	// if a capture hook is installed and its filter matches.
+	var peer key.NodePublic
+	if c.capturing() {
+		peer = c.discoPeerLocked(derpNodeSrc, sender)
+	}
 	if cb := c.captureHook.Load(); cb != nil {
-		cb(capture.PathDisco, time.Now(), disco.ToPCAPFrame(src, derpNodeSrc, payload), packet.CaptureMeta{})
+		if f := c.captureFilter.Load(); f.Match(capture.PathDisco, len(payload)) && f.MatchPeer(peer) {
+			cb(capture.PathDisco, c.now(), disco.ToPCAPFrame(src, derpNodeSrc, payload), packet.CaptureMeta{})
+		}
 	}
+	c.captureDisco(capture.PathDisco, src, peer, payload)
 
 	dm, err := disco.Parse(payload)
 	if debugDisco() {
@@ -1474,7 +2381,11 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netip.AddrPort, derpNodeSrc ke
 		// newer version of Tailscale that we don't
 		// understand. Not even worth logging about, lest it
 		// be too spammy for old clients.
-		metricRecvDiscoBadParse.Add(1)
+		if errors.Is(err, disco.ErrUnknownMessageType) {
+			metricRecvDiscoUnknownType.Add(1)
+		} else {
+			metricRecvDiscoBadParse.Add(1)
+		}
 		return
 	}
 
@@ -1483,51 +2394,90 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netip.AddrPort, derpNodeSrc ke
 		metricRecvDiscoDERP.Add(1)
 	} else {
 		metricRecvDiscoUDP.Add(1)
+		if via == discoRXPathRawSocket {
+			metricRecvDiscoViaRaw.Add(1)
+		} else {
+			metricRecvDiscoViaSocket.Add(1)
+		}
 	}
 
 	switch dm := dm.(type) {
 	case *disco.Ping:
 		metricRecvDiscoPing.Add(1)
+		if isSelfTest {
+			c.noteSelfTestPingLocked(dm.TxID)
+			return
+		}
 		c.handlePingLocked(dm, src, di, derpNodeSrc)
 	case *disco.Pong:
 		metricRecvDiscoPong.Add(1)
-		// There might be multiple nodes for the sender's DiscoKey.
-		// Ask each to handle it, stopping once one reports that
-		// the Pong's TxID was theirs.
-		c.peerMap.forEachEndpointWithDiscoKey(sender, func(ep *endpoint) (keepGoing bool) {
-			if ep.handlePongConnLocked(dm, di, src) {
-				return false
-			}
-			return true
-		})
-	case *disco.CallMeMaybe:
-		metricRecvDiscoCallMeMaybe.Add(1)
-		if !isDERP || derpNodeSrc.IsZero() {
-			// CallMeMaybe messages should only come via DERP.
-			c.logf("[unexpected] CallMeMaybe packets should only come via DERP")
+		// There might be multiple nodes for the sender's DiscoKey,
+		// so hand the pong to the one that sent the ping.
+		ep := c.discoPings.owner(dm.TxID)
+		if ep == nil {
+			metricRecvDiscoPongUnknownTx.Add(1)
 			return
 		}
-		nodeKey := derpNodeSrc
-		ep, ok := c.peerMap.endpointForNodeKey(nodeKey)
-		if !ok {
-			metricRecvDiscoCallMeMaybeBadNode.Add(1)
-			c.logf("magicsock: disco: ignoring CallMeMaybe from %v; %v is unknown", sender.ShortString(), derpNodeSrc.ShortString())
+		if epDisco := ep.disco.Load(); epDisco == nil || epDisco.key != sender {
+			metricRecvDiscoPongUnknownTx.Add(1)
 			return
 		}
+		ep.handlePongConnLocked(dm, di, src)
+	case *disco.CallMeMaybe:
+		metricRecvDiscoCallMeMaybe.Add(1)
+		var ep *endpoint
+		if isDERP {
+			if derpNodeSrc.IsZero() {
+				c.logf("[unexpected] CallMeMaybe via DERP without a source node")
+				return
+			}
+			var ok bool
+			ep, ok = c.peerMap.endpointForNodeKey(derpNodeSrc)
+			if !ok {
+				metricRecvDiscoCallMeMaybeBadNode.Add(1)
+				c.logf("magicsock: disco: ignoring CallMeMaybe from %v; %v is unknown", sender.ShortString(), derpNodeSrc.ShortString())
+				return
+			}
+		} else {
+			// Peers send CallMeMaybe over UDP when their DERP is
+			// down. Only accept it from a path we've validated to the
+			// peer, so it can't be used to probe for other peers.
+			var ok bool
+			ep, ok = c.peerMap.endpointForIPPort(src)
+			if !ok || ep.validatedUDPAddr() != src {
+				metricRecvDiscoCallMeMaybeBadUDP.Add(1)
+				c.dlog("disco: ignoring call-me-maybe over unvalidated path", append([]any{LogKeyDisco, sender.ShortString()}, pathAttrs(src)...)...)
+				return
+			}
+			metricRecvDiscoCallMeMaybeUDP.Add(1)
+		}
 		epDisco := ep.disco.Load()
 		if epDisco == nil {
 			return
 		}
 		if epDisco.key != di.discoKey {
 			metricRecvDiscoCallMeMaybeBadDisco.Add(1)
-			c.logf("[unexpected] CallMeMaybe from peer via DERP whose netmap discokey != disco source")
+			c.logf("[unexpected] CallMeMaybe from peer whose netmap discokey != disco source")
 			return
 		}
-		c.dlogf("[v1] magicsock: disco: %v<-%v (%v, %v)  got call-me-maybe, %d endpoints",
-			c.discoShort, epDisco.short,
-			ep.publicKey.ShortString(), derpStr(src.String()),
-			len(dm.MyNumber))
+		c.dlog("disco: got call-me-maybe", append([]any{LogKeyPeer, ep.publicKey.ShortString(), LogKeyDisco, epDisco.short, "endpoints", len(dm.MyNumber)}, pathAttrs(src)...)...)
 		go ep.handleCallMeMaybe(dm)
+	case *disco.PortPredict:
+		metricRecvDiscoPortPredict.Add(1)
+		if !isDERP || derpNodeSrc.IsZero() {
+			// Port predictions are only coordinated over DERP, as
+			// there's no direct path yet.
+			return
+		}
+		ep, ok := c.peerMap.endpointForNodeKey(derpNodeSrc)
+		if !ok {
+			return
+		}
+		if epDisco := ep.disco.Load(); epDisco == nil || epDisco.key != di.discoKey {
+			return
+		}
+		c.dlog("disco: got port-predict", LogKeyPeer, ep.publicKey.ShortString(), "addr", dm.Addr, "step", dm.Step, "reply", dm.Reply)
+		go c.handlePortPredict(ep, dm, src)
 	}
 	return
 }
@@ -1573,9 +2523,10 @@ func (c *Conn) unambiguousNodeKeyOfPingLocked(dm *disco.Ping, dk key.DiscoPublic
 // di is the discoInfo of the source of the ping.
 // derpNodeSrc is non-zero if the ping arrived via DERP.
 func (c *Conn) handlePingLocked(dm *disco.Ping, src netip.AddrPort, di *discoInfo, derpNodeSrc key.NodePublic) {
-	likelyHeartBeat := src == di.lastPingFrom && time.Since(di.lastPingTime) < 5*time.Second
+	likelyHeartBeat := src == di.lastPingFrom && c.now().Sub(di.lastPingTime) < 5*time.Second
 	di.lastPingFrom = src
-	di.lastPingTime = time.Now()
+	di.lastPingTime = c.now()
+	c.noteDiscoCapsLocked(di, dm.Caps)
 	isDerp := src.Addr() == tailcfg.DerpMagicIPAddr
 
 	// If we can figure out with certainty which node key this disco
@@ -1585,10 +2536,9 @@ func (c *Conn) handlePingLocked(dm *disco.Ping, src netip.AddrPort, di *discoInf
 	// reliant on DERP call-me-maybe to establish the disco<>node
 	// mapping, and on subsequent disco handlePongLocked to establish
 	// the IP<>disco mapping.
-	if nk, ok := c.unambiguousNodeKeyOfPingLocked(dm, di.discoKey, derpNodeSrc); ok {
-		if !isDerp {
-			c.peerMap.setNodeKeyForIPPort(src, nk)
-		}
+	nk, unambiguous := c.unambiguousNodeKeyOfPingLocked(dm, di.discoKey, derpNodeSrc)
+	if unambiguous && !isDerp {
+		c.peerMap.setNodeKeyForIPPort(src, nk)
 	}
 
 	// If we got a ping over DERP, then derpNodeSrc is non-zero and we reply
@@ -1608,6 +2558,19 @@ func (c *Conn) handlePingLocked(dm *disco.Ping, src netip.AddrPort, di *discoInf
 			}
 			numNodes = 1
 		}
+	} else if unambiguous {
+		// Only the sending node gets src as a candidate; its address
+		// says nothing about the other nodes sharing its disco key.
+		if ep, ok := c.peerMap.endpointForNodeKey(nk); ok {
+			if ep.addCandidateEndpoint(src, dm.TxID) {
+				return
+			}
+			numNodes = 1
+			dstKey = nk
+			if dm.Migrating {
+				ep.noteMigrationPing(src)
+			}
+		}
 	} else {
 		c.peerMap.forEachEndpointWithDiscoKey(di.discoKey, func(ep *endpoint) (keepGoing bool) {
 			if ep.addCandidateEndpoint(src, dm.TxID) {
@@ -1627,11 +2590,12 @@ func (c *Conn) handlePingLocked(dm *disco.Ping, src netip.AddrPort, di *discoInf
 			// Zero it out if it's ambiguous, so sendDiscoMessage logging
 			// isn't confusing.
 			dstKey = key.NodePublic{}
+			metricRecvDiscoPingAmbiguous.Add(1)
 		}
 	}
 
 	if numNodes == 0 {
-		c.logf("[unexpected] got disco ping from %v/%v for node not in peers", src, derpNodeSrc)
+		c.logfSampled("disco-ping-unknown", "[unexpected] got disco ping from %v/%v for node not in peers", src, derpNodeSrc)
 		return
 	}
 
@@ -1640,7 +2604,7 @@ func (c *Conn) handlePingLocked(dm *disco.Ping, src netip.AddrPort, di *discoInf
 		if numNodes > 1 {
 			pingNodeSrcStr = "[one-of-multi]"
 		}
-		c.dlogf("[v1] magicsock: disco: %v<-%v (%v, %v)  got ping tx=%x", c.discoShort, di.discoShort, pingNodeSrcStr, src, dm.TxID[:6])
+		c.dlog("disco: got ping", append([]any{LogKeyPeer, pingNodeSrcStr, LogKeyDisco, di.discoShort, "tx", fmt.Sprintf("%x", dm.TxID[:6])}, pathAttrs(src)...)...)
 	}
 
 	ipDst := src
@@ -1654,6 +2618,9 @@ func (c *Conn) handlePingLocked(dm *disco.Ping, src netip.AddrPort, di *discoInf
 // enqueueCallMeMaybe schedules a send of disco.CallMeMaybe to de via derpAddr
 // once we know that our STUN endpoint is fresh.
 //
+// If derpAddr is invalid or its region isn't connected, the CallMeMaybe is
+// sent over de's validated UDP path instead, if it has one.
+//
 // derpAddr is de.derpAddr at the time of send. It's assumed the peer won't be
 // flipping primary DERPs in the 0-30ms it takes to confirm our STUN endpoint.
 // If they do, traffic will just go over DERP for a bit longer until the next
@@ -1667,22 +2634,31 @@ func (c *Conn) enqueueCallMeMaybe(derpAddr netip.AddrPort, de *endpoint) {
 		return
 	}
 
-	if !c.lastEndpointsTime.After(time.Now().Add(-endpointsFreshEnoughDuration)) {
+	if !c.lastEndpointsTime.After(c.now().Add(-endpointsFreshEnoughDuration)) {
 		c.dlogf("[v1] magicsock: want call-me-maybe but endpoints stale; restunning")
 
 		mak.Set(&c.onEndpointRefreshed, de, func() {
 			c.dlogf("[v1] magicsock: STUN done; sending call-me-maybe to %v %v", epDisco.short, de.publicKey.ShortString())
 			c.enqueueCallMeMaybe(derpAddr, de)
 		})
-		// TODO(bradfitz): make a new 'reSTUNQuickly' method
-		// that passes down a do-a-lite-netcheck flag down to
-		// netcheck that does 1 (or 2 max) STUN queries
-		// (UDP-only, not HTTPs) to find our port mapping to
-		// our home DERP and maybe one other. For now we do a
-		// "full" ReSTUN which may or may not be a full one
-		// (depending on age) and may do HTTPS timing queries
-		// (if UDP is blocked). Good enough for now.
-		go c.ReSTUN("refresh-for-peering")
+		// Only our current port mapping matters here, so STUN
+		// just the home DERP region rather than netcheck every
+		// region.
+		go c.RefreshEndpoints(RefreshHomeDERP, "refresh-for-peering")
+		return
+	}
+
+	dst := derpAddr
+	if !derpAddr.IsValid() || !c.derpConnected.Contains(int(derpAddr.Port())) {
+		// DERP is down or the peer has no home region. Rather than
+		// queue the CallMeMaybe for a DERP connection that may never
+		// come up, send it over a UDP path the peer proved to us.
+		if udpAddr := de.validatedUDPAddr(); udpAddr.IsValid() {
+			dst = udpAddr
+			metricSendDiscoCallMeMaybeUDP.Add(1)
+		}
+	}
+	if !dst.IsValid() {
 		return
 	}
 
@@ -1693,7 +2669,10 @@ func (c *Conn) enqueueCallMeMaybe(derpAddr netip.AddrPort, de *endpoint) {
 	// NOTE: sending an empty call-me-maybe (e.g. when BlockEndpoints is true)
 	// is still valid and results in the other side forgetting all the endpoints
 	// it knows of ours.
-	go de.c.sendDiscoMessage(derpAddr, de.publicKey, epDisco.key, &disco.CallMeMaybe{MyNumber: eps}, discoLog)
+	go de.c.sendDiscoMessage(dst, de.publicKey, epDisco.key, &disco.CallMeMaybe{MyNumber: eps}, discoLog)
+	if c.shouldPredictPorts(dst) {
+		go c.startPortPrediction(de, dst)
+	}
 	if debugSendCallMeUnknownPeer() {
 		// Send a callMeMaybe packet to a non-existent peer
 		unknownKey := key.NewNode().Public()
@@ -1722,11 +2701,35 @@ func (c *Conn) SetDERPHeader(header http.Header) {
 	c.derpHeader.Store(&header)
 }
 
+// SetDERPHeaderAndReconnect is like SetDERPHeader, but also replaces the
+// open DERP connections, which were made with the old header, such as
+// when it carries a credential that was rotated. Each old connection is
+// closed once the packets already queued on it are sent, and the home
+// DERP connection is reopened right away; others are reopened when next
+// needed.
+func (c *Conn) SetDERPHeaderAndReconnect(header http.Header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.derpHeader.Store(&header)
+	if c.closed || len(c.activeDerp) == 0 {
+		return
+	}
+	for regionID := range c.activeDerp {
+		c.drainDerpLocked(regionID, "derp-header-changed")
+	}
+	c.logActiveDerpLocked()
+	if !c.privateKey.IsZero() {
+		c.startDerpHomeConnectLocked()
+	}
+}
+
 func (c *Conn) SetDERPForceWebsockets(v bool) {
 	c.derpForceWebsockets.Store(v)
 }
 
-func (c *Conn) SetDERPRegionDialer(dialer func(ctx context.Context, region *tailcfg.DERPRegion) net.Conn) {
+// SetDERPRegionDialer sets the dialer the DERP clients use to connect to
+// the nodes of their regions; see derphttp.Client.SetRegionDialer.
+func (c *Conn) SetDERPRegionDialer(dialer func(ctx context.Context, region *tailcfg.DERPRegion, node *tailcfg.DERPNode) net.Conn) {
 	c.derpRegionDialer.Store(&dialer)
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -1783,6 +2786,7 @@ func (c *Conn) SetPrivateKey(privateKey key.NodePrivate) error {
 		return nil
 	}
 	c.privateKey = newKey
+	c.healthWatchers.poke()
 	c.havePrivateKey.Store(!newKey.IsZero())
 
 	if newKey.IsZero() {
@@ -1794,7 +2798,7 @@ func (c *Conn) SetPrivateKey(privateKey key.NodePrivate) error {
 	if oldKey.IsZero() {
 		c.everHadKey = true
 		c.logf("magicsock: SetPrivateKey called (init)")
-		go c.ReSTUN("set-private-key")
+		go c.RefreshEndpoints(RefreshFull, "set-private-key")
 	} else if newKey.IsZero() {
 		c.logf("magicsock: SetPrivateKey called (zeroed)")
 		c.closeAllDerpLocked("zero-private-key")
@@ -1802,7 +2806,11 @@ func (c *Conn) SetPrivateKey(privateKey key.NodePrivate) error {
 		c.onEndpointRefreshed = nil
 	} else {
 		c.logf("magicsock: SetPrivateKey called (changed)")
-		c.closeAllDerpLocked("new-private-key")
+		if c.keyRotationWindow > 0 {
+			c.retireDerpLocked()
+		} else {
+			c.closeAllDerpLocked("new-private-key")
+		}
 	}
 
 	// Key changed. Close existing DERP connections and reconnect to home.
@@ -1837,20 +2845,25 @@ func (c *Conn) UpdatePeers(newPeers map[key.NodePublic]struct{}) {
 		if _, ok := newPeers[peer]; !ok {
 			delete(c.derpRoute, peer)
 			delete(c.peerLastDerp, peer)
+			delete(c.peerKeepalive, peer)
+			c.derpDrops.Delete(peer)
 		}
 	}
 
 	if len(oldPeers) == 0 && len(newPeers) > 0 {
-		go c.ReSTUN("non-zero-peers")
+		go c.RefreshEndpoints(RefreshFull, "non-zero-peers")
 	}
 }
 
+// nodesEqual reports whether x and y are equal. Nodes shared by both, as
+// when a network map is built from the last one, are equal without being
+// compared.
 func nodesEqual(x, y []*tailcfg.Node) bool {
 	if len(x) != len(y) {
 		return false
 	}
 	for i := range x {
-		if !x[i].Equal(y[i]) {
+		if x[i] != y[i] && !x[i].Equal(y[i]) {
 			return false
 		}
 	}
@@ -1863,6 +2876,14 @@ func nodesEqual(x, y []*tailcfg.Node) bool {
 // It should not use the DERPMap field of NetworkMap; that's
 // conditionally sent to SetDERPMap instead.
 func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
+	// The diff is reported after c.mu is released.
+	var diff NetmapDiff
+	defer func() {
+		if c.netmapDiffFunc != nil && !diff.IsEmpty() {
+			c.netmapDiffFunc(diff)
+		}
+	}()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -1887,9 +2908,16 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 		// silent disco) haven't changed, no need to do anything else.
 		return
 	}
+	if c.netmapDiffFunc != nil {
+		var priorPeers []*tailcfg.Node
+		if priorNetmap != nil {
+			priorPeers = priorNetmap.Peers
+		}
+		diff = diffNetmapPeers(priorPeers, nm.Peers)
+	}
 
 	c.logf("[v1] magicsock: got updated network map; %d peers", len(nm.Peers))
-	heartbeatDisabled := debugEnableSilentDisco() || (c.netMap != nil && c.netMap.Debug != nil && c.netMap.Debug.EnableSilentDisco)
+	heartbeatDisabled := c.heartbeatDisabledLocked()
 
 	// Set a maximum size for our set of endpoint ring buffers by assuming
 	// that a single large update is ~500 bytes, and that we want to not
@@ -1920,9 +2948,19 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 	// efficient alloc-free update. If the set of nodes is different,
 	// we'll fall through to the next pass, which allocates but can
 	// handle full set updates.
-	for _, n := range nm.Peers {
-		if ep, ok := c.peerMap.endpointForNodeKey(n.Key); ok {
-			if n.DiscoKey.IsZero() && !n.IsWireGuardOnly {
+	//
+	// Network maps are immutable, and a new one shares the nodes of
+	// peers that haven't changed with the last, so an endpoint last
+	// updated from the very same node is already up to date.
+	var unchanged int64
+	for _, p := range nm.Peers {
+		n := p.View()
+		if ep, ok := c.peerMap.endpointForNodeKey(n.Key()); ok {
+			if ep.node == n && !debugChanged {
+				unchanged++
+				continue
+			}
+			if n.DiscoKey().IsZero() && !n.IsWireGuardOnly() {
 				// Discokey transitioned from non-zero to zero? This should not
 				// happen in the wild, however it could mean:
 				// 1. A node was downgraded from post 0.100 to pre 0.100.
@@ -1931,6 +2969,7 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 				//    IsWireGuardOnly check)
 				// 3. The server is misbehaving.
 				c.peerMap.deleteEndpoint(ep)
+				c.releasePeerPorts(ep.publicKey)
 				continue
 			}
 			var oldDiscoKey key.DiscoPublic
@@ -1939,9 +2978,10 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 			}
 			ep.updateFromNode(n, heartbeatDisabled)
 			c.peerMap.upsertEndpoint(ep, oldDiscoKey) // maybe update discokey mappings in peerMap
+			c.tryLearnedPathLocked(ep)
 			continue
 		}
-		if n.DiscoKey.IsZero() && !n.IsWireGuardOnly {
+		if n.DiscoKey().IsZero() && !n.IsWireGuardOnly() {
 			// Ancient pre-0.100 node, which does not have a disco key, and will only be reachable via DERP.
 			continue
 		}
@@ -1949,30 +2989,31 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 		ep := &endpoint{
 			c:                 c,
 			debugUpdates:      ringbuffer.New[EndpointChange](entriesPerBuffer),
-			publicKey:         n.Key,
-			publicKeyHex:      n.Key.UntypedHexString(),
+			publicKey:         n.Key(),
+			publicKeyHex:      n.Key().UntypedHexString(),
 			sentPing:          map[stun.TxID]sentPing{},
 			endpointState:     map[netip.AddrPort]*endpointState{},
 			heartbeatDisabled: heartbeatDisabled,
-			isWireguardOnly:   n.IsWireGuardOnly,
+			keepaliveInterval: c.peerKeepalive[n.Key()],
+			isWireguardOnly:   n.IsWireGuardOnly(),
 		}
-		if len(n.Addresses) > 0 {
-			ep.nodeAddr = n.Addresses[0].Addr()
+		if n.Addresses().Len() > 0 {
+			ep.nodeAddr = n.Addresses().At(0).Addr()
 		}
 		ep.initFakeUDPAddr()
-		if n.DiscoKey.IsZero() {
+		if n.DiscoKey().IsZero() {
 			ep.disco.Store(nil)
 		} else {
 			ep.disco.Store(&endpointDisco{
-				key:   n.DiscoKey,
-				short: n.DiscoKey.ShortString(),
+				key:   n.DiscoKey(),
+				short: n.DiscoKey().ShortString(),
 			})
 
 			if debugDisco() { // rather than making a new knob
-				c.logf("magicsock: created endpoint key=%s: disco=%s; %v", n.Key.ShortString(), n.DiscoKey.ShortString(), logger.ArgWriter(func(w *bufio.Writer) {
+				c.logf("magicsock: created endpoint key=%s: disco=%s; %v", n.Key().ShortString(), n.DiscoKey().ShortString(), logger.ArgWriter(func(w *bufio.Writer) {
 					const derpPrefix = "127.3.3.40:"
-					if strings.HasPrefix(n.DERP, derpPrefix) {
-						ipp, _ := netip.ParseAddrPort(n.DERP)
+					if strings.HasPrefix(n.DERP(), derpPrefix) {
+						ipp, _ := netip.ParseAddrPort(n.DERP())
 						regionID := int(ipp.Port())
 						code := c.derpRegionCodeLocked(regionID)
 						if code != "" {
@@ -1981,22 +3022,25 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 						fmt.Fprintf(w, "derp=%v%s ", regionID, code)
 					}
 
-					for _, a := range n.AllowedIPs {
+					for i := 0; i < n.AllowedIPs().Len(); i++ {
+						a := n.AllowedIPs().At(i)
 						if a.IsSingleIP() {
 							fmt.Fprintf(w, "aip=%v ", a.Addr())
 						} else {
 							fmt.Fprintf(w, "aip=%v ", a)
 						}
 					}
-					for _, ep := range n.Endpoints {
-						fmt.Fprintf(w, "ep=%v ", ep)
+					for i := 0; i < n.Endpoints().Len(); i++ {
+						fmt.Fprintf(w, "ep=%v ", n.Endpoints().At(i))
 					}
 				}))
 			}
 		}
 		ep.updateFromNode(n, heartbeatDisabled)
 		c.peerMap.upsertEndpoint(ep, key.DiscoPublic{})
+		c.tryLearnedPathLocked(ep)
 	}
+	metricNetmapPeersUnchanged.Add(unchanged)
 
 	// If the set of nodes changed since the last SetNetworkMap, the
 	// upsert loop just above made c.peerMap contain the union of the
@@ -2011,6 +3055,7 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 		c.peerMap.forEachEndpoint(func(ep *endpoint) {
 			if !keep[ep.publicKey] {
 				c.peerMap.deleteEndpoint(ep)
+				c.releasePeerPorts(ep.publicKey)
 			}
 		})
 	}
@@ -2023,6 +3068,12 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 	}
 }
 
+// heartbeatDisabledLocked reports whether silent disco turns off the
+// heartbeat pings of c's peers. c.mu must be held.
+func (c *Conn) heartbeatDisabledLocked() bool {
+	return c.silentDisco || debugEnableSilentDisco() || (c.netMap != nil && c.netMap.Debug != nil && c.netMap.Debug.EnableSilentDisco)
+}
+
 func (c *Conn) logEndpointChange(endpoints []tailcfg.Endpoint) {
 	c.logf("magicsock: endpoints changed: %s", logger.ArgWriter(func(buf *bufio.Writer) {
 		for i, ep := range endpoints {
@@ -2061,13 +3112,7 @@ type connBind struct {
 //
 // See https://pkg.go.dev/golang.zx2c4.com/wireguard/conn#Bind.BatchSize
 func (c *connBind) BatchSize() int {
-	// TODO(raggi): determine by properties rather than hardcoding platform behavior
-	switch runtime.GOOS {
-	case "linux":
-		return conn.IdealBatchSize
-	default:
-		return 1
-	}
+	return c.batchSize
 }
 
 // Open is called by WireGuard to create a UDP binding.
@@ -2083,6 +3128,9 @@ func (c *connBind) Open(ignoredPort uint16) ([]conn.ReceiveFunc, uint16, error)
 	}
 	c.closed = false
 	fns := []conn.ReceiveFunc{c.receiveIPv4(), c.receiveIPv6(), c.receiveDERP}
+	if c.usesPeerPorts() {
+		fns = append(fns, c.receivePeerPorts)
+	}
 	if runtime.GOOS == "js" {
 		fns = []conn.ReceiveFunc{c.receiveDERP}
 	}
@@ -2112,16 +3160,19 @@ func (c *connBind) Close() error {
 	// Unblock all outstanding receives.
 	c.pconn4.Close()
 	c.pconn6.Close()
-	if c.closeDisco4 != nil {
-		c.closeDisco4.Close()
-	}
-	if c.closeDisco6 != nil {
-		c.closeDisco6.Close()
-	}
+	c.rawDiscoMu.Lock()
+	c.stopRawDiscoLocked()
+	c.rawDiscoMu.Unlock()
 	// Send an empty read result to unblock receiveDERP,
 	// which will then check connBind.Closed.
 	// connBind.Closed takes c.mu, but c.derpRecvCh is buffered.
 	c.derpRecvCh <- derpReadResult{}
+	// Likewise for receivePeerPorts, unless it has a packet to read
+	// already, after which it checks too.
+	select {
+	case c.peerPortRecvCh <- peerPortReadResult{}:
+	default:
+	}
 	return nil
 }
 
@@ -2136,6 +3187,14 @@ func (c *connBind) isClosed() bool {
 //
 // Only the first close does anything. Any later closes return nil.
 func (c *Conn) Close() error {
+	return c.CloseWithTimeout(0)
+}
+
+// CloseWithTimeout is like Close, but waits no longer than d, if positive,
+// for the goroutines updating endpoints and connecting to DERP to stop.
+// Past that, it tears down what it can without them, and returns an error
+// listing those still running, which are left to exit on their own.
+func (c *Conn) CloseWithTimeout(d time.Duration) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.closed {
@@ -2147,6 +3206,10 @@ func (c *Conn) Close() error {
 	}
 	c.stopPeriodicReSTUNTimerLocked()
 	c.portMapper.Close()
+	if c.netMonUnregister != nil {
+		c.netMonUnregister()
+		c.autoRebind.stop()
+	}
 
 	c.peerMap.forEachEndpoint(func(ep *endpoint) {
 		ep.stopAndReset()
@@ -2154,30 +3217,63 @@ func (c *Conn) Close() error {
 
 	c.closed = true
 	c.connCtxCancel()
+	c.healthWatchers.poke()
 	c.closeAllDerpLocked("conn-close")
 	// Ignore errors from c.pconnN.Close.
 	// They will frequently have been closed already by a call to connBind.Close.
 	c.pconn6.Close()
 	c.pconn4.Close()
+	c.closePeerPorts()
+	c.rawDiscoMu.Lock()
+	c.stopRawDiscoLocked()
+	c.rawDiscoMu.Unlock()
 
 	// Wait on goroutines updating right at the end, once everything is
 	// already closed. We want everything else in the Conn to be
 	// consistently in the closed state before we release mu to wait
 	// on the endpoint updater & derphttp.Connect.
-	for c.goroutinesRunningLocked() {
+	timedOut := false
+	if d > 0 {
+		t := time.AfterFunc(d, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			timedOut = true
+			c.muCond.Broadcast()
+		})
+		defer t.Stop()
+	}
+	for c.goroutinesRunningLocked() && !timedOut {
 		c.muCond.Wait()
 	}
+	var err error
+	if running := c.runningGoroutinesLocked(); len(running) > 0 {
+		metricCloseTimeouts.Add(1)
+		err = fmt.Errorf("magicsock: Close timed out after %v; still running: %s", d, strings.Join(running, ", "))
+		c.logf("%v", err)
+		// Release the DERP readers and writers waiting on a wedged
+		// first connect, which see connCtx done and exit.
+		c.closeDerpStartedLocked()
+	}
 
 	if pinger := c.getPinger(); pinger != nil {
 		pinger.Close()
 	}
 
-	return nil
+	return err
 }
 
 func (c *Conn) goroutinesRunningLocked() bool {
+	return len(c.runningGoroutinesLocked()) > 0
+}
+
+// runningGoroutinesLocked returns what goroutinesRunningLocked is
+// waiting on, for CloseWithTimeout's error.
+//
+// c.mu must be held.
+func (c *Conn) runningGoroutinesLocked() []string {
+	var running []string
 	if c.endpointsUpdateActive {
-		return true
+		running = append(running, "endpoint update")
 	}
 	// The goroutine running dc.Connect in derpWriteChanOfAddr may linger
 	// and appear to leak, as observed in https://github.com/tailscale/tailscale/issues/554.
@@ -2191,10 +3287,21 @@ func (c *Conn) goroutinesRunningLocked() bool {
 		select {
 		case <-c.derpStarted:
 		default:
-			return true
+			running = append(running, "DERP connect")
 		}
 	}
-	return false
+	return running
+}
+
+// closeDerpStartedLocked closes c.derpStarted, if it isn't already.
+//
+// c.mu must be held.
+func (c *Conn) closeDerpStartedLocked() {
+	select {
+	case <-c.derpStarted:
+	default:
+		close(c.derpStarted)
+	}
 }
 
 func (c *Conn) shouldDoPeriodicReSTUNLocked() bool {
@@ -2222,43 +3329,9 @@ func (c *Conn) shouldDoPeriodicReSTUNLocked() bool {
 	return true
 }
 
-func (c *Conn) onPortMapChanged() { c.ReSTUN("portmap-changed") }
-
-// ReSTUN triggers an address discovery.
-// The provided why string is for debug logging only.
-func (c *Conn) ReSTUN(why string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.closed {
-		// raced with a shutdown.
-		return
-	}
-	metricReSTUNCalls.Add(1)
-
-	// If the user stopped the app, stop doing work. (When the
-	// user stops Tailscale via the GUI apps, ipn/local.go
-	// reconfigures the engine with a zero private key.)
-	//
-	// This used to just check c.privateKey.IsZero, but that broke
-	// some end-to-end tests that didn't ever set a private
-	// key somehow. So for now, only stop doing work if we ever
-	// had a key, which helps real users, but appeases tests for
-	// now. TODO: rewrite those tests to be less brittle or more
-	// realistic.
-	if c.privateKey.IsZero() && c.everHadKey {
-		c.logf("magicsock: ReSTUN(%q) ignored; stopped, no private key", why)
-		return
-	}
-
-	if c.endpointsUpdateActive {
-		if c.wantEndpointsUpdate != why {
-			c.dlogf("[v1] magicsock: ReSTUN: endpoint update active, need another later (%q)", why)
-			c.wantEndpointsUpdate = why
-		}
-	} else {
-		c.endpointsUpdateActive = true
-		go c.updateEndpoints(why)
-	}
+func (c *Conn) onPortMapChanged() {
+	c.healthWatchers.poke()
+	c.RefreshEndpoints(RefreshPortmap, "portmap-changed")
 }
 
 // listenPacket opens a packet listener.
@@ -2274,7 +3347,20 @@ func (c *Conn) listenPacket(network string, port uint16) (nettype.PacketConn, er
 	if c.testOnlyPacketListener != nil {
 		return nettype.MakePacketListenerWithNetIP(c.testOnlyPacketListener).ListenPacket(ctx, network, addr)
 	}
-	return nettype.MakePacketListenerWithNetIP(netns.Listener(c.logf, c.netMon)).ListenPacket(ctx, network, addr)
+	lc := netns.Listener(c.logf, c.netMon)
+	if c.reusePort.Enabled {
+		lc = withReusePort(lc)
+	}
+	return nettype.MakePacketListenerWithNetIP(lc).ListenPacket(ctx, network, addr)
+}
+
+// sockstatsLabelOf returns the sockstats label of the socket that
+// exchanges datagrams with addr, for sockstats.AddPeerBytes.
+func sockstatsLabelOf(addr netip.AddrPort) sockstats.Label {
+	if addr.Addr().Is4() {
+		return sockstats.LabelMagicsockConnUDP4
+	}
+	return sockstats.LabelMagicsockConnUDP6
 }
 
 // bindSocket initializes rucPtr if necessary and binds a UDP socket to it.
@@ -2304,6 +3390,41 @@ func (c *Conn) bindSocket(ruc *RebindingUDPConn, network string, curPortFate cur
 		return nil
 	}
 
+	if (network == "udp4" && c.disableIPv4.Load()) || (network == "udp6" && c.disableIPv6.Load()) {
+		// The embedder's sockets are left open for re-enabling.
+		if ruc.pconn != nil && c.packetConns.isZero() {
+			if err := ruc.closeLocked(); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, errNilPConn) {
+				c.logf("magicsock: bindSocket %v close failed: %v", network, err)
+			}
+		}
+		ruc.setConnLocked(newBlockForeverConn(), "", c.bind.BatchSize())
+		if network == "udp4" {
+			health.SetUDP4Unbound(false)
+		}
+		return nil
+	}
+
+	if !c.packetConns.isZero() {
+		// Keep the embedder's socket, set on the first bind, as
+		// there's nothing else to rebind to, unless it was set aside
+		// while its family was disabled.
+		if _, unbound := ruc.pconn.(*blockForeverConn); ruc.pconn != nil && (!unbound || c.packetConns.forNetwork(network) == nil) {
+			return nil
+		}
+		pconn := c.packetConns.forNetwork(network)
+		if pconn == nil {
+			c.logf("magicsock: bindSocket: no %v socket provided; leaving it unbound", network)
+			ruc.setConnLocked(newBlockForeverConn(), "", c.bind.BatchSize())
+		} else {
+			trySetSocketBuffer(pconn, c.logf)
+			ruc.setConnLocked(pconn, network, c.bind.BatchSize())
+		}
+		if network == "udp4" {
+			health.SetUDP4Unbound(pconn == nil)
+		}
+		return nil
+	}
+
 	// Build a list of preferred ports.
 	// Best is the port that the user requested.
 	// Second best is the port that is currently in use.
@@ -2338,6 +3459,11 @@ func (c *Conn) bindSocket(ruc *RebindingUDPConn, network string, curPortFate cur
 			continue
 		}
 		trySetSocketBuffer(pconn, c.logf)
+		if fd := c.reusePortBPF.Load(); fd > 0 {
+			if err := attachReusePortBPF(pconn, fd); err != nil {
+				c.logf("magicsock: bindSocket: %v", err)
+			}
+		}
 		// Success.
 		if debugBindSocket() {
 			c.logf("magicsock: bindSocket: successfully listened %v port %d", network, port)
@@ -2368,14 +3494,20 @@ func (c *Conn) bindSocket(ruc *RebindingUDPConn, network string, curPortFate cur
 )
 
 // rebind closes and re-binds the UDP sockets.
-// We consider it successful if we manage to bind the IPv4 socket.
+// We consider it successful if we manage to bind the IPv4 socket, or
+// the IPv6 one if IPv4 is disabled.
 func (c *Conn) rebind(curPortFate currentPortFate) error {
 	if err := c.bindSocket(&c.pconn6, "udp6", curPortFate); err != nil {
+		if c.disableIPv4.Load() {
+			return fmt.Errorf("magicsock: Rebind IPv6 failed with IPv4 disabled: %w", err)
+		}
 		c.logf("magicsock: Rebind ignoring IPv6 bind failure: %v", err)
 	}
+	c.rebindPeerPorts("udp6", curPortFate)
 	if err := c.bindSocket(&c.pconn4, "udp4", curPortFate); err != nil {
 		return fmt.Errorf("magicsock: Rebind IPv4 failed: %w", err)
 	}
+	c.rebindPeerPorts("udp4", curPortFate)
 	c.portMapper.SetLocalPort(c.LocalPort())
 	return nil
 }
@@ -2406,6 +3538,20 @@ func (c *Conn) Rebind() {
 
 	c.maybeCloseDERPsOnRebind(ifIPs)
 	c.resetEndpointStates()
+	c.sendMigrationPings()
+	c.healthWatchers.poke()
+}
+
+// sendMigrationPings sends a migration ping to each peer in active use,
+// after a Rebind, so the peers switch to our new sockets (whose address
+// they see may have changed) without waiting for their next discovery,
+// falling back to DERP meanwhile.
+func (c *Conn) sendMigrationPings() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peerMap.forEachEndpoint(func(ep *endpoint) {
+		ep.sendMigrationPing()
+	})
 }
 
 // resetEndpointStates resets the preferred address for all peers.
@@ -2459,16 +3605,14 @@ func (c *Conn) ParseEndpoint(nodeKeyStr string) (conn.Endpoint, error) {
 	return ep, nil
 }
 
-func (c *batchingUDPConn) writeBatch(msgs []ipv6.Message) error {
+// writeBatch writes msgs, returning the number of msgs written before any
+// error. A coalesced msg counts as one.
+func (c *batchingUDPConn) writeBatch(msgs []ipv6.Message) (int, error) {
 	var head int
 	for {
 		n, err := c.xpc.WriteBatch(msgs[head:], 0)
 		if err != nil || n == len(msgs[head:]) {
-			// Returning the number of packets written would require
-			// unraveling individual msg len and gso size during a coalesced
-			// write. The top of the call stack disregards partial success,
-			// so keep this simple for now.
-			return err
+			return head + max(n, 0), err
 		}
 		head += n
 	}
@@ -2525,7 +3669,14 @@ func (c *batchingUDPConn) splitCoalescedMessages(msgs []ipv6.Message, firstMsgAt
 
 func (c *batchingUDPConn) ReadBatch(msgs []ipv6.Message, flags int) (n int, err error) {
 	if !c.rxOffload || len(msgs) < 2 {
-		return c.xpc.ReadBatch(msgs, flags)
+		// Without offload, each message is a datagram, so reading
+		// fewer at once is safe.
+		msgs = msgs[:c.rxTune.size(len(msgs))]
+		n, err = c.xpc.ReadBatch(msgs, flags)
+		if err == nil {
+			c.rxTune.note(n, len(msgs))
+		}
+		return n, err
 	}
 	// Read into the tail of msgs, split into the head.
 	readAt := len(msgs) - 2
@@ -2545,19 +3696,41 @@ func (c *batchingUDPConn) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int
 }
 
 func (c *batchingUDPConn) Close() error {
-	return c.pc.Close()
+	err := c.pc.Close()
+	if u, ok := c.xpc.(*ioURingConn); ok {
+		u.release()
+	}
+	return err
+}
+
+// batchingSupported reports whether batched UDP I/O is supported on this
+// platform: with recvmmsg and sendmmsg on Linux, and recvmsg_x and
+// sendmsg_x on Apple platforms.
+func batchingSupported() bool {
+	return runtime.GOOS == "linux" || msgXSupported
+}
+
+// defaultBatchSize returns the Conn's BatchSize when not set by
+// Options.ReceiveBatchSize.
+func defaultBatchSize() int {
+	if batchingSupported() {
+		return conn.IdealBatchSize
+	}
+	return 1
 }
 
 // tryUpgradeToBatchingUDPConn probes the capabilities of the OS and pconn, and
-// upgrades pconn to a *batchingUDPConn if appropriate.
-func tryUpgradeToBatchingUDPConn(pconn nettype.PacketConn, network string, batchSize int) nettype.PacketConn {
+// upgrades pconn to a *batchingUDPConn if appropriate, doing its batched I/O
+// with backend if possible. Falling back from backend is logged to logf, if
+// non-nil.
+func tryUpgradeToBatchingUDPConn(pconn nettype.PacketConn, network string, batchSize int, backend UDPIOBackend, logf logger.Logf) nettype.PacketConn {
 	if network != "udp4" && network != "udp6" {
 		return pconn
 	}
-	if runtime.GOOS != "linux" {
+	if !batchingSupported() || batchSize < 2 {
 		return pconn
 	}
-	if strings.HasPrefix(hostinfo.GetOSVersion(), "2.") {
+	if runtime.GOOS == "linux" && strings.HasPrefix(hostinfo.GetOSVersion(), "2.") {
 		// recvmmsg/sendmmsg were added in 2.6.33, but we support down to
 		// 2.6.32 for old NAS devices. See https://github.com/tailscale/tailscale/issues/6807.
 		// As a cheap heuristic: if the Linux kernel starts with "2", just
@@ -2572,6 +3745,7 @@ func tryUpgradeToBatchingUDPConn(pconn nettype.PacketConn, network string, batch
 	}
 	b := &batchingUDPConn{
 		pc:                    pconn,
+		rxTune:                newBatchTuner(batchSize),
 		getGSOSizeFromControl: getGSOSizeFromControl,
 		setGSOSizeInControl:   setGSOSizeInControl,
 		sendBatchPool: sync.Pool{
@@ -2600,6 +3774,29 @@ func tryUpgradeToBatchingUDPConn(pconn nettype.PacketConn, network string, batch
 	default:
 		panic("bogus network")
 	}
+	if msgXSupported {
+		xpc, err := newMsgXConn(uc)
+		if err != nil {
+			if logf != nil {
+				logf("magicsock: %s: recvmsg_x unavailable, not batching UDP I/O: %v", network, err)
+			}
+			return pconn
+		}
+		b.xpc = xpc
+	}
+	switch backend {
+	case UDPIODefault:
+	case UDPIOURing:
+		if xpc, err := newIOURingConn(uc, network); err == nil {
+			b.xpc = xpc
+		} else if logf != nil {
+			logf("magicsock: %s: io_uring unavailable, using default UDP I/O: %v", network, err)
+		}
+	default:
+		if logf != nil {
+			logf("magicsock: %s: UDP I/O backend %q unsupported, using default", network, backend)
+		}
+	}
 	var txOffload bool
 	txOffload, b.rxOffload = tryEnableUDPOffload(uc)
 	b.txOffload.Store(txOffload)
@@ -2664,6 +3861,7 @@ func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 			ps := &ipnstate.PeerStatus{InMagicSock: true}
 			//ps.Addrs = append(ps.Addrs, n.Endpoints...)
 			ep.populatePeerStatus(ps)
+			ps.SharedDiscoKey = c.peerMap.discoKeyShared(ep)
 			sb.AddPeer(ep.publicKey, ps)
 		})
 	}
@@ -2712,6 +3910,11 @@ func (c *Conn) SetStatistics(stats *connstats.Statistics) {
 	// endpoint after we last see it. This is intentionally chosen to be
 	// slightly longer than a full netcheck period.
 	endpointTrackerLifetime = 5*time.Minute + 10*time.Second
+
+	// discoDERPQueueTimeout is how long a disco message waits for room
+	// in a full DERP write queue before it's dropped. See
+	// Conn.SendWithContext.
+	discoDERPQueueTimeout = time.Second
 )
 
 // Constants that are variable for testing.
@@ -2735,7 +3938,11 @@ func (c *Conn) SetStatistics(stats *connstats.Statistics) {
 // already instantiated it returns the existing one.
 func (c *Conn) getPinger() *ping.Pinger {
 	return c.wgPinger.Get(func() *ping.Pinger {
-		return ping.New(c.connCtx, c.dlogf, netns.Listener(c.logf, c.netMon))
+		p := ping.New(c.connCtx, c.dlogf, netns.Listener(c.logf, c.netMon))
+		// Without raw sockets (such as when not running as root),
+		// probe WireGuard only peers with datagram ICMP sockets.
+		p.Unprivileged = true
+		return p
 	})
 }
 
@@ -2794,6 +4001,23 @@ type discoInfo struct {
 
 	// lastPingTime is the last time of a ping for discoKey.
 	lastPingTime time.Time
+
+	// plainUntil, if non-zero, is when to retry obfuscating disco
+	// messages to the peer over UDP, after falling back to plain ones.
+	// See DiscoObfuscation.
+	plainUntil mono.Time
+
+	// obfuscatedUnanswered is the number of obfuscated pings sent to
+	// the peer since an obfuscated message was last received from it.
+	obfuscatedUnanswered int
+
+	// peerObfuscates is whether the last disco message received from
+	// the peer over UDP was obfuscated.
+	peerObfuscates bool
+
+	// peerCaps are the disco capabilities advertised in the peer's last
+	// ping; zero if none. See peerHasDiscoCapLocked.
+	peerCaps disco.Capability
 }
 
 type endpointTrackerEntry struct {
@@ -2842,6 +4066,42 @@ func (et *endpointTracker) update(now time.Time, eps []tailcfg.Endpoint) (epsPlu
 	return epsPlusCached
 }
 
+// withdraw removes the cached endpoints that aren't in eps, the ones just
+// observed, and for which dead returns true. It returns the removed
+// endpoints.
+func (et *endpointTracker) withdraw(eps []tailcfg.Endpoint, dead func(tailcfg.Endpoint) bool) (withdrawn []tailcfg.Endpoint) {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	for k, entry := range et.cache {
+		if slices.ContainsFunc(eps, func(ep tailcfg.Endpoint) bool { return ep.Addr == k }) {
+			continue
+		}
+		if dead(entry.endpoint) {
+			delete(et.cache, k)
+			withdrawn = append(withdrawn, entry.endpoint)
+		}
+	}
+	return withdrawn
+}
+
+// probeContradicts reports whether ep, a cached endpoint that wasn't
+// re-observed, is contradicted by this endpoint update's probes: nr, the
+// netcheck report, and whether a port mapping was found. That's when the
+// probe that would have found ep succeeded with a different answer,
+// rather than failing.
+func probeContradicts(ep tailcfg.Endpoint, nr *netcheck.Report, havePortmap bool) bool {
+	switch ep.Type {
+	case tailcfg.EndpointPortmapped:
+		return havePortmap
+	case tailcfg.EndpointSTUN, tailcfg.EndpointSTUN4LocalPort:
+		if ep.Addr.Addr().Is4() {
+			return nr.IPv4 && nr.GlobalV4 != ""
+		}
+		return nr.IPv6 && nr.GlobalV6 != ""
+	}
+	return false
+}
+
 // add will store the provided endpoint(s) in the cache for a fixed period of
 // time, and remove any entries in the cache that have expired.
 //
@@ -2873,19 +4133,32 @@ func (et *endpointTracker) removeExpiredLocked(now time.Time) {
 	metricNumPeers     = clientmetric.NewGauge("magicsock_netmap_num_peers")
 	metricNumDERPConns = clientmetric.NewGauge("magicsock_num_derp_conns")
 
+	// metricNetmapPeersUnchanged counts the peers SetNetworkMap skipped
+	// because their node was shared with the last network map.
+	metricNetmapPeersUnchanged = clientmetric.NewCounter("magicsock_netmap_peers_unchanged")
+
 	metricRebindCalls     = clientmetric.NewCounter("magicsock_rebind_calls")
 	metricReSTUNCalls     = clientmetric.NewCounter("magicsock_restun_calls")
 	metricUpdateEndpoints = clientmetric.NewCounter("magicsock_update_endpoints")
+	metricCloseTimeouts   = clientmetric.NewCounter("magicsock_close_timeouts")
+
+	metricEndpointsWithdrawn = clientmetric.NewCounter("magicsock_endpoints_withdrawn")
 
 	// Sends (data or disco)
 	metricSendDERPQueued      = clientmetric.NewCounter("magicsock_send_derp_queued")
 	metricSendDERPErrorChan   = clientmetric.NewCounter("magicsock_send_derp_error_chan")
 	metricSendDERPErrorClosed = clientmetric.NewCounter("magicsock_send_derp_error_closed")
 	metricSendDERPErrorQueue  = clientmetric.NewCounter("magicsock_send_derp_error_queue")
+	metricSendDERPQueueWait   = clientmetric.NewCounter("magicsock_send_derp_queue_wait")
 	metricSendUDP             = clientmetric.NewCounter("magicsock_send_udp")
 	metricSendUDPError        = clientmetric.NewCounter("magicsock_send_udp_error")
 	metricSendDERP            = clientmetric.NewCounter("magicsock_send_derp")
 	metricSendDERPError       = clientmetric.NewCounter("magicsock_send_derp_error")
+	metricSendDERPDiscoLane   = clientmetric.NewCounter("magicsock_send_derp_disco_lane")
+
+	// metricGSODisabledPeers is how many times UDP send coalescing was
+	// disabled for a peer after repeated coalesced send failures.
+	metricGSODisabledPeers = clientmetric.NewCounter("magicsock_gso_disabled_peers")
 
 	// Data packets (non-disco)
 	metricSendData            = clientmetric.NewCounter("magicsock_send_data")
@@ -2895,16 +4168,31 @@ func (et *endpointTracker) removeExpiredLocked(now time.Time) {
 	metricRecvDataIPv6        = clientmetric.NewCounter("magicsock_recv_data_ipv6")
 
 	// Disco packets
-	metricSendDiscoUDP         = clientmetric.NewCounter("magicsock_disco_send_udp")
-	metricSendDiscoDERP        = clientmetric.NewCounter("magicsock_disco_send_derp")
-	metricSentDiscoUDP         = clientmetric.NewCounter("magicsock_disco_sent_udp")
-	metricSentDiscoDERP        = clientmetric.NewCounter("magicsock_disco_sent_derp")
-	metricSentDiscoPing        = clientmetric.NewCounter("magicsock_disco_sent_ping")
-	metricSentDiscoPong        = clientmetric.NewCounter("magicsock_disco_sent_pong")
-	metricSentDiscoCallMeMaybe = clientmetric.NewCounter("magicsock_disco_sent_callmemaybe")
-	metricRecvDiscoBadPeer     = clientmetric.NewCounter("magicsock_disco_recv_bad_peer")
-	metricRecvDiscoBadKey      = clientmetric.NewCounter("magicsock_disco_recv_bad_key")
-	metricRecvDiscoBadParse    = clientmetric.NewCounter("magicsock_disco_recv_bad_parse")
+	metricSendDiscoUDP            = clientmetric.NewCounter("magicsock_disco_send_udp")
+	metricSendDiscoDERP           = clientmetric.NewCounter("magicsock_disco_send_derp")
+	metricSentDiscoUDP            = clientmetric.NewCounter("magicsock_disco_sent_udp")
+	metricSentDiscoDERP           = clientmetric.NewCounter("magicsock_disco_sent_derp")
+	metricSentDiscoPing           = clientmetric.NewCounter("magicsock_disco_sent_ping")
+	metricSentDiscoPong           = clientmetric.NewCounter("magicsock_disco_sent_pong")
+	metricSentDiscoCallMeMaybe    = clientmetric.NewCounter("magicsock_disco_sent_callmemaybe")
+	metricSendDiscoCallMeMaybeUDP = clientmetric.NewCounter("magicsock_disco_send_callmemaybe_udp")
+	metricRecvDiscoBadPeer        = clientmetric.NewCounter("magicsock_disco_recv_bad_peer")
+	metricRecvDiscoBadKey         = clientmetric.NewCounter("magicsock_disco_recv_bad_key")
+	metricRecvDiscoBadParse       = clientmetric.NewCounter("magicsock_disco_recv_bad_parse")
+	metricRecvDiscoUnknownType    = clientmetric.NewCounter("magicsock_disco_recv_unknown_type")
+
+	// metricRecvDiscoRejected counts disco messages dropped for an
+	// invalid source address or a box too short to open, and
+	// metricRecvDiscoRateLimited those over their source's receive
+	// limit. See discoRecvLimiter.
+	metricRecvDiscoRejected    = clientmetric.NewCounter("magicsock_disco_recv_rejected")
+	metricRecvDiscoRateLimited = clientmetric.NewCounter("magicsock_disco_recv_ratelimited")
+
+	// metricDiscoSendThrottledGlobal and metricDiscoSendThrottledPeer
+	// count disco messages dropped by the process-wide and per-peer
+	// send limits, respectively. See SetDiscoSendLimits.
+	metricDiscoSendThrottledGlobal = clientmetric.NewCounter("magicsock_disco_send_throttled_global")
+	metricDiscoSendThrottledPeer   = clientmetric.NewCounter("magicsock_disco_send_throttled_peer")
 
 	metricRecvDiscoUDP                 = clientmetric.NewCounter("magicsock_disco_recv_udp")
 	metricRecvDiscoDERP                = clientmetric.NewCounter("magicsock_disco_recv_derp")
@@ -2913,8 +4201,60 @@ func (et *endpointTracker) removeExpiredLocked(now time.Time) {
 	metricRecvDiscoCallMeMaybe         = clientmetric.NewCounter("magicsock_disco_recv_callmemaybe")
 	metricRecvDiscoCallMeMaybeBadNode  = clientmetric.NewCounter("magicsock_disco_recv_callmemaybe_bad_node")
 	metricRecvDiscoCallMeMaybeBadDisco = clientmetric.NewCounter("magicsock_disco_recv_callmemaybe_bad_disco")
+	metricRecvDiscoCallMeMaybeUDP      = clientmetric.NewCounter("magicsock_disco_recv_callmemaybe_udp")
+	metricRecvDiscoCallMeMaybeBadUDP   = clientmetric.NewCounter("magicsock_disco_recv_callmemaybe_bad_udp")
+	metricRecvDiscoPortPredict         = clientmetric.NewCounter("magicsock_disco_recv_port_predict")
 	metricRecvDiscoDERPPeerNotHere     = clientmetric.NewCounter("magicsock_disco_recv_derp_peer_not_here")
 	metricRecvDiscoDERPPeerGoneUnknown = clientmetric.NewCounter("magicsock_disco_recv_derp_peer_gone_unknown")
+
+	// metricDiscoKeyShared counts the nodes found to share a disco key
+	// with another node, and metricRecvDiscoPingAmbiguous the pings
+	// from such a key that couldn't be attributed to one of its nodes.
+	// metricRecvDiscoPongUnknownTx counts pongs matching no ping sent
+	// to their sender.
+	metricDiscoKeyShared         = clientmetric.NewCounter("magicsock_disco_key_shared")
+	metricRecvDiscoPingAmbiguous = clientmetric.NewCounter("magicsock_disco_recv_ping_ambiguous")
+	metricRecvDiscoPongUnknownTx = clientmetric.NewCounter("magicsock_disco_recv_pong_unknown_tx")
+
+	// Disco obfuscation. See DiscoObfuscation.
+	metricSendDiscoObfuscated      = clientmetric.NewCounter("magicsock_disco_send_obfuscated")
+	metricRecvDiscoObfuscated      = clientmetric.NewCounter("magicsock_disco_recv_obfuscated")
+	metricRecvDiscoPlainDropped    = clientmetric.NewCounter("magicsock_disco_recv_plain_dropped")
+	metricDiscoObfuscationFallback = clientmetric.NewCounter("magicsock_disco_obfuscation_fallback")
+	metricSendHandshakePadded      = clientmetric.NewCounter("magicsock_send_handshake_padded")
+
+	// metricSendUDPBatchPaced and metricSendUDPBatchImmediate count the
+	// UDP batches sent paced and, with pacing enabled, those small
+	// enough to be sent at once. See SendPacing.
+	metricSendUDPBatchPaced     = clientmetric.NewCounter("magicsock_send_udp_batch_paced")
+	metricSendUDPBatchImmediate = clientmetric.NewCounter("magicsock_send_udp_batch_immediate")
+
+	// metricLearnedPathTried and metricLearnedPathConfirmed count the
+	// paths from SetLearnedPaths tried first, and those then confirmed
+	// by a pong.
+	metricLearnedPathTried     = clientmetric.NewCounter("magicsock_learned_path_tried")
+	metricLearnedPathConfirmed = clientmetric.NewCounter("magicsock_learned_path_confirmed")
+
+	// metricDERPRouteFromData counts the DERP routes learned from data
+	// packets, metricDERPRouteVerifyPing the pings sent to verify them,
+	// and metricDERPRouteVerifyFailed the routes forgotten after those
+	// pings timed out.
+	metricDERPRouteFromData     = clientmetric.NewCounter("magicsock_derp_route_from_data")
+	metricDERPRouteVerifyPing   = clientmetric.NewCounter("magicsock_derp_route_verify_ping")
+	metricDERPRouteVerifyFailed = clientmetric.NewCounter("magicsock_derp_route_verify_failed")
+
+	// metricSendMultipathDup counts the packets duplicated on a peer's
+	// previous path. See SetMultipathWindow.
+	metricSendMultipathDup = clientmetric.NewCounter("magicsock_send_multipath_dup")
+
+	// metricWireGuardOnlyPong and metricWireGuardOnlyPingLost count the
+	// ICMP pings to WireGuard only peers' endpoints that were answered
+	// and that timed out, and metricWireGuardOnlyEndpointChange how many
+	// times such a peer was switched to another of its endpoints.
+	metricWireGuardOnlyPong           = clientmetric.NewCounter("magicsock_wireguard_only_pong")
+	metricWireGuardOnlyPingLost       = clientmetric.NewCounter("magicsock_wireguard_only_ping_lost")
+	metricWireGuardOnlyEndpointChange = clientmetric.NewCounter("magicsock_wireguard_only_endpoint_change")
+
 	// metricDERPHomeChange is how many times our DERP home region DI has
 	// changed from non-zero to a different non-zero.
 	metricDERPHomeChange = clientmetric.NewCounter("derp_home_change")
@@ -8,6 +8,7 @@
 import (
 	"errors"
 	"io"
+	"net"
 
 	"tailscale.com/types/logger"
 	"tailscale.com/types/nettype"
@@ -34,3 +35,14 @@ func setGSOSizeInControl(control *[]byte, gso uint16) {}
 const (
 	controlMessageSize = 0
 )
+
+// ioURingConn is only implemented on Linux.
+type ioURingConn struct {
+	xnetBatchReaderWriter
+}
+
+func newIOURingConn(*net.UDPConn, string) (*ioURingConn, error) {
+	return nil, errors.New("io_uring is only supported on Linux")
+}
+
+func (c *ioURingConn) release() {}
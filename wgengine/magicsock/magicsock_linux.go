@@ -258,6 +258,9 @@ func (c *Conn) receiveDisco(pc net.PacketConn, isIPV6 bool) {
 			metricRecvDiscoPacketIPv6.Add(1)
 		}
 
+		if c.classifyRecv(buf[udpHeaderSize:n], discoRXPathRawSocket) != packetDisco {
+			continue
+		}
 		c.handleDiscoMessage(buf[udpHeaderSize:n], netip.AddrPortFrom(srcIP, srcPort), key.NodePublic{}, discoRXPathRawSocket)
 	}
 }
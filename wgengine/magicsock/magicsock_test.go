@@ -10,10 +10,13 @@
 	crand "crypto/rand"
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"net/http"
@@ -26,6 +29,7 @@
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 	"unsafe"
@@ -45,17 +49,24 @@
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/disco"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/metrics"
 	"tailscale.com/net/connstats"
+	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netaddr"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/net/neterror"
 	"tailscale.com/net/packet"
 	"tailscale.com/net/ping"
+	"tailscale.com/net/stun"
 	"tailscale.com/net/stun/stuntest"
 	"tailscale.com/net/tstun"
 	"tailscale.com/net/wsconn"
+	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/tstest/natlab"
 	"tailscale.com/tstime/mono"
+	"tailscale.com/tstime/rate"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netlogtype"
@@ -63,7 +74,11 @@
 	"tailscale.com/types/nettype"
 	"tailscale.com/types/ptr"
 	"tailscale.com/util/cibuild"
+	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/racebuild"
+	"tailscale.com/util/ringbuffer"
+	"tailscale.com/util/set"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/wgcfg"
 	"tailscale.com/wgengine/wgcfg/nmcfg"
@@ -1828,7 +1843,21 @@ func randNodeKey() (k key.NodePublic)   { return key.NewNode().Public() }
 // It is used in tests only, so it doesn't need to be efficient.
 func (m *peerMap) validate() error {
 	seenEps := make(map[*endpoint]bool)
-	for pub, pi := range m.byNodeKey {
+	byNodeKey := make(map[key.NodePublic]*peerInfo)
+	for i := range m.shards {
+		for pub, pi := range m.shards[i].byNodeKey {
+			if m.shard(pub) != &m.shards[i] {
+				return fmt.Errorf("byNodeKey[%v] in wrong shard %d", pub, i)
+			}
+			byNodeKey[pub] = pi
+		}
+	}
+	byIPPort := make(map[netip.AddrPort]*peerInfo)
+	m.byIPPort.Range(func(k, v any) bool {
+		byIPPort[k.(netip.AddrPort)] = v.(*peerInfo)
+		return true
+	})
+	for pub, pi := range byNodeKey {
 		if got := pi.ep.publicKey; got != pub {
 			return fmt.Errorf("byNodeKey[%v].publicKey = %v", pub, got)
 		}
@@ -1840,17 +1869,17 @@ func (m *peerMap) validate() error {
 			if !v {
 				return fmt.Errorf("m.byIPPort[%v] is false, expected map to be set-like", ipp)
 			}
-			if got := m.byIPPort[ipp]; got != pi {
+			if got := byIPPort[ipp]; got != pi {
 				return fmt.Errorf("m.byIPPort[%v] = %v, want %v", ipp, got, pi)
 			}
 		}
 	}
 
-	for ipp, pi := range m.byIPPort {
+	for ipp, pi := range byIPPort {
 		if !pi.ipPorts[ipp] {
 			return fmt.Errorf("ipPorts[%v] for %v is false", ipp, pi.ep.publicKey)
 		}
-		pi2 := m.byNodeKey[pi.ep.publicKey]
+		pi2 := byNodeKey[pi.ep.publicKey]
 		if pi != pi2 {
 			return fmt.Errorf("byNodeKey[%v]=%p doesn't match byIPPort[%v]=%p", pi, pi, pi.ep.publicKey, pi2)
 		}
@@ -1862,7 +1891,7 @@ func (m *peerMap) validate() error {
 			if !v {
 				return fmt.Errorf("m.nodeOfDisco[%v][%v] is false, expected map to be set-like", disco, pub)
 			}
-			if _, ok := m.byNodeKey[pub]; !ok {
+			if _, ok := byNodeKey[pub]; !ok {
 				return fmt.Errorf("nodesOfDisco refers to public key %v, which is not present in byNodeKey", pub)
 			}
 			if _, ok := publicToDisco[pub]; ok {
@@ -1956,6 +1985,46 @@ func TestBufferedDerpWritesBeforeDrop(t *testing.T) {
 	t.Logf("bufferedDerpWritesBeforeDrop = %d", vv)
 }
 
+func TestEnqueueDerpWrite(t *testing.T) {
+	a := key.NewNode().Public()
+	b := key.NewNode().Public()
+	wr := func(k key.NodePublic, n int) derpWriteRequest {
+		return derpWriteRequest{pubKey: k, pkts: make([][]byte, n)}
+	}
+
+	tests := []struct {
+		policy    DERPDropPolicy
+		wantErr   error
+		wantQueue key.NodePublic // pubKey of the request left queued
+		wantDrops map[key.NodePublic]int64
+	}{
+		{DERPDropNewest, errDropDerpPacket, a, map[key.NodePublic]int64{b: 3}},
+		{DERPDropOldest, nil, b, map[key.NodePublic]int64{a: 2}},
+		{DERPBlock, errDropDerpPacket, a, map[key.NodePublic]int64{b: 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			c := newConn()
+			c.derpDropPolicy = tt.policy
+			c.derpBlockTimeout = time.Millisecond
+			ch := make(chan derpWriteRequest, 1)
+			if queued, err := c.enqueueDerpWrite(context.Background(), ch, wr(a, 2)); !queued || err != nil {
+				t.Fatalf("first enqueue = %v, %v; want true, nil", queued, err)
+			}
+			queued, err := c.enqueueDerpWrite(context.Background(), ch, wr(b, 3))
+			if err != tt.wantErr || queued != (err == nil) {
+				t.Errorf("second enqueue = %v, %v; want %v, %v", queued, err, tt.wantErr == nil, tt.wantErr)
+			}
+			if got := (<-ch).pubKey; got != tt.wantQueue {
+				t.Errorf("queued write for %v; want %v", got.ShortString(), tt.wantQueue.ShortString())
+			}
+			if got := c.DERPDropsByPeer(); !reflect.DeepEqual(got, tt.wantDrops) {
+				t.Errorf("DERPDropsByPeer = %v; want %v", got, tt.wantDrops)
+			}
+		})
+	}
+}
+
 func setGSOSize(control *[]byte, gsoSize uint16) {
 	*control = (*control)[:cap(*control)]
 	binary.LittleEndian.PutUint16(*control, gsoSize)
@@ -2100,10 +2169,11 @@ func Test_batchingUDPConn_coalesceMessages(t *testing.T) {
 	}
 
 	cases := []struct {
-		name     string
-		buffs    [][]byte
-		wantLens []int
-		wantGSO  []int
+		name        string
+		buffs       [][]byte
+		maxSegments int
+		wantLens    []int
+		wantGSO     []int
 	}{
 		{
 			name: "one message no coalesce",
@@ -2151,6 +2221,17 @@ func Test_batchingUDPConn_coalesceMessages(t *testing.T) {
 			wantLens: []int{4, 2},
 			wantGSO:  []int{2, 0},
 		},
+		{
+			name: "three messages max segments coalesce",
+			buffs: [][]byte{
+				make([]byte, 1, 3),
+				make([]byte, 1, 1),
+				make([]byte, 1, 1),
+			},
+			maxSegments: 2,
+			wantLens:    []int{2, 1},
+			wantGSO:     []int{1, 0},
+		},
 	}
 
 	for _, tt := range cases {
@@ -2164,7 +2245,7 @@ func Test_batchingUDPConn_coalesceMessages(t *testing.T) {
 				msgs[i].Buffers = make([][]byte, 1)
 				msgs[i].OOB = make([]byte, 0, 2)
 			}
-			got := c.coalesceMessages(addr, tt.buffs, msgs)
+			got := c.coalesceMessages(addr, tt.buffs, msgs, tt.maxSegments)
 			if got != len(tt.wantLens) {
 				t.Fatalf("got len %d want: %d", got, len(tt.wantLens))
 			}
@@ -2188,6 +2269,307 @@ func Test_batchingUDPConn_coalesceMessages(t *testing.T) {
 	}
 }
 
+// gsoTestWriter is an xnetBatchReaderWriter whose writes fail according to
+// fail, recording the length and GSO size of each msg written.
+type gsoTestWriter struct {
+	fail func(msg ipv6.Message, coalesced bool) error // or nil to accept all
+
+	mu      sync.Mutex
+	written []ipv6.Message
+}
+
+func (w *gsoTestWriter) ReadBatch([]ipv6.Message, int) (int, error) {
+	return 0, errors.New("not implemented")
+}
+
+func (w *gsoTestWriter) WriteBatch(msgs []ipv6.Message, _ int) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i, msg := range msgs {
+		gso, _ := getGSOSize(msg.OOB)
+		if w.fail != nil {
+			if err := w.fail(msg, gso > 0); err != nil {
+				return i, &os.SyscallError{Syscall: "sendmmsg", Err: err}
+			}
+		}
+		w.written = append(w.written, ipv6.Message{Buffers: [][]byte{msg.Buffers[0]}, OOB: msg.OOB})
+	}
+	return len(msgs), nil
+}
+
+// takeWritten returns the lengths of the msgs written since the last call,
+// and whether any of them were coalesced.
+func (w *gsoTestWriter) takeWritten() (lens []int, coalesced bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, msg := range w.written {
+		lens = append(lens, len(msg.Buffers[0]))
+		if gso, _ := getGSOSize(msg.OOB); gso > 0 {
+			coalesced = true
+		}
+	}
+	w.written = nil
+	return lens, coalesced
+}
+
+func newGSOTestConn(t *testing.T, w *gsoTestWriter) *batchingUDPConn {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	c := &batchingUDPConn{
+		pc:                    pc.(nettype.PacketConn),
+		xpc:                   w,
+		setGSOSizeInControl:   setGSOSize,
+		getGSOSizeFromControl: getGSOSize,
+		sendBatchPool: sync.Pool{
+			New: func() any {
+				ua := &net.UDPAddr{IP: make([]byte, 16)}
+				msgs := make([]ipv6.Message, 8)
+				for i := range msgs {
+					msgs[i].Buffers = make([][]byte, 1)
+					msgs[i].Addr = ua
+					msgs[i].OOB = make([]byte, 2)
+				}
+				return &sendBatch{ua: ua, msgs: msgs}
+			},
+		},
+	}
+	c.txOffload.Store(true)
+	return c
+}
+
+// gsoTestBuffs returns n 100 byte buffs with room for coalescing.
+func gsoTestBuffs(n int) [][]byte {
+	buffs := make([][]byte, n)
+	for i := range buffs {
+		buffs[i] = make([]byte, 100, 100*n)
+	}
+	return buffs
+}
+
+func Test_batchingUDPConn_WriteBatchTo_uncoalescedKeepsOffload(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("UDP GSO is only used on Linux")
+	}
+	w := &gsoTestWriter{
+		fail: func(ipv6.Message, bool) error { return syscall.EIO },
+	}
+	c := newGSOTestConn(t, w)
+	addr := netip.MustParseAddrPort("127.0.0.1:1")
+
+	for _, tt := range []struct {
+		name        string
+		buffs       [][]byte
+		maxSegments int
+	}{
+		{"coalescing_disabled", gsoTestBuffs(3), 1},
+		{"single_buff", gsoTestBuffs(1), 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := c.WriteBatchTo(tt.buffs, addr, tt.maxSegments)
+			if !errors.Is(err, syscall.EIO) {
+				t.Fatalf("err = %v; want EIO", err)
+			}
+			if errors.As(err, new(coalescedSendError)) {
+				t.Errorf("err = %#v; want no coalescedSendError", err)
+			}
+			if !c.txOffload.Load() {
+				t.Fatal("tx offload disabled by a send that wasn't coalesced")
+			}
+		})
+	}
+}
+
+func Test_batchingUDPConn_WriteBatchTo_disableOffload(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("UDP GSO is only used on Linux")
+	}
+	w := &gsoTestWriter{
+		fail: func(_ ipv6.Message, coalesced bool) error {
+			if coalesced {
+				return syscall.EIO
+			}
+			return nil
+		},
+	}
+	c := newGSOTestConn(t, w)
+	err := c.WriteBatchTo(gsoTestBuffs(3), netip.MustParseAddrPort("127.0.0.1:1"), 0)
+	var errGSO neterror.ErrUDPGSODisabled
+	if !errors.As(err, &errGSO) || errGSO.RetryErr != nil {
+		t.Fatalf("err = %v; want ErrUDPGSODisabled with a nil RetryErr", err)
+	}
+	if c.txOffload.Load() {
+		t.Error("tx offload still enabled")
+	}
+	if lens, coalesced := w.takeWritten(); !reflect.DeepEqual(lens, []int{100, 100, 100}) || coalesced {
+		t.Errorf("written = %v (coalesced %v); want 3 uncoalesced datagrams", lens, coalesced)
+	}
+}
+
+func TestPeerGSOSegments(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	ep := &endpoint{
+		c:                 c,
+		publicKey:         key.NewNode().Public(),
+		heartbeatDisabled: true,
+	}
+	discoKey := key.NewDisco().Public()
+	ep.disco.Store(&endpointDisco{key: discoKey, short: discoKey.ShortString()})
+	c.peerMap.upsertEndpoint(ep, key.DiscoPublic{})
+
+	if n, ok := c.PeerGSOSegments(ep.publicKey); !ok || n != 0 {
+		t.Errorf("PeerGSOSegments = %v, %v; want 0, true", n, ok)
+	}
+	if err := c.SetPeerGSOSegments(ep.publicKey, 4); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := c.PeerGSOSegments(ep.publicKey); n != 4 {
+		t.Errorf("PeerGSOSegments = %v; want 4", n)
+	}
+	if err := c.SetPeerGSOSegments(ep.publicKey, -1); err == nil {
+		t.Error("SetPeerGSOSegments accepted a negative count")
+	}
+	if n, _ := c.PeerGSOSegments(ep.publicKey); n != 4 {
+		t.Errorf("PeerGSOSegments after invalid set = %v; want 4", n)
+	}
+
+	unknown := key.NewNode().Public()
+	if err := c.SetPeerGSOSegments(unknown, 1); err == nil {
+		t.Error("SetPeerGSOSegments succeeded for an unknown peer")
+	}
+	if _, ok := c.PeerGSOSegments(unknown); ok {
+		t.Error("PeerGSOSegments reported an unknown peer")
+	}
+}
+
+func TestCoalescedSendFallback(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("UDP GSO is only used on Linux")
+	}
+	var failErr atomic.Value // of syscall.Errno, or nil
+	w := &gsoTestWriter{
+		fail: func(_ ipv6.Message, coalesced bool) error {
+			if err, _ := failErr.Load().(syscall.Errno); err != 0 && coalesced {
+				return err
+			}
+			return nil
+		},
+	}
+	bc := newGSOTestConn(t, w)
+	c := newConn()
+	c.logf = t.Logf
+	var pconn nettype.PacketConn = bc
+	c.pconn4.pconn = pconn
+	c.pconn4.pconnAtomic.Store(&pconn)
+
+	ep := &endpoint{
+		c:                  c,
+		publicKey:          key.NewNode().Public(),
+		heartbeatDisabled:  true,
+		bestAddr:           addrLatency{AddrPort: netip.MustParseAddrPort("127.0.0.1:1")},
+		trustBestAddrUntil: mono.Now().Add(time.Hour),
+	}
+	discoKey := key.NewDisco().Public()
+	ep.disco.Store(&endpointDisco{key: discoKey, short: discoKey.ShortString()})
+	c.peerMap.upsertEndpoint(ep, key.DiscoPublic{})
+
+	send := func(wantLens []int, wantCoalesced bool) {
+		t.Helper()
+		if err := ep.send(context.Background(), gsoTestBuffs(3)); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		lens, coalesced := w.takeWritten()
+		if !reflect.DeepEqual(lens, wantLens) || coalesced != wantCoalesced {
+			t.Fatalf("written = %v (coalesced %v); want %v (coalesced %v)", lens, coalesced, wantLens, wantCoalesced)
+		}
+	}
+	wantSegments := func(want int) {
+		t.Helper()
+		if n, _ := c.PeerGSOSegments(ep.publicKey); n != want {
+			t.Fatalf("PeerGSOSegments = %v; want %v", n, want)
+		}
+	}
+
+	// A non-GSO error is returned as is, without resending.
+	failErr.Store(syscall.EPERM)
+	if err := ep.send(context.Background(), gsoTestBuffs(3)); !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("send err = %v; want EPERM", err)
+	}
+	if lens, _ := w.takeWritten(); len(lens) != 0 {
+		t.Fatalf("resent %v after a non-GSO error", lens)
+	}
+
+	// A GSO error is recovered from by resending uncoalesced, once.
+	failErr.Store(syscall.EMSGSIZE)
+	for range maxCoalescedSendErrs - 1 {
+		send([]int{100, 100, 100}, false)
+	}
+	wantSegments(0)
+
+	// A successful coalesced send resets the count of failures.
+	failErr.Store(syscall.Errno(0))
+	send([]int{300}, true)
+	failErr.Store(syscall.EMSGSIZE)
+	for range maxCoalescedSendErrs - 1 {
+		send([]int{100, 100, 100}, false)
+	}
+	wantSegments(0)
+
+	// Enough consecutive failures disable coalescing for the peer,
+	// without disabling it for the socket.
+	send([]int{100, 100, 100}, false)
+	wantSegments(1)
+	if !bc.txOffload.Load() {
+		t.Error("tx offload disabled for the socket")
+	}
+	send([]int{100, 100, 100}, false)
+}
+
+func TestCoalescedSendFallbackPartial(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("UDP GSO is only used on Linux")
+	}
+	// Fail the second msg: the first, coalescing buffs 0-2, was sent,
+	// so only buffs 3 and 4 may be resent.
+	var msgs int
+	w := &gsoTestWriter{
+		fail: func(_ ipv6.Message, coalesced bool) error {
+			msgs++
+			if msgs == 2 && coalesced {
+				return syscall.EMSGSIZE
+			}
+			return nil
+		},
+	}
+	bc := newGSOTestConn(t, w)
+	c := newConn()
+	c.logf = t.Logf
+	var pconn nettype.PacketConn = bc
+	c.pconn4.pconn = pconn
+	c.pconn4.pconnAtomic.Store(&pconn)
+	ep := &endpoint{
+		c:                  c,
+		publicKey:          key.NewNode().Public(),
+		heartbeatDisabled:  true,
+		bestAddr:           addrLatency{AddrPort: netip.MustParseAddrPort("127.0.0.1:1")},
+		trustBestAddrUntil: mono.Now().Add(time.Hour),
+	}
+
+	// The short third buff ends the first coalesced msg.
+	buffs := gsoTestBuffs(5)
+	buffs[2] = buffs[2][:50]
+	if err := ep.send(context.Background(), buffs); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	lens, _ := w.takeWritten()
+	if want := []int{250, 100, 100}; !reflect.DeepEqual(lens, want) {
+		t.Errorf("written = %v; want %v", lens, want)
+	}
+}
+
 // newWireguard starts up a new wireguard-go device attached to a test tun, and
 // returns the device, tun and endpoint port. To add peers call device.IpcSet with UAPI instructions.
 func newWireguard(t *testing.T, uapi string, aips []netip.Prefix) (*device.Device, *tuntest.ChannelTUN, uint16) {
@@ -2578,7 +2960,7 @@ func TestIsWireGuardOnlyPickEndpointByPing(t *testing.T) {
 		t.Fatal("no packet after 1s")
 	}
 
-	pi, ok := m.conn.peerMap.byNodeKey[wgkey.Public()]
+	pi, ok := m.conn.peerMap.shard(wgkey.Public()).byNodeKey[wgkey.Public()]
 	if !ok {
 		t.Fatal("wgkey doesn't exist in peer map")
 	}
@@ -2641,7 +3023,7 @@ func TestIsWireGuardOnlyPickEndpointByPing(t *testing.T) {
 		t.Fatal("pingresponder response count was not 2", pr.responseCount)
 	}
 
-	pi, ok = m.conn.peerMap.byNodeKey[wgkey.Public()]
+	pi, ok = m.conn.peerMap.shard(wgkey.Public()).byNodeKey[wgkey.Public()]
 	if !ok {
 		t.Fatal("wgkey doesn't exist in peer map")
 	}
@@ -2849,6 +3231,7 @@ type endpointDetails struct {
 			isWireguardOnly: true,
 			endpointState:   map[netip.AddrPort]*endpointState{},
 			c: &Conn{
+				logf: t.Logf,
 				noV4: atomic.Bool{},
 				noV6: atomic.Bool{},
 			},
@@ -2886,12 +3269,29 @@ type endpointDetails struct {
 		if udpAddr != test.want {
 			t.Errorf("udpAddr returned is not expected: got %v, want %v", udpAddr, test.want)
 		}
-		if shouldPing {
-			t.Error("addrForSendLocked should not indicate ping is required")
+		if !shouldPing {
+			t.Error("addrForSendLocked should indicate re-probing is required")
 		}
 		if endpoint.bestAddr.AddrPort != test.want {
 			t.Errorf("bestAddr.AddrPort is not as expected: got %v, want %v", endpoint.bestAddr.AddrPort, test.want)
 		}
+
+		// Re-probing is only needed once the choice expires.
+		if _, _, shouldPing := endpoint.addrForSendLocked(testTime.Add(2*time.Minute + wireguardOnlyReprobeInterval/2)); shouldPing {
+			t.Error("addrForSendLocked indicated ping before re-probe interval")
+		}
+
+		// Once the chosen address stops answering, the other is used.
+		for i := 0; i < wireguardOnlyDeadPings; i++ {
+			endpoint.noteWireGuardOnlyPingLost(test.want)
+		}
+		if !endpoint.trustBestAddrUntil.IsZero() {
+			t.Error("dead address still trusted")
+		}
+		udpAddr, _, _ = endpoint.addrForSendLocked(testTime.Add(3 * time.Minute))
+		if udpAddr == test.want {
+			t.Errorf("addrForSendLocked = %v after it stopped answering; want failover", udpAddr)
+		}
 	}
 }
 
@@ -3129,3 +3529,3635 @@ func waitForNoEndpoints(t *testing.T, ms *Conn) {
 	}
 	t.Log("endpoints are blocked")
 }
+
+func TestDiscoSendLimiter(t *testing.T) {
+	d := newDiscoSendLimiter(DiscoSendLimits{
+		Rate:      0.001,
+		Burst:     5,
+		PeerRate:  0.001,
+		PeerBurst: 3,
+	})
+	a := key.NewDisco().Public()
+	b := key.NewDisco().Public()
+	c := key.NewDisco().Public()
+
+	allowed := func(k key.DiscoPublic, n int) (got int) {
+		for range n {
+			if d.allow(k) {
+				got++
+			}
+		}
+		return got
+	}
+	// A single peer is capped at its own burst, leaving the rest of
+	// the global budget for others.
+	if got := allowed(a, 10); got != 3 {
+		t.Errorf("peer a allowed %d; want 3", got)
+	}
+	if got := allowed(b, 10); got != 2 {
+		t.Errorf("peer b allowed %d; want 2 (remaining global budget)", got)
+	}
+	if got := allowed(c, 1); got != 0 {
+		t.Errorf("peer c allowed %d; want 0 (global budget exhausted)", got)
+	}
+
+	// Messages dropped by the global limit don't spend their peer's
+	// budget: once the global bucket refills, c still has its burst.
+	d.mu.Lock()
+	d.global = rate.NewLimiter(0.001, 5)
+	d.mu.Unlock()
+	if got := allowed(c, 10); got != 3 {
+		t.Errorf("peer c allowed %d after global refill; want 3", got)
+	}
+
+	d.set(DiscoSendLimits{})
+	if got := allowed(a, 100); got != 100 {
+		t.Errorf("unlimited: allowed %d; want 100", got)
+	}
+}
+
+func TestEndpointChangeWhen(t *testing.T) {
+	de := &endpoint{c: &Conn{}, debugUpdates: ringbuffer.New[EndpointChange](2)}
+	before := time.Now()
+	de.addDebugUpdate(EndpointChange{What: "test"})
+	chs := de.debugUpdates.GetAll()
+	if len(chs) != 1 {
+		t.Fatalf("got %d changes; want 1", len(chs))
+	}
+	ch := chs[0]
+	if ch.WhenMono.IsZero() || !ch.When.Equal(ch.WhenMono.Wall) {
+		t.Errorf("When = %v, WhenMono = %v; want both set to the same instant", ch.When, ch.WhenMono)
+	}
+	if ch.When.Before(before.Round(0)) {
+		t.Errorf("When = %v; want at or after %v", ch.When, before)
+	}
+
+	// When is still encoded as a plain time, for existing consumers.
+	b, err := json.Marshal(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct{ When time.Time }
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("decoding %s: %v", b, err)
+	}
+	if !got.When.Equal(ch.When) {
+		t.Errorf("decoded When = %v; want %v", got.When, ch.When)
+	}
+}
+
+func TestConnClock(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	c := &Conn{clock: clock, logf: logger.Discard}
+
+	m0 := c.monoNow()
+	clock.Advance(time.Minute)
+	if got := c.monoNow().Sub(m0); got != time.Minute {
+		t.Errorf("monoNow advanced %v; want 1m", got)
+	}
+
+	fired := make(chan bool, 1)
+	c.afterFunc(time.Second, func() {
+		c.now() // mustn't deadlock
+		fired <- true
+	})
+	clock.Advance(time.Second)
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("afterFunc didn't fire when the clock advanced")
+	}
+
+	// Trust in a peer's UDP address expires by the Conn's clock.
+	udp := netip.MustParseAddrPort("1.2.3.4:567")
+	derp := netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 1)
+	de := &endpoint{
+		c:                  c,
+		derpAddr:           derp,
+		bestAddr:           addrLatency{AddrPort: udp},
+		trustBestAddrUntil: c.monoNow().Add(trustUDPAddrDuration),
+	}
+	if gotUDP, gotDERP, _ := de.addrForSendLocked(c.monoNow()); gotUDP != udp || gotDERP.IsValid() {
+		t.Errorf("before expiry: addrForSendLocked = %v, %v; want %v, none", gotUDP, gotDERP, udp)
+	}
+	clock.Advance(trustUDPAddrDuration + derpFallbackGrace + time.Second)
+	if gotUDP, gotDERP, _ := de.addrForSendLocked(c.monoNow()); gotUDP != udp || gotDERP != derp {
+		t.Errorf("after expiry: addrForSendLocked = %v, %v; want %v, %v", gotUDP, gotDERP, udp, derp)
+	}
+}
+
+func TestStartPacketCapture(t *testing.T) {
+	c := newConn()
+	var buf bytes.Buffer
+	stop := c.StartPacketCapture(&buf, CaptureOpts{Data: true, HeadersOnly: true})
+	headerLen := buf.Len()
+
+	addr := netip.MustParseAddrPort("1.2.3.4:567")
+	data := make([]byte, 100)
+	data[0] = device.MessageTransportType
+	c.captureWireGuard(capture.PathWireGuardToPeer, addr, key.NodePublic{}, data)
+	wgLen := buf.Len() - headerLen
+	c.captureDisco(capture.PathDiscoToPeer, addr, key.NodePublic{}, []byte("disco"))
+	if buf.Len() == headerLen+wgLen {
+		t.Fatal("disco message not captured")
+	}
+	// The WireGuard packet's 100 bytes should have been cut to its header.
+	if wgLen >= 100 {
+		t.Errorf("captured WireGuard packet block is %d bytes; want its payload omitted", wgLen)
+	}
+
+	stop()
+	n := buf.Len()
+	c.captureDisco(capture.PathDisco, addr, key.NodePublic{}, []byte("disco"))
+	if buf.Len() != n {
+		t.Error("captured a packet after stop")
+	}
+}
+
+func TestSilentDiscoPings(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	c := newConn()
+	c.logf = t.Logf
+	c.clock = clock
+	c.closed = true // don't actually send the pings
+
+	udp := netip.MustParseAddrPort("1.2.3.4:567")
+	other := netip.MustParseAddrPort("5.6.7.8:910")
+	de := &endpoint{
+		c:                 c,
+		publicKey:         key.NewNode().Public(),
+		heartbeatDisabled: true,
+		sentPing:          map[stun.TxID]sentPing{},
+		endpointState: map[netip.AddrPort]*endpointState{
+			udp:   {},
+			other: {},
+		},
+		bestAddr:           addrLatency{AddrPort: udp, latency: time.Millisecond},
+		trustBestAddrUntil: c.monoNow().Add(time.Hour),
+		lastFullPing:       c.monoNow(),
+	}
+	discoKey := key.NewDisco().Public()
+	de.disco.Store(&endpointDisco{key: discoKey, short: discoKey.ShortString()})
+
+	// send is what endpoint.send does when sending to udp. Pings time
+	// out by the clock, which takes de.mu, so it's only held while
+	// sending.
+	send := func() mono.Time {
+		de.mu.Lock()
+		defer de.mu.Unlock()
+		now := c.monoNow()
+		de.sendSilentDiscoPingsLocked(udp, now)
+		return now
+	}
+	lastPings := func() (udpPing, otherPing mono.Time) {
+		de.mu.Lock()
+		defer de.mu.Unlock()
+		return de.endpointState[udp].lastPing, de.endpointState[other].lastPing
+	}
+
+	t0 := send()
+	if u, o := lastPings(); u != t0 || !o.IsZero() {
+		t.Fatalf("first send: pinged udp at %v, other at %v; want only udp, at %v", u, o, t0)
+	}
+
+	// Another send within heartbeatInterval doesn't ping again.
+	clock.Advance(heartbeatInterval / 2)
+	send()
+	if u, o := lastPings(); u != t0 || !o.IsZero() {
+		t.Fatalf("second send: pinged udp at %v, other at %v; want no new pings", u, o)
+	}
+
+	// Once the path is known to be slow, a send after upgradeInterval
+	// looks for a better one.
+	de.mu.Lock()
+	de.bestAddr.latency = time.Second
+	de.mu.Unlock()
+	clock.Advance(upgradeInterval)
+	t2 := send()
+	if u, o := lastPings(); u != t2 || o != t2 {
+		t.Fatalf("after upgradeInterval: pinged udp at %v, other at %v; want both at %v", u, o, t2)
+	}
+}
+
+func TestSetPeerKeepaliveInterval(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	known := key.NewNode().Public()
+	unknown := key.NewNode().Public()
+
+	de := &endpoint{c: c, publicKey: known}
+	discoKey := key.NewDisco().Public()
+	de.disco.Store(&endpointDisco{key: discoKey, short: discoKey.ShortString()})
+	c.peerMap.upsertEndpoint(de, key.DiscoPublic{})
+
+	interval := func() time.Duration {
+		de.mu.Lock()
+		defer de.mu.Unlock()
+		return de.heartbeatIntervalLocked()
+	}
+	if got := interval(); got != heartbeatInterval {
+		t.Errorf("default interval = %v; want %v", got, heartbeatInterval)
+	}
+	c.SetPeerKeepaliveInterval(known, time.Minute)
+	if got := interval(); got != time.Minute {
+		t.Errorf("interval = %v; want 1m", got)
+	}
+	c.SetPeerKeepaliveInterval(known, 0)
+	if got := interval(); got != heartbeatInterval {
+		t.Errorf("reset interval = %v; want %v", got, heartbeatInterval)
+	}
+
+	// Intervals for peers not yet known are kept for when they are.
+	c.SetPeerKeepaliveInterval(unknown, 30*time.Second)
+	if got := c.peerKeepalive[unknown]; got != 30*time.Second {
+		t.Errorf("pending interval = %v; want 30s", got)
+	}
+	if _, ok := c.peerKeepalive[known]; ok {
+		t.Error("reset interval still recorded")
+	}
+}
+
+// ipv4PathSelector is a PathSelector preferring IPv4 paths, then lower
+// latency.
+type ipv4PathSelector struct{}
+
+func (ipv4PathSelector) Better(_ key.NodePublic, a, b Path) bool {
+	if a.Addr.Addr().Is4() != b.Addr.Addr().Is4() {
+		return a.Addr.Addr().Is4()
+	}
+	return a.Latency < b.Latency
+}
+
+func (ipv4PathSelector) BestWireGuardOnly(_ key.NodePublic, paths []Path) (Path, bool) {
+	return Path{}, false
+}
+
+func TestPathSelector(t *testing.T) {
+	v4 := addrLatency{netip.MustParseAddrPort("1.2.3.4:1"), 50 * time.Millisecond}
+	v6 := addrLatency{netip.MustParseAddrPort("[2001:db8::1]:1"), 10 * time.Millisecond}
+
+	de := &endpoint{c: &Conn{}}
+	if de.betterAddrLocked(v4, v6) || !de.betterAddrLocked(v6, v4) {
+		t.Error("default selector didn't prefer the faster IPv6 path")
+	}
+	if !de.betterAddrLocked(v4, addrLatency{}) {
+		t.Error("default selector didn't prefer a path to none")
+	}
+
+	de.c.pathSelector = ipv4PathSelector{}
+	if !de.betterAddrLocked(v4, v6) || de.betterAddrLocked(v6, v4) {
+		t.Error("custom selector didn't prefer the IPv4 path")
+	}
+	if de.betterAddrLocked(v4, v4) {
+		t.Error("path is better than itself")
+	}
+
+	best, ok := LatencyPathSelector{}.BestWireGuardOnly(key.NodePublic{}, []Path{
+		{Addr: v4.AddrPort, Latency: 10 * time.Millisecond},
+		{Addr: v6.AddrPort, Latency: 10 * time.Millisecond},
+		{Addr: netip.MustParseAddrPort("5.6.7.8:1"), Latency: 20 * time.Millisecond},
+	})
+	if !ok || best.Addr != v6.AddrPort {
+		t.Errorf("BestWireGuardOnly = %v, %v; want %v", best, ok, v6.AddrPort)
+	}
+	if _, ok := (LatencyPathSelector{}).BestWireGuardOnly(key.NodePublic{}, nil); ok {
+		t.Error("BestWireGuardOnly of no paths succeeded")
+	}
+}
+
+func TestEndpointStateLoss(t *testing.T) {
+	st := new(endpointState)
+	if _, ok := st.lossLocked(); ok {
+		t.Fatal("loss known before any pings")
+	}
+	for i := 0; i < 4; i++ {
+		st.addPingResultLocked(i == 0)
+	}
+	if loss, ok := st.lossLocked(); !ok || loss != 25 {
+		t.Errorf("loss = %v, %v; want 25, true", loss, ok)
+	}
+	// Fill the window with pongs, pushing the loss out of it.
+	for i := 0; i < pingLossWindow; i++ {
+		st.addPingResultLocked(false)
+	}
+	if loss, ok := st.lossLocked(); !ok || loss != 0 {
+		t.Errorf("loss = %v, %v; want 0, true", loss, ok)
+	}
+	st.addPingResultLocked(true)
+	if loss, _ := st.lossLocked(); loss != 100.0/pingLossWindow {
+		t.Errorf("loss = %v; want %v", loss, 100.0/pingLossWindow)
+	}
+}
+
+func TestStaticEndpoints(t *testing.T) {
+	static := netip.MustParseAddrPort("203.0.113.1:41641")
+	conn, err := NewConn(Options{
+		Logf:                   t.Logf,
+		TestOnlyPacketListener: localhostListener{},
+		StaticEndpoints:        []netip.AddrPort{static},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	hasStatic := func() bool {
+		t.Helper()
+		eps, err := conn.determineEndpoints(context.Background(), RefreshFull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ep := range eps {
+			if ep.Addr == static {
+				if ep.Type != tailcfg.EndpointExplicitConf {
+					t.Errorf("static endpoint type = %v; want %v", ep.Type, tailcfg.EndpointExplicitConf)
+				}
+				return true
+			}
+		}
+		return false
+	}
+	if !hasStatic() {
+		t.Error("static endpoint not advertised")
+	}
+	conn.SetStaticEndpoints(nil)
+	if hasStatic() {
+		t.Error("static endpoint still advertised after removal")
+	}
+}
+
+func TestPacketConns(t *testing.T) {
+	pconn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint16(pconn.LocalAddr().(*net.UDPAddr).Port)
+
+	conn, err := NewConn(Options{
+		Logf:        t.Logf,
+		PacketConns: PacketConns{UDP4: pconn},
+	})
+	if err != nil {
+		pconn.Close()
+		t.Fatal(err)
+	}
+	if got := conn.LocalPort(); got != port {
+		t.Errorf("LocalPort = %d; want provided socket's port %d", got, port)
+	}
+
+	conn.Rebind()
+	conn.SetPreferredPort(port + 1)
+	if got := conn.LocalPort(); got != port {
+		t.Errorf("LocalPort after rebind = %d; want %d", got, port)
+	}
+	if _, err := pconn.WriteToUDPAddrPort([]byte("x"), pconn.LocalAddr().(*net.UDPAddr).AddrPort()); err != nil {
+		t.Errorf("provided socket unusable after rebind: %v", err)
+	}
+
+	conn.Close()
+	if _, err := pconn.WriteToUDPAddrPort([]byte("x"), pconn.LocalAddr().(*net.UDPAddr).AddrPort()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write to provided socket after Close = %v; want %v", err, net.ErrClosed)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	derpMap, cleanup := runDERPAndStun(t, t.Logf, localhostListener{}, netaddr.IPv4(127, 0, 0, 1))
+	defer cleanup()
+
+	m := newMagicStack(t, t.Logf, localhostListener{}, derpMap)
+	defer m.Close()
+
+	rep, err := m.conn.SelfTest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.NetCheck == nil || !rep.NetCheck.UDP {
+		t.Errorf("netcheck failed: %+v", rep.NetCheck)
+	}
+	if rr, ok := rep.DERP[1]; !ok || rr.Error != "" {
+		t.Errorf("DERP region 1 = %+v, %v; want connected", rr, ok)
+	}
+	if len(rep.LoopbackDisco) == 0 {
+		t.Errorf("no loopback disco pings arrived at %v", rep.Endpoints)
+	}
+	m.conn.mu.Lock()
+	defer m.conn.mu.Unlock()
+	if len(m.conn.selfTestPings) != 0 {
+		t.Errorf("%d self-test pings left pending", len(m.conn.selfTestPings))
+	}
+}
+
+func TestLogHandler(t *testing.T) {
+	var lines []string
+	logf := func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	c := newConn()
+	c.logf = logf
+	c.debugLogging.Store(true)
+	de := &endpoint{c: c, publicKey: key.NewNode().Public()}
+	dk := key.NewDisco().Public()
+	de.disco.Store(&endpointDisco{key: dk, short: dk.ShortString()})
+	ep := netip.MustParseAddrPort("1.2.3.4:567")
+
+	de.dlogPeer("disco: adding candidate endpoint", LogKeyEndpoint, ep)
+	de.logPeer(slog.LevelWarn, "odd")
+	c.dlog("disco: sent", pathAttrs(netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 3))...)
+	want := []string{
+		fmt.Sprintf("[v1] magicsock: disco: adding candidate endpoint peer=%s disco=%s endpoint=1.2.3.4:567", de.publicKey.ShortString(), dk.ShortString()),
+		fmt.Sprintf("[unexpected] magicsock: odd peer=%s disco=%s", de.publicKey.ShortString(), dk.ShortString()),
+		"[v1] magicsock: disco: sent endpoint=derp-3 path=derp",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("logfHandler lines:\n got: %q\nwant: %q", lines, want)
+	}
+
+	// The other way: Logf lines to a slog.Handler.
+	var buf bytes.Buffer
+	h := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: LevelVerbose2,
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	opts := Options{LogHandler: h}
+	sl, hlogf := opts.newLogger()
+	hlogf("[v2] magicsock: chatty %d", 1)
+	hlogf("magicsock: [unexpected] bad")
+	sl.Info("hello", LogKeyPath, "udp")
+	wantText := `level=DEBUG-4 msg="chatty 1"
+level=WARN msg="[unexpected] bad"
+level=INFO msg=hello path=udp
+`
+	if got := buf.String(); got != wantText {
+		t.Errorf("handlerLogf output:\n got: %s\nwant: %s", got, wantText)
+	}
+}
+
+func TestPreferredDERPRegion(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.derpMap = &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1},
+		2: {RegionID: 2},
+	}}
+	type held struct{ home, wanted int }
+	var gotHeld []held
+	c.SetDERPHomeHeldCallback(func(home, wanted int) {
+		gotHeld = append(gotHeld, held{home, wanted})
+	})
+	report := func(preferred int, reachable ...int) *netcheck.Report {
+		r := &netcheck.Report{PreferredDERP: preferred, RegionLatency: map[int]time.Duration{}}
+		for _, rid := range reachable {
+			r.RegionLatency[rid] = time.Millisecond
+		}
+		return r
+	}
+	pin := func(regionID int, sticky bool) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.pinnedDERP, c.pinnedDERPSticky, c.derpHomeHeldWant = regionID, sticky, 0
+	}
+
+	tests := []struct {
+		name   string
+		pin    int
+		sticky bool
+		report *netcheck.Report
+		want   int
+	}{
+		{"none", 0, false, report(1, 1, 2), 1},
+		{"bias-reachable", 2, false, report(1, 1, 2), 2},
+		{"bias-unreachable", 2, false, report(1, 1), 1},
+		{"bias-no-udp", 2, false, report(0), 2},
+		{"sticky-unreachable", 2, true, report(1, 1), 2},
+		{"not-in-map", 3, true, report(1, 1), 1},
+	}
+	for _, tt := range tests {
+		pin(tt.pin, tt.sticky)
+		if got := c.applyPinnedDERP(tt.report); got != tt.want {
+			t.Errorf("%s: home = %d; want %d", tt.name, got, tt.want)
+		}
+	}
+
+	gotHeld = nil
+	pin(2, true)
+	c.applyPinnedDERP(report(1, 1))
+	c.applyPinnedDERP(report(1, 1)) // same wanted region; no new event
+	c.applyPinnedDERP(report(2, 2))
+	if want := []held{{2, 1}}; !reflect.DeepEqual(gotHeld, want) {
+		t.Errorf("held events = %v; want %v", gotHeld, want)
+	}
+}
+
+func TestSharedDiscoKey(t *testing.T) {
+	c := newConn()
+	c.logf = logger.Discard // pongs are sent asynchronously
+	c.privateKey = key.NewNode()
+	var pc nettype.PacketConn = &blockForeverConn{} // drops the pongs
+	c.pconn4.pconn = pc
+	c.pconn4.pconnAtomic.Store(&pc)
+
+	peerDisco := key.NewDisco()
+	newEndpoint := func() *endpoint {
+		de := &endpoint{
+			c:                 c,
+			publicKey:         key.NewNode().Public(),
+			heartbeatDisabled: true,
+			sentPing:          map[stun.TxID]sentPing{},
+			endpointState:     map[netip.AddrPort]*endpointState{},
+			debugUpdates:      ringbuffer.New[EndpointChange](2),
+		}
+		de.disco.Store(&endpointDisco{key: peerDisco.Public(), short: peerDisco.Public().ShortString()})
+		c.peerMap.upsertEndpoint(de, key.DiscoPublic{})
+		return de
+	}
+	ep1, ep2 := newEndpoint(), newEndpoint()
+	if !c.peerMap.discoKeyShared(ep1) || !c.peerMap.discoKeyShared(ep2) {
+		t.Fatal("disco key not reported shared")
+	}
+
+	// A ping naming its node key only adds a candidate to that node.
+	src1 := netip.MustParseAddrPort("1.2.3.4:567")
+	c.mu.Lock()
+	di := c.discoInfoLocked(peerDisco.Public())
+	c.handlePingLocked(&disco.Ping{TxID: stun.NewTxID(), NodeKey: ep1.publicKey}, src1, di, key.NodePublic{})
+	c.mu.Unlock()
+	ep1.mu.Lock()
+	_, ok1 := ep1.endpointState[src1]
+	ep1.mu.Unlock()
+	ep2.mu.Lock()
+	_, ok2 := ep2.endpointState[src1]
+	ep2.mu.Unlock()
+	if !ok1 || ok2 {
+		t.Errorf("candidate %v added to ep1, ep2 = %v, %v; want true, false", src1, ok1, ok2)
+	}
+
+	// A pong goes to the node that sent the ping.
+	src2 := netip.MustParseAddrPort("5.6.7.8:910")
+	txid := stun.NewTxID()
+	ep2.mu.Lock()
+	ep2.endpointState[src2] = &endpointState{}
+	ep2.sentPing[txid] = sentPing{to: src2, at: c.monoNow(), timer: time.AfterFunc(time.Hour, func() {})}
+	c.discoPings.add(txid, ep2)
+	ep2.mu.Unlock()
+
+	pong := &disco.Pong{TxID: txid, Src: src2}
+	pkt := peerDisco.Public().AppendTo([]byte(disco.Magic))
+	pkt = append(pkt, peerDisco.Shared(c.discoPrivate.Public()).Seal(pong.AppendMarshal(nil))...)
+	if !c.handleDiscoMessage(pkt, src2, key.NodePublic{}, discoRXPathUDP) {
+		t.Fatal("pong not handled as disco")
+	}
+	ep2.mu.Lock()
+	best, pending := ep2.bestAddr.AddrPort, len(ep2.sentPing)
+	ep2.mu.Unlock()
+	if best != src2 || pending != 0 {
+		t.Errorf("ep2 bestAddr, pending pings = %v, %d; want %v, 0", best, pending, src2)
+	}
+	if c.discoPings.owner(txid) != nil {
+		t.Error("pong's ping still tracked")
+	}
+}
+
+func TestMigrationPong(t *testing.T) {
+	c := newConn()
+	c.logf = logger.Discard // pongs are sent asynchronously
+	c.privateKey = key.NewNode()
+
+	peerDisco := key.NewDisco()
+	de := &endpoint{
+		c:                 c,
+		publicKey:         key.NewNode().Public(),
+		heartbeatDisabled: true,
+		sentPing:          map[stun.TxID]sentPing{},
+		endpointState:     map[netip.AddrPort]*endpointState{},
+		debugUpdates:      ringbuffer.New[EndpointChange](2),
+	}
+	de.disco.Store(&endpointDisco{key: peerDisco.Public(), short: peerDisco.Public().ShortString()})
+	c.peerMap.upsertEndpoint(de, key.DiscoPublic{})
+
+	oldAddr := netip.MustParseAddrPort("1.2.3.4:567")
+	newAddr := netip.MustParseAddrPort("1.2.3.4:890")
+	sendPong := func(to netip.AddrPort, purpose discoPingPurpose) {
+		t.Helper()
+		txid := stun.NewTxID()
+		de.mu.Lock()
+		de.endpointState[to] = &endpointState{}
+		de.sentPing[txid] = sentPing{to: to, at: c.monoNow() - mono.Time(time.Second), purpose: purpose, timer: time.AfterFunc(time.Hour, func() {})}
+		c.discoPings.add(txid, de)
+		de.mu.Unlock()
+
+		pong := &disco.Pong{TxID: txid, Src: to}
+		pkt := peerDisco.Public().AppendTo([]byte(disco.Magic))
+		pkt = append(pkt, peerDisco.Shared(c.discoPrivate.Public()).Seal(pong.AppendMarshal(nil))...)
+		if !c.handleDiscoMessage(pkt, to, key.NodePublic{}, discoRXPathUDP) {
+			t.Fatal("pong not handled as disco")
+		}
+	}
+	bestAddr := func() netip.AddrPort {
+		de.mu.Lock()
+		defer de.mu.Unlock()
+		return de.bestAddr.AddrPort
+	}
+	setBest := func() {
+		de.mu.Lock()
+		defer de.mu.Unlock()
+		de.bestAddr = addrLatency{AddrPort: oldAddr, latency: time.Millisecond}
+		de.trustBestAddrUntil = c.monoNow().Add(time.Hour)
+	}
+
+	// A slow pong doesn't normally replace a fast path...
+	setBest()
+	sendPong(newAddr, pingDiscovery)
+	if got := bestAddr(); got != oldAddr {
+		t.Fatalf("bestAddr = %v; want %v", got, oldAddr)
+	}
+
+	// ... but does when the peer said it migrated there.
+	de.mu.Lock()
+	de.migrateTo = newAddr
+	de.mu.Unlock()
+	sendPong(newAddr, pingDiscovery)
+	if got := bestAddr(); got != newAddr {
+		t.Errorf("after migration, bestAddr = %v; want %v", got, newAddr)
+	}
+	de.mu.Lock()
+	pending := de.migrateTo
+	de.mu.Unlock()
+	if pending.IsValid() {
+		t.Errorf("migrateTo = %v after its pong; want zero", pending)
+	}
+
+	// As does the pong to our own migration ping.
+	setBest()
+	sendPong(newAddr, pingMigration)
+	if got := bestAddr(); got != newAddr {
+		t.Errorf("after migration ping, bestAddr = %v; want %v", got, newAddr)
+	}
+}
+
+func TestDiscoObfuscation(t *testing.T) {
+	o := newDiscoObfuscator(DiscoObfuscation{Secret: []byte("network secret"), Period: time.Minute, PadTo: 64})
+	sender := key.NewDisco().Public()
+	box := bytes.Repeat([]byte{0xab}, 70)
+	now := time.Unix(1700000000, 0)
+
+	pkt := o.seal(now, sender, box)
+	if len(pkt)%64 != 0 {
+		t.Errorf("len = %d; want a multiple of 64", len(pkt))
+	}
+	if bytes.HasPrefix(pkt, []byte(disco.Magic)) || !looksObfuscated(pkt) {
+		t.Errorf("packet starts with %x; want an obfuscated magic", pkt[:6])
+	}
+	for _, d := range []time.Duration{0, time.Minute, -time.Minute} {
+		gotSender, gotBox, ok := o.open(now.Add(d), pkt)
+		if !ok || gotSender != sender || !bytes.Equal(gotBox, box) {
+			t.Errorf("open %v later = %v, %x, %v; want %v, %x, true", d, gotSender, gotBox, ok, sender, box)
+		}
+	}
+	if _, _, ok := o.open(now.Add(2*time.Minute), pkt); ok {
+		t.Error("opened a packet two periods old")
+	}
+	other := newDiscoObfuscator(DiscoObfuscation{Secret: []byte("other secret"), Period: time.Minute})
+	if _, _, ok := other.open(now, pkt); ok {
+		t.Error("opened a packet of another network")
+	}
+
+	init := make([]byte, device.MessageInitiationSize)
+	init[0] = device.MessageInitiationType
+	data := []byte{device.MessageTransportType, 0, 0, 0, 1, 2, 3}
+	o.cfg.PadHandshakes = true
+	buffs := o.padHandshakes([][]byte{data, init})
+	if len(buffs[1]) != 192 || !bytes.Equal(buffs[0], data) {
+		t.Errorf("padded lens = %d, %d; want %d, 192", len(buffs[0]), len(buffs[1]), len(data))
+	}
+	if len(init) != device.MessageInitiationSize {
+		t.Error("padHandshakes modified its input")
+	}
+	if got := unpaddedLen(buffs[1]); got != device.MessageInitiationSize {
+		t.Errorf("unpaddedLen = %d; want %d", got, device.MessageInitiationSize)
+	}
+	if got := unpaddedLen(data); got != len(data) {
+		t.Errorf("unpaddedLen(data) = %d; want %d", got, len(data))
+	}
+}
+
+func TestDiscoObfuscationFallback(t *testing.T) {
+	c := newConn()
+	c.logf = logger.Discard
+	c.privateKey = key.NewNode()
+	c.SetDiscoObfuscation(DiscoObfuscation{Secret: []byte("network secret")})
+	o := c.discoObfuscator.Load()
+
+	peerDisco := key.NewDisco()
+	de := &endpoint{
+		c:                 c,
+		publicKey:         key.NewNode().Public(),
+		heartbeatDisabled: true,
+		sentPing:          map[stun.TxID]sentPing{},
+		endpointState:     map[netip.AddrPort]*endpointState{},
+		debugUpdates:      ringbuffer.New[EndpointChange](2),
+	}
+	de.disco.Store(&endpointDisco{key: peerDisco.Public(), short: peerDisco.Public().ShortString()})
+	c.peerMap.upsertEndpoint(de, key.DiscoPublic{})
+
+	src := netip.MustParseAddrPort("1.2.3.4:567")
+	box := func() []byte {
+		pong := &disco.Pong{TxID: stun.NewTxID(), Src: src}
+		return peerDisco.Shared(c.discoPrivate.Public()).Seal(pong.AppendMarshal(nil))
+	}
+	plain := func() []byte {
+		pkt := peerDisco.Public().AppendTo([]byte(disco.Magic))
+		return append(pkt, box()...)
+	}
+	shouldObfuscate := func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.shouldObfuscateLocked(c.discoObfuscator.Load(), c.discoInfoLocked(peerDisco.Public()), c.monoNow())
+	}
+
+	if !shouldObfuscate() {
+		t.Fatal("not obfuscating initially")
+	}
+	if !c.handleDiscoMessage(plain(), src, key.NodePublic{}, discoRXPathUDP) {
+		t.Fatal("plain pong not handled as disco")
+	}
+	if shouldObfuscate() {
+		t.Error("still obfuscating to a peer sending plain disco")
+	}
+	if !c.handleDiscoMessage(o.seal(c.now(), peerDisco.Public(), box()), src, key.NodePublic{}, discoRXPathUDP) {
+		t.Fatal("obfuscated pong not handled as disco")
+	}
+	if !shouldObfuscate() {
+		t.Error("not obfuscating to a peer sending obfuscated disco")
+	}
+
+	// Unanswered pings fall back too.
+	c.mu.Lock()
+	di := c.discoInfoLocked(peerDisco.Public())
+	for range discoObfuscationFallbackPings {
+		c.noteObfuscatedPingSentLocked(o, di, c.monoNow())
+	}
+	c.mu.Unlock()
+	if shouldObfuscate() {
+		t.Error("still obfuscating after unanswered pings")
+	}
+
+	// In strict mode, plain disco over UDP is dropped, but not over DERP.
+	c.SetDiscoObfuscation(DiscoObfuscation{Secret: []byte("network secret"), Strict: true})
+	before := metricRecvDiscoPlainDropped.Value()
+	if !c.handleDiscoMessage(plain(), src, key.NodePublic{}, discoRXPathUDP) {
+		t.Fatal("plain pong not handled as disco")
+	}
+	if got := metricRecvDiscoPlainDropped.Value() - before; got != 1 {
+		t.Errorf("plain messages dropped = %d; want 1", got)
+	}
+	if !shouldObfuscate() {
+		t.Error("not obfuscating in strict mode")
+	}
+	c.handleDiscoMessage(plain(), netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 1), de.publicKey, discoRXPathDERP)
+	if got := metricRecvDiscoPlainDropped.Value() - before; got != 1 {
+		t.Errorf("plain messages dropped = %d after DERP; want 1", got)
+	}
+}
+
+func TestConnHealth(t *testing.T) {
+	c := newConn()
+	c.logf = logger.Discard
+
+	h := c.Health()
+	if h.Ready || len(h.Problems) == 0 {
+		t.Fatalf("new Conn: Ready = %v, Problems = %q; want false and some", h.Ready, h.Problems)
+	}
+
+	ch, stop := c.WatchHealth()
+	defer stop()
+	recv := func() ConnHealth {
+		t.Helper()
+		select {
+		case h := <-ch:
+			return h
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for Health")
+			return ConnHealth{}
+		}
+	}
+	recv() // the initial Health
+
+	c.mu.Lock()
+	c.privateKey = key.NewNode()
+	c.derpMap = derpMapWithRegion(1)
+	c.myDerp = 1
+	c.lastNetCheckTime = c.now()
+	c.lastEndpointsTime = c.now()
+	c.mu.Unlock()
+	c.setDERPConnected(1, true)
+	for h = recv(); !h.Ready; h = recv() {
+	}
+	if h.DERPHome != 1 || !h.DERPHomeConnected || h.EndpointsStale {
+		t.Errorf("Health = %+v; want connected to region 1 with fresh endpoints", h)
+	}
+	if want := []string{"no UDP socket bound"}; !slices.Equal(h.Problems, want) {
+		t.Errorf("Problems = %q; want %q", h.Problems, want)
+	}
+
+	c.setDERPConnected(1, false)
+	if h = recv(); h.Ready || h.DERPHomeConnected {
+		t.Errorf("after DERP disconnect, Ready, DERPHomeConnected = %v, %v; want false, false", h.Ready, h.DERPHomeConnected)
+	}
+
+	stop()
+	if _, ok := <-ch; ok {
+		t.Error("channel not closed by stop")
+	}
+}
+
+func derpMapWithRegion(regionID int) *tailcfg.DERPMap {
+	return &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		regionID: {RegionID: regionID, Nodes: []*tailcfg.DERPNode{{Name: "n", RegionID: regionID}}},
+	}}
+}
+
+func TestSendPacing(t *testing.T) {
+	if got := pacedChunks(gsoTestBuffs(8), 300); len(got) != 3 || len(got[0]) != 3 || len(got[2]) != 2 {
+		t.Errorf("pacedChunks(8 buffs) lens = %d; want chunks of 3, 3 and 2", len(got))
+	}
+	if got := pacedChunks([][]byte{make([]byte, 500)}, 300); len(got) != 1 {
+		t.Errorf("pacedChunks(oversized buff) = %d chunks; want 1", len(got))
+	}
+
+	if runtime.GOOS != "linux" {
+		t.Skip("UDP GSO is only used on Linux")
+	}
+	w := new(gsoTestWriter)
+	c := newConn()
+	c.logf = t.Logf
+	var pc nettype.PacketConn = newGSOTestConn(t, w)
+	c.pconn4.pconn = pc
+	c.pconn4.pconnAtomic.Store(&pc)
+	addr := netip.MustParseAddrPort("127.0.0.1:1")
+
+	const interval = 30 * time.Millisecond
+	c.SetSendPacing(SendPacing{Interval: interval, BurstBytes: 300})
+	start := time.Now()
+	if _, err := c.sendUDPBatch(addr, key.NodePublic{}, gsoTestBuffs(8), 0); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < interval*2/3 {
+		t.Errorf("paced batch sent in %v; want at least %v", d, interval*2/3)
+	}
+	if lens, _ := w.takeWritten(); !slices.Equal(lens, []int{300, 300, 200}) {
+		t.Errorf("written lens = %v; want [300 300 200]", lens)
+	}
+
+	// Batches within the burst size go out at once.
+	if _, err := c.sendUDPBatch(addr, key.NodePublic{}, gsoTestBuffs(3), 0); err != nil {
+		t.Fatal(err)
+	}
+	if lens, _ := w.takeWritten(); !slices.Equal(lens, []int{300}) {
+		t.Errorf("written lens = %v; want [300]", lens)
+	}
+}
+
+func TestIOURingConn(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("io_uring is only supported on Linux")
+	}
+	listen := func() *batchingUDPConn {
+		t.Helper()
+		pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, ok := tryUpgradeToBatchingUDPConn(pc.(nettype.PacketConn), "udp4", 8, UDPIOURing, t.Logf).(*batchingUDPConn)
+		if !ok {
+			pc.Close()
+			t.Skip("no batching UDP I/O")
+		}
+		t.Cleanup(func() { b.Close() })
+		if _, ok := b.xpc.(*ioURingConn); !ok {
+			t.Skip("io_uring unavailable")
+		}
+		return b
+	}
+	src, dst := listen(), listen()
+	dstAddr := dst.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	want := [][]byte{[]byte("one"), []byte("two"), []byte("three")}
+	if err := src.WriteBatchTo(want, dstAddr, 1); err != nil {
+		t.Fatal(err)
+	}
+	msgs := make([]ipv6.Message, 8)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, 1500)}
+		msgs[i].OOB = make([]byte, controlMessageSize)
+	}
+	var got [][]byte
+	dst.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(got) < len(want) {
+		n, err := dst.ReadBatch(msgs, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range msgs[:n] {
+			got = append(got, slices.Clone(msg.Buffers[0][:msg.N]))
+			if from := msg.Addr.(*net.UDPAddr).AddrPort(); from != src.LocalAddr().(*net.UDPAddr).AddrPort() {
+				t.Errorf("from = %v; want %v", from, src.LocalAddr())
+			}
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	// A read waits for a packet, and for the socket to be closed.
+	dst.SetReadDeadline(time.Time{})
+	errc := make(chan error, 1)
+	go func() {
+		_, err := dst.ReadBatch(msgs, 0)
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	dst.Close()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("read after close succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read not unblocked by close")
+	}
+}
+
+func TestLearnedPaths(t *testing.T) {
+	c := newConn()
+	c.logf = logger.Discard // pongs are sent asynchronously
+	c.privateKey = key.NewNode()
+
+	peerDisco := key.NewDisco()
+	de := &endpoint{
+		c:                 c,
+		publicKey:         key.NewNode().Public(),
+		heartbeatDisabled: true,
+		sentPing:          map[stun.TxID]sentPing{},
+		endpointState:     map[netip.AddrPort]*endpointState{},
+		debugUpdates:      ringbuffer.New[EndpointChange](2),
+	}
+	de.disco.Store(&endpointDisco{key: peerDisco.Public(), short: peerDisco.Public().ShortString()})
+	c.peerMap.upsertEndpoint(de, key.DiscoPublic{})
+
+	learned := netip.MustParseAddrPort("1.2.3.4:567")
+	gone := netip.MustParseAddrPort("5.6.7.8:910")
+	de.endpointState[learned] = &endpointState{}
+
+	type path struct {
+		peer key.NodePublic
+		addr netip.AddrPort
+	}
+	reported := make(chan path, 1)
+	c.SetPathLearnedCallback(func(peer key.NodePublic, addr netip.AddrPort) {
+		reported <- path{peer, addr}
+	})
+
+	// A learned path that's no longer an endpoint isn't tried.
+	c.SetLearnedPaths(map[key.NodePublic]netip.AddrPort{de.publicKey: gone})
+	c.mu.Lock()
+	c.tryLearnedPathLocked(de)
+	c.mu.Unlock()
+	if de.bestAddr.IsValid() {
+		t.Fatalf("bestAddr = %v; want none", de.bestAddr)
+	}
+
+	c.SetLearnedPaths(map[key.NodePublic]netip.AddrPort{de.publicKey: learned})
+	c.mu.Lock()
+	c.tryLearnedPathLocked(de)
+	c.mu.Unlock()
+	de.mu.Lock()
+	udpAddr, derpAddr, _ := de.addrForSendLocked(c.monoNow())
+	de.mu.Unlock()
+	if udpAddr != learned || derpAddr.IsValid() {
+		t.Fatalf("addrForSendLocked = %v, %v; want %v alone", udpAddr, derpAddr, learned)
+	}
+
+	// Its pong confirms it, and it's reported.
+	txid := stun.NewTxID()
+	de.mu.Lock()
+	de.sentPing[txid] = sentPing{to: learned, at: c.monoNow(), timer: time.AfterFunc(time.Hour, func() {})}
+	c.discoPings.add(txid, de)
+	de.mu.Unlock()
+	pong := &disco.Pong{TxID: txid, Src: learned}
+	pkt := peerDisco.Public().AppendTo([]byte(disco.Magic))
+	pkt = append(pkt, peerDisco.Shared(c.discoPrivate.Public()).Seal(pong.AppendMarshal(nil))...)
+	if !c.handleDiscoMessage(pkt, learned, key.NodePublic{}, discoRXPathUDP) {
+		t.Fatal("pong not handled as disco")
+	}
+	select {
+	case got := <-reported:
+		if got != (path{de.publicKey, learned}) {
+			t.Errorf("reported %v; want %v", got, path{de.publicKey, learned})
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("path not reported")
+	}
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	if de.bestAddrLearned || de.bestAddr.latency == time.Hour {
+		t.Errorf("learned path not confirmed: bestAddr = %+v", de.bestAddr)
+	}
+}
+
+func TestDERPDataRoute(t *testing.T) {
+	c := newConn()
+	c.logf = logger.Discard
+	c.privateKey = key.NewNode()
+
+	peerDisco := key.NewDisco()
+	de := &endpoint{
+		c:                 c,
+		publicKey:         key.NewNode().Public(),
+		heartbeatDisabled: true,
+		derpAddr:          netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 1),
+		sentPing:          map[stun.TxID]sentPing{},
+		endpointState:     map[netip.AddrPort]*endpointState{},
+		debugUpdates:      ringbuffer.New[EndpointChange](2),
+	}
+	de.disco.Store(&endpointDisco{key: peerDisco.Public(), short: peerDisco.Public().ShortString()})
+	c.peerMap.upsertEndpoint(de, key.DiscoPublic{})
+
+	route := func() (derpRoute, bool) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		r, ok := c.derpRoute[de.publicKey]
+		return r, ok
+	}
+	note := func(regionID int, dc *derphttp.Client) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.noteDERPDataRouteLocked(de, regionID, dc)
+	}
+	lastPing := func() mono.Time {
+		de.mu.Lock()
+		defer de.mu.Unlock()
+		return de.lastDERPRoutePing
+	}
+
+	// Data via the peer's home region is routed but not verified.
+	dc1 := new(derphttp.Client)
+	note(1, dc1)
+	if r, _ := route(); r != (derpRoute{1, dc1}) {
+		t.Fatalf("route = %v; want region 1", r)
+	}
+	if lastPing() != 0 {
+		t.Fatal("route via home region was verified")
+	}
+
+	// Data via another region switches the route and pings the peer there.
+	dc2 := new(derphttp.Client)
+	note(2, dc2)
+	if r, _ := route(); r != (derpRoute{2, dc2}) {
+		t.Fatalf("route = %v; want region 2", r)
+	}
+	pinged := lastPing()
+	if pinged == 0 {
+		t.Fatal("route via region 2 not verified")
+	}
+
+	// Another switch soon after is rate limited.
+	dc3 := new(derphttp.Client)
+	note(3, dc3)
+	if r, _ := route(); r != (derpRoute{3, dc3}) {
+		t.Fatalf("route = %v; want region 3", r)
+	}
+	if lastPing() != pinged {
+		t.Fatal("verification ping not rate limited")
+	}
+
+	// A verification ping that times out forgets the route.
+	txid := stun.NewTxID()
+	de.mu.Lock()
+	de.sentPing[txid] = sentPing{
+		to:      netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 3),
+		at:      c.monoNow(),
+		purpose: pingDERPRoute,
+		timer:   time.AfterFunc(time.Hour, func() {}),
+	}
+	c.discoPings.add(txid, de)
+	de.mu.Unlock()
+	de.discoPingTimeout(txid)
+	if err := tstest.WaitFor(5*time.Second, func() error {
+		if r, ok := route(); ok {
+			return fmt.Errorf("route = %v; want none", r)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultipathAddr(t *testing.T) {
+	c := newConn()
+	de := &endpoint{c: c}
+	derpAddr := netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 1)
+	a := netip.MustParseAddrPort("1.2.3.4:1")
+	b := netip.MustParseAddrPort("1.2.3.4:2")
+	var now mono.Time
+
+	steps := []struct {
+		name      string
+		window    time.Duration
+		advance   time.Duration
+		udp, derp netip.AddrPort
+		wantDupTo netip.AddrPort
+	}{
+		{name: "derp-only", window: time.Second, derp: derpAddr},
+		{name: "upgrade-to-udp", udp: a, wantDupTo: derpAddr},
+		{name: "within-window", advance: 500 * time.Millisecond, udp: a, wantDupTo: derpAddr},
+		{name: "trust-expired", udp: a, derp: derpAddr},
+		{name: "window-over", advance: time.Second, udp: a},
+		{name: "switch-udp", udp: b, wantDupTo: a},
+		{name: "disabled", window: -1, advance: 2 * time.Second, udp: a},
+		{name: "disabled-switch", udp: b},
+	}
+	for _, st := range steps {
+		switch {
+		case st.window > 0:
+			c.SetMultipathWindow(st.window)
+		case st.window < 0:
+			c.SetMultipathWindow(0)
+		}
+		now = now.Add(st.advance)
+		de.mu.Lock()
+		got := de.multipathAddrLocked(now, st.udp, st.derp)
+		de.mu.Unlock()
+		if got != st.wantDupTo {
+			t.Errorf("%s: dup to %v; want %v", st.name, got, st.wantDupTo)
+		}
+	}
+}
+
+func TestExportDebugBundle(t *testing.T) {
+	c := newConn()
+	c.lastNetCheckReport.Store(&netcheck.Report{UDP: true, PreferredDERP: 7})
+
+	a := netip.MustParseAddrPort("1.2.3.4:1")
+	b := netip.MustParseAddrPort("1.2.3.4:2")
+	var eps []*endpoint
+	for range 2 {
+		de := &endpoint{
+			c:            c,
+			publicKey:    key.NewNode().Public(),
+			debugUpdates: ringbuffer.New[EndpointChange](4),
+		}
+		dk := key.NewDisco().Public()
+		de.disco.Store(&endpointDisco{key: dk, short: dk.ShortString()})
+		c.peerMap.upsertEndpoint(de, key.DiscoPublic{})
+		eps = append(eps, de)
+	}
+	eps[0].addDebugUpdate(EndpointChange{
+		What:   "handlePingLocked-bestAddr-update",
+		Reason: ChangeBestAddrUpdated,
+		From:   addrLatency{a, 20 * time.Millisecond},
+		To:     addrLatency{b, 10 * time.Millisecond},
+	})
+
+	var buf bytes.Buffer
+	if err := c.ExportDebugBundle(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadDebugBundle(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Netcheck == nil || got.Netcheck.PreferredDERP != 7 {
+		t.Errorf("Netcheck = %+v; want PreferredDERP 7", got.Netcheck)
+	}
+	if len(got.Peers) != 2 {
+		t.Fatalf("got %d peers; want 2", len(got.Peers))
+	}
+	for _, p := range got.Peers {
+		if p.NodeKey != eps[0].publicKey {
+			if len(p.Changes) != 0 {
+				t.Errorf("peer without changes has %d", len(p.Changes))
+			}
+			continue
+		}
+		if len(p.Changes) != 1 {
+			t.Fatalf("got %d changes; want 1", len(p.Changes))
+		}
+		ch := p.Changes[0]
+		if ch.Reason != ChangeBestAddrUpdated || ch.OldAddr != a || ch.NewAddr != b ||
+			ch.OldLatency != 20*time.Millisecond || ch.NewLatency != 10*time.Millisecond {
+			t.Errorf("change = %+v", ch)
+		}
+	}
+}
+
+func TestPathImpairment(t *testing.T) {
+	if err := newConn().SetPathImpairmentForTest(netip.MustParseAddrPort("1.2.3.4:5"), PathImpairment{LossRate: 1}); err == nil {
+		t.Fatal("SetPathImpairmentForTest succeeded without Options.TestOnlyPathImpairments")
+	}
+
+	c, err := NewConn(Options{
+		Logf:                    t.Logf,
+		TestOnlyPacketListener:  localhostListener{},
+		TestOnlyPathImpairments: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	dst := pc.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	// recv returns how long after now a packet arrives, or false if none
+	// does within timeout.
+	recv := func(timeout time.Duration) (time.Duration, bool) {
+		start := time.Now()
+		pc.SetReadDeadline(start.Add(timeout))
+		buf := make([]byte, 100)
+		if _, _, err := pc.ReadFrom(buf); err != nil {
+			return 0, false
+		}
+		return time.Since(start), true
+	}
+	send := func() {
+		t.Helper()
+		if _, err := c.sendUDP(dst, key.NodePublic{}, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.SetPathImpairmentForTest(dst, PathImpairment{LossRate: 1}); err != nil {
+		t.Fatal(err)
+	}
+	send()
+	if _, ok := recv(200 * time.Millisecond); ok {
+		t.Error("packet arrived despite 100% loss")
+	}
+
+	const latency = 200 * time.Millisecond
+	c.SetPathImpairmentForTest(dst, PathImpairment{Latency: latency})
+	send()
+	if d, ok := recv(5 * time.Second); !ok {
+		t.Error("delayed packet never arrived")
+	} else if d < latency-10*time.Millisecond {
+		t.Errorf("delayed packet arrived after %v; want at least %v", d, latency)
+	}
+
+	c.SetPathImpairmentForTest(dst, PathImpairment{})
+	if c.pathImpairments.Load() != nil {
+		t.Error("impairments remain after removing the only one")
+	}
+	send()
+	if _, ok := recv(5 * time.Second); !ok {
+		t.Error("unimpaired packet never arrived")
+	}
+}
+
+func TestKeyRotationRetiresDERP(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.keyRotationWindow = time.Hour
+	c.privateKey = key.NewNode() // not SetPrivateKey, which would ReSTUN
+
+	dc := derphttp.NewRegionClient(key.NewNode(), t.Logf, nil, func() *tailcfg.DERPRegion { return nil })
+	canceled := false
+	c.mu.Lock()
+	c.activeDerp = map[int]activeDerp{1: {
+		c:          dc,
+		cancel:     func() { canceled = true },
+		lastWrite:  new(time.Time),
+		createTime: c.now(),
+	}}
+	c.prevDerp = map[int]*syncs.WaitGroupChan{1: syncs.NewWaitGroupChan()}
+	c.mu.Unlock()
+
+	if err := c.SetPrivateKey(key.NewNode()); err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	if len(c.activeDerp) != 0 || c.prevDerp[1] != nil {
+		t.Errorf("old key's connection still active: %v, %v", c.activeDerp, c.prevDerp)
+	}
+	if rd, ok := c.retiredDerp[dc]; !ok || rd.closed || canceled {
+		t.Errorf("old key's connection not retired and open: %+v", rd)
+	}
+	c.mu.Unlock()
+	if !c.isRetiredDerp(dc) {
+		t.Error("isRetiredDerp = false")
+	}
+
+	// The window ending closes it, but it's known to be retired until its
+	// reader exits.
+	c.mu.Lock()
+	c.closeRetiredDerpLocked("test")
+	c.mu.Unlock()
+	if !canceled {
+		t.Error("retired connection not closed")
+	}
+	if !c.isRetiredDerp(dc) {
+		t.Error("isRetiredDerp = false before reader exited")
+	}
+	c.forgetRetiredDerp(dc)
+	if c.isRetiredDerp(dc) {
+		t.Error("isRetiredDerp = true after reader exited")
+	}
+}
+
+func TestNetmapDiff(t *testing.T) {
+	k1, k2, k3 := key.NewNode().Public(), key.NewNode().Public(), key.NewNode().Public()
+	node := func(k key.NodePublic, eps ...string) *tailcfg.Node {
+		return &tailcfg.Node{Key: k, DiscoKey: key.NewDisco().Public(), Endpoints: eps}
+	}
+	n1, n2 := node(k1, "1.2.3.4:5"), node(k2, "1.2.3.4:6")
+	n1ep := n1.Clone()
+	n1ep.Endpoints = []string{"1.2.3.4:7"}
+	n2disco := n2.Clone()
+	n2disco.DiscoKey = key.NewDisco().Public()
+
+	got := diffNetmapPeers([]*tailcfg.Node{n1, n2}, []*tailcfg.Node{n1ep, n2disco, node(k3)})
+	want := NetmapDiff{
+		NumPeers:         3,
+		PeersAdded:       []key.NodePublic{k3},
+		PeersChanged:     []key.NodePublic{k1, k2},
+		EndpointsChanged: []key.NodePublic{k1},
+		DiscoKeysChanged: []key.NodePublic{k2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diff = %+v; want %+v", got, want)
+	}
+
+	got = diffNetmapPeers([]*tailcfg.Node{n1, n2}, []*tailcfg.Node{n2})
+	if want := (NetmapDiff{NumPeers: 1, PeersRemoved: []key.NodePublic{k1}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("diff = %+v; want %+v", got, want)
+	}
+
+	// SetNetworkMap reports diffs, but not unchanged netmaps.
+	c := newConn()
+	c.logf = t.Logf
+	var diffs []NetmapDiff
+	c.netmapDiffFunc = func(d NetmapDiff) {
+		if !c.mu.TryLock() {
+			t.Error("NetmapDiffFunc called with c.mu held")
+		} else {
+			c.mu.Unlock()
+		}
+		diffs = append(diffs, d)
+	}
+	c.SetNetworkMap(&netmap.NetworkMap{Peers: []*tailcfg.Node{n1}})
+	c.SetNetworkMap(&netmap.NetworkMap{Peers: []*tailcfg.Node{n1}})
+	if len(diffs) != 1 || !slices.Equal(diffs[0].PeersAdded, []key.NodePublic{k1}) {
+		t.Errorf("diffs = %+v; want one adding %v", diffs, k1.ShortString())
+	}
+}
+
+// addrRecordingConn is a nettype.PacketConn that drops writes, sending
+// their destinations to ch if there's room.
+type addrRecordingConn struct {
+	blockForeverConn
+	ch chan netip.AddrPort
+}
+
+func (c *addrRecordingConn) WriteToUDPAddrPort(p []byte, addr netip.AddrPort) (int, error) {
+	select {
+	case c.ch <- addr:
+	default:
+	}
+	return len(p), nil
+}
+
+func TestCallMeMaybeOverUDP(t *testing.T) {
+	c := newConn()
+	c.logf = logger.Discard
+	c.privateKey = key.NewNode()
+	rc := &addrRecordingConn{ch: make(chan netip.AddrPort, 16)}
+	var pc nettype.PacketConn = rc
+	c.pconn4.pconn = pc
+	c.pconn4.pconnAtomic.Store(&pc)
+
+	peerDisco := key.NewDisco()
+	de := &endpoint{
+		c:                 c,
+		publicKey:         key.NewNode().Public(),
+		heartbeatDisabled: true,
+		sentPing:          map[stun.TxID]sentPing{},
+		endpointState:     map[netip.AddrPort]*endpointState{},
+		debugUpdates:      ringbuffer.New[EndpointChange](2),
+	}
+	de.disco.Store(&endpointDisco{key: peerDisco.Public(), short: peerDisco.Public().ShortString()})
+	c.peerMap.upsertEndpoint(de, key.DiscoPublic{})
+
+	// Without DERP or a validated path, there's nowhere to send it.
+	c.mu.Lock()
+	c.lastEndpointsTime = c.now()
+	c.mu.Unlock()
+	c.enqueueCallMeMaybe(netip.AddrPort{}, de)
+	udpAddr := netip.MustParseAddrPort("1.2.3.4:567")
+	de.mu.Lock()
+	de.bestAddr = addrLatency{AddrPort: udpAddr, latency: time.Millisecond}
+	de.mu.Unlock()
+	c.peerMap.setNodeKeyForIPPort(udpAddr, de.publicKey)
+
+	// With DERP down, it goes over the validated path.
+	derpAddr := netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 1)
+	c.enqueueCallMeMaybe(derpAddr, de)
+	select {
+	case got := <-rc.ch:
+		if got != udpAddr {
+			t.Fatalf("CallMeMaybe sent to %v; want %v", got, udpAddr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CallMeMaybe not sent over UDP")
+	}
+
+	receive := func(src netip.AddrPort) {
+		t.Helper()
+		cmm := &disco.CallMeMaybe{MyNumber: []netip.AddrPort{netip.MustParseAddrPort("9.9.9.9:999")}}
+		pkt := peerDisco.Public().AppendTo([]byte(disco.Magic))
+		pkt = append(pkt, peerDisco.Shared(c.discoPrivate.Public()).Seal(cmm.AppendMarshal(nil))...)
+		if !c.handleDiscoMessage(pkt, src, key.NodePublic{}, discoRXPathUDP) {
+			t.Fatal("CallMeMaybe not handled as disco")
+		}
+	}
+
+	// A CallMeMaybe over UDP is only accepted from the validated path.
+	okBefore, badBefore := metricRecvDiscoCallMeMaybeUDP.Value(), metricRecvDiscoCallMeMaybeBadUDP.Value()
+	receive(netip.MustParseAddrPort("5.6.7.8:910"))
+	if got := metricRecvDiscoCallMeMaybeBadUDP.Value() - badBefore; got != 1 {
+		t.Errorf("CallMeMaybe from unvalidated path: bad_udp += %d; want 1", got)
+	}
+	receive(udpAddr)
+	if got := metricRecvDiscoCallMeMaybeUDP.Value() - okBefore; got != 1 {
+		t.Errorf("CallMeMaybe from validated path: udp += %d; want 1", got)
+	}
+}
+
+func TestDERPFallback(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	c := &Conn{clock: clock, logf: logger.Discard}
+	udp := netip.MustParseAddrPort("1.2.3.4:567")
+	derp := netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 1)
+	st := &endpointState{}
+	de := &endpoint{
+		c:                  c,
+		derpAddr:           derp,
+		bestAddr:           addrLatency{AddrPort: udp},
+		trustBestAddrUntil: c.monoNow().Add(trustUDPAddrDuration),
+		endpointState:      map[netip.AddrPort]*endpointState{udp: st},
+	}
+	check := func(name string, wantDERP bool, want derpFallbackReason) {
+		t.Helper()
+		_, gotDERP, _ := de.addrForSendLocked(c.monoNow())
+		if gotDERP.IsValid() != wantDERP || de.derpFallback != want {
+			t.Errorf("%s: sending via DERP = %v (%v); want %v (%v)", name, gotDERP.IsValid(), de.derpFallback, wantDERP, want)
+		}
+	}
+	pongs := func(lost ...bool) {
+		for _, l := range lost {
+			st.addPingResultLocked(l)
+		}
+	}
+
+	pongs(false, false)
+	check("trusted", false, derpFallbackNone)
+
+	// A single lost pong lets trust lapse, but the peer only falls back
+	// to DERP after the grace period.
+	pongs(true)
+	clock.Advance(trustUDPAddrDuration + time.Second)
+	check("in grace", false, derpFallbackNone)
+	clock.Advance(derpFallbackGrace)
+	check("after grace", true, derpFallbackTrustExpired)
+	pongs(false)
+	de.trustBestAddrUntil = c.monoNow().Add(trustUDPAddrDuration)
+	check("pong", false, derpFallbackNone)
+
+	// Lost pongs fall back even while trusted, until the path
+	// answers derpFallbackRecoverPongs in a row.
+	pongs(true, true, true)
+	check("pong loss", true, derpFallbackPongLoss)
+	pongs(false)
+	check("one pong", true, derpFallbackPongLoss)
+	pongs(false)
+	check("recovered from pong loss", false, derpFallbackNone)
+
+	// As do send errors, until a send succeeds.
+	de.udpSendErrs = derpFallbackSendErrs
+	check("send errors", true, derpFallbackSendErrors)
+	de.udpSendErrs = 1
+	check("still failing", true, derpFallbackSendErrors)
+	de.udpSendErrs = 0
+	check("recovered from send errors", false, derpFallbackNone)
+}
+
+func TestReusePort(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	if err := c.AttachReusePortBPF(1); err != errReusePortNotEnabled {
+		t.Errorf("AttachReusePortBPF without ReusePort = %v; want %v", err, errReusePortNotEnabled)
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT groups are only supported on Linux")
+	}
+
+	c.reusePort.Enabled = true
+	pc1, err := c.listenPacket("udp4", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc1.Close()
+	port := uint16(pc1.LocalAddr().(*net.UDPAddr).Port)
+	pc2, err := c.listenPacket("udp4", port)
+	if err != nil {
+		t.Fatalf("second socket in reuseport group: %v", err)
+	}
+	pc2.Close()
+
+	c.reusePort.Enabled = false
+	if pc3, err := c.listenPacket("udp4", port); err == nil {
+		pc3.Close()
+		t.Error("socket outside reuseport group bound to the group's port")
+	}
+}
+
+func TestDisableIPFamily(t *testing.T) {
+	conn, err := NewConn(Options{
+		EndpointsFunc: func(eps []tailcfg.Endpoint) {},
+		Logf:          t.Logf,
+		DisableIPv6:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	unbound := func(ruc *RebindingUDPConn) bool {
+		ruc.mu.Lock()
+		defer ruc.mu.Unlock()
+		_, ok := ruc.pconn.(*blockForeverConn)
+		return ok
+	}
+	if !unbound(&conn.pconn6) {
+		t.Error("IPv6 socket bound with DisableIPv6")
+	}
+	if unbound(&conn.pconn4) {
+		t.Error("IPv4 socket unbound without DisableIPv4")
+	}
+	if !conn.noV6.Load() {
+		t.Error("noV6 = false with DisableIPv6")
+	}
+	v4 := netip.MustParseAddr("192.0.2.1")
+	v6 := netip.MustParseAddr("2001:db8::1")
+	if conn.familyDisabled(v4) || !conn.familyDisabled(v6) {
+		t.Errorf("familyDisabled(v4, v6) = %v, %v; want false, true", conn.familyDisabled(v4), conn.familyDisabled(v6))
+	}
+
+	// Swap the disabled family at runtime.
+	conn.SetDisableIPv6(false)
+	conn.SetDisableIPv4(true)
+	if unbound(&conn.pconn6) {
+		t.Error("IPv6 socket unbound after SetDisableIPv6(false)")
+	}
+	if !unbound(&conn.pconn4) {
+		t.Error("IPv4 socket bound after SetDisableIPv4(true)")
+	}
+	if !conn.familyDisabled(v4) || conn.familyDisabled(v6) {
+		t.Errorf("familyDisabled(v4, v6) = %v, %v; want true, false", conn.familyDisabled(v4), conn.familyDisabled(v6))
+	}
+	if got, want := conn.LocalPort(), uint16(conn.pconn6.LocalAddr().Port); got != want || got == 0 {
+		t.Errorf("LocalPort = %d; want the IPv6 socket's port %d", got, want)
+	}
+}
+
+func TestClassifyPacket(t *testing.T) {
+	o := newDiscoObfuscator(DiscoObfuscation{Secret: []byte("network secret"), Period: time.Minute})
+	stunPkt := stun.Request(stun.NewTxID())
+	discoPkt := append([]byte(disco.Magic), make([]byte, key.DiscoPublicRawLen+40)...)
+	obfuscatedPkt := o.seal(time.Now(), key.NewDisco().Public(), make([]byte, 40))
+	wgPkt := []byte{4, 0, 0, 0, 1, 2, 3, 4}
+
+	tests := []struct {
+		name       string
+		b          []byte
+		via        discoRXPath
+		obfuscated bool
+		noKey      bool
+		want       packetKind
+	}{
+		{"stun-udp", stunPkt, discoRXPathUDP, false, false, packetSTUN},
+		{"stun-udp-no-key", stunPkt, discoRXPathUDP, false, true, packetSTUN},
+		{"stun-derp", stunPkt, discoRXPathDERP, false, false, packetDrop},
+		{"stun-raw", stunPkt, discoRXPathRawSocket, false, false, packetDrop},
+		{"disco-udp", discoPkt, discoRXPathUDP, false, false, packetDisco},
+		{"disco-derp", discoPkt, discoRXPathDERP, false, false, packetDisco},
+		{"disco-raw", discoPkt, discoRXPathRawSocket, false, false, packetDisco},
+		{"disco-no-key", discoPkt, discoRXPathUDP, false, true, packetDisco},
+		{"obfuscated-udp", obfuscatedPkt, discoRXPathUDP, true, false, packetDisco},
+		{"obfuscated-raw", obfuscatedPkt, discoRXPathRawSocket, true, false, packetDisco},
+		{"obfuscated-derp", obfuscatedPkt, discoRXPathDERP, true, false, packetWireGuard},
+		{"obfuscated-off", obfuscatedPkt, discoRXPathUDP, false, false, packetWireGuard},
+		{"wg-udp", wgPkt, discoRXPathUDP, false, false, packetWireGuard},
+		{"wg-derp", wgPkt, discoRXPathDERP, false, false, packetWireGuard},
+		{"wg-raw", wgPkt, discoRXPathRawSocket, false, false, packetDrop},
+		{"wg-udp-no-key", wgPkt, discoRXPathUDP, false, true, packetDrop},
+		{"wg-derp-no-key", wgPkt, discoRXPathDERP, false, true, packetDrop},
+		{"empty", nil, discoRXPathUDP, false, false, packetDrop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := metricClassified[tt.want].Value()
+			if got := classifyPacket(tt.b, tt.via, tt.obfuscated, !tt.noKey); got != tt.want {
+				t.Errorf("classifyPacket = %v; want %v", got, tt.want)
+			}
+			if got := metricClassified[tt.want].Value() - before; got != 1 {
+				t.Errorf("%v metric incremented by %d; want 1", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPathQuality(t *testing.T) {
+	var q pathQuality
+	for _, rtt := range []time.Duration{10, 10, 10, 10} {
+		q.addRTT(rtt * time.Millisecond)
+	}
+	if q.srtt != 10*time.Millisecond || q.jitter != 0 {
+		t.Errorf("steady RTT: srtt, jitter = %v, %v; want 10ms, 0", q.srtt, q.jitter)
+	}
+	q.addRTT(26 * time.Millisecond)
+	if want := 12 * time.Millisecond; q.srtt != want {
+		t.Errorf("srtt = %v; want %v", q.srtt, want)
+	}
+	if want := time.Millisecond; q.jitter != want {
+		t.Errorf("jitter = %v; want %v", q.jitter, want)
+	}
+
+	now := mono.Now()
+	q.notePathChange(now.Add(-6 * time.Minute))
+	q.notePathChange(now.Add(-4 * time.Minute))
+	q.notePathChange(now.Add(-time.Minute))
+	if got := q.pathChanges(now); got != 2 {
+		t.Errorf("pathChanges = %d; want 2", got)
+	}
+	if got := q.pathChanges(now.Add(2 * time.Minute)); got != 1 {
+		t.Errorf("pathChanges 2m later = %d; want 1", got)
+	}
+}
+
+func TestBatchTuner(t *testing.T) {
+	const max = 64
+	bt := newBatchTuner(max)
+	if got := bt.size(max); got != minTunedBatchSize {
+		t.Fatalf("initial size = %d; want %d", got, minTunedBatchSize)
+	}
+	// Full reads grow the batch, up to max.
+	for i := 0; i < 100; i++ {
+		n := bt.size(max)
+		bt.note(n, n)
+	}
+	if got := bt.size(max); got != max {
+		t.Fatalf("size after full reads = %d; want %d", got, max)
+	}
+	// The caller's limit applies, and reads it limits don't count.
+	if got := bt.size(4); got != 4 {
+		t.Errorf("size(4) = %d; want 4", got)
+	}
+	for i := 0; i < 2*batchShrinkAfter; i++ {
+		bt.note(0, 4)
+	}
+	if got := bt.size(max); got != max {
+		t.Errorf("size after limited reads = %d; want %d", got, max)
+	}
+	// Sparse reads shrink it, down to minTunedBatchSize.
+	for i := 0; i < 10*batchShrinkAfter; i++ {
+		n := bt.size(max)
+		bt.note(1, n)
+	}
+	if got := bt.size(max); got != minTunedBatchSize {
+		t.Errorf("size after sparse reads = %d; want %d", got, minTunedBatchSize)
+	}
+
+	var nilTuner *batchTuner
+	if got := nilTuner.size(max); got != max {
+		t.Errorf("nil size = %d; want %d", got, max)
+	}
+	nilTuner.note(max, max)
+}
+
+func TestReceiveBatchSize(t *testing.T) {
+	for _, tt := range []struct {
+		opt, want int
+	}{
+		{0, defaultBatchSize()},
+		{1, 1},
+		{32, 32},
+		{maxReceiveBatchSize * 2, maxReceiveBatchSize},
+	} {
+		conn, err := NewConn(Options{
+			EndpointsFunc:    func(eps []tailcfg.Endpoint) {},
+			Logf:             t.Logf,
+			DisableIPv6:      true,
+			ReceiveBatchSize: tt.opt,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.Bind().BatchSize(); got != tt.want {
+			t.Errorf("ReceiveBatchSize %d: BatchSize = %d; want %d", tt.opt, got, tt.want)
+		}
+		conn.Close()
+	}
+}
+
+func TestNATAllocation(t *testing.T) {
+	aps := func(ports ...uint16) []netip.AddrPort {
+		var ret []netip.AddrPort
+		for _, p := range ports {
+			ret = append(ret, netip.AddrPortFrom(netip.MustParseAddr("203.0.113.1"), p))
+		}
+		return ret
+	}
+	tests := []struct {
+		name     string
+		mapped   []netip.AddrPort
+		wantPort uint16
+		wantStep int
+		wantErr  bool
+	}{
+		{"sequential", aps(1000, 1001, 1002, 1003), 1003, 1, false},
+		{"step-2-with-gap", aps(1000, 1002, 1004, 1010, 1012), 1012, 2, false},
+		{"descending", aps(5000, 4996, 4992, 4988), 4988, -4, false},
+		{"random", aps(1000, 31337, 4242, 60000, 123), 0, 0, true},
+		{"same-port", aps(1000, 1000, 1000), 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := natAllocationOf(tt.mapped)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v; want error", a)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.addr.Port() != tt.wantPort || a.step != tt.wantStep {
+				t.Errorf("got port %d, step %d; want %d, %d", a.addr.Port(), a.step, tt.wantPort, tt.wantStep)
+			}
+		})
+	}
+
+	got := predictedPorts(natAllocation{addr: netip.MustParseAddrPort("203.0.113.1:65530"), step: 2}, 5)
+	want := aps(65532, 65534)
+	if !slices.Equal(got, want) {
+		t.Errorf("predictedPorts near the top = %v; want %v", got, want)
+	}
+}
+
+func TestMeasureNATAllocation(t *testing.T) {
+	stunAddr, stunCleanup := stuntest.Serve(t)
+	defer stunCleanup()
+	server := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(stunAddr.Port))
+
+	var lastPort uint16
+	listen := func(port uint16) (nettype.PacketConn, error) {
+		pc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)})
+		if err == nil {
+			lastPort = uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+		}
+		return pc, err
+	}
+	// Without a NAT, the mapped ports are the sockets' sequential
+	// source ports.
+	a, err := measureNATAllocation(context.Background(), listen, server, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.step != 1 || a.addr.Port() != lastPort {
+		t.Errorf("got %v step %d; want port %d step 1", a.addr, a.step, lastPort)
+	}
+}
+
+func TestPredictedEndpointExpiry(t *testing.T) {
+	now := time.Now()
+	st := &endpointState{predictedTime: now}
+	if st.shouldDeleteLocked(now.Add(portPredictTimeout / 2)) {
+		t.Error("predicted endpoint deleted before portPredictTimeout")
+	}
+	if !st.shouldDeleteLocked(now.Add(portPredictTimeout + time.Second)) {
+		t.Error("predicted endpoint kept after portPredictTimeout")
+	}
+}
+
+func TestLatencyHistogramsPublished(t *testing.T) {
+	for _, name := range []string{
+		"magicsock_disco_rtt_seconds",
+		"magicsock_derp_write_queue_wait_seconds",
+		"magicsock_endpoint_update_seconds",
+	} {
+		if _, ok := expvar.Get(name).(*metrics.Histogram); !ok {
+			t.Errorf("%s not published as a histogram", name)
+		}
+	}
+
+	before := histDiscoRTT.String()
+	histDiscoRTT.Observe(0.003)
+	if histDiscoRTT.String() == before {
+		t.Error("Observe didn't change histDiscoRTT")
+	}
+	var buf bytes.Buffer
+	histDiscoRTT.PromExport(&buf, "magicsock_disco_rtt_seconds")
+	if !strings.Contains(buf.String(), `magicsock_disco_rtt_seconds_bucket{le="0.005"}`) {
+		t.Errorf("Prometheus export missing bucket:\n%s", buf.String())
+	}
+}
+
+func TestDiscoPrivateKeyOption(t *testing.T) {
+	k := key.NewDisco()
+	c, err := NewConn(Options{
+		EndpointsFunc:   func([]tailcfg.Endpoint) {},
+		Logf:            t.Logf,
+		DisableIPv6:     true,
+		DiscoPrivateKey: k,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got, want := c.DiscoPublicKey(), k.Public(); got != want {
+		t.Errorf("DiscoPublicKey = %v; want %v", got, want)
+	}
+
+	c2, err := NewConn(Options{
+		EndpointsFunc: func([]tailcfg.Endpoint) {},
+		Logf:          t.Logf,
+		DisableIPv6:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if c2.DiscoPublicKey() == k.Public() {
+		t.Error("Conn without DiscoPrivateKey reused the key")
+	}
+}
+
+func TestDiscoRecvLimiter(t *testing.T) {
+	d := newDiscoRecvLimiter(0.001, 3)
+	src := netip.MustParseAddrPort("1.2.3.4:41641")
+	k1, k2 := key.NewDisco().Public(), key.NewDisco().Public()
+
+	for i := range 3 {
+		if ok, _ := d.allow(src, k1); !ok {
+			t.Fatalf("message %d within burst dropped", i)
+		}
+	}
+	if ok, first := d.allow(src, k1); ok || !first {
+		t.Errorf("over burst: ok=%v first=%v; want false, true", ok, first)
+	}
+	if ok, first := d.allow(src, k1); ok || first {
+		t.Errorf("still over burst: ok=%v first=%v; want false, false", ok, first)
+	}
+
+	// Other disco keys from the same source, and the same key from
+	// another source, have their own buckets.
+	if ok, _ := d.allow(src, k2); !ok {
+		t.Error("other key from same source dropped")
+	}
+	if ok, _ := d.allow(netip.MustParseAddrPort("1.2.3.4:41642"), k1); !ok {
+		t.Error("same key from other source dropped")
+	}
+}
+
+func TestValidDiscoSource(t *testing.T) {
+	tests := []struct {
+		src  netip.AddrPort
+		via  discoRXPath
+		want bool
+	}{
+		{netip.MustParseAddrPort("1.2.3.4:41641"), discoRXPathUDP, true},
+		{netip.MustParseAddrPort("[fd7a::1]:41641"), discoRXPathRawSocket, true},
+		{netip.MustParseAddrPort("1.2.3.4:0"), discoRXPathUDP, false},
+		{netip.MustParseAddrPort("0.0.0.0:41641"), discoRXPathUDP, false},
+		{netip.MustParseAddrPort("224.0.0.1:41641"), discoRXPathUDP, false},
+		{netip.MustParseAddrPort("255.255.255.255:41641"), discoRXPathUDP, false},
+		{netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 1), discoRXPathUDP, false},
+		{netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 1), discoRXPathDERP, true},
+		{netip.MustParseAddrPort("1.2.3.4:41641"), discoRXPathDERP, false},
+	}
+	for _, tt := range tests {
+		if got := validDiscoSource(tt.src, tt.via); got != tt.want {
+			t.Errorf("validDiscoSource(%v, %v) = %v; want %v", tt.src, tt.via, got, tt.want)
+		}
+	}
+}
+
+func TestSetDERPHeaderAndReconnect(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+
+	dc := derphttp.NewRegionClient(key.NewNode(), t.Logf, nil, func() *tailcfg.DERPRegion { return nil })
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan struct{})
+	ch := make(chan derpWriteRequest, 4)
+	ch <- derpWriteRequest{pubKey: key.NewNode().Public(), pkts: [][]byte{[]byte("queued")}}
+	wg := syncs.NewWaitGroupChan()
+	wg.Add(1)
+	c.mu.Lock()
+	c.activeDerp = map[int]activeDerp{1: {
+		c:          dc,
+		writeCh:    ch,
+		cancel:     func() { cancel(); close(canceled) },
+		lastWrite:  new(time.Time),
+		createTime: c.now(),
+	}}
+	c.mu.Unlock()
+	go c.runDerpWriter(ctx, dc, ch, nil, wg, syncs.ClosedChan())
+
+	h := http.Header{"Authorization": {"Bearer new"}}
+	c.SetDERPHeaderAndReconnect(h)
+	if got := c.derpHeader.Load(); got == nil || got.Get("Authorization") != "Bearer new" {
+		t.Errorf("derpHeader = %v; want new header", got)
+	}
+	c.mu.Lock()
+	if len(c.activeDerp) != 0 {
+		t.Errorf("old connection still active: %v", c.activeDerp)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-canceled:
+	case <-time.After(derpDrainTimeout / 2):
+		t.Fatal("old connection not closed after its queue drained")
+	}
+	if len(ch) != 0 {
+		t.Errorf("old connection closed with %d writes queued", len(ch))
+	}
+	<-wg.DoneChan()
+}
+
+func TestAltDERPRegion(t *testing.T) {
+	if r := altDERPRegion(&tailcfg.DERPRegion{Nodes: []*tailcfg.DERPNode{{Name: "1a"}}}); r != nil {
+		t.Errorf("single-node region: got %+v; want nil", r)
+	}
+	orig := &tailcfg.DERPRegion{RegionID: 1, Nodes: []*tailcfg.DERPNode{{Name: "1a"}, {Name: "1b"}, {Name: "1c"}}}
+	r := altDERPRegion(orig)
+	var names []string
+	for _, n := range r.Nodes {
+		names = append(names, n.Name)
+	}
+	if got, want := strings.Join(names, ","), "1b,1c,1a"; got != want {
+		t.Errorf("nodes = %v; want %v", got, want)
+	}
+	if orig.Nodes[0].Name != "1a" {
+		t.Error("altDERPRegion modified its argument")
+	}
+}
+
+func TestDERPDualHome(t *testing.T) {
+	c, err := NewConn(Options{
+		EndpointsFunc: func([]tailcfg.Endpoint) {},
+		Logf:          t.Logf,
+		DisableIPv6:   true,
+		DERPDualHome:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.mu.Lock()
+	c.privateKey = key.NewNode() // not SetPrivateKey, which would ReSTUN
+	c.derpMap = &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, Nodes: []*tailcfg.DERPNode{{Name: "1a"}}},
+		2: {RegionID: 2, Nodes: []*tailcfg.DERPNode{{Name: "2a"}, {Name: "2b"}}},
+	}}
+	c.myDerp = 1
+	c.updateDerpAltLocked()
+	if c.derpAlt != nil {
+		t.Error("second connection to single-node region")
+	}
+	c.myDerp = 2
+	c.updateDerpAltLocked()
+	alt := c.derpAlt
+	c.mu.Unlock()
+	if alt == nil || alt.regionID != 2 {
+		t.Fatalf("derpAlt = %+v; want one to region 2", alt)
+	}
+	if !c.isSecondaryDerp(alt.c) {
+		t.Error("isSecondaryDerp = false for derpAlt")
+	}
+
+	before := metricDERPDualHomeSent.Value()
+	peer := key.NewNode().Public()
+	c.sendDERPAlt(netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 1), peer, []byte("other region"))
+	c.sendDERPAlt(netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 2), peer, []byte("home region"))
+	if got := metricDERPDualHomeSent.Value() - before; got != 1 {
+		t.Errorf("sent %d on second connection; want 1", got)
+	}
+
+	c.mu.Lock()
+	c.myDerp = 1
+	c.updateDerpAltLocked()
+	if c.derpAlt != nil {
+		t.Error("second connection kept after home moved to single-node region")
+	}
+	c.mu.Unlock()
+}
+
+func TestLANAnnounce(t *testing.T) {
+	want := lanAnnounce{
+		node:  key.NewNode().Public(),
+		disco: key.NewDisco().Public(),
+		port:  41641,
+	}
+	pkt := appendLANAnnounce(nil, want)
+	if len(pkt) != lanAnnounceLen {
+		t.Fatalf("len = %d; want %d", len(pkt), lanAnnounceLen)
+	}
+	got, ok := parseLANAnnounce(pkt)
+	if !ok || got != want {
+		t.Fatalf("parseLANAnnounce = %v, %v; want %v, true", got, ok, want)
+	}
+	for _, bad := range [][]byte{
+		nil,
+		pkt[:len(pkt)-1],
+		append(slices.Clone(pkt), 0),
+		append([]byte("TSLAN0"), pkt[len(lanAnnounceMagic):]...),
+		appendLANAnnounce(nil, lanAnnounce{node: want.node, disco: want.disco}),
+	} {
+		if _, ok := parseLANAnnounce(bad); ok {
+			t.Errorf("parseLANAnnounce(%x) ok", bad)
+		}
+	}
+}
+
+func TestHandleLANAnnounce(t *testing.T) {
+	c, err := NewConn(Options{
+		EndpointsFunc: func([]tailcfg.Endpoint) {},
+		Logf:          logger.Discard, // pings are sent asynchronously
+		DisableIPv6:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.SetPrivateKey(key.NewNode()); err != nil {
+		t.Fatal(err)
+	}
+
+	peerDisco := key.NewDisco().Public()
+	de := &endpoint{
+		c:                 c,
+		publicKey:         key.NewNode().Public(),
+		heartbeatDisabled: true,
+		sentPing:          map[stun.TxID]sentPing{},
+		endpointState:     map[netip.AddrPort]*endpointState{},
+		debugUpdates:      ringbuffer.New[EndpointChange](4),
+	}
+	de.disco.Store(&endpointDisco{key: peerDisco, short: peerDisco.ShortString()})
+	c.peerMap.upsertEndpoint(de, key.DiscoPublic{})
+
+	lanState := func(ep netip.AddrPort) *endpointState {
+		de.mu.Lock()
+		defer de.mu.Unlock()
+		return de.endpointState[ep]
+	}
+	src := netip.MustParseAddr("192.0.2.20")
+	ep := netip.AddrPortFrom(src, 41641)
+
+	tests := []struct {
+		name string
+		a    lanAnnounce
+		src  netip.Addr
+	}{
+		{"unknown-peer", lanAnnounce{node: key.NewNode().Public(), disco: peerDisco, port: 41641}, src},
+		{"wrong-disco", lanAnnounce{node: de.publicKey, disco: key.NewDisco().Public(), port: 41641}, src},
+		{"loopback-src", lanAnnounce{node: de.publicKey, disco: peerDisco, port: 41641}, netip.MustParseAddr("127.0.0.1")},
+		{"tailscale-src", lanAnnounce{node: de.publicKey, disco: peerDisco, port: 41641}, netip.MustParseAddr("100.64.1.2")},
+	}
+	for _, tt := range tests {
+		c.handleLANAnnounce(tt.a, tt.src)
+		de.mu.Lock()
+		n := len(de.endpointState)
+		de.mu.Unlock()
+		if n != 0 {
+			t.Fatalf("%s: announcement added an endpoint", tt.name)
+		}
+	}
+
+	c.handleLANAnnounce(lanAnnounce{node: de.publicKey, disco: peerDisco, port: 41641}, src)
+	st := lanState(ep)
+	if st == nil || st.lanTime.IsZero() {
+		t.Fatalf("endpoint %v not added with lanTime", ep)
+	}
+	if st.lastPing == 0 {
+		t.Error("added endpoint wasn't pinged")
+	}
+	if st.shouldDeleteLocked(st.lanTime.Add(lanDiscoveryTimeout / 2)) {
+		t.Error("LAN endpoint deleted before lanDiscoveryTimeout")
+	}
+	if !st.shouldDeleteLocked(st.lanTime.Add(lanDiscoveryTimeout + time.Second)) {
+		t.Error("LAN endpoint kept after lanDiscoveryTimeout")
+	}
+}
+
+func TestEndpointTrackerWithdraw(t *testing.T) {
+	stun4Old := tailcfg.Endpoint{Addr: netip.MustParseAddrPort("1.2.3.4:1000"), Type: tailcfg.EndpointSTUN}
+	stun4New := tailcfg.Endpoint{Addr: netip.MustParseAddrPort("5.6.7.8:1000"), Type: tailcfg.EndpointSTUN}
+	stun6 := tailcfg.Endpoint{Addr: netip.MustParseAddrPort("[2001:db8::1]:1000"), Type: tailcfg.EndpointSTUN}
+	portmap := tailcfg.Endpoint{Addr: netip.MustParseAddrPort("1.2.3.4:2000"), Type: tailcfg.EndpointPortmapped}
+
+	now := time.Now()
+	var et endpointTracker
+	et.update(now, []tailcfg.Endpoint{stun4Old, stun6, portmap})
+
+	// The IPv6 STUN probe was lost and no port mapping was found: those
+	// cached endpoints are kept, but the IPv4 one is contradicted.
+	nr := &netcheck.Report{IPv4: true, GlobalV4: stun4New.Addr.String()}
+	eps := []tailcfg.Endpoint{stun4New}
+	dead := et.withdraw(eps, func(ep tailcfg.Endpoint) bool {
+		return probeContradicts(ep, nr, false)
+	})
+	if want := []tailcfg.Endpoint{stun4Old}; !reflect.DeepEqual(dead, want) {
+		t.Errorf("withdrawn = %v; want %v", dead, want)
+	}
+	got := et.update(now.Add(time.Minute), eps)
+	slices.SortFunc(got, func(a, b tailcfg.Endpoint) int {
+		return strings.Compare(a.Addr.String(), b.Addr.String())
+	})
+	if want := []tailcfg.Endpoint{portmap, stun4New, stun6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("endpoints = %v; want %v", got, want)
+	}
+
+	// A different port mapping contradicts the cached one.
+	if !probeContradicts(portmap, nr, true) {
+		t.Error("portmap not contradicted by a new mapping")
+	}
+	if probeContradicts(stun6, nr, true) {
+		t.Error("IPv6 endpoint contradicted without an IPv6 STUN answer")
+	}
+}
+
+func TestPathKeepalive(t *testing.T) {
+	derpAddr := netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 1)
+	tests := []struct {
+		udp, derp netip.AddrPort
+		want      bool
+	}{
+		{netip.AddrPort{}, derpAddr, false},
+		{netip.MustParseAddrPort("1.2.3.4:41641"), derpAddr, false},
+		{netip.MustParseAddrPort("1.2.3.4:41641"), netip.AddrPort{}, true},
+		{netip.MustParseAddrPort("[2001:db8::1]:41641"), netip.AddrPort{}, true},
+		{netip.MustParseAddrPort("192.168.1.2:41641"), netip.AddrPort{}, false},
+		{netip.MustParseAddrPort("[fe80::1]:41641"), netip.AddrPort{}, false},
+	}
+	for _, tt := range tests {
+		if got := pathWantsKeepalive(tt.udp, tt.derp); got != tt.want {
+			t.Errorf("pathWantsKeepalive(%v, %v) = %v; want %v", tt.udp, tt.derp, got, tt.want)
+		}
+	}
+
+	c := newConn()
+	changed := make(chan key.NodePublic, 4)
+	c.pathKeepaliveFunc = func(nk key.NodePublic) { changed <- nk }
+	de := &endpoint{c: c, publicKey: key.NewNode().Public()}
+	peerDisco := key.NewDisco().Public()
+	de.disco.Store(&endpointDisco{key: peerDisco, short: peerDisco.ShortString()})
+	c.peerMap.upsertEndpoint(de, key.DiscoPublic{})
+
+	check := func(wantChange, wantKeepalive, wantOK bool) {
+		t.Helper()
+		if wantChange {
+			select {
+			case nk := <-changed:
+				if nk != de.publicKey {
+					t.Errorf("changed peer = %v; want %v", nk.ShortString(), de.publicKey.ShortString())
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no change reported")
+			}
+		}
+		select {
+		case <-changed:
+			t.Fatal("unexpected change reported")
+		default:
+		}
+		if want, ok := c.PathWantsKeepalive(de.publicKey); want != wantKeepalive || ok != wantOK {
+			t.Errorf("PathWantsKeepalive = %v, %v; want %v, %v", want, ok, wantKeepalive, wantOK)
+		}
+	}
+	note := func(udp, derp netip.AddrPort) {
+		de.mu.Lock()
+		defer de.mu.Unlock()
+		de.notePathKeepaliveLocked(udp, derp)
+	}
+
+	check(false, false, false)
+	note(netip.AddrPort{}, derpAddr)
+	check(true, false, true)
+	note(netip.AddrPort{}, derpAddr)
+	check(false, false, true)
+	note(netip.MustParseAddrPort("1.2.3.4:41641"), netip.AddrPort{})
+	check(true, true, true)
+}
+
+func TestRefreshScope(t *testing.T) {
+	for _, s := range []RefreshScope{RefreshFull, RefreshHomeDERP, RefreshPortmap} {
+		b, _ := s.MarshalText()
+		var got RefreshScope
+		if err := got.UnmarshalText(b); err != nil || got != s {
+			t.Errorf("UnmarshalText(%q) = %v, %v; want %v", b, got, err, s)
+		}
+	}
+
+	// Queued updates widen to the broadest scope requested.
+	c := newConn()
+	c.queueEndpointsUpdateLocked(RefreshPortmap, "a")
+	c.queueEndpointsUpdateLocked(RefreshHomeDERP, "b")
+	c.queueEndpointsUpdateLocked(RefreshPortmap, "c")
+	if c.wantEndpointsUpdate != "c" || c.wantEndpointsScope != RefreshHomeDERP {
+		t.Errorf("queued %q, %v; want %q, %v", c.wantEndpointsUpdate, c.wantEndpointsScope, "c", RefreshHomeDERP)
+	}
+}
+
+func TestRefreshHomeDERP(t *testing.T) {
+	stunAddr, stunCleanup := stuntest.Serve(t)
+	defer stunCleanup()
+
+	c, err := NewConn(Options{
+		EndpointsFunc: func([]tailcfg.Endpoint) {},
+		Logf:          t.Logf,
+		DisableIPv6:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go func() {
+		pkts := [][]byte{make([]byte, 64<<10)}
+		sizes := make([]int, 1)
+		eps := make([]wgconn.Endpoint, 1)
+		receiveIPv4 := c.receiveIPv4()
+		for {
+			if _, err := receiveIPv4(pkts, sizes, eps); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Set the DERP map and home directly, as SetDERPMap would start a
+	// full update.
+	c.mu.Lock()
+	c.derpMap = stuntest.DERPMapOf(stunAddr.String())
+	c.myDerp = 1
+	c.mu.Unlock()
+	stale := "203.0.113.1:1"
+	c.lastNetCheckReport.Store(&netcheck.Report{IPv4: true, GlobalV4: stale, PreferredDERP: 1})
+
+	nr, err := c.refreshNetInfo(context.Background(), RefreshPortmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nr.GlobalV4 != stale {
+		t.Errorf("portmap refresh GlobalV4 = %q; want last report's %q", nr.GlobalV4, stale)
+	}
+
+	nr, err = c.refreshNetInfo(context.Background(), RefreshHomeDERP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), c.LocalPort()).String()
+	if nr.GlobalV4 != want {
+		t.Errorf("home DERP refresh GlobalV4 = %q; want %q", nr.GlobalV4, want)
+	}
+	if nr.PreferredDERP != 1 {
+		t.Errorf("PreferredDERP = %d; want last report's 1", nr.PreferredDERP)
+	}
+}
+
+func TestDERPErrClass(t *testing.T) {
+	c := newConn()
+	ctx := context.Background()
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	tests := []struct {
+		ctx  context.Context
+		err  error
+		want string
+	}{
+		{ctx, derphttp.ErrClientClosed, "closed"},
+		{canceled, errors.New("read failed"), "canceled"},
+		{ctx, fmt.Errorf("dial: %w", &net.DNSError{Err: "no such host", Name: "derp.invalid"}), "dns"},
+		{ctx, &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, "refused"},
+		{ctx, &net.OpError{Op: "read", Err: syscall.ECONNRESET}, "reset"},
+		{ctx, fmt.Errorf("recv: %w", io.EOF), "eof"},
+		{ctx, context.DeadlineExceeded, "timeout"},
+		{ctx, tls.RecordHeaderError{Msg: "bad record"}, "tls"},
+		{ctx, errors.New("something else"), "other"},
+	}
+	for _, tt := range tests {
+		if got := c.derpErrClass(tt.ctx, tt.err); got != tt.want {
+			t.Errorf("derpErrClass(%v) = %q; want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestNoteDERPState(t *testing.T) {
+	c := newConn()
+
+	var got []DERPStateEvent
+	c.SetDERPStateCallback(func(ev DERPStateEvent) {
+		got = append(got, ev)
+	})
+	const region = 9001
+	m := derpRegionMetricsFor(region)
+	disconnectEOF := derpDisconnectMetric("eof")
+	before := disconnectEOF.Value()
+
+	c.noteDERPState(DERPStateEvent{Region: region, State: DERPConnecting})
+	c.noteDERPState(DERPStateEvent{Region: region, State: DERPConnected})
+	c.noteDERPState(DERPStateEvent{Region: region, State: DERPDisconnected, Err: io.EOF, ErrClass: "eof"})
+	c.noteDERPState(DERPStateEvent{Region: region, State: DERPBackoff, Backoff: 250 * time.Millisecond})
+
+	var states []string
+	for _, ev := range got {
+		states = append(states, ev.State.String())
+	}
+	if want := "connecting connected disconnected backoff"; strings.Join(states, " ") != want {
+		t.Errorf("callback states = %q; want %q", states, want)
+	}
+	for _, tt := range []struct {
+		m    *clientmetric.Metric
+		want int64
+	}{
+		{m.connecting, 1},
+		{m.connected, 1},
+		{m.disconnected, 1},
+		{m.backoffMs, 250},
+		{disconnectEOF, before + 1},
+	} {
+		if got := tt.m.Value(); got != tt.want {
+			t.Errorf("%s = %d; want %d", tt.m.Name(), got, tt.want)
+		}
+	}
+	if derpRegionMetricsFor(region) != m {
+		t.Error("derpRegionMetricsFor returned new metrics for a known region")
+	}
+}
+
+func TestLogSampler(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := &logSampler{limit: 2}
+	var logged []bool
+	for i := 0; i < 4; i++ {
+		ok, suppressed := s.allow("a", now)
+		if suppressed != 0 {
+			t.Fatalf("line %d: suppressed = %d within the first window", i, suppressed)
+		}
+		logged = append(logged, ok)
+	}
+	if want := []bool{true, true, false, false}; !reflect.DeepEqual(logged, want) {
+		t.Errorf("logged = %v; want %v", logged, want)
+	}
+	if ok, _ := s.allow("b", now); !ok {
+		t.Error("class b limited by class a's lines")
+	}
+
+	ok, suppressed := s.allow("a", now.Add(logSampleWindow))
+	if !ok || suppressed != 2 {
+		t.Errorf("next window = (%v, %d); want (true, 2)", ok, suppressed)
+	}
+	if _, suppressed := s.allow("a", now.Add(2*logSampleWindow)); suppressed != 0 {
+		t.Errorf("window after = %d suppressed; want 0", suppressed)
+	}
+
+	unlimited := &logSampler{limit: -1}
+	for i := 0; i < 2*defaultLogSamplesPerMinute; i++ {
+		if ok, _ := unlimited.allow("a", now); !ok {
+			t.Fatalf("unlimited sampler suppressed line %d", i)
+		}
+	}
+}
+
+func TestLogfSampled(t *testing.T) {
+	c := newConn()
+	var lines []string
+	c.logf = func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	c.logSampler.limit = 1
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1000, 0)})
+	c.clock = clock
+
+	c.logfSampled("send", "failed %d", 1)
+	c.logfSampled("send", "failed %d", 2)
+	c.logfSampled("send", "failed %d", 3)
+	clock.Advance(logSampleWindow)
+	c.logfSampled("send", "failed %d", 4)
+
+	want := []string{
+		"failed 1",
+		`magicsock: suppressed 2 "send" log lines in the previous minute`,
+		"failed 4",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines = %q; want %q", lines, want)
+	}
+}
+
+func TestPunchUDPErrors(t *testing.T) {
+	c := newConn()
+	peer := key.NewNode().Public()
+	if _, err := c.PunchUDP(context.Background(), peer, 0); err == nil {
+		t.Error("zero port: want error")
+	}
+	if _, err := c.PunchUDP(context.Background(), peer, 41641); err == nil || !strings.Contains(err.Error(), "unknown peer") {
+		t.Errorf("unknown peer: err = %v", err)
+	}
+
+	de := &endpoint{
+		c:             c,
+		publicKey:     peer,
+		endpointState: map[netip.AddrPort]*endpointState{},
+	}
+	peerDisco := key.NewDisco().Public()
+	de.disco.Store(&endpointDisco{key: peerDisco, short: peerDisco.ShortString()})
+	c.peerMap.upsertEndpoint(de, key.DiscoPublic{})
+	if _, err := c.PunchUDP(context.Background(), peer, 41641); err == nil || !strings.Contains(err.Error(), "no known addresses") {
+		t.Errorf("no addresses: err = %v", err)
+	}
+
+	de.endpointState[netip.MustParseAddrPort("192.0.2.1:41641")] = &endpointState{}
+	de.bestAddr = addrLatency{AddrPort: netip.MustParseAddrPort("[::ffff:192.0.2.1]:1234")}
+	if got, want := de.punchIPs(), []netip.Addr{netip.MustParseAddr("192.0.2.1")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("punchIPs = %v; want %v", got, want)
+	}
+}
+
+func TestPunchRead(t *testing.T) {
+	c := newConn()
+	peerPriv := key.NewDisco()
+	p := &punch{
+		c:         c,
+		peerDisco: peerPriv.Public(),
+		shared:    c.discoPrivate.Shared(peerPriv.Public()),
+		txid:      stun.NewTxID(),
+		got:       make(chan netip.AddrPort, 2),
+	}
+
+	pc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go p.read(pc)
+
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peerAddr := peer.LocalAddr().(*net.UDPAddr).AddrPort()
+	dst := pc.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	peerShared := peerPriv.Shared(c.discoPublic)
+	sealFromPeer := func(m disco.Message) []byte {
+		pkt := append([]byte(disco.Magic), peerPriv.Public().AppendTo(nil)...)
+		return append(pkt, peerShared.Seal(m.AppendMarshal(nil))...)
+	}
+	wait := func() netip.AddrPort {
+		t.Helper()
+		select {
+		case ap := <-p.got:
+			return ap
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for punch result")
+		}
+		return netip.AddrPort{}
+	}
+
+	// A pong for another punch is ignored; one for ours is a result.
+	peer.WriteToUDPAddrPort(sealFromPeer(&disco.Pong{TxID: stun.NewTxID(), Src: dst}), dst)
+	peer.WriteToUDPAddrPort(sealFromPeer(&disco.Pong{TxID: [12]byte(p.txid), Src: dst}), dst)
+	if got := wait(); got != peerAddr {
+		t.Errorf("pong result = %v; want %v", got, peerAddr)
+	}
+
+	// A ping is answered with a pong and is a result.
+	txid := stun.NewTxID()
+	peer.WriteToUDPAddrPort(sealFromPeer(&disco.Ping{TxID: txid}), dst)
+	if got := wait(); got != peerAddr {
+		t.Errorf("ping result = %v; want %v", got, peerAddr)
+	}
+	buf := make([]byte, 1500)
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := peer.ReadFromUDPAddrPort(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const headerLen = len(disco.Magic) + key.DiscoPublicRawLen
+	payload, ok := peerShared.Open(buf[headerLen:n])
+	if !ok {
+		t.Fatal("can't open reply")
+	}
+	dm, err := disco.Parse(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pong, ok := dm.(*disco.Pong); !ok || pong.TxID != [12]byte(txid) || pong.Src != peerAddr {
+		t.Errorf("reply = %#v; want pong of %x from %v", dm, txid, peerAddr)
+	}
+}
+
+func TestApplyPeerChange(t *testing.T) {
+	k1, k2 := key.NewNode().Public(), key.NewNode().Public()
+	d1 := key.NewDisco().Public()
+	n1 := &tailcfg.Node{ID: 1, Key: k1, DiscoKey: d1, DERP: "127.3.3.40:1", Endpoints: []string{"1.2.3.4:5"}}
+	n2 := &tailcfg.Node{ID: 2, Key: k2, DiscoKey: key.NewDisco().Public()}
+
+	c := newConn()
+	c.logf = t.Logf
+	var diffs []NetmapDiff
+	c.netmapDiffFunc = func(d NetmapDiff) {
+		diffs = append(diffs, d)
+	}
+	c.SetNetworkMap(&netmap.NetworkMap{Peers: []*tailcfg.Node{n1, n2}})
+	c.mu.Lock()
+	c.discoInfoLocked(d1)
+	c.mu.Unlock()
+	diffs = nil
+
+	d1b := key.NewDisco().Public()
+	c.ApplyPeerChange(&tailcfg.PeerChange{
+		NodeID:     1,
+		DERPRegion: 2,
+		Endpoints:  []string{"1.2.3.4:7"},
+		DiscoKey:   &d1b,
+	})
+
+	if n1.DERP != "127.3.3.40:1" || n1.DiscoKey != d1 {
+		t.Error("ApplyPeerChange modified the caller's node")
+	}
+	c.mu.Lock()
+	got := c.netMap.Peers[0]
+	_, oldInfo := c.discoInfo[d1]
+	c.mu.Unlock()
+	if got.DERP != "127.3.3.40:2" || !slices.Equal(got.Endpoints, []string{"1.2.3.4:7"}) || got.DiscoKey != d1b {
+		t.Errorf("netmap peer = %v; want change applied", got)
+	}
+	if oldInfo {
+		t.Error("old disco key's info kept")
+	}
+
+	ep, ok := c.peerMap.endpointForNodeKey(k1)
+	if !ok {
+		t.Fatal("endpoint gone")
+	}
+	ep.mu.Lock()
+	derpAddr := ep.derpAddr
+	_, oldEP := ep.endpointState[netip.MustParseAddrPort("1.2.3.4:5")]
+	_, newEP := ep.endpointState[netip.MustParseAddrPort("1.2.3.4:7")]
+	ep.mu.Unlock()
+	if derpAddr != netip.MustParseAddrPort("127.3.3.40:2") {
+		t.Errorf("derpAddr = %v; want region 2", derpAddr)
+	}
+	if oldEP || !newEP {
+		t.Errorf("endpoints old=%v new=%v; want only the new one", oldEP, newEP)
+	}
+	if d := ep.disco.Load(); d == nil || d.key != d1b {
+		t.Errorf("endpoint disco = %v; want %v", d, d1b.ShortString())
+	}
+	if !c.peerMap.anyEndpointForDiscoKey(d1b) || c.peerMap.anyEndpointForDiscoKey(d1) {
+		t.Error("peerMap disco keys not updated")
+	}
+	want := NetmapDiff{
+		NumPeers:         2,
+		PeersChanged:     []key.NodePublic{k1},
+		EndpointsChanged: []key.NodePublic{k1},
+		DiscoKeysChanged: []key.NodePublic{k1},
+	}
+	if len(diffs) != 1 || !reflect.DeepEqual(diffs[0], want) {
+		t.Errorf("diffs = %+v; want %+v", diffs, want)
+	}
+
+	// Unknown nodes and no-op changes are ignored.
+	diffs = nil
+	c.ApplyPeerChange(&tailcfg.PeerChange{NodeID: 3, DERPRegion: 5})
+	c.ApplyPeerChange(&tailcfg.PeerChange{NodeID: 2})
+	if len(diffs) != 0 {
+		t.Errorf("diffs = %+v; want none", diffs)
+	}
+
+	// A new node key replaces the peer's endpoint.
+	k2b := key.NewNode().Public()
+	c.ApplyPeerChange(&tailcfg.PeerChange{NodeID: 2, Key: &k2b})
+	if _, ok := c.peerMap.endpointForNodeKey(k2); ok {
+		t.Error("endpoint of old node key kept")
+	}
+	if _, ok := c.peerMap.endpointForNodeKey(k2b); !ok {
+		t.Error("no endpoint for new node key")
+	}
+}
+
+func TestProbeOnlyPeer(t *testing.T) {
+	k := key.NewNode().Public()
+	n := &tailcfg.Node{ID: 1, Key: k, DiscoKey: key.NewDisco().Public(), DERP: "127.3.3.40:1", Endpoints: []string{"1.2.3.4:5"}, ProbeOnly: true}
+
+	c := newConn()
+	c.logf = t.Logf
+	// The clock never advances, so the probes don't actually run.
+	c.clock = tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	c.SetNetworkMap(&netmap.NetworkMap{Peers: []*tailcfg.Node{n}})
+
+	ep, ok := c.peerMap.endpointForNodeKey(k)
+	if !ok {
+		t.Fatal("no endpoint for probe-only peer")
+	}
+	ep.mu.Lock()
+	probing := ep.probeOnly && ep.probeTimer != nil
+	ep.bestAddr = addrLatency{netip.MustParseAddrPort("1.2.3.4:5"), 20 * time.Millisecond}
+	ep.quality.addRTT(20 * time.Millisecond)
+	ep.mu.Unlock()
+	if !probing {
+		t.Fatal("probes of probe-only peer not started")
+	}
+
+	var ps ipnstate.PeerStatus
+	ep.populatePeerStatus(&ps)
+	if !ps.ProbeOnly || ps.CurAddr != "1.2.3.4:5" || ps.SmoothedRTTSeconds == 0 {
+		t.Errorf("status = ProbeOnly %v, CurAddr %q, RTT %v; want the probed path", ps.ProbeOnly, ps.CurAddr, ps.SmoothedRTTSeconds)
+	}
+
+	n2 := n.Clone()
+	n2.ProbeOnly = false
+	c.SetNetworkMap(&netmap.NetworkMap{Peers: []*tailcfg.Node{n2}})
+	ep.mu.Lock()
+	probing = ep.probeOnly || ep.probeTimer != nil
+	ep.mu.Unlock()
+	if probing {
+		t.Error("probes continued after the peer stopped being probe-only")
+	}
+}
+
+func TestPeerHasDiscoCap(t *testing.T) {
+	const newCap = disco.Capability(1 << 30) // a feature after negotiation
+	c := newConn()
+	c.logf = t.Logf
+	dk := key.NewDisco().Public()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	di := c.discoInfoLocked(dk)
+	check := func(name string, cap disco.Capability, want bool) {
+		t.Helper()
+		if got := c.peerHasDiscoCapLocked(dk, cap); got != want {
+			t.Errorf("%s: peerHasDiscoCap(%v) = %v; want %v", name, cap, got, want)
+		}
+	}
+	check("silent peer", disco.CapPortPredict, true)
+	check("silent peer", newCap, false)
+
+	c.noteDiscoCapsLocked(di, newCap)
+	check("new peer", disco.CapPortPredict, false)
+	check("new peer", newCap, true)
+
+	c.noteDiscoCapsLocked(di, 0)
+	check("downgraded peer", disco.CapPortPredict, true)
+	check("downgraded peer", newCap, false)
+}
+
+func TestProvisionalDERPHome(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.derpMap = &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, RegionCode: "one"},
+		2: {RegionID: 2, RegionCode: "two"},
+		3: {RegionID: 3, RegionCode: "three"},
+	}}
+
+	home := func() int {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.provisionalDERPHomeLocked()
+	}
+	if got := home(); got != 0 {
+		t.Errorf("cold start: provisional home = %d; want 0, for the fallback", got)
+	}
+	c.lastNetCheckReport.Store(&netcheck.Report{PreferredDERP: 9})
+	if got := home(); got != 0 {
+		t.Errorf("unknown last region: provisional home = %d; want 0", got)
+	}
+	c.lastNetCheckReport.Store(&netcheck.Report{PreferredDERP: 2})
+	if got := home(); got != 2 {
+		t.Errorf("after netcheck: provisional home = %d; want 2", got)
+	}
+	c.pinnedDERP = 3
+	if got := home(); got != 3 {
+		t.Errorf("pinned: provisional home = %d; want 3", got)
+	}
+
+	// Without a private key, DERP can't connect, so there's no home yet.
+	c.startProvisionalDERPHome()
+	if c.myDerp != 0 {
+		t.Errorf("provisional home derp-%d without a private key", c.myDerp)
+	}
+}
+
+func TestEnqueueDerpWriteContext(t *testing.T) {
+	c := newConn()
+	c.derpDropPolicy = DERPDropNewest
+	ch := make(chan derpWriteRequest, 1)
+	ch <- derpWriteRequest{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	queued, err := c.enqueueDerpWrite(ctx, ch, derpWriteRequest{pkts: make([][]byte, 1)})
+	if queued || !errors.Is(err, errDropDerpPacket) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("enqueue to full queue = %v, %v; want dropped at the deadline", queued, err)
+	}
+
+	// With room made before the deadline, the write waits for it rather
+	// than being dropped.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-ch
+	}()
+	if queued, err := c.enqueueDerpWrite(ctx, ch, derpWriteRequest{}); !queued || err != nil {
+		t.Errorf("enqueue = %v, %v; want queued once there's room", queued, err)
+	}
+}
+
+func TestSendPathMTU(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("UDP GSO is only used on Linux")
+	}
+	// Fail the first write of the last run, which coalesces buffs 3
+	// and 4, so only they may be resent.
+	var msgs int
+	w := &gsoTestWriter{
+		fail: func(_ ipv6.Message, coalesced bool) error {
+			msgs++
+			if msgs == 3 && coalesced {
+				return syscall.EMSGSIZE
+			}
+			return nil
+		},
+	}
+	bc := newGSOTestConn(t, w)
+	c := newConn()
+	c.logf = t.Logf
+	var pconn nettype.PacketConn = bc
+	c.pconn4.pconn = pconn
+	c.pconn4.pconnAtomic.Store(&pconn)
+	ep := &endpoint{
+		c:                  c,
+		publicKey:          key.NewNode().Public(),
+		heartbeatDisabled:  true,
+		bestAddr:           addrLatency{AddrPort: netip.MustParseAddrPort("127.0.0.1:1")},
+		trustBestAddrUntil: mono.Now().Add(time.Hour),
+	}
+	discoKey := key.NewDisco().Public()
+	ep.disco.Store(&endpointDisco{key: discoKey, short: discoKey.ShortString()})
+	c.peerMap.upsertEndpoint(ep, key.DiscoPublic{})
+	if err := c.SetPeerPathMTU(ep.publicKey, 100+udpHeaderLen(netip.MustParseAddr("127.0.0.1"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The long third buff is sent on its own, between two coalesced
+	// runs.
+	buffs := gsoTestBuffs(5)
+	buffs[2] = make([]byte, 150)
+	if err := ep.send(context.Background(), buffs); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	lens, _ := w.takeWritten()
+	if want := []int{200, 150, 100, 100}; !reflect.DeepEqual(lens, want) {
+		t.Errorf("written = %v; want %v", lens, want)
+	}
+
+	if got := mtuRuns(buffs, 100); !reflect.DeepEqual(got, []mtuRun{{2, false}, {1, true}, {2, false}}) {
+		t.Errorf("mtuRuns = %v", got)
+	}
+}
+
+func TestAutoRebindFlapping(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	c := newConn()
+	c.logf = t.Logf
+	c.clock = clock
+	a := newAutoRebind(c, time.Second)
+	c.autoRebind = a
+	applied := make(chan bool, 10)
+	a.apply = func(major bool, _ *interfaces.State) { applied <- major }
+
+	wantApplied := func(name string, want ...bool) {
+		t.Helper()
+		var got []bool
+		timeout := time.After(5 * time.Second)
+		for len(got) < len(want) {
+			select {
+			case major := <-applied:
+				got = append(got, major)
+			case <-timeout:
+				t.Fatalf("%s: applied %v; want %v", name, got, want)
+			}
+		}
+		select {
+		case major := <-applied:
+			t.Fatalf("%s: applied %v and then %v; want %v", name, got, major, want)
+		case <-time.After(20 * time.Millisecond):
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: applied %v; want %v", name, got, want)
+		}
+	}
+
+	// A short storm is applied once, when it settles, as major if any
+	// change was.
+	for i := range 10 {
+		a.onChange(i == 3, nil)
+		clock.Advance(200 * time.Millisecond)
+	}
+	wantApplied("during short storm")
+	clock.Advance(time.Second)
+	wantApplied("after short storm", true)
+
+	// A storm that doesn't settle is applied after five windows anyway,
+	// and the rest of it once it does.
+	for i := range 14 {
+		a.onChange(false, nil)
+		clock.Advance(500 * time.Millisecond)
+		switch i {
+		case 8:
+			wantApplied("before max delay")
+		case 9:
+			wantApplied("at max delay", false)
+		}
+	}
+	wantApplied("during long storm")
+	clock.Advance(time.Second)
+	wantApplied("after long storm", false)
+
+	// Changes while suppressed wait for the release.
+	release := c.SuppressAutoRebind()
+	release2 := c.SuppressAutoRebind()
+	a.onChange(true, nil)
+	clock.Advance(10 * time.Second)
+	release()
+	release() // no-op
+	clock.Advance(10 * time.Second)
+	wantApplied("while suppressed")
+	release2()
+	wantApplied("at release")
+	clock.Advance(time.Second)
+	wantApplied("after release", true)
+}
+
+func TestDERPDiscoLane(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	ch := make(chan derpWriteRequest, 4)
+	discoCh := make(chan derpWriteRequest, 4)
+	c.mu.Lock()
+	c.privateKey = key.NewNode()
+	c.derpMap = &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{1: {RegionID: 1}}}
+	c.activeDerp = map[int]activeDerp{1: {
+		writeCh:      ch,
+		discoWriteCh: discoCh,
+		lastWrite:    new(time.Time),
+		createTime:   c.now(),
+	}}
+	c.mu.Unlock()
+
+	addr := netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 1)
+	peer := key.NewNode().Public()
+	data := []byte("data")
+	discoMsg := append([]byte(disco.Magic), make([]byte, 64)...)
+	ctx := context.Background()
+	for _, b := range [][]byte{data, data, discoMsg} {
+		if sent, err := c.sendDERPBatch(ctx, addr, peer, [][]byte{b}); !sent || err != nil {
+			t.Fatalf("sendDERPBatch = %v, %v; want true, nil", sent, err)
+		}
+	}
+	// A batch is never disco, even if it starts with a disco message.
+	if sent, err := c.sendDERPBatch(ctx, addr, peer, [][]byte{discoMsg, data}); !sent || err != nil {
+		t.Fatalf("sendDERPBatch = %v, %v; want true, nil", sent, err)
+	}
+	if len(ch) != 3 || len(discoCh) != 1 {
+		t.Fatalf("queued %d data, %d disco; want 3, 1", len(ch), len(discoCh))
+	}
+
+	// The disco message is written first, though queued last.
+	var got []int
+	for range 4 {
+		wr, ok := nextDerpWrite(ctx, ch, discoCh)
+		if !ok {
+			t.Fatal("nextDerpWrite: not ok")
+		}
+		got = append(got, len(wr.pkts[0]))
+	}
+	if want := []int{len(discoMsg), len(data), len(data), len(discoMsg)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("written packet lengths %v; want %v", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, ok := nextDerpWrite(ctx, ch, discoCh); ok {
+		t.Error("nextDerpWrite after ctx done: ok")
+	}
+}
+
+func TestSendCircuitBreaker(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	c := &Conn{clock: clock, logf: t.Logf}
+	a := netip.MustParseAddrPort("1.2.3.4:567")
+	b := netip.MustParseAddrPort("5.6.7.8:567")
+	derp := netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 1)
+	now := c.monoNow()
+	stA, stB := &endpointState{}, &endpointState{}
+	stA.addPongReplyLocked(pongReply{latency: 10 * time.Millisecond, pongAt: now})
+	stB.addPongReplyLocked(pongReply{latency: 20 * time.Millisecond, pongAt: now})
+	de := &endpoint{
+		c:                  c,
+		derpAddr:           derp,
+		bestAddr:           addrLatency{a, 10 * time.Millisecond},
+		trustBestAddrUntil: now.Add(trustUDPAddrDuration),
+		endpointState:      map[netip.AddrPort]*endpointState{a: stA, b: stB},
+		debugUpdates:       ringbuffer.New[EndpointChange](4),
+	}
+	fail := func(addr netip.AddrPort, n int) {
+		for range n {
+			de.noteUDPSendResult(addr, true)
+		}
+	}
+
+	// A success resets the count, so sends must fail in a row.
+	fail(a, quarantineSendErrs-1)
+	de.noteUDPSendResult(a, false)
+	fail(a, quarantineSendErrs-1)
+	if de.bestAddr.AddrPort != a {
+		t.Fatalf("bestAddr = %v before %d failures; want %v", de.bestAddr, quarantineSendErrs, a)
+	}
+
+	// The next failure quarantines a, switching to b.
+	fail(a, 1)
+	if de.bestAddr.AddrPort != b {
+		t.Fatalf("bestAddr = %v after quarantine; want %v", de.bestAddr, b)
+	}
+	if udp, gotDERP, _ := de.addrForSendLocked(c.monoNow()); udp != b || gotDERP.IsValid() {
+		t.Errorf("sending to %v, %v; want %v alone", udp, gotDERP, b)
+	}
+	ups := de.debugUpdates.GetAll()
+	if last := ups[len(ups)-1]; last.Reason != ChangeBestAddrQuarantined || last.OldAddr != a || last.NewAddr != b {
+		t.Errorf("last change = %+v; want %v from %v to %v", last, ChangeBestAddrQuarantined, a, b)
+	}
+	if got := stA.quarantinedUntil.Sub(c.monoNow()); got != quarantineMin {
+		t.Errorf("quarantined for %v; want %v", got, quarantineMin)
+	}
+
+	// A quarantined address isn't promoted by its pongs.
+	if de.betterAddrLocked(addrLatency{a, time.Millisecond}, de.bestAddr) {
+		t.Error("quarantined address is better")
+	}
+	clock.Advance(quarantineMin)
+	if !de.betterAddrLocked(addrLatency{a, time.Millisecond}, de.bestAddr) {
+		t.Error("address not better after its quarantine")
+	}
+
+	// With nothing left, the peer uses DERP alone, and a second
+	// quarantine of the same address lasts twice as long.
+	de.bestAddr = addrLatency{a, 10 * time.Millisecond}
+	stB.quarantinedUntil = c.monoNow().Add(time.Minute)
+	fail(a, quarantineSendErrs)
+	if de.bestAddr.IsValid() {
+		t.Fatalf("bestAddr = %v; want none", de.bestAddr)
+	}
+	if udp, gotDERP, _ := de.addrForSendLocked(c.monoNow()); udp.IsValid() || gotDERP != derp {
+		t.Errorf("sending to %v, %v; want %v alone", udp, gotDERP, derp)
+	}
+	if got := stA.quarantinedUntil.Sub(c.monoNow()); got != 2*quarantineMin {
+		t.Errorf("quarantined again for %v; want %v", got, 2*quarantineMin)
+	}
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	conn := newTestConn(t)
+	// Pretend the first DERP connect is wedged.
+	conn.mu.Lock()
+	conn.activeDerp = map[int]activeDerp{}
+	conn.mu.Unlock()
+
+	start := time.Now()
+	err := conn.CloseWithTimeout(50 * time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "DERP connect") {
+		t.Errorf("CloseWithTimeout = %v; want error naming the DERP connect", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("CloseWithTimeout took %v", d)
+	}
+	select {
+	case <-conn.derpStarted:
+	default:
+		t.Error("derpStarted still open after forced teardown")
+	}
+	if err := conn.CloseWithTimeout(50 * time.Millisecond); err != nil {
+		t.Errorf("second CloseWithTimeout = %v; want nil", err)
+	}
+}
+
+func TestDERPReason(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	a := netip.MustParseAddrPort("1.2.3.4:567")
+	now := mono.FromWall(clock.Now())
+	tests := []struct {
+		name  string
+		block bool
+		setup func(de *endpoint)
+		want  string
+	}{
+		{
+			name: "not-sent-to",
+			setup: func(de *endpoint) {
+				de.lastSend = 0
+			},
+			want: "",
+		},
+		{
+			name: "direct",
+			setup: func(de *endpoint) {
+				de.bestAddr = addrLatency{a, time.Millisecond}
+				de.trustBestAddrUntil = now.Add(time.Minute)
+			},
+			want: "",
+		},
+		{
+			name: "trust-expired",
+			setup: func(de *endpoint) {
+				de.bestAddr = addrLatency{a, time.Millisecond}
+				de.trustBestAddrUntil = now.Add(-time.Minute)
+			},
+			want: "trust-expired",
+		},
+		{
+			name:  "blocked",
+			block: true,
+			want:  "endpoints-blocked",
+		},
+		{
+			name: "no-endpoints",
+			want: "no-endpoints",
+		},
+		{
+			name: "pings-failed",
+			setup: func(de *endpoint) {
+				de.endpointState[a] = &endpointState{}
+			},
+			want: "pings-failed",
+		},
+		{
+			name: "quarantined",
+			setup: func(de *endpoint) {
+				de.endpointState[a] = &endpointState{quarantinedUntil: now.Add(time.Minute)}
+			},
+			want: "send-errors",
+		},
+		{
+			name: "mtu",
+			setup: func(de *endpoint) {
+				de.endpointState[a] = &endpointState{}
+				de.pathMTU = 1300
+			},
+			want: "mtu-too-small",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conn{clock: clock, logf: t.Logf, blockEndpoints4: tt.block, blockEndpoints6: tt.block}
+			de := &endpoint{
+				c:             c,
+				derpAddr:      netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 1),
+				endpointState: map[netip.AddrPort]*endpointState{},
+				lastSend:      now,
+			}
+			if tt.setup != nil {
+				tt.setup(de)
+			}
+			var ps ipnstate.PeerStatus
+			de.populatePeerStatus(&ps)
+			if ps.DERPReason != tt.want {
+				t.Errorf("DERPReason = %q; want %q", ps.DERPReason, tt.want)
+			}
+		})
+	}
+}
+
+func TestNoteHandshakeFailed(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	c := &Conn{clock: clock, logf: t.Logf}
+	a := netip.MustParseAddrPort("1.2.3.4:567")
+	b := netip.MustParseAddrPort("5.6.7.8:567")
+	now := c.monoNow()
+	stA, stB := &endpointState{}, &endpointState{}
+	stA.addPongReplyLocked(pongReply{latency: 10 * time.Millisecond, pongAt: now})
+	stB.addPongReplyLocked(pongReply{latency: 20 * time.Millisecond, pongAt: now})
+	de := &endpoint{
+		c:                  c,
+		derpAddr:           netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 1),
+		bestAddr:           addrLatency{a, 10 * time.Millisecond},
+		trustBestAddrUntil: now.Add(trustUDPAddrDuration),
+		endpointState:      map[netip.AddrPort]*endpointState{a: stA, b: stB},
+		sentPing:           map[stun.TxID]sentPing{},
+		debugUpdates:       ringbuffer.New[EndpointChange](4),
+	}
+	fail := func(n int) {
+		for range n {
+			de.noteHandshakeFailed()
+			clock.Advance(5 * time.Second)
+		}
+	}
+
+	// Failures too far apart don't add up.
+	fail(handshakeFailQuarantine - 1)
+	clock.Advance(handshakeFailGap)
+	fail(handshakeFailQuarantine - 1)
+	if de.bestAddr.AddrPort != a {
+		t.Fatalf("bestAddr = %v after spread-out failures; want %v", de.bestAddr, a)
+	}
+
+	// The next one in a row quarantines a and restarts discovery.
+	fail(1)
+	if de.bestAddr.AddrPort != b {
+		t.Fatalf("bestAddr = %v after handshake failures; want %v", de.bestAddr, b)
+	}
+	ups := de.debugUpdates.GetAll()
+	if last := ups[len(ups)-1]; last.Reason != ChangeBestAddrHandshakeFailed || last.OldAddr != a {
+		t.Errorf("last change = %+v; want %v from %v", last, ChangeBestAddrHandshakeFailed, a)
+	}
+	if stA.quarantinedUntil.IsZero() {
+		t.Error("address not quarantined")
+	}
+	if de.lastFullPing.IsZero() {
+		t.Error("discovery not restarted")
+	}
+
+	// Failures on the new best address start a new count.
+	fail(handshakeFailQuarantine - 1)
+	if de.bestAddr.AddrPort != b {
+		t.Errorf("bestAddr = %v; want %v", de.bestAddr, b)
+	}
+}
+
+func TestDERPCoalesceRegions(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.clock = tstest.NewClock(tstest.ClockOpts{})
+	c.networkUp.Store(true)
+	c.privateKey = key.NewNode()
+	c.derpMap = &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1},
+		2: {RegionID: 2},
+		3: {RegionID: 3},
+	}}
+	c.myDerp = 1
+	dc := new(derphttp.Client)
+	ch := make(chan derpWriteRequest, 1)
+	c.activeDerp = map[int]activeDerp{1: {c: dc, writeCh: ch, lastWrite: new(time.Time)}}
+	peer := key.NewNode().Public()
+
+	c.noteDERPRegionsServed(1, dc, []int{1, 2, 4})
+	if got := c.derpWriteChanOfAddr(netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 2), peer, derpLaneData); got != ch {
+		t.Errorf("region 2 not coalesced onto derp-1")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, _, ok := c.coalescedDERPLocked(3); ok {
+		t.Errorf("region 3 coalesced; the server didn't serve it")
+	}
+
+	// Once the connection is replaced, region 2 needs its own again.
+	c.activeDerp[1] = activeDerp{c: new(derphttp.Client), writeCh: ch, lastWrite: new(time.Time)}
+	if _, _, ok := c.coalescedDERPLocked(2); ok {
+		t.Errorf("region 2 still coalesced after derp-1 reconnected")
+	}
+}
+
+func TestSetRawDiscoEnabled(t *testing.T) {
+	conn, err := NewConn(Options{
+		Logf:                   t.Logf,
+		Port:                   pickPort(t),
+		TestOnlyPacketListener: localhostListener{},
+		DisableRawDisco:        true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	running := func() bool {
+		conn.rawDiscoMu.Lock()
+		defer conn.rawDiscoMu.Unlock()
+		return conn.closeDisco4 != nil || conn.closeDisco6 != nil
+	}
+	if running() {
+		t.Fatal("raw disco receivers started despite DisableRawDisco")
+	}
+
+	// Whether they start depends on the platform and privileges, but
+	// they must stop.
+	conn.SetRawDiscoEnabled(true)
+	t.Logf("raw disco receivers running: %v", running())
+	conn.SetRawDiscoEnabled(false)
+	if running() {
+		t.Error("raw disco receivers still running")
+	}
+	conn.Close()
+	conn.SetRawDiscoEnabled(true)
+	if running() {
+		t.Error("raw disco receivers started after Close")
+	}
+}
+
+func TestBlockEndpointsPerFamily(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	eps := []tailcfg.Endpoint{
+		{Addr: netip.MustParseAddrPort("1.2.3.4:41641"), Type: tailcfg.EndpointSTUN},
+		{Addr: netip.MustParseAddrPort("192.168.1.2:41641"), Type: tailcfg.EndpointLocal},
+		{Addr: netip.MustParseAddrPort("[fd7a:115c:a1e0::1]:41641"), Type: tailcfg.EndpointLocal},
+	}
+	tests := []struct {
+		name           string
+		block4, block6 bool
+		want           []string
+	}{
+		{"none", false, false, []string{"1.2.3.4:41641", "192.168.1.2:41641", "[fd7a:115c:a1e0::1]:41641"}},
+		{"v4", true, false, []string{"[fd7a:115c:a1e0::1]:41641"}},
+		{"v6", false, true, []string{"1.2.3.4:41641", "192.168.1.2:41641"}},
+		{"both", true, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.mu.Lock()
+			c.blockEndpoints4, c.blockEndpoints6 = tt.block4, tt.block6
+			c.mu.Unlock()
+			c.setEndpoints(slices.Clone(eps))
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			var got []string
+			for _, ep := range c.lastEndpoints {
+				got = append(got, ep.Addr.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("endpoints = %v; want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Have the setters queue their update rather than start one.
+	c.mu.Lock()
+	c.endpointsUpdateActive = true
+	c.mu.Unlock()
+	c.SetBlockEndpoints(true)
+	c.SetBlockEndpointsV4(false)
+	c.mu.Lock()
+	block4, block6, why := c.blockEndpoints4, c.blockEndpoints6, c.wantEndpointsUpdate
+	c.mu.Unlock()
+	if block4 || !block6 {
+		t.Errorf("after SetBlockEndpoints(true), SetBlockEndpointsV4(false): block4=%v, block6=%v; want false, true", block4, block6)
+	}
+	if why != "SetBlockEndpointsV4" {
+		t.Errorf("queued endpoints update = %q; want SetBlockEndpointsV4", why)
+	}
+}
+
+func TestSetNetworkMapSharedNodes(t *testing.T) {
+	conn := newTestConn(t)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetPrivateKey(key.NewNode())
+
+	var peers []*tailcfg.Node
+	for i := range 3 {
+		peers = append(peers, &tailcfg.Node{
+			ID:        tailcfg.NodeID(i + 1),
+			Key:       key.NewNode().Public(),
+			DiscoKey:  key.NewDisco().Public(),
+			Endpoints: []string{fmt.Sprintf("192.168.1.%d:41641", i+1)},
+		})
+	}
+	conn.SetNetworkMap(&netmap.NetworkMap{Peers: peers})
+
+	// Share the first two peers with the last network map, and change
+	// the endpoints of the third.
+	changed := peers[2].Clone()
+	changed.Endpoints = []string{"10.0.0.3:41641"}
+	before := metricNetmapPeersUnchanged.Value()
+	conn.SetNetworkMap(&netmap.NetworkMap{Peers: []*tailcfg.Node{peers[0], peers[1], changed}})
+	if got := metricNetmapPeersUnchanged.Value() - before; got != 2 {
+		t.Errorf("unchanged peers skipped = %d; want 2", got)
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	de, ok := conn.peerMap.endpointForNodeKey(changed.Key)
+	if !ok {
+		t.Fatal("no endpoint for changed peer")
+	}
+	if de.node != changed.View() {
+		t.Errorf("endpoint not updated from the changed node")
+	}
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	if _, ok := de.endpointState[netip.MustParseAddrPort("10.0.0.3:41641")]; !ok {
+		t.Errorf("changed peer's new endpoint missing; have %v", de.endpointState)
+	}
+}
+
+// BenchmarkSetNetworkMapChurn measures a network map update that changes
+// one peer of many, as most updates from control do.
+func BenchmarkSetNetworkMapChurn(b *testing.B) {
+	const numPeers = 5000
+	conn := newTestConn(b)
+	defer conn.Close()
+	conn.logf = logger.Discard
+	conn.SetPrivateKey(key.NewNode())
+
+	peers := make([]*tailcfg.Node, numPeers)
+	for i := range peers {
+		peers[i] = &tailcfg.Node{
+			ID:        tailcfg.NodeID(i + 1),
+			Key:       key.NewNode().Public(),
+			DiscoKey:  key.NewDisco().Public(),
+			Endpoints: []string{fmt.Sprintf("10.%d.%d.1:41641", i/256, i%256)},
+			DERP:      "127.3.3.40:1",
+		}
+	}
+	churned := slices.Clone(peers)
+	churned[numPeers/2] = peers[numPeers/2].Clone()
+	churned[numPeers/2].DERP = "127.3.3.40:2"
+	nms := []*netmap.NetworkMap{{Peers: peers}, {Peers: churned}}
+	conn.SetNetworkMap(nms[0])
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.SetNetworkMap(nms[(i+1)%2])
+	}
+}
+
+func TestStartPacketCaptureFilter(t *testing.T) {
+	c := newConn()
+	peer := key.NewNode().Public()
+	var buf bytes.Buffer
+	stop := c.StartPacketCapture(&buf, CaptureOpts{
+		Data: true,
+		Filter: &capture.Filter{
+			Peers:   set.Set[key.NodePublic]{peer: {}},
+			MaxSize: 50,
+		},
+	})
+	defer stop()
+	headerLen := buf.Len()
+
+	addr := netip.MustParseAddrPort("1.2.3.4:567")
+	c.captureDisco(capture.PathDiscoToPeer, addr, key.NewNode().Public(), []byte("disco"))
+	c.captureDisco(capture.PathDiscoToPeer, addr, key.NodePublic{}, []byte("disco"))
+	c.captureWireGuard(capture.PathWireGuardToPeer, addr, peer, make([]byte, 100))
+	if buf.Len() != headerLen {
+		t.Fatal("captured packets the filter doesn't match")
+	}
+	c.captureWireGuard(capture.PathWireGuardToPeer, addr, peer, make([]byte, 50))
+	n := buf.Len()
+	if n == headerLen {
+		t.Fatal("WireGuard packet to the peer not captured")
+	}
+	c.captureDisco(capture.PathDisco, addr, peer, []byte("disco"))
+	if buf.Len() == n {
+		t.Fatal("disco message from the peer not captured")
+	}
+}
+
+func TestPreferFasterDERP(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	c := &Conn{clock: clock, logf: t.Logf}
+	udp := netip.MustParseAddrPort("1.2.3.4:567")
+	derp := netip.AddrPortFrom(tailcfg.DerpMagicIPAddr, 1)
+	now := c.monoNow()
+	de := &endpoint{
+		c:                  c,
+		derpAddr:           derp,
+		bestAddr:           addrLatency{udp, 50 * time.Millisecond},
+		trustBestAddrUntil: now.Add(time.Hour),
+		endpointState:      map[netip.AddrPort]*endpointState{udp: {}},
+		derpLatency:        20 * time.Millisecond,
+		derpLatencyAt:      now,
+		lastSend:           now,
+	}
+	wantAddrs := func(what string, wantDERP bool) {
+		t.Helper()
+		gotUDP, gotDERP, _ := de.addrForSendLocked(c.monoNow())
+		if wantDERP && (gotUDP.IsValid() || gotDERP != derp) || !wantDERP && (gotUDP != udp || gotDERP.IsValid()) {
+			t.Errorf("%s: addrForSendLocked = %v, %v; want DERP %v", what, gotUDP, gotDERP, wantDERP)
+		}
+	}
+
+	wantAddrs("disabled", false)
+
+	c.SetPreferFasterDERP(true)
+	before := metricPreferDERPFaster.Value()
+	wantAddrs("enabled", true)
+	if got := metricPreferDERPFaster.Value() - before; got != 1 {
+		t.Errorf("metric = %d; want 1", got)
+	}
+	var ps ipnstate.PeerStatus
+	de.populatePeerStatus(&ps)
+	if ps.DERPReason != "derp-faster" {
+		t.Errorf("DERPReason = %q; want derp-faster", ps.DERPReason)
+	}
+
+	// A gain too small to switch to DERP is enough to stay on it.
+	de.bestAddr.latency = 30 * time.Millisecond
+	wantAddrs("hysteresis", true)
+	de.bestAddr.latency = 24 * time.Millisecond
+	wantAddrs("similar", false)
+	de.bestAddr.latency = 30 * time.Millisecond
+	wantAddrs("too-small-gain", false)
+
+	de.bestAddr.latency = 50 * time.Millisecond
+	wantAddrs("faster-again", true)
+	clock.Advance(derpRTTTrust)
+	de.trustBestAddrUntil = c.monoNow().Add(time.Hour)
+	wantAddrs("stale", false)
+	if got := metricPreferDERPFaster.Value() - before; got != 2 {
+		t.Errorf("metric = %d; want 2", got)
+	}
+}
+
+func TestPeerPorts(t *testing.T) {
+	if _, err := NewConn(Options{
+		Logf:      t.Logf,
+		PeerPorts: PeerPorts{Enabled: true, First: 2000, Last: 1000},
+	}); !errors.Is(err, errPeerPortsRange) {
+		t.Fatalf("NewConn with inverted range = %v; want %v", err, errPeerPortsRange)
+	}
+
+	// A single port in the range: the first peer gets it, the next falls
+	// back to the shared socket.
+	port := pickPort(t)
+	conn, err := NewConn(Options{
+		Logf:                   t.Logf,
+		TestOnlyPacketListener: localhostListener{},
+		EndpointsFunc:          func(eps []tailcfg.Endpoint) {},
+		PeerPorts:              PeerPorts{Enabled: true, First: port, Last: port},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fns, _, err := conn.bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.bind.Close()
+	if len(fns) != 4 {
+		t.Fatalf("got %d ReceiveFuncs; want 4", len(fns))
+	}
+	receivePeerPorts := fns[3]
+
+	sendConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sendConn.Close()
+	peer, _ := addTestEndpoint(t, conn, sendConn)
+	addr := netip.MustParseAddrPort(sendConn.LocalAddr().String())
+
+	ruc := conn.udpConnFor(addr, peer)
+	if ruc == &conn.pconn4 || ruc.Port() != port {
+		t.Fatalf("peer's socket port = %d; want own socket on %d", ruc.Port(), port)
+	}
+	if got := conn.udpConnFor(addr, peer); got != ruc {
+		t.Error("peer's socket changed")
+	}
+	if got := conn.udpConnFor(addr, key.NewNode().Public()); got != &conn.pconn4 {
+		t.Errorf("peer beyond the range got port %d; want the shared socket", got.Port())
+	}
+	if got := conn.udpConnFor(addr, key.NodePublic{}); got != &conn.pconn4 {
+		t.Error("unknown peer not sent to from the shared socket")
+	}
+
+	// WireGuard packets read from the peer's socket come out of its
+	// ReceiveFunc.
+	pkt := bytes.Repeat([]byte("x"), 100)
+	if _, err := sendConn.WriteTo(pkt, ruc.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buffs := [][]byte{make([]byte, 1500)}
+	sizes := make([]int, 1)
+	eps := make([]wgconn.Endpoint, 1)
+	n, err := receivePeerPorts(buffs, sizes, eps)
+	if err != nil || n != 1 {
+		t.Fatalf("receivePeerPorts = %d, %v; want 1", n, err)
+	}
+	if !bytes.Equal(buffs[0][:sizes[0]], pkt) {
+		t.Errorf("received %q; want %q", buffs[0][:sizes[0]], pkt)
+	}
+	if de, ok := eps[0].(*endpoint); !ok || de.publicKey != peer {
+		t.Errorf("received from %v; want peer's endpoint", eps[0])
+	}
+
+	// Released ports are free for other peers.
+	conn.releasePeerPorts(peer)
+	if got := conn.udpConnFor(addr, key.NewNode().Public()); got.Port() != port {
+		t.Errorf("next peer's port = %d; want released %d", got.Port(), port)
+	}
+}
+
+func TestWireGuardOnlyPeerStatus(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1700000000, 0)})
+	c := &Conn{clock: clock, logf: t.Logf}
+	fast := netip.MustParseAddrPort("1.1.1.1:111")
+	slow := netip.MustParseAddrPort("2.2.2.2:222")
+	silent := netip.MustParseAddrPort("3.3.3.3:333")
+	de := &endpoint{
+		c:               c,
+		isWireguardOnly: true,
+		endpointState: map[netip.AddrPort]*endpointState{
+			fast:   {},
+			slow:   {},
+			silent: {},
+		},
+	}
+	de.endpointState[fast].addPongReplyLocked(pongReply{latency: 10 * time.Millisecond})
+	de.endpointState[slow].addPongReplyLocked(pongReply{latency: 100 * time.Millisecond})
+
+	var ps ipnstate.PeerStatus
+	de.populatePeerStatus(&ps)
+	want := map[string]float64{
+		fast.String(): 0.01,
+		slow.String(): 0.1,
+	}
+	if !reflect.DeepEqual(ps.WireGuardOnlyLatencySeconds, want) {
+		t.Errorf("WireGuardOnlyLatencySeconds = %v; want %v", ps.WireGuardOnlyLatencySeconds, want)
+	}
+	if ps.CurAddr != "" {
+		t.Errorf("CurAddr = %q before choosing an endpoint; want none", ps.CurAddr)
+	}
+
+	// Once chosen, the endpoint shows even while idle.
+	if udpAddr, _, _ := de.addrForSendLocked(c.monoNow()); udpAddr != fast {
+		t.Fatalf("addrForSendLocked = %v; want %v", udpAddr, fast)
+	}
+	ps = ipnstate.PeerStatus{}
+	de.populatePeerStatus(&ps)
+	if ps.CurAddr != fast.String() {
+		t.Errorf("CurAddr = %q; want %v", ps.CurAddr, fast)
+	}
+}
+
+func TestDERPTrafficCallback(t *testing.T) {
+	c := &Conn{}
+	var got []DERPTraffic
+	c.SetDERPTrafficCallback(func(tr DERPTraffic) {
+		got = append(got, tr)
+	})
+
+	discoMsg := append([]byte(disco.Magic), make([]byte, 50)...)
+	initiation := make([]byte, device.MessageInitiationSize)
+	initiation[0] = device.MessageInitiationType
+	data := make([]byte, 100)
+	data[0] = device.MessageTransportType
+
+	beforeTx := metricDERPTxBytes[DERPTrafficData].Value()
+	c.noteDERPSent(1, [][]byte{data, data, initiation})
+	c.noteDERPRecv(2, discoMsg)
+	want := []DERPTraffic{
+		{Region: 1, Class: DERPTrafficHandshake, TxBytes: len(initiation)},
+		{Region: 1, Class: DERPTrafficData, TxBytes: 2 * len(data)},
+		{Region: 2, Class: DERPTrafficDisco, RxBytes: len(discoMsg)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+	if n := metricDERPTxBytes[DERPTrafficData].Value() - beforeTx; n != int64(2*len(data)) {
+		t.Errorf("data tx metric grew by %d; want %d", n, 2*len(data))
+	}
+
+	c.SetDERPTrafficCallback(nil)
+	got = nil
+	c.noteDERPRecv(2, data)
+	if got != nil {
+		t.Errorf("removed callback called with %+v", got)
+	}
+}
@@ -0,0 +1,448 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package magicsocktest provides a fake magicsock.Interface, for tests of
+// code that drives a magicsock.Conn without needing sockets, DERP servers
+// or natlab.
+package magicsocktest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"go4.org/mem"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/capture"
+	"tailscale.com/wgengine/magicsock"
+)
+
+// Path is the scripted state of a FakeConn's path to a peer.
+type Path struct {
+	// Endpoint is the peer's UDP endpoint, if the path is direct.
+	Endpoint netip.AddrPort
+	// DERPRegion is the DERP region the peer is reached through, if
+	// the path isn't direct.
+	DERPRegion int
+	// Latency is the round-trip time reported by Ping.
+	Latency time.Duration
+	// Err, if non-empty, is the error reported by Ping, as for an
+	// unreachable peer.
+	Err string
+	// Keepalive is whether PathWantsKeepalive reports that the path
+	// wants WireGuard persistent keepalives.
+	Keepalive bool
+}
+
+// Packet is a packet sent through a FakeConn.
+type Packet struct {
+	Peer key.NodePublic
+	Data []byte
+}
+
+// Refresh is a call to a FakeConn's RefreshEndpoints.
+type Refresh struct {
+	Scope magicsock.RefreshScope
+	Why   string
+}
+
+// FakeConn is a fake magicsock.Interface. It sends no packets, but
+// records them, and its paths to peers are set with SetPath rather than
+// discovered. Packets from peers are delivered to its Bind with Inject.
+//
+// The zero value is not valid; use NewFakeConn.
+type FakeConn struct {
+	discoKey key.DiscoPrivate
+	recv     chan Packet // injected packets, for the Bind
+
+	mu             sync.Mutex
+	closed         bool
+	privateKey     key.NodePrivate
+	netMap         *netmap.NetworkMap
+	peers          map[key.NodePublic]struct{}
+	derpMap        *tailcfg.DERPMap
+	netInfoFunc    func(*tailcfg.NetInfo)
+	networkUp      bool
+	port           uint16
+	blockEndpoints bool
+	captureHook    capture.Callback
+	paths          map[key.NodePublic]Path
+	lastRecv       map[key.NodePublic]time.Time
+	sent           []Packet
+	refreshes      []Refresh
+	rebinds        int
+}
+
+var _ magicsock.Interface = (*FakeConn)(nil)
+
+// NewFakeConn returns a new FakeConn, with its network up and no paths.
+func NewFakeConn() *FakeConn {
+	return &FakeConn{
+		discoKey:  key.NewDisco(),
+		recv:      make(chan Packet, 64),
+		networkUp: true,
+		paths:     make(map[key.NodePublic]Path),
+		lastRecv:  make(map[key.NodePublic]time.Time),
+	}
+}
+
+// SetPath sets the path to peer reported by Ping and UpdateStatus.
+func (f *FakeConn) SetPath(peer key.NodePublic, p Path) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths[peer] = p
+}
+
+// Sent returns the packets sent so far, oldest first.
+func (f *FakeConn) Sent() []Packet {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Packet(nil), f.sent...)
+}
+
+// Inject delivers b to the Bind as a packet received from peer. It
+// blocks while the Bind's receive queue is full.
+func (f *FakeConn) Inject(peer key.NodePublic, b []byte) {
+	f.mu.Lock()
+	f.lastRecv[peer] = time.Now()
+	f.mu.Unlock()
+	f.recv <- Packet{Peer: peer, Data: append([]byte(nil), b...)}
+}
+
+// SendNetInfo calls the callback set by SetNetInfoCallback, if any, with
+// ni.
+func (f *FakeConn) SendNetInfo(ni *tailcfg.NetInfo) {
+	f.mu.Lock()
+	fn := f.netInfoFunc
+	f.mu.Unlock()
+	if fn != nil {
+		fn(ni)
+	}
+}
+
+// NetworkMap returns the network map last set by SetNetworkMap.
+func (f *FakeConn) NetworkMap() *netmap.NetworkMap {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.netMap
+}
+
+// Peers returns the peers last set by UpdatePeers.
+func (f *FakeConn) Peers() map[key.NodePublic]struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.peers
+}
+
+// PrivateKey returns the key last set by SetPrivateKey.
+func (f *FakeConn) PrivateKey() key.NodePrivate {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.privateKey
+}
+
+// NetworkUp reports the state last set by SetNetworkUp.
+func (f *FakeConn) NetworkUp() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.networkUp
+}
+
+// BlockEndpoints reports the state last set by SetBlockEndpoints.
+func (f *FakeConn) BlockEndpoints() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.blockEndpoints
+}
+
+// Refreshes returns the calls to RefreshEndpoints so far, oldest first.
+func (f *FakeConn) Refreshes() []Refresh {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Refresh(nil), f.refreshes...)
+}
+
+// Rebinds returns the number of calls to Rebind so far.
+func (f *FakeConn) Rebinds() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rebinds
+}
+
+func (f *FakeConn) Bind() conn.Bind { return &fakeBind{f: f} }
+
+var errClosed = errors.New("magicsocktest: FakeConn closed")
+
+func (f *FakeConn) Send(buffs [][]byte, ep conn.Endpoint) error {
+	fe, ok := ep.(*fakeEndpoint)
+	if !ok {
+		return fmt.Errorf("magicsocktest: unexpected endpoint type %T", ep)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return errClosed
+	}
+	for _, b := range buffs {
+		f.sent = append(f.sent, Packet{Peer: fe.peer, Data: append([]byte(nil), b...)})
+	}
+	return nil
+}
+
+func (f *FakeConn) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *FakeConn) SetPrivateKey(k key.NodePrivate) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.privateKey = k
+	return nil
+}
+
+func (f *FakeConn) SetNetworkMap(nm *netmap.NetworkMap) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.netMap = nm
+}
+
+func (f *FakeConn) UpdatePeers(newPeers map[key.NodePublic]struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.peers = newPeers
+}
+
+func (f *FakeConn) SetDERPMap(dm *tailcfg.DERPMap) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.derpMap = dm
+}
+
+func (f *FakeConn) SetNetInfoCallback(fn func(*tailcfg.NetInfo)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.netInfoFunc = fn
+}
+
+func (f *FakeConn) SetNetworkUp(up bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.networkUp = up
+}
+
+func (f *FakeConn) SetPreferredPort(port uint16) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.port = port
+}
+
+func (f *FakeConn) SetBlockEndpoints(block bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blockEndpoints = block
+}
+
+func (f *FakeConn) InstallCaptureHook(cb capture.Callback) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.captureHook = cb
+}
+
+func (f *FakeConn) RefreshEndpoints(scope magicsock.RefreshScope, why string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refreshes = append(f.refreshes, Refresh{Scope: scope, Why: why})
+}
+
+func (f *FakeConn) Rebind() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rebinds++
+}
+
+// UpdateStatus adds the FakeConn's key and its peers with paths to sb.
+func (f *FakeConn) UpdateStatus(sb *ipnstate.StatusBuilder) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sb.MutateSelfStatus(func(ss *ipnstate.PeerStatus) {
+		if !f.privateKey.IsZero() {
+			ss.PublicKey = f.privateKey.Public()
+		}
+	})
+	if !sb.WantPeers {
+		return
+	}
+	for k, p := range f.paths {
+		ps := &ipnstate.PeerStatus{InMagicSock: true}
+		if p.Endpoint.IsValid() {
+			ps.CurAddr = p.Endpoint.String()
+		} else {
+			ps.Relay = f.regionCodeLocked(p.DERPRegion)
+		}
+		ps.SmoothedRTTSeconds = p.Latency.Seconds()
+		sb.AddPeer(k, ps)
+	}
+}
+
+// Ping reports the path set for peer with SetPath.
+func (f *FakeConn) Ping(peer *tailcfg.Node, res *ipnstate.PingResult, cb func(*ipnstate.PingResult)) {
+	f.mu.Lock()
+	if f.privateKey.IsZero() {
+		res.Err = "local tailscaled stopped"
+	} else if p, ok := f.paths[peer.Key]; !ok {
+		res.Err = "unknown peer"
+	} else if p.Err != "" {
+		res.Err = p.Err
+	} else {
+		res.LatencySeconds = p.Latency.Seconds()
+		if p.Endpoint.IsValid() {
+			res.Endpoint = p.Endpoint.String()
+		} else {
+			res.DERPRegionID = p.DERPRegion
+			res.DERPRegionCode = f.regionCodeLocked(p.DERPRegion)
+		}
+	}
+	if len(peer.Addresses) > 0 {
+		res.NodeIP = peer.Addresses[0].Addr().String()
+	}
+	res.NodeName = peer.Name
+	f.mu.Unlock()
+	cb(res)
+}
+
+func (f *FakeConn) LastRecvActivityOfNodeKey(nk key.NodePublic) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, ok := f.lastRecv[nk]
+	if !ok {
+		return "never"
+	}
+	return time.Since(t).Round(time.Second).String()
+}
+
+// PathWantsKeepalive reports the Keepalive of the path set for nk with
+// SetPath.
+func (f *FakeConn) PathWantsKeepalive(nk key.NodePublic) (want, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.paths[nk]
+	return p.Keepalive, ok
+}
+
+func (f *FakeConn) LocalPort() uint16 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.port
+}
+
+// DERPs returns the number of DERP regions used by the paths set with
+// SetPath.
+func (f *FakeConn) DERPs() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	regions := map[int]bool{}
+	for _, p := range f.paths {
+		if !p.Endpoint.IsValid() && p.DERPRegion != 0 {
+			regions[p.DERPRegion] = true
+		}
+	}
+	return len(regions)
+}
+
+func (f *FakeConn) DiscoPublicKey() key.DiscoPublic { return f.discoKey.Public() }
+
+func (f *FakeConn) regionCodeLocked(regionID int) string {
+	if f.derpMap == nil {
+		return ""
+	}
+	if r, ok := f.derpMap.Regions[regionID]; ok {
+		return r.RegionCode
+	}
+	return ""
+}
+
+// fakeBind is the conn.Bind of a FakeConn. Its one ReceiveFunc returns
+// the packets passed to FakeConn.Inject.
+type fakeBind struct {
+	f *FakeConn
+
+	mu     sync.Mutex
+	closed chan struct{} // closed by Close; nil until Open
+}
+
+func (b *fakeBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		select {
+		case <-b.closed:
+		default:
+			return nil, 0, errors.New("magicsocktest: Bind already open")
+		}
+	}
+	closed := make(chan struct{})
+	b.closed = closed
+	b.f.SetPreferredPort(port)
+	recv := func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		select {
+		case <-closed:
+			return 0, net.ErrClosed
+		case p := <-b.f.recv:
+			sizes[0] = copy(packets[0], p.Data)
+			eps[0] = &fakeEndpoint{peer: p.Peer}
+			return 1, nil
+		}
+	}
+	return []conn.ReceiveFunc{recv}, port, nil
+}
+
+func (b *fakeBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		select {
+		case <-b.closed:
+		default:
+			close(b.closed)
+		}
+	}
+	return nil
+}
+
+func (b *fakeBind) SetMark(uint32) error { return nil }
+
+func (b *fakeBind) Send(bufs [][]byte, ep conn.Endpoint) error { return b.f.Send(bufs, ep) }
+
+// ParseEndpoint parses the hex node key wireguard-go configures peers
+// with, as magicsock.Conn does.
+func (b *fakeBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	k, err := key.ParseNodePublicUntyped(mem.S(s))
+	if err != nil {
+		return nil, fmt.Errorf("magicsocktest: ParseEndpoint: parse failed on %q: %w", s, err)
+	}
+	return &fakeEndpoint{peer: k}, nil
+}
+
+func (b *fakeBind) BatchSize() int { return 1 }
+
+// fakeEndpoint is the conn.Endpoint of a FakeConn's peer.
+type fakeEndpoint struct {
+	peer key.NodePublic
+}
+
+func (e *fakeEndpoint) ClearSrc()           {}
+func (e *fakeEndpoint) SrcToString() string { return "" }
+func (e *fakeEndpoint) DstToString() string { return e.peer.UntypedHexString() }
+func (e *fakeEndpoint) DstToBytes() []byte  { return e.peer.AppendTo(nil) }
+func (e *fakeEndpoint) DstIP() netip.Addr   { return netip.Addr{} }
+func (e *fakeEndpoint) SrcIP() netip.Addr   { return netip.Addr{} }
@@ -0,0 +1,101 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsocktest
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestFakeConn(t *testing.T) {
+	f := NewFakeConn()
+	if err := f.SetPrivateKey(key.NewNode()); err != nil {
+		t.Fatal(err)
+	}
+	f.SetDERPMap(&tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, RegionCode: "nyc"},
+	}})
+	direct, relayed, down := key.NewNode().Public(), key.NewNode().Public(), key.NewNode().Public()
+	f.SetPath(direct, Path{Endpoint: netip.MustParseAddrPort("1.2.3.4:41641"), Latency: 5 * time.Millisecond})
+	f.SetPath(relayed, Path{DERPRegion: 1, Latency: 40 * time.Millisecond})
+	f.SetPath(down, Path{Err: "timeout"})
+
+	ping := func(k key.NodePublic) *ipnstate.PingResult {
+		var got *ipnstate.PingResult
+		f.Ping(&tailcfg.Node{Key: k}, new(ipnstate.PingResult), func(res *ipnstate.PingResult) { got = res })
+		return got
+	}
+	if res := ping(direct); res.Endpoint != "1.2.3.4:41641" || res.LatencySeconds != 0.005 {
+		t.Errorf("direct ping = %+v", res)
+	}
+	if res := ping(relayed); res.DERPRegionCode != "nyc" || res.Endpoint != "" {
+		t.Errorf("relayed ping = %+v", res)
+	}
+	if res := ping(down); res.Err != "timeout" {
+		t.Errorf("down ping Err = %q; want timeout", res.Err)
+	}
+	if res := ping(key.NewNode().Public()); res.Err != "unknown peer" {
+		t.Errorf("unknown ping Err = %q; want unknown peer", res.Err)
+	}
+	if got := f.DERPs(); got != 1 {
+		t.Errorf("DERPs = %d; want 1", got)
+	}
+
+	sb := &ipnstate.StatusBuilder{WantPeers: true}
+	f.UpdateStatus(sb)
+	st := sb.Status()
+	if ps := st.Peer[direct]; ps == nil || ps.CurAddr != "1.2.3.4:41641" {
+		t.Errorf("direct status = %+v", ps)
+	}
+	if ps := st.Peer[relayed]; ps == nil || ps.Relay != "nyc" {
+		t.Errorf("relayed status = %+v", ps)
+	}
+}
+
+func TestFakeConnBind(t *testing.T) {
+	f := NewFakeConn()
+	b := f.Bind()
+	fns, _, err := b.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := key.NewNode().Public()
+	ep, err := b.ParseEndpoint(peer.UntypedHexString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Send([][]byte{[]byte("hello")}, ep); err != nil {
+		t.Fatal(err)
+	}
+	if sent := f.Sent(); len(sent) != 1 || sent[0].Peer != peer || string(sent[0].Data) != "hello" {
+		t.Errorf("Sent = %+v", sent)
+	}
+
+	f.Inject(peer, []byte("hi"))
+	packets := [][]byte{make([]byte, 100)}
+	sizes := make([]int, 1)
+	eps := make([]conn.Endpoint, 1)
+	n, err := fns[0](packets, sizes, eps)
+	if err != nil || n != 1 {
+		t.Fatalf("receive = %d, %v", n, err)
+	}
+	if !bytes.Equal(packets[0][:sizes[0]], []byte("hi")) || eps[0].DstToString() != peer.UntypedHexString() {
+		t.Errorf("received %q from %v", packets[0][:sizes[0]], eps[0].DstToString())
+	}
+	if f.LastRecvActivityOfNodeKey(peer) == "never" {
+		t.Error("LastRecvActivityOfNodeKey = never after Inject")
+	}
+
+	b.Close()
+	if _, err := fns[0](packets, sizes, eps); err == nil {
+		t.Error("receive after Close succeeded")
+	}
+}
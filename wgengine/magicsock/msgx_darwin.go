@@ -0,0 +1,155 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// msgXSupported is whether newMsgXConn is implemented on this platform.
+const msgXSupported = true
+
+// msghdrX is Darwin's struct msghdr_x, the message header of recvmsg_x.
+type msghdrX struct {
+	name       *byte
+	namelen    uint32
+	iov        *unix.Iovec
+	iovlen     int32
+	control    *byte
+	controllen uint32
+	flags      int32
+	datalen    uintptr
+}
+
+// msgXEntries is the most messages read by a recvmsg_x call.
+const msgXEntries = 128
+
+// msgXConn is an xnetBatchReaderWriter reading batches of datagrams with
+// Darwin's recvmsg_x, its equivalent of recvmmsg. Its counterpart
+// sendmsg_x only sends on connected sockets, so writes fall back to a
+// sendmsg per datagram, as do reads if recvmsg_x doesn't report their
+// sources.
+type msgXConn struct {
+	rc       syscall.RawConn
+	fallback xnetBatchReaderWriter // ipv4 or ipv6 PacketConn
+	noMsgX   atomic.Bool           // recvmsg_x didn't report a source
+
+	mu    sync.Mutex // guards the following, for reads
+	hdrs  [msgXEntries]msghdrX
+	iovs  [msgXEntries]unix.Iovec
+	addrs [msgXEntries]unix.RawSockaddrAny
+}
+
+func newMsgXConn(uc *net.UDPConn) (*msgXConn, error) {
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	c := &msgXConn{rc: rc}
+	if uc.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		c.fallback = ipv4.NewPacketConn(uc)
+	} else {
+		c.fallback = ipv6.NewPacketConn(uc)
+	}
+	return c, nil
+}
+
+func (c *msgXConn) WriteBatch(msgs []ipv6.Message, flags int) (int, error) {
+	return c.fallback.WriteBatch(msgs, flags)
+}
+
+func (c *msgXConn) ReadBatch(msgs []ipv6.Message, flags int) (int, error) {
+	if c.noMsgX.Load() {
+		return c.fallback.ReadBatch(msgs, flags)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := min(len(msgs), msgXEntries)
+	for i := range msgs[:n] {
+		m := &msgs[i]
+		if len(m.Buffers) == 0 || len(m.Buffers[0]) == 0 {
+			n = i
+			break
+		}
+		c.iovs[i] = unix.Iovec{Base: &m.Buffers[0][0]}
+		c.iovs[i].SetLen(len(m.Buffers[0]))
+		c.hdrs[i] = msghdrX{
+			name:    (*byte)(unsafe.Pointer(&c.addrs[i])),
+			namelen: uint32(unsafe.Sizeof(c.addrs[i])),
+			iov:     &c.iovs[i],
+			iovlen:  1,
+		}
+		if len(m.OOB) > 0 {
+			c.hdrs[i].control = &m.OOB[0]
+			c.hdrs[i].controllen = uint32(len(m.OOB))
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	var got int
+	var opErr error
+	err := c.rc.Read(func(fd uintptr) bool {
+		r, _, errno := unix.Syscall6(unix.SYS_RECVMSG_X, fd, uintptr(unsafe.Pointer(&c.hdrs[0])), uintptr(n), uintptr(flags), 0, 0)
+		switch errno {
+		case 0:
+			got = int(r)
+		case unix.EAGAIN:
+			return false // wait until readable
+		default:
+			opErr = os.NewSyscallError("recvmsg_x", errno)
+		}
+		return true
+	})
+	runtime.KeepAlive(msgs)
+	if err != nil {
+		return 0, err
+	}
+	if opErr != nil {
+		return 0, opErr
+	}
+	for i := 0; i < got; i++ {
+		m := &msgs[i]
+		m.N = int(c.hdrs[i].datalen)
+		m.NN = int(c.hdrs[i].controllen)
+		m.Flags = int(c.hdrs[i].flags)
+		m.Addr = msgXSockaddrToUDPAddr(&c.addrs[i], c.hdrs[i].namelen)
+		if m.Addr == nil {
+			// Without its source, the datagram is useless. Drop
+			// it, and read one datagram at a time from now on.
+			c.noMsgX.Store(true)
+			m.N = 0
+			m.Addr = &net.UDPAddr{}
+		}
+	}
+	return got, nil
+}
+
+// msgXSockaddrToUDPAddr returns sa, of length n, as a UDP address, or nil
+// if it isn't an IPv4 or IPv6 address.
+func msgXSockaddrToUDPAddr(sa *unix.RawSockaddrAny, n uint32) *net.UDPAddr {
+	switch {
+	case sa.Addr.Family == unix.AF_INET && n >= unix.SizeofSockaddrInet4:
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+		port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa4.Port))[:])
+		return &net.UDPAddr{IP: append(net.IP(nil), sa4.Addr[:]...), Port: int(port)}
+	case sa.Addr.Family == unix.AF_INET6 && n >= unix.SizeofSockaddrInet6:
+		sa6 := (*unix.RawSockaddrInet6)(unsafe.Pointer(sa))
+		port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa6.Port))[:])
+		return &net.UDPAddr{IP: append(net.IP(nil), sa6.Addr[:]...), Port: int(port)}
+	}
+	return nil
+}
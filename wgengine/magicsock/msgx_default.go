@@ -0,0 +1,23 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !darwin
+
+package magicsock
+
+import (
+	"errors"
+	"net"
+)
+
+// msgXSupported is whether newMsgXConn is implemented on this platform.
+const msgXSupported = false
+
+// msgXConn is only implemented on Darwin.
+type msgXConn struct {
+	xnetBatchReaderWriter
+}
+
+func newMsgXConn(*net.UDPConn) (*msgXConn, error) {
+	return nil, errors.New("recvmsg_x is only supported on Darwin")
+}
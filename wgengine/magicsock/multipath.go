@@ -0,0 +1,64 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"context"
+	"net/netip"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime/mono"
+)
+
+// SetMultipathWindow sets how long, after the path a Conn sends a peer's
+// WireGuard packets on changes, the packets are also sent on the previous
+// path: the old UDP address, or DERP when upgrading from it. Packets in
+// flight while the peer or a NAT catches up with the new path then aren't
+// lost, and WireGuard drops the duplicates that arrive. Zero, the
+// default, disables it. It replaces Options.MultipathWindow.
+func (c *Conn) SetMultipathWindow(d time.Duration) {
+	c.multipathWindow.Store(max(d, 0))
+}
+
+// multipathAddrLocked returns the previous path to also send buffs on, if
+// de is in a multipath transition, given the udpAddr and derpAddr to send
+// on from addrForSendLocked. A change of path starts a transition of
+// Conn.multipathWindow. de.mu must be held.
+func (de *endpoint) multipathAddrLocked(now mono.Time, udpAddr, derpAddr netip.AddrPort) netip.AddrPort {
+	path := udpAddr
+	if !path.IsValid() {
+		path = derpAddr
+	}
+	if path != de.lastSendPath {
+		prev := de.lastSendPath
+		de.lastSendPath = path
+		if d := de.c.multipathWindow.Load(); d > 0 && prev.IsValid() && path.IsValid() {
+			de.multipathPrev = prev
+			de.multipathUntil = now.Add(d)
+		}
+	}
+	if !de.multipathPrev.IsValid() {
+		return netip.AddrPort{}
+	}
+	if now.After(de.multipathUntil) {
+		de.multipathPrev = netip.AddrPort{}
+		return netip.AddrPort{}
+	}
+	if de.multipathPrev == udpAddr || de.multipathPrev == derpAddr {
+		return netip.AddrPort{}
+	}
+	return de.multipathPrev
+}
+
+// sendMultipathDup sends a duplicate of buffs to addr, the previous path
+// of a multipath transition. It's best effort: errors are ignored.
+func (de *endpoint) sendMultipathDup(addr netip.AddrPort, buffs [][]byte) {
+	metricSendMultipathDup.Add(int64(len(buffs)))
+	if addr.Addr() == tailcfg.DerpMagicIPAddr {
+		de.c.sendDERPBatch(context.Background(), addr, de.publicKey, buffs)
+		return
+	}
+	de.c.sendUDPBatch(addr, de.publicKey, de.c.padHandshakesTo(de, buffs), 1)
+}
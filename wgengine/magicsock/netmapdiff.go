@@ -0,0 +1,68 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"golang.org/x/exp/slices"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// NetmapDiff summarizes how SetNetworkMap changed a Conn's peers. See
+// Options.NetmapDiffFunc.
+type NetmapDiff struct {
+	// NumPeers is the number of peers in the new network map.
+	NumPeers int
+
+	// PeersAdded and PeersRemoved are the peers added to and removed
+	// from the network map, and PeersChanged those whose node changed
+	// in any way.
+	PeersAdded   []key.NodePublic
+	PeersRemoved []key.NodePublic
+	PeersChanged []key.NodePublic
+
+	// EndpointsChanged and DiscoKeysChanged are the peers in
+	// PeersChanged whose endpoints and disco key changed, respectively.
+	EndpointsChanged []key.NodePublic
+	DiscoKeysChanged []key.NodePublic
+}
+
+// IsEmpty reports whether d has no changes.
+func (d NetmapDiff) IsEmpty() bool {
+	return len(d.PeersAdded) == 0 && len(d.PeersRemoved) == 0 && len(d.PeersChanged) == 0
+}
+
+// diffNetmapPeers returns the changes from the peers old to new.
+func diffNetmapPeers(old, new []*tailcfg.Node) NetmapDiff {
+	d := NetmapDiff{NumPeers: len(new)}
+	oldByKey := make(map[key.NodePublic]*tailcfg.Node, len(old))
+	for _, n := range old {
+		oldByKey[n.Key] = n
+	}
+	for _, n := range new {
+		o, ok := oldByKey[n.Key]
+		if !ok {
+			d.PeersAdded = append(d.PeersAdded, n.Key)
+			continue
+		}
+		delete(oldByKey, n.Key)
+		if o.Equal(n) {
+			continue
+		}
+		d.PeersChanged = append(d.PeersChanged, n.Key)
+		if !slices.Equal(o.Endpoints, n.Endpoints) {
+			d.EndpointsChanged = append(d.EndpointsChanged, n.Key)
+		}
+		if o.DiscoKey != n.DiscoKey {
+			d.DiscoKeysChanged = append(d.DiscoKeysChanged, n.Key)
+		}
+	}
+	// Removed peers are in the old netmap's order.
+	for _, n := range old {
+		if _, ok := oldByKey[n.Key]; ok {
+			d.PeersRemoved = append(d.PeersRemoved, n.Key)
+		}
+	}
+	return d
+}
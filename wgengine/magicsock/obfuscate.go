@@ -0,0 +1,294 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/tailscale/wireguard-go/device"
+	"go4.org/mem"
+	"golang.org/x/exp/slices"
+	"tailscale.com/disco"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/key"
+)
+
+// DiscoObfuscation configures the obfuscation of the disco messages a Conn
+// sends and receives over UDP, to get past middleboxes that throttle or
+// drop recognizable WireGuard or Tailscale traffic.
+//
+// Obfuscated disco messages replace disco.Magic with a value derived from
+// Secret that rotates every Period, hide the length of the sealed message,
+// and are padded with random bytes to a multiple of PadTo. Disco messages
+// over DERP are never obfuscated, as DERP connections are encrypted.
+//
+// Unless Strict is set, obfuscation falls back to plain disco messages for
+// peers that don't appear to support it: those that send plain disco
+// messages over UDP, or that leave several obfuscated pings in a row
+// unanswered. Obfuscation is retried with them after a few minutes.
+type DiscoObfuscation struct {
+	// Secret is the secret shared by all nodes of the network,
+	// distributed out of band (such as by the control plane), from which
+	// the rotating magic is derived. Obfuscation is disabled if it's
+	// empty.
+	Secret []byte
+
+	// Period is how often the magic rotates. Messages with the magic of
+	// the previous or next period are accepted too, for clock skew. Zero
+	// means DefaultDiscoObfuscationPeriod.
+	Period time.Duration
+
+	// PadTo is the size of which obfuscated messages are padded to a
+	// multiple. Zero means DefaultDiscoObfuscationPadTo.
+	PadTo int
+
+	// PadHandshakes is whether to also pad the WireGuard handshake
+	// initiations sent over UDP, to peers that were heard sending
+	// obfuscated disco messages. The padding of received initiations is
+	// always removed.
+	PadHandshakes bool
+
+	// Strict is whether to drop plain disco messages received over UDP,
+	// and never send them, instead of falling back to them.
+	Strict bool
+}
+
+const (
+	// DefaultDiscoObfuscationPeriod is the default DiscoObfuscation.Period.
+	DefaultDiscoObfuscationPeriod = time.Hour
+
+	// DefaultDiscoObfuscationPadTo is the default DiscoObfuscation.PadTo.
+	DefaultDiscoObfuscationPadTo = 256
+)
+
+const (
+	// discoObfuscationFallbackPings is the number of obfuscated pings to a
+	// peer that may go unanswered before falling back to plain disco.
+	discoObfuscationFallbackPings = 3
+
+	// discoObfuscationRetry is how long a fallback to plain disco lasts
+	// before obfuscation is retried.
+	discoObfuscationRetry = 5 * time.Minute
+)
+
+// SetDiscoObfuscation sets c's disco obfuscation configuration, replacing
+// any set by Options.DiscoObfuscation or an earlier call, such as when the
+// network's secret rotates.
+func (c *Conn) SetDiscoObfuscation(o DiscoObfuscation) {
+	c.discoObfuscator.Store(newDiscoObfuscator(o))
+}
+
+// discoObfuscator implements a DiscoObfuscation.
+type discoObfuscator struct {
+	cfg DiscoObfuscation // with defaults filled in, and its own Secret
+
+	mu     sync.Mutex
+	epoch  int64     // period of masks[1]
+	masks  [3][]byte // for epochs epoch-1, epoch, epoch+1
+	hasAny bool      // whether masks is initialized
+}
+
+// obfuscatedHeaderLen is the length of the header of obfuscated disco
+// messages: the rotating magic, the sender's disco key, and the length of
+// the sealed message, masked.
+const obfuscatedHeaderLen = len(disco.Magic) + key.DiscoPublicRawLen + 2
+
+// newDiscoObfuscator returns the discoObfuscator for o, or nil if o
+// disables obfuscation.
+func newDiscoObfuscator(o DiscoObfuscation) *discoObfuscator {
+	if len(o.Secret) == 0 {
+		return nil
+	}
+	o.Secret = slices.Clone(o.Secret)
+	if o.Period <= 0 {
+		o.Period = DefaultDiscoObfuscationPeriod
+	}
+	if o.PadTo <= 0 {
+		o.PadTo = DefaultDiscoObfuscationPadTo
+	}
+	return &discoObfuscator{cfg: o}
+}
+
+// mask returns the magic and length mask of epoch, as 8 bytes. The first
+// byte has its high bit set, so no mask begins like a WireGuard or STUN
+// packet.
+func (o *discoObfuscator) mask(epoch int64) []byte {
+	h := hmac.New(sha256.New, o.cfg.Secret)
+	h.Write([]byte("tailscale disco obfuscation"))
+	binary.Write(h, binary.BigEndian, epoch)
+	m := h.Sum(nil)[:len(disco.Magic)+2]
+	m[0] |= 0x80
+	return m
+}
+
+// masksAt returns the masks of the period of now and its neighbors, most
+// likely first.
+func (o *discoObfuscator) masksAt(now time.Time) [3][]byte {
+	epoch := now.UnixNano() / int64(o.cfg.Period)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.hasAny || o.epoch != epoch {
+		for i := range o.masks {
+			o.masks[i] = o.mask(epoch - 1 + int64(i))
+		}
+		o.epoch, o.hasAny = epoch, true
+	}
+	return [3][]byte{o.masks[1], o.masks[0], o.masks[2]}
+}
+
+// seal returns an obfuscated disco message from sender, wrapping box, the
+// sealed message.
+func (o *discoObfuscator) seal(now time.Time, sender key.DiscoPublic, box []byte) []byte {
+	m := o.masksAt(now)[0]
+	n := obfuscatedHeaderLen + len(box)
+	pkt := make([]byte, 0, n+o.cfg.PadTo)
+	pkt = append(pkt, m[:len(disco.Magic)]...)
+	pkt = sender.AppendTo(pkt)
+	pkt = binary.BigEndian.AppendUint16(pkt, uint16(len(box))^binary.BigEndian.Uint16(m[len(disco.Magic):]))
+	pkt = append(pkt, box...)
+	return appendPadding(pkt, o.cfg.PadTo)
+}
+
+// looksObfuscated reports whether pkt could be an obfuscated disco
+// message. It's cheap enough to call on every received packet, which
+// WireGuard packets fail.
+func looksObfuscated(pkt []byte) bool {
+	return len(pkt) >= obfuscatedHeaderLen+disco.NonceLen && pkt[0]&0x80 != 0
+}
+
+// open reports whether pkt is an obfuscated disco message and, if so,
+// returns its sender and sealed message. The caller should check
+// looksObfuscated first.
+func (o *discoObfuscator) open(now time.Time, pkt []byte) (sender key.DiscoPublic, box []byte, ok bool) {
+	if !looksObfuscated(pkt) {
+		return sender, nil, false
+	}
+	for _, m := range o.masksAt(now) {
+		if string(pkt[:len(disco.Magic)]) != string(m[:len(disco.Magic)]) {
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(pkt[obfuscatedHeaderLen-2:]) ^ binary.BigEndian.Uint16(m[len(disco.Magic):]))
+		box = pkt[obfuscatedHeaderLen:]
+		if n > len(box) {
+			return sender, nil, false
+		}
+		sender = key.DiscoPublicFromRaw32(mem.B(pkt[len(disco.Magic) : obfuscatedHeaderLen-2]))
+		return sender, box[:n], true
+	}
+	return sender, nil, false
+}
+
+// appendPadding appends random bytes to pkt up to a multiple of padTo.
+func appendPadding(pkt []byte, padTo int) []byte {
+	n := len(pkt)
+	if rem := n % padTo; rem != 0 {
+		pkt = append(pkt, make([]byte, padTo-rem)...)
+		rand.Read(pkt[n:])
+	}
+	return pkt
+}
+
+// padHandshakes returns buffs with its WireGuard handshake initiations
+// padded, if o pads them. It doesn't modify buffs.
+func (o *discoObfuscator) padHandshakes(buffs [][]byte) [][]byte {
+	if o == nil || !o.cfg.PadHandshakes {
+		return buffs
+	}
+	var padded [][]byte
+	for i, b := range buffs {
+		if !isHandshakeInitiation(b) {
+			continue
+		}
+		if padded == nil {
+			padded = slices.Clone(buffs)
+		}
+		padded[i] = appendPadding(slices.Clip(b), o.cfg.PadTo)
+	}
+	if padded == nil {
+		return buffs
+	}
+	metricSendHandshakePadded.Add(1)
+	return padded
+}
+
+// isHandshakeInitiation reports whether b is an unpadded WireGuard
+// handshake initiation.
+func isHandshakeInitiation(b []byte) bool {
+	return len(b) == device.MessageInitiationSize && b[0] == device.MessageInitiationType
+}
+
+// unpaddedLen returns the length of the received packet b, without the
+// padding of a padded WireGuard handshake initiation, which is never
+// valid otherwise.
+func unpaddedLen(b []byte) int {
+	if len(b) > device.MessageInitiationSize && b[0] == device.MessageInitiationType && b[1] == 0 && b[2] == 0 && b[3] == 0 {
+		return device.MessageInitiationSize
+	}
+	return len(b)
+}
+
+// shouldObfuscateLocked reports whether to obfuscate a disco message sent
+// over UDP to di's peer. c.mu must be held.
+func (c *Conn) shouldObfuscateLocked(o *discoObfuscator, di *discoInfo, now mono.Time) bool {
+	if o == nil {
+		return false
+	}
+	return o.cfg.Strict || di.plainUntil == 0 || now.After(di.plainUntil)
+}
+
+// noteObfuscatedPingSentLocked counts an obfuscated ping sent to di's
+// peer, falling back to plain disco if too many went unanswered. c.mu must
+// be held.
+func (c *Conn) noteObfuscatedPingSentLocked(o *discoObfuscator, di *discoInfo, now mono.Time) {
+	di.obfuscatedUnanswered++
+	if !o.cfg.Strict && di.obfuscatedUnanswered >= discoObfuscationFallbackPings {
+		c.logf("magicsock: disco: %v: no answer to obfuscated pings, falling back to plain disco", di.discoShort)
+		di.obfuscatedUnanswered = 0
+		di.plainUntil = now.Add(discoObfuscationRetry)
+		metricDiscoObfuscationFallback.Add(1)
+	}
+}
+
+// noteDiscoRecvLocked records whether a disco message received over UDP
+// from di's peer was obfuscated. c.mu must be held.
+func (c *Conn) noteDiscoRecvLocked(o *discoObfuscator, di *discoInfo, obfuscated bool, now mono.Time) {
+	if obfuscated {
+		di.obfuscatedUnanswered = 0
+		di.plainUntil = 0
+		di.peerObfuscates = true
+		return
+	}
+	di.peerObfuscates = false
+	if o != nil && !o.cfg.Strict && (di.plainUntil == 0 || now.After(di.plainUntil)) {
+		c.logf("magicsock: disco: %v: got plain disco, falling back to plain disco", di.discoShort)
+		di.plainUntil = now.Add(discoObfuscationRetry)
+		metricDiscoObfuscationFallback.Add(1)
+	}
+}
+
+// padHandshakesTo returns buffs, sent over UDP to de, with their
+// WireGuard handshake initiations padded if c pads them for de.
+func (c *Conn) padHandshakesTo(de *endpoint, buffs [][]byte) [][]byte {
+	o := c.discoObfuscator.Load()
+	if o == nil || !o.cfg.PadHandshakes || !slices.ContainsFunc(buffs, isHandshakeInitiation) {
+		return buffs
+	}
+	epDisco := de.disco.Load()
+	if epDisco == nil {
+		return buffs
+	}
+	c.mu.Lock()
+	di, ok := c.discoInfo[epDisco.key]
+	pad := ok && di.peerObfuscates
+	c.mu.Unlock()
+	if !pad {
+		return buffs
+	}
+	return o.padHandshakes(buffs)
+}
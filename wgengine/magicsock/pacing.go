@@ -0,0 +1,90 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+
+	"tailscale.com/types/key"
+)
+
+// SendPacing configures the pacing of the batches of packets a Conn sends
+// to a peer over UDP. Rather than writing a whole batch at once, such as
+// in 64KB GSO bursts, a paced batch is written in chunks of at most
+// BurstBytes spread over Interval, to avoid overflowing the buffers of
+// constrained uplinks downstream.
+//
+// Pacing blocks the sender (wireguard-go) while a batch is written, so
+// Interval should be small: a few hundred microseconds to a few
+// milliseconds.
+type SendPacing struct {
+	// Interval is the time over which a batch is spread. Zero
+	// disables pacing.
+	Interval time.Duration
+
+	// BurstBytes is the most bytes of a paced batch written at once.
+	// Batches no bigger are written immediately. Zero means
+	// DefaultPacingBurstBytes.
+	BurstBytes int
+}
+
+// DefaultPacingBurstBytes is the default SendPacing.BurstBytes.
+const DefaultPacingBurstBytes = 16 << 10
+
+func (p SendPacing) burstBytes() int {
+	if p.BurstBytes > 0 {
+		return p.BurstBytes
+	}
+	return DefaultPacingBurstBytes
+}
+
+// SetSendPacing sets the pacing of c's UDP sends, replacing that of
+// Options.SendPacing.
+func (c *Conn) SetSendPacing(p SendPacing) {
+	c.sendPacing.Store(p)
+}
+
+// pacedChunks splits buffs into consecutive chunks of at most burstBytes,
+// each with at least one buff.
+func pacedChunks(buffs [][]byte, burstBytes int) [][][]byte {
+	var chunks [][][]byte
+	start, size := 0, 0
+	for i, b := range buffs {
+		if i > start && size+len(b) > burstBytes {
+			chunks = append(chunks, buffs[start:i])
+			start, size = i, 0
+		}
+		size += len(b)
+	}
+	return append(chunks, buffs[start:])
+}
+
+// writeUDPBatchPaced writes buffs to addr like writeUDPBatch, in chunks
+// spread over p.Interval. If a coalesced write fails, the
+// coalescedSendError counts the buffs sent by all chunks.
+func (c *Conn) writeUDPBatchPaced(addr netip.AddrPort, peer key.NodePublic, buffs [][]byte, maxSegments int, p SendPacing) error {
+	chunks := pacedChunks(buffs, p.burstBytes())
+	gap := p.Interval / time.Duration(len(chunks))
+	start := time.Now()
+	sent := 0
+	for i, chunk := range chunks {
+		if i > 0 {
+			if d := time.Until(start.Add(time.Duration(i) * gap)); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		if err := c.writeUDPBatch(addr, peer, chunk, maxSegments); err != nil {
+			var errCoalesced coalescedSendError
+			if errors.As(err, &errCoalesced) {
+				errCoalesced.sent += sent
+				return errCoalesced
+			}
+			return err
+		}
+		sent += len(chunk)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"net/netip"
+
+	"tailscale.com/types/key"
+)
+
+// pathKeepalive is whether a peer's current path wants WireGuard
+// persistent keepalives.
+type pathKeepalive uint8
+
+const (
+	pathKeepaliveUnknown  pathKeepalive = iota // no path used yet
+	pathKeepaliveWanted                        // a direct path through a NAT
+	pathKeepaliveUnneeded                      // a DERP or LAN path
+)
+
+// pathWantsKeepalive reports whether the path chosen to send to a peer,
+// per addrForSendLocked, wants WireGuard persistent keepalives to keep
+// it open while idle. A DERP path doesn't: the relay connection is
+// already kept up. Neither does a direct path on the LAN, which crosses
+// no NAT or stateful firewall whose mapping could expire.
+func pathWantsKeepalive(udpAddr, derpAddr netip.AddrPort) bool {
+	if !udpAddr.IsValid() || derpAddr.IsValid() {
+		return false
+	}
+	ip := udpAddr.Addr()
+	return !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast()
+}
+
+// notePathKeepaliveLocked records whether the path chosen to send to
+// the peer wants keepalives, and reports a change to the
+// Options.PathKeepaliveFunc func. de.mu must be held.
+func (de *endpoint) notePathKeepaliveLocked(udpAddr, derpAddr netip.AddrPort) {
+	fn := de.c.pathKeepaliveFunc
+	if fn == nil || !udpAddr.IsValid() && !derpAddr.IsValid() {
+		return
+	}
+	pk := pathKeepaliveUnneeded
+	if pathWantsKeepalive(udpAddr, derpAddr) {
+		pk = pathKeepaliveWanted
+	}
+	if pk == de.pathKeepalive {
+		return
+	}
+	de.pathKeepalive = pk
+	go fn(de.publicKey)
+}
+
+// PathWantsKeepalive reports whether the path last used to send to the
+// peer with node key nk wants WireGuard persistent keepalives: whether
+// it's direct and crosses a NAT. ok is false if the peer is unknown or
+// nothing has been sent to it yet. See Options.PathKeepaliveFunc.
+func (c *Conn) PathWantsKeepalive(nk key.NodePublic) (want, ok bool) {
+	c.mu.Lock()
+	de, found := c.peerMap.endpointForNodeKey(nk)
+	c.mu.Unlock()
+	if !found {
+		return false, false
+	}
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	switch de.pathKeepalive {
+	case pathKeepaliveWanted:
+		return true, true
+	case pathKeepaliveUnneeded:
+		return false, true
+	}
+	return false, false
+}
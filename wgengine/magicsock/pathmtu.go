@@ -0,0 +1,114 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"tailscale.com/types/key"
+	"tailscale.com/util/clientmetric"
+)
+
+// SetPeerPathMTU sets the path MTU to the peer with node key nk: the size
+// of the largest IP packet that reaches it unfragmented, as found by path
+// MTU discovery. Zero means unknown, the default.
+//
+// UDP GSO can only coalesce datagrams that fit the path MTU, or the kernel
+// rejects the whole send with EMSGSIZE, to be retried uncoalesced. So
+// datagrams to the peer that don't fit are sent on their own up front,
+// while smaller ones are still coalesced, rather than the peer's sends
+// failing until coalescing is disabled for it altogether.
+func (c *Conn) SetPeerPathMTU(nk key.NodePublic, mtu int) error {
+	if mtu < 0 {
+		return fmt.Errorf("invalid path MTU %d", mtu)
+	}
+	c.mu.Lock()
+	de, ok := c.peerMap.endpointForNodeKey(nk)
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown peer")
+	}
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	de.pathMTU = mtu
+	return nil
+}
+
+// udpHeaderLen returns the length of the IP and UDP headers of a
+// datagram to addr.
+func udpHeaderLen(addr netip.Addr) int {
+	if addr.Is4() {
+		return 20 + 8
+	}
+	return 40 + 8
+}
+
+// maxCoalescedLenLocked returns the length of the largest datagram to
+// udpAddr that may be coalesced, per de.pathMTU, or zero if there's no
+// limit.
+//
+// de.mu must be held.
+func (de *endpoint) maxCoalescedLenLocked(udpAddr netip.AddrPort) int {
+	if de.pathMTU == 0 {
+		return 0
+	}
+	return max(de.pathMTU-udpHeaderLen(udpAddr.Addr()), 1)
+}
+
+// sendUDPBatchMTU is like Conn.sendUDPBatch, but sends the datagrams in
+// buffs longer than maxLen uncoalesced. Zero maxLen means no limit. If a
+// coalesced send fails, the error is a coalescedSendError whose count of
+// sent datagrams is relative to buffs.
+func (c *Conn) sendUDPBatchMTU(addr netip.AddrPort, peer key.NodePublic, buffs [][]byte, maxSegments, maxLen int) (sent bool, err error) {
+	if maxLen == 0 || maxSegments == 1 {
+		return c.sendUDPBatch(addr, peer, buffs, maxSegments)
+	}
+	var done int
+	for _, r := range mtuRuns(buffs, maxLen) {
+		segs := maxSegments
+		if r.oversize {
+			segs = 1
+			metricSendUDPOversizeUncoalesced.Add(int64(r.n))
+		}
+		sent, err = c.sendUDPBatch(addr, peer, buffs[done:done+r.n], segs)
+		if err != nil {
+			var errCoalesced coalescedSendError
+			if errors.As(err, &errCoalesced) {
+				errCoalesced.sent += done
+				err = errCoalesced
+			}
+			return sent, err
+		}
+		done += r.n
+	}
+	return sent, nil
+}
+
+// mtuRun is a run of consecutive datagrams that either all fit a path
+// MTU or all exceed it.
+type mtuRun struct {
+	n        int
+	oversize bool
+}
+
+// mtuRuns splits buffs into runs of datagrams no longer than maxLen, and
+// of longer ones, in order.
+func mtuRuns(buffs [][]byte, maxLen int) []mtuRun {
+	var runs []mtuRun
+	for _, b := range buffs {
+		oversize := len(b) > maxLen
+		if len(runs) > 0 && runs[len(runs)-1].oversize == oversize {
+			runs[len(runs)-1].n++
+			continue
+		}
+		runs = append(runs, mtuRun{1, oversize})
+	}
+	return runs
+}
+
+// metricSendUDPOversizeUncoalesced counts the datagrams sent uncoalesced
+// because they exceed their peer's path MTU.
+var metricSendUDPOversizeUncoalesced = clientmetric.NewCounter("magicsock_send_udp_oversize_uncoalesced")
@@ -0,0 +1,62 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"time"
+
+	"tailscale.com/tstime/mono"
+)
+
+// pathChangeWindow is the period over which pathQuality counts path
+// changes.
+const pathChangeWindow = 5 * time.Minute
+
+// pathQuality tracks the quality of the path to a peer from the RTTs of
+// the disco pongs received on it and the peer's path changes.
+type pathQuality struct {
+	srtt    time.Duration // smoothed RTT, as in RFC 6298; zero if no samples
+	jitter  time.Duration // interarrival jitter of RTTs, as in RFC 3550
+	lastRTT time.Duration // most recent RTT sample
+
+	// changes are the times of the path changes in the last
+	// pathChangeWindow, oldest first.
+	changes []mono.Time
+}
+
+// addRTT records rtt, the RTT of a pong on the peer's current path.
+func (q *pathQuality) addRTT(rtt time.Duration) {
+	if q.srtt == 0 {
+		q.srtt = rtt
+	} else {
+		d := rtt - q.lastRTT
+		if d < 0 {
+			d = -d
+		}
+		q.srtt += (rtt - q.srtt) / 8
+		q.jitter += (d - q.jitter) / 16
+	}
+	q.lastRTT = rtt
+}
+
+// notePathChange records that the peer's path changed at now.
+func (q *pathQuality) notePathChange(now mono.Time) {
+	q.prune(now)
+	q.changes = append(q.changes, now)
+}
+
+// pathChanges returns the number of path changes in the pathChangeWindow
+// before now.
+func (q *pathQuality) pathChanges(now mono.Time) int {
+	q.prune(now)
+	return len(q.changes)
+}
+
+func (q *pathQuality) prune(now mono.Time) {
+	i := 0
+	for i < len(q.changes) && now.Sub(q.changes[i]) > pathChangeWindow {
+		i++
+	}
+	q.changes = q.changes[i:]
+}
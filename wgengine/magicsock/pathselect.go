@@ -0,0 +1,69 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"net/netip"
+	"time"
+
+	"tailscale.com/types/key"
+)
+
+// Path is a UDP path to a peer.
+type Path struct {
+	// Addr is the peer's address.
+	Addr netip.AddrPort
+	// Latency is the round-trip time last measured over the path.
+	Latency time.Duration
+	// Loss is the percentage of recent disco pings over the path that
+	// got no pong, or zero if none have completed yet.
+	Loss float64
+}
+
+// PathSelector decides which of a peer's UDP paths a Conn sends to. Its
+// methods are called with internal locks held, so they must be fast and
+// must not call back into the Conn.
+type PathSelector interface {
+	// Better reports whether a is a better path to peer than b, the
+	// current best path, which is the zero Path if there is none. It's
+	// called for each disco pong received over a path, with the path's
+	// new latency.
+	Better(peer key.NodePublic, a, b Path) bool
+
+	// BestWireGuardOnly returns which of paths, each with a measured
+	// latency, to send to for a WireGuard-only peer (one that doesn't
+	// speak disco). If it returns false, or paths is empty, a path is
+	// picked at random until more latencies are known.
+	BestWireGuardOnly(peer key.NodePublic, paths []Path) (best Path, ok bool)
+}
+
+// LatencyPathSelector is the default PathSelector. It prefers paths with
+// lower latency, but favors loopback, private and IPv6 addresses over
+// paths with similar latency, and only switches paths for an improvement
+// of more than 1%.
+type LatencyPathSelector struct{}
+
+// Better implements PathSelector.
+func (LatencyPathSelector) Better(_ key.NodePublic, a, b Path) bool {
+	return betterAddr(addrLatency{a.Addr, a.Latency}, addrLatency{b.Addr, b.Latency})
+}
+
+// BestWireGuardOnly implements PathSelector. It picks the path with the
+// lowest latency, preferring IPv6 on a tie.
+func (LatencyPathSelector) BestWireGuardOnly(_ key.NodePublic, paths []Path) (best Path, ok bool) {
+	for _, p := range paths {
+		if !ok || p.Latency < best.Latency || p.Latency == best.Latency && p.Addr.Addr().Is6() {
+			best, ok = p, true
+		}
+	}
+	return best, ok
+}
+
+// pathSelectorOrDefault returns c's PathSelector.
+func (c *Conn) pathSelectorOrDefault() PathSelector {
+	if c.pathSelector == nil {
+		return LatencyPathSelector{}
+	}
+	return c.pathSelector
+}
@@ -0,0 +1,139 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"io"
+	"net/netip"
+
+	"github.com/tailscale/wireguard-go/device"
+	"tailscale.com/disco"
+	"tailscale.com/net/packet"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/wgengine/capture"
+)
+
+// CaptureOpts configures a packet capture started with
+// Conn.StartPacketCapture.
+type CaptureOpts struct {
+	// Data is whether to capture WireGuard packets, as well as disco
+	// messages.
+	Data bool
+
+	// HeadersOnly is whether to capture only the header of WireGuard
+	// transport (data) packets, omitting their encrypted payload. It
+	// only applies if Data is set.
+	HeadersOnly bool
+
+	// Filter, if non-nil, limits the capture to the packets it matches.
+	// Its Addrs don't apply, as the packets captured aren't IP packets.
+	Filter *capture.Filter
+}
+
+// packetCapture is a capture started by Conn.StartPacketCapture.
+type packetCapture struct {
+	w    *capture.PcapngWriter
+	opts CaptureOpts
+}
+
+// StartPacketCapture starts writing the disco messages c sends and
+// receives (and, if opts.Data is set, WireGuard packets) to w as a pcapng
+// stream, until stop is called. Disco messages are captured decrypted.
+// The stream can be read by Wireshark with the dissector in
+// capture.DissectorLua.
+//
+// Unlike InstallCaptureHook, it needs no other capture plumbing. Only one
+// capture runs at a time: starting one stops any other. Writes to w are
+// synchronous with packet processing, so w should be fast, and the
+// capture stops at the first write error.
+func (c *Conn) StartPacketCapture(w io.Writer, opts CaptureOpts) (stop func()) {
+	pc := &packetCapture{
+		w:    capture.NewPcapngWriter(w),
+		opts: opts,
+	}
+	c.packetCapture.Store(pc)
+	return func() {
+		c.packetCapture.CompareAndSwap(pc, nil)
+	}
+}
+
+// captureDisco records a disco message payload, decrypted, sent to or
+// received from addr, if a capture is running and its filter matches.
+// peer is the peer's node key, if known; it must be if addr is a DERP
+// address.
+func (c *Conn) captureDisco(path capture.Path, addr netip.AddrPort, peer key.NodePublic, payload []byte) {
+	pc := c.packetCapture.Load()
+	if pc == nil || !pc.opts.Filter.Match(path, len(payload)) || !pc.opts.Filter.MatchPeer(peer) {
+		return
+	}
+	pc.w.LogPacket(path, c.now(), disco.ToPCAPFrame(addr, derpNodeOf(addr, peer), payload), packet.CaptureMeta{})
+}
+
+// captureWireGuard records the WireGuard packets buffs sent to or received
+// from addr, if a data capture is running and its filter matches. peer is
+// as for captureDisco.
+func (c *Conn) captureWireGuard(path capture.Path, addr netip.AddrPort, peer key.NodePublic, buffs ...[]byte) {
+	pc := c.packetCapture.Load()
+	if pc == nil || !pc.opts.Data || !pc.opts.Filter.MatchPeer(peer) {
+		return
+	}
+	now := c.now()
+	derpNode := derpNodeOf(addr, peer)
+	for _, b := range buffs {
+		if !pc.opts.Filter.Match(path, len(b)) {
+			continue
+		}
+		origLen := len(b)
+		if pc.opts.HeadersOnly && len(b) > device.MessageTransportHeaderSize && b[0] == device.MessageTransportType {
+			b = b[:device.MessageTransportHeaderSize]
+		}
+		frame := disco.ToPCAPFrame(addr, derpNode, b)
+		pc.w.LogTruncatedPacket(path, now, frame, len(frame)-len(b)+origLen, packet.CaptureMeta{})
+	}
+}
+
+// derpNodeOf returns the node key to put in the disco.ToPCAPFrame of a
+// packet to or from peer at addr: peer if addr is a DERP address, or else
+// zero.
+func derpNodeOf(addr netip.AddrPort, peer key.NodePublic) key.NodePublic {
+	if addr.Addr() != tailcfg.DerpMagicIPAddr {
+		return key.NodePublic{}
+	}
+	return peer
+}
+
+// InstallFilteredCaptureHook is like InstallCaptureHook, but cb is only
+// called for the packets f matches. A nil f matches all packets.
+func (c *Conn) InstallFilteredCaptureHook(cb capture.Callback, f *capture.Filter) {
+	c.captureFilter.Store(f)
+	c.captureHook.Store(cb)
+}
+
+// capturing reports whether a capture hook is installed or a capture is
+// running.
+func (c *Conn) capturing() bool {
+	return c.captureHook.Load() != nil || c.packetCapture.Load() != nil
+}
+
+// discoPeerLocked returns the node key of the peer with disco key dk, for
+// capture filters: nk if it's non-zero, or else the only peer with dk. It
+// returns zero if dk is shared by several peers.
+//
+// c.mu must be held.
+func (c *Conn) discoPeerLocked(nk key.NodePublic, dk key.DiscoPublic) key.NodePublic {
+	if !nk.IsZero() {
+		return nk
+	}
+	n := 0
+	c.peerMap.forEachEndpointWithDiscoKey(dk, func(ep *endpoint) bool {
+		nk = ep.publicKey
+		n++
+		return n < 2
+	})
+	if n != 1 {
+		return key.NodePublic{}
+	}
+	return nk
+}
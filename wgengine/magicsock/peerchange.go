@@ -0,0 +1,134 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"fmt"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+	"tailscale.com/util/clientmetric"
+)
+
+// ApplyPeerChange updates the peer named by change from the network map
+// last set by SetNetworkMap, like a delta from control, without
+// reprocessing the rest of the network map. Changes to the peer's
+// endpoints, disco key and home DERP region apply to its endpoint as
+// SetNetworkMap would; the rest only update the network map. A change
+// to a peer not in the network map is ignored.
+//
+// A change of node key, or of a disco key to or from zero, changes which
+// endpoint the peer has, so it's applied as a full SetNetworkMap.
+func (c *Conn) ApplyPeerChange(change *tailcfg.PeerChange) {
+	// The diff is reported after c.mu is released.
+	var diff NetmapDiff
+	defer func() {
+		if c.netmapDiffFunc != nil && !diff.IsEmpty() {
+			c.netmapDiffFunc(diff)
+		}
+	}()
+
+	c.mu.Lock()
+	if c.closed || c.netMap == nil {
+		c.mu.Unlock()
+		return
+	}
+	i := c.peerIndexLocked(change.NodeID)
+	if i < 0 {
+		c.mu.Unlock()
+		c.logf("[v1] magicsock: ApplyPeerChange: unknown node %v", change.NodeID)
+		return
+	}
+	old := c.netMap.Peers[i]
+	n := applyPeerChange(old, change)
+
+	// Don't modify the caller's network map; replace it with a copy
+	// sharing all but the changed peer.
+	nm := new(netmap.NetworkMap)
+	*nm = *c.netMap
+	nm.Peers = append(nm.Peers[:0:0], nm.Peers...)
+	nm.Peers[i] = n
+
+	ep, ok := c.peerMap.endpointForNodeKey(n.Key)
+	if n.Key != old.Key || old.DiscoKey.IsZero() != n.DiscoKey.IsZero() || !ok && !n.DiscoKey.IsZero() {
+		c.mu.Unlock()
+		c.SetNetworkMap(nm)
+		return
+	}
+	defer c.mu.Unlock()
+	c.netMap = nm
+	metricPeerChangeApplied.Add(1)
+	if old.Equal(n) {
+		return
+	}
+	if c.netmapDiffFunc != nil {
+		diff = diffNetmapPeers([]*tailcfg.Node{old}, []*tailcfg.Node{n})
+		diff.NumPeers = len(nm.Peers)
+	}
+	if !ok {
+		// A node without a disco key, only reachable via DERP.
+		return
+	}
+
+	oldDiscoKey := old.DiscoKey
+	ep.updateFromNode(n.View(), c.heartbeatDisabledLocked())
+	c.peerMap.upsertEndpoint(ep, oldDiscoKey)
+	c.tryLearnedPathLocked(ep)
+	if oldDiscoKey != n.DiscoKey && !c.peerMap.anyEndpointForDiscoKey(oldDiscoKey) {
+		delete(c.discoInfo, oldDiscoKey)
+	}
+}
+
+// peerIndexLocked returns the index of the peer with id in c.netMap.Peers,
+// or -1 if there's none. c.mu must be held.
+func (c *Conn) peerIndexLocked(id tailcfg.NodeID) int {
+	for i, n := range c.netMap.Peers {
+		if n.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// applyPeerChange returns a copy of n with change applied.
+func applyPeerChange(n *tailcfg.Node, change *tailcfg.PeerChange) *tailcfg.Node {
+	n = n.Clone()
+	if change.DERPRegion != 0 {
+		n.DERP = fmt.Sprintf("%s:%d", tailcfg.DerpMagicIP, change.DERPRegion)
+	}
+	if change.Cap != 0 {
+		n.Cap = change.Cap
+	}
+	if change.Endpoints != nil {
+		n.Endpoints = append([]string(nil), change.Endpoints...)
+	}
+	if change.Key != nil {
+		n.Key = *change.Key
+	}
+	if change.KeySignature != nil {
+		n.KeySignature = append(n.KeySignature[:0:0], change.KeySignature...)
+	}
+	if change.DiscoKey != nil {
+		n.DiscoKey = *change.DiscoKey
+	}
+	if change.Online != nil {
+		v := *change.Online
+		n.Online = &v
+	}
+	if change.LastSeen != nil {
+		v := *change.LastSeen
+		n.LastSeen = &v
+	}
+	if change.KeyExpiry != nil {
+		n.KeyExpiry = *change.KeyExpiry
+	}
+	if change.Capabilities != nil {
+		n.Capabilities = append([]string(nil), (*change.Capabilities)...)
+	}
+	return n
+}
+
+// metricPeerChangeApplied counts the ApplyPeerChange calls applied
+// without a full SetNetworkMap.
+var metricPeerChangeApplied = clientmetric.NewCounter("magicsock_peer_change_applied")
@@ -5,8 +5,11 @@
 
 import (
 	"net/netip"
+	"sync"
 
+	"tailscale.com/net/stun"
 	"tailscale.com/types/key"
+	"tailscale.com/util/mak"
 )
 
 // peerInfo is all the information magicsock tracks about a particular
@@ -16,7 +19,8 @@ type peerInfo struct {
 	// ipPorts is an inverted version of peerMap.byIPPort (below), so
 	// that when we're deleting this node, we can rapidly find out the
 	// keys that need deleting from peerMap.byIPPort without having to
-	// iterate over every IPPort known for any peer.
+	// iterate over every IPPort known for any peer. It's guarded by
+	// Conn.mu.
 	ipPorts map[netip.AddrPort]bool
 }
 
@@ -27,30 +31,59 @@ func newPeerInfo(ep *endpoint) *peerInfo {
 	}
 }
 
+// peerMapShards is the number of shards of a peerMap's index by node key.
+// It must be a power of two.
+const peerMapShards = 16
+
+// peerMapShard is a shard of a peerMap's index by node key.
+type peerMapShard struct {
+	mu        sync.RWMutex
+	byNodeKey map[key.NodePublic]*peerInfo
+}
+
 // peerMap is an index of peerInfos by node (WireGuard) key, disco
 // key, and discovered ip:port endpoints.
 //
-// Doesn't do any locking, all access must be done with Conn.mu held.
+// The zero value is ready to use. All changes must be made with Conn.mu
+// held, as must all other access
+// except for endpointForNodeKey and endpointForIPPort. Those may be
+// called without it, so that receiving packets doesn't contend with
+// SetNetworkMap and UpdateStatus in tailnets with thousands of peers:
+// the index by node key is sharded, each shard with its own lock, and
+// the index by ip:port is read without locks.
 type peerMap struct {
-	byNodeKey map[key.NodePublic]*peerInfo
-	byIPPort  map[netip.AddrPort]*peerInfo
+	shards [peerMapShards]peerMapShard
+
+	// byIPPort maps a netip.AddrPort to its *peerInfo.
+	byIPPort sync.Map
 
 	// nodesOfDisco contains the set of nodes that are using a
 	// DiscoKey. Usually those sets will be just one node.
 	nodesOfDisco map[key.DiscoPublic]map[key.NodePublic]bool
 }
 
-func newPeerMap() peerMap {
-	return peerMap{
-		byNodeKey:    map[key.NodePublic]*peerInfo{},
-		byIPPort:     map[netip.AddrPort]*peerInfo{},
-		nodesOfDisco: map[key.DiscoPublic]map[key.NodePublic]bool{},
-	}
+// shard returns the shard of m indexing nk.
+func (m *peerMap) shard(nk key.NodePublic) *peerMapShard {
+	// Node keys are random, so any of their bytes will do.
+	raw := nk.Raw32()
+	return &m.shards[raw[31]&(peerMapShards-1)]
+}
+
+// peerInfoForNodeKey returns the peerInfo for nk, or nil.
+func (m *peerMap) peerInfoForNodeKey(nk key.NodePublic) *peerInfo {
+	s := m.shard(nk)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byNodeKey[nk]
 }
 
 // nodeCount returns the number of nodes currently in m.
 func (m *peerMap) nodeCount() int {
-	return len(m.byNodeKey)
+	n := 0
+	for i := range m.shards {
+		n += len(m.shards[i].byNodeKey)
+	}
+	return n
 }
 
 // anyEndpointForDiscoKey reports whether there exists any
@@ -65,7 +98,7 @@ func (m *peerMap) endpointForNodeKey(nk key.NodePublic) (ep *endpoint, ok bool)
 	if nk.IsZero() {
 		return nil, false
 	}
-	if info, ok := m.byNodeKey[nk]; ok {
+	if info := m.peerInfoForNodeKey(nk); info != nil {
 		return info.ep, true
 	}
 	return nil, false
@@ -74,16 +107,20 @@ func (m *peerMap) endpointForNodeKey(nk key.NodePublic) (ep *endpoint, ok bool)
 // endpointForIPPort returns the endpoint for the peer we
 // believe to be at ipp, or nil if we don't know of any such peer.
 func (m *peerMap) endpointForIPPort(ipp netip.AddrPort) (ep *endpoint, ok bool) {
-	if info, ok := m.byIPPort[ipp]; ok {
-		return info.ep, true
+	if v, ok := m.byIPPort.Load(ipp); ok {
+		return v.(*peerInfo).ep, true
 	}
 	return nil, false
 }
 
-// forEachEndpoint invokes f on every endpoint in m.
+// forEachEndpoint invokes f on every endpoint in m. f may delete them.
 func (m *peerMap) forEachEndpoint(f func(ep *endpoint)) {
-	for _, pi := range m.byNodeKey {
-		f(pi.ep)
+	// Conn.mu excludes changes to m except by f, so no shard locks
+	// are needed to read, and none are held for f to make changes.
+	for i := range m.shards {
+		for _, pi := range m.shards[i].byNodeKey {
+			f(pi.ep)
+		}
 	}
 }
 
@@ -92,8 +129,8 @@ func (m *peerMap) forEachEndpoint(f func(ep *endpoint)) {
 // iterate.
 func (m *peerMap) forEachEndpointWithDiscoKey(dk key.DiscoPublic, f func(*endpoint) (keepGoing bool)) {
 	for nk := range m.nodesOfDisco[dk] {
-		pi, ok := m.byNodeKey[nk]
-		if !ok {
+		pi := m.shard(nk).byNodeKey[nk]
+		if pi == nil {
 			// Unexpected. Data structures would have to
 			// be out of sync.  But we don't have a logger
 			// here to log [unexpected], so just skip.
@@ -111,8 +148,10 @@ func (m *peerMap) forEachEndpointWithDiscoKey(dk key.DiscoPublic, f func(*endpoi
 // ep.publicKey, and updates indexes. m must already have a
 // tailcfg.Node for ep.publicKey.
 func (m *peerMap) upsertEndpoint(ep *endpoint, oldDiscoKey key.DiscoPublic) {
-	if m.byNodeKey[ep.publicKey] == nil {
-		m.byNodeKey[ep.publicKey] = newPeerInfo(ep)
+	if s := m.shard(ep.publicKey); s.byNodeKey[ep.publicKey] == nil {
+		s.mu.Lock()
+		mak.Set(&s.byNodeKey, ep.publicKey, newPeerInfo(ep))
+		s.mu.Unlock()
 	}
 	epDisco := ep.disco.Load()
 	if epDisco == nil || oldDiscoKey != epDisco.key {
@@ -135,11 +174,21 @@ func (m *peerMap) upsertEndpoint(ep *endpoint, oldDiscoKey key.DiscoPublic) {
 	set := m.nodesOfDisco[epDisco.key]
 	if set == nil {
 		set = map[key.NodePublic]bool{}
-		m.nodesOfDisco[epDisco.key] = set
+		mak.Set(&m.nodesOfDisco, epDisco.key, set)
+	}
+	if !set[ep.publicKey] && len(set) == 1 {
+		metricDiscoKeyShared.Add(1)
 	}
 	set[ep.publicKey] = true
 }
 
+// discoKeyShared reports whether ep's disco key is also used by other
+// nodes in m.
+func (m *peerMap) discoKeyShared(ep *endpoint) bool {
+	epDisco := ep.disco.Load()
+	return epDisco != nil && len(m.nodesOfDisco[epDisco.key]) > 1
+}
+
 // setNodeKeyForIPPort makes future peer lookups by ipp return the
 // same endpoint as a lookup by nk.
 //
@@ -147,16 +196,28 @@ func (m *peerMap) upsertEndpoint(ep *endpoint, oldDiscoKey key.DiscoPublic) {
 // nk, because calling this function defines the endpoint we hand to
 // WireGuard for packets received from ipp.
 func (m *peerMap) setNodeKeyForIPPort(ipp netip.AddrPort, nk key.NodePublic) {
-	if pi := m.byIPPort[ipp]; pi != nil {
-		delete(pi.ipPorts, ipp)
-		delete(m.byIPPort, ipp)
+	if v, ok := m.byIPPort.Load(ipp); ok {
+		delete(v.(*peerInfo).ipPorts, ipp)
 	}
-	if pi, ok := m.byNodeKey[nk]; ok {
+	// Replace rather than delete any old mapping first, so concurrent
+	// lookups see one or the other.
+	if pi := m.shard(nk).byNodeKey[nk]; pi != nil {
 		pi.ipPorts[ipp] = true
-		m.byIPPort[ipp] = pi
+		m.byIPPort.Store(ipp, pi)
+	} else {
+		m.byIPPort.Delete(ipp)
 	}
 }
 
+// forEachIPPort invokes f on every ip:port in m and the endpoint it maps
+// to.
+func (m *peerMap) forEachIPPort(f func(ipp netip.AddrPort, ep *endpoint)) {
+	m.byIPPort.Range(func(k, v any) bool {
+		f(k.(netip.AddrPort), v.(*peerInfo).ep)
+		return true
+	})
+}
+
 // deleteEndpoint deletes the peerInfo associated with ep, and
 // updates indexes.
 func (m *peerMap) deleteEndpoint(ep *endpoint) {
@@ -167,17 +228,50 @@ func (m *peerMap) deleteEndpoint(ep *endpoint) {
 
 	epDisco := ep.disco.Load()
 
-	pi := m.byNodeKey[ep.publicKey]
+	s := m.shard(ep.publicKey)
+	pi := s.byNodeKey[ep.publicKey]
 	if epDisco != nil {
 		delete(m.nodesOfDisco[epDisco.key], ep.publicKey)
 	}
-	delete(m.byNodeKey, ep.publicKey)
+	s.mu.Lock()
+	delete(s.byNodeKey, ep.publicKey)
+	s.mu.Unlock()
 	if pi == nil {
 		// Kneejerk paranoia from earlier issue 2801.
 		// Unexpected. But no logger plumbed here to log so.
 		return
 	}
 	for ip := range pi.ipPorts {
-		delete(m.byIPPort, ip)
+		m.byIPPort.Delete(ip)
 	}
 }
+
+// discoPingOwners maps the TxIDs of outstanding disco pings to the endpoint
+// that sent each, so a pong is handled by the node its ping was for, even
+// when several nodes share a disco key.
+//
+// Its mu is a leaf lock, acquired with Conn.mu and endpoint.mu held.
+type discoPingOwners struct {
+	mu sync.Mutex
+	m  map[stun.TxID]*endpoint
+}
+
+func (o *discoPingOwners) add(txid stun.TxID, de *endpoint) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	mak.Set(&o.m, txid, de)
+}
+
+func (o *discoPingOwners) remove(txid stun.TxID) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.m, txid)
+}
+
+// owner returns the endpoint that sent the ping txid, or nil if it's
+// unknown or its pong was already handled.
+func (o *discoPingOwners) owner(txid stun.TxID) *endpoint {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.m[txid]
+}
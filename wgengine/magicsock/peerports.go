@@ -0,0 +1,347 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"golang.org/x/net/ipv6"
+	"tailscale.com/net/neterror"
+	"tailscale.com/types/key"
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/mak"
+	"tailscale.com/util/set"
+)
+
+// PeerPorts configures a Conn to exchange packets with each peer over UDP
+// sockets of its own, bound to distinct local ports, rather than the
+// shared ones. That suits NATs that throttle each 5-tuple, as the load is
+// spread over as many as there are peers, and lets firewalls open a
+// pinhole per peer. It's ignored with PacketConns.
+//
+// The peers' ports aren't advertised as endpoints. Peers learn them as
+// usual from the disco pings sent from them, and data follows the path
+// they confirm; pings from peers to the shared port are still answered,
+// but from the peer's own port.
+type PeerPorts struct {
+	// Enabled binds a socket per address family for each peer, when
+	// something is first sent to it over UDP, and closes it once the
+	// peer leaves the netmap. A peer whose socket can't be bound uses
+	// the shared one until the next rebind.
+	Enabled bool
+
+	// First and Last are the range of ports, inclusive, that peers'
+	// sockets are bound to, each to a random port in it not used by
+	// another peer. If both are zero, the system picks the ports.
+	First uint16
+	Last  uint16
+}
+
+// peerPortBindAttempts is how many random ports of PeerPorts' range are
+// tried, at most, to bind a peer's socket.
+const peerPortBindAttempts = 8
+
+// peerPortSet is the sockets of the peers of one address family, with
+// Options.PeerPorts.
+type peerPortSet struct {
+	mu     sync.Mutex
+	closed bool // no more sockets are bound; see Conn.closePeerPorts
+	ports  map[key.NodePublic]*peerPort
+}
+
+// peerPort is a peer's socket.
+type peerPort struct {
+	ruc   RebindingUDPConn
+	port  uint16 // bound port, if bound
+	bound bool   // if not, the peer uses the shared socket until the next rebind
+}
+
+// peerPortReadResult is a WireGuard packet read from a peer's socket, of
+// n bytes in buf, for receivePeerPorts. A zero one wakes it up to notice
+// that the connBind was closed.
+type peerPortReadResult struct {
+	buf *[]byte // from peerPortBufPool
+	n   int
+	ep  *endpoint
+}
+
+var peerPortBufPool = &sync.Pool{
+	New: func() any {
+		b := make([]byte, maxIPv6PayloadLen)
+		return &b
+	},
+}
+
+var errPeerPortsRange = errors.New("magicsock: invalid PeerPorts range")
+
+// checkRange returns an error if p's port range is invalid.
+func (p PeerPorts) checkRange() error {
+	if p.First > p.Last || p.First == 0 && p.Last != 0 {
+		return fmt.Errorf("%w %d-%d", errPeerPortsRange, p.First, p.Last)
+	}
+	return nil
+}
+
+// usesPeerPorts reports whether c binds sockets of their own for peers.
+func (c *Conn) usesPeerPorts() bool {
+	return c.peerPorts.Enabled && c.packetConns.isZero() && runtime.GOOS != "js" && !debugAlwaysDERP()
+}
+
+// peerPortSetOf returns the set of peers' sockets of network, "udp4" or
+// "udp6".
+func (c *Conn) peerPortSetOf(network string) *peerPortSet {
+	if network == "udp6" {
+		return &c.peerPorts6
+	}
+	return &c.peerPorts4
+}
+
+// udpConnFor returns the socket to send to addr, an IPv4 or IPv6 address
+// of peer, from: the peer's own, with Options.PeerPorts, or else the
+// shared one of addr's family. peer is zero if unknown.
+func (c *Conn) udpConnFor(addr netip.AddrPort, peer key.NodePublic) *RebindingUDPConn {
+	network, shared := "udp4", &c.pconn4
+	if addr.Addr().Is6() {
+		network, shared = "udp6", &c.pconn6
+	}
+	if peer.IsZero() || !c.usesPeerPorts() {
+		return shared
+	}
+	if ruc := c.peerConn(network, peer); ruc != nil {
+		return ruc
+	}
+	return shared
+}
+
+// peerConn returns peer's socket of network, binding it on first use, or
+// nil if it has none.
+func (c *Conn) peerConn(network string, peer key.NodePublic) *RebindingUDPConn {
+	ps := c.peerPortSetOf(network)
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if pp, ok := ps.ports[peer]; ok {
+		if !pp.bound {
+			return nil
+		}
+		return &pp.ruc
+	}
+	if ps.closed || network == "udp4" && c.disableIPv4.Load() || network == "udp6" && c.disableIPv6.Load() {
+		return nil
+	}
+	pp := &peerPort{}
+	pp.ruc.ioBackend = c.pconn4.ioBackend
+	pp.ruc.logf = c.logf
+	mak.Set(&ps.ports, peer, pp)
+	err := c.bindPeerPortLocked(ps, pp, network, 0)
+	metric := metricRecvDataIPv4
+	if network == "udp6" {
+		metric = metricRecvDataIPv6
+	}
+	// Even unbound, the reader waits for the next rebind.
+	go c.readPeerPort(&pp.ruc, metric)
+	if err != nil {
+		c.logf("magicsock: %v for peer %v; using the shared socket", err, peer.ShortString())
+		return nil
+	}
+	return &pp.ruc
+}
+
+// bindPeerPortLocked binds pp, a socket of ps, to keep if non-zero and
+// possible, or else to a port picked per Options.PeerPorts. If none can be
+// bound, pp is left with a placeholder whose reads block until the next
+// rebind.
+//
+// ps.mu must be held.
+func (c *Conn) bindPeerPortLocked(ps *peerPortSet, pp *peerPort, network string, keep uint16) error {
+	ruc := &pp.ruc
+	ruc.mu.Lock()
+	defer ruc.mu.Unlock()
+	if ruc.pconn != nil {
+		if err := ruc.closeLocked(); err != nil && !errors.Is(err, net.ErrClosed) {
+			c.logf("magicsock: peer port %v close failed: %v", network, err)
+		}
+	}
+	pp.bound = false
+
+	used := make(set.Set[uint16])
+	used.Add(c.pconn4.Port())
+	used.Add(c.pconn6.Port())
+	for _, other := range ps.ports {
+		if other != pp && other.bound {
+			used.Add(other.port)
+		}
+	}
+	ports := c.peerPorts.candidates(keep)
+	for _, port := range ports {
+		if port != 0 && used.Contains(port) {
+			continue
+		}
+		pconn, err := c.listenPacket(network, port)
+		if err != nil {
+			continue
+		}
+		trySetSocketBuffer(pconn, c.logf)
+		ruc.setConnLocked(pconn, network, c.bind.BatchSize())
+		pp.port = ruc.port
+		pp.bound = true
+		metricPeerPortBound.Add(1)
+		return nil
+	}
+	ruc.setConnLocked(newBlockForeverConn(), "", c.bind.BatchSize())
+	metricPeerPortBindFailed.Add(1)
+	return fmt.Errorf("failed to bind a peer port for %v (tried %v)", network, ports)
+}
+
+// candidates returns the ports to try binding a peer's socket to, in
+// order: keep if non-zero, then random ones of p's range.
+func (p PeerPorts) candidates(keep uint16) []uint16 {
+	var ports []uint16
+	if keep != 0 {
+		ports = append(ports, keep)
+	}
+	if p.First == 0 {
+		return append(ports, 0)
+	}
+	n := int(p.Last-p.First) + 1
+	for range min(n, peerPortBindAttempts) {
+		ports = append(ports, p.First+uint16(rand.Intn(n)))
+	}
+	return ports
+}
+
+// rebindPeerPorts rebinds the peers' sockets of network, on their current
+// ports unless curPortFate is dropCurrentPort, or closes them if the
+// family is disabled.
+func (c *Conn) rebindPeerPorts(network string, curPortFate currentPortFate) {
+	ps := c.peerPortSetOf(network)
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	disabled := network == "udp4" && c.disableIPv4.Load() || network == "udp6" && c.disableIPv6.Load()
+	for peer, pp := range ps.ports {
+		if disabled {
+			pp.ruc.Close()
+			delete(ps.ports, peer)
+			continue
+		}
+		var keep uint16
+		if curPortFate == keepCurrentPort && pp.bound {
+			keep = pp.port
+		}
+		if err := c.bindPeerPortLocked(ps, pp, network, keep); err != nil {
+			c.logf("magicsock: %v for peer %v; using the shared socket", err, peer.ShortString())
+		}
+	}
+}
+
+// releasePeerPorts closes peer's sockets, if any, such as when it leaves
+// the netmap.
+func (c *Conn) releasePeerPorts(peer key.NodePublic) {
+	if !c.peerPorts.Enabled {
+		return
+	}
+	for _, ps := range []*peerPortSet{&c.peerPorts4, &c.peerPorts6} {
+		ps.mu.Lock()
+		if pp, ok := ps.ports[peer]; ok {
+			pp.ruc.Close()
+			delete(ps.ports, peer)
+		}
+		ps.mu.Unlock()
+	}
+}
+
+// closePeerPorts closes all the peers' sockets, for Conn.Close.
+func (c *Conn) closePeerPorts() {
+	for _, ps := range []*peerPortSet{&c.peerPorts4, &c.peerPorts6} {
+		ps.mu.Lock()
+		ps.closed = true
+		for _, pp := range ps.ports {
+			pp.ruc.Close()
+		}
+		ps.ports = nil
+		ps.mu.Unlock()
+	}
+}
+
+// readPeerPort handles the packets read from ruc, a peer's socket, until
+// it's closed, passing the WireGuard ones on to receivePeerPorts. Their
+// buffers go along, replaced by new ones from peerPortBufPool.
+func (c *Conn) readPeerPort(ruc *RebindingUDPConn, metric *clientmetric.Metric) {
+	var epCache ippEndpointCache
+	bufs := make([]*[]byte, c.bind.BatchSize())
+	msgs := make([]ipv6.Message, len(bufs))
+	for i := range msgs {
+		bufs[i] = peerPortBufPool.Get().(*[]byte)
+		msgs[i].Buffers = make([][]byte, 1)
+		msgs[i].OOB = make([]byte, controlMessageSize)
+	}
+	defer func() {
+		for _, buf := range bufs {
+			peerPortBufPool.Put(buf)
+		}
+	}()
+	for {
+		for i := range msgs {
+			msgs[i] = ipv6.Message{Buffers: msgs[i].Buffers, OOB: msgs[i].OOB[:cap(msgs[i].OOB)]}
+			msgs[i].Buffers[0] = *bufs[i]
+		}
+		numMsgs, err := ruc.ReadBatch(msgs, 0)
+		if err != nil {
+			if neterror.PacketWasTruncated(err) {
+				continue
+			}
+			return
+		}
+		for i, msg := range msgs[:numMsgs] {
+			if msg.N == 0 {
+				continue
+			}
+			b := msg.Buffers[0][:msg.N]
+			ep, ok := c.receiveIP(b, msg.Addr.(*net.UDPAddr).AddrPort(), &epCache)
+			if !ok {
+				continue
+			}
+			metric.Add(1)
+			select {
+			case c.peerPortRecvCh <- peerPortReadResult{buf: bufs[i], n: unpaddedLen(b), ep: ep}:
+				bufs[i] = peerPortBufPool.Get().(*[]byte)
+			case <-c.donec:
+				return
+			}
+		}
+	}
+}
+
+// receivePeerPorts is the ReceiveFunc of the WireGuard packets read from
+// peers' sockets, with Options.PeerPorts.
+func (c *connBind) receivePeerPorts(buffs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+	for r := range c.peerPortRecvCh {
+		if r.buf == nil {
+			if c.isClosed() {
+				break
+			}
+			continue
+		}
+		n := copy(buffs[0], (*r.buf)[:r.n])
+		peerPortBufPool.Put(r.buf)
+		if c.isClosed() {
+			break
+		}
+		sizes[0] = n
+		eps[0] = r.ep
+		return 1, nil
+	}
+	return 0, net.ErrClosed
+}
+
+var (
+	metricPeerPortBound      = clientmetric.NewCounter("magicsock_peer_port_bound")
+	metricPeerPortBindFailed = clientmetric.NewCounter("magicsock_peer_port_bind_failed")
+)
@@ -0,0 +1,326 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"tailscale.com/disco"
+	"tailscale.com/net/netns"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/nettype"
+	"tailscale.com/util/clientmetric"
+)
+
+// Port prediction lets two peers that are both behind NATs with
+// endpoint-dependent mapping ("hard" NATs), which CallMeMaybe can't
+// traverse, guess the ports their NATs map for each other. Each measures
+// how its NAT allocates ports by sending STUN requests from a burst of
+// sockets with sequential source ports, and tells the other over DERP,
+// with disco.PortPredict. Then each pings a window of the ports the
+// other's NAT should map next, while its own pings make its NAT map the
+// ports the other is pinging. See Options.PortPrediction.
+
+const (
+	// portPredictBurst is the number of sockets opened to measure how
+	// the NAT allocates ports.
+	portPredictBurst = 16
+
+	// portPredictWindow is the number of a peer's predicted ports
+	// pinged.
+	portPredictWindow = 32
+
+	// portPredictMaxStep is the largest port allocation step that's
+	// considered sequential rather than random.
+	portPredictMaxStep = 64
+
+	// portPredictInterval is the least time between port predictions
+	// with a peer.
+	portPredictInterval = time.Minute
+
+	// portPredictTimeout is how long a predicted endpoint lasts without
+	// a pong.
+	portPredictTimeout = 2 * time.Minute
+
+	// portPredictSTUNTimeout is how long each socket of the burst waits
+	// for its STUN response.
+	portPredictSTUNTimeout = time.Second
+)
+
+var errRandomNATAllocation = errors.New("NAT doesn't allocate ports sequentially")
+
+// natAllocation is how a NAT allocates ports, as measured by
+// measureNATAllocation.
+type natAllocation struct {
+	addr netip.AddrPort // public address of the most recent mapping
+	step int            // difference between consecutive mapped ports
+}
+
+// measureNATAllocation measures how the NAT in front of us allocates
+// ports, by sending a STUN request to server from each of burst sockets
+// with sequential source ports, opened with listen, in turn.
+func measureNATAllocation(ctx context.Context, listen func(port uint16) (nettype.PacketConn, error), server netip.AddrPort, burst int) (natAllocation, error) {
+	var mapped []netip.AddrPort
+	var port uint16 // zero for the first socket, then sequential
+	buf := make([]byte, 1500)
+	for tries := 0; len(mapped) < burst && tries < 2*burst; tries++ {
+		if err := ctx.Err(); err != nil {
+			return natAllocation{}, err
+		}
+		pc, err := listen(port)
+		if err != nil {
+			if port == 0 {
+				return natAllocation{}, err
+			}
+			port++ // in use; skip it
+			continue
+		}
+		port = uint16(pc.LocalAddr().(*net.UDPAddr).Port) + 1
+		ap, err := stunRoundTrip(ctx, pc, server, buf)
+		pc.Close()
+		if err != nil {
+			continue
+		}
+		mapped = append(mapped, ap)
+	}
+	if len(mapped) < 3 {
+		return natAllocation{}, fmt.Errorf("got %d of %d STUN responses", len(mapped), burst)
+	}
+	return natAllocationOf(mapped)
+}
+
+// natAllocationOf returns the natAllocation of a NAT that mapped the
+// sockets of a burst to mapped, in order. Its step is the most common
+// difference between consecutive mapped ports, if at least half have it.
+func natAllocationOf(mapped []netip.AddrPort) (natAllocation, error) {
+	steps := map[int]int{}
+	var step, count int
+	for i := 1; i < len(mapped); i++ {
+		d := int(mapped[i].Port()) - int(mapped[i-1].Port())
+		steps[d]++
+		if steps[d] > count {
+			step, count = d, steps[d]
+		}
+	}
+	if step == 0 || step > portPredictMaxStep || step < -portPredictMaxStep || count < (len(mapped)-1)/2 {
+		return natAllocation{}, errRandomNATAllocation
+	}
+	return natAllocation{addr: mapped[len(mapped)-1], step: step}, nil
+}
+
+// stunRoundTrip sends a STUN request to server from pc and returns the
+// address mapped for pc, from the response.
+func stunRoundTrip(ctx context.Context, pc nettype.PacketConn, server netip.AddrPort, buf []byte) (netip.AddrPort, error) {
+	deadline := time.Now().Add(portPredictSTUNTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	pc.SetReadDeadline(deadline)
+	txID := stun.NewTxID()
+	if _, err := pc.WriteToUDPAddrPort(stun.Request(txID), server); err != nil {
+		return netip.AddrPort{}, err
+	}
+	for {
+		n, _, err := pc.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		gotTx, ap, err := stun.ParseResponse(buf[:n])
+		if err == nil && gotTx == txID {
+			return ap, nil
+		}
+	}
+}
+
+// predictedPorts returns the n addresses a's NAT should map next.
+func predictedPorts(a natAllocation, n int) []netip.AddrPort {
+	var ret []netip.AddrPort
+	for i := 1; i <= n; i++ {
+		p := int(a.addr.Port()) + i*a.step
+		if p <= 0 || p > 65535 {
+			break
+		}
+		ret = append(ret, netip.AddrPortFrom(a.addr.Addr(), uint16(p)))
+	}
+	return ret
+}
+
+// behindHardNAT reports whether the last netcheck found that our NAT's
+// mapping varies by destination.
+func (c *Conn) behindHardNAT() bool {
+	r := c.lastNetCheckReport.Load()
+	return r != nil && r.MappingVariesByDestIP.EqualBool(true)
+}
+
+// portPredictSTUNServer returns the IPv4 STUN server of our home DERP
+// region to measure our NAT's allocation with, if any.
+func (c *Conn) portPredictSTUNServer() netip.AddrPort {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.derpMap == nil {
+		return netip.AddrPort{}
+	}
+	r, ok := c.derpMap.Regions[c.myDerp]
+	if !ok {
+		return netip.AddrPort{}
+	}
+	for _, n := range r.Nodes {
+		ip, err := netip.ParseAddr(n.IPv4)
+		if err != nil || n.STUNPort < 0 {
+			continue
+		}
+		port := n.STUNPort
+		if port == 0 {
+			port = 3478
+		}
+		return netip.AddrPortFrom(ip, uint16(port))
+	}
+	return netip.AddrPort{}
+}
+
+// measureNATAllocation measures our NAT's allocation against our home
+// DERP region's STUN server, with sockets not in any SO_REUSEPORT group.
+func (c *Conn) measureNATAllocation() (natAllocation, error) {
+	server := c.portPredictSTUNServer()
+	if !server.IsValid() {
+		return natAllocation{}, errors.New("no IPv4 STUN server in home DERP region")
+	}
+	ctx, cancel := context.WithTimeout(c.connCtx, portPredictBurst*portPredictSTUNTimeout)
+	defer cancel()
+	listen := func(port uint16) (nettype.PacketConn, error) {
+		addr := net.JoinHostPort("", fmt.Sprint(port))
+		if c.testOnlyPacketListener != nil {
+			return nettype.MakePacketListenerWithNetIP(c.testOnlyPacketListener).ListenPacket(ctx, "udp4", addr)
+		}
+		return nettype.MakePacketListenerWithNetIP(netns.Listener(c.logf, c.netMon)).ListenPacket(ctx, "udp4", addr)
+	}
+	return measureNATAllocation(ctx, listen, server, portPredictBurst)
+}
+
+// startPortPrediction starts a port prediction with de, via derpAddr, if
+// de handles it, has no direct path and none was started recently.
+func (c *Conn) startPortPrediction(de *endpoint, derpAddr netip.AddrPort) {
+	epDisco := de.disco.Load()
+	if epDisco == nil {
+		return
+	}
+	c.mu.Lock()
+	ok := c.peerHasDiscoCapLocked(epDisco.key, disco.CapPortPredict)
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	de.mu.Lock()
+	now := c.monoNow()
+	if de.bestAddr.IsValid() || !de.lastPortPredict.IsZero() && now.Sub(de.lastPortPredict) < portPredictInterval {
+		de.mu.Unlock()
+		return
+	}
+	de.lastPortPredict = now
+	txID := stun.NewTxID()
+	de.portPredictTxID = txID
+	de.mu.Unlock()
+
+	a, err := c.measureNATAllocation()
+	if err != nil {
+		metricPortPredictFailed.Add(1)
+		de.dlogPeer("disco: can't predict ports", "err", err)
+		return
+	}
+	metricPortPredictStarted.Add(1)
+	de.dlogPeer("disco: starting port prediction", "addr", a.addr, "step", a.step)
+	c.sendDiscoMessage(derpAddr, de.publicKey, epDisco.key, &disco.PortPredict{
+		TxID: txID,
+		Addr: a.addr,
+		Step: int16(a.step),
+	}, discoLog)
+}
+
+// handlePortPredict handles m, a PortPredict from de received via
+// derpAddr. If it's not a reply, it replies if we're behind a hard NAT
+// too. Then it pings the ports predicted for de.
+func (c *Conn) handlePortPredict(de *endpoint, m *disco.PortPredict, derpAddr netip.AddrPort) {
+	if !c.portPrediction {
+		return
+	}
+	if m.Step == 0 || !m.Addr.Addr().Is4() {
+		return
+	}
+	if m.Reply {
+		de.mu.Lock()
+		ok := de.portPredictTxID == m.TxID
+		de.portPredictTxID = stun.TxID{}
+		de.mu.Unlock()
+		if !ok {
+			return
+		}
+	} else {
+		epDisco := de.disco.Load()
+		if epDisco == nil || !c.behindHardNAT() {
+			// Call-me-maybe can reach us.
+			return
+		}
+		a, err := c.measureNATAllocation()
+		if err != nil {
+			metricPortPredictFailed.Add(1)
+			de.dlogPeer("disco: can't predict ports", "err", err)
+			return
+		}
+		de.mu.Lock()
+		de.lastPortPredict = c.monoNow()
+		de.mu.Unlock()
+		c.sendDiscoMessage(derpAddr, de.publicKey, epDisco.key, &disco.PortPredict{
+			TxID:  m.TxID,
+			Addr:  a.addr,
+			Step:  int16(a.step),
+			Reply: true,
+		}, discoLog)
+	}
+	de.addPredictedEndpoints(predictedPorts(natAllocation{addr: m.Addr, step: int(m.Step)}, portPredictWindow))
+}
+
+// addPredictedEndpoints adds eps, ports predicted for de, as candidate
+// endpoints and pings them.
+func (de *endpoint) addPredictedEndpoints(eps []netip.AddrPort) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	now := de.c.now()
+	for _, ep := range eps {
+		if st, ok := de.endpointState[ep]; ok {
+			if !st.predictedTime.IsZero() {
+				st.predictedTime = now
+			}
+			st.lastPing = 0
+			continue
+		}
+		de.endpointState[ep] = &endpointState{predictedTime: now}
+	}
+	metricPortPredictEndpoints.Add(int64(len(eps)))
+	de.addDebugUpdate(EndpointChange{
+		What:   "addPredictedEndpoints",
+		Reason: ChangePortPredict,
+		To:     eps,
+	})
+	de.sendDiscoPingsLocked(de.c.monoNow(), false)
+}
+
+// shouldPredictPorts reports whether to start a port prediction with a
+// peer after sending it a CallMeMaybe via dst: whether port prediction is
+// enabled, dst is a DERP address and CallMeMaybe isn't expected to open a
+// path through our NAT.
+func (c *Conn) shouldPredictPorts(dst netip.AddrPort) bool {
+	return c.portPrediction && dst.Addr() == tailcfg.DerpMagicIPAddr && c.behindHardNAT()
+}
+
+var (
+	metricPortPredictStarted   = clientmetric.NewCounter("magicsock_port_predict_started")
+	metricPortPredictFailed    = clientmetric.NewCounter("magicsock_port_predict_failed")
+	metricPortPredictEndpoints = clientmetric.NewCounter("magicsock_port_predict_endpoints")
+)
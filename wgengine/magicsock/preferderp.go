@@ -0,0 +1,87 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"log/slog"
+	"time"
+
+	"tailscale.com/tstime/mono"
+	"tailscale.com/util/clientmetric"
+)
+
+const (
+	// derpRTTInterval is how often the round-trip time to a peer via
+	// DERP is measured, with Options.PreferFasterDERP, while it has a
+	// direct path.
+	derpRTTInterval = 30 * time.Second
+
+	// derpRTTTrust is how long a measured DERP round-trip time is used
+	// to prefer DERP. It outlasts a lost ping or two.
+	derpRTTTrust = 3 * derpRTTInterval
+
+	// preferDERPMinGain and preferDERPMinGainFrac are how much faster,
+	// at least, DERP must be than the direct path to be preferred: by
+	// the larger of the duration or the fraction of the DERP round-trip
+	// time. Going back to the direct path takes half as much, so that
+	// paths with similar latencies don't flap.
+	preferDERPMinGain     = 10 * time.Millisecond
+	preferDERPMinGainFrac = 0.2
+)
+
+// SetPreferFasterDERP sets whether peers with a direct path are sent to
+// via DERP instead when it's measured to be meaningfully faster, as with
+// Options.PreferFasterDERP.
+func (c *Conn) SetPreferFasterDERP(v bool) {
+	c.preferFasterDERP.Store(v)
+}
+
+// updatePreferDERPLocked reports whether de should be sent to via DERP
+// rather than its best address, which is trusted if direct is set, and
+// logs and counts the changes. DERP is preferred when its last measured
+// round-trip time is meaningfully lower than the best address's.
+//
+// de.mu must be held.
+func (de *endpoint) updatePreferDERPLocked(now mono.Time, direct bool) bool {
+	want := direct && de.c.preferFasterDERP.Load() && de.derpAddr.IsValid() &&
+		!de.bestAddrLearned && de.bestAddr.latency > 0 &&
+		de.derpLatency > 0 && !de.derpLatencyAt.IsZero() && now.Sub(de.derpLatencyAt) < derpRTTTrust
+	if want {
+		need := max(preferDERPMinGain, time.Duration(float64(de.derpLatency)*preferDERPMinGainFrac))
+		if de.preferDERP {
+			need /= 2
+		}
+		want = de.bestAddr.latency-de.derpLatency > need
+	}
+	if want == de.preferDERP {
+		return want
+	}
+	de.preferDERP = want
+	if want {
+		metricPreferDERPFaster.Add(1)
+		de.logPeer(slog.LevelInfo, "disco: preferring faster DERP", LogKeyPath, de.bestAddr.AddrPort, "latency", de.bestAddr.latency.Round(time.Millisecond), "derp-latency", de.derpLatency.Round(time.Millisecond))
+	} else {
+		de.logPeer(slog.LevelInfo, "disco: stopped preferring DERP", LogKeyPath, de.bestAddr.AddrPort)
+	}
+	return want
+}
+
+// pingDERPRTTLocked measures the round-trip time to de via DERP, for
+// updatePreferDERPLocked, if it's due.
+//
+// de.mu must be held.
+func (de *endpoint) pingDERPRTTLocked(now mono.Time) {
+	if !de.c.preferFasterDERP.Load() || !de.derpAddr.IsValid() || !de.bestAddr.IsValid() {
+		return
+	}
+	if !de.lastDERPRTTPing.IsZero() && now.Sub(de.lastDERPRTTPing) < derpRTTInterval {
+		return
+	}
+	de.lastDERPRTTPing = now
+	de.startDiscoPingLocked(de.derpAddr, now, pingDERPRTT)
+}
+
+// metricPreferDERPFaster counts the peers switched from their direct path
+// to DERP because it was faster.
+var metricPreferDERPFaster = clientmetric.NewCounter("magicsock_prefer_derp_faster")
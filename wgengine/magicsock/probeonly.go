@@ -0,0 +1,72 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"time"
+
+	"tailscale.com/util/clientmetric"
+)
+
+// probeOnlyInterval is how often a probe-only peer is probed.
+const probeOnlyInterval = 10 * time.Second
+
+// setProbeOnlyLocked sets whether de is a probe-only peer, per
+// tailcfg.Node.ProbeOnly, starting or stopping its probes.
+//
+// A probe-only peer isn't configured in WireGuard, so nothing is ever sent
+// to it and the heartbeat, which only runs while there's traffic, never
+// starts. Instead, de's paths are discovered and measured by a probe every
+// probeOnlyInterval, whose pongs feed bestAddr and de.quality as usual.
+//
+// de.mu must be held.
+func (de *endpoint) setProbeOnlyLocked(probeOnly bool) {
+	if de.probeOnly == probeOnly {
+		return
+	}
+	de.probeOnly = probeOnly
+	if !probeOnly {
+		de.stopProbeLocked()
+		return
+	}
+	de.dlogPeer("disco: starting probes of probe-only peer")
+	de.probeTimer = de.c.afterFunc(0, de.probe)
+}
+
+// stopProbeLocked stops the probes of a probe-only peer, if running.
+//
+// de.mu must be held.
+func (de *endpoint) stopProbeLocked() {
+	if de.probeTimer != nil {
+		de.probeTimer.Stop()
+		de.probeTimer = nil
+	}
+}
+
+// probe pings a probe-only peer's candidate paths, sending it a
+// CallMeMaybe so it pings back through its NAT, and pings its current path,
+// or DERP if it has no direct one, to measure the path's latency.
+func (de *endpoint) probe() {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	de.probeTimer = nil
+	if !de.probeOnly || de.expired {
+		return
+	}
+
+	now := de.c.monoNow()
+	if de.bestAddr.IsValid() {
+		de.startDiscoPingLocked(de.bestAddr.AddrPort, now, pingProbe)
+	} else if de.derpAddr.IsValid() {
+		de.startDiscoPingLocked(de.derpAddr, now, pingProbe)
+	}
+	de.sendDiscoPingsLocked(now, true)
+	metricProbeOnlyProbes.Add(1)
+
+	de.probeTimer = de.c.afterFunc(probeOnlyInterval, de.probe)
+}
+
+// metricProbeOnlyProbes counts the probes of probe-only peers.
+var metricProbeOnlyProbes = clientmetric.NewCounter("magicsock_probe_only_probes")
@@ -0,0 +1,205 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"go4.org/mem"
+	"golang.org/x/exp/slices"
+	"tailscale.com/disco"
+	"tailscale.com/net/stun"
+	"tailscale.com/types/key"
+	"tailscale.com/types/nettype"
+	"tailscale.com/util/clientmetric"
+)
+
+// punchInterval is how often PunchUDP resends its pings.
+const punchInterval = 200 * time.Millisecond
+
+// PunchUDP opens a direct UDP path, outside WireGuard, between localPort
+// on this node and the same port on the peer with node key peerKey, so
+// an embedder can run a flow of its own, such as a media stream, over
+// magicsock's NAT traversal. The peer must call PunchUDP for this node
+// with the same port meanwhile.
+//
+// It binds localPort and, until ctx is done, sends disco pings from it
+// to localPort at each of the peer's known IP addresses, answering the
+// peer's pings with pongs. Like magicsock's own traversal, that opens
+// the NAT bindings on both sides as long as at least one side's NAT maps
+// localPort to the same public port for every destination. It returns
+// the address the first authenticated ping or pong from the peer came
+// from. PunchUDP closes its sockets before it returns, so the embedder
+// can bind localPort itself and send to that address while the bindings
+// last, which is typically 30 seconds or more without traffic.
+func (c *Conn) PunchUDP(ctx context.Context, peerKey key.NodePublic, localPort uint16) (netip.AddrPort, error) {
+	if localPort == 0 {
+		return netip.AddrPort{}, errors.New("PunchUDP: zero port")
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return netip.AddrPort{}, errConnClosed
+	}
+	de, ok := c.peerMap.endpointForNodeKey(peerKey)
+	if !ok {
+		c.mu.Unlock()
+		return netip.AddrPort{}, fmt.Errorf("PunchUDP: unknown peer %v", peerKey.ShortString())
+	}
+	dk := de.disco.Load()
+	if dk == nil {
+		c.mu.Unlock()
+		return netip.AddrPort{}, fmt.Errorf("PunchUDP: peer %v has no disco key", peerKey.ShortString())
+	}
+	p := &punch{
+		c:         c,
+		peerDisco: dk.key,
+		shared:    c.discoInfoLocked(dk.key).sharedKey,
+		txid:      stun.NewTxID(),
+		got:       make(chan netip.AddrPort, 2),
+	}
+	c.mu.Unlock()
+
+	ips := de.punchIPs()
+	if len(ips) == 0 {
+		return netip.AddrPort{}, fmt.Errorf("PunchUDP: no known addresses for peer %v", peerKey.ShortString())
+	}
+
+	type punchSocket struct {
+		pc   nettype.PacketConn
+		dsts []netip.AddrPort
+	}
+	var socks []punchSocket
+	var bindErr error
+	for _, network := range []string{"udp4", "udp6"} {
+		var dsts []netip.AddrPort
+		for _, ip := range ips {
+			if ip.Is4() == (network == "udp4") {
+				dsts = append(dsts, netip.AddrPortFrom(ip, localPort))
+			}
+		}
+		if len(dsts) == 0 {
+			continue
+		}
+		pc, err := c.listenPacket(network, localPort)
+		if err != nil {
+			bindErr = err
+			continue
+		}
+		defer pc.Close()
+		socks = append(socks, punchSocket{pc, dsts})
+		go p.read(pc)
+	}
+	if len(socks) == 0 {
+		return netip.AddrPort{}, fmt.Errorf("PunchUDP: %w", bindErr)
+	}
+
+	ping := p.seal(&disco.Ping{TxID: [12]byte(p.txid), NodeKey: c.publicKeyAtomic.Load()})
+	t := time.NewTicker(punchInterval)
+	defer t.Stop()
+	for {
+		for _, s := range socks {
+			for _, dst := range s.dsts {
+				s.pc.WriteToUDPAddrPort(ping, dst)
+				metricPunchPingSent.Add(1)
+			}
+		}
+		select {
+		case ap := <-p.got:
+			metricPunchSuccess.Add(1)
+			return ap, nil
+		case <-ctx.Done():
+			return netip.AddrPort{}, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// punchIPs returns the IP addresses of de's known UDP endpoints.
+func (de *endpoint) punchIPs() []netip.Addr {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	var ips []netip.Addr
+	add := func(ip netip.Addr) {
+		ip = ip.Unmap()
+		if ip.IsValid() && !slices.Contains(ips, ip) {
+			ips = append(ips, ip)
+		}
+	}
+	if de.bestAddr.AddrPort.IsValid() {
+		add(de.bestAddr.Addr())
+	}
+	for ep := range de.endpointState {
+		add(ep.Addr())
+	}
+	return ips
+}
+
+// punch is the state of a PunchUDP call.
+type punch struct {
+	c         *Conn
+	peerDisco key.DiscoPublic
+	shared    key.DiscoShared
+	txid      stun.TxID
+	got       chan netip.AddrPort // sources of the peer's messages
+}
+
+// seal returns the disco packet of m for the peer.
+func (p *punch) seal(m disco.Message) []byte {
+	pkt := append([]byte(disco.Magic), p.c.discoPublic.AppendTo(nil)...)
+	return append(pkt, p.shared.Seal(m.AppendMarshal(nil))...)
+}
+
+// read handles the peer's disco messages arriving on pc until it's
+// closed, answering pings and sending the source of each ping or pong
+// for this punch to p.got.
+func (p *punch) read(pc nettype.PacketConn) {
+	const headerLen = len(disco.Magic) + key.DiscoPublicRawLen
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := pc.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		msg := buf[:n]
+		if len(msg) < headerLen || string(msg[:len(disco.Magic)]) != disco.Magic {
+			continue
+		}
+		if key.DiscoPublicFromRaw32(mem.B(msg[len(disco.Magic):headerLen])) != p.peerDisco {
+			continue
+		}
+		payload, ok := p.shared.Open(msg[headerLen:])
+		if !ok {
+			continue
+		}
+		dm, err := disco.Parse(payload)
+		if err != nil {
+			continue
+		}
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		switch m := dm.(type) {
+		case *disco.Ping:
+			pc.WriteToUDPAddrPort(p.seal(&disco.Pong{TxID: m.TxID, Src: src}), src)
+		case *disco.Pong:
+			if m.TxID != [12]byte(p.txid) {
+				continue
+			}
+		default:
+			continue
+		}
+		select {
+		case p.got <- src:
+		default:
+		}
+	}
+}
+
+var (
+	metricPunchPingSent = clientmetric.NewCounter("magicsock_punch_ping_sent")
+	metricPunchSuccess  = clientmetric.NewCounter("magicsock_punch_success")
+)
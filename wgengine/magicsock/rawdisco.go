@@ -0,0 +1,70 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"tailscale.com/util/clientmetric"
+)
+
+// SetRawDiscoEnabled starts or stops the raw socket disco receivers, for
+// environments such as some containers where raw sockets only half work,
+// so that disco packets read with them are mangled or missed. Disco
+// packets are still received on the UDP sockets while they're stopped.
+// It does nothing on platforms without them.
+func (c *Conn) SetRawDiscoEnabled(v bool) {
+	c.rawDiscoMu.Lock()
+	defer c.rawDiscoMu.Unlock()
+	c.rawDiscoDisabled = !v
+	if !v {
+		c.stopRawDiscoLocked()
+		return
+	}
+	if c.closing.Load() {
+		return
+	}
+	c.startRawDiscoLocked()
+}
+
+// startRawDiscoLocked starts the raw disco receivers that aren't running.
+//
+// c.rawDiscoMu must be held.
+func (c *Conn) startRawDiscoLocked() {
+	if c.closeDisco4 == nil {
+		if d4, err := c.listenRawDisco("ip4"); err == nil {
+			c.logf("[v1] using BPF disco receiver for IPv4")
+			c.closeDisco4 = d4
+		} else {
+			c.logf("[v1] couldn't create raw v4 disco listener, using regular listener instead: %v", err)
+		}
+	}
+	if c.closeDisco6 == nil {
+		if d6, err := c.listenRawDisco("ip6"); err == nil {
+			c.logf("[v1] using BPF disco receiver for IPv6")
+			c.closeDisco6 = d6
+		} else {
+			c.logf("[v1] couldn't create raw v6 disco listener, using regular listener instead: %v", err)
+		}
+	}
+}
+
+// stopRawDiscoLocked stops the raw disco receivers that are running.
+//
+// c.rawDiscoMu must be held.
+func (c *Conn) stopRawDiscoLocked() {
+	if c.closeDisco4 != nil {
+		c.closeDisco4.Close()
+		c.closeDisco4 = nil
+	}
+	if c.closeDisco6 != nil {
+		c.closeDisco6.Close()
+		c.closeDisco6 = nil
+	}
+}
+
+var (
+	// metricRecvDiscoViaRaw and metricRecvDiscoViaSocket count the disco
+	// messages handled from the raw disco receivers and the UDP sockets.
+	metricRecvDiscoViaRaw    = clientmetric.NewCounter("magicsock_disco_recv_via_raw")
+	metricRecvDiscoViaSocket = clientmetric.NewCounter("magicsock_disco_recv_via_socket")
+)
@@ -12,6 +12,7 @@
 
 	"golang.org/x/net/ipv6"
 	"tailscale.com/net/netaddr"
+	"tailscale.com/types/logger"
 	"tailscale.com/types/nettype"
 )
 
@@ -30,6 +31,12 @@ type RebindingUDPConn struct {
 	mu    sync.Mutex // held while changing pconn (and pconnAtomic)
 	pconn nettype.PacketConn
 	port  uint16
+
+	// ioBackend is the UDPIOBackend of the sockets set, and logf where
+	// falling back from it is logged. They're set by the Conn before
+	// binding.
+	ioBackend UDPIOBackend
+	logf      logger.Logf
 }
 
 // setConnLocked sets the provided nettype.PacketConn. It should be called only
@@ -39,7 +46,7 @@ type RebindingUDPConn struct {
 // avoid disrupting surrounding code that assumes nettype.PacketConn is a
 // *net.UDPConn.
 func (c *RebindingUDPConn) setConnLocked(p nettype.PacketConn, network string, batchSize int) {
-	upc := tryUpgradeToBatchingUDPConn(p, network, batchSize)
+	upc := tryUpgradeToBatchingUDPConn(p, network, batchSize, c.ioBackend, c.logf)
 	c.pconn = upc
 	c.pconnAtomic.Store(&upc)
 	c.port = uint16(c.localAddrLocked().Port)
@@ -52,6 +59,18 @@ func (c *RebindingUDPConn) currentConn() nettype.PacketConn {
 	return c.pconn
 }
 
+// isBound reports whether c has a socket bound, rather than none or the
+// placeholder of a failed bind.
+func (c *RebindingUDPConn) isBound() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pconn == nil {
+		return false
+	}
+	_, unbound := c.pconn.(*blockForeverConn)
+	return !unbound
+}
+
 func (c *RebindingUDPConn) readFromWithInitPconn(pconn nettype.PacketConn, b []byte) (int, netip.AddrPort, error) {
 	for {
 		n, addr, err := pconn.ReadFromUDPAddrPort(b)
@@ -69,8 +88,11 @@ func (c *RebindingUDPConn) ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, e
 	return c.readFromWithInitPconn(*c.pconnAtomic.Load(), b)
 }
 
-// WriteBatchTo writes buffs to addr.
-func (c *RebindingUDPConn) WriteBatchTo(buffs [][]byte, addr netip.AddrPort) error {
+// WriteBatchTo writes buffs to addr. maxSegments caps the number of
+// datagrams coalesced into a single send where the platform supports it;
+// zero means no cap beyond the platform maximum, and one disables
+// coalescing.
+func (c *RebindingUDPConn) WriteBatchTo(buffs [][]byte, addr netip.AddrPort, maxSegments int) error {
 	for {
 		pconn := *c.pconnAtomic.Load()
 		b, ok := pconn.(*batchingUDPConn)
@@ -83,7 +105,7 @@ func (c *RebindingUDPConn) WriteBatchTo(buffs [][]byte, addr netip.AddrPort) err
 			}
 			return nil
 		}
-		err := b.WriteBatchTo(buffs, addr)
+		err := b.WriteBatchTo(buffs, addr, maxSegments)
 		if err != nil {
 			if pconn != c.currentConn() {
 				continue
@@ -0,0 +1,211 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/net/netcheck"
+	"tailscale.com/net/stun"
+)
+
+// RefreshScope is how much of the probing of a full endpoint update a
+// RefreshEndpoints call does.
+type RefreshScope int
+
+const (
+	// RefreshFull runs a netcheck of every DERP region, which also
+	// updates the NetInfo and may move the home DERP region, and
+	// refreshes the port mapping.
+	RefreshFull RefreshScope = iota
+	// RefreshHomeDERP only sends STUN requests to the home DERP
+	// region's nodes with addresses in the DERP map, to learn the
+	// current public addresses, and refreshes the port mapping.
+	RefreshHomeDERP
+	// RefreshPortmap only refreshes the port mapping, keeping the
+	// public addresses found by the last netcheck.
+	RefreshPortmap
+)
+
+var refreshScopeNames = [...]string{
+	RefreshFull:     "full",
+	RefreshHomeDERP: "home-derp",
+	RefreshPortmap:  "portmap",
+}
+
+func (s RefreshScope) String() string {
+	if s < 0 || int(s) >= len(refreshScopeNames) {
+		return fmt.Sprintf("RefreshScope(%d)", int(s))
+	}
+	return refreshScopeNames[s]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s RefreshScope) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *RefreshScope) UnmarshalText(b []byte) error {
+	for i, name := range refreshScopeNames {
+		if string(b) == name {
+			*s = RefreshScope(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown RefreshScope %q", b)
+}
+
+// homeSTUNTimeout is how long a RefreshHomeDERP update waits for STUN
+// responses from the home region.
+const homeSTUNTimeout = time.Second
+
+// RefreshEndpoints starts an update of the Conn's endpoints, probing as
+// much as scope says, for the reason why. If an update is already
+// running, another is done when it finishes, with the broadest scope
+// requested meanwhile.
+func (c *Conn) RefreshEndpoints(scope RefreshScope, why string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		// raced with a shutdown.
+		return
+	}
+	metricReSTUNCalls.Add(1)
+
+	// If the user stopped the app, stop doing work. (When the
+	// user stops Tailscale via the GUI apps, ipn/local.go
+	// reconfigures the engine with a zero private key.)
+	//
+	// This used to just check c.privateKey.IsZero, but that broke
+	// some end-to-end tests that didn't ever set a private
+	// key somehow. So for now, only stop doing work if we ever
+	// had a key, which helps real users, but appeases tests for
+	// now. TODO: rewrite those tests to be less brittle or more
+	// realistic.
+	if c.privateKey.IsZero() && c.everHadKey {
+		c.logf("magicsock: RefreshEndpoints(%v, %q) ignored; stopped, no private key", scope, why)
+		return
+	}
+
+	if c.endpointsUpdateActive {
+		if c.wantEndpointsUpdate != why {
+			c.dlogf("[v1] magicsock: RefreshEndpoints: endpoint update active, need another later (%v, %q)", scope, why)
+		}
+		c.queueEndpointsUpdateLocked(scope, why)
+	} else {
+		c.endpointsUpdateActive = true
+		go c.updateEndpoints(scope, why)
+	}
+}
+
+// queueEndpointsUpdateLocked records that an endpoints update of scope is
+// wanted once the running one finishes, widening the scope of one
+// already wanted. c.mu must be held.
+func (c *Conn) queueEndpointsUpdateLocked(scope RefreshScope, why string) {
+	if c.wantEndpointsUpdate == "" || scope < c.wantEndpointsScope {
+		c.wantEndpointsScope = scope
+	}
+	c.wantEndpointsUpdate = why
+}
+
+// refreshNetInfo returns the netcheck report for an endpoints update of
+// scope, RefreshHomeDERP or RefreshPortmap: the last full report, with
+// the public addresses from the home region's STUN responses for
+// RefreshHomeDERP. Without a last report, it runs a full netcheck.
+func (c *Conn) refreshNetInfo(ctx context.Context, scope RefreshScope) (*netcheck.Report, error) {
+	last := c.lastNetCheckReport.Load()
+	if last == nil {
+		return c.updateNetInfo(ctx)
+	}
+	report := last.Clone()
+	if scope == RefreshHomeDERP && !c.networkDown() {
+		v4, v6 := c.stunHomeDERP(ctx)
+		if v4.IsValid() {
+			report.IPv4, report.UDP = true, true
+			report.GlobalV4 = v4.String()
+		}
+		if v6.IsValid() {
+			report.IPv6, report.UDP = true, true
+			report.GlobalV6 = v6.String()
+		}
+		c.lastNetCheckReport.Store(report)
+	}
+	return report, nil
+}
+
+// stunHomeDERP sends a STUN request from each of c's sockets to each
+// node of the home DERP region, and returns the public addresses of the
+// first responses, for each address family.
+func (c *Conn) stunHomeDERP(ctx context.Context) (v4, v6 netip.AddrPort) {
+	c.mu.Lock()
+	dm, home := c.derpMap, c.myDerp
+	c.mu.Unlock()
+	if dm == nil || dm.Regions[home] == nil {
+		return
+	}
+
+	var mu sync.Mutex
+	txs := map[stun.TxID]bool{}
+	got := make(chan netip.AddrPort, 2*len(dm.Regions[home].Nodes))
+	c.stunReceiveFunc.Store(func(p []byte, _ netip.AddrPort) {
+		tx, ap, err := stun.ParseResponse(p)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		ok := txs[tx]
+		delete(txs, tx)
+		mu.Unlock()
+		if ok {
+			got <- ap
+		}
+	})
+	defer c.ignoreSTUNPackets()
+
+	var sent4, sent6 bool
+	send := func(ruc *RebindingUDPConn, ip netip.Addr, port uint16) bool {
+		tx := stun.NewTxID()
+		mu.Lock()
+		txs[tx] = true
+		mu.Unlock()
+		_, err := ruc.WriteToUDPAddrPort(stun.Request(tx), netip.AddrPortFrom(ip, port))
+		return err == nil
+	}
+	for _, n := range dm.Regions[home].Nodes {
+		if n.STUNPort < 0 {
+			continue
+		}
+		port := uint16(3478)
+		if n.STUNPort != 0 {
+			port = uint16(n.STUNPort)
+		}
+		if ip, err := netip.ParseAddr(n.IPv4); err == nil && ip.Is4() && !c.disableIPv4.Load() {
+			sent4 = send(&c.pconn4, ip, port) || sent4
+		}
+		if ip, err := netip.ParseAddr(n.IPv6); err == nil && ip.Is6() && !c.disableIPv6.Load() {
+			sent6 = send(&c.pconn6, ip, port) || sent6
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, homeSTUNTimeout)
+	defer cancel()
+	for (sent4 && !v4.IsValid()) || (sent6 && !v6.IsValid()) {
+		select {
+		case ap := <-got:
+			if ap.Addr().Is4() && !v4.IsValid() {
+				v4 = ap
+			} else if ap.Addr().Is6() && !v6.IsValid() {
+				v6 = ap
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,81 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"tailscale.com/types/nettype"
+)
+
+// ReusePort configures a Conn's UDP sockets to share their port with
+// other processes, such as an old and a new version of an agent running
+// side by side during an upgrade. It's only supported on Linux.
+type ReusePort struct {
+	// Enabled sets SO_REUSEPORT on the Conn's UDP sockets before
+	// they're bound, so they join the group of sockets bound to the
+	// same port by processes of the same user, or start one. The kernel
+	// spreads the packets arriving on the port over the group's sockets
+	// by flow hash, unless a BPF program selects the socket.
+	Enabled bool
+
+	// BPFProgFD, if positive, is the file descriptor of a loaded
+	// BPF_PROG_TYPE_SK_REUSEPORT program to attach to the group once the
+	// Conn's sockets are bound, replacing any program attached by
+	// another member. See also Conn.AttachReusePortBPF.
+	BPFProgFD int
+}
+
+var errReusePortNotEnabled = errors.New("magicsock: ReusePort not enabled")
+
+// AttachReusePortBPF attaches the loaded BPF_PROG_TYPE_SK_REUSEPORT
+// program progFD to the SO_REUSEPORT groups of c's bound UDP sockets,
+// replacing any program attached by another member, and to those of the
+// sockets c binds later. The program then selects which member receives
+// each packet, such as to move traffic from an old process to a new one.
+// It requires Options.ReusePort.Enabled.
+func (c *Conn) AttachReusePortBPF(progFD int) error {
+	if !c.reusePort.Enabled {
+		return errReusePortNotEnabled
+	}
+	c.reusePortBPF.Store(progFD)
+	var errs []error
+	for _, ruc := range []*RebindingUDPConn{&c.pconn4, &c.pconn6} {
+		if !ruc.isBound() {
+			continue
+		}
+		if err := attachReusePortBPF(ruc.currentConn(), progFD); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// withReusePort returns a copy of lc that sets SO_REUSEPORT on its
+// sockets.
+func withReusePort(lc *net.ListenConfig) *net.ListenConfig {
+	lc2 := *lc
+	control := lc.Control
+	lc2.Control = func(network, address string, rc syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, rc); err != nil {
+				return err
+			}
+		}
+		return setReusePort(rc)
+	}
+	return &lc2
+}
+
+// rawSyscallConn returns the syscall.Conn of the socket underlying pconn,
+// if it has one.
+func rawSyscallConn(pconn nettype.PacketConn) (syscall.Conn, bool) {
+	if b, ok := pconn.(*batchingUDPConn); ok {
+		pconn = b.pc
+	}
+	sc, ok := pconn.(syscall.Conn)
+	return sc, ok
+}
@@ -0,0 +1,23 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package magicsock
+
+import (
+	"errors"
+	"syscall"
+
+	"tailscale.com/types/nettype"
+)
+
+var errReusePortUnsupported = errors.New("magicsock: ReusePort only supported on Linux")
+
+func setReusePort(rc syscall.RawConn) error {
+	return errReusePortUnsupported
+}
+
+func attachReusePortBPF(pconn nettype.PacketConn, progFD int) error {
+	return errReusePortUnsupported
+}
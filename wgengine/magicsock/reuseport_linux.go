@@ -0,0 +1,46 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"tailscale.com/types/nettype"
+)
+
+func setReusePort(rc syscall.RawConn) error {
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("setting SO_REUSEPORT: %w", serr)
+	}
+	return nil
+}
+
+func attachReusePortBPF(pconn nettype.PacketConn, progFD int) error {
+	sc, ok := rawSyscallConn(pconn)
+	if !ok {
+		return fmt.Errorf("magicsock: can't attach reuseport BPF program to %T", pconn)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ATTACH_REUSEPORT_EBPF, progFD)
+	}); err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("magicsock: attaching reuseport BPF program: %w", serr)
+	}
+	return nil
+}
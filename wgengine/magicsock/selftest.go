@@ -0,0 +1,196 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/disco"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/net/portmapper"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/util/mak"
+)
+
+// TraversalReport is the result of Conn.SelfTest.
+type TraversalReport struct {
+	// NetCheck is the report of the STUN and DERP probes: whether UDP
+	// works, the public addresses, whether the NAT's mappings vary by
+	// destination, whether it supports hairpinning, which port mapping
+	// services are present, and the latency to each DERP region.
+	NetCheck *netcheck.Report
+
+	// Endpoints are the endpoints the Conn advertises to peers.
+	Endpoints []tailcfg.Endpoint
+
+	// PortMap is the NAT port mapping held by the Conn, if HavePortMap.
+	PortMap     portmapper.MappingStatus
+	HavePortMap bool
+
+	// DERP is the result of connecting to each DERP region, keyed by
+	// region ID.
+	DERP map[int]DERPRegionReport
+
+	// LoopbackDisco maps each of the Conn's endpoints to the time a
+	// disco ping sent there by the Conn to itself took to arrive. Pings
+	// to public endpoints also exercise NAT hairpinning. Endpoints the
+	// ping didn't arrive at are absent.
+	LoopbackDisco map[netip.AddrPort]time.Duration
+}
+
+// DERPRegionReport is the result of connecting to a DERP region in
+// Conn.SelfTest.
+type DERPRegionReport struct {
+	// ConnectTime is how long connecting took, if Error is empty.
+	ConnectTime time.Duration
+	Error       string `json:",omitempty"`
+}
+
+// selfTestTimeout bounds each step of SelfTest that ctx doesn't.
+const selfTestTimeout = 5 * time.Second
+
+// SelfTest exercises c's means of reaching peers and reports how each
+// fared, for diagnosing peers stuck on DERP. It updates c's endpoints,
+// which runs a netcheck and tries for a port mapping, then connects to
+// every DERP region and sends a disco ping to each of c's endpoints from
+// c itself. If c is stopped (it has no private key), the results of its
+// last endpoint update are reported instead.
+//
+// Failures of individual steps are recorded in the report. It only
+// returns an error if c is closed.
+func (c *Conn) SelfTest(ctx context.Context) (*TraversalReport, error) {
+	rep := new(TraversalReport)
+
+	// Run the netcheck as an endpoint update, as only one may run at a
+	// time, and wait for it and any update already running.
+	c.RefreshEndpoints(RefreshFull, "self-test")
+	c.mu.Lock()
+	for c.endpointsUpdateActive && !c.closed {
+		c.muCond.Wait()
+	}
+	closed := c.closed
+	dm := c.derpMap
+	rep.Endpoints = append(rep.Endpoints, c.lastEndpoints...)
+	c.mu.Unlock()
+	if closed {
+		return nil, errConnClosed
+	}
+	rep.NetCheck = c.lastNetCheckReport.Load()
+	rep.PortMap, rep.HavePortMap = c.portMapper.Mapping()
+
+	if dm != nil {
+		rep.DERP = c.selfTestDERP(ctx, dm)
+	}
+	rep.LoopbackDisco = c.selfTestDisco(ctx, rep.Endpoints)
+	return rep, nil
+}
+
+// selfTestDERP connects to each region of dm in parallel, with a new
+// node key so as not to displace c's own DERP connections.
+func (c *Conn) selfTestDERP(ctx context.Context, dm *tailcfg.DERPMap) map[int]DERPRegionReport {
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		res = make(map[int]DERPRegionReport)
+	)
+	privKey := key.NewNode()
+	for _, reg := range dm.Regions {
+		if reg == nil || reg.Avoid {
+			continue
+		}
+		reg := reg
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dc := derphttp.NewRegionClient(privKey, c.logf, c.netMon, func() *tailcfg.DERPRegion {
+				return reg
+			})
+			defer dc.Close()
+			c.configureDERPClient(dc)
+
+			var rr DERPRegionReport
+			start := c.now()
+			if err := dc.Connect(ctx); err != nil {
+				rr.Error = err.Error()
+			} else {
+				rr.ConnectTime = c.now().Sub(start)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			res[reg.RegionID] = rr
+		}()
+	}
+	wg.Wait()
+	return res
+}
+
+// selfTestDisco sends a disco ping from c to itself at each of eps, and
+// returns how long each took to arrive.
+func (c *Conn) selfTestDisco(ctx context.Context, eps []tailcfg.Endpoint) map[netip.AddrPort]time.Duration {
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	type pending struct {
+		txid stun.TxID
+		addr netip.AddrPort
+		sent time.Time
+		got  chan struct{}
+	}
+	var pings []pending
+	c.mu.Lock()
+	for _, ep := range eps {
+		p := pending{txid: stun.NewTxID(), addr: ep.Addr, got: make(chan struct{})}
+		mak.Set(&c.selfTestPings, p.txid, p.got)
+		pings = append(pings, p)
+	}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, p := range pings {
+			delete(c.selfTestPings, p.txid)
+		}
+		if len(c.selfTestPings) == 0 && !c.peerMap.anyEndpointForDiscoKey(c.discoPublic) {
+			delete(c.discoInfo, c.discoPublic)
+		}
+	}()
+
+	for i := range pings {
+		p := &pings[i]
+		p.sent = c.now()
+		c.sendDiscoMessage(p.addr, key.NodePublic{}, c.discoPublic, &disco.Ping{
+			TxID:    p.txid,
+			NodeKey: c.publicKeyAtomic.Load(),
+		}, discoVerboseLog)
+	}
+
+	var res map[netip.AddrPort]time.Duration
+	for _, p := range pings {
+		select {
+		case <-p.got:
+			mak.Set(&res, p.addr, c.now().Sub(p.sent))
+		case <-ctx.Done():
+			return res
+		}
+	}
+	return res
+}
+
+// noteSelfTestPingLocked records the receipt of a disco ping sent by
+// SelfTest. c.mu must be held.
+func (c *Conn) noteSelfTestPingLocked(txid stun.TxID) {
+	if ch, ok := c.selfTestPings[txid]; ok {
+		close(ch)
+		delete(c.selfTestPings, txid)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"tailscale.com/envknob"
+)
+
+// UDPIOBackend selects the implementation of a Conn's batched UDP socket
+// I/O on Linux. Other platforms always use the default.
+//
+// Backends other than the default are experimental. A Conn falls back to
+// the default if its backend can't be used, such as on kernels without
+// io_uring or where seccomp filters block it.
+type UDPIOBackend string
+
+const (
+	// UDPIODefault uses recvmmsg and sendmmsg.
+	UDPIODefault UDPIOBackend = ""
+
+	// UDPIOURing uses io_uring to submit a batch's recvmsg and sendmsg
+	// calls at once, with one system call.
+	UDPIOURing UDPIOBackend = "io_uring"
+
+	// UDPIOXDP would use AF_XDP sockets. It's not supported yet, as it
+	// needs an XDP program attached to the interface, and always falls
+	// back to the default.
+	UDPIOXDP UDPIOBackend = "af_xdp"
+)
+
+// debugUDPIOBackend, if set, overrides Options.UDPIOBackend.
+var debugUDPIOBackend = envknob.RegisterString("TS_DEBUG_UDP_IO_BACKEND")
+
+// udpIOBackend returns the UDPIOBackend to use, given the one from
+// Options.
+func udpIOBackend(opt UDPIOBackend) UDPIOBackend {
+	if v := debugUDPIOBackend(); v != "" {
+		if v == "default" {
+			return UDPIODefault
+		}
+		return UDPIOBackend(v)
+	}
+	return opt
+}
@@ -0,0 +1,73 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"tailscale.com/net/art"
+)
+
+// DialRoute selects the dialer used for the TCP flows that netstack
+// forwards to destinations in Prefix. See Config.DialRoutes.
+type DialRoute struct {
+	Prefix netip.Prefix
+
+	// UserDial is whether flows are dialed with tsdial.Dialer.UserDial,
+	// which respects the netns and Tailscale's routes, rather than the
+	// system dialer.
+	UserDial bool
+}
+
+// dialRouteTable is a longest-prefix-match table of DialRoutes. It's
+// immutable once built.
+type dialRouteTable struct {
+	t art.Table[bool]
+}
+
+func newDialRouteTable(routes []DialRoute) (*dialRouteTable, error) {
+	rt := new(dialRouteTable)
+	for _, r := range routes {
+		if !r.Prefix.IsValid() {
+			return nil, fmt.Errorf("invalid dial route prefix %v", r.Prefix)
+		}
+		userDial := r.UserDial
+		rt.t.Insert(r.Prefix.Masked(), &userDial)
+	}
+	return rt, nil
+}
+
+// userDial reports whether flows to ip use UserDial.
+func (rt *dialRouteTable) userDial(ip netip.Addr) bool {
+	if rt == nil {
+		return false
+	}
+	v := rt.t.Get(ip)
+	return v != nil && *v
+}
+
+// SetDialRoutes replaces the table selecting the dialer for forwarded TCP
+// flows. It only affects flows forwarded after it returns. See
+// Config.DialRoutes.
+func (ns *Impl) SetDialRoutes(routes []DialRoute) error {
+	rt, err := newDialRouteTable(routes)
+	if err != nil {
+		return err
+	}
+	ns.dialRoutes.Store(rt)
+	return nil
+}
+
+// dialFunc returns the func that forwardTCP uses to dial dst, per the
+// dial routes.
+func (ns *Impl) dialFunc(dst netip.Addr) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if ns.dialRoutes.Load().userDial(dst) {
+		return ns.dialer.UserDial
+	}
+	var stdDialer net.Dialer
+	return stdDialer.DialContext
+}
@@ -20,22 +20,50 @@
 
 import (
 	"context"
+	"sync/atomic"
 
 	"gvisor.dev/gvisor/pkg/sync"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/stack/gro"
 )
 
 type queue struct {
-	// c is the outbound packet channel.
-	c  chan *stack.PacketBuffer
+	// cmu guards c. It's only held to load or replace c, never while
+	// blocked on the channel.
+	cmu sync.RWMutex
+	// c is the outbound packet channel. It's replaced by Resize.
+	// +checklocks:cmu
+	c chan *stack.PacketBuffer
+
+	// mu is held for reading by writers and for writing by Close and
+	// Resize, so c is never replaced or closed under a blocked writer.
 	mu sync.RWMutex
 	// +checklocks:mu
 	closed bool
 
 	closedChOnce sync.Once
 	closedCh     chan struct{}
+
+	// blockedWrites counts writes that found c full and had to wait.
+	blockedWrites atomic.Int64
+}
+
+func (q *queue) ch() chan *stack.PacketBuffer {
+	q.cmu.RLock()
+	defer q.cmu.RUnlock()
+	return q.c
+}
+
+// isClosed reports whether Close has been called.
+func (q *queue) isClosed() bool {
+	select {
+	case <-q.closedCh:
+		return true
+	default:
+		return false
+	}
 }
 
 func (q *queue) Close() {
@@ -49,25 +77,35 @@ func (q *queue) Close() {
 	if q.closed {
 		return
 	}
-	close(q.c)
+	close(q.ch())
 	q.closed = true
 }
 
 func (q *queue) Read() *stack.PacketBuffer {
-	select {
-	case p := <-q.c:
-		return p
-	default:
-		return nil
+	for {
+		select {
+		case p, ok := <-q.ch():
+			if !ok && !q.isClosed() {
+				continue // channel was replaced by Resize
+			}
+			return p
+		default:
+			return nil
+		}
 	}
 }
 
 func (q *queue) ReadContext(ctx context.Context) *stack.PacketBuffer {
-	select {
-	case pkt := <-q.c:
-		return pkt
-	case <-ctx.Done():
-		return nil
+	for {
+		select {
+		case pkt, ok := <-q.ch():
+			if !ok && !q.isClosed() {
+				continue // channel was replaced by Resize
+			}
+			return pkt
+		case <-ctx.Done():
+			return nil
+		}
 	}
 }
 
@@ -77,8 +115,17 @@ func (q *queue) Write(pkt *stack.PacketBuffer) tcpip.Error {
 	if q.closed {
 		return &tcpip.ErrClosedForSend{}
 	}
+	c := q.ch()
+	pkt.IncRef()
 	select {
-	case q.c <- pkt.IncRef():
+	case c <- pkt:
+		return nil
+	default:
+	}
+	q.blockedWrites.Add(1)
+	metricLinkQueueBlockedWrites.Add(1)
+	select {
+	case c <- pkt:
 		return nil
 	case <-q.closedCh:
 		pkt.DecRef()
@@ -86,8 +133,40 @@ func (q *queue) Write(pkt *stack.PacketBuffer) tcpip.Error {
 	}
 }
 
+// Resize replaces the packet channel with one of the given size, moving
+// over queued packets. Packets that don't fit are discarded and counted
+// in the return value.
+func (q *queue) Resize(size int) (dropped int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return 0
+	}
+	newc := make(chan *stack.PacketBuffer, size)
+	q.cmu.Lock()
+	old := q.c
+	q.c = newc
+	q.cmu.Unlock()
+
+	// Wake up readers blocked on the old channel; they'll pick up newc.
+	close(old)
+	for pkt := range old {
+		select {
+		case newc <- pkt:
+		default:
+			pkt.DecRef()
+			dropped++
+		}
+	}
+	return dropped
+}
+
 func (q *queue) Num() int {
-	return len(q.c)
+	return len(q.ch())
+}
+
+func (q *queue) Cap() int {
+	return cap(q.ch())
 }
 
 var _ stack.LinkEndpoint = (*Endpoint)(nil)
@@ -113,18 +192,45 @@ type Endpoint struct {
 
 	// Outbound packet queue.
 	q *queue
+
+	groEnabled bool
+	groPool    sync.Pool // of *gro.GRO
+}
+
+// EndpointOptions are the optional offloads of an Endpoint.
+type EndpointOptions struct {
+	// GSO enables gVisor's software GSO. TCP then builds segments of
+	// up to GSOMaxSize bytes and splits them to the MSS in one batch,
+	// rather than going through its send path once per MSS.
+	GSO bool
+
+	// GRO enables coalescing the inbound TCP segments of a flow that
+	// are injected together with InjectInboundGRO before they're
+	// delivered to the stack. It also marks inbound checksums as
+	// already verified, as gVisor's GRO doesn't fix up the IPv4
+	// header checksum of coalesced packets; packets from WireGuard
+	// are authenticated, so their checksums add nothing.
+	GRO bool
 }
 
 // NewEndpoint creates a new channel endpoint.
-func NewEndpoint(size int, mtu uint32, linkAddr tcpip.LinkAddress) *Endpoint {
-	return &Endpoint{
+func NewEndpoint(size int, mtu uint32, linkAddr tcpip.LinkAddress, opts EndpointOptions) *Endpoint {
+	e := &Endpoint{
 		q: &queue{
-			c:        make(chan *stack.PacketBuffer, size),
 			closedCh: make(chan struct{}),
 		},
-		mtu:      mtu,
-		linkAddr: linkAddr,
+		mtu:        mtu,
+		linkAddr:   linkAddr,
+		groEnabled: opts.GRO,
 	}
+	if opts.GSO {
+		e.SupportedGSOKind = stack.GVisorGSOSupported
+	}
+	if opts.GRO {
+		e.LinkEPCapabilities |= stack.CapabilityRXChecksumOffload
+	}
+	e.q.c = make(chan *stack.PacketBuffer, size)
+	return e
 }
 
 // Close closes e. Further packet injections will return an error, and all pending
@@ -145,6 +251,27 @@ func (e *Endpoint) ReadContext(ctx context.Context) *stack.PacketBuffer {
 	return e.q.ReadContext(ctx)
 }
 
+// ReadBatchContext does a blocking read for at least one packet from the
+// outbound packet queue, then fills the rest of pkts with any packets that
+// are queued without blocking further. It returns the number of packets
+// read, which is zero only if ctx is done or e is closed.
+func (e *Endpoint) ReadBatchContext(ctx context.Context, pkts []*stack.PacketBuffer) int {
+	if len(pkts) == 0 {
+		return 0
+	}
+	pkts[0] = e.q.ReadContext(ctx)
+	if pkts[0] == nil {
+		return 0
+	}
+	n := 1
+	for ; n < len(pkts); n++ {
+		if pkts[n] = e.q.Read(); pkts[n] == nil {
+			break
+		}
+	}
+	return n
+}
+
 // Drain removes all outbound packets from the channel and counts them.
 func (e *Endpoint) Drain() int {
 	c := 0
@@ -160,6 +287,26 @@ func (e *Endpoint) NumQueued() int {
 	return e.q.Num()
 }
 
+// QueueSize returns the capacity of the outbound packet queue.
+func (e *Endpoint) QueueSize() int {
+	return e.q.Cap()
+}
+
+// NumBlockedWrites returns the number of outbound packet writes that found
+// the queue full and had to wait for space.
+func (e *Endpoint) NumBlockedWrites() int64 {
+	return e.q.blockedWrites.Load()
+}
+
+// Resize changes the capacity of the outbound packet queue to size,
+// keeping queued packets. If more than size packets are queued, the
+// excess are discarded and their number is returned. Resize may be called
+// concurrently with WritePackets and reads; blocked writers are given
+// the chance to complete first.
+func (e *Endpoint) Resize(size int) (dropped int) {
+	return e.q.Resize(size)
+}
+
 // InjectInbound injects an inbound packet. If the endpoint is not attached, the
 // packet is not delivered.
 func (e *Endpoint) InjectInbound(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
@@ -171,6 +318,48 @@ func (e *Endpoint) InjectInbound(protocol tcpip.NetworkProtocolNumber, pkt *stac
 	}
 }
 
+// InjectInboundGRO is like InjectInbound, but if GRO is enabled, pkt is
+// coalesced with the other packets passed with the same g rather than
+// delivered immediately. g is nil for the first packet of a batch; the
+// returned GRO is passed with the batch's next packet, and finally to
+// FlushGRO, which delivers the rest of the batch. A GRO must only be used
+// by one goroutine at a time.
+func (e *Endpoint) InjectInboundGRO(g *gro.GRO, protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) *gro.GRO {
+	if !e.groEnabled {
+		e.InjectInbound(protocol, pkt)
+		return g
+	}
+	if g == nil {
+		e.mu.RLock()
+		d := e.dispatcher
+		e.mu.RUnlock()
+		if d == nil {
+			return nil
+		}
+		g, _ = e.groPool.Get().(*gro.GRO)
+		if g == nil {
+			g = new(gro.GRO)
+			g.Init(true)
+		}
+		g.Dispatcher = d
+	}
+	pkt.NetworkProtocolNumber = protocol
+	pkt.RXChecksumValidated = true // see EndpointOptions.GRO
+	g.Enqueue(pkt)
+	return g
+}
+
+// FlushGRO delivers the packets held by g, as returned by
+// InjectInboundGRO, and releases it. g may be nil.
+func (e *Endpoint) FlushGRO(g *gro.GRO) {
+	if g == nil {
+		return
+	}
+	g.Flush()
+	g.Dispatcher = nil
+	e.groPool.Put(g)
+}
+
 // Attach saves the stack network-layer dispatcher for use later when packets
 // are injected.
 func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
@@ -15,7 +15,7 @@
 func TestEndpointBlockingWrites(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
-	linkEP := NewEndpoint(1, 1500, "")
+	linkEP := NewEndpoint(1, 1500, "", EndpointOptions{})
 	pb1 := stack.NewPacketBuffer(stack.PacketBufferOptions{})
 	defer pb1.DecRef()
 	pb2 := stack.NewPacketBuffer(stack.PacketBufferOptions{})
@@ -81,7 +81,7 @@ func TestEndpointBlockingWrites(t *testing.T) {
 func TestEndpointCloseUnblocksWrites(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
-	linkEP := NewEndpoint(1, 1500, "")
+	linkEP := NewEndpoint(1, 1500, "", EndpointOptions{})
 	pb1 := stack.NewPacketBuffer(stack.PacketBufferOptions{})
 	pb2 := stack.NewPacketBuffer(stack.PacketBufferOptions{})
 	defer pb2.DecRef()
@@ -140,3 +140,68 @@ func TestEndpointCloseUnblocksWrites(t *testing.T) {
 		t.Fatal("timed out for 2nd write error")
 	}
 }
+
+func TestEndpointResizeAndBatchRead(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	linkEP := NewEndpoint(4, 1500, "", EndpointOptions{})
+	defer linkEP.Close()
+
+	var pbs []*stack.PacketBuffer
+	for i := 0; i < 3; i++ {
+		pb := stack.NewPacketBuffer(stack.PacketBufferOptions{})
+		defer pb.DecRef()
+		bl := stack.PacketBufferList{}
+		bl.PushBack(pb)
+		if _, err := linkEP.WritePackets(bl); err != nil {
+			t.Fatalf("write %d: %s", i, err)
+		}
+		pbs = append(pbs, pb)
+	}
+	if got := linkEP.NumQueued(); got != 3 {
+		t.Fatalf("NumQueued = %d; want 3", got)
+	}
+
+	// Shrinking below the number of queued packets drops the excess.
+	if dropped := linkEP.Resize(2); dropped != 1 {
+		t.Fatalf("Resize dropped %d; want 1", dropped)
+	}
+	if got := linkEP.QueueSize(); got != 2 {
+		t.Fatalf("QueueSize = %d; want 2", got)
+	}
+
+	// A reader blocked across a resize must see packets written after it.
+	if dropped := linkEP.Resize(8); dropped != 0 {
+		t.Fatalf("Resize dropped %d; want 0", dropped)
+	}
+	batch := make([]*stack.PacketBuffer, 4)
+	n := linkEP.ReadBatchContext(ctx, batch)
+	if n != 2 {
+		t.Fatalf("ReadBatchContext = %d; want 2", n)
+	}
+	for i, pb := range batch[:n] {
+		if pb != pbs[i] {
+			t.Errorf("batch[%d] = %p; want %p", i, pb, pbs[i])
+		}
+		pb.DecRef()
+	}
+
+	got := make(chan *stack.PacketBuffer, 1)
+	go func() { got <- linkEP.ReadContext(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	linkEP.Resize(1)
+	bl := stack.PacketBufferList{}
+	bl.PushBack(pbs[0])
+	if _, err := linkEP.WritePackets(bl); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pb := <-got:
+		if pb != pbs[0] {
+			t.Fatalf("ReadContext = %p; want %p", pb, pbs[0])
+		}
+		pb.DecRef()
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for read after resize")
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netstack
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/nettype"
+)
+
+// FlowOutcome is what netstack did with a new TCP or UDP flow.
+type FlowOutcome int
+
+const (
+	// FlowAccepted means the flow was handed to a handler, such as
+	// one from Impl.GetTCPHandlerForFlow.
+	FlowAccepted FlowOutcome = iota
+	// FlowForwarded means netstack proxies the flow to its
+	// destination, or to localhost for the node's own addresses.
+	FlowForwarded
+	// FlowRejected means the flow was refused, with a RST for TCP.
+	FlowRejected
+)
+
+func (o FlowOutcome) String() string {
+	switch o {
+	case FlowAccepted:
+		return "accepted"
+	case FlowForwarded:
+		return "forwarded"
+	case FlowRejected:
+		return "rejected"
+	}
+	return "unknown"
+}
+
+// FlowEvent describes a new TCP or UDP flow and its outcome.
+type FlowEvent struct {
+	Proto   ipproto.Proto // ipproto.TCP or ipproto.UDP
+	Src     netip.AddrPort
+	Dst     netip.AddrPort
+	Outcome FlowOutcome
+	// Reason says why a FlowRejected flow was rejected.
+	Reason string
+}
+
+// FlowSummary describes an accepted or forwarded flow that ended.
+type FlowSummary struct {
+	FlowEvent
+	// RxBytes is the number of bytes received from the flow's source,
+	// and TxBytes the number sent to it.
+	RxBytes  int64
+	TxBytes  int64
+	Duration time.Duration
+	// Err is the error that ended a forwarded flow, if any.
+	Err error
+}
+
+// FlowLogger receives events about the TCP and UDP flows netstack
+// handles, except MagicDNS's. See Impl.FlowLogger.
+//
+// Its methods are called from netstack's goroutines and must not block.
+type FlowLogger interface {
+	// LogFlow is called when a flow is accepted, forwarded or
+	// rejected.
+	LogFlow(FlowEvent)
+	// LogFlowClose is called when an accepted or forwarded flow ends:
+	// for an accepted flow, when its handler first closes the conn.
+	LogFlowClose(FlowSummary)
+}
+
+// flowLog reports the events of one flow to a FlowLogger. A nil
+// *flowLog, for when there's no FlowLogger, reports nothing.
+type flowLog struct {
+	l     FlowLogger
+	ev    FlowEvent
+	start time.Time
+
+	rx, tx    atomic.Int64
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	halves   int   // directions of a forwarded flow done copying
+	firstErr error // error of the first direction done
+}
+
+// newFlowLog returns the flowLog of a flow from src to dst, or nil if ns
+// has no FlowLogger.
+func (ns *Impl) newFlowLog(proto ipproto.Proto, src, dst netip.AddrPort) *flowLog {
+	if ns.FlowLogger == nil {
+		return nil
+	}
+	return &flowLog{l: ns.FlowLogger, ev: FlowEvent{Proto: proto, Src: src, Dst: dst}}
+}
+
+// reject reports that the flow was rejected for reason.
+func (f *flowLog) reject(reason string) {
+	if f == nil {
+		return
+	}
+	f.ev.Outcome = FlowRejected
+	f.ev.Reason = reason
+	f.l.LogFlow(f.ev)
+}
+
+// open reports that the flow was accepted or forwarded, per o, and
+// starts timing it.
+func (f *flowLog) open(o FlowOutcome) {
+	if f == nil {
+		return
+	}
+	f.ev.Outcome = o
+	f.start = time.Now()
+	f.l.LogFlow(f.ev)
+}
+
+// close reports that the flow ended with err, the first time it's
+// called.
+func (f *flowLog) close(err error) {
+	if f == nil {
+		return
+	}
+	f.closeOnce.Do(func() {
+		f.l.LogFlowClose(FlowSummary{
+			FlowEvent: f.ev,
+			RxBytes:   f.rx.Load(),
+			TxBytes:   f.tx.Load(),
+			Duration:  time.Since(f.start),
+			Err:       err,
+		})
+	})
+}
+
+// copied records that one direction of a forwarded flow, from its
+// source if fromSrc, stopped after copying n bytes, with err. The flow
+// is reported closed once both directions have, with the first's err.
+func (f *flowLog) copied(fromSrc bool, n int64, err error) {
+	if f == nil {
+		return
+	}
+	if fromSrc {
+		f.rx.Add(n)
+	} else {
+		f.tx.Add(n)
+	}
+	f.mu.Lock()
+	f.halves++
+	if f.halves == 1 {
+		f.firstErr = err
+	}
+	done, err := f.halves == 2, f.firstErr
+	f.mu.Unlock()
+	if done {
+		f.close(err)
+	}
+}
+
+// conn returns c, the conn of an accepted flow, counting its bytes and
+// reporting the flow closed when it's first closed. It returns c itself
+// if f is nil.
+func (f *flowLog) conn(c net.Conn) net.Conn {
+	if f == nil {
+		return c
+	}
+	return &flowLogConn{Conn: c, f: f}
+}
+
+// packetConn is conn for a UDP flow.
+func (f *flowLog) packetConn(c nettype.ConnPacketConn) nettype.ConnPacketConn {
+	if f == nil {
+		return c
+	}
+	return &flowLogPacketConn{ConnPacketConn: c, f: f}
+}
+
+type flowLogConn struct {
+	net.Conn
+	f *flowLog
+}
+
+func (c *flowLogConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.f.rx.Add(int64(n))
+	return n, err
+}
+
+func (c *flowLogConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.f.tx.Add(int64(n))
+	return n, err
+}
+
+func (c *flowLogConn) Close() error {
+	err := c.Conn.Close()
+	c.f.close(nil)
+	return err
+}
+
+type flowLogPacketConn struct {
+	nettype.ConnPacketConn
+	f *flowLog
+}
+
+func (c *flowLogPacketConn) Read(p []byte) (int, error) {
+	n, err := c.ConnPacketConn.Read(p)
+	c.f.rx.Add(int64(n))
+	return n, err
+}
+
+func (c *flowLogPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.ConnPacketConn.ReadFrom(p)
+	c.f.rx.Add(int64(n))
+	return n, addr, err
+}
+
+func (c *flowLogPacketConn) Write(p []byte) (int, error) {
+	n, err := c.ConnPacketConn.Write(p)
+	c.f.tx.Add(int64(n))
+	return n, err
+}
+
+func (c *flowLogPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.ConnPacketConn.WriteTo(p, addr)
+	c.f.tx.Add(int64(n))
+	return n, err
+}
+
+func (c *flowLogPacketConn) Close() error {
+	err := c.ConnPacketConn.Close()
+	c.f.close(nil)
+	return err
+}
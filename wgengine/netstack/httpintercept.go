@@ -0,0 +1,170 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netstack
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/waiter"
+	"tailscale.com/net/netutil"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/clientmetric"
+)
+
+// HTTPIntercept configures the interception of the TCP flows that
+// netstack forwards for subnet routes to port 80 (HTTP) and port 443
+// (HTTPS). Rather than being forwarded to their destination, such flows
+// are served in-process, so they can be inspected or rewritten. See
+// Config.HTTPIntercept.
+type HTTPIntercept struct {
+	// Handler, if non-nil, serves the requests of flows to port 80.
+	// Their RemoteAddr is the peer's address, and their destination
+	// is available from HTTPInterceptDst.
+	Handler http.Handler
+
+	// TLSRouter, if non-nil, routes flows to port 443. It's called with
+	// the server name (SNI) from the flow's TLS ClientHello, which is
+	// empty if it had none, and the flow's destination. If it returns
+	// a non-nil handler, the handler takes over the connection, from
+	// the start of the ClientHello. Otherwise, as for flows that aren't
+	// TLS, the flow is forwarded to its destination.
+	TLSRouter func(serverName string, dst netip.AddrPort) (handler func(net.Conn))
+}
+
+// clientHelloTimeout is how long an intercepted HTTPS flow has to send
+// its TLS ClientHello.
+const clientHelloTimeout = 10 * time.Second
+
+type httpInterceptDstKey struct{}
+
+// HTTPInterceptDst returns the original destination of a request served
+// by HTTPIntercept.Handler, given its context.
+func HTTPInterceptDst(ctx context.Context) (dst netip.AddrPort, ok bool) {
+	dst, ok = ctx.Value(httpInterceptDstKey{}).(netip.AddrPort)
+	return dst, ok
+}
+
+// interceptHTTP serves the flow from client to dst, to a subnet route,
+// per ns.httpIntercept, if it applies. It reports whether the flow was
+// handled; if not, the caller forwards it to dialAddr as usual.
+func (ns *Impl) interceptHTTP(getClient func(...tcpip.SettableSocketOption) *gonet.TCPConn, client netip.AddrPort, wq *waiter.Queue, dst, dialAddr netip.AddrPort, fc *flowCloser) (handled bool) {
+	hi := ns.httpIntercept
+	switch {
+	case dst.Port() == 80 && hi.Handler != nil:
+		c := getClient() // will send a RST if it fails
+		if c == nil {
+			return true
+		}
+		metricHTTPIntercepted.Add(1)
+		fc.log.open(FlowAccepted)
+		ns.serveHTTPIntercept(fc.log.conn(c), client, dst)
+		return true
+	case dst.Port() == 443 && hi.TLSRouter != nil:
+		c := getClient() // will send a RST if it fails
+		if c == nil {
+			return true
+		}
+		serverName, hello, err := peekClientHello(c)
+		if err == nil {
+			if handler := hi.TLSRouter(serverName, dst); handler != nil {
+				metricHTTPSIntercepted.Add(1)
+				fc.log.open(FlowAccepted)
+				handler(fc.log.conn(&prefixConn{c, io.MultiReader(bytes.NewReader(hello), c)}))
+				return true
+			}
+		} else if debugNetstack() {
+			ns.logf("[v2] netstack: no TLS ClientHello from %v to %v: %v", client, dst, err)
+		}
+		// Pass the flow through, with what was read of it.
+		if !ns.forwardTCPPrefixed(func(...tcpip.SettableSocketOption) *gonet.TCPConn { return c }, hello, client.Addr(), wq, dialAddr, fc) {
+			fc.log.reject("dial failed")
+			c.Close()
+		}
+		return true
+	}
+	return false
+}
+
+// serveHTTPIntercept serves the HTTP requests on c, from client to dst,
+// with ns.httpIntercept.Handler until c is closed or hijacked.
+func (ns *Impl) serveHTTPIntercept(c net.Conn, client, dst netip.AddrPort) {
+	done := make(chan struct{})
+	s := &http.Server{
+		Handler: ns.httpIntercept.Handler,
+		ConnContext: func(ctx context.Context, _ net.Conn) context.Context {
+			return context.WithValue(ctx, httpInterceptDstKey{}, dst)
+		},
+		ConnState: func(_ net.Conn, st http.ConnState) {
+			if st == http.StateClosed || st == http.StateHijacked {
+				close(done)
+			}
+		},
+		ErrorLog: logger.StdLogger(ns.logf),
+	}
+	s.Serve(netutil.NewOneConnListener(&remoteAddrConn{c, net.TCPAddrFromAddrPort(client)}, net.TCPAddrFromAddrPort(dst)))
+	<-done
+}
+
+// errClientHelloRead stops the TLS handshake of peekClientHello once it
+// has the ClientHello.
+var errClientHelloRead = errors.New("read ClientHello")
+
+// peekClientHello reads the TLS ClientHello from c, returning its server
+// name and the bytes read from c.
+func peekClientHello(c net.Conn) (serverName string, read []byte, err error) {
+	var buf bytes.Buffer
+	var gotHello bool
+	c.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	err = tls.Server(&prefixConn{readOnlyConn{c}, io.TeeReader(c, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName, gotHello = hello.ServerName, true
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if gotHello {
+		return serverName, buf.Bytes(), nil
+	}
+	return "", buf.Bytes(), err
+}
+
+// prefixConn is a net.Conn reading from r.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// readOnlyConn is a net.Conn whose writes fail, so peekClientHello
+// doesn't send the client a TLS alert.
+type readOnlyConn struct {
+	net.Conn
+}
+
+func (readOnlyConn) Write([]byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// remoteAddrConn is a net.Conn with a fixed RemoteAddr, as a
+// gonet.TCPConn's isn't known until its handshake completes.
+type remoteAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr { return c.remote }
+
+var (
+	metricHTTPIntercepted  = clientmetric.NewCounter("netstack_http_intercepted")
+	metricHTTPSIntercepted = clientmetric.NewCounter("netstack_https_intercepted")
+)
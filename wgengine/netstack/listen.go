@@ -0,0 +1,388 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netstack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"tailscale.com/types/ipproto"
+)
+
+// maxListenPorts is the most ports a single Listen can cover.
+const maxListenPorts = 1024
+
+// listenKey is a protocol and local address listened on by Listen or
+// ListenPacket.
+type listenKey struct {
+	proto ipproto.Proto
+	addr  netip.AddrPort
+}
+
+// isListening reports whether a listener from Listen or ListenPacket is
+// bound to dst for proto, so shouldProcessInbound lets its packets into
+// the stack.
+func (ns *Impl) isListening(proto ipproto.Proto, dst netip.AddrPort) bool {
+	_, ok := ns.listening.Load(listenKey{proto, dst})
+	return ok
+}
+
+// Listen announces on the node's Tailscale IPs inside netstack, so that
+// embedders can serve TCP connections from the tailnet without
+// GetTCPHandlerForFlow. The network must be "tcp", "tcp4" or "tcp6".
+//
+// The host in addr must be one of the node's Tailscale IPs or empty (or
+// unspecified) for all of them in the network's address family, as of the
+// call. The port must be non-zero, or a range like "8000-8099" of up to
+// maxListenPorts ports, accepting connections to any of them; the
+// listener's Addr is then that of the first.
+func (ns *Impl) Listen(network, addr string) (net.Listener, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	ips, lo, hi, err := ns.parseListenAddr(network, addr, true)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	ln := &tailnetListener{
+		ns:   ns,
+		acc:  make(chan acceptResult),
+		done: make(chan struct{}),
+	}
+	for _, ip := range ips {
+		for port := int(lo); port <= int(hi); port++ {
+			sub, err := gonet.ListenTCP(ns.ipstack, fullAddr(ip, uint16(port)), protoOfAddr(ip))
+			if err != nil {
+				ln.Close()
+				return nil, &net.OpError{Op: "listen", Net: network, Addr: net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), Err: err}
+			}
+			ln.add(sub, listenKey{ipproto.TCP, netip.AddrPortFrom(ip, uint16(port))})
+		}
+	}
+	return ln, nil
+}
+
+// ListenPacket is like Listen, but for UDP. The network must be "udp",
+// "udp4" or "udp6", and addr can't have a port range.
+func (ns *Impl) ListenPacket(network, addr string) (net.PacketConn, error) {
+	if network != "udp" && network != "udp4" && network != "udp6" {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	ips, port, _, err := ns.parseListenAddr(network, addr, false)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	pc := &tailnetPacketConn{
+		ns:          ns,
+		recv:        make(chan udpPacket),
+		done:        make(chan struct{}),
+		deadlineSet: make(chan struct{}),
+	}
+	for _, ip := range ips {
+		laddr := fullAddr(ip, port)
+		c, err := gonet.DialUDP(ns.ipstack, &laddr, nil, protoOfAddr(ip))
+		if err != nil {
+			pc.Close()
+			return nil, &net.OpError{Op: "listen", Net: network, Addr: net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), Err: err}
+		}
+		pc.add(c, ip, listenKey{ipproto.UDP, netip.AddrPortFrom(ip, port)})
+	}
+	return pc, nil
+}
+
+// parseListenAddr parses the addr of Listen or ListenPacket, returning the
+// IPs to listen on and the range of ports, which can only have more than
+// one if allowRange.
+func (ns *Impl) parseListenAddr(network, addr string, allowRange bool) (ips []netip.Addr, lo, hi uint16, err error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	loStr, hiStr, isRange := strings.Cut(portStr, "-")
+	if isRange && !allowRange {
+		return nil, 0, 0, fmt.Errorf("port range %q not supported", portStr)
+	}
+	if !isRange {
+		hiStr = loStr
+	}
+	lo64, err := strconv.ParseUint(loStr, 10, 16)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	hi64, err := strconv.ParseUint(hiStr, 10, 16)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	switch {
+	case lo64 == 0:
+		return nil, 0, 0, errors.New("port required")
+	case hi64 < lo64:
+		return nil, 0, 0, fmt.Errorf("invalid port range %q", portStr)
+	case hi64-lo64 >= maxListenPorts:
+		return nil, 0, 0, fmt.Errorf("port range %q has more than %d ports", portStr, maxListenPorts)
+	}
+
+	wantFamily := func(ip netip.Addr) bool {
+		switch network[len(network)-1] {
+		case '4':
+			return ip.Is4()
+		case '6':
+			return ip.Is6()
+		}
+		return true
+	}
+	var ip netip.Addr
+	if host != "" {
+		ip, err = netip.ParseAddr(host)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		ip = ip.Unmap()
+	}
+	for _, selfIP := range ns.selfIPs.Load() {
+		if !wantFamily(selfIP) {
+			continue
+		}
+		if !ip.IsValid() || ip.IsUnspecified() || ip == selfIP {
+			ips = append(ips, selfIP)
+		}
+	}
+	if len(ips) == 0 {
+		if ip.IsValid() && !ip.IsUnspecified() {
+			return nil, 0, 0, fmt.Errorf("%v is not a Tailscale IP of this node", ip)
+		}
+		return nil, 0, 0, errors.New("no Tailscale IPs to listen on")
+	}
+	return ips, uint16(lo64), uint16(hi64), nil
+}
+
+func fullAddr(ip netip.Addr, port uint16) tcpip.FullAddress {
+	return tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.AddrFromSlice(ip.AsSlice()),
+		Port: port,
+	}
+}
+
+func protoOfAddr(ip netip.Addr) tcpip.NetworkProtocolNumber {
+	if ip.Is4() {
+		return ipv4.ProtocolNumber
+	}
+	return ipv6.ProtocolNumber
+}
+
+// tailnetListener is the net.Listener of Listen: the gVisor listeners on
+// each IP and port it covers, accepted from as one.
+type tailnetListener struct {
+	ns        *Impl
+	lns       []*gonet.TCPListener
+	keys      []listenKey
+	acc       chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	c   net.Conn
+	err error
+}
+
+// add adds sub, listening on k, to ln and starts accepting from it.
+func (ln *tailnetListener) add(sub *gonet.TCPListener, k listenKey) {
+	ln.lns = append(ln.lns, sub)
+	ln.keys = append(ln.keys, k)
+	ln.ns.listening.Store(k, struct{}{})
+	go func() {
+		for {
+			c, err := sub.Accept()
+			select {
+			case ln.acc <- acceptResult{c, err}:
+			case <-ln.done:
+				if c != nil {
+					c.Close()
+				}
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (ln *tailnetListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-ln.acc:
+		return r.c, r.err
+	case <-ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *tailnetListener) Close() error {
+	ln.closeOnce.Do(func() {
+		close(ln.done)
+		for i, sub := range ln.lns {
+			ln.ns.listening.Delete(ln.keys[i])
+			sub.Close()
+		}
+	})
+	return nil
+}
+
+func (ln *tailnetListener) Addr() net.Addr {
+	return ln.lns[0].Addr()
+}
+
+// tailnetPacketConn is the net.PacketConn of ListenPacket: the gVisor UDP
+// endpoints on each IP it covers, read from as one. Writes go out of the
+// endpoint in the destination's address family.
+type tailnetPacketConn struct {
+	ns        *Impl
+	conns     []*gonet.UDPConn
+	ips       []netip.Addr // of conns
+	keys      []listenKey  // of conns
+	recv      chan udpPacket
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	deadlineSet  chan struct{} // closed and replaced when readDeadline changes
+}
+
+type udpPacket struct {
+	b    []byte
+	from net.Addr
+	err  error
+}
+
+// add adds c, bound to ip and listening on k, to pc and starts reading
+// from it.
+func (pc *tailnetPacketConn) add(c *gonet.UDPConn, ip netip.Addr, k listenKey) {
+	pc.conns = append(pc.conns, c)
+	pc.ips = append(pc.ips, ip)
+	pc.keys = append(pc.keys, k)
+	pc.ns.listening.Store(k, struct{}{})
+	go func() {
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, from, err := c.ReadFrom(buf)
+			p := udpPacket{from: from, err: err}
+			if err == nil {
+				p.b = bytes.Clone(buf[:n])
+			}
+			select {
+			case pc.recv <- p:
+			case <-pc.done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (pc *tailnetPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		pc.mu.Lock()
+		deadline, deadlineSet := pc.readDeadline, pc.deadlineSet
+		pc.mu.Unlock()
+
+		var timeout <-chan time.Time
+		var t *time.Timer
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			t = time.NewTimer(d)
+			timeout = t.C
+		}
+		stop := func() {
+			if t != nil {
+				t.Stop()
+			}
+		}
+		select {
+		case p := <-pc.recv:
+			stop()
+			return copy(b, p.b), p.from, p.err
+		case <-pc.done:
+			stop()
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-deadlineSet:
+			stop()
+		}
+	}
+}
+
+func (pc *tailnetPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: net.InvalidAddrError("not a UDP address")}
+	}
+	dst := ua.AddrPort().Addr().Unmap()
+	for i, ip := range pc.ips {
+		if ip.Is4() == dst.Is4() {
+			return pc.conns[i].WriteTo(b, addr)
+		}
+	}
+	return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: errors.New("no Tailscale IP in its address family")}
+}
+
+func (pc *tailnetPacketConn) Close() error {
+	pc.closeOnce.Do(func() {
+		close(pc.done)
+		for i, c := range pc.conns {
+			pc.ns.listening.Delete(pc.keys[i])
+			c.Close()
+		}
+	})
+	return nil
+}
+
+func (pc *tailnetPacketConn) LocalAddr() net.Addr {
+	return pc.conns[0].LocalAddr()
+}
+
+func (pc *tailnetPacketConn) SetDeadline(t time.Time) error {
+	pc.SetReadDeadline(t)
+	return pc.SetWriteDeadline(t)
+}
+
+func (pc *tailnetPacketConn) SetReadDeadline(t time.Time) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.readDeadline = t
+	close(pc.deadlineSet)
+	pc.deadlineSet = make(chan struct{})
+	return nil
+}
+
+func (pc *tailnetPacketConn) SetWriteDeadline(t time.Time) error {
+	for _, c := range pc.conns {
+		if err := c.SetWriteDeadline(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
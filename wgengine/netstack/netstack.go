@@ -13,6 +13,7 @@
 	"log"
 	"net"
 	"net/netip"
+	"net/url"
 	"os"
 	"os/exec"
 	"runtime"
@@ -21,6 +22,7 @@
 	"sync/atomic"
 	"time"
 
+	"golang.org/x/exp/maps"
 	"gvisor.dev/gvisor/pkg/buffer"
 	"gvisor.dev/gvisor/pkg/refs"
 	"gvisor.dev/gvisor/pkg/tcpip"
@@ -29,6 +31,7 @@
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/stack/gro"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
@@ -46,6 +49,8 @@
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/nettype"
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/mak"
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/filter"
@@ -61,6 +66,11 @@
 	magicDNSIPv6 = tsaddr.TailscaleServiceIPv6()
 )
 
+// metricLinkQueueBlockedWrites counts writes, across all Impls, that
+// found the outbound link queue full. Per-Impl queue state is available
+// from LinkStats.
+var metricLinkQueueBlockedWrites = clientmetric.NewCounter("netstack_link_queue_blocked_writes")
+
 func init() {
 	mode := envknob.String("TS_DEBUG_NETSTACK_LEAK_MODE")
 	if mode == "" {
@@ -103,6 +113,12 @@ type Impl struct {
 	// over the UDP flow.
 	GetUDPHandlerForFlow func(src, dst netip.AddrPort) (handler func(nettype.ConnPacketConn), intercept bool)
 
+	// FlowLogger, if non-nil, is told about each TCP and UDP flow
+	// accepted, forwarded or rejected, other than MagicDNS's, and of
+	// its byte counts and duration when it ends.
+	// It can only be set before calling Start.
+	FlowLogger FlowLogger
+
 	// ProcessLocalIPs is whether netstack should handle incoming
 	// traffic directed at the Node.Addresses (local IPs).
 	// It can only be set before calling Start.
@@ -127,6 +143,28 @@ type Impl struct {
 	lb        *ipnlocal.LocalBackend // or nil
 	dns       *dns.Manager
 
+	linkBatchSize atomic.Int32 // max packets dequeued from linkEP at once
+
+	// egressProxy is Config.EgressProxy, copied at CreateWithConfig so it can be
+	// read without holding mu.
+	egressProxy func(dst netip.AddrPort) (*url.URL, error)
+
+	// httpIntercept is Config.HTTPIntercept, copied at CreateWithConfig.
+	httpIntercept *HTTPIntercept
+
+	dialRoutes atomic.Pointer[dialRouteTable] // or nil for none
+
+	rawForward *rawForwarder // or nil if Config.RawForwardProtocols is empty
+
+	// tcpForwarder is the forwarder that new inbound TCP flows are
+	// handed to, once Start has run. It's replaced when the TCP buffer
+	// configuration changes, as gVisor sizes the receive buffer of
+	// forwarded connections from the forwarder rather than the stack.
+	tcpForwarder atomic.Pointer[tcp.Forwarder]
+
+	tcpForwardInFlight atomic.Int64 // TCP forwarder requests not yet completed
+	tcpForwardActive   atomic.Int64 // TCP connections being proxied by forwardTCP
+
 	peerapiPort4Atomic atomic.Uint32 // uint16 port number for IPv4 peerapi
 	peerapiPort6Atomic atomic.Uint32 // uint16 port number for IPv6 peerapi
 
@@ -136,12 +174,76 @@ type Impl struct {
 	// updates.
 	atomicIsLocalIPFunc syncs.AtomicValue[func(netip.Addr) bool]
 
+	// selfIPs are the node's Tailscale IPs, from the last netmap, for
+	// Listen and ListenPacket.
+	selfIPs syncs.AtomicValue[[]netip.Addr]
+
+	// listening has the protocols and local addresses that listeners
+	// from Listen and ListenPacket are bound to.
+	listening syncs.Map[listenKey, struct{}]
+
 	mu sync.Mutex
+	// cfg is the configuration passed to CreateWithConfig, updated by
+	// SetTCPBufferSizes.
+	cfg Config
 	// connsOpenBySubnetIP keeps track of number of connections open
 	// for each subnet IP temporarily registered on netstack for active
 	// TCP connections, so they can be unregistered when connections are
 	// closed.
 	connsOpenBySubnetIP map[netip.Addr]int
+	// activeFlows are the forwarded TCP connections and UDP sessions
+	// currently being copied, each mapped to a func that closes it.
+	activeFlows map[*activeFlow]func()
+	// flowsDrained, if non-nil, is closed when activeFlows becomes
+	// empty during Drain.
+	flowsDrained chan struct{}
+
+	// draining is set by Drain to reject new flows.
+	draining atomic.Bool
+
+	// ready is closed once the inject goroutine is running and the
+	// first netmap's addresses are installed. See WaitReady.
+	ready          chan struct{}
+	readyOnce      sync.Once
+	injectRunning  atomic.Bool
+	addrsInstalled atomic.Bool
+}
+
+// activeFlow is a key of Impl.activeFlows.
+type activeFlow struct{}
+
+// flowCloser accumulates the funcs that tear down a forwarded flow as its
+// parts are set up, so a flow can be closed by Drain at any stage.
+type flowCloser struct {
+	log *flowLog // reports the flow to Impl.FlowLogger, or nil
+
+	mu     sync.Mutex
+	closed bool
+	fns    []func()
+}
+
+// add registers f to be called on close. If the flow is already closed,
+// f is called immediately.
+func (fc *flowCloser) add(f func()) {
+	fc.mu.Lock()
+	if fc.closed {
+		fc.mu.Unlock()
+		f()
+		return
+	}
+	fc.fns = append(fc.fns, f)
+	fc.mu.Unlock()
+}
+
+func (fc *flowCloser) close() {
+	fc.mu.Lock()
+	fc.closed = true
+	fns := fc.fns
+	fc.fns = nil
+	fc.mu.Unlock()
+	for _, f := range fns {
+		f()
+	}
 }
 
 const nicID = 1
@@ -172,8 +274,148 @@ type Impl struct {
 	congestionControlCubic = "cubic"
 )
 
-// Create creates and populates a new Impl.
+// Config is the optional configuration of an Impl, passed to
+// CreateWithConfig.
+// The zero value is valid and results in the defaults documented on
+// each field.
+type Config struct {
+	// TCPReceiveBufferSize is the size in bytes of TCP receive
+	// buffers. If zero, 6MiB is used. High bandwidth-delay product
+	// links may want more; memory constrained hosts may want less.
+	TCPReceiveBufferSize int
+
+	// TCPSendBufferSize is the size in bytes of TCP send buffers. It
+	// should be greater than half of TCPReceiveBufferSize. If zero,
+	// 4MiB is used.
+	TCPSendBufferSize int
+
+	// TCPMaxRetries is the maximum number of TCP retransmissions
+	// before a connection is considered broken. If zero, gVisor's
+	// default is used.
+	TCPMaxRetries uint
+
+	// TCPModerateReceiveBuffer enables gVisor's TCP receive buffer
+	// auto-tuning. Receive buffers then start small and grow with
+	// utilization up to TCPReceiveBufferSize, rather than always being
+	// allocated at that size. It can be changed at runtime with
+	// SetTCPModerateReceiveBuffer.
+	TCPModerateReceiveBuffer bool
+
+	// CongestionControl is the name of the TCP congestion control
+	// algorithm to use: "cubic" or "reno". If empty, "cubic" is used.
+	CongestionControl string
+
+	// EgressProxy, if non-nil, selects a proxy for TCP flows that
+	// netstack forwards to a backend. It's called with the address
+	// being dialed. If it returns a non-nil URL, the backend is dialed
+	// through that SOCKS5 ("socks5://") or HTTP CONNECT ("http://",
+	// "https://") proxy instead of directly. If it returns an error or
+	// the proxy dial fails, the client's connection is reset.
+	EgressProxy func(dst netip.AddrPort) (*url.URL, error)
+
+	// LinkQueueSize is the number of outbound packets buffered between
+	// gVisor and WireGuard. If zero, 512 is used. It can be changed at
+	// runtime with SetLinkQueueSize.
+	LinkQueueSize int
+
+	// LinkMTU is the MTU of the link endpoint between gVisor and
+	// WireGuard. If zero, tstun.DefaultMTU() is used.
+	LinkMTU uint32
+
+	// LinkBatchSize is the maximum number of outbound packets dequeued
+	// from the link endpoint at once. If zero, 1 is used. It can be
+	// changed at runtime with SetLinkBatchSize.
+	LinkBatchSize int
+
+	// LinkGSO enables gVisor's software GSO on the link endpoint, so
+	// TCP builds large segments and splits them to the MSS in one
+	// batch. See EndpointOptions.
+	LinkGSO bool
+
+	// LinkGRO enables coalescing the inbound TCP segments of each
+	// batch of packets from WireGuard before they're delivered to
+	// the stack. See EndpointOptions.
+	LinkGRO bool
+
+	// HTTPIntercept, if non-nil, intercepts the HTTP and HTTPS flows
+	// forwarded for subnet routes, rather than dialing their
+	// destination. See HTTPIntercept.
+	HTTPIntercept *HTTPIntercept
+
+	// DialRoutes selects, by destination, the dialer for the TCP flows
+	// netstack forwards that aren't proxied by EgressProxy. The route
+	// with the longest prefix containing the destination applies.
+	// Flows that match none are dialed with the system dialer. It can
+	// be changed at runtime with SetDialRoutes.
+	DialRoutes []DialRoute
+
+	// RawForwardProtocols are the IP protocols, other than TCP, UDP and
+	// ICMP, whose subnet-routed packets are forwarded to the host
+	// network over raw IP sockets, such as ipproto.GRE or 41 (6in4).
+	// Forwarding needs raw socket access (CAP_NET_RAW on Linux); if
+	// it's denied, packets of the protocol are dropped.
+	RawForwardProtocols []ipproto.Proto
+}
+
+func (c *Config) tcpReceiveBufferSize() int {
+	if c.TCPReceiveBufferSize > 0 {
+		return c.TCPReceiveBufferSize
+	}
+	return recvBufSize
+}
+
+// tcpInitialReceiveBufferSize returns the receive buffer size new TCP
+// connections start with.
+func (c *Config) tcpInitialReceiveBufferSize() int {
+	recv := c.tcpReceiveBufferSize()
+	if c.TCPModerateReceiveBuffer {
+		return min(tcp.DefaultReceiveBufferSize, recv)
+	}
+	return recv
+}
+
+func (c *Config) tcpSendBufferSize() int {
+	if c.TCPSendBufferSize > 0 {
+		return c.TCPSendBufferSize
+	}
+	return sendBufSize
+}
+
+func (c *Config) linkQueueSize() int {
+	if c.LinkQueueSize > 0 {
+		return c.LinkQueueSize
+	}
+	return 512
+}
+
+func (c *Config) linkMTU() uint32 {
+	if c.LinkMTU > 0 {
+		return c.LinkMTU
+	}
+	return tstun.DefaultMTU()
+}
+
+func (c *Config) linkBatchSize() int {
+	if c.LinkBatchSize > 0 {
+		return c.LinkBatchSize
+	}
+	return 1
+}
+
+func (c *Config) congestionControl() string {
+	if c.CongestionControl != "" {
+		return c.CongestionControl
+	}
+	return congestionControlCubic
+}
+
+// Create creates and populates a new Impl with the default Config.
 func Create(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magicsock.Conn, dialer *tsdial.Dialer, dns *dns.Manager) (*Impl, error) {
+	return CreateWithConfig(logf, tundev, e, mc, dialer, dns, Config{})
+}
+
+// CreateWithConfig is like Create, but uses the provided Config.
+func CreateWithConfig(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magicsock.Conn, dialer *tsdial.Dialer, dns *dns.Manager, cfg Config) (*Impl, error) {
 	if mc == nil {
 		return nil, errors.New("nil magicsock.Conn")
 	}
@@ -189,6 +431,16 @@ func Create(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magi
 	if dialer == nil {
 		return nil, errors.New("nil Dialer")
 	}
+	dialRoutes, err := newDialRouteTable(cfg.DialRoutes)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TCPReceiveBufferSize < 0 || cfg.TCPSendBufferSize < 0 {
+		return nil, errors.New("negative TCP buffer size")
+	}
+	if cfg.LinkQueueSize < 0 || cfg.LinkBatchSize < 0 {
+		return nil, errors.New("negative link queue or batch size")
+	}
 	ipstack := stack.New(stack.Options{
 		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
 		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
@@ -199,36 +451,31 @@ func Create(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magi
 	if tcpipErr != nil {
 		return nil, fmt.Errorf("could not enable TCP SACK: %v", tcpipErr)
 	}
-	soRecv := tcpip.TCPReceiveBufferSizeRangeOption{
-		Min:     recvBufSize,
-		Default: recvBufSize,
-		Max:     recvBufSize,
-	}
-	tcpipErr = ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &soRecv)
-	if tcpipErr != nil {
-		return nil, fmt.Errorf("could not set recv buf size: %v", tcpipErr)
-	}
-	soSend := tcpip.TCPSendBufferSizeRangeOption{
-		Min:     sendBufSize,
-		Default: sendBufSize,
-		Max:     sendBufSize,
-	}
-	tcpipErr = ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &soSend)
-	if tcpipErr != nil {
-		return nil, fmt.Errorf("could not set send buf size: %v", tcpipErr)
+	if err := setTCPBufferSizes(ipstack, &cfg); err != nil {
+		return nil, err
 	}
 	rack := tcpip.TCPRecovery(0) // Disable RACK
 	tcpipErr = ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &rack)
 	if tcpipErr != nil {
 		return nil, fmt.Errorf("could not disable RACK: %v", tcpipErr)
 	}
-	cc := tcpip.CongestionControlOption(congestionControlCubic)
+	cc := tcpip.CongestionControlOption(cfg.congestionControl())
 	tcpipErr = ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &cc)
 	if tcpipErr != nil {
-		return nil, fmt.Errorf("could not set congestion control: %v", tcpipErr)
+		return nil, fmt.Errorf("could not set congestion control %q: %v", cc, tcpipErr)
+	}
+	if cfg.TCPMaxRetries > 0 {
+		maxRetries := tcpip.TCPMaxRetriesOption(cfg.TCPMaxRetries)
+		tcpipErr = ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &maxRetries)
+		if tcpipErr != nil {
+			return nil, fmt.Errorf("could not set TCP max retries: %v", tcpipErr)
+		}
 	}
 
-	linkEP := NewEndpoint(512, tstun.DefaultMTU(), "")
+	linkEP := NewEndpoint(cfg.linkQueueSize(), cfg.linkMTU(), "", EndpointOptions{
+		GSO: cfg.LinkGSO,
+		GRO: cfg.LinkGRO,
+	})
 	if tcpipProblem := ipstack.CreateNIC(nicID, linkEP); tcpipProblem != nil {
 		return nil, fmt.Errorf("could not create netstack NIC: %v", tcpipProblem)
 	}
@@ -262,20 +509,278 @@ func Create(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magi
 		dialer:              dialer,
 		connsOpenBySubnetIP: make(map[netip.Addr]int),
 		dns:                 dns,
+		cfg:                 cfg,
+		egressProxy:         cfg.EgressProxy,
+		httpIntercept:       cfg.HTTPIntercept,
+		ready:               make(chan struct{}),
+	}
+	ns.linkBatchSize.Store(int32(cfg.linkBatchSize()))
+	ns.dialRoutes.Store(dialRoutes)
+	if len(cfg.RawForwardProtocols) > 0 {
+		ns.rawForward = newRawForwarder(logf, cfg.RawForwardProtocols, tundev.InjectOutbound)
 	}
 	ns.ctx, ns.ctxCancel = context.WithCancel(context.Background())
 	ns.atomicIsLocalIPFunc.Store(tsaddr.NewContainsIPFunc(nil))
-	ns.tundev.PostFilterPacketInboundFromWireGaurd = ns.injectInbound
+	ns.tundev.PostFilterPacketInboundFromWireGuardGRO = ns.injectInboundGRO
+	ns.tundev.EndPacketVectorInboundFromWireGuardFlush = ns.linkEP.FlushGRO
 	ns.tundev.PreFilterPacketOutboundToWireGuardNetstackIntercept = ns.handleLocalPackets
 	return ns, nil
 }
 
+// setTCPBufferSizes sets the TCP receive and send buffer sizes, and whether
+// receive buffers are auto-tuned, used by new TCP endpoints created in
+// ipstack.
+func setTCPBufferSizes(ipstack *stack.Stack, cfg *Config) error {
+	recv, send := cfg.tcpReceiveBufferSize(), cfg.tcpSendBufferSize()
+	soRecv := tcpip.TCPReceiveBufferSizeRangeOption{
+		Min:     recv,
+		Default: recv,
+		Max:     recv,
+	}
+	if cfg.TCPModerateReceiveBuffer {
+		// Leave room for gVisor to grow the buffer from a small
+		// default up to recv.
+		soRecv.Min = min(tcp.MinBufferSize, recv)
+		soRecv.Default = cfg.tcpInitialReceiveBufferSize()
+	}
+	if tcpipErr := ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &soRecv); tcpipErr != nil {
+		return fmt.Errorf("could not set recv buf size: %v", tcpipErr)
+	}
+	soSend := tcpip.TCPSendBufferSizeRangeOption{
+		Min:     send,
+		Default: send,
+		Max:     send,
+	}
+	if tcpipErr := ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &soSend); tcpipErr != nil {
+		return fmt.Errorf("could not set send buf size: %v", tcpipErr)
+	}
+	moderate := tcpip.TCPModerateReceiveBufferOption(cfg.TCPModerateReceiveBuffer)
+	if tcpipErr := ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &moderate); tcpipErr != nil {
+		return fmt.Errorf("could not set receive buffer moderation: %v", tcpipErr)
+	}
+	return nil
+}
+
+// SetTCPBufferSizes changes the TCP receive and send buffer sizes, in
+// bytes, at runtime. A zero value restores the default for that buffer.
+// The new sizes apply to TCP connections established after the call;
+// existing connections keep the sizes they were created with.
+func (ns *Impl) SetTCPBufferSizes(recv, send int) error {
+	if recv < 0 || send < 0 {
+		return errors.New("negative TCP buffer size")
+	}
+	return ns.updateTCPBufferConfig(func(cfg *Config) {
+		cfg.TCPReceiveBufferSize = recv
+		cfg.TCPSendBufferSize = send
+	})
+}
+
+// SetTCPModerateReceiveBuffer enables or disables gVisor's TCP receive
+// buffer auto-tuning at runtime. See Config.TCPModerateReceiveBuffer.
+// Like SetTCPBufferSizes, it only affects new TCP connections.
+func (ns *Impl) SetTCPModerateReceiveBuffer(enable bool) error {
+	return ns.updateTCPBufferConfig(func(cfg *Config) {
+		cfg.TCPModerateReceiveBuffer = enable
+	})
+}
+
+// updateTCPBufferConfig applies the buffer settings of ns.cfg as modified
+// by f to the stack, and saves them if that succeeds.
+func (ns *Impl) updateTCPBufferConfig(f func(*Config)) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	cfg := ns.cfg
+	f(&cfg)
+	if err := setTCPBufferSizes(ns.ipstack, &cfg); err != nil {
+		return err
+	}
+	ns.cfg = cfg
+	if ns.tcpForwarder.Load() != nil {
+		ns.tcpForwarder.Store(ns.newTCPForwarderLocked())
+	}
+	return nil
+}
+
+// TCPBufferSizes returns the TCP receive and send buffer sizes, in bytes,
+// used for new TCP connections.
+func (ns *Impl) TCPBufferSizes() (recv, send int) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.cfg.tcpReceiveBufferSize(), ns.cfg.tcpSendBufferSize()
+}
+
+// SetLinkQueueSize changes the number of outbound packets buffered between
+// gVisor and WireGuard. Packets already queued are kept, unless there are
+// more than size of them, in which case the excess are discarded and
+// counted in the returned dropped value.
+func (ns *Impl) SetLinkQueueSize(size int) (dropped int, err error) {
+	if size <= 0 {
+		return 0, fmt.Errorf("invalid link queue size %d", size)
+	}
+	dropped = ns.linkEP.Resize(size)
+	if dropped > 0 {
+		ns.logf("netstack: link queue resized to %d; dropped %d packets", size, dropped)
+	}
+	return dropped, nil
+}
+
+// SetLinkBatchSize changes the maximum number of outbound packets
+// dequeued from the link endpoint at once.
+func (ns *Impl) SetLinkBatchSize(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("invalid link batch size %d", n)
+	}
+	ns.linkBatchSize.Store(int32(n))
+	return nil
+}
+
+// Stats are selected counters from the gVisor stack and the forwarder,
+// for monitoring and comparing throughput modes.
+type Stats struct {
+	DroppedPackets             uint64 // packets dropped by the stack for any reason
+	MalformedPackets           uint64 // malformed IP packets received
+	TCPChecksumErrors          uint64 // TCP segments with checksum errors
+	UDPChecksumErrors          uint64 // UDP datagrams with checksum errors
+	UDPReceiveBufferErrors     uint64 // UDP datagrams dropped due to full receive buffers
+	TCPRetransmits             uint64 // TCP segments retransmitted
+	TCPForwardMaxInFlightDrops uint64 // TCP SYNs dropped because too many connections were being forwarded
+	TCPForwardInFlight         int64  // TCP forwarder requests not yet accepted or reset
+	TCPForwardActive           int64  // forwarded TCP connections currently open
+}
+
+// Stats returns a snapshot of the stack's counters.
+func (ns *Impl) Stats() Stats {
+	st := ns.ipstack.Stats()
+	return Stats{
+		DroppedPackets:             st.DroppedPackets.Value(),
+		MalformedPackets:           st.IP.MalformedPacketsReceived.Value(),
+		TCPChecksumErrors:          st.TCP.ChecksumErrors.Value(),
+		UDPChecksumErrors:          st.UDP.ChecksumErrors.Value(),
+		UDPReceiveBufferErrors:     st.UDP.ReceiveBufferErrors.Value(),
+		TCPRetransmits:             st.TCP.Retransmits.Value(),
+		TCPForwardMaxInFlightDrops: st.TCP.ForwardMaxInFlightDrop.Value(),
+		TCPForwardInFlight:         ns.tcpForwardInFlight.Load(),
+		TCPForwardActive:           ns.tcpForwardActive.Load(),
+	}
+}
+
+// LinkStats describes the state of the link endpoint between gVisor and
+// WireGuard.
+type LinkStats struct {
+	QueueSize     int   // capacity of the outbound packet queue
+	Queued        int   // packets currently in the outbound queue
+	BatchSize     int   // max packets dequeued at once
+	BlockedWrites int64 // writes that found the queue full
+}
+
+// LinkStats returns the current state of the link endpoint.
+func (ns *Impl) LinkStats() LinkStats {
+	return LinkStats{
+		QueueSize:     ns.linkEP.QueueSize(),
+		Queued:        ns.linkEP.NumQueued(),
+		BatchSize:     int(ns.linkBatchSize.Load()),
+		BlockedWrites: ns.linkEP.NumBlockedWrites(),
+	}
+}
+
+// trackFlow registers a forwarded flow that closeFlow tears down, for
+// Drain. The returned func must be called once the flow is done.
+func (ns *Impl) trackFlow(closeFlow func()) (untrack func()) {
+	f := new(activeFlow)
+	ns.mu.Lock()
+	mak.Set(&ns.activeFlows, f, closeFlow)
+	ns.mu.Unlock()
+	return func() {
+		ns.mu.Lock()
+		defer ns.mu.Unlock()
+		delete(ns.activeFlows, f)
+		if len(ns.activeFlows) == 0 && ns.flowsDrained != nil {
+			close(ns.flowsDrained)
+			ns.flowsDrained = nil
+		}
+	}
+}
+
+// Drain stops netstack from accepting new TCP connections and UDP
+// sessions, and waits for the flows it's already forwarding to finish on
+// their own. If ctx is done first, the remaining flows are closed.
+// Drain returns the number of flows it closed.
+//
+// Drain is intended to be called before Close, which closes all flows
+// immediately, to let traffic finish gracefully. Once Drain has been
+// called, netstack rejects new flows until it's closed, except for
+// MagicDNS queries.
+//
+// Forwarded UDP sessions only end when they've been idle for a while, so
+// if any are open, Drain generally waits until ctx is done and then
+// closes them.
+func (ns *Impl) Drain(ctx context.Context) (terminated int) {
+	ns.draining.Store(true)
+
+	ns.mu.Lock()
+	if len(ns.activeFlows) == 0 {
+		ns.mu.Unlock()
+		return 0
+	}
+	if ns.flowsDrained == nil {
+		ns.flowsDrained = make(chan struct{})
+	}
+	drained := ns.flowsDrained
+	ns.logf("netstack: draining %d forwarded flows", len(ns.activeFlows))
+	ns.mu.Unlock()
+
+	select {
+	case <-drained:
+		return 0
+	case <-ctx.Done():
+	}
+
+	ns.mu.Lock()
+	closers := maps.Values(ns.activeFlows)
+	ns.mu.Unlock()
+	for _, closeFlow := range closers {
+		closeFlow()
+	}
+	if len(closers) > 0 {
+		ns.logf("netstack: drain timed out; closed %d forwarded flows", len(closers))
+	}
+	return len(closers)
+}
+
+// WaitReady blocks until ns is fully operational: its NIC, routes and
+// protocol handlers are installed, the goroutine delivering outbound
+// packets is running, and the addresses from the first network map have
+// been registered. It returns an error if ctx is done or ns is closed
+// first.
+//
+// Embedders should call it after Start and before their first Dial or
+// Listen on the stack.
+func (ns *Impl) WaitReady(ctx context.Context) error {
+	select {
+	case <-ns.ready:
+		return nil
+	case <-ns.ctx.Done():
+		return errors.New("netstack closed before becoming ready")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// maybeSetReady closes ns.ready if all the conditions documented on
+// WaitReady are met.
+func (ns *Impl) maybeSetReady() {
+	if ns.injectRunning.Load() && ns.addrsInstalled.Load() {
+		ns.readyOnce.Do(func() { close(ns.ready) })
+	}
+}
+
 func (ns *Impl) Close() error {
 	ns.ctxCancel()
 	// close the linkEP before attempting to close the IP stack, to ensure we unblock writes.
 	ns.linkEP.Close()
 	ns.ipstack.Close()
 	ns.ipstack.Wait()
+	ns.rawForward.Close()
 	return nil
 }
 
@@ -305,15 +810,31 @@ func (ns *Impl) Start(lb *ipnlocal.LocalBackend) error {
 		ns.lb = lb
 	}
 	ns.e.AddNetworkMapCallback(ns.updateIPs)
-	const maxInFlightConnectionAttempts = 1024
-	tcpFwd := tcp.NewForwarder(ns.ipstack, recvBufSize, maxInFlightConnectionAttempts, ns.acceptTCP)
-	udpFwd := udp.NewForwarder(ns.ipstack, ns.acceptUDP)
-	ns.ipstack.SetTransportProtocolHandler(tcp.ProtocolNumber, ns.wrapProtoHandler(tcpFwd.HandlePacket))
-	ns.ipstack.SetTransportProtocolHandler(udp.ProtocolNumber, ns.wrapProtoHandler(udpFwd.HandlePacket))
+	ns.installForwarders()
 	go ns.inject()
 	return nil
 }
 
+// installForwarders sets the TCP and UDP protocol handlers of ns.ipstack
+// to forward flows to acceptTCP and acceptUDP.
+func (ns *Impl) installForwarders() {
+	ns.mu.Lock()
+	ns.tcpForwarder.Store(ns.newTCPForwarderLocked())
+	ns.mu.Unlock()
+	udpFwd := udp.NewForwarder(ns.ipstack, ns.acceptUDP)
+	ns.ipstack.SetTransportProtocolHandler(tcp.ProtocolNumber, ns.wrapProtoHandler(func(id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
+		return ns.tcpForwarder.Load().HandlePacket(id, pkt)
+	}))
+	ns.ipstack.SetTransportProtocolHandler(udp.ProtocolNumber, ns.wrapProtoHandler(udpFwd.HandlePacket))
+}
+
+// newTCPForwarderLocked returns a TCP forwarder for the current ns.cfg.
+// ns.mu must be held.
+func (ns *Impl) newTCPForwarderLocked() *tcp.Forwarder {
+	const maxInFlightConnectionAttempts = 1024
+	return tcp.NewForwarder(ns.ipstack, ns.cfg.tcpInitialReceiveBufferSize(), maxInFlightConnectionAttempts, ns.acceptTCP)
+}
+
 func (ns *Impl) addSubnetAddress(ip netip.Addr) {
 	ns.mu.Lock()
 	ns.connsOpenBySubnetIP[ip]++
@@ -377,10 +898,14 @@ func (ns *Impl) updateIPs(nm *netmap.NetworkMap) {
 	newIPs := make(map[tcpip.AddressWithPrefix]bool)
 
 	isAddr := map[netip.Prefix]bool{}
+	var selfIPs []netip.Addr
 	if nm.SelfNode != nil {
 		for _, ipp := range nm.SelfNode.Addresses {
 			isAddr[ipp] = true
 			newIPs[ipPrefixToAddressWithPrefix(ipp)] = true
+			if ipp.IsSingleIP() {
+				selfIPs = append(selfIPs, ipp.Addr())
+			}
 		}
 		for _, ipp := range nm.SelfNode.AllowedIPs {
 			if !isAddr[ipp] && ns.ProcessSubnets {
@@ -389,6 +914,8 @@ func (ns *Impl) updateIPs(nm *netmap.NetworkMap) {
 		}
 	}
 
+	ns.selfIPs.Store(selfIPs)
+
 	ipsToBeAdded := make(map[tcpip.AddressWithPrefix]bool)
 	for ipp := range newIPs {
 		if !oldIPs[ipp] {
@@ -436,6 +963,28 @@ func (ns *Impl) updateIPs(nm *netmap.NetworkMap) {
 			ns.logf("[v2] netstack: registered IP %s", ipp)
 		}
 	}
+	if nm.SelfNode != nil && ns.hasAddresses(nm.SelfNode.Addresses) {
+		ns.addrsInstalled.Store(true)
+		ns.maybeSetReady()
+	}
+}
+
+// hasAddresses reports whether all of addrs, of which there's at least
+// one, are registered on the NIC.
+func (ns *Impl) hasAddresses(addrs []netip.Prefix) bool {
+	if len(addrs) == 0 {
+		return false
+	}
+	registered := make(map[tcpip.AddressWithPrefix]bool)
+	for _, pa := range ns.ipstack.AllAddresses()[nicID] {
+		registered[pa.AddressWithPrefix] = true
+	}
+	for _, ipp := range addrs {
+		if !registered[ipPrefixToAddressWithPrefix(ipp)] {
+			return false
+		}
+	}
+	return true
 }
 
 // handleLocalPackets is hooked into the tun datapath for packets leaving
@@ -518,9 +1067,18 @@ func (ns *Impl) DialContextUDP(ctx context.Context, ipp netip.AddrPort) (*gonet.
 // The inject goroutine reads in packets that netstack generated, and delivers
 // them to the correct path.
 func (ns *Impl) inject() {
+	ns.injectRunning.Store(true)
+	ns.maybeSetReady()
+
+	var pkts []*stack.PacketBuffer
 	for {
-		pkt := ns.linkEP.ReadContext(ns.ctx)
-		if pkt == nil {
+		batchSize := int(ns.linkBatchSize.Load())
+		if cap(pkts) < batchSize {
+			pkts = make([]*stack.PacketBuffer, batchSize)
+		}
+		pkts = pkts[:batchSize]
+		n := ns.linkEP.ReadBatchContext(ns.ctx, pkts)
+		if n == 0 {
 			if ns.ctx.Err() != nil {
 				// Return without logging.
 				return
@@ -529,55 +1087,69 @@ func (ns *Impl) inject() {
 			continue
 		}
 
-		if debugPackets {
-			ns.logf("[v2] packet Write out: % x", stack.PayloadSince(pkt.NetworkHeader()))
+		for i, pkt := range pkts[:n] {
+			pkts[i] = nil
+			if err := ns.injectPacket(pkt); err != nil {
+				log.Printf("netstack inject: %v", err)
+				for _, pkt := range pkts[i+1 : n] {
+					pkt.DecRef()
+				}
+				return
+			}
 		}
+	}
+}
 
-		// In the normal case, netstack synthesizes the bytes for
-		// traffic which should transit back into WG and go to peers.
-		// However, some uses of netstack (presently, magic DNS)
-		// send traffic destined for the local device, hence must
-		// be injected 'inbound'.
-		sendToHost := false
-
-		// Determine if the packet is from a service IP, in which case it
-		// needs to go back into the machines network (inbound) instead of
-		// out.
-		// TODO(tom): Work out a way to avoid parsing packets to determine if
-		//            its from the service IP. Maybe gvisor netstack magic. I
-		//            went through the fields of PacketBuffer, and nop :/
-		// TODO(tom): Figure out if its safe to modify packet.Parsed to fill in
-		//            the IP src/dest even if its missing the rest of the pkt.
-		//            That way we dont have to do this twitchy-af byte-yeeting.
-		if b := pkt.NetworkHeader().Slice(); len(b) >= 20 { // min ipv4 header
-			switch b[0] >> 4 { // ip proto field
-			case 4:
-				if srcIP := netaddr.IPv4(b[12], b[13], b[14], b[15]); magicDNSIP == srcIP {
+// injectPacket delivers one packet that netstack generated to the correct
+// path. It takes ownership of one reference to pkt.
+func (ns *Impl) injectPacket(pkt *stack.PacketBuffer) error {
+	if debugPackets {
+		ns.logf("[v2] packet Write out: % x", stack.PayloadSince(pkt.NetworkHeader()))
+	}
+
+	// In the normal case, netstack synthesizes the bytes for
+	// traffic which should transit back into WG and go to peers.
+	// However, some uses of netstack (presently, magic DNS)
+	// send traffic destined for the local device, hence must
+	// be injected 'inbound'.
+	sendToHost := false
+
+	// Determine if the packet is from a service IP, in which case it
+	// needs to go back into the machines network (inbound) instead of
+	// out.
+	// TODO(tom): Work out a way to avoid parsing packets to determine if
+	//            its from the service IP. Maybe gvisor netstack magic. I
+	//            went through the fields of PacketBuffer, and nop :/
+	// TODO(tom): Figure out if its safe to modify packet.Parsed to fill in
+	//            the IP src/dest even if its missing the rest of the pkt.
+	//            That way we dont have to do this twitchy-af byte-yeeting.
+	if b := pkt.NetworkHeader().Slice(); len(b) >= 20 { // min ipv4 header
+		switch b[0] >> 4 { // ip proto field
+		case 4:
+			if srcIP := netaddr.IPv4(b[12], b[13], b[14], b[15]); magicDNSIP == srcIP {
+				sendToHost = true
+			}
+		case 6:
+			if len(b) >= 40 { // min ipv6 header
+				if srcIP, ok := netip.AddrFromSlice(net.IP(b[8:24])); ok && magicDNSIPv6 == srcIP {
 					sendToHost = true
 				}
-			case 6:
-				if len(b) >= 40 { // min ipv6 header
-					if srcIP, ok := netip.AddrFromSlice(net.IP(b[8:24])); ok && magicDNSIPv6 == srcIP {
-						sendToHost = true
-					}
-				}
 			}
 		}
+	}
 
-		// pkt has a non-zero refcount, so injection methods takes
-		// ownership of one count and will decrement on completion.
-		if sendToHost {
-			if err := ns.tundev.InjectInboundPacketBuffer(pkt); err != nil {
-				log.Printf("netstack inject inbound: %v", err)
-				return
-			}
-		} else {
-			if err := ns.tundev.InjectOutboundPacketBuffer(pkt); err != nil {
-				log.Printf("netstack inject outbound: %v", err)
-				return
-			}
+	// pkt has a non-zero refcount, so injection methods takes
+	// ownership of one count and will decrement on completion.
+	if sendToHost {
+		if err := ns.tundev.InjectInboundPacketBuffer(pkt); err != nil {
+			return fmt.Errorf("inbound: %w", err)
+		}
+	} else {
+		if err := ns.tundev.InjectOutboundPacketBuffer(pkt); err != nil {
+			return fmt.Errorf("outbound: %w", err)
 		}
 	}
+	return nil
 }
 
 // isLocalIP reports whether ip is a Tailscale IP assigned to this
@@ -603,6 +1175,11 @@ func (ns *Impl) shouldProcessInbound(p *packet.Parsed, t *tstun.Wrapper) bool {
 	dstIP := p.Dst.Addr()
 	isLocal := ns.isLocalIP(dstIP)
 
+	// Handle traffic to listeners from Listen and ListenPacket.
+	if isLocal && (p.IPProto == ipproto.TCP || p.IPProto == ipproto.UDP) && ns.isListening(p.IPProto, p.Dst) {
+		return true
+	}
+
 	// Handle TCP connection to the Tailscale IP(s) in some cases:
 	if ns.lb != nil && p.IPProto == ipproto.TCP && isLocal {
 		var peerAPIPort uint16
@@ -722,23 +1299,39 @@ func (ns *Impl) userPing(dstIP netip.Addr, pingResPkt []byte) {
 	}
 }
 
-// injectInbound is installed as a packet hook on the 'inbound' (from a
+// injectInbound is injectInboundGRO for a single packet.
+func (ns *Impl) injectInbound(p *packet.Parsed, t *tstun.Wrapper) filter.Response {
+	res, g := ns.injectInboundGRO(p, t, nil)
+	ns.linkEP.FlushGRO(g)
+	return res
+}
+
+// injectInboundGRO is installed as a packet hook on the 'inbound' (from a
 // WireGuard peer) path. Returning filter.Accept releases the packet to
 // continue normally (typically being delivered to the host networking stack),
 // whereas returning filter.DropSilently is done when netstack intercepts the
 // packet and no further processing towards to host should be done.
-func (ns *Impl) injectInbound(p *packet.Parsed, t *tstun.Wrapper) filter.Response {
+// Packets netstack intercepts are coalesced with g, per
+// Endpoint.InjectInboundGRO.
+func (ns *Impl) injectInboundGRO(p *packet.Parsed, t *tstun.Wrapper, g *gro.GRO) (filter.Response, *gro.GRO) {
 	if ns.ctx.Err() != nil {
-		return filter.DropSilently
+		return filter.DropSilently, g
 	}
 
 	if !ns.shouldProcessInbound(p, t) {
 		// Let the host network stack (if any) deal with it.
-		return filter.Accept
+		return filter.Accept, g
 	}
 
 	destIP := p.Dst.Addr()
 
+	// gVisor only handles TCP, UDP and ICMP, so forward the other
+	// protocols we're configured to for subnet routes ourselves.
+	if ns.rawForward.handles(p.IPProto) && ns.ProcessSubnets && !ns.isLocalIP(destIP) && !viaRange.Contains(destIP) {
+		ns.rawForward.forward(p)
+		return filter.DropSilently, g
+	}
+
 	// If this is an echo request and we're a subnet router, handle pings
 	// ourselves instead of forwarding the packet on.
 	pingIP, handlePing := ns.shouldHandlePing(p)
@@ -754,7 +1347,7 @@ func (ns *Impl) injectInbound(p *packet.Parsed, t *tstun.Wrapper) filter.Respons
 			pong = packet.Generate(&h, p.Payload())
 		}
 		go ns.userPing(pingIP, pong)
-		return filter.DropSilently
+		return filter.DropSilently, g
 	}
 
 	var pn tcpip.NetworkProtocolNumber
@@ -770,7 +1363,7 @@ func (ns *Impl) injectInbound(p *packet.Parsed, t *tstun.Wrapper) filter.Respons
 	packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
 		Payload: buffer.MakeWithData(bytes.Clone(p.Buffer())),
 	})
-	ns.linkEP.InjectInbound(pn, packetBuf)
+	g = ns.linkEP.InjectInboundGRO(g, pn, packetBuf)
 	packetBuf.DecRef()
 
 	// We've now delivered this to netstack, so we're done.
@@ -779,7 +1372,7 @@ func (ns *Impl) injectInbound(p *packet.Parsed, t *tstun.Wrapper) filter.Respons
 	// filter.Drop (which would log about rejected traffic),
 	// instead return filter.DropSilently which just quietly stops
 	// processing it in the tstun TUN wrapper.
-	return filter.DropSilently
+	return filter.DropSilently, g
 }
 
 // shouldHandlePing returns whether or not netstack should handle an incoming
@@ -848,6 +1441,13 @@ func netaddrIPFromNetstackIP(s tcpip.Address) netip.Addr {
 }
 
 func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
+	// Track the request as in flight until it's completed, as the
+	// forwarder does for its maxInFlight limit.
+	ns.tcpForwardInFlight.Add(1)
+	complete := func(sendReset bool) {
+		r.Complete(sendReset)
+		ns.tcpForwardInFlight.Add(-1)
+	}
 	reqDetails := r.ID()
 	if debugNetstack() {
 		ns.logf("[v2] TCP ForwarderRequest: %s", stringifyTEI(reqDetails))
@@ -855,7 +1455,7 @@ func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
 	clientRemoteIP := netaddrIPFromNetstackIP(reqDetails.RemoteAddress)
 	if !clientRemoteIP.IsValid() {
 		ns.logf("invalid RemoteAddress in TCP ForwarderRequest: %s", stringifyTEI(reqDetails))
-		r.Complete(true) // sends a RST
+		complete(true) // sends a RST
 		return
 	}
 	clientRemotePort := reqDetails.RemotePort
@@ -864,7 +1464,21 @@ func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
 	dialIP := netaddrIPFromNetstackIP(reqDetails.LocalAddress)
 	isTailscaleIP := tsaddr.IsTailscaleIP(dialIP)
 
+	// While draining, only MagicDNS keeps working. Other flows are
+	// tracked from here on, so that Drain waits for (or closes) them
+	// even while the backend is still being dialed.
+	isMagicDNS := dialIP == magicDNSIP || dialIP == magicDNSIPv6
 	dstAddrPort := netip.AddrPortFrom(dialIP, reqDetails.LocalPort)
+	fc := new(flowCloser)
+	if !isMagicDNS {
+		fc.log = ns.newFlowLog(ipproto.TCP, clientRemoteAddrPort, dstAddrPort)
+		if ns.draining.Load() {
+			fc.log.reject("draining")
+			complete(true) // sends a RST
+			return
+		}
+		defer ns.trackFlow(fc.close)()
+	}
 
 	if viaRange.Contains(dialIP) {
 		isTailscaleIP = false
@@ -889,10 +1503,11 @@ func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
 		ep, err := r.CreateEndpoint(&wq)
 		if err != nil {
 			ns.logf("CreateEndpoint error for %s: %v", stringifyTEI(reqDetails), err)
-			r.Complete(true) // sends a RST
+			fc.log.reject("create endpoint failed")
+			complete(true) // sends a RST
 			return nil
 		}
-		r.Complete(false)
+		complete(false)
 		for _, opt := range opts {
 			ep.SetSockOpt(opt)
 		}
@@ -919,11 +1534,13 @@ func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
 		// gonet.TCPConn.RemoteAddr. The byte copies in both
 		// directions to/from the gonet.TCPConn in forwardTCP will
 		// block until the TCP handshake is complete.
-		return gonet.NewTCPConn(&wq, ep)
+		c := gonet.NewTCPConn(&wq, ep)
+		fc.add(func() { c.Close() })
+		return c
 	}
 
 	// DNS
-	if reqDetails.LocalPort == 53 && (dialIP == magicDNSIP || dialIP == magicDNSIPv6) {
+	if reqDetails.LocalPort == 53 && isMagicDNS {
 		c := getConnOrReset()
 		if c == nil {
 			return
@@ -939,7 +1556,8 @@ func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
 			if c == nil {
 				return
 			}
-			handler(c)
+			fc.log.open(FlowAccepted)
+			handler(fc.log.conn(c))
 			return
 		}
 	}
@@ -948,14 +1566,16 @@ func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
 		handler, opts, ok := ns.GetTCPHandlerForFlow(clientRemoteAddrPort, dstAddrPort)
 		if ok {
 			if handler == nil {
-				r.Complete(true)
+				fc.log.reject("intercepted")
+				complete(true)
 				return
 			}
 			c := getConnOrReset(opts...) // will send a RST if it fails
 			if c == nil {
 				return
 			}
-			handler(c)
+			fc.log.open(FlowAccepted)
+			handler(fc.log.conn(c))
 			return
 		}
 	}
@@ -964,12 +1584,28 @@ func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
 	}
 	dialAddr := netip.AddrPortFrom(dialIP, uint16(reqDetails.LocalPort))
 
-	if !ns.forwardTCP(getConnOrReset, clientRemoteIP, &wq, dialAddr) {
-		r.Complete(true) // sends a RST
+	if !isTailscaleIP && ns.httpIntercept != nil {
+		if ns.interceptHTTP(getConnOrReset, clientRemoteAddrPort, &wq, dstAddrPort, dialAddr, fc) {
+			return
+		}
+	}
+
+	if !ns.forwardTCP(getConnOrReset, clientRemoteIP, &wq, dialAddr, fc) {
+		fc.log.reject("dial failed")
+		complete(true) // sends a RST
 	}
 }
 
-func (ns *Impl) forwardTCP(getClient func(...tcpip.SettableSocketOption) *gonet.TCPConn, clientRemoteIP netip.Addr, wq *waiter.Queue, dialAddr netip.AddrPort) (handled bool) {
+// forwardTCP dials dialAddr and copies data between it and the client
+// returned by getClient. The dial and the backend connection are
+// registered with fc, which getClient also registers the client with.
+func (ns *Impl) forwardTCP(getClient func(...tcpip.SettableSocketOption) *gonet.TCPConn, clientRemoteIP netip.Addr, wq *waiter.Queue, dialAddr netip.AddrPort, fc *flowCloser) (handled bool) {
+	return ns.forwardTCPPrefixed(getClient, nil, clientRemoteIP, wq, dialAddr, fc)
+}
+
+// forwardTCPPrefixed is forwardTCP for a client from which prefix was
+// already read. It's written to the backend first.
+func (ns *Impl) forwardTCPPrefixed(getClient func(...tcpip.SettableSocketOption) *gonet.TCPConn, prefix []byte, clientRemoteIP netip.Addr, wq *waiter.Queue, dialAddr netip.AddrPort, fc *flowCloser) (handled bool) {
 	dialAddrStr := dialAddr.String()
 	if debugNetstack() {
 		ns.logf("[v2] netstack: forwarding incoming connection to %s", dialAddrStr)
@@ -977,6 +1613,7 @@ func (ns *Impl) forwardTCP(getClient func(...tcpip.SettableSocketOption) *gonet.
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	fc.add(cancel)
 
 	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.EventHUp) // TODO(bradfitz): right EventMask?
 	wq.EventRegister(&waitEntry)
@@ -997,13 +1634,21 @@ func (ns *Impl) forwardTCP(getClient func(...tcpip.SettableSocketOption) *gonet.
 	}()
 
 	// Attempt to dial the outbound connection before we accept the inbound one.
-	var stdDialer net.Dialer
-	server, err := stdDialer.DialContext(ctx, "tcp", dialAddrStr)
+	dial := ns.dialFunc(dialAddr.Addr())
+	server, proxied, err := ns.dialProxy(ctx, dialAddr)
+	if proxied {
+		if err != nil {
+			ns.logf("netstack: could not connect to %s via proxy: %v", dialAddrStr, err)
+			return
+		}
+	} else {
+		server, err = dial(ctx, "tcp", dialAddrStr)
+	}
 	if err != nil {
 		// Coder: Retry with loopback IPv6 if the dial was for 127.0.0.1.
 		if dialAddr.Addr().Is4() && dialAddr.Addr().String() == "127.0.0.1" {
 			ipv6DialAddr := netip.AddrPortFrom(netip.IPv6Loopback(), dialAddr.Port())
-			server, err = stdDialer.DialContext(ctx, "tcp", ipv6DialAddr.String())
+			server, err = dial(ctx, "tcp", ipv6DialAddr.String())
 			if err == nil {
 				if debugNetstack() {
 					ns.logf("[coder] netstack: successful IPv4 loopback => IPv6 loopback redirect: original = %s, new = %s", dialAddrStr, ipv6DialAddr.String())
@@ -1020,6 +1665,7 @@ func (ns *Impl) forwardTCP(getClient func(...tcpip.SettableSocketOption) *gonet.
 		}
 	}
 	defer server.Close()
+	fc.add(func() { server.Close() })
 
 	// If we get here, either the getClient call below will succeed and
 	// return something we can Close, or it will fail and will properly
@@ -1034,17 +1680,33 @@ func (ns *Impl) forwardTCP(getClient func(...tcpip.SettableSocketOption) *gonet.
 	}
 	defer client.Close()
 
-	backendLocalAddr := server.LocalAddr().(*net.TCPAddr)
-	backendLocalIPPort := netaddr.Unmap(backendLocalAddr.AddrPort())
-	ns.e.RegisterIPPortIdentity(backendLocalIPPort, clientRemoteIP)
-	defer ns.e.UnregisterIPPortIdentity(backendLocalIPPort)
+	ns.tcpForwardActive.Add(1)
+	defer ns.tcpForwardActive.Add(-1)
+
+	// Connections through a proxy don't originate from a local port the
+	// backend can look up, so there's no identity to register.
+	if backendLocalAddr, ok := server.LocalAddr().(*net.TCPAddr); ok && !proxied {
+		backendLocalIPPort := netaddr.Unmap(backendLocalAddr.AddrPort())
+		ns.e.RegisterIPPortIdentity(backendLocalIPPort, clientRemoteIP)
+		defer ns.e.UnregisterIPPortIdentity(backendLocalIPPort)
+	}
+	fc.log.open(FlowForwarded)
+	if len(prefix) > 0 {
+		if _, err := server.Write(prefix); err != nil {
+			ns.logf("netstack: writing to %s: %v", dialAddrStr, err)
+			fc.log.close(err)
+			return
+		}
+	}
 	connClosed := make(chan error, 2)
 	go func() {
-		_, err := io.Copy(server, client)
+		n, err := io.Copy(server, client)
+		fc.log.copied(true, n+int64(len(prefix)), err)
 		connClosed <- err
 	}()
 	go func() {
-		_, err := io.Copy(client, server)
+		n, err := io.Copy(client, server)
+		fc.log.copied(false, n, err)
 		connClosed <- err
 	}()
 	err = <-connClosed
@@ -1055,11 +1717,41 @@ func (ns *Impl) forwardTCP(getClient func(...tcpip.SettableSocketOption) *gonet.
 	return
 }
 
+// dialProxy dials dialAddr through the proxy selected by the configured
+// EgressProxy func, if any. It reports proxied=false if the caller should
+// dial dialAddr directly instead.
+func (ns *Impl) dialProxy(ctx context.Context, dialAddr netip.AddrPort) (_ net.Conn, proxied bool, _ error) {
+	if ns.egressProxy == nil {
+		return nil, false, nil
+	}
+	proxyURL, err := ns.egressProxy(dialAddr)
+	if err != nil {
+		return nil, true, err
+	}
+	if proxyURL == nil {
+		return nil, false, nil
+	}
+	if debugNetstack() {
+		ns.logf("[v2] netstack: dialing %s via proxy %s", dialAddr, proxyURL.Redacted())
+	}
+	c, err := ns.dialer.ProxyDial(ctx, proxyURL, "tcp", dialAddr.String())
+	return c, true, err
+}
+
 func (ns *Impl) acceptUDP(r *udp.ForwarderRequest) {
 	sess := r.ID()
 	if debugNetstack() {
 		ns.logf("[v2] UDP ForwarderRequest: %v", stringifyTEI(sess))
 	}
+	if ns.draining.Load() {
+		// Keep MagicDNS working while draining.
+		if dst := netaddrIPFromNetstackIP(sess.LocalAddress); dst != magicDNSIP && dst != magicDNSIPv6 {
+			srcAddr, _ := ipPortOfNetstackAddr(sess.RemoteAddress, sess.RemotePort)
+			dstAddr, _ := ipPortOfNetstackAddr(sess.LocalAddress, sess.LocalPort)
+			ns.newFlowLog(ipproto.UDP, srcAddr, dstAddr).reject("draining")
+			return
+		}
+	}
 	var wq waiter.Queue
 	ep, err := r.CreateEndpoint(&wq)
 	if err != nil {
@@ -1089,20 +1781,23 @@ func (ns *Impl) acceptUDP(r *udp.ForwarderRequest) {
 		return
 	}
 
+	flog := ns.newFlowLog(ipproto.UDP, srcAddr, dstAddr)
 	if get := ns.GetUDPHandlerForFlow; get != nil {
 		h, intercept := get(srcAddr, dstAddr)
 		if intercept {
 			if h == nil {
+				flog.reject("intercepted")
 				ep.Close()
 				return
 			}
-			go h(gonet.NewUDPConn(&wq, ep))
+			flog.open(FlowAccepted)
+			go h(flog.packetConn(gonet.NewUDPConn(&wq, ep)))
 			return
 		}
 	}
 
 	c := gonet.NewUDPConn(&wq, ep)
-	go ns.forwardUDP(c, srcAddr, dstAddr)
+	go ns.forwardUDP(c, srcAddr, dstAddr, flog)
 }
 
 func (ns *Impl) handleMagicDNSUDP(srcAddr netip.AddrPort, c *gonet.UDPConn) {
@@ -1146,7 +1841,9 @@ func (ns *Impl) handleMagicDNSUDP(srcAddr netip.AddrPort, c *gonet.UDPConn) {
 // dstAddr may be either a local Tailscale IP, in which we case we proxy to
 // 127.0.0.1, or any other IP (from an advertised subnet), in which case we
 // proxy to it directly.
-func (ns *Impl) forwardUDP(client *gonet.UDPConn, clientAddr, dstAddr netip.AddrPort) {
+//
+// The flow is reported to flog, which may be nil.
+func (ns *Impl) forwardUDP(client *gonet.UDPConn, clientAddr, dstAddr netip.AddrPort, flog *flowLog) {
 	port, srcPort := dstAddr.Port(), clientAddr.Port()
 	if debugNetstack() {
 		ns.logf("[v2] netstack: forwarding incoming UDP connection on port %v", port)
@@ -1177,6 +1874,7 @@ func (ns *Impl) forwardUDP(client *gonet.UDPConn, clientAddr, dstAddr netip.Addr
 		backendConn, err = net.ListenUDP("udp", backendListenAddr)
 		if err != nil {
 			ns.logf("netstack: could not create UDP socket, preventing forwarding to %v: %v", dstAddr, err)
+			flog.reject("backend socket failed")
 			return
 		}
 	}
@@ -1213,7 +1911,13 @@ func (ns *Impl) forwardUDP(client *gonet.UDPConn, clientAddr, dstAddr netip.Addr
 	extend := func() {
 		timer.Reset(idleTimeout)
 	}
+	untrack := ns.trackFlow(func() {
+		cancel()
+		client.Close()
+		backendConn.Close()
+	})
 	go func() {
+		defer untrack()
 		select {
 		case <-ctx.Done():
 			return
@@ -1222,8 +1926,13 @@ func (ns *Impl) forwardUDP(client *gonet.UDPConn, clientAddr, dstAddr netip.Addr
 		client.Close()
 		backendConn.Close()
 	}()
-	startPacketCopy(ctx, cancel, client, net.UDPAddrFromAddrPort(clientAddr), backendConn, ns.logf, extend)
-	startPacketCopy(ctx, cancel, backendConn, backendRemoteAddr, client, ns.logf, extend)
+	flog.open(FlowForwarded)
+	startPacketCopy(ctx, cancel, client, net.UDPAddrFromAddrPort(clientAddr), backendConn, ns.logf, extend, func(n int64, err error) {
+		flog.copied(false, n, err)
+	})
+	startPacketCopy(ctx, cancel, backendConn, backendRemoteAddr, client, ns.logf, extend, func(n int64, err error) {
+		flog.copied(true, n, err)
+	})
 	if isLocal {
 		// Wait for the copies to be done before decrementing the
 		// subnet address count to potentially remove the route.
@@ -1232,12 +1941,19 @@ func (ns *Impl) forwardUDP(client *gonet.UDPConn, clientAddr, dstAddr netip.Addr
 	}
 }
 
-func startPacketCopy(ctx context.Context, cancel context.CancelFunc, dst net.PacketConn, dstAddr net.Addr, src net.PacketConn, logf logger.Logf, extend func()) {
+// startPacketCopy starts copying packets from src to dstAddr via dst,
+// until ctx is done or either fails. It then calls copied with the number
+// of bytes copied and the error that stopped it, which is nil if ctx was
+// done.
+func startPacketCopy(ctx context.Context, cancel context.CancelFunc, dst net.PacketConn, dstAddr net.Addr, src net.PacketConn, logf logger.Logf, extend func(), copied func(n int64, err error)) {
 	if debugNetstack() {
 		logf("[v2] netstack: startPacketCopy to %v (%T) from %T", dstAddr, dst, src)
 	}
 	go func() {
 		defer cancel() // tear down the other direction's copy
+		var total int64
+		var copyErr error
+		defer func() { copied(total, copyErr) }()
 		pkt := make([]byte, maxUDPPacketSize)
 		for {
 			select {
@@ -1248,6 +1964,7 @@ func startPacketCopy(ctx context.Context, cancel context.CancelFunc, dst net.Pac
 				if err != nil {
 					if ctx.Err() == nil {
 						logf("read packet from %s failed: %v", srcAddr, err)
+						copyErr = err
 					}
 					return
 				}
@@ -1255,9 +1972,11 @@ func startPacketCopy(ctx context.Context, cancel context.CancelFunc, dst net.Pac
 				if err != nil {
 					if ctx.Err() == nil {
 						logf("write packet to %s failed: %v", dstAddr, err)
+						copyErr = err
 					}
 					return
 				}
+				total += int64(n)
 				if debugNetstack() {
 					logf("[v2] wrote UDP packet %s -> %s", srcAddr, dstAddr)
 				}
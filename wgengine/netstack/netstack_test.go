@@ -4,22 +4,47 @@
 package netstack
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"net/netip"
+	"net/url"
+	"os"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/stack/gro"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/net/packet"
+	"tailscale.com/net/socks5"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/net/tstun"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tsd"
 	"tailscale.com/tstest"
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/logid"
+	"tailscale.com/types/netmap"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/filter"
 )
@@ -86,6 +111,16 @@ func getMemStats() (ms runtime.MemStats) {
 }
 
 func makeNetstack(t *testing.T, config func(*Impl)) *Impl {
+	ns, lb := newTestNetstack(t, config)
+	if err := ns.Start(lb); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return ns
+}
+
+// newTestNetstack returns a new Impl that treats every IP as local, and the
+// LocalBackend to Start it with.
+func newTestNetstack(t *testing.T, config func(*Impl)) (*Impl, *ipnlocal.LocalBackend) {
 	tunDev := tstun.NewFake()
 	sys := &tsd.System{}
 	sys.Set(new(mem.Store))
@@ -117,10 +152,125 @@ func makeNetstack(t *testing.T, config func(*Impl)) *Impl {
 	if config != nil {
 		config(ns)
 	}
-	if err := ns.Start(lb); err != nil {
-		t.Fatalf("Start: %v", err)
+	return ns, lb
+}
+
+var (
+	testNetstackIP = netip.MustParseAddr("100.64.0.1")
+	testClientIP   = netip.MustParseAddr("100.64.0.2")
+)
+
+// makeForwardingNetstack returns an Impl forwarding flows to local
+// backends, and a client gVisor stack whose link is wired directly to the
+// Impl's link endpoint. Connections the client makes to testNetstackIP go
+// through acceptTCP and forwardTCP to 127.0.0.1 on the same port.
+func makeForwardingNetstack(t *testing.T, config func(*Impl)) (*Impl, *stack.Stack) {
+	ns, lb := newTestNetstack(t, config)
+	ns.lb = lb
+	ns.installForwarders()
+	ns.updateIPs(&netmap.NetworkMap{
+		SelfNode: &tailcfg.Node{
+			Addresses: []netip.Prefix{netip.PrefixFrom(testNetstackIP, 32)},
+		},
+	})
+
+	client := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	t.Cleanup(func() {
+		client.Close()
+		client.Wait()
+	})
+	clientEP := NewEndpoint(64, 1280, "", EndpointOptions{})
+	t.Cleanup(clientEP.Close)
+	if err := client.CreateNIC(nicID, clientEP); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddProtocolAddress(nicID, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFromSlice(testClientIP.AsSlice()).WithPrefix(),
+	}, stack.AddressProperties{}); err != nil {
+		t.Fatal(err)
+	}
+	anyV4, _ := tcpip.NewSubnet(tcpip.AddrFromSlice(make([]byte, 4)), tcpip.MaskFromBytes(make([]byte, 4)))
+	client.SetRouteTable([]tcpip.Route{{Destination: anyV4, NIC: nicID}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go pumpPackets(ctx, clientEP, ns.linkEP)
+	go pumpPackets(ctx, ns.linkEP, clientEP)
+	return ns, client
+}
+
+// pumpPackets copies IPv4 packets written to from into to until ctx is done.
+func pumpPackets(ctx context.Context, from, to *Endpoint) {
+	for {
+		pkt := from.ReadContext(ctx)
+		if pkt == nil {
+			return
+		}
+		v := stack.PayloadSince(pkt.NetworkHeader())
+		b := bytes.Clone(v.AsSlice())
+		v.Release()
+		pkt.DecRef()
+		np := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Payload: buffer.MakeWithData(b),
+		})
+		to.InjectInbound(header.IPv4ProtocolNumber, np)
+		np.DecRef()
+	}
+}
+
+// dialThroughNetstack dials port on testNetstackIP from client.
+func dialThroughNetstack(t *testing.T, client *stack.Stack, port uint16) (*gonet.TCPConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return gonet.DialContextTCP(ctx, client, tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.AddrFromSlice(testNetstackIP.AsSlice()),
+		Port: port,
+	}, ipv4.ProtocolNumber)
+}
+
+// startEchoServer starts a TCP echo server on 127.0.0.1 and returns its
+// port.
+func startEchoServer(t *testing.T) uint16 {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// checkEcho writes a message to c and checks it's echoed back.
+func checkEcho(t *testing.T, c net.Conn) {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	const msg = "hello"
+	if _, err := io.WriteString(c, msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Errorf("got %q; want %q", buf, msg)
 	}
-	return ns
 }
 
 func TestShouldHandlePing(t *testing.T) {
@@ -455,3 +605,856 @@ func TestShouldProcessInbound(t *testing.T) {
 		})
 	}
 }
+
+func TestSetTCPBufferSizes(t *testing.T) {
+	ns := makeNetstack(t, nil)
+
+	checkSizes := func(wantRecv, wantSend int) {
+		t.Helper()
+		if recv, send := ns.TCPBufferSizes(); recv != wantRecv || send != wantSend {
+			t.Errorf("TCPBufferSizes() = %v, %v; want %v, %v", recv, send, wantRecv, wantSend)
+		}
+		var soRecv tcpip.TCPReceiveBufferSizeRangeOption
+		if err := ns.ipstack.TransportProtocolOption(tcp.ProtocolNumber, &soRecv); err != nil {
+			t.Fatal(err)
+		}
+		if soRecv.Default != wantRecv {
+			t.Errorf("stack recv buf size = %v; want %v", soRecv.Default, wantRecv)
+		}
+		var soSend tcpip.TCPSendBufferSizeRangeOption
+		if err := ns.ipstack.TransportProtocolOption(tcp.ProtocolNumber, &soSend); err != nil {
+			t.Fatal(err)
+		}
+		if soSend.Default != wantSend {
+			t.Errorf("stack send buf size = %v; want %v", soSend.Default, wantSend)
+		}
+	}
+
+	checkSizes(recvBufSize, sendBufSize)
+
+	if err := ns.SetTCPBufferSizes(16*megabytes, 12*megabytes); err != nil {
+		t.Fatal(err)
+	}
+	checkSizes(16*megabytes, 12*megabytes)
+
+	if err := ns.SetTCPBufferSizes(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	checkSizes(recvBufSize, sendBufSize)
+
+	if err := ns.SetTCPBufferSizes(-1, 0); err == nil {
+		t.Error("SetTCPBufferSizes with negative size succeeded; want error")
+	}
+}
+
+func TestSetTCPModerateReceiveBuffer(t *testing.T) {
+	echoPort := startEchoServer(t)
+	ns, client := makeForwardingNetstack(t, nil)
+
+	checkModerate := func(want bool) {
+		t.Helper()
+		var moderate tcpip.TCPModerateReceiveBufferOption
+		if err := ns.ipstack.TransportProtocolOption(tcp.ProtocolNumber, &moderate); err != nil {
+			t.Fatal(err)
+		}
+		if bool(moderate) != want {
+			t.Errorf("moderate receive buffer = %v; want %v", moderate, want)
+		}
+		var soRecv tcpip.TCPReceiveBufferSizeRangeOption
+		if err := ns.ipstack.TransportProtocolOption(tcp.ProtocolNumber, &soRecv); err != nil {
+			t.Fatal(err)
+		}
+		if soRecv.Max != recvBufSize {
+			t.Errorf("recv buf max = %v; want %v", soRecv.Max, recvBufSize)
+		}
+
+		// Forwarded connections start small when moderating, and at
+		// the full size otherwise.
+		c, err := dialThroughNetstack(t, client, echoPort)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer c.Close()
+		checkEcho(t, c)
+		wantInitial := int64(recvBufSize)
+		if want {
+			wantInitial = tcp.DefaultReceiveBufferSize
+		}
+		if got := forwardedEndpoint(t, ns, echoPort).SocketOptions().GetReceiveBufferSize(); got != wantInitial {
+			t.Errorf("forwarded receive buffer = %d; want %d", got, wantInitial)
+		}
+	}
+
+	checkModerate(false)
+	if err := ns.SetTCPModerateReceiveBuffer(true); err != nil {
+		t.Fatal(err)
+	}
+	checkModerate(true)
+	if err := ns.SetTCPModerateReceiveBuffer(false); err != nil {
+		t.Fatal(err)
+	}
+	checkModerate(false)
+}
+
+func TestStats(t *testing.T) {
+	echoPort := startEchoServer(t)
+	dialing := make(chan bool)
+	proceed := make(chan bool)
+	ns, client := makeForwardingNetstack(t, func(ns *Impl) {
+		// Hold the forwarder request in flight until the test has
+		// looked at it.
+		ns.egressProxy = func(netip.AddrPort) (*url.URL, error) {
+			dialing <- true
+			<-proceed
+			return nil, nil
+		}
+	})
+	if st := ns.Stats(); st.TCPForwardInFlight != 0 || st.TCPForwardActive != 0 {
+		t.Fatalf("Stats() = %+v; want no forwarded connections", st)
+	}
+
+	type dialResult struct {
+		c   net.Conn
+		err error
+	}
+	dialed := make(chan dialResult, 1)
+	go func() {
+		c, err := dialThroughNetstack(t, client, echoPort)
+		dialed <- dialResult{c, err}
+	}()
+	<-dialing
+	if st := ns.Stats(); st.TCPForwardInFlight != 1 || st.TCPForwardActive != 0 {
+		t.Errorf("while dialing backend: Stats() = %+v; want 1 in flight, 0 active", st)
+	}
+	close(proceed)
+
+	res := <-dialed
+	if res.err != nil {
+		t.Fatalf("dial: %v", res.err)
+	}
+	checkEcho(t, res.c)
+	if st := ns.Stats(); st.TCPForwardInFlight != 0 || st.TCPForwardActive != 1 {
+		t.Errorf("while connected: Stats() = %+v; want 0 in flight, 1 active", st)
+	}
+
+	res.c.Close()
+	for deadline := time.Now().Add(5 * time.Second); ns.Stats().TCPForwardActive != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("after close: Stats() = %+v; want 0 active", ns.Stats())
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	ns := makeNetstack(t, nil)
+
+	// A flow that finishes on its own is waited for.
+	untrack := ns.trackFlow(func() { t.Error("finished flow was closed") })
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		untrack()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if n := ns.Drain(ctx); n != 0 {
+		t.Errorf("Drain = %d; want 0", n)
+	}
+
+	// A flow still running when the context expires is closed.
+	closed := make(chan bool, 1)
+	defer ns.trackFlow(func() { closed <- true })()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if n := ns.Drain(ctx); n != 1 {
+		t.Errorf("Drain = %d; want 1", n)
+	}
+	select {
+	case <-closed:
+	default:
+		t.Error("flow not closed")
+	}
+	if !ns.draining.Load() {
+		t.Error("not draining after Drain")
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	ns := makeNetstack(t, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := ns.WaitReady(ctx); err == nil {
+		t.Fatal("WaitReady succeeded before first netmap")
+	}
+
+	// A netmap without self addresses doesn't make the stack ready.
+	ns.updateIPs(&netmap.NetworkMap{SelfNode: &tailcfg.Node{}})
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := ns.WaitReady(ctx); err == nil {
+		t.Fatal("WaitReady succeeded without self addresses")
+	}
+
+	ns.updateIPs(&netmap.NetworkMap{
+		SelfNode: &tailcfg.Node{
+			Addresses: []netip.Prefix{netip.MustParsePrefix("100.101.102.103/32")},
+		},
+	})
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ns.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady: %v", err)
+	}
+}
+
+func TestForwardTCPEgressProxy(t *testing.T) {
+	echoPort := startEchoServer(t)
+
+	socksLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { socksLn.Close() })
+	var proxiedDials atomic.Int32
+	socksSrv := &socks5.Server{
+		Logf: t.Logf,
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			proxiedDials.Add(1)
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	go socksSrv.Serve(socksLn)
+
+	closedLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closedLn.Addr().String()
+	closedLn.Close()
+
+	tests := []struct {
+		name      string
+		proxy     func(netip.AddrPort) (*url.URL, error)
+		wantErr   bool
+		wantDials int32
+	}{
+		{
+			name: "via-proxy",
+			proxy: func(netip.AddrPort) (*url.URL, error) {
+				return &url.URL{Scheme: "socks5", Host: socksLn.Addr().String()}, nil
+			},
+			wantDials: 1,
+		},
+		{
+			name:  "direct",
+			proxy: func(netip.AddrPort) (*url.URL, error) { return nil, nil },
+		},
+		{
+			name: "proxy-func-error",
+			proxy: func(netip.AddrPort) (*url.URL, error) {
+				return nil, errors.New("no proxy for you")
+			},
+			wantErr: true,
+		},
+		{
+			name: "proxy-dial-error",
+			proxy: func(netip.AddrPort) (*url.URL, error) {
+				return &url.URL{Scheme: "socks5", Host: closedAddr}, nil
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxiedDials.Store(0)
+			_, client := makeForwardingNetstack(t, func(ns *Impl) {
+				ns.egressProxy = tt.proxy
+			})
+			c, err := dialThroughNetstack(t, client, echoPort)
+			if tt.wantErr {
+				if err == nil {
+					c.Close()
+					t.Fatal("dial succeeded; want connection reset")
+				}
+				if !strings.Contains(err.Error(), "refused") {
+					t.Errorf("dial error = %v; want connection refused (RST)", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer c.Close()
+			checkEcho(t, c)
+			if got := proxiedDials.Load(); got != tt.wantDials {
+				t.Errorf("proxied dials = %d; want %d", got, tt.wantDials)
+			}
+		})
+	}
+}
+
+// forwardedEndpoint returns the netstack side of the forwarded TCP
+// connection to port, waiting for it to be established.
+func forwardedEndpoint(t *testing.T, ns *Impl, port uint16) *tcp.Endpoint {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, te := range ns.ipstack.RegisteredEndpoints() {
+			ep, ok := te.(*tcp.Endpoint)
+			if ok && ep.TransportEndpointInfo.ID.LocalPort == port && ep.EndpointState() == tcp.StateEstablished {
+				return ep
+			}
+		}
+	}
+	t.Fatalf("no established forwarded endpoint for port %d", port)
+	return nil
+}
+
+func TestForwardedTCPReceiveBufferSize(t *testing.T) {
+	echoPort := startEchoServer(t)
+	ns, client := makeForwardingNetstack(t, nil)
+
+	check := func(want int64) {
+		t.Helper()
+		c, err := dialThroughNetstack(t, client, echoPort)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer c.Close()
+		checkEcho(t, c)
+		if got := forwardedEndpoint(t, ns, echoPort).SocketOptions().GetReceiveBufferSize(); got != want {
+			t.Errorf("forwarded receive buffer = %d; want %d", got, want)
+		}
+	}
+	check(recvBufSize)
+
+	const recv = 256 << 10
+	if err := ns.SetTCPBufferSizes(recv, 0); err != nil {
+		t.Fatal(err)
+	}
+	check(recv)
+}
+
+func TestDrainDuringDial(t *testing.T) {
+	echoPort := startEchoServer(t)
+	dialing := make(chan bool)
+	proceed := make(chan bool)
+	ns, client := makeForwardingNetstack(t, func(ns *Impl) {
+		ns.egressProxy = func(netip.AddrPort) (*url.URL, error) {
+			dialing <- true
+			<-proceed
+			return nil, nil
+		}
+	})
+
+	dialErr := make(chan error, 1)
+	go func() {
+		c, err := dialThroughNetstack(t, client, echoPort)
+		if err == nil {
+			c.Close()
+		}
+		dialErr <- err
+	}()
+	<-dialing
+
+	// The flow is still dialing its backend, but Drain must see it.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if n := ns.Drain(ctx); n != 1 {
+		t.Errorf("Drain = %d; want 1", n)
+	}
+	close(proceed)
+	if err := <-dialErr; err == nil {
+		t.Error("dial succeeded after its flow was closed by Drain")
+	}
+}
+
+func TestHTTPIntercept(t *testing.T) {
+	client := netip.MustParseAddrPort("100.64.1.2:1234")
+	dst := netip.MustParseAddrPort("10.0.0.1:80")
+	ns := &Impl{
+		logf: t.Logf,
+		httpIntercept: &HTTPIntercept{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ := HTTPInterceptDst(r.Context())
+				fmt.Fprintf(w, "%v %v %v", r.Host, r.RemoteAddr, got)
+			}),
+		},
+	}
+	c1, c2 := net.Pipe()
+	served := make(chan bool)
+	go func() {
+		ns.serveHTTPIntercept(c2, client, dst)
+		close(served)
+	}()
+	io.WriteString(c1, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(c1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if want := fmt.Sprintf("example.com %v %v", client, dst); string(body) != want {
+		t.Errorf("response = %q; want %q", body, want)
+	}
+	c1.Close()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveHTTPIntercept didn't return after the connection closed")
+	}
+
+	// The SNI server name is read from a TLS flow's ClientHello.
+	c1, c2 = net.Pipe()
+	defer c1.Close()
+	go tls.Client(c1, &tls.Config{ServerName: "example.com"}).Handshake()
+	serverName, hello, err := peekClientHello(c2)
+	c2.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverName != "example.com" {
+		t.Errorf("serverName = %q; want example.com", serverName)
+	}
+	if len(hello) == 0 || hello[0] != 0x16 { // handshake record
+		t.Errorf("ClientHello read = %x; want a TLS handshake record", hello)
+	}
+}
+
+// BenchmarkLinkOffload measures the throughput of a bulk TCP stream
+// between two gVisor stacks whose links are wired together in batches,
+// with and without GSO and GRO on their link endpoints.
+func BenchmarkLinkOffload(b *testing.B) {
+	for _, tt := range []struct {
+		name string
+		opts EndpointOptions
+	}{
+		{"none", EndpointOptions{}},
+		{"GSO", EndpointOptions{GSO: true}},
+		{"GRO", EndpointOptions{GRO: true}},
+		{"GSO+GRO", EndpointOptions{GSO: true, GRO: true}},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			sender, senderEP := newBenchStack(b, testClientIP, tt.opts)
+			receiver, receiverEP := newBenchStack(b, testNetstackIP, tt.opts)
+			go pumpPacketBatches(ctx, senderEP, receiverEP)
+			go pumpPacketBatches(ctx, receiverEP, senderEP)
+
+			ln, err := gonet.ListenTCP(receiver, tcpip.FullAddress{
+				NIC:  nicID,
+				Addr: tcpip.AddrFromSlice(testNetstackIP.AsSlice()),
+				Port: 1,
+			}, ipv4.ProtocolNumber)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer ln.Close()
+			received := make(chan int64, 1)
+			go func() {
+				c, err := ln.Accept()
+				if err != nil {
+					received <- 0
+					return
+				}
+				defer c.Close()
+				n, _ := io.Copy(io.Discard, c)
+				received <- n
+			}()
+			c, err := gonet.DialContextTCP(ctx, sender, tcpip.FullAddress{
+				NIC:  nicID,
+				Addr: tcpip.AddrFromSlice(testNetstackIP.AsSlice()),
+				Port: 1,
+			}, ipv4.ProtocolNumber)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			buf := make([]byte, 64<<10)
+			b.SetBytes(int64(len(buf)))
+			b.ResetTimer()
+			for range b.N {
+				if _, err := c.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			c.Close()
+			if n := <-received; n != int64(b.N*len(buf)) {
+				b.Fatalf("received %d bytes; want %d", n, b.N*len(buf))
+			}
+		})
+	}
+}
+
+// newBenchStack returns a gVisor stack with a single NIC, with address
+// ip, whose link endpoint has the given offloads.
+func newBenchStack(tb testing.TB, ip netip.Addr, opts EndpointOptions) (*stack.Stack, *Endpoint) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+	})
+	ep := NewEndpoint(512, 1280, "", opts)
+	tb.Cleanup(func() {
+		ep.Close()
+		s.Close()
+		s.Wait()
+	})
+	if err := s.CreateNIC(nicID, ep); err != nil {
+		tb.Fatal(err)
+	}
+	if err := s.AddProtocolAddress(nicID, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFromSlice(ip.AsSlice()).WithPrefix(),
+	}, stack.AddressProperties{}); err != nil {
+		tb.Fatal(err)
+	}
+	anyV4, _ := tcpip.NewSubnet(tcpip.AddrFromSlice(make([]byte, 4)), tcpip.MaskFromBytes(make([]byte, 4)))
+	s.SetRouteTable([]tcpip.Route{{Destination: anyV4, NIC: nicID}})
+	return s, ep
+}
+
+// pumpPacketBatches is pumpPackets, injecting packets in batches of up to
+// 64 as tstun does, so they can be coalesced if to has GRO enabled.
+func pumpPacketBatches(ctx context.Context, from, to *Endpoint) {
+	pkts := make([]*stack.PacketBuffer, 64)
+	for {
+		n := from.ReadBatchContext(ctx, pkts)
+		if n == 0 {
+			return
+		}
+		var g *gro.GRO
+		for _, pkt := range pkts[:n] {
+			v := stack.PayloadSince(pkt.NetworkHeader())
+			np := stack.NewPacketBuffer(stack.PacketBufferOptions{
+				Payload: buffer.MakeWithData(bytes.Clone(v.AsSlice())),
+			})
+			v.Release()
+			pkt.DecRef()
+			g = to.InjectInboundGRO(g, header.IPv4ProtocolNumber, np)
+			np.DecRef()
+		}
+		to.FlushGRO(g)
+	}
+}
+
+func TestDialRoutes(t *testing.T) {
+	ns := makeNetstack(t, nil)
+	if err := ns.SetDialRoutes([]DialRoute{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), UserDial: true},
+		{Prefix: netip.MustParsePrefix("10.1.0.0/16")},
+		{Prefix: netip.MustParsePrefix("fd7a::/16"), UserDial: true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"10.2.3.4", true},
+		{"10.1.2.3", false}, // longer prefix wins
+		{"192.168.1.1", false},
+		{"fd7a::1", true},
+	} {
+		if got := ns.dialRoutes.Load().userDial(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("userDial(%s) = %v; want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	if err := ns.SetDialRoutes([]DialRoute{{}}); err == nil {
+		t.Error("SetDialRoutes with an invalid prefix succeeded")
+	}
+	if err := ns.SetDialRoutes(nil); err != nil {
+		t.Fatal(err)
+	}
+	if ns.dialRoutes.Load().userDial(netip.MustParseAddr("10.2.3.4")) {
+		t.Error("userDial after clearing dial routes = true; want false")
+	}
+}
+
+// fakeRawConn is a net.PacketConn for rawForwarder tests. Writes are sent
+// to writes, and reads are served from reads.
+type fakeRawConn struct {
+	net.PacketConn // nil; only the methods below are used
+	writes         chan rawDatagram
+	reads          chan rawDatagram
+	closed         chan struct{}
+}
+
+type rawDatagram struct {
+	addr    netip.Addr
+	payload []byte
+}
+
+func (c *fakeRawConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ip, _ := netip.AddrFromSlice(addr.(*net.IPAddr).IP)
+	c.writes <- rawDatagram{ip, bytes.Clone(b)}
+	return len(b), nil
+}
+
+func (c *fakeRawConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-c.reads:
+		return copy(b, d.payload), &net.IPAddr{IP: d.addr.AsSlice()}, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *fakeRawConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestRawForward(t *testing.T) {
+	ns := makeNetstack(t, func(impl *Impl) {
+		impl.ProcessSubnets = true
+	})
+	ns.atomicIsLocalIPFunc.Store(tsaddr.NewContainsIPFunc(nil))
+	conn := &fakeRawConn{
+		writes: make(chan rawDatagram, 1),
+		reads:  make(chan rawDatagram, 2),
+		closed: make(chan struct{}),
+	}
+	var network string
+	injected := make(chan []byte, 2)
+	ns.rawForward = newRawForwarder(t.Logf, []ipproto.Proto{ipproto.GRE}, func(pkt []byte) error {
+		injected <- pkt
+		return nil
+	})
+	ns.rawForward.listen = func(nw, _ string) (net.PacketConn, error) {
+		network = nw
+		return conn, nil
+	}
+
+	peer := netip.MustParseAddr("100.101.102.103")
+	remote := netip.MustParseAddr("10.0.0.5")
+	payload := []byte("\x00\x00\x08\x00gre payload")
+	p := new(packet.Parsed)
+	p.Decode(packet.Generate(&packet.IP4Header{IPProto: ipproto.GRE, Src: peer, Dst: remote}, payload))
+	if res := ns.injectInbound(p, ns.tundev); res != filter.DropSilently {
+		t.Fatalf("injectInbound = %v; want DropSilently", res)
+	}
+	select {
+	case d := <-conn.writes:
+		if d.addr != remote || !bytes.Equal(d.payload, payload) {
+			t.Errorf("forwarded %q to %v; want %q to %v", d.payload, d.addr, payload, remote)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("GRE packet not forwarded")
+	}
+	if network != "ip4:47" {
+		t.Errorf("raw socket network = %q; want ip4:47", network)
+	}
+
+	// Replies are only sent back for remotes a peer has sent to.
+	conn.reads <- rawDatagram{netip.MustParseAddr("10.0.0.6"), []byte("stray")}
+	conn.reads <- rawDatagram{remote, []byte("reply")}
+	select {
+	case pkt := <-injected:
+		q := new(packet.Parsed)
+		q.Decode(pkt)
+		if q.IPProto != ipproto.GRE || q.Src.Addr() != remote || q.Dst.Addr() != peer || string(q.Transport()) != "reply" {
+			t.Errorf("injected %v %v->%v %q; want GRE %v->%v %q", q.IPProto, q.Src.Addr(), q.Dst.Addr(), q.Transport(), remote, peer, "reply")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply not injected")
+	}
+
+	// Other protocols go to gVisor as before.
+	if ns.rawForward.handles(ipproto.SCTP) {
+		t.Error("SCTP is raw forwarded; want only GRE")
+	}
+}
+
+// testFlowLogger is a FlowLogger sending its events on channels.
+type testFlowLogger struct {
+	events    chan FlowEvent
+	summaries chan FlowSummary
+}
+
+func (l *testFlowLogger) LogFlow(ev FlowEvent)       { l.events <- ev }
+func (l *testFlowLogger) LogFlowClose(s FlowSummary) { l.summaries <- s }
+
+func TestFlowLogger(t *testing.T) {
+	fl := &testFlowLogger{
+		events:    make(chan FlowEvent, 10),
+		summaries: make(chan FlowSummary, 10),
+	}
+	const rejectedPort = 1
+	_, client := makeForwardingNetstack(t, func(ns *Impl) {
+		ns.FlowLogger = fl
+		ns.GetTCPHandlerForFlow = func(src, dst netip.AddrPort) (func(net.Conn), []tcpip.SettableSocketOption, bool) {
+			return nil, nil, dst.Port() == rejectedPort
+		}
+	})
+
+	next := func() FlowEvent {
+		t.Helper()
+		select {
+		case ev := <-fl.events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for flow event")
+		}
+		panic("unreachable")
+	}
+
+	port := startEchoServer(t)
+	c, err := dialThroughNetstack(t, client, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, c)
+	ev := next()
+	if ev.Proto != ipproto.TCP || ev.Outcome != FlowForwarded || ev.Src.Addr() != testClientIP || ev.Dst != netip.AddrPortFrom(testNetstackIP, port) {
+		t.Errorf("forwarded flow event = %+v", ev)
+	}
+	c.Close()
+	select {
+	case s := <-fl.summaries:
+		if s.Outcome != FlowForwarded || s.RxBytes != 5 || s.TxBytes != 5 || s.Duration <= 0 {
+			t.Errorf("forwarded flow summary = %+v", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for flow summary")
+	}
+
+	if c, err := dialThroughNetstack(t, client, rejectedPort); err == nil {
+		c.Close()
+		t.Error("dial to rejected port succeeded")
+	}
+	if ev := next(); ev.Outcome != FlowRejected || ev.Reason != "intercepted" || ev.Dst.Port() != rejectedPort {
+		t.Errorf("rejected flow event = %+v", ev)
+	}
+}
+
+func TestListen(t *testing.T) {
+	ns, client := makeForwardingNetstack(t, nil)
+
+	for _, addr := range []string{":0", ":1-2000", ":2-1", "100.64.9.9:80", "[fd7a:115c:a1e0::1]:80"} {
+		if ln, err := ns.Listen("tcp", addr); err == nil {
+			ln.Close()
+			t.Errorf("Listen(%q) succeeded", addr)
+		}
+	}
+	if _, err := ns.ListenPacket("udp", ":53-54"); err == nil {
+		t.Error("ListenPacket with port range succeeded")
+	}
+
+	// A listener on a port range accepts connections to any of its
+	// ports, ahead of the TCP forwarder.
+	ln, err := ns.Listen("tcp", ":8000-8002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ln.Addr().String(), netip.AddrPortFrom(testNetstackIP, 8000).String(); got != want {
+		t.Errorf("Addr = %v; want %v", got, want)
+	}
+	if !ns.isListening(ipproto.TCP, netip.AddrPortFrom(testNetstackIP, 8002)) {
+		t.Error("not listening on the end of the range")
+	}
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+	c, err := dialThroughNetstack(t, client, 8001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, c)
+	c.Close()
+	ln.Close()
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close = %v; want %v", err, net.ErrClosed)
+	}
+	if ns.isListening(ipproto.TCP, netip.AddrPortFrom(testNetstackIP, 8001)) {
+		t.Error("still listening after Close")
+	}
+
+	pc, err := ns.ListenPacket("udp4", ":5353")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	uc, err := gonet.DialUDP(client, nil, &tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.AddrFromSlice(testNetstackIP.AsSlice()),
+		Port: 5353,
+	}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	if _, err := uc.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 10)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" || from.(*net.UDPAddr).AddrPort().Addr() != testClientIP {
+		t.Errorf("ReadFrom = %q from %v; want ping from %v", buf[:n], from, testClientIP)
+	}
+	if _, err := pc.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+	uc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := uc.Read(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Errorf("reply = %q, %v; want pong", buf[:n], err)
+	}
+	pc.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := pc.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("ReadFrom past deadline = %v; want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestInjectRaw(t *testing.T) {
+	ns, _ := makeForwardingNetstack(t, func(ns *Impl) {
+		ns.ProcessLocalIPs = true
+	})
+	ns.atomicIsLocalIPFunc.Store(func(ip netip.Addr) bool { return ip == testNetstackIP })
+	pc, err := ns.ListenPacket("udp4", ":5353")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	udpTo := func(dst netip.Addr) []byte {
+		return packet.Generate(packet.UDP4Header{
+			IP4Header: packet.IP4Header{IPProto: ipproto.UDP, Src: testClientIP, Dst: dst},
+			SrcPort:   1234,
+			DstPort:   5353,
+		}, []byte("hi"))
+	}
+	pkt := udpTo(testNetstackIP)
+	for _, bad := range [][]byte{nil, []byte("garbage"), pkt[:len(pkt)-1]} {
+		if err := ns.InjectInbound(bad); err == nil || errors.Is(err, ErrNotHandled) {
+			t.Errorf("InjectInbound(%x) = %v; want invalid packet error", bad, err)
+		}
+	}
+	if err := ns.InjectInbound(udpTo(netip.MustParseAddr("10.0.0.1"))); !errors.Is(err, ErrNotHandled) {
+		t.Errorf("InjectInbound to non-local IP = %v; want %v", err, ErrNotHandled)
+	}
+	if err := ns.InjectOutbound(pkt); !errors.Is(err, ErrNotHandled) {
+		t.Errorf("InjectOutbound to non-service IP = %v; want %v", err, ErrNotHandled)
+	}
+
+	if err := ns.InjectInbound(pkt); err != nil {
+		t.Fatalf("InjectInbound: %v", err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 10)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hi" || from.String() != "100.64.0.2:1234" {
+		t.Errorf("ReadFrom = %q from %v; want hi from 100.64.0.2:1234", buf[:n], from)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netstack
+
+import (
+	"errors"
+	"net"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/wgengine/filter"
+)
+
+// ErrNotHandled is returned by InjectInbound and InjectOutbound for a
+// packet that netstack doesn't handle, which tstun would pass on to the
+// host or to WireGuard.
+var ErrNotHandled = errors.New("netstack: packet not handled by netstack")
+
+// InjectInbound feeds pkt, a raw IPv4 or IPv6 packet, through netstack as
+// if it had arrived from a WireGuard peer, for tests and tooling such as
+// traffic replay that don't have tstun plumbing. The stack's replies go
+// out through the tun device as usual. pkt isn't retained.
+//
+// It returns an error if pkt isn't a whole IP packet, and ErrNotHandled if
+// netstack wouldn't process it, per ProcessLocalIPs, ProcessSubnets and
+// the other interceptions.
+func (ns *Impl) InjectInbound(pkt []byte) error {
+	p, err := ns.parseInjected(pkt)
+	if err != nil {
+		return err
+	}
+	if ns.injectInbound(p, ns.tundev) == filter.Accept {
+		return ErrNotHandled
+	}
+	return nil
+}
+
+// InjectOutbound is like InjectInbound, but for a packet leaving the
+// local host, such as a MagicDNS query to the service IP.
+func (ns *Impl) InjectOutbound(pkt []byte) error {
+	p, err := ns.parseInjected(pkt)
+	if err != nil {
+		return err
+	}
+	if ns.handleLocalPackets(p, ns.tundev) == filter.Accept {
+		return ErrNotHandled
+	}
+	return nil
+}
+
+// parseInjected validates and parses a packet for InjectInbound or
+// InjectOutbound.
+func (ns *Impl) parseInjected(pkt []byte) (*packet.Parsed, error) {
+	if ns.ctx.Err() != nil {
+		return nil, net.ErrClosed
+	}
+	p := new(packet.Parsed)
+	p.Decode(pkt)
+	if p.IPVersion == 0 {
+		return nil, errors.New("netstack: not an IP packet")
+	}
+	if p.IPProto == ipproto.Unknown {
+		return nil, errors.New("netstack: malformed or truncated IP packet")
+	}
+	return p, nil
+}
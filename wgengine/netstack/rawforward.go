@@ -0,0 +1,212 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netstack
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/mak"
+	"tailscale.com/util/set"
+)
+
+const (
+	// rawFlowTimeout is how long a raw-forwarded flow lasts without
+	// packets from its peer. Replies for expired flows are dropped.
+	rawFlowTimeout = 2 * time.Minute
+
+	// maxRawFlows is the number of raw-forwarded flows above which
+	// expired flows are pruned as new ones are added.
+	maxRawFlows = 1024
+)
+
+// rawForwarder forwards the IP payloads of subnet-routed packets of the
+// protocols in Config.RawForwardProtocols, which gVisor can't handle,
+// over raw IP sockets on the host. Replies are sent back to the peer
+// that last sent to the remote host with the same protocol.
+type rawForwarder struct {
+	logf   logger.Logf
+	protos set.Set[ipproto.Proto]
+	listen func(network, addr string) (net.PacketConn, error) // net.ListenPacket, except in tests
+	inject func(pkt []byte) error                             // sends a reply packet to its peer
+
+	mu     sync.Mutex
+	closed bool
+	conns  map[rawConnKey]net.PacketConn // nil value if listening failed
+	flows  map[rawFlowKey]rawFlow
+}
+
+// rawConnKey identifies the raw socket for a protocol and address family.
+type rawConnKey struct {
+	proto ipproto.Proto
+	is6   bool
+}
+
+// rawFlowKey identifies a raw-forwarded flow, for replies.
+type rawFlowKey struct {
+	proto  ipproto.Proto
+	remote netip.Addr
+}
+
+type rawFlow struct {
+	peer       netip.Addr
+	lastActive time.Time
+}
+
+func newRawForwarder(logf logger.Logf, protos []ipproto.Proto, inject func([]byte) error) *rawForwarder {
+	f := &rawForwarder{
+		logf:   logf,
+		protos: make(set.Set[ipproto.Proto]),
+		listen: net.ListenPacket,
+		inject: inject,
+	}
+	for _, p := range protos {
+		f.protos.Add(p)
+	}
+	return f
+}
+
+// handles reports whether f forwards packets of proto.
+func (f *rawForwarder) handles(proto ipproto.Proto) bool {
+	return f != nil && f.protos.Contains(proto)
+}
+
+// forward sends the payload of p, from a peer, to its destination over a
+// raw socket.
+func (f *rawForwarder) forward(p *packet.Parsed) {
+	src, dst := p.Src.Addr(), p.Dst.Addr()
+	key := rawConnKey{p.IPProto, dst.Is6()}
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	c, ok := f.conns[key]
+	if !ok {
+		c = f.listenLocked(key)
+	}
+	if c != nil {
+		f.noteFlowLocked(rawFlowKey{p.IPProto, dst}, src)
+	}
+	f.mu.Unlock()
+	if c == nil {
+		metricRawForwardDropped.Add(1)
+		return
+	}
+	if _, err := c.WriteTo(p.Transport(), &net.IPAddr{IP: dst.AsSlice()}); err != nil {
+		metricRawForwardDropped.Add(1)
+		f.logf("[v2] netstack: raw forward of %v to %v: %v", p.IPProto, dst, err)
+		return
+	}
+	metricRawForwardSent.Add(1)
+}
+
+// listenLocked opens the raw socket for key and starts reading replies
+// from it. If it fails, forwarding key is disabled. f.mu must be held.
+func (f *rawForwarder) listenLocked(key rawConnKey) net.PacketConn {
+	network, addr := fmt.Sprintf("ip4:%d", key.proto), "0.0.0.0"
+	if key.is6 {
+		network, addr = fmt.Sprintf("ip6:%d", key.proto), "::"
+	}
+	c, err := f.listen(network, addr)
+	if err != nil {
+		f.logf("netstack: can't raw forward %v; disabling: %v", key.proto, err)
+		c = nil
+	}
+	mak.Set(&f.conns, key, c)
+	if c != nil {
+		go f.readReplies(c, key)
+	}
+	return c
+}
+
+// noteFlowLocked records that peer sent to remote. f.mu must be held.
+func (f *rawForwarder) noteFlowLocked(k rawFlowKey, peer netip.Addr) {
+	now := time.Now()
+	if _, ok := f.flows[k]; !ok && len(f.flows) >= maxRawFlows {
+		for k, fl := range f.flows {
+			if now.Sub(fl.lastActive) > rawFlowTimeout {
+				delete(f.flows, k)
+			}
+		}
+	}
+	mak.Set(&f.flows, k, rawFlow{peer: peer, lastActive: now})
+}
+
+// readReplies reads packets from c, a raw socket for key, and injects
+// those from remote hosts with a live flow back to the flow's peer.
+func (f *rawForwarder) readReplies(c net.PacketConn, key rawConnKey) {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			f.mu.Lock()
+			closed := f.closed
+			f.mu.Unlock()
+			if !closed {
+				f.logf("netstack: raw forward reader for %v: %v", key.proto, err)
+			}
+			return
+		}
+		ipAddr, ok := addr.(*net.IPAddr)
+		if !ok {
+			continue
+		}
+		remote, ok := netip.AddrFromSlice(ipAddr.IP)
+		if !ok {
+			continue
+		}
+		remote = remote.Unmap()
+		fk := rawFlowKey{key.proto, remote}
+		f.mu.Lock()
+		fl, ok := f.flows[fk]
+		if ok && time.Since(fl.lastActive) > rawFlowTimeout {
+			delete(f.flows, fk)
+			ok = false
+		}
+		f.mu.Unlock()
+		if !ok {
+			continue
+		}
+		var h packet.Header
+		if remote.Is6() {
+			h = &packet.IP6Header{IPProto: key.proto, Src: remote, Dst: fl.peer}
+		} else {
+			h = &packet.IP4Header{IPProto: key.proto, Src: remote, Dst: fl.peer}
+		}
+		if err := f.inject(packet.Generate(h, buf[:n])); err != nil {
+			f.logf("[v2] netstack: raw forward reply from %v: %v", remote, err)
+			continue
+		}
+		metricRawForwardReplies.Add(1)
+	}
+}
+
+// Close closes f's raw sockets.
+func (f *rawForwarder) Close() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for _, c := range f.conns {
+		if c != nil {
+			c.Close()
+		}
+	}
+}
+
+var (
+	metricRawForwardSent    = clientmetric.NewCounter("netstack_raw_forward_sent")
+	metricRawForwardReplies = clientmetric.NewCounter("netstack_raw_forward_replies")
+	metricRawForwardDropped = clientmetric.NewCounter("netstack_raw_forward_dropped")
+)
@@ -28,6 +28,7 @@
 	"tailscale.com/net/flowtrack"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netmon"
+	"tailscale.com/net/netns"
 	"tailscale.com/net/packet"
 	"tailscale.com/net/sockstats"
 	"tailscale.com/net/tsaddr"
@@ -306,6 +307,7 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 
 	unregisterMonWatch := e.netMon.RegisterChangeCallback(func(changed bool, st *interfaces.State) {
 		tshttpproxy.InvalidateCache()
+		netns.ClearRouteCache()
 		e.linkChange(changed, st)
 	})
 	closePool.addFunc(unregisterMonWatch)
@@ -319,13 +321,14 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		e.RequestStatus()
 	}
 	magicsockOpts := magicsock.Options{
-		Logf:             logf,
-		Port:             conf.ListenPort,
-		EndpointsFunc:    endpointsFn,
-		DERPActiveFunc:   e.RequestStatus,
-		IdleFunc:         e.tundev.IdleDuration,
-		NoteRecvActivity: e.noteRecvActivity,
-		NetMon:           e.netMon,
+		Logf:              logf,
+		Port:              conf.ListenPort,
+		EndpointsFunc:     endpointsFn,
+		DERPActiveFunc:    e.RequestStatus,
+		IdleFunc:          e.tundev.IdleDuration,
+		NoteRecvActivity:  e.noteRecvActivity,
+		PathKeepaliveFunc: e.notePathKeepalive,
+		NetMon:            e.netMon,
 	}
 
 	var err error
@@ -355,6 +358,7 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 	}
 
 	e.wgLogger = wglog.NewLogger(logf)
+	e.wgLogger.SetHandshakeFailedFunc(e.magicConn.NoteHandshakeFailed)
 	e.tundev.OnTSMPPongReceived = func(pong packet.TSMPPongReply) {
 		e.mu.Lock()
 		defer e.mu.Unlock()
@@ -576,6 +580,47 @@ func (e *userspaceEngine) noteRecvActivity(nk key.NodePublic) {
 	}
 }
 
+// notePathKeepalive is called by magicsock when whether the path to the
+// peer with node key nk wants persistent keepalives changes, to turn
+// the peer's configured keepalive on or off to match.
+func (e *userspaceEngine) notePathKeepalive(nk key.NodePublic) {
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+
+	e.mu.Lock()
+	if e.closing {
+		e.mu.Unlock()
+		return
+	}
+	e.mu.Unlock()
+
+	if e.trimmedNodes[nk] {
+		return
+	}
+	for _, p := range e.lastCfgFull.Peers {
+		if p.PublicKey == nk {
+			if p.PersistentKeepalive != 0 {
+				e.maybeReconfigWireguardLocked(nil)
+			}
+			return
+		}
+	}
+}
+
+// withPathKeepalive returns p with its PersistentKeepalive turned off if
+// magicsock reports that the peer's current path doesn't want one: a
+// DERP path, whose relay connection is already kept up, or a direct
+// path that crosses no NAT. That saves the keepalives of a large idle
+// mesh.
+func (e *userspaceEngine) withPathKeepalive(p wgcfg.Peer) wgcfg.Peer {
+	if p.PersistentKeepalive != 0 {
+		if want, ok := e.magicConn.PathWantsKeepalive(p.PublicKey); ok && !want {
+			p.PersistentKeepalive = 0
+		}
+	}
+	return p
+}
+
 // isActiveSinceLocked reports whether the peer identified by (nk, ip)
 // has had a packet sent to or received from it since t.
 //
@@ -639,7 +684,7 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Node
 		p := &full.Peers[i]
 		nk := p.PublicKey
 		if !isTrimmablePeer(p, len(full.Peers)) {
-			min.Peers = append(min.Peers, *p)
+			min.Peers = append(min.Peers, e.withPathKeepalive(*p))
 			if discoChanged[nk] {
 				needRemoveStep = true
 			}
@@ -652,7 +697,7 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Node
 			recentlyActive = recentlyActive || e.isActiveSinceLocked(nk, cidr.Addr(), activeCutoff)
 		}
 		if recentlyActive {
-			min.Peers = append(min.Peers, *p)
+			min.Peers = append(min.Peers, e.withPathKeepalive(*p))
 			if discoChanged[nk] {
 				needRemoveStep = true
 			}
@@ -1159,15 +1204,17 @@ func (e *userspaceEngine) linkChange(changed bool, cur *interfaces.State) {
 		}
 	}
 
-	why := "link-change-minor"
+	// A minor change doesn't move us on the internet, so only our
+	// public addresses need checking, not every DERP region's latency.
+	why, scope := "link-change-minor", magicsock.RefreshHomeDERP
 	if changed {
-		why = "link-change-major"
+		why, scope = "link-change-major", magicsock.RefreshFull
 		metricNumMajorChanges.Add(1)
 		e.magicConn.Rebind()
 	} else {
 		metricNumMinorChanges.Add(1)
 	}
-	e.magicConn.ReSTUN(why)
+	e.magicConn.RefreshEndpoints(scope, why)
 }
 
 func (e *userspaceEngine) AddNetworkMapCallback(cb NetworkMapCallback) func() {
@@ -1581,3 +1628,36 @@ func (e *userspaceEngine) InstallCaptureHook(cb capture.Callback) {
 	e.tundev.InstallCaptureHook(cb)
 	e.magicConn.InstallCaptureHook(cb)
 }
+
+func (e *userspaceEngine) InstallFilteredCaptureHook(cb capture.Callback, f *capture.Filter) {
+	e.tundev.InstallFilteredCaptureHook(cb, e.ipCaptureFilter(f))
+	e.magicConn.InstallFilteredCaptureHook(cb, f)
+}
+
+// ipCaptureFilter returns f for tstun's capture of IP packets, which
+// don't know their peer: a copy with the Tailscale addresses of f's Peers
+// as its Addrs.
+func (e *userspaceEngine) ipCaptureFilter(f *capture.Filter) *capture.Filter {
+	if f == nil || len(f.Peers) == 0 {
+		return f
+	}
+	e.mu.Lock()
+	nm := e.netMap
+	e.mu.Unlock()
+
+	ipf := *f
+	ipf.Addrs = append([]netip.Prefix(nil), f.Addrs...)
+	if nm != nil {
+		for _, p := range nm.Peers {
+			if f.Peers.Contains(p.Key) {
+				ipf.Addrs = append(ipf.Addrs, p.Addresses...)
+			}
+		}
+	}
+	if len(ipf.Addrs) == 0 {
+		// None of the peers are known. The invalid prefix contains
+		// no addresses, so nothing matches, rather than everything.
+		ipf.Addrs = []netip.Prefix{{}}
+	}
+	return &ipf
+}
@@ -186,3 +186,7 @@ func (e *watchdogEngine) Wait() {
 func (e *watchdogEngine) InstallCaptureHook(cb capture.Callback) {
 	e.wrap.InstallCaptureHook(cb)
 }
+
+func (e *watchdogEngine) InstallFilteredCaptureHook(cb capture.Callback, f *capture.Filter) {
+	e.wrap.InstallFilteredCaptureHook(cb, f)
+}
@@ -91,12 +91,17 @@ func WGCfg(nm *netmap.NetworkMap, logf logger.Logf, flags netmap.WGConfigFlags,
 			logf("[v1] wgcfg: skipped peer %s, doesn't offer DERP or disco", peer.Key.ShortString())
 			continue
 		}
+		if peer.ProbeOnly {
+			// Peer is only measured by magicsock, never sent traffic.
+			logf("[v1] wgcfg: skipped probe-only peer %s", peer.Key.ShortString())
+			continue
+		}
 		cfg.Peers = append(cfg.Peers, wgcfg.Peer{
 			PublicKey: peer.Key,
 			DiscoKey:  peer.DiscoKey,
 		})
 		cpeer := &cfg.Peers[len(cfg.Peers)-1]
-		if peer.KeepAlive {
+		if peer.KeepAlive || flags&netmap.KeepAliveAllPeers != 0 {
 			cpeer.PersistentKeepalive = 25 // seconds
 		}
 
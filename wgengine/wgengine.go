@@ -173,4 +173,10 @@ type Engine interface {
 	// packets traversing the data path. The hook can be uninstalled by
 	// calling this function with a nil value.
 	InstallCaptureHook(capture.Callback)
+
+	// InstallFilteredCaptureHook is like InstallCaptureHook, but the
+	// hook is only called for the packets the filter matches. The
+	// filter's Peers are matched against IP packets by the peers'
+	// Tailscale addresses as of the call.
+	InstallFilteredCaptureHook(capture.Callback, *capture.Filter)
 }
@@ -23,6 +23,9 @@ type Logger struct {
 	replace      syncs.AtomicValue[map[string]string]
 	mu           sync.Mutex                   // protects strs
 	strs         map[key.NodePublic]*strCache // cached strs used to populate replace
+
+	peerKeys          syncs.AtomicValue[map[string]key.NodePublic] // wireguard-go peer strings to keys
+	onHandshakeFailed syncs.AtomicValue[func(key.NodePublic)]      // see SetHandshakeFailedFunc
 }
 
 // strCache holds a wireguard-go and a Tailscale style peer string.
@@ -52,6 +55,9 @@ func NewLogger(logf logger.Logf) *Logger {
 			// See https://github.com/tailscale/tailscale/issues/1388.
 			return
 		}
+		if strings.Contains(format, "Handshake did not complete after %d seconds") {
+			ret.noteHandshakeFailed(args)
+		}
 		replace := ret.replace.Load()
 		if replace == nil {
 			// No replacements specified; log as originally planned.
@@ -88,6 +94,29 @@ func NewLogger(logf logger.Logf) *Logger {
 	return ret
 }
 
+// SetHandshakeFailedFunc sets f to be called with the peer's key each time
+// wireguard-go retries a handshake that went unanswered, for
+// magicsock.Conn.NoteHandshakeFailed. It's safe for concurrent use.
+func (x *Logger) SetHandshakeFailedFunc(f func(key.NodePublic)) {
+	x.onHandshakeFailed.Store(f)
+}
+
+// noteHandshakeFailed calls the SetHandshakeFailedFunc func, if any, for
+// the peer of a wireguard-go handshake retry log line with args.
+func (x *Logger) noteHandshakeFailed(args []any) {
+	f := x.onHandshakeFailed.Load()
+	if f == nil || len(args) == 0 {
+		return
+	}
+	s, ok := args[0].(fmt.Stringer)
+	if !ok {
+		return
+	}
+	if k, ok := x.peerKeys.Load()[s.String()]; ok {
+		f(k)
+	}
+}
+
 // SetPeers adjusts x to rewrite the peer public keys found in peers.
 // SetPeers is safe for concurrent use.
 func (x *Logger) SetPeers(peers []wgcfg.Peer) {
@@ -95,6 +124,7 @@ func (x *Logger) SetPeers(peers []wgcfg.Peer) {
 	defer x.mu.Unlock()
 	// Construct a new peer public key log rewriter.
 	replace := make(map[string]string)
+	peerKeys := make(map[string]key.NodePublic)
 	for _, peer := range peers {
 		c, ok := x.strs[peer.PublicKey] // look up cached strs
 		if !ok {
@@ -105,6 +135,7 @@ func (x *Logger) SetPeers(peers []wgcfg.Peer) {
 		}
 		c.used = true
 		replace[c.wg] = c.ts
+		peerKeys[c.wg] = peer.PublicKey
 	}
 	// Remove any unused cached strs.
 	for k, c := range x.strs {
@@ -116,4 +147,5 @@ func (x *Logger) SetPeers(peers []wgcfg.Peer) {
 		c.used = false
 	}
 	x.replace.Store(replace)
+	x.peerKeys.Store(peerKeys)
 }
@@ -98,3 +98,19 @@ func genPeers(n int) []wgcfg.Peer {
 	}
 	return peers
 }
+
+func TestHandshakeFailedFunc(t *testing.T) {
+	x := wglog.NewLogger(logger.Discard)
+	k := key.NewNode().Public()
+	x.SetPeers([]wgcfg.Peer{{PublicKey: k}})
+	var got []key.NodePublic
+	x.SetHandshakeFailedFunc(func(nk key.NodePublic) { got = append(got, nk) })
+
+	peer := stringer(k.WireGuardGoString())
+	x.DeviceLogger.Verbosef("%s - Handshake did not complete after %d seconds, retrying (try %d)", peer, 5, 2)
+	x.DeviceLogger.Verbosef("%s - Sending handshake initiation", peer)
+	x.DeviceLogger.Verbosef("%s - Handshake did not complete after %d seconds, retrying (try %d)", stringer("peer(unknown)"), 5, 2)
+	if len(got) != 1 || got[0] != k {
+		t.Errorf("handshake failures for %v; want [%v]", got, k)
+	}
+}